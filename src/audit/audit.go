@@ -0,0 +1,96 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+// Package audit records the administrative operations performed through burnell.
+// Every event is logged, and sent to the registered sinks.
+package audit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// outcomes of an audited operation
+const (
+	Allowed   = "allowed"
+	Denied    = "denied"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// Event is an audit record, OnBehalfOf is the subject impersonated by the subject
+type Event struct {
+	Time       time.Time `json:"time"`
+	Subject    string    `json:"subject"`
+	OnBehalfOf string    `json:"onBehalfOf,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Action     string    `json:"action"`
+	Resource   string    `json:"resource,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+}
+
+// Sink is a destination of the audit events
+type Sink interface {
+	Name() string
+	Send(Event) error
+}
+
+var (
+	logger    = log.WithFields(log.Fields{"app": "audit"})
+	sinks     []Sink
+	sinksLock sync.RWMutex
+)
+
+// AddSink registers an audit event sink
+func AddSink(sink Sink) {
+	sinksLock.Lock()
+	sinks = append(sinks, sink)
+	sinksLock.Unlock()
+}
+
+// Record logs an audit event and sends it to the sinks
+func Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	logger.WithFields(log.Fields{
+		"subject":  e.Subject,
+		"onBehalf": e.OnBehalfOf,
+		"tenant":   e.Tenant,
+		"action":   e.Action,
+		"resource": e.Resource,
+		"outcome":  e.Outcome,
+		"reason":   e.Reason,
+		"remote":   e.RemoteAddr,
+	}).Info("audit")
+
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+	for _, sink := range sinks {
+		if err := sink.Send(e); err != nil {
+			logger.Errorf("audit sink %s error %v", sink.Name(), err)
+		}
+	}
+}
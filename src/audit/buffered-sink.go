@@ -0,0 +1,148 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultBufferSize = 10000
+	minRetryBackoff   = time.Second
+	maxRetryBackoff   = 30 * time.Second
+)
+
+// BufferedSink sends the events in the background in order. A failed event or batch is retried with backoff,
+// while the new events are buffered up to the buffer size; the oldest events are dropped over the size.
+type BufferedSink struct {
+	name      string
+	size      int
+	batchSize int
+	publish   func([]Event) error
+
+	lock   sync.Mutex
+	events []Event
+	// head is the sequence number of the first buffered event
+	head     uint64
+	dropped  int64
+	dropping bool
+	signal   chan struct{}
+}
+
+// NewBufferedSink creates a sink that publishes the events in a goroutine with the publish function
+func NewBufferedSink(name string, size int, publish func(Event) error) *BufferedSink {
+	return NewBatchSink(name, size, 1, func(events []Event) error {
+		return publish(events[0])
+	})
+}
+
+// NewBatchSink creates a sink that publishes up to the batch size of the buffered events at a time,
+// a failed batch is retried as a whole so the publish function must be idempotent
+func NewBatchSink(name string, size, batchSize int, publish func([]Event) error) *BufferedSink {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	s := &BufferedSink{
+		name:      name,
+		size:      size,
+		batchSize: batchSize,
+		publish:   publish,
+		signal:    make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+// Name is the sink name
+func (s *BufferedSink) Name() string {
+	return s.name
+}
+
+// Send buffers the event, it never blocks on the destination
+func (s *BufferedSink) Send(e Event) error {
+	s.lock.Lock()
+	s.events = append(s.events, e)
+	if over := len(s.events) - s.size; over > 0 {
+		if !s.dropping {
+			logger.Warnf("audit sink %s buffer is full, the oldest events are dropped", s.name)
+			s.dropping = true
+		}
+		s.events = s.events[over:]
+		s.head += uint64(over)
+		s.dropped += int64(over)
+	}
+	s.lock.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stats returns the number of the buffered events and the dropped events
+func (s *BufferedSink) Stats() (buffered int, dropped int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.events), s.dropped
+}
+
+func (s *BufferedSink) run() {
+	backoff := minRetryBackoff
+	for {
+		s.lock.Lock()
+		if len(s.events) == 0 {
+			s.lock.Unlock()
+			<-s.signal
+			continue
+		}
+		n := len(s.events)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		batch, seq := append([]Event{}, s.events[:n]...), s.head
+		s.lock.Unlock()
+
+		if err := s.publish(batch); err != nil {
+			logger.Errorf("audit sink %s failed to publish, retry in %v error %v", s.name, backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			continue
+		}
+		backoff = minRetryBackoff
+
+		s.lock.Lock()
+		// the events may have been dropped from the buffer while being published
+		if end := seq + uint64(n); end > s.head {
+			s.events = s.events[end-s.head:]
+			s.head = end
+		}
+		s.dropping = false
+		s.lock.Unlock()
+	}
+}
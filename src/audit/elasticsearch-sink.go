@@ -0,0 +1,235 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package audit
+
+// Elasticsearch and OpenSearch bulk indexing of the audit events
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIndexPrefix     = "burnell-audit"
+	defaultBulkSize        = 500
+	elasticsearchTimeout   = 30 * time.Second
+	elasticsearchMaxErrors = 3
+)
+
+// ElasticsearchOptions are the options of the Elasticsearch sink
+type ElasticsearchOptions struct {
+	// URLs of the cluster nodes, a failed request is retried with the next node
+	URLs     []string
+	Username string
+	Password string
+	// APIKey is the base64 encoded id:key, it takes precedence over the basic auth
+	APIKey string
+	// IndexPrefix of the daily indices <prefix>-yyyy.mm.dd, default to burnell-audit
+	IndexPrefix string
+	// Shards and Replicas of the index template, 0 leaves them to the cluster default
+	Shards   int
+	Replicas int
+	// BulkSize is the number of events per bulk request, default to 500
+	BulkSize   int
+	BufferSize int
+}
+
+// elasticsearchIndexer indexes the events with the bulk API, the index template is installed before the first bulk.
+// It is called by a single goroutine.
+type elasticsearchIndexer struct {
+	opts      ElasticsearchOptions
+	client    *http.Client
+	node      int
+	templated bool
+}
+
+// NewElasticsearchSink creates a buffered sink bulk indexing the events into Elasticsearch or OpenSearch
+func NewElasticsearchSink(opts ElasticsearchOptions) *BufferedSink {
+	if opts.IndexPrefix == "" {
+		opts.IndexPrefix = defaultIndexPrefix
+	}
+	if opts.BulkSize <= 0 {
+		opts.BulkSize = defaultBulkSize
+	}
+	x := &elasticsearchIndexer{opts: opts, client: &http.Client{Timeout: elasticsearchTimeout}}
+	return NewBatchSink("elasticsearch "+opts.IndexPrefix, opts.BufferSize, opts.BulkSize, x.index)
+}
+
+// IndexTemplate is the composable index template of the audit indices, supported by Elasticsearch 7.8 and later
+// and by OpenSearch. The strings are keywords for the exact match and the aggregations of the compliance searches.
+func IndexTemplate(opts ElasticsearchOptions) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if opts.Shards > 0 {
+		settings["number_of_shards"] = opts.Shards
+	}
+	if opts.Replicas > 0 {
+		settings["number_of_replicas"] = opts.Replicas
+	}
+	keyword := map[string]string{"type": "keyword"}
+	return map[string]interface{}{
+		"index_patterns": []string{opts.IndexPrefix + "-*"},
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": map[string]interface{}{
+				"dynamic": false,
+				"properties": map[string]interface{}{
+					"time":       map[string]string{"type": "date"},
+					"subject":    keyword,
+					"onBehalfOf": keyword,
+					"tenant":     keyword,
+					"action":     keyword,
+					"resource":   keyword,
+					"outcome":    keyword,
+					"reason":     map[string]string{"type": "text"},
+					"remoteAddr": keyword,
+				},
+			},
+		},
+	}
+}
+
+// BulkBody returns the ndjson body of a bulk request. The document id is derived from the event,
+// so a retried bulk overwrites the documents indexed by a partially failed bulk instead of duplicating them.
+func BulkBody(indexPrefix string, events []Event) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, e := range events {
+		doc, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(doc)
+		action := map[string]map[string]string{"index": {
+			"_index": indexPrefix + "-" + e.Time.UTC().Format("2006.01.02"),
+			"_id":    hex.EncodeToString(sum[:16]),
+		}}
+		meta, _ := json.Marshal(action)
+		buf.Write(meta)
+		buf.WriteByte('\n')
+		buf.Write(doc)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (x *elasticsearchIndexer) index(events []Event) error {
+	if !x.templated {
+		template, _ := json.Marshal(IndexTemplate(x.opts))
+		status, _, err := x.do(http.MethodPut, "/_index_template/"+x.opts.IndexPrefix, "application/json", template)
+		if err != nil && (status == 0 || status >= 500) {
+			return fmt.Errorf("failed to install the index template %v", err)
+		}
+		if err != nil {
+			// such as a user without the manage_index_templates privilege, the indices take the dynamic mappings
+			logger.Warnf("index the audit events without the index template %v", err)
+		}
+		x.templated = true
+	}
+
+	body, err := BulkBody(x.opts.IndexPrefix, events)
+	if err != nil {
+		// the events that cannot be serialized are never retried
+		logger.Errorf("failed to marshal audit events %v", err)
+		return nil
+	}
+	_, data, err := x.do(http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return err
+	}
+	var resp bulkResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if !resp.Errors {
+		return nil
+	}
+	// the rejected documents are dropped, while the overloaded cluster is retried with backoff
+	rejected := 0
+	for _, item := range resp.Items {
+		for _, result := range item {
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				return fmt.Errorf("bulk index status %d %s", result.Status, result.Error.Reason)
+			}
+			if result.Status >= 300 {
+				if rejected++; rejected <= elasticsearchMaxErrors {
+					logger.Errorf("audit event rejected by the index with status %d %s %s", result.Status, result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+	}
+	if rejected > 0 {
+		logger.Errorf("%d audit events of the bulk are rejected by the index", rejected)
+	}
+	return nil
+}
+
+// do sends the request to the current node, and moves to the next node on a network error or a server error
+func (x *elasticsearchIndexer) do(method, path, contentType string, body []byte) (int, []byte, error) {
+	if len(x.opts.URLs) == 0 {
+		return 0, nil, fmt.Errorf("no elasticsearch url")
+	}
+	base := strings.TrimSuffix(x.opts.URLs[x.node%len(x.opts.URLs)], "/")
+	req, err := http.NewRequest(method, base+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if x.opts.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+x.opts.APIKey)
+	} else if x.opts.Username != "" {
+		req.SetBasicAuth(x.opts.Username, x.opts.Password)
+	}
+	resp, err := x.client.Do(req)
+	if err != nil {
+		x.node++
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	if resp.StatusCode >= 500 {
+		x.node++
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, nil, fmt.Errorf("%s %s status %d %s", method, path, resp.StatusCode, string(data))
+	}
+	return resp.StatusCode, data, nil
+}
@@ -0,0 +1,74 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+const pulsarSendTimeout = 10 * time.Second
+
+// pulsarPublisher publishes the events to a topic, the producer is created on demand
+// so that the sink works once the broker becomes available. It is called by a single goroutine.
+type pulsarPublisher struct {
+	client   pulsar.Client
+	topic    string
+	producer pulsar.Producer
+}
+
+// NewPulsarSink creates a buffered sink publishing the events as json to the Pulsar topic, keyed by the tenant
+func NewPulsarSink(client pulsar.Client, topic string, bufferSize int) *BufferedSink {
+	p := &pulsarPublisher{client: client, topic: topic}
+	return NewBufferedSink("pulsar "+topic, bufferSize, p.publish)
+}
+
+func (p *pulsarPublisher) publish(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// an event that cannot be serialized is never retried
+		logger.Errorf("failed to marshal audit event %v", err)
+		return nil
+	}
+
+	if p.producer == nil {
+		if p.producer, err = p.client.CreateProducer(pulsar.ProducerOptions{Topic: p.topic}); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pulsarSendTimeout)
+	defer cancel()
+	_, err = p.producer.Send(ctx, &pulsar.ProducerMessage{
+		Payload:   data,
+		Key:       e.Tenant,
+		EventTime: e.Time,
+		Properties: map[string]string{
+			"action":  e.Action,
+			"outcome": e.Outcome,
+		},
+	})
+	return err
+}
@@ -0,0 +1,136 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package icrypto
+
+// Token binding restricts a token to the client certificate or the network ranges it is presented from,
+// so that an exfiltrated token is useless elsewhere. The certificate binding is the cnf claim of RFC 8705.
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	confirmationClaim = "cnf"
+	allowedCIDRsClaim = "allowed_cidrs"
+)
+
+// TokenBinding is the client certificate thumbprint and the network ranges a token is bound to
+type TokenBinding struct {
+	CertThumbprint string   `json:"x5t#S256,omitempty"`
+	CIDRs          []string `json:"cidrs,omitempty"`
+}
+
+// CertThumbprint is the base64url encoded SHA-256 digest of the DER certificate
+func CertThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewTokenBinding validates a binding, it is nil without the thumbprint and the network ranges
+func NewTokenBinding(thumbprint string, cidrs []string) (*TokenBinding, error) {
+	thumbprint = strings.TrimSpace(thumbprint)
+	if thumbprint == "" && len(cidrs) == 0 {
+		return nil, nil
+	}
+	if thumbprint != "" {
+		if sum, err := base64.RawURLEncoding.DecodeString(thumbprint); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("certificate thumbprint %s must be a base64url encoded SHA-256 digest", thumbprint)
+		}
+	}
+	binding := &TokenBinding{CertThumbprint: thumbprint}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid network range %s", cidr)
+		}
+		binding.CIDRs = append(binding.CIDRs, cidr)
+	}
+	return binding, nil
+}
+
+// Verify checks the client certificate and the source IP of a request against the binding
+func (b *TokenBinding) Verify(cert *x509.Certificate, ip string) error {
+	if b.CertThumbprint != "" {
+		if cert == nil {
+			return errors.New("token is bound to a client certificate")
+		}
+		if CertThumbprint(cert) != b.CertThumbprint {
+			return errors.New("client certificate does not match the token binding")
+		}
+	}
+	if len(b.CIDRs) == 0 {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	for _, cidr := range b.CIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && addr != nil && network.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source IP %s is out of the token network ranges", ip)
+}
+
+// apply sets the binding claims
+func (b *TokenBinding) apply(claims jwt.MapClaims) {
+	if b == nil {
+		return
+	}
+	if b.CertThumbprint != "" {
+		claims[confirmationClaim] = map[string]string{"x5t#S256": b.CertThumbprint}
+	}
+	if len(b.CIDRs) > 0 {
+		claims[allowedCIDRsClaim] = b.CIDRs
+	}
+}
+
+// tokenBinding reads the binding claims, a malformed binding fails the verification rather than being ignored
+func tokenBinding(claims jwt.MapClaims) (*TokenBinding, error) {
+	thumbprint, cidrs := "", []string{}
+	if v, ok := claims[confirmationClaim]; ok {
+		cnf, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("malformed cnf claim")
+		}
+		if thumbprint, ok = cnf["x5t#S256"].(string); !ok || thumbprint == "" {
+			return nil, errors.New("cnf claim requires the x5t#S256 certificate thumbprint")
+		}
+	}
+	if v, ok := claims[allowedCIDRsClaim]; ok {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &cidrs); err != nil || len(cidrs) == 0 {
+			return nil, errors.New("malformed allowed_cidrs claim")
+		}
+	}
+	return NewTokenBinding(thumbprint, cidrs)
+}
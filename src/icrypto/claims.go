@@ -0,0 +1,106 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package icrypto
+
+// Claims template applied to every minted token.
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// ClaimsTemplate defines additional claims applied to every token minted by an RSAKeyPair.
+// Downstream authorizers expect different claim names, i.e. role, roles, or scope,
+// so the claim set is configurable rather than hard coded.
+type ClaimsTemplate struct {
+	// Static claims are copied into every token as is
+	Static map[string]interface{} `json:"static"`
+	// Derived claims are computed from the token request.
+	// The value is a template such as "{sub}", "tenant:{tenant}" or "{param.team}"
+	Derived map[string]string `json:"derived"`
+	// Required claims must be present in the final claims, otherwise token generation fails
+	Required []string `json:"required"`
+}
+
+// reserved claims are always set by GenerateToken and DelegateToken and cannot be overwritten by a template,
+// a template claim named as the delegation scope, its parent subject, or the binding would forge or rebind a token
+var reservedClaims = []string{"sub", "exp", "iat", "jti", delegationClaim, "psub", confirmationClaim, allowedCIDRsClaim}
+
+var claimVarPattern = regexp.MustCompile(`\{([a-zA-Z0-9_.-]+)\}`)
+
+// IsEmpty returns true if the template does not define any claim
+func (t *ClaimsTemplate) IsEmpty() bool {
+	return t == nil || (len(t.Static) == 0 && len(t.Derived) == 0 && len(t.Required) == 0)
+}
+
+// Validate verifies the template does not attempt to overwrite the reserved claims
+func (t *ClaimsTemplate) Validate() error {
+	if t == nil {
+		return nil
+	}
+	for _, name := range reservedClaims {
+		if _, ok := t.Static[name]; ok {
+			return fmt.Errorf("static claim %s is reserved", name)
+		}
+		if _, ok := t.Derived[name]; ok {
+			return fmt.Errorf("derived claim %s is reserved", name)
+		}
+	}
+	return nil
+}
+
+// Apply adds the static and derived claims to the claims map and verifies required claims.
+// A derived claim is skipped if any variable referenced by its template is missing in vars.
+func (t *ClaimsTemplate) Apply(claims jwt.MapClaims, vars map[string]string) error {
+	if t == nil {
+		return nil
+	}
+	for k, v := range t.Static {
+		claims[k] = v
+	}
+	for k, tmpl := range t.Derived {
+		if v, ok := expandClaim(tmpl, vars); ok {
+			claims[k] = v
+		}
+	}
+	for _, name := range t.Required {
+		if _, ok := claims[name]; !ok {
+			return fmt.Errorf("missing required claim %s", name)
+		}
+	}
+	return nil
+}
+
+// expandClaim replaces {var} references in the template, returns false if any variable is missing
+func expandClaim(tmpl string, vars map[string]string) (string, bool) {
+	complete := true
+	value := claimVarPattern.ReplaceAllStringFunc(tmpl, func(ref string) string {
+		v, ok := vars[ref[1:len(ref)-1]]
+		if !ok || v == "" {
+			complete = false
+		}
+		return v
+	})
+	return value, complete
+}
@@ -0,0 +1,270 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package icrypto
+
+// Delegation tokens are narrower tokens derived from an existing valid token.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	// PermissionRead allows read only access, i.e. HTTP GET
+	PermissionRead = "read"
+	// PermissionWrite allows state changing access, i.e. HTTP POST, PUT, and DELETE
+	PermissionWrite = "write"
+
+	delegationClaim = "dlg"
+	// delegatedSubjectPrefix is the subject claim of a delegated token, so Pulsar never takes it for the parent subject
+	delegatedSubjectPrefix = "delegated:"
+)
+
+// DelegationScope is the restriction carried by a delegated token
+type DelegationScope struct {
+	Namespaces  []string `json:"ns"`
+	Permissions []string `json:"perm"`
+	ParentID    string   `json:"pjti"`
+	// ParentSubject is the subject the token acts for, the sub claim of a delegated token is distinct
+	ParentSubject string `json:"psub,omitempty"`
+}
+
+// AllowsNamespace checks if the tenant/namespace is covered by the scope
+func (d *DelegationScope) AllowsNamespace(namespace string) bool {
+	return containsStr(d.Namespaces, namespace)
+}
+
+// AllowsPermission checks if the permission is covered by the scope
+func (d *DelegationScope) AllowsPermission(permission string) bool {
+	return containsStr(d.Permissions, permission)
+}
+
+// TokenID returns the jti claim of a token or a digest of the token string if the jti is absent
+func TokenID(claims jwt.MapClaims, tokenStr string) string {
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		return jti
+	}
+	sum := sha256.Sum256([]byte(tokenStr))
+	return hex.EncodeToString(sum[:16])
+}
+
+// VerifiedToken is the outcome of a successful token verification
+type VerifiedToken struct {
+	Subject string           `json:"sub"`
+	Scope   *DelegationScope `json:"scope,omitempty"`
+	// Binding is nil if the token is not bound to a client certificate or network ranges
+	Binding *TokenBinding `json:"binding,omitempty"`
+	// ExpiresAt is zero if the token does not expire
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// GetTokenSubjectAndScope gets the subject and the delegation scope from a token.
+// The scope is nil if the token is not a delegated token.
+func (keys *RSAKeyPair) GetTokenSubjectAndScope(tokenStr string) (string, *DelegationScope, error) {
+	verified, err := keys.VerifyToken(tokenStr)
+	return verified.Subject, verified.Scope, err
+}
+
+// VerifyToken verifies a token and returns its subject, delegation scope, and expiry
+func (keys *RSAKeyPair) VerifyToken(tokenStr string) (VerifiedToken, error) {
+	token, err := keys.DecodeToken(tokenStr)
+	if err != nil {
+		return VerifiedToken{}, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	subject, ok := claims["sub"].(string)
+	if !ok {
+		return VerifiedToken{}, errors.New("missing subjects")
+	}
+	scope, err := delegationScope(claims)
+	if err != nil {
+		return VerifiedToken{}, err
+	}
+	binding, err := tokenBinding(claims)
+	if err != nil {
+		return VerifiedToken{}, err
+	}
+	if scope != nil && scope.ParentSubject != "" {
+		subject = scope.ParentSubject
+	}
+	verified := VerifiedToken{Subject: subject, Scope: scope, Binding: binding}
+	if exp, ok := claims["exp"].(float64); ok {
+		verified.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return verified, nil
+}
+
+// UnverifiedSubject returns the subject a token claims without verifying the token, it is only for accounting
+func UnverifiedSubject(tokenStr string) string {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+	subject, _ := token.Claims.(jwt.MapClaims)["sub"].(string)
+	return subject
+}
+
+// FailedTokenSubject returns the subject to account for a failed token validation. It is only returned
+// if the signature of the token is verified, such as an expired token or a bound token presented
+// without its certificate, so a forged token cannot get the subject of someone else banned.
+func FailedTokenSubject(tokenStr string, verified VerifiedToken, err error) string {
+	if verified.Subject != "" {
+		return verified.Subject
+	}
+	validationErr, ok := err.(*jwt.ValidationError)
+	if !ok || validationErr.Errors&(jwt.ValidationErrorMalformed|jwt.ValidationErrorUnverifiable|jwt.ValidationErrorSignatureInvalid) != 0 {
+		return ""
+	}
+	return UnverifiedSubject(tokenStr)
+}
+
+func delegationScope(claims jwt.MapClaims) (*DelegationScope, error) {
+	v, ok := claims[delegationClaim]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	scope := DelegationScope{}
+	if err = json.Unmarshal(data, &scope); err != nil {
+		return nil, fmt.Errorf("malformed delegation claim %v", err)
+	}
+	return &scope, nil
+}
+
+// DelegateToken derives a narrower token from a valid parent token.
+// The delegated token acts for the parent subject but has a distinct sub claim, so it is only accepted where its scope
+// is enforced. Its namespaces and permissions must be a subset of the parent's, and it cannot outlive the parent.
+// A zero duration inherits the parent expiry.
+func (keys *RSAKeyPair) DelegateToken(parentTokenStr string, req DelegationScope, duration time.Duration) (string, DelegationScope, time.Time, error) {
+	token, err := keys.DecodeToken(parentTokenStr)
+	if err != nil {
+		return "", DelegationScope{}, time.Time{}, err
+	}
+	parentClaims := token.Claims.(jwt.MapClaims)
+	subject, ok := parentClaims["sub"].(string)
+	if !ok {
+		return "", DelegationScope{}, time.Time{}, errors.New("missing subjects")
+	}
+	parentScope, err := delegationScope(parentClaims)
+	if err != nil {
+		return "", DelegationScope{}, time.Time{}, err
+	}
+	if parentScope != nil && parentScope.ParentSubject != "" {
+		subject = parentScope.ParentSubject
+	}
+	// a delegated token is bound the same as its parent
+	binding, err := tokenBinding(parentClaims)
+	if err != nil {
+		return "", DelegationScope{}, time.Time{}, err
+	}
+
+	if len(req.Namespaces) == 0 {
+		return "", DelegationScope{}, time.Time{}, errors.New("at least one namespace is required")
+	}
+	if len(req.Permissions) == 0 {
+		req.Permissions = []string{PermissionRead, PermissionWrite}
+		if parentScope != nil {
+			req.Permissions = parentScope.Permissions
+		}
+	}
+	for _, p := range req.Permissions {
+		if p != PermissionRead && p != PermissionWrite {
+			return "", DelegationScope{}, time.Time{}, fmt.Errorf("invalid permission %s", p)
+		}
+		if parentScope != nil && !parentScope.AllowsPermission(p) {
+			return "", DelegationScope{}, time.Time{}, fmt.Errorf("permission %s is not granted to the parent token", p)
+		}
+	}
+	if parentScope != nil {
+		for _, ns := range req.Namespaces {
+			if !parentScope.AllowsNamespace(ns) {
+				return "", DelegationScope{}, time.Time{}, fmt.Errorf("namespace %s is not granted to the parent token", ns)
+			}
+		}
+	}
+
+	now := time.Now()
+	var expiry time.Time
+	if duration > 0 {
+		expiry = now.Add(duration)
+	}
+	if exp, ok := parentClaims["exp"].(float64); ok {
+		parentExpiry := time.Unix(int64(exp), 0)
+		if expiry.IsZero() || expiry.After(parentExpiry) {
+			expiry = parentExpiry
+		}
+	}
+
+	req.ParentID, req.ParentSubject = TokenID(parentClaims, parentTokenStr), subject
+	jti, err := newTokenID()
+	if err != nil {
+		return "", DelegationScope{}, time.Time{}, err
+	}
+	claims := jwt.MapClaims{}
+	if err := keys.ClaimsTemplate.Apply(claims, map[string]string{"sub": subject}); err != nil {
+		return "", DelegationScope{}, time.Time{}, err
+	}
+	claims["sub"] = delegatedSubjectPrefix + jti
+	claims["iat"] = now.Unix()
+	claims["jti"] = jti
+	claims[delegationClaim] = req
+	// the binding is copied from the parent, the template output never binds or unbinds a delegated token
+	delete(claims, confirmationClaim)
+	delete(claims, allowedCIDRsClaim)
+	binding.apply(claims)
+	if !expiry.IsZero() {
+		claims["exp"] = expiry.Unix()
+	}
+
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(keys.PrivateKey)
+	if err != nil {
+		return "", DelegationScope{}, time.Time{}, err
+	}
+	return tokenString, req, expiry, nil
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func containsStr(strs []string, str string) bool {
+	for _, v := range strs {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -40,15 +40,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/golang-jwt/jwt"
 )
 
+// logger of the icrypto module, util.ModuleLogger is not available since util imports icrypto
+var logger = log.WithField("module", "icrypto")
+
 // RSAKeyPair for JWT token sign and verification
 type RSAKeyPair struct {
 	PrivateKey           *rsa.PrivateKey
 	PublicKey            *rsa.PublicKey
 	PrivateKeyPKCS8Bytes []byte
 	PublicKeyPKIXBytes   []byte
+	ClaimsTemplate       *ClaimsTemplate
 }
 
 const (
@@ -198,22 +203,35 @@ func writeKeyToFile(keyBytes []byte, saveFileTo string) error {
 
 // GenerateToken generates token with user defined subject
 func (keys *RSAKeyPair) GenerateToken(userSubject string, timeDuration time.Duration, signingMethod jwt.SigningMethod) (string, error) {
+	return keys.GenerateTokenWithVars(userSubject, timeDuration, signingMethod, map[string]string{"sub": userSubject})
+}
+
+// GenerateTokenWithVars generates token with user defined subject,
+// vars are the request attributes used to compute derived claims in the claims template
+func (keys *RSAKeyPair) GenerateTokenWithVars(userSubject string, timeDuration time.Duration, signingMethod jwt.SigningMethod, vars map[string]string) (string, error) {
+	return keys.GenerateBoundToken(userSubject, timeDuration, signingMethod, vars, nil)
+}
+
+// GenerateBoundToken generates token with user defined subject bound to a client certificate or network ranges,
+// a nil binding generates an unbound token
+func (keys *RSAKeyPair) GenerateBoundToken(userSubject string, timeDuration time.Duration, signingMethod jwt.SigningMethod, vars map[string]string, binding *TokenBinding) (string, error) {
 	token := jwt.New(signingMethod)
+	claims := jwt.MapClaims{}
+	if err := keys.ClaimsTemplate.Apply(claims, vars); err != nil {
+		return "", err
+	}
 	if timeDuration > 0 {
-		token.Claims = jwt.MapClaims{
-			"exp": time.Now().Add(timeDuration).Unix(),
-			"iat": time.Now().Unix(),
-			"sub": userSubject,
-		}
-	} else {
-		token.Claims = jwt.MapClaims{
-			"sub": userSubject,
-		}
+		claims["exp"] = time.Now().Add(timeDuration).Unix()
+		claims["iat"] = time.Now().Unix()
 	}
+	claims["sub"] = userSubject
+	binding.apply(claims)
+	token.Claims = claims
 	tokenString, err := token.SignedString(keys.PrivateKey)
 	if err != nil {
 		return "", err
 	}
+	logger.Debugf("generated %s token for subject %s with expiry %v", signingMethod.Alg(), userSubject, timeDuration)
 	return tokenString, nil
 }
 
@@ -224,6 +242,7 @@ func (keys *RSAKeyPair) DecodeToken(tokenStr string) (*jwt.Token, error) {
 	})
 
 	if err != nil {
+		logger.Debugf("token verification failed %v", err)
 		return nil, err
 	}
 
@@ -31,6 +31,7 @@ import (
 	v1 "k8s.io/api/apps/v1"
 	core_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -42,6 +43,7 @@ import (
 type Client struct {
 	Clientset        *kubernetes.Clientset
 	Metrics          *metrics.Clientset
+	Dynamic          dynamic.Interface
 	ClusterName      string
 	DefaultNamespace string
 }
@@ -104,9 +106,15 @@ func GetK8sClient() (*Client, error) {
 		return nil, err
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
 	client := Client{
 		Clientset: clientset,
 		Metrics:   metrics,
+		Dynamic:   dynamicClient,
 	}
 
 	return &client, nil
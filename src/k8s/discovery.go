@@ -0,0 +1,85 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DiscoverServiceURL discovers the URL of the first service, sorted by name, matching the label selector
+// that has at least one ready endpoint. The port is matched by name or number, or the first service port if empty.
+func (c *Client) DiscoverServiceURL(namespace, selector, port, path string) (string, error) {
+	services, err := c.Clientset.CoreV1().Services(namespace).List(context.TODO(), meta_v1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return "", err
+	}
+	items := services.Items
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+
+	for _, svc := range items {
+		svcPort, ok := matchServicePort(svc.Spec.Ports, port)
+		if !ok {
+			continue
+		}
+		endpoints, err := c.Clientset.CoreV1().Endpoints(namespace).Get(context.TODO(), svc.Name, meta_v1.GetOptions{})
+		if err != nil || !hasReadyAddress(endpoints) {
+			continue
+		}
+		return fmt.Sprintf("http://%s.%s.svc:%d%s", svc.Name, namespace, svcPort, path), nil
+	}
+	return "", fmt.Errorf("no ready service matches selector %s under namespace %s", selector, namespace)
+}
+
+func matchServicePort(ports []core_v1.ServicePort, port string) (int32, bool) {
+	if len(ports) == 0 {
+		return 0, false
+	}
+	if port == "" {
+		return ports[0].Port, true
+	}
+	number, _ := strconv.Atoi(port)
+	for _, p := range ports {
+		if p.Name == port || int(p.Port) == number {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+func hasReadyAddress(endpoints *core_v1.Endpoints) bool {
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package k8s
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseName     = "burnell-leader"
+	defaultLeaseDuration = 15 * time.Second
+)
+
+// StartLeaderElection campaigns for the lease in the background, this replica is a follower until elected
+func StartLeaderElection(ctx context.Context) error {
+	client, err := GetK8sClient()
+	if err != nil {
+		return err
+	}
+	cfg := util.GetConfig().LeaderElection
+	identity := util.LeaderIdentity()
+	duration := defaultLeaseDuration
+	if cfg.LeaseDurationSeconds > 0 {
+		duration = time.Duration(cfg.LeaseDurationSeconds) * time.Second
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: meta_v1.ObjectMeta{
+			Name:      util.AssignString(cfg.LeaseName, defaultLeaseName),
+			Namespace: util.AssignString(cfg.LeaseNamespace, os.Getenv("POD_NAMESPACE"), util.GetConfig().PulsarNamespace),
+		},
+		Client:     client.Clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	electionConfig := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   duration,
+		RenewDeadline:   duration * 2 / 3,
+		RetryPeriod:     duration / 5,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				util.SetLeader(identity)
+				log.Warnf("replica %s is elected the leader of lease %s/%s", identity, lock.LeaseMeta.Namespace, lock.LeaseMeta.Name)
+			},
+			OnStoppedLeading: func() {
+				log.Warnf("replica %s stopped leading", identity)
+				util.SetLeader("")
+			},
+			OnNewLeader: func(current string) {
+				log.Infof("the leader is %s", current)
+				util.SetLeader(current)
+			},
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(electionConfig)
+	if err != nil {
+		return err
+	}
+
+	util.EnableLeaderElection(identity)
+	go func() {
+		// Run returns once the leadership is lost, the replica campaigns again as a follower
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return nil
+}
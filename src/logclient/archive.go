@@ -0,0 +1,161 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Bulk download of the logs of every instance of a function as a gzip compressed tar stream
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultArchiveBytes is the default size cap of the logs in an archive
+	DefaultArchiveBytes = 32 << 20
+	// MaxArchiveBytes caps the size of the logs in an archive
+	MaxArchiveBytes = 256 << 20
+
+	archiveChunkBytes = 256 * 1024
+)
+
+// ArchiveInstance is the manifest entry of an instance log
+type ArchiveInstance struct {
+	InstanceID int    `json:"instanceId"`
+	WorkerID   string `json:"workerId"`
+	File       string `json:"file,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	// Truncated is true if only the tail of the log fits in the size cap
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ArchiveManifest is the manifest.json of an archive
+type ArchiveManifest struct {
+	Tenant    string            `json:"tenant"`
+	Namespace string            `json:"namespace"`
+	Function  string            `json:"function"`
+	CreatedAt time.Time         `json:"createdAt"`
+	MaxBytes  int64             `json:"maxBytes"`
+	Instances []ArchiveInstance `json:"instances"`
+}
+
+// WriteFunctionLogArchive writes the logs of the instances and a manifest.json as a gzip compressed tar stream.
+// The size cap is shared by the instances in the order of the instance ID, a log over the remaining cap is cut
+// to its most recent bytes. An instance failed to read is recorded in the manifest and skipped.
+func WriteFunctionLogArchive(w io.Writer, fn FunctionType, instances []FuncInstance, maxBytes int64) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	manifest := ArchiveManifest{
+		Tenant:    fn.Tenant,
+		Namespace: fn.Namespace,
+		Function:  fn.FunctionName,
+		CreatedAt: now,
+		MaxBytes:  maxBytes,
+		Instances: []ArchiveInstance{},
+	}
+	dir := path.Join(fn.Tenant, fn.Namespace, fn.FunctionName)
+
+	remaining := maxBytes
+	for _, instance := range instances {
+		entry := ArchiveInstance{InstanceID: instance.InstanceID, WorkerID: instance.Status.WorkerID}
+		data, truncated, err := readInstanceLog(fn, instance, remaining)
+		if err != nil {
+			logger.Errorf("failed to archive the log of %s instance %d error %v", dir, instance.InstanceID, err)
+			entry.Error = err.Error()
+			manifest.Instances = append(manifest.Instances, entry)
+			continue
+		}
+		entry.File = path.Join(dir, fn.FunctionName+"-"+strconv.Itoa(instance.InstanceID)+".log")
+		entry.Bytes, entry.Truncated = int64(len(data)), truncated
+		if err := writeTarFile(tw, entry.File, data, now); err != nil {
+			return err
+		}
+		remaining -= entry.Bytes
+		manifest.Instances = append(manifest.Instances, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, path.Join(dir, "manifest.json"), data, now); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readInstanceLog reads up to the most recent maxBytes of an instance log, it returns true if the log is cut
+func readInstanceLog(fn FunctionType, instance FuncInstance, maxBytes int64) ([]byte, bool, error) {
+	functionName := fn.Tenant + fn.Namespace + fn.FunctionName
+	conn, c, file, err := dialFunctionLog(functionName, instance.Status.WorkerID, instance.InstanceID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	size, err := logFileSize(c, file)
+	if err != nil {
+		return nil, false, err
+	}
+	pos, truncated := int64(0), false
+	if maxBytes <= 0 {
+		return nil, size > 0, nil
+	} else if size > maxBytes {
+		pos, truncated = size-maxBytes, true
+	}
+
+	var buf bytes.Buffer
+	for pos < size {
+		n := size - pos
+		if n > archiveChunkBytes {
+			n = archiveChunkBytes
+		}
+		logs, end, err := readLogRange(c, file, pos, n)
+		if err != nil {
+			return nil, false, err
+		}
+		if logs == "" || end <= pos {
+			break
+		}
+		buf.WriteString(logs)
+		pos = end
+	}
+	return buf.Bytes(), truncated, nil
+}
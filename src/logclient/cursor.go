@@ -0,0 +1,238 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Log positions surviving the rotation of a function log file. The log server only serves byte offsets,
+// so a cursor carries the fingerprints of the file head and of the bytes before its offset
+// to tell a rotated or truncated file from a grown one.
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/datastax/burnell/src/logstream"
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	headFingerprintBytes = 256
+	tailFingerprintBytes = 64
+)
+
+// DefaultRotatedLogSuffixes are the default suffixes of the rotated log files readable by the log server
+var DefaultRotatedLogSuffixes = []string{".1"}
+
+// ErrInvalidLogCursor is the error of a malformed log cursor
+var ErrInvalidLogCursor = fmt.Errorf("invalid log cursor")
+
+// LogCursor is the position after the last read line of a function log
+type LogCursor struct {
+	// Seq counts the rotations since the first read
+	Seq int   `json:"seq"`
+	Pos int64 `json:"pos"`
+	// Rotated is the suffix of the rotated file still being read
+	Rotated string `json:"rotated,omitempty"`
+	HeadLen int    `json:"headLen"`
+	Head    string `json:"head"`
+	TailLen int    `json:"tailLen"`
+	Tail    string `json:"tail"`
+}
+
+// Encode returns the opaque string of the cursor
+func (lc LogCursor) Encode() string {
+	data, _ := json.Marshal(lc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeLogCursor parses an encoded cursor
+func DecodeLogCursor(cursor string) (LogCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return LogCursor{}, ErrInvalidLogCursor
+	}
+	var lc LogCursor
+	if err := json.Unmarshal(data, &lc); err != nil || lc.Pos < 0 || lc.HeadLen < 0 || lc.TailLen < 0 {
+		return LogCursor{}, ErrInvalidLogCursor
+	}
+	return lc, nil
+}
+
+func fingerprint(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ReadFunctionLogCursor reads the next chunk of lines after a cursor, an empty cursor reads the tail of the log.
+// After a rotation, the rest of the previous file is read from a rotated file that still has the lines of the cursor,
+// otherwise the read starts over at the beginning of the new file and the response reports the gap.
+func ReadFunctionLogCursor(functionName, workerID string, instanceID int, cursor string, bytes int64) (FunctionLogResponse, error) {
+	tailer, err := NewLogTailer(functionName, workerID, instanceID, cursor)
+	if err != nil {
+		return FunctionLogResponse{}, err
+	}
+	defer tailer.Close()
+	return tailer.Next(bytes)
+}
+
+// readLogTail reads the tail of the log and returns the cursor after it
+func readLogTail(c logstream.LogStreamClient, file string, bytes int64) (FunctionLogResponse, error) {
+	res, err := readFunctionLog(c, file, FunctionLogRequest{Bytes: bytes})
+	if err != nil {
+		return FunctionLogResponse{}, err
+	}
+	lc, err := advanceLogCursor(c, file, LogCursor{}, res.Logs, res.ForwardPosition)
+	if err != nil {
+		return FunctionLogResponse{}, err
+	}
+	res.Cursor = lc.Encode()
+	return res, nil
+}
+
+func readAfterLogCursor(c logstream.LogStreamClient, file string, lc LogCursor, bytes int64) (FunctionLogResponse, error) {
+	res := FunctionLogResponse{}
+	matched, err := logCursorMatches(c, file+lc.Rotated, lc)
+	if err != nil {
+		return res, err
+	}
+	if !matched {
+		// the file of the cursor is rotated, a later rotated file may still have its lines
+		for _, suffix := range rotatedSuffixesAfter(lc.Rotated) {
+			if ok, err := logCursorMatches(c, file+suffix, lc); err == nil && ok {
+				lc.Rotated, matched = suffix, true
+				break
+			}
+		}
+	}
+	if !matched {
+		logger.Infof("log %s rotated, the lines after offset %d are not readable", file+lc.Rotated, lc.Pos)
+		lc = LogCursor{Seq: lc.Seq + 1}
+		res.Rotated, res.Gap = true, true
+	}
+
+	current := file + lc.Rotated
+	logs, end, err := readLogRange(c, current, lc.Pos, bytes)
+	if err != nil {
+		return res, err
+	}
+	if lc.Rotated != "" && logs == "" {
+		// the rotated file is fully read, the read continues at the beginning of the new file
+		lc, current = LogCursor{Seq: lc.Seq + 1}, file
+		res.Rotated = true
+		if logs, end, err = readLogRange(c, current, 0, bytes); err != nil {
+			return res, err
+		}
+	}
+	if lc, err = advanceLogCursor(c, current, lc, logs, end); err != nil {
+		return res, err
+	}
+	res.Logs, res.BackwardPosition, res.ForwardPosition = logs, end-int64(len(logs)), end
+	res.Cursor = lc.Encode()
+	return res, nil
+}
+
+// rotatedSuffixesAfter returns the suffixes of the files the rotated file would be renamed to by the next rotations
+func rotatedSuffixesAfter(suffix string) []string {
+	suffixes := util.GetConfig().LogRotatedSuffixes
+	if len(suffixes) == 0 {
+		suffixes = DefaultRotatedLogSuffixes
+	}
+	if suffix == "" {
+		return suffixes
+	}
+	for i, s := range suffixes {
+		if s == suffix {
+			return suffixes[i+1:]
+		}
+	}
+	return nil
+}
+
+// logCursorMatches checks the file still has the head and the lines before the cursor
+func logCursorMatches(c logstream.LogStreamClient, file string, lc LogCursor) (bool, error) {
+	size, err := logFileSize(c, file)
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "no such file or directory") {
+			return false, nil
+		}
+		return false, err
+	}
+	if size < lc.Pos {
+		return false, nil
+	}
+	if lc.HeadLen > 0 {
+		head, _, err := readLogRange(c, file, 0, int64(lc.HeadLen))
+		if err != nil {
+			return false, err
+		}
+		if len(head) != lc.HeadLen || fingerprint(head) != lc.Head {
+			return false, nil
+		}
+	}
+	if lc.TailLen > 0 {
+		tail, _, err := readLogRange(c, file, lc.Pos-int64(lc.TailLen), int64(lc.TailLen))
+		if err != nil {
+			return false, err
+		}
+		if len(tail) != lc.TailLen || fingerprint(tail) != lc.Tail {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// advanceLogCursor moves the cursor to the end of the read lines and updates the fingerprints
+func advanceLogCursor(c logstream.LogStreamClient, file string, lc LogCursor, logs string, end int64) (LogCursor, error) {
+	lc.Pos = end
+	tail := logs
+	if len(tail) < tailFingerprintBytes && end > int64(len(tail)) {
+		from := end - tailFingerprintBytes
+		if from < 0 {
+			from = 0
+		}
+		var err error
+		if tail, _, err = readLogRange(c, file, from, end-from); err != nil {
+			return lc, err
+		}
+	}
+	if len(tail) > tailFingerprintBytes {
+		tail = tail[len(tail)-tailFingerprintBytes:]
+	}
+	lc.TailLen, lc.Tail = len(tail), fingerprint(tail)
+
+	// the head grows up to its full length with the read lines
+	if lc.HeadLen < headFingerprintBytes && end > int64(lc.HeadLen) {
+		n := end
+		if n > headFingerprintBytes {
+			n = headFingerprintBytes
+		}
+		head, _, err := readLogRange(c, file, 0, n)
+		if err != nil {
+			return lc, err
+		}
+		lc.HeadLen, lc.Head = len(head), fingerprint(head)
+	}
+	return lc, nil
+}
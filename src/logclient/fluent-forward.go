@@ -0,0 +1,404 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Forwarding of the function logs to Fluentd or Fluent Bit with the Forward protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	defaultFluentTagPrefix = "pulsar.functions"
+	defaultFluentInterval  = time.Second
+	fluentReadBytes        = 64 * 1024
+	fluentWriteTimeout     = 10 * time.Second
+	fluentMinBackoff       = time.Second
+	fluentMaxBackoff       = 30 * time.Second
+	defaultFluentCursors   = "burnell-fluent-cursors.json"
+	// maxFluentPending is the number of records of an instance kept while the forward input is unavailable
+	maxFluentPending = 10000
+)
+
+// FluentEntry is a record of the Forward protocol
+type FluentEntry struct {
+	Time   time.Time
+	Record map[string]string
+}
+
+// ErrFluentNotConnected is the error of a send while the forward input is not connected
+var ErrFluentNotConnected = errors.New("the forward input is not connected")
+
+// FluentClient sends the entries in the Forward mode of the Forward protocol. The connection is dialed in the
+// background and re-dialed with backoff after a failure, a send fails fast while it is not connected.
+type FluentClient struct {
+	address string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	dialing bool
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// NewFluentClient creates a client of the forward input at the address and starts dialing it
+func NewFluentClient(address string) *FluentClient {
+	c := &FluentClient{address: address}
+	c.mu.Lock()
+	c.dial()
+	c.mu.Unlock()
+	return c
+}
+
+// Send sends the entries of a tag as one forward message
+func (c *FluentClient) Send(tag string, entries []FluentEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		c.dial()
+		return ErrFluentNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(fluentWriteTimeout))
+	if _, err := c.conn.Write(encodeForwardMessage(tag, entries)); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.failed()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection
+func (c *FluentClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// dial connects in the background unless a dial is in flight or the backoff has not passed,
+// it is called with the lock held
+func (c *FluentClient) dial() {
+	if c.dialing || time.Now().Before(c.retryAt) {
+		return
+	}
+	c.dialing = true
+	go func() {
+		conn, err := net.DialTimeout("tcp", c.address, fluentWriteTimeout)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.dialing = false
+		if err != nil {
+			c.failed()
+			logger.Warnf("failed to connect the forward input %s error %v, retry in %v", c.address, err, c.backoff)
+			return
+		}
+		c.conn, c.backoff = conn, 0
+	}()
+}
+
+// failed doubles the backoff before the next dial, it is called with the lock held
+func (c *FluentClient) failed() {
+	c.backoff *= 2
+	if c.backoff < fluentMinBackoff {
+		c.backoff = fluentMinBackoff
+	} else if c.backoff > fluentMaxBackoff {
+		c.backoff = fluentMaxBackoff
+	}
+	c.retryAt = time.Now().Add(c.backoff)
+}
+
+// encodeForwardMessage encodes [tag, [[time, record], ...], {"size": n}] in MessagePack,
+// the time is an EventTime of the nanosecond precision
+func encodeForwardMessage(tag string, entries []FluentEntry) []byte {
+	b := msgpackArray(nil, 3)
+	b = msgpackString(b, tag)
+	b = msgpackArray(b, len(entries))
+	for _, e := range entries {
+		b = msgpackArray(b, 2)
+		b = append(b, 0xd7, 0x00)
+		b = appendUint32(b, uint32(e.Time.Unix()))
+		b = appendUint32(b, uint32(e.Time.Nanosecond()))
+		b = msgpackMap(b, len(e.Record))
+		for k, v := range e.Record {
+			b = msgpackString(b, k)
+			b = msgpackString(b, v)
+		}
+	}
+	b = msgpackMap(b, 1)
+	b = msgpackString(b, "size")
+	return msgpackUint(b, uint64(len(entries)))
+}
+
+func msgpackArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(b, 0xdc), uint16(n))
+	}
+	return appendUint32(append(b, 0xdd), uint32(n))
+}
+
+func msgpackMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(b, 0xde), uint16(n))
+	}
+	return appendUint32(append(b, 0xdf), uint32(n))
+}
+
+func msgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = appendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = appendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(b, buf[:]...)
+}
+
+func msgpackUint(b []byte, n uint64) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return appendUint64(append(b, 0xcf), n)
+}
+
+// fluentInstance follows the log of a function instance
+type fluentInstance struct {
+	tailer  *LogTailer
+	pending []FluentEntry
+}
+
+// fluentCursors are the cursors after the last forwarded lines of the instances, kept in a file
+// so a restart resumes the forward after them
+type fluentCursors struct {
+	path    string
+	cursors map[string]string
+	dirty   bool
+}
+
+// loadFluentCursors reads the cursors of the file, a missing or malformed file starts over at the tail of the logs
+func loadFluentCursors(path string) *fluentCursors {
+	fc := &fluentCursors{path: path, cursors: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("failed to read the forward cursors %s error %v", path, err)
+		}
+		return fc
+	}
+	if err := json.Unmarshal(data, &fc.cursors); err != nil {
+		logger.Warnf("failed to parse the forward cursors %s error %v", path, err)
+		fc.cursors = map[string]string{}
+	}
+	return fc
+}
+
+func (fc *fluentCursors) set(key, cursor string) {
+	if fc.cursors[key] != cursor {
+		fc.cursors[key] = cursor
+		fc.dirty = true
+	}
+}
+
+func (fc *fluentCursors) remove(key string) {
+	if _, ok := fc.cursors[key]; ok {
+		delete(fc.cursors, key)
+		fc.dirty = true
+	}
+}
+
+// save writes the cursors to a temporary file renamed over the file, so a crash never leaves a partial file
+func (fc *fluentCursors) save() {
+	if !fc.dirty {
+		return
+	}
+	data, _ := json.Marshal(fc.cursors)
+	tmp := fc.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		logger.Errorf("failed to write the forward cursors %s error %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, fc.path); err != nil {
+		logger.Errorf("failed to write the forward cursors %s error %v", fc.path, err)
+		return
+	}
+	fc.dirty = false
+}
+
+// StartFluentForward follows the logs of the function instances of the configured tenants
+// and forwards the new records, the records are tagged per tenant, namespace, and function
+func StartFluentForward() {
+	cfg := util.GetConfig().FluentForward
+	if cfg.Address == "" {
+		return
+	}
+	interval := time.Duration(cfg.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultFluentInterval
+	}
+	prefix := util.AssignString(cfg.TagPrefix, defaultFluentTagPrefix)
+	cursorFile := util.AssignString(cfg.CursorFile, filepath.Join(os.TempDir(), defaultFluentCursors))
+	logger.Infof("forward the function logs to %s with tag prefix %s", cfg.Address, prefix)
+	go func() {
+		client := NewFluentClient(cfg.Address)
+		cursors := loadFluentCursors(cursorFile)
+		instances := map[string]*fluentInstance{}
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			// the replicas follow the same functions, only the leader forwards when the leader election is enabled
+			if util.IsLeader() {
+				forwardFunctionLogs(client, instances, cursors, prefix, cfg.Tenants)
+				cursors.save()
+			}
+		}
+	}()
+}
+
+// forwardFunctionLogs reads the new lines of every instance and forwards them, the instances of the functions no
+// longer deployed are closed. The records of a failed forward are kept for the next one, the cursor of an instance
+// only moves once its records are forwarded.
+func forwardFunctionLogs(client *FluentClient, instances map[string]*fluentInstance, cursors *fluentCursors, prefix string, tenants []string) {
+	seen := map[string]bool{}
+	for _, fn := range TenantFunctions("") {
+		if len(tenants) > 0 && !util.StrContains(tenants, fn.Tenant) {
+			continue
+		}
+		tag := strings.Join([]string{prefix, fn.Tenant, fn.Namespace, fn.FunctionName}, ".")
+		for id := 0; id < int(fn.Parallism) || id < len(fn.Instances); id++ {
+			key := fn.Tenant + "/" + fn.Namespace + "/" + fn.FunctionName + "/" + strconv.Itoa(id)
+			seen[key] = true
+			instance, ok := instances[key]
+			if !ok {
+				tailer, err := newFluentTailer(fn, id, cursors.cursors[key])
+				if err != nil {
+					logger.Errorf("failed to follow the log of %s error %v", key, err)
+					continue
+				}
+				instance = &fluentInstance{tailer: tailer}
+				instances[key] = instance
+			}
+			if res, err := instance.tailer.Next(fluentReadBytes); err == nil && res.Logs != "" {
+				instance.pending = append(instance.pending, fluentEntries(fn, id, res.Logs)...)
+				if over := len(instance.pending) - maxFluentPending; over > 0 {
+					logger.Warnf("dropped %d records of function %s instance %d over the forward buffer", over, key, id)
+					instance.pending = instance.pending[over:]
+				}
+			}
+			if err := client.Send(tag, instance.pending); err != nil {
+				logger.Errorf("failed to forward the logs of %s error %v", key, err)
+				continue
+			}
+			instance.pending = nil
+			if cursor := instance.tailer.Cursor(); cursor != "" {
+				cursors.set(key, cursor)
+			}
+		}
+	}
+	for key, instance := range instances {
+		if !seen[key] {
+			instance.tailer.Close()
+			delete(instances, key)
+			cursors.remove(key)
+		}
+	}
+}
+
+// newFluentTailer resumes after the saved cursor of an instance, the forward starts at the tail of the log
+// without a cursor or with a cursor no longer valid
+func newFluentTailer(fn FunctionType, id int, cursor string) (*LogTailer, error) {
+	functionName := fn.Tenant + fn.Namespace + fn.FunctionName
+	tailer, err := NewLogTailer(functionName, "", id, cursor)
+	if err != nil && cursor != "" {
+		logger.Warnf("discard the forward cursor of function %s instance %d error %v", functionName, id, err)
+		return NewLogTailer(functionName, "", id, "")
+	}
+	return tailer, err
+}
+
+// fluentEntries converts the log lines of an instance to the forward records
+func fluentEntries(fn FunctionType, instance int, logs string) []FluentEntry {
+	now := time.Now()
+	entries := []FluentEntry{}
+	for _, r := range ParseLogRecords(logs) {
+		e := FluentEntry{Time: now, Record: map[string]string{
+			"tenant":    fn.Tenant,
+			"namespace": fn.Namespace,
+			"function":  fn.FunctionName,
+			"instance":  strconv.Itoa(instance),
+			"message":   r.Message,
+		}}
+		if r.Time != nil {
+			e.Time = *r.Time
+		}
+		for k, v := range map[string]string{"level": r.Level, "logger": r.Logger, "thread": r.Thread} {
+			if v != "" {
+				e.Record[k] = v
+			}
+		}
+		if len(r.StackTrace) > 0 {
+			e.Record["stack_trace"] = strings.Join(r.StackTrace, "\n")
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,240 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Runtime metrics of the functions aggregated from the functions worker stats
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// the number of concurrent stats requests to the functions worker
+const functionStatsConcurrency = 8
+
+// functionExceptionStats is an exception reported by an instance
+type functionExceptionStats struct {
+	ExceptionString string `json:"exceptionString"`
+	TimestampMs     int64  `json:"timestampMs"`
+}
+
+// functionInstanceStats are the metrics of an instance in the functions worker stats
+type functionInstanceStats struct {
+	InstanceID int `json:"instanceId"`
+	Metrics    struct {
+		LatestUserExceptions   []functionExceptionStats `json:"latestUserExceptions"`
+		LatestSystemExceptions []functionExceptionStats `json:"latestSystemExceptions"`
+	} `json:"metrics"`
+}
+
+// functionStats is the stats response of the functions worker, the totals are summed over the instances
+type functionStats struct {
+	ReceivedTotal              int64                   `json:"receivedTotal"`
+	ProcessedSuccessfullyTotal int64                   `json:"processedSuccessfullyTotal"`
+	SystemExceptionsTotal      int64                   `json:"systemExceptionsTotal"`
+	UserExceptionsTotal        int64                   `json:"userExceptionsTotal"`
+	AvgProcessLatency          *float64                `json:"avgProcessLatency"`
+	LastInvocation             *int64                  `json:"lastInvocation"`
+	Instances                  []functionInstanceStats `json:"instances"`
+}
+
+// FunctionException is the latest exception of a function
+type FunctionException struct {
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+	InstanceID int       `json:"instanceId"`
+	// System is true for a system exception, false for a user exception thrown by the function code
+	System bool `json:"system"`
+}
+
+// FunctionMetrics are the runtime metrics of a function
+type FunctionMetrics struct {
+	Tenant                     string             `json:"tenant"`
+	Namespace                  string             `json:"namespace"`
+	Name                       string             `json:"name"`
+	Component                  string             `json:"component"`
+	Instances                  int                `json:"instances"`
+	ReceivedTotal              int64              `json:"receivedTotal"`
+	ProcessedSuccessfullyTotal int64              `json:"processedSuccessfullyTotal"`
+	FailedTotal                int64              `json:"failedTotal"`
+	SystemExceptionsTotal      int64              `json:"systemExceptionsTotal"`
+	UserExceptionsTotal        int64              `json:"userExceptionsTotal"`
+	AvgProcessLatencyMs        *float64           `json:"avgProcessLatencyMs,omitempty"`
+	LastInvocation             *time.Time         `json:"lastInvocation,omitempty"`
+	LastException              *FunctionException `json:"lastException,omitempty"`
+	// Error is the failure to get the stats from the functions worker
+	Error string `json:"error,omitempty"`
+}
+
+type functionMetricsEntry struct {
+	metrics []FunctionMetrics
+	expires time.Time
+}
+
+// functionMetricsCache caches the metrics per tenant, the empty tenant caches all functions
+var functionMetricsCache = struct {
+	sync.Mutex
+	entries map[string]functionMetricsEntry
+}{entries: make(map[string]functionMetricsEntry)}
+
+// GetFunctionMetrics returns the metrics of the functions of a tenant, an empty tenant returns all functions.
+// The metrics are cached for FunctionMetricsCacheSeconds, default to 30 seconds.
+func GetFunctionMetrics(tenant string) []FunctionMetrics {
+	functionMetricsCache.Lock()
+	entry, ok := functionMetricsCache.entries[tenant]
+	functionMetricsCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.metrics
+	}
+
+	functions := TenantFunctions(tenant)
+	metrics := make([]FunctionMetrics, len(functions))
+	sem := make(chan struct{}, functionStatsConcurrency)
+	var wg sync.WaitGroup
+	for i, fn := range functions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fn FunctionType) {
+			defer func() { <-sem; wg.Done() }()
+			metrics[i] = collectFunctionMetrics(fn)
+		}(i, fn)
+	}
+	wg.Wait()
+
+	ttl := time.Duration(util.GetEnvInt("FunctionMetricsCacheSeconds", 30)) * time.Second
+	functionMetricsCache.Lock()
+	functionMetricsCache.entries[tenant] = functionMetricsEntry{metrics: metrics, expires: time.Now().Add(ttl)}
+	functionMetricsCache.Unlock()
+	return metrics
+}
+
+// ResetFunctionMetricsCache drops the cached metrics
+func ResetFunctionMetricsCache() {
+	functionMetricsCache.Lock()
+	functionMetricsCache.entries = make(map[string]functionMetricsEntry)
+	functionMetricsCache.Unlock()
+}
+
+func collectFunctionMetrics(fn FunctionType) FunctionMetrics {
+	m := FunctionMetrics{Tenant: fn.Tenant, Namespace: fn.Namespace, Name: fn.FunctionName, Component: fn.Component}
+	var stats functionStats
+	if err := getFunctionAdmin(fn, "stats", &stats); err != nil {
+		logger.Errorf("failed to get %s/%s/%s stats error %v", fn.Tenant, fn.Namespace, fn.FunctionName, err)
+		m.Error = err.Error()
+		return m
+	}
+	m.Instances = len(stats.Instances)
+	m.ReceivedTotal = stats.ReceivedTotal
+	m.ProcessedSuccessfullyTotal = stats.ProcessedSuccessfullyTotal
+	m.SystemExceptionsTotal = stats.SystemExceptionsTotal
+	m.UserExceptionsTotal = stats.UserExceptionsTotal
+	m.FailedTotal = stats.SystemExceptionsTotal + stats.UserExceptionsTotal
+	m.AvgProcessLatencyMs = stats.AvgProcessLatency
+	if stats.LastInvocation != nil && *stats.LastInvocation > 0 {
+		t := time.Unix(0, *stats.LastInvocation*int64(time.Millisecond)).UTC()
+		m.LastInvocation = &t
+	}
+
+	for _, instance := range stats.Instances {
+		for i, exceptions := range [][]functionExceptionStats{instance.Metrics.LatestUserExceptions, instance.Metrics.LatestSystemExceptions} {
+			for _, e := range exceptions {
+				t := time.Unix(0, e.TimestampMs*int64(time.Millisecond)).UTC()
+				if m.LastException == nil || t.After(m.LastException.Time) {
+					m.LastException = &FunctionException{Message: e.ExceptionString, Time: t, InstanceID: instance.InstanceID, System: i == 1}
+				}
+			}
+		}
+	}
+	return m
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// FunctionMetricsText renders the metrics in the Prometheus text format.
+// The exception messages are only in the JSON format to bound the label cardinality.
+func FunctionMetricsText(metrics []FunctionMetrics) []byte {
+	families := []struct {
+		name, help, metricType string
+		value                  func(FunctionMetrics) (float64, bool)
+	}{
+		{"burnell_function_received_total", "Messages received by the function", "counter",
+			func(m FunctionMetrics) (float64, bool) { return float64(m.ReceivedTotal), true }},
+		{"burnell_function_processed_successfully_total", "Messages processed successfully by the function", "counter",
+			func(m FunctionMetrics) (float64, bool) { return float64(m.ProcessedSuccessfullyTotal), true }},
+		{"burnell_function_system_exceptions_total", "System exceptions of the function", "counter",
+			func(m FunctionMetrics) (float64, bool) { return float64(m.SystemExceptionsTotal), true }},
+		{"burnell_function_user_exceptions_total", "User exceptions thrown by the function", "counter",
+			func(m FunctionMetrics) (float64, bool) { return float64(m.UserExceptionsTotal), true }},
+		{"burnell_function_process_latency_ms", "Average process latency of the function in milliseconds", "gauge",
+			func(m FunctionMetrics) (float64, bool) {
+				if m.AvgProcessLatencyMs == nil {
+					return 0, false
+				}
+				return *m.AvgProcessLatencyMs, true
+			}},
+		{"burnell_function_last_invocation_timestamp_seconds", "Unix time of the last invocation of the function", "gauge",
+			func(m FunctionMetrics) (float64, bool) {
+				if m.LastInvocation == nil {
+					return 0, false
+				}
+				return float64(m.LastInvocation.UnixNano()) / float64(time.Second), true
+			}},
+		{"burnell_function_last_exception_timestamp_seconds", "Unix time of the latest exception of the function", "gauge",
+			func(m FunctionMetrics) (float64, bool) {
+				if m.LastException == nil {
+					return 0, false
+				}
+				return float64(m.LastException.Time.UnixNano()) / float64(time.Second), true
+			}},
+		{"burnell_function_instances", "Instances of the function", "gauge",
+			func(m FunctionMetrics) (float64, bool) { return float64(m.Instances), true }},
+		{"burnell_function_stats_up", "1 if the stats of the function are available from the functions worker", "gauge",
+			func(m FunctionMetrics) (float64, bool) {
+				if m.Error != "" {
+					return 0, true
+				}
+				return 1, true
+			}},
+	}
+
+	var b bytes.Buffer
+	for _, family := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.metricType)
+		for _, m := range metrics {
+			if m.Error != "" && family.name != "burnell_function_stats_up" {
+				continue
+			}
+			if value, ok := family.value(m); ok {
+				fmt.Fprintf(&b, "%s{tenant=\"%s\",namespace=\"%s\",function=\"%s\"} %s\n", family.name,
+					labelValueEscaper.Replace(m.Tenant), labelValueEscaper.Replace(m.Tenant+"/"+m.Namespace),
+					labelValueEscaper.Replace(m.Name), strconv.FormatFloat(value, 'g', -1, 64))
+			}
+		}
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,132 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Parsing of the function log lines into entries, a multi-line entry such as a stack trace
+// is grouped with the line of its timestamp
+
+import (
+	"strings"
+	"time"
+)
+
+// the timestamp layouts at the start of a function log line, the time only layout has no date.
+// A Python instance line starts with the timestamp in brackets.
+var logTimeLayouts = []string{
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05.000-0700",
+	"2006-01-02T15:04:05.000Z07:00",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05,000",
+	"15:04:05.000",
+}
+
+var logLevels = map[string]string{
+	"TRACE":   "TRACE",
+	"DEBUG":   "DEBUG",
+	"INFO":    "INFO",
+	"WARN":    "WARN",
+	"WARNING": "WARN",
+	"ERROR":   "ERROR",
+	"FATAL":   "FATAL",
+}
+
+// logEntry is a log line with its continuation lines, start and end are the byte offsets in the parsed chunk
+type logEntry struct {
+	text  string
+	start int
+	end   int
+	// header is false for the continuation lines without a leading timestamp
+	header bool
+	time   time.Time
+	level  string
+}
+
+// parseLogEntries splits a chunk of complete lines into entries
+func parseLogEntries(data string) []logEntry {
+	entries := []logEntry{}
+	offset := 0
+	for offset < len(data) {
+		end := strings.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += offset + 1
+		}
+		line := data[offset:end]
+		if ts, _, header := parseLogTime(line); header || len(entries) == 0 {
+			entries = append(entries, logEntry{start: offset, header: header, time: ts, level: parseLogLevel(line)})
+		}
+		last := &entries[len(entries)-1]
+		last.end = end
+		last.text = data[last.start:end]
+		offset = end
+	}
+	return entries
+}
+
+// parseLogTime parses the leading timestamp of a line and returns the rest of the line, it returns false if the line has none
+func parseLogTime(line string) (time.Time, string, bool) {
+	rest := ""
+	if strings.HasPrefix(line, "[") {
+		if end := strings.IndexByte(line, ']'); end > 0 {
+			line, rest = line[1:end], line[end+1:]
+		}
+	}
+	if len(line) == 0 || line[0] < '0' || line[0] > '9' {
+		return time.Time{}, "", false
+	}
+	for _, layout := range logTimeLayouts {
+		// the timestamp spans as many fields as its layout
+		spaces := strings.Count(layout, " ")
+		fields := strings.SplitN(line, " ", spaces+2)
+		if len(fields) <= spaces {
+			continue
+		}
+		prefix := strings.TrimSpace(strings.Join(fields[:spaces+1], " "))
+		if ts, err := time.Parse(layout, prefix); err == nil {
+			if len(fields) > spaces+1 {
+				rest = fields[spaces+1] + rest
+			}
+			if ts.Year() == 0 {
+				// a time only timestamp cannot be compared against a time range
+				return time.Time{}, rest, true
+			}
+			return ts, rest, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// parseLogLevel finds the level among the first fields of a line
+func parseLogLevel(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) > 6 {
+		fields = fields[:6]
+	}
+	for _, field := range fields {
+		if level, ok := logLevels[strings.ToUpper(strings.Trim(field, "[]:"))]; ok {
+			return level
+		}
+	}
+	return ""
+}
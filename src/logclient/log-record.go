@@ -0,0 +1,113 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Structured records of the function log entries
+
+import (
+	"strings"
+	"time"
+)
+
+// LogRecord is a structured function log entry, StackTrace has the lines of a multi-line exception
+type LogRecord struct {
+	Time       *time.Time `json:"time,omitempty"`
+	Level      string     `json:"level,omitempty"`
+	Thread     string     `json:"thread,omitempty"`
+	Logger     string     `json:"logger,omitempty"`
+	Message    string     `json:"message"`
+	StackTrace []string   `json:"stackTrace,omitempty"`
+}
+
+const pythonTraceback = "Traceback (most recent call last)"
+
+// ParseLogRecords parses the log lines into records. The continuation lines of a Java exception are the stack trace
+// of the record, and so are the lines of a Python traceback logged with the same time, level, and logger.
+func ParseLogRecords(logs string) []LogRecord {
+	records := []LogRecord{}
+	for _, e := range parseLogEntries(logs) {
+		lines := strings.Split(strings.TrimRight(e.text, "\r\n"), "\n")
+		for i := range lines {
+			lines[i] = strings.TrimRight(lines[i], "\r")
+		}
+		r := parseLogRecord(lines[0], e)
+		if len(lines) > 1 {
+			r.StackTrace = lines[1:]
+		}
+		if n := len(records); n > 0 && inPythonTraceback(records[n-1], r) {
+			records[n-1].StackTrace = append(records[n-1].StackTrace, r.Message)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// parseLogRecord parses the first line of an entry, such as
+// 2021-05-04T18:00:00.000+0000 [public/default/fn-0] INFO  function - message of a Java instance or
+// [2020-03-30 12:31:57 +0000] [ERROR] log.py: message of a Python instance
+func parseLogRecord(line string, e logEntry) LogRecord {
+	r := LogRecord{Level: e.level, Message: line}
+	if !e.time.IsZero() {
+		t := e.time
+		r.Time = &t
+	}
+	if !e.header {
+		return r
+	}
+	_, rest, _ := parseLogTime(line)
+	rest = strings.TrimSpace(rest)
+
+	// the bracketed fields are the level or the thread
+	for strings.HasPrefix(rest, "[") {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			break
+		}
+		if level, ok := logLevels[strings.ToUpper(rest[1:end])]; ok {
+			r.Level = level
+		} else if r.Thread == "" {
+			r.Thread = rest[1:end]
+		}
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+	if fields := strings.SplitN(rest, " ", 2); len(fields) == 2 {
+		if level, ok := logLevels[strings.ToUpper(strings.Trim(fields[0], ":"))]; ok {
+			r.Level, rest = level, strings.TrimSpace(fields[1])
+		}
+	}
+
+	// a logger name has no space and is followed by " - " or ": ", the indentation of the message is kept
+	if i := strings.Index(rest, " - "); i > 0 && !strings.Contains(rest[:i], " ") {
+		r.Logger, rest = rest[:i], rest[i+3:]
+	} else if i := strings.Index(rest, ": "); i > 0 && !strings.Contains(rest[:i], " ") {
+		r.Logger, rest = rest[:i], rest[i+2:]
+	}
+	r.Message = rest
+	return r
+}
+
+// inPythonTraceback checks the record is a line of the traceback started by the previous record
+func inPythonTraceback(prev, r LogRecord) bool {
+	return strings.HasPrefix(prev.Message, pythonTraceback) && !strings.HasPrefix(r.Message, pythonTraceback) &&
+		prev.Time != nil && r.Time != nil && prev.Time.Equal(*r.Time) && prev.Level == r.Level && prev.Logger == r.Logger
+}
@@ -0,0 +1,202 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Merge of the logs of the function instances on all workers into one chronological stream
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMergeBytes is the default bytes read from every instance log
+	DefaultMergeBytes = 64 * 1024
+	// MaxMergeBytes caps the bytes read from every instance log
+	MaxMergeBytes = 1 << 20
+)
+
+// MergedLogInstance is the read state of an instance in a merged log,
+// BackwardPosition continues the merge toward the older entries and 0 means the start of the log is reached
+type MergedLogInstance struct {
+	InstanceID       int
+	WorkerID         string
+	BackwardPosition int64
+	ForwardPosition  int64
+	Entries          int
+	Error            string `json:"Error,omitempty"`
+}
+
+// MergedFunctionLog is the chronologically merged log of the function instances
+type MergedFunctionLog struct {
+	Logs      string
+	Entries   int
+	Instances []MergedLogInstance
+}
+
+// instanceEntries are the parsed entries of an instance log chunk
+type instanceEntries struct {
+	state   MergedLogInstance
+	entries []logEntry
+	// complete is true if the chunk reaches the start of the log
+	complete bool
+}
+
+// MergeFunctionLogs reads the log tail of every instance and interleaves the entries in the order of their timestamps.
+// Every line is labelled with its instance ID. positions maps an instance ID to the backward position to continue from,
+// a nil map reads every instance from the end of its log and an instance missing from a non nil map is skipped.
+// An entry without a timestamp takes the time of the previous entry of its instance.
+func MergeFunctionLogs(fn FunctionType, instances []FuncInstance, positions map[int]int64, bytes int64) MergedFunctionLog {
+	results := make([]*instanceEntries, 0, len(instances))
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		pos, ok := positions[instance.InstanceID]
+		if positions != nil && (!ok || pos <= 0) {
+			continue
+		}
+		result := &instanceEntries{state: MergedLogInstance{InstanceID: instance.InstanceID, WorkerID: instance.Status.WorkerID}}
+		results = append(results, result)
+		wg.Add(1)
+		go func(instance FuncInstance) {
+			defer wg.Done()
+			readInstanceEntries(fn, instance, pos, bytes, result)
+		}(instance)
+	}
+	wg.Wait()
+
+	// An instance with older entries left unread may have entries before the latest of the first timestamps
+	// of those instances. The entries before it are left to the next merge, so no entry is missed in the order.
+	var cutoff time.Time
+	for _, result := range results {
+		if !result.complete && len(result.entries) > 0 && result.entries[0].time.After(cutoff) {
+			cutoff = result.entries[0].time
+		}
+	}
+	for _, result := range results {
+		drop := 0
+		for drop < len(result.entries) && result.entries[drop].time.Before(cutoff) {
+			drop++
+		}
+		if drop > 0 {
+			result.state.BackwardPosition += int64(result.entries[drop-1].end)
+			result.entries = result.entries[drop:]
+		}
+		result.state.Entries = len(result.entries)
+	}
+
+	merged := MergedFunctionLog{Instances: []MergedLogInstance{}}
+	var b strings.Builder
+	for {
+		// the instance with the oldest next entry, the instance order breaks a tie
+		next := -1
+		for i, result := range results {
+			if len(result.entries) > 0 && (next < 0 || result.entries[0].time.Before(results[next].entries[0].time)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		writeLabelledEntry(&b, results[next].state.InstanceID, results[next].entries[0].text)
+		results[next].entries = results[next].entries[1:]
+		merged.Entries++
+	}
+	merged.Logs = b.String()
+	for _, result := range results {
+		merged.Instances = append(merged.Instances, result.state)
+	}
+	return merged
+}
+
+// readInstanceEntries reads a chunk backward from pos, or from the end of the log if pos is 0, and parses its entries.
+// The partial first line and the first entry without its timestamp line are left to the next read.
+func readInstanceEntries(fn FunctionType, instance FuncInstance, pos, bytes int64, result *instanceEntries) {
+	res, err := func() (FunctionLogResponse, error) {
+		conn, c, file, err := dialFunctionLog(fn.Tenant+fn.Namespace+fn.FunctionName, instance.Status.WorkerID, instance.InstanceID)
+		if err != nil {
+			return FunctionLogResponse{}, err
+		}
+		defer conn.Close()
+		return readFunctionLog(c, file, FunctionLogRequest{BackwardPosition: pos, Bytes: bytes})
+	}()
+	if err != nil {
+		logger.Errorf("failed to read the log of %s instance %d error %v", fn.FunctionName, instance.InstanceID, err)
+		result.state.Error = err.Error()
+		// the same position is retried by the next merge
+		result.state.BackwardPosition = pos
+		result.complete = true
+		return
+	}
+	result.state.BackwardPosition, result.state.ForwardPosition = res.BackwardPosition, res.ForwardPosition
+	result.complete = res.BackwardPosition <= 0
+
+	data := res.Logs
+	skip := 0
+	if !result.complete {
+		if i := strings.IndexByte(data, '\n'); i >= 0 {
+			skip = i + 1
+		} else {
+			skip = len(data)
+		}
+	}
+	entries := parseLogEntries(data[skip:])
+	if !result.complete && len(entries) > 0 && !entries[0].header {
+		entries = entries[1:]
+	}
+	if len(entries) == 0 && !result.complete {
+		// an entry longer than the chunk is returned in part to make progress
+		skip, entries = 0, parseLogEntries(data)
+	}
+	if len(entries) > 0 {
+		base := entries[0].start
+		for i := range entries {
+			entries[i].start -= base
+			entries[i].end -= base
+		}
+		skip += base
+	}
+	result.state.BackwardPosition += int64(skip)
+
+	// an entry without a timestamp keeps its place after the previous entry
+	for i := 1; i < len(entries); i++ {
+		if entries[i].time.IsZero() {
+			entries[i].time = entries[i-1].time
+		}
+	}
+	result.entries = entries
+}
+
+// writeLabelledEntry writes every line of an entry with the instance label
+func writeLabelledEntry(b *strings.Builder, instanceID int, text string) {
+	label := fmt.Sprintf("[%d] ", instanceID)
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" {
+			b.WriteString(label)
+			b.WriteString(line)
+		}
+	}
+	if !strings.HasSuffix(text, "\n") {
+		b.WriteString("\n")
+	}
+}
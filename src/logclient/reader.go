@@ -28,6 +28,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,10 +45,20 @@ import (
 )
 
 // FunctionLogResponse is HTTP response object
+// Matches and ScannedBytes are only set by a filtered search.
 type FunctionLogResponse struct {
 	Logs             string
 	BackwardPosition int64
 	ForwardPosition  int64
+	Matches          int   `json:"Matches,omitempty"`
+	ScannedBytes     int64 `json:"ScannedBytes,omitempty"`
+	// Cursor continues the read after a rotation of the log file
+	Cursor string `json:"Cursor,omitempty"`
+	// Rotated is true if the read has moved to a rotated log file, Gap is true if unread lines of it are lost
+	Rotated bool `json:"Rotated,omitempty"`
+	Gap     bool `json:"Gap,omitempty"`
+	// Records are the structured entries of the logs when requested
+	Records []LogRecord `json:"Records,omitempty"`
 }
 
 // ErrNotFoundFunction error for function not found
@@ -100,6 +111,36 @@ func ReadFunctionMap(key string) (FunctionType, bool) {
 	return f, ok
 }
 
+// LookupFunction returns the function deployed in the tenant and namespace, the function map key alone is ambiguous
+// since it concatenates the names
+func LookupFunction(tenant, namespace, name string) (FunctionType, error) {
+	fn, ok := ReadFunctionMap(tenant + namespace + name)
+	if !ok || fn.Tenant != tenant || fn.Namespace != namespace || fn.FunctionName != name {
+		return FunctionType{}, ErrNotFoundFunction
+	}
+	return fn, nil
+}
+
+// TenantFunctions returns the functions of a tenant sorted by namespace and name, an empty tenant returns all functions
+func TenantFunctions(tenant string) []FunctionType {
+	fnMpLock.RLock()
+	functions := []FunctionType{}
+	for _, f := range functionMap {
+		if tenant == "" || f.Tenant == tenant {
+			functions = append(functions, f)
+		}
+	}
+	fnMpLock.RUnlock()
+	sort.Slice(functions, func(i, j int) bool {
+		a, b := functions[i], functions[j]
+		if a.Tenant+"/"+a.Namespace != b.Tenant+"/"+b.Namespace {
+			return a.Tenant+"/"+a.Namespace < b.Tenant+"/"+b.Namespace
+		}
+		return a.FunctionName < b.FunctionName
+	})
+	return functions
+}
+
 // WriteFunctionMapIfNotExist writes a key/value to a thread safe map
 func WriteFunctionMapIfNotExist(key string, f FunctionType) {
 	fnMpLock.Lock()
@@ -158,7 +199,7 @@ func ReaderLoop(sig chan *liveSignal) {
 	}(sig)
 
 	// Configuration variables pertaining to this reader
-	tokenStr := util.GetConfig().PulsarToken
+	tokenStr := util.PulsarToken()
 	uri := util.GetConfig().PulsarURL
 	topicName := "persistent://public/functions/metadata"
 
@@ -169,7 +210,10 @@ func ReaderLoop(sig chan *liveSignal) {
 	}
 
 	if tokenStr != "" {
-		clientOpt.Authentication = pulsar.NewAuthenticationToken(tokenStr)
+		// the supplier picks up the refreshed token
+		clientOpt.Authentication = pulsar.NewAuthenticationTokenFromSupplier(func() (string, error) {
+			return util.PulsarToken(), nil
+		})
 	}
 
 	if strings.HasPrefix(uri, "pulsar+ssl://") {
@@ -247,12 +291,23 @@ func FunctionTopicWatchDog() {
 // GetFunctionLog gets the logs from the function worker process
 // Since the function may get reassigned after restart, we will establish the connection every time the log request is being made.
 func GetFunctionLog(functionName, workerID string, instanceID int, rd FunctionLogRequest) (FunctionLogResponse, error) {
-	var fn FunctionType
+	conn, c, file, err := dialFunctionLog(functionName, workerID, instanceID)
+	if err != nil {
+		return FunctionLogResponse{}, err
+	}
+	defer conn.Close()
+	return readFunctionLog(c, file, rd)
+}
+
+// dialFunctionLog connects to the log server of the worker running the function instance,
+// it returns the log file of the instance
+func dialFunctionLog(functionName, workerID string, instanceID int) (*grpc.ClientConn, logstream.LogStreamClient, string, error) {
+	fn, _ := ReadFunctionMap(functionName)
 	if workerID == "" {
 		var err error
 		fn, workerID, err = GetFunctionWorkerID(functionName, instanceID)
 		if err != nil {
-			return FunctionLogResponse{}, err
+			return nil, nil, "", err
 		}
 	}
 
@@ -264,17 +319,20 @@ func GetFunctionLog(functionName, workerID string, instanceID int, rd FunctionLo
 	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(600*time.Second))
 	if err != nil {
 		logger.Errorf("grpc.Dial to log server error %v", err)
-		return FunctionLogResponse{}, err
+		return nil, nil, "", err
 	}
-	defer conn.Close()
-	c := logstream.NewLogStreamClient(conn)
+	file := logstream.FunctionLogPath(fn.Tenant, fn.Namespace, fn.FunctionName, strconv.Itoa(instanceID))
+	return conn, logstream.NewLogStreamClient(conn), file, nil
+}
 
+// readFunctionLog reads a chunk of the log file from the log server
+func readFunctionLog(c logstream.LogStreamClient, file string, rd FunctionLogRequest) (FunctionLogResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
 	direction := requestDirection(rd)
 	req := &logstream.ReadRequest{
-		File:          logstream.FunctionLogPath(fn.Tenant, fn.Namespace, fn.FunctionName, strconv.Itoa(instanceID)),
+		File:          file,
 		Direction:     direction,
 		Bytes:         rd.Bytes,
 		ForwardIndex:  rd.ForwardPosition,
@@ -294,6 +352,29 @@ func GetFunctionLog(functionName, workerID string, instanceID int, rd FunctionLo
 	}, nil
 }
 
+// readLogRange reads up to n bytes of the log file from an offset, it returns the logs and their end offset
+func readLogRange(c logstream.LogStreamClient, file string, from, n int64) (string, int64, error) {
+	req := FunctionLogRequest{ForwardPosition: from, Bytes: n}
+	if from == 0 {
+		// a zero forward position reads backward, the first chunk is read backward from its end
+		req = FunctionLogRequest{BackwardPosition: n, Bytes: n}
+	}
+	res, err := readFunctionLog(c, file, req)
+	if err != nil {
+		return "", from, err
+	}
+	return res.Logs, res.ForwardPosition, nil
+}
+
+// logFileSize returns the size of the log file, the forward index of a read from the end of the file
+func logFileSize(c logstream.LogStreamClient, file string) (int64, error) {
+	res, err := readFunctionLog(c, file, FunctionLogRequest{Bytes: 1})
+	if err != nil {
+		return 0, err
+	}
+	return res.ForwardPosition, nil
+}
+
 func requestDirection(rd FunctionLogRequest) logstream.ReadRequest_Direction {
 	if rd.ForwardPosition > 0 {
 		return logstream.ReadRequest_FORWARD
@@ -337,49 +418,49 @@ type FuncStatus struct {
 
 // GetFunctionStatus get the function status
 func GetFunctionStatus(fn FunctionType) (FuncStatus, error) {
+	status := FuncStatus{}
+	if err := getFunctionAdmin(fn, "status", &status); err != nil {
+		return FuncStatus{}, err
+	}
+	logger.Infof("function status %v", status)
+	return status, nil
+}
+
+// getFunctionAdmin gets a function resource from the functions worker admin REST API
+func getFunctionAdmin(fn FunctionType, resource string, v interface{}) error {
 	// util.Config.FunctionProxyURL
-	functionRoute := fn.Tenant + "/" + fn.Namespace + "/" + fn.FunctionName + "/status"
-	requestURL := util.SingleJoinSlash(util.Config.FunctionProxyURL,
+	functionRoute := fn.Tenant + "/" + fn.Namespace + "/" + fn.FunctionName + "/" + resource
+	requestURL := util.SingleJoinSlash(util.FunctionURL(fn.Tenant),
 		util.SingleJoinSlash("/admin/v3/"+fn.Component, functionRoute))
-	log.Infof("GET FunctionStatus request url is %s", requestURL)
+	log.Infof("GET function %s request url is %s", resource, requestURL)
 
 	// Update the headers to allow for SSL redirection
 	newRequest, err := http.NewRequest(http.MethodGet, requestURL, nil)
 	if err != nil {
-		return FuncStatus{}, err
+		return err
 	}
 	newRequest.Header.Add("X-Request", "burnell-functions-cache")
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
 
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
 	}
 	if err != nil {
 		log.Errorf("%v", err)
-		return FuncStatus{}, err
+		return err
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return FuncStatus{}, fmt.Errorf("%s failure status code %d", requestURL, response.StatusCode)
+		return fmt.Errorf("%s failure status code %d", requestURL, response.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return FuncStatus{}, err
+		return err
 	}
-
-	logger.Infof("nex to unmarshal res  body")
-	status := FuncStatus{}
-	if err := json.Unmarshal(body, &status); err != nil {
-		return FuncStatus{}, err
-	}
-
-	logger.Infof("function status %v", status)
-	return status, nil
+	return json.Unmarshal(body, v)
 }
 
 const queryTimeout = 3 * time.Minute
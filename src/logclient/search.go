@@ -0,0 +1,206 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Server side search of the function logs. The log server returns the chunk between the backward and
+// the forward index of a read, the search reads successive chunks in the request direction and only keeps
+// the matching entries, so a tenant does not download the whole log to grep for one error.
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/logstream"
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	// DefaultSearchMatches is the default maximum matching entries of a search
+	DefaultSearchMatches = 100
+	// DefaultSearchScanBytes is the default maximum bytes read from the log server by a search
+	DefaultSearchScanBytes = 1 << 20
+	// MaxSearchScanBytes caps the bytes read by a search
+	MaxSearchScanBytes = 16 << 20
+
+	searchChunkBytes = 64 * 1024
+)
+
+// FunctionLogFilter is the filter of a function log search, an entry matches all of the set conditions
+type FunctionLogFilter struct {
+	Substring string
+	Regex     *regexp.Regexp
+	// Levels are upper case, such as ERROR and WARN
+	Levels []string
+	Since  time.Time
+	Until  time.Time
+
+	// MaxMatches stops the search once reached
+	MaxMatches int
+	// MaxScanBytes bounds the bytes read from the log server
+	MaxScanBytes int64
+}
+
+// IsEmpty returns true if the filter has no condition
+func (f FunctionLogFilter) IsEmpty() bool {
+	return f.Substring == "" && f.Regex == nil && len(f.Levels) == 0 && f.Since.IsZero() && f.Until.IsZero()
+}
+
+func (f FunctionLogFilter) matches(e logEntry) bool {
+	if len(f.Levels) > 0 && !util.StrContains(f.Levels, e.level) {
+		return false
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		if e.time.IsZero() || (!f.Since.IsZero() && e.time.Before(f.Since)) || (!f.Until.IsZero() && e.time.After(f.Until)) {
+			return false
+		}
+	}
+	if f.Substring != "" && !strings.Contains(e.text, f.Substring) {
+		return false
+	}
+	return f.Regex == nil || f.Regex.MatchString(strings.TrimSuffix(e.text, "\n"))
+}
+
+// SearchFunctionLog returns the matching log entries of a function instance in the file order,
+// and the positions to continue the search from in either direction
+func SearchFunctionLog(functionName, workerID string, instanceID int, rd FunctionLogRequest, filter FunctionLogFilter) (FunctionLogResponse, error) {
+	conn, c, file, err := dialFunctionLog(functionName, workerID, instanceID)
+	if err != nil {
+		return FunctionLogResponse{}, err
+	}
+	defer conn.Close()
+	read := func(req FunctionLogRequest) (FunctionLogResponse, error) {
+		return readFunctionLog(c, file, req)
+	}
+	if filter.MaxMatches <= 0 {
+		filter.MaxMatches = DefaultSearchMatches
+	}
+	if filter.MaxScanBytes <= 0 {
+		filter.MaxScanBytes = DefaultSearchScanBytes
+	}
+	if requestDirection(rd) == logstream.ReadRequest_FORWARD {
+		return searchForward(read, rd, filter)
+	}
+	return searchBackward(read, rd, filter)
+}
+
+// searchForward reads from the forward position towards the end of the file. The last entry of a chunk
+// is left to the next chunk since its continuation lines may not have been read yet.
+func searchForward(read func(FunctionLogRequest) (FunctionLogResponse, error), rd FunctionLogRequest, filter FunctionLogFilter) (FunctionLogResponse, error) {
+	resp := FunctionLogResponse{BackwardPosition: rd.ForwardPosition, ForwardPosition: rd.ForwardPosition}
+	matched := []string{}
+	for resp.ScannedBytes < filter.MaxScanBytes && len(matched) < filter.MaxMatches {
+		res, err := read(FunctionLogRequest{ForwardPosition: resp.ForwardPosition, Bytes: searchChunkBytes})
+		if err != nil {
+			return FunctionLogResponse{}, err
+		}
+		data := res.Logs
+		resp.ScannedBytes += int64(len(data))
+		eof := len(data) < searchChunkBytes
+		if !eof {
+			data = data[:strings.LastIndexByte(data, '\n')+1]
+		}
+		entries := parseLogEntries(data)
+		if !eof && len(entries) > 1 {
+			entries = entries[:len(entries)-1]
+		}
+
+		consumed, stop := 0, false
+		for _, e := range entries {
+			if !filter.Until.IsZero() && e.time.After(filter.Until) {
+				stop = true
+				break
+			}
+			if filter.matches(e) {
+				matched = append(matched, e.text)
+			}
+			consumed = e.end
+			if len(matched) >= filter.MaxMatches {
+				break
+			}
+		}
+		resp.ForwardPosition += int64(consumed)
+		if stop || eof || consumed == 0 {
+			break
+		}
+	}
+	resp.Logs = strings.Join(matched, "")
+	resp.Matches = len(matched)
+	return resp, nil
+}
+
+// searchBackward reads from the backward position, or the end of the file, towards the start of the file.
+// The first line of a chunk may be partial and the first entry may miss its timestamp line, both are left to the next chunk.
+func searchBackward(read func(FunctionLogRequest) (FunctionLogResponse, error), rd FunctionLogRequest, filter FunctionLogFilter) (FunctionLogResponse, error) {
+	resp := FunctionLogResponse{BackwardPosition: rd.BackwardPosition}
+	matched := []string{}
+	for resp.ScannedBytes < filter.MaxScanBytes && len(matched) < filter.MaxMatches {
+		res, err := read(FunctionLogRequest{BackwardPosition: resp.BackwardPosition, Bytes: searchChunkBytes})
+		if err != nil {
+			return FunctionLogResponse{}, err
+		}
+		if resp.ForwardPosition == 0 {
+			resp.ForwardPosition = res.ForwardPosition
+		}
+		data := res.Logs
+		resp.ScannedBytes += int64(len(data))
+		sof := res.BackwardPosition <= 0
+		skip := 0
+		if !sof {
+			if skip = strings.IndexByte(data, '\n') + 1; skip == 0 {
+				skip = len(data)
+			}
+			if entries := parseLogEntries(data[skip:]); len(entries) > 1 && !entries[0].header {
+				skip += entries[1].start
+			}
+		}
+		entries := parseLogEntries(data[skip:])
+
+		consumedFrom, stop := len(data), false
+		taken := []string{}
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			if !filter.Since.IsZero() && !e.time.IsZero() && e.time.Before(filter.Since) {
+				stop = true
+				break
+			}
+			if filter.matches(e) {
+				taken = append(taken, e.text)
+			}
+			consumedFrom = skip + e.start
+			if len(matched)+len(taken) >= filter.MaxMatches {
+				break
+			}
+		}
+		for i, j := 0, len(taken)-1; i < j; i, j = i+1, j-1 {
+			taken[i], taken[j] = taken[j], taken[i]
+		}
+		matched = append(taken, matched...)
+		resp.BackwardPosition = res.BackwardPosition + int64(consumedFrom)
+		if stop || consumedFrom == len(data) || resp.BackwardPosition <= 0 {
+			break
+		}
+	}
+	resp.Logs = strings.Join(matched, "")
+	resp.Matches = len(matched)
+	return resp, nil
+}
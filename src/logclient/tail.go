@@ -0,0 +1,96 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package logclient
+
+// Follow of the lines appended to a function instance log
+
+import (
+	"google.golang.org/grpc"
+
+	"github.com/datastax/burnell/src/logstream"
+)
+
+// LogTailer reads the lines after a cursor over one log server connection, the connection is re-established
+// on the next read after a failure
+type LogTailer struct {
+	functionName string
+	workerID     string
+	instanceID   int
+	cursor       string
+	lc           LogCursor
+
+	conn *grpc.ClientConn
+	c    logstream.LogStreamClient
+	file string
+}
+
+// NewLogTailer creates a tailer of an instance log, an empty cursor starts at the tail of the log
+func NewLogTailer(functionName, workerID string, instanceID int, cursor string) (*LogTailer, error) {
+	t := &LogTailer{functionName: functionName, workerID: workerID, instanceID: instanceID, cursor: cursor}
+	if cursor != "" {
+		lc, err := DecodeLogCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		t.lc = lc
+	}
+	return t, nil
+}
+
+// Next reads up to bytes of the lines after the cursor and moves the cursor after them
+func (t *LogTailer) Next(bytes int64) (FunctionLogResponse, error) {
+	if t.conn == nil {
+		conn, c, file, err := dialFunctionLog(t.functionName, t.workerID, t.instanceID)
+		if err != nil {
+			return FunctionLogResponse{}, err
+		}
+		t.conn, t.c, t.file = conn, c, file
+	}
+
+	var res FunctionLogResponse
+	var err error
+	if t.cursor == "" {
+		res, err = readLogTail(t.c, t.file, bytes)
+	} else {
+		res, err = readAfterLogCursor(t.c, t.file, t.lc, bytes)
+	}
+	if err != nil {
+		t.Close()
+		return FunctionLogResponse{}, err
+	}
+	t.cursor = res.Cursor
+	t.lc, _ = DecodeLogCursor(res.Cursor)
+	return res, nil
+}
+
+// Cursor returns the cursor after the lines read
+func (t *LogTailer) Cursor() string {
+	return t.cursor
+}
+
+// Close closes the log server connection
+func (t *LogTailer) Close() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
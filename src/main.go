@@ -22,28 +22,36 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/google/gops/agent"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 
+	"github.com/datastax/burnell/src/k8s"
 	"github.com/datastax/burnell/src/logclient"
 	"github.com/datastax/burnell/src/metrics"
 	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/pulsarproxy"
 	"github.com/datastax/burnell/src/route"
 	"github.com/datastax/burnell/src/util"
 	"github.com/datastax/burnell/src/workflow"
-	httptls "github.com/kafkaesque-io/pulsar-beam/src/util"
 )
 
 // commit sha which this binary is built against
 var gitCommit string
 
+// shutdownTimeout bounds the flush of the pending telemetry on shutdown
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	// runtime.GOMAXPROCS does not the container's CPU quota in Kubernetes
 	// therefore, it requires to be set explicitly
@@ -54,8 +62,13 @@ func main() {
 		log.Fatalf("gops instrument error %v", err)
 	}
 
-	modePtr := flag.String("mode", util.Proxy, "process running mode: proxy(default), init, healer")
+	modePtr := flag.String("mode", util.Proxy, "process running mode: proxy(default), init, healer, bootstrap, backup, restore, migrate")
 	version := flag.Bool("version", false, "version (commit sha)")
+	snapshotFile := flag.String("snapshot", "burnell-snapshot.json", "policy store snapshot file of the backup and restore modes")
+	dryRun := flag.Bool("dryRun", false, "report the changes of the restore mode without writing them")
+	prune := flag.Bool("prune", false, "delete the records missing in the snapshot in the restore mode")
+	schemaVersion := flag.Int("schemaVersion", 0, "target schema version of the migrate mode, default to the version of the release")
+	util.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
 	if *version {
 		fmt.Printf("git commit: %s\n", gitCommit)
@@ -66,7 +79,20 @@ func main() {
 	log.Warnf("process running mode %s", mode)
 
 	util.Init(&mode)
+	util.HandleLogLevelSignals()
 	config := util.GetConfig()
+	if err := util.InitTracing(); err != nil {
+		log.Fatalf("failed to set up tracing %v", err)
+	}
+	// the run once modes flush on return, the proxy and healer modes on a termination signal
+	defer shutdown()
+	handleShutdownSignals()
+	if err := metrics.StartOTLPExport(); err != nil {
+		log.Fatalf("failed to set up the otlp metrics export %v", err)
+	}
+	if err := util.InitErrorReporting(gitCommit); err != nil {
+		log.Fatalf("failed to set up error reporting %v", err)
+	}
 
 	var router *mux.Router
 	if util.IsInitializer(&mode) {
@@ -74,18 +100,81 @@ func main() {
 		// run once for initialization and exit
 		workflow.ConfigKeysJWTs(true)
 		return
+	} else if util.IsBootstrap(&mode) {
+		// run once to create the declared resources and exit
+		policy.Initialize()
+		if err := workflow.RunBootstrap(); err != nil {
+			log.Fatalf("bootstrap failed %v", err)
+		}
+		return
+	} else if util.IsBackup(&mode) {
+		// run once to write a snapshot of the policy stores and exit
+		policy.Initialize()
+		snapshot, err := policy.BackupToFile(*snapshotFile)
+		if err != nil {
+			log.Fatalf("backup failed %v", err)
+		}
+		log.Infof("wrote the snapshot of %d tenants to %s", len(snapshot.Tenants), *snapshotFile)
+		return
+	} else if util.IsRestore(&mode) {
+		// run once to restore the policy stores from a snapshot and exit
+		policy.Initialize()
+		report, err := policy.RestoreFromFile(*snapshotFile, *dryRun, *prune)
+		if err != nil {
+			log.Fatalf("restore failed %v", err)
+		}
+		for name, counts := range report.Stores {
+			log.Infof("restored %s created %d updated %d unchanged %d deleted %d dry run %v",
+				name, counts.Created, counts.Updated, counts.Unchanged, counts.Deleted, report.DryRun)
+		}
+		return
+	} else if util.IsMigrate(&mode) {
+		// run once to migrate the policy stores up or down and exit
+		policy.Initialize()
+		if err := policy.WaitForStores(policy.StoreLoadTimeout); err != nil {
+			log.Fatalf("migration failed %v", err)
+		}
+		target := *schemaVersion
+		if target == 0 {
+			target = util.LatestSchemaVersion(util.PolicySchema)
+		}
+		from, _, err := policy.MigratePolicyStores(target)
+		if err != nil {
+			log.Fatalf("migration failed %v", err)
+		}
+		log.Infof("policy stores are migrated from schema version %d to %d", from, target)
+		return
 	} else if util.IsHealer(&mode) {
 		router = route.HealerRouter()
 		workflow.ConfigKeysJWTs(false)
+		util.MarkReady()
 	} else { //default proxy mode
 		route.Init()
-		metrics.Init()
-
+		if err := route.InitAccessLog(); err != nil {
+			log.Fatalf("failed to open the access log %v", err)
+		}
+		route.InitLoki()
 		router = route.NewRouter()
-		if !util.IsStatsMode() {
-			log.Infof("a full proxy mode")
-			logclient.FunctionTopicWatchDog()
-			policy.Initialize()
+		if addr := config.DiagnosticsAddress; addr != "" {
+			go func() {
+				log.Warnf("diagnostics listens on %s", addr)
+				log.Fatal(util.ListenAndServeTLS(addr, config.CertFile, config.KeyFile, route.DiagnosticsRouter()).Error())
+			}()
+		}
+		if config.StartupProbes.MaxWaitSeconds > 0 {
+			// only the liveness and readiness are served while waiting for the dependencies
+			router.Use(route.RequireReady)
+			go func() {
+				if err := util.WaitForDependencies(); err != nil {
+					if config.StartupProbes.ExitOnTimeout {
+						log.Fatalf("startup probes failed %v", err)
+					}
+					log.Errorf("start regardless of the startup probes error %v", err)
+				}
+				startProxy(config)
+			}()
+		} else {
+			startProxy(config)
 		}
 	}
 
@@ -100,9 +189,68 @@ func main() {
 	certFile := util.GetConfig().CertFile
 	keyFile := util.GetConfig().KeyFile
 	port := util.AssignString(config.PORT, "8080")
-	err := httptls.ListenAndServeTLS(":"+port, certFile, keyFile, handler)
+	err := util.ListenAndServeTLS(":"+port, certFile, keyFile, handler)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 }
+
+// shutdown flushes the pending telemetry before the process exits
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := util.ShutdownTracing(ctx); err != nil {
+		log.Errorf("failed to flush the pending spans %v", err)
+	}
+	if !util.FlushErrorReports(shutdownTimeout) {
+		log.Errorf("failed to send the pending error reports within %v", shutdownTimeout)
+	}
+}
+
+// handleShutdownSignals runs the shutdown on SIGINT and SIGTERM, then exits
+func handleShutdownSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Warnf("shut down on %v", s)
+		shutdown()
+		os.Exit(0)
+	}()
+}
+
+// startProxy starts the background loops and the stores of the proxy mode, then marks the replica ready
+func startProxy(config *util.Configuration) {
+	if config.LeaderElection.Enabled {
+		if err := k8s.StartLeaderElection(context.Background()); err != nil {
+			log.Fatalf("failed to start leader election %v", err)
+		}
+	}
+	metrics.Init()
+	metrics.StartS3Export()
+	util.StartFailoverProbes()
+	if !util.IsStatsMode() {
+		log.Infof("a full proxy mode")
+		logclient.FunctionTopicWatchDog()
+		logclient.StartFluentForward()
+		policy.Initialize()
+		route.StartDebugSubscriptionSweep()
+		policy.StartMigrations()
+		if err := workflow.RunBootstrap(); err != nil {
+			log.Errorf("bootstrap manifest error %v", err)
+		}
+		workflow.StartReconciliation()
+		workflow.StartGitOps()
+		if err := workflow.StartOperator(); err != nil {
+			log.Fatalf("failed to start the operator %v", err)
+		}
+		if err := pulsarproxy.Start(); err != nil {
+			log.Fatalf("failed to start the binary protocol proxy %v", err)
+		}
+	}
+	if err := util.StartScheduler(); err != nil {
+		log.Fatalf("failed to start the scheduler %v", err)
+	}
+	util.MarkReady()
+}
@@ -0,0 +1,364 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Alerting rules evaluated against the federated metrics cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Alert is a firing or resolved alert of a rule on a tenant, namespace, or topic
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Expr       string     `json:"expr"`
+	Tenant     string     `json:"tenant"`
+	Key        string     `json:"key"`
+	Value      float64    `json:"value"`
+	Status     string     `json:"status"`
+	StartsAt   time.Time  `json:"startsAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+const (
+	// AlertFiring is the status of an active alert
+	AlertFiring = "firing"
+	// AlertResolved is the status of an alert whose condition no longer holds
+	AlertResolved = "resolved"
+
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// Summary returns a human readable description of the alert
+func (a Alert) Summary() string {
+	return fmt.Sprintf("[%s] %s on %s: %s (value %v)", strings.ToUpper(a.Status), a.Rule, a.Key, a.Expr, a.Value)
+}
+
+type alertRule struct {
+	util.AlertRule
+	metric    string
+	matchers  map[string]string
+	op        string
+	threshold float64
+}
+
+type alertState struct {
+	count int
+	alert *Alert
+}
+
+var (
+	alertExprPattern    = regexp.MustCompile(`^\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(\{[^}]*\})?\s*(>=|<=|==|!=|>|<)\s*([-+0-9.eE]+)\s*$`)
+	alertMatcherPattern = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"([^"]*)"\s*$`)
+
+	alertLock   = sync.RWMutex{}
+	alertRules  = []*alertRule{}
+	alertStates = make(map[string]*alertState)
+
+	alertClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// InitAlertRules compiles the alert rules, it replaces any rules and alert states
+func InitAlertRules(rules []util.AlertRule) error {
+	compiled := make([]*alertRule, 0, len(rules))
+	for _, r := range rules {
+		rule, err := compileAlertRule(r)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, rule)
+	}
+	alertLock.Lock()
+	alertRules = compiled
+	alertStates = make(map[string]*alertState)
+	alertLock.Unlock()
+	return nil
+}
+
+func compileAlertRule(r util.AlertRule) (*alertRule, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("alert rule requires a name")
+	}
+	switch r.By {
+	case "":
+		r.By = "topic"
+	case "tenant", "namespace", "topic":
+	default:
+		return nil, fmt.Errorf("alert rule %s has unsupported aggregation %s", r.Name, r.By)
+	}
+	if r.For < 1 {
+		r.For = 1
+	}
+	parts := alertExprPattern.FindStringSubmatch(r.Expr)
+	if parts == nil {
+		return nil, fmt.Errorf("alert rule %s has invalid expression %s", r.Name, r.Expr)
+	}
+	threshold, err := strconv.ParseFloat(parts[4], 64)
+	if err != nil {
+		return nil, fmt.Errorf("alert rule %s has invalid threshold %v", r.Name, err)
+	}
+	matchers := make(map[string]string)
+	if selector := strings.Trim(parts[2], "{}"); strings.TrimSpace(selector) != "" {
+		for _, m := range strings.Split(selector, ",") {
+			kv := alertMatcherPattern.FindStringSubmatch(m)
+			if kv == nil {
+				return nil, fmt.Errorf("alert rule %s has invalid label matcher %s", r.Name, m)
+			}
+			matchers[kv[1]] = kv[2]
+		}
+	}
+	return &alertRule{
+		AlertRule: r,
+		metric:    parts[1],
+		matchers:  matchers,
+		op:        parts[3],
+		threshold: threshold,
+	}, nil
+}
+
+func (r *alertRule) holds(value float64) bool {
+	switch r.op {
+	case ">":
+		return value > r.threshold
+	case ">=":
+		return value >= r.threshold
+	case "<":
+		return value < r.threshold
+	case "<=":
+		return value <= r.threshold
+	case "==":
+		return value == r.threshold
+	default:
+		return value != r.threshold
+	}
+}
+
+// aggregate sums the matching series by the aggregation key, it returns the values and the tenant of each key
+func (r *alertRule) aggregate(mf *dto.MetricFamily) (map[string]float64, map[string]string) {
+	values := make(map[string]float64)
+	keyTenants := make(map[string]string)
+	for _, m := range mf.GetMetric() {
+		labels := make(map[string]string)
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if !r.matches(labels) {
+			continue
+		}
+		tenant := strings.Split(labels["namespace"], "/")[0]
+		if tenant == "" || (len(r.Tenants) > 0 && !util.StrContains(r.Tenants, tenant)) {
+			continue
+		}
+		var key string
+		switch r.By {
+		case "tenant":
+			key = tenant
+		case "namespace":
+			key = labels["namespace"]
+		default:
+			key = labels["topic"]
+		}
+		if key == "" {
+			continue
+		}
+		values[key] += seriesValue(m)
+		keyTenants[key] = tenant
+	}
+	return values, keyTenants
+}
+
+func (r *alertRule) matches(labels map[string]string) bool {
+	for k, v := range r.matchers {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func seriesValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	default:
+		return m.GetUntyped().GetValue()
+	}
+}
+
+// EvaluateAlertRules evaluates all the rules against the metric families of a scrape
+// and notifies the receivers about fired and resolved alerts
+func EvaluateAlertRules(metricFamilies map[string]*dto.MetricFamily) {
+	type notification struct {
+		alert     Alert
+		receivers []util.AlertReceiver
+	}
+	notifications := []notification{}
+	now := time.Now()
+
+	alertLock.Lock()
+	for _, rule := range alertRules {
+		values, keyTenants := map[string]float64{}, map[string]string{}
+		if mf, ok := metricFamilies[rule.metric]; ok {
+			values, keyTenants = rule.aggregate(mf)
+		}
+		prefix := rule.Name + "|"
+		for key, value := range values {
+			if !rule.holds(value) {
+				continue
+			}
+			id := prefix + key
+			state, ok := alertStates[id]
+			if !ok {
+				state = &alertState{}
+				alertStates[id] = state
+			}
+			state.count++
+			if state.alert != nil {
+				state.alert.Value = value
+			} else if state.count >= rule.For {
+				state.alert = &Alert{
+					Rule:     rule.Name,
+					Expr:     rule.Expr,
+					Tenant:   keyTenants[key],
+					Key:      key,
+					Value:    value,
+					Status:   AlertFiring,
+					StartsAt: now,
+				}
+				notifications = append(notifications, notification{*state.alert, rule.Receivers})
+			}
+		}
+		for id, state := range alertStates {
+			if !strings.HasPrefix(id, prefix) {
+				continue
+			}
+			key := strings.TrimPrefix(id, prefix)
+			if value, ok := values[key]; ok && rule.holds(value) {
+				continue
+			}
+			if state.alert != nil {
+				resolved := *state.alert
+				resolved.Status = AlertResolved
+				resolved.ResolvedAt = &now
+				if value, ok := values[key]; ok {
+					resolved.Value = value
+				}
+				notifications = append(notifications, notification{resolved, rule.Receivers})
+			}
+			delete(alertStates, id)
+		}
+	}
+	alertLock.Unlock()
+
+	for _, n := range notifications {
+		receivers := append([]util.AlertReceiver{}, n.receivers...)
+		receivers = append(receivers, util.GetConfig().TenantAlertReceivers[n.alert.Tenant]...)
+		go notifyAlert(n.alert, receivers)
+		util.Notify(util.EventThresholdCrossed, n.alert.Tenant, n.alert.Rule+"|"+n.alert.Key, 0, n.alert)
+	}
+}
+
+// GetFiringAlerts returns the firing alerts of a tenant, or all tenants if the tenant is empty
+func GetFiringAlerts(tenant string) []Alert {
+	alerts := []Alert{}
+	alertLock.RLock()
+	for _, state := range alertStates {
+		if state.alert != nil && (tenant == "" || state.alert.Tenant == tenant) {
+			alerts = append(alerts, *state.alert)
+		}
+	}
+	alertLock.RUnlock()
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].StartsAt.Before(alerts[j].StartsAt)
+	})
+	return alerts
+}
+
+func notifyAlert(alert Alert, receivers []util.AlertReceiver) {
+	logger.Infof("%s", alert.Summary())
+	for _, r := range receivers {
+		if err := sendAlert(r, alert); err != nil {
+			logger.Errorf("failed to send alert %s to %s receiver error %v", alert.Rule, r.Type, err)
+		}
+	}
+}
+
+func sendAlert(r util.AlertReceiver, alert Alert) error {
+	var payload interface{}
+	url := r.URL
+	switch strings.ToLower(r.Type) {
+	case "slack":
+		payload = map[string]string{"text": alert.Summary()}
+	case "pagerduty":
+		if url == "" {
+			url = pagerDutyEventsURL
+		}
+		action := "trigger"
+		if alert.Status == AlertResolved {
+			action = "resolve"
+		}
+		payload = map[string]interface{}{
+			"routing_key":  r.RoutingKey,
+			"event_action": action,
+			"dedup_key":    alert.Rule + "|" + alert.Key,
+			"payload": map[string]interface{}{
+				"summary":        alert.Summary(),
+				"source":         "burnell",
+				"severity":       "warning",
+				"custom_details": alert,
+			},
+		}
+	default:
+		payload = alert
+	}
+	if url == "" {
+		return fmt.Errorf("missing receiver url")
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := alertClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("failure status code %v", resp.StatusCode)
+	}
+	return nil
+}
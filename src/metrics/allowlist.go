@@ -0,0 +1,66 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Per tenant metric allowlist of the federated metrics
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// FilterMetricNames keeps the series, HELP, and TYPE lines of the metrics matching any of the name prefixes
+func FilterMetricNames(data []byte, prefixes []string) []byte {
+	if len(prefixes) == 0 {
+		return data
+	}
+	allowed := func(name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		name := ""
+		if fields := bytes.Fields(line); len(fields) >= 3 && line[0] == '#' &&
+			(bytes.Equal(fields[1], []byte("HELP")) || bytes.Equal(fields[1], []byte("TYPE"))) {
+			name = string(fields[2])
+		} else if len(line) > 0 && line[0] != '#' {
+			name = seriesName(line)
+		}
+		if name != "" && !allowed(name) {
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,66 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the API usage per route class and of the top talking subjects
+
+import (
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	apiClassRequestsDesc = prometheus.NewDesc("burnell_api_requests_total",
+		"The number of requests per route class", []string{"class"}, nil)
+	apiClassErrorsDesc = prometheus.NewDesc("burnell_api_errors_total",
+		"The number of requests with a 5xx status per route class", []string{"class"}, nil)
+	apiClassDeniedDesc = prometheus.NewDesc("burnell_api_denied_requests_total",
+		"The number of requests rejected with a 401, 403, or 429 status per route class", []string{"class"}, nil)
+	apiTopTalkerDesc = prometheus.NewDesc("burnell_api_top_subject_request_rate",
+		"The request rate per second over the last five minutes of the top talking subjects", []string{"subject"}, nil)
+)
+
+// apiUsageCollector collects the route class counters and the top talkers at scrape time,
+// only the top talkers are labeled by subject to bound the cardinality
+type apiUsageCollector struct{}
+
+func (apiUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- apiClassRequestsDesc
+	ch <- apiClassErrorsDesc
+	ch <- apiClassDeniedDesc
+	ch <- apiTopTalkerDesc
+}
+
+func (apiUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	for class, c := range util.GetAPIClassTotals() {
+		ch <- prometheus.MustNewConstMetric(apiClassRequestsDesc, prometheus.CounterValue, float64(c.Requests), class)
+		ch <- prometheus.MustNewConstMetric(apiClassErrorsDesc, prometheus.CounterValue, float64(c.Errors), class)
+		ch <- prometheus.MustNewConstMetric(apiClassDeniedDesc, prometheus.CounterValue, float64(c.Denied), class)
+	}
+	for _, talker := range util.GetAPITopTalkers(util.APITopTalkers()) {
+		ch <- prometheus.MustNewConstMetric(apiTopTalkerDesc, prometheus.GaugeValue, talker.RatePerSecond, talker.Subject)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(apiUsageCollector{})
+}
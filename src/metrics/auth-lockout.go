@@ -0,0 +1,48 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self metrics of the auth lockout
+
+import (
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_auth_failures_total",
+		Help: "Failed token validations",
+	}, func() float64 { return float64(util.GetAuthLockoutStats().Failures) }))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_auth_bans_total",
+		Help: "Source IPs and subjects banned after repeated failed token validations",
+	}, func() float64 { return float64(util.GetAuthLockoutStats().Bans) }))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_auth_banned_requests_total",
+		Help: "Requests rejected because of a ban",
+	}, func() float64 { return float64(util.GetAuthLockoutStats().Rejections) }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "burnell_auth_active_bans",
+		Help: "Active bans of source IPs and subjects",
+	}, func() float64 { return float64(util.GetAuthLockoutStats().Banned) }))
+}
@@ -0,0 +1,122 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Broker fleet metrics aggregated per broker from the cluster wide metrics cache
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// BrokerMetrics are the topic count, the rates, and the error rates of a broker
+type BrokerMetrics struct {
+	Broker        string  `json:"broker"`
+	Topics        int     `json:"topics"`
+	RateIn        float64 `json:"rateIn"`
+	RateOut       float64 `json:"rateOut"`
+	ThroughputIn  float64 `json:"throughputIn"`
+	ThroughputOut float64 `json:"throughputOut"`
+	Backlog       float64 `json:"backlog"`
+	// ErrorRate is the managed ledger add and read entry errors per second
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// brokerLabels identify the broker of a series, the pod name is preferred over the scrape instance
+var brokerLabels = []string{"kubernetes_pod_name", "instance"}
+
+// GetBrokerFleetMetrics aggregates the metrics of every broker from the cluster wide metrics cache
+func GetBrokerFleetMetrics() ([]BrokerMetrics, error) {
+	data, err := GetTenantPromMetrics(SuperRole)
+	if err != nil {
+		return nil, err
+	}
+	return BrokerFleetMetrics(data)
+}
+
+// BrokerFleetMetrics aggregates the metrics of every broker in the Prometheus text format data
+func BrokerFleetMetrics(data []byte) ([]BrokerMetrics, error) {
+	parser := expfmt.TextParser{}
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := make(map[string]*BrokerMetrics)
+	topics := make(map[string]map[string]bool)
+	for _, name := range []string{"pulsar_rate_in", "pulsar_rate_out", "pulsar_throughput_in", "pulsar_throughput_out",
+		"pulsar_msg_backlog", "pulsar_ml_AddEntryErrors", "pulsar_ml_ReadEntriesErrors"} {
+		mf, ok := metricFamilies[name]
+		if !ok {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			var broker string
+			for _, label := range brokerLabels {
+				if broker = labels[label]; broker != "" {
+					break
+				}
+			}
+			if broker == "" {
+				continue
+			}
+			b, ok := brokers[broker]
+			if !ok {
+				b = &BrokerMetrics{Broker: broker}
+				brokers[broker] = b
+				topics[broker] = make(map[string]bool)
+			}
+			if topic := labels["topic"]; topic != "" {
+				topics[broker][topic] = true
+			}
+			value := seriesValue(m)
+			switch name {
+			case "pulsar_rate_in":
+				b.RateIn += value
+			case "pulsar_rate_out":
+				b.RateOut += value
+			case "pulsar_throughput_in":
+				b.ThroughputIn += value
+			case "pulsar_throughput_out":
+				b.ThroughputOut += value
+			case "pulsar_msg_backlog":
+				b.Backlog += value
+			default:
+				b.ErrorRate += value
+			}
+		}
+	}
+
+	fleet := make([]BrokerMetrics, 0, len(brokers))
+	for name, b := range brokers {
+		b.Topics = len(topics[name])
+		fleet = append(fleet, *b)
+	}
+	sort.Slice(fleet, func(i, j int) bool { return fleet[i].Broker < fleet[j].Broker })
+	return fleet, nil
+}
@@ -0,0 +1,141 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Cardinality protection of the federated metrics cache
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cardinalityLock    = sync.RWMutex{}
+	maxSeriesPerMetric = 0
+	maxSeriesPerTenant = 0
+
+	droppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "burnell_federated_series_dropped_total",
+		Help: "The number of federated series dropped by the cardinality limits",
+	}, []string{"reason", "tenant"})
+
+	tenantSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "burnell_federated_tenant_series",
+		Help: "The number of federated series per tenant in the last scrape",
+	}, []string{"tenant"})
+)
+
+func init() {
+	prometheus.MustRegister(droppedSeries, tenantSeries)
+}
+
+// SetCardinalityLimits sets the maximum number of series per metric and per tenant, 0 is unlimited
+func SetCardinalityLimits(perMetric, perTenant int) {
+	cardinalityLock.Lock()
+	maxSeriesPerMetric = perMetric
+	maxSeriesPerTenant = perTenant
+	cardinalityLock.Unlock()
+}
+
+// LimitCardinality drops the series exceeding the per metric or per tenant limit from the Prometheus text data
+func LimitCardinality(data []byte) []byte {
+	limiter := newCardinalityLimiter()
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if limiter.admit(line) {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	limiter.done()
+	return buf.Bytes()
+}
+
+// cardinalityLimiter counts the series of a single scrape line by line
+type cardinalityLimiter struct {
+	perMetric    int
+	perTenant    int
+	metricCounts map[string]int
+	tenantCounts map[string]int
+	dropped      int
+}
+
+func newCardinalityLimiter() *cardinalityLimiter {
+	cardinalityLock.RLock()
+	defer cardinalityLock.RUnlock()
+	return &cardinalityLimiter{
+		perMetric:    maxSeriesPerMetric,
+		perTenant:    maxSeriesPerTenant,
+		metricCounts: make(map[string]int),
+		tenantCounts: make(map[string]int),
+	}
+}
+
+// admit returns false if the line is a series over the per metric or per tenant limit
+func (l *cardinalityLimiter) admit(line []byte) bool {
+	if len(line) == 0 || line[0] == '#' {
+		return true
+	}
+
+	name := seriesName(line)
+	tenant := string(seriesTenant(line))
+
+	if l.perMetric > 0 && l.metricCounts[name] >= l.perMetric {
+		droppedSeries.WithLabelValues("metric", tenant).Inc()
+		l.dropped++
+		return false
+	}
+	if l.perTenant > 0 && tenant != "" && l.tenantCounts[tenant] >= l.perTenant {
+		droppedSeries.WithLabelValues("tenant", tenant).Inc()
+		l.dropped++
+		return false
+	}
+	l.metricCounts[name]++
+	if tenant != "" {
+		l.tenantCounts[tenant]++
+	}
+	return true
+}
+
+// done publishes the number of series per tenant in the scrape
+func (l *cardinalityLimiter) done() {
+	for tenant, count := range l.tenantCounts {
+		tenantSeries.WithLabelValues(tenant).Set(float64(count))
+	}
+	if l.dropped > 0 {
+		logger.Warnf("dropped %d series over the cardinality limits, %d per metric and %d per tenant", l.dropped, l.perMetric, l.perTenant)
+	}
+}
+
+func seriesName(line []byte) string {
+	if i := bytes.IndexAny(line, "{ "); i >= 0 {
+		return string(line[:i])
+	}
+	return string(line)
+}
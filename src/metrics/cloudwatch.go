@@ -0,0 +1,188 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// CloudWatch embedded metric format export of the metrics selected in the tenant settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/common/expfmt"
+)
+
+// emfMetadata is the _aws member of an embedded metric format record
+type emfMetadata struct {
+	Timestamp         int64                `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+type emfMetricDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+}
+
+// emfMaxMetrics is the limit of the metrics in a record
+const emfMaxMetrics = 100
+
+// StartCloudWatchExport writes the records of every tenant with CloudWatch metrics in its settings on the interval,
+// only the leader exports when the leader election is enabled
+func StartCloudWatchExport() {
+	cfg := util.GetConfig().CloudWatchEMF
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if !util.IsLeader() {
+				continue
+			}
+			for _, tenant := range TenantNames() {
+				if len(util.TenantSettingsOf(tenant).CloudWatchMetrics) == 0 {
+					continue
+				}
+				if err := ExportCloudWatchEMF(tenant); err != nil {
+					logger.Errorf("failed to export the metrics of tenant %s to cloudwatch %v", tenant, err)
+				}
+			}
+		}
+	}()
+}
+
+// ExportCloudWatchEMF writes the embedded metric format records of a tenant to the configured endpoint
+func ExportCloudWatchEMF(tenant string) error {
+	data, err := GetTenantPromMetrics(tenant)
+	if err != nil {
+		return err
+	}
+	records, err := CloudWatchEMFRecords(tenant, data, util.TenantSettingsOf(tenant), time.Now())
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	endpoint := util.AssignString(util.GetConfig().CloudWatchEMF.Endpoint, "stdout")
+	var w io.Writer = os.Stdout
+	if endpoint != "stdout" {
+		parts := strings.SplitN(endpoint, "://", 2)
+		if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "udp") {
+			return fmt.Errorf("unsupported cloudwatch endpoint %s", endpoint)
+		}
+		conn, err := net.DialTimeout(parts[0], parts[1], 10*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		w = conn
+	}
+	for _, record := range records {
+		// a record is a line, and a datagram of the udp endpoint
+		if _, err := w.Write(append(record, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloudWatchEMFRecords builds an embedded metric format record per Pulsar namespace of the tenant. The series of
+// a selected metric are summed per namespace, so the dimensions stay at the Tenant and the Namespace to bound
+// the number of CloudWatch metrics.
+func CloudWatchEMFRecords(tenant string, data []byte, settings util.TenantSettings, now time.Time) ([][]byte, error) {
+	var selected bytes.Buffer
+	for _, name := range settings.CloudWatchMetrics {
+		selected.Write(selectMetricFamily(data, name))
+	}
+	parser := expfmt.TextParser{}
+	metricFamilies, err := parser.TextToMetricFamilies(&selected)
+	if err != nil {
+		return nil, err
+	}
+
+	// the summed values by namespace and metric name
+	namespaces := map[string]map[string]float64{}
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			namespace := ""
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "namespace" {
+					namespace = lp.GetValue()
+				}
+			}
+			if strings.Split(namespace, "/")[0] != tenant {
+				continue
+			}
+			if _, ok := namespaces[namespace]; !ok {
+				namespaces[namespace] = map[string]float64{}
+			}
+			namespaces[namespace][name] += seriesValue(m)
+		}
+	}
+
+	cwNamespace := util.AssignString(settings.CloudWatchNamespace, "Pulsar/"+tenant)
+	names := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	records := [][]byte{}
+	for _, namespace := range names {
+		values := namespaces[namespace]
+		metricNames := make([]string, 0, len(values))
+		for name := range values {
+			metricNames = append(metricNames, name)
+		}
+		sort.Strings(metricNames)
+		for start := 0; start < len(metricNames); start += emfMaxMetrics {
+			end := start + emfMaxMetrics
+			if end > len(metricNames) {
+				end = len(metricNames)
+			}
+			directive := emfMetricDirective{Namespace: cwNamespace, Dimensions: [][]string{{"Tenant", "Namespace"}}}
+			record := map[string]interface{}{"Tenant": tenant, "Namespace": namespace}
+			for _, name := range metricNames[start:end] {
+				directive.Metrics = append(directive.Metrics, emfMetric{Name: name})
+				record[name] = values[name]
+			}
+			record["_aws"] = emfMetadata{Timestamp: now.UnixNano() / int64(time.Millisecond), CloudWatchMetrics: []emfMetricDirective{directive}}
+			line, err := json.Marshal(record)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, line)
+		}
+	}
+	return records, nil
+}
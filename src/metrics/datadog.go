@@ -0,0 +1,231 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Datadog output of the tenant metrics, served as a series payload or pushed to the tenants' Datadog accounts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DatadogSeries is a series of the Datadog series API
+type DatadogSeries struct {
+	Metric string       `json:"metric"`
+	Points [][2]float64 `json:"points"`
+	Type   string       `json:"type"`
+	Tags   []string     `json:"tags,omitempty"`
+}
+
+// DatadogPayload is the body of the Datadog series API
+type DatadogPayload struct {
+	Series []DatadogSeries `json:"series"`
+}
+
+const (
+	defaultDatadogSite = "datadoghq.com"
+)
+
+// datadogDroppedLabels are the labels of the federation and the scrape jobs, they are not tags of a tenant metric
+var datadogDroppedLabels = map[string]bool{
+	"app": true, "component": true, "instance": true, "job": true, "pod_template_hash": true, "release": true,
+	"kubernetes_namespace": true, "kubernetes_pod_name": true, "prometheus": true, "prometheus_replica": true,
+}
+
+var (
+	datadogPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "burnell_datadog_pushes_total",
+		Help: "The number of pushes of the tenant metrics to Datadog per tenant and result",
+	}, []string{"tenant", "result"})
+
+	datadogClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+func init() {
+	prometheus.MustRegister(datadogPushes)
+}
+
+// DatadogMetricName maps a Prometheus metric name to a Datadog name, the first underscore separates the namespace
+// such as pulsar.subscription_back_log
+func DatadogMetricName(name string) string {
+	return strings.Replace(name, "_", ".", 1)
+}
+
+// DatadogMetrics converts the Prometheus text format data to Datadog gauge series. The labels are the tags except
+// the labels of the federation, and the extra tags are added to every series. A summary or a histogram is split into
+// the count, the sum, and the quantile series.
+func DatadogMetrics(data []byte, extraTags []string) ([]DatadogSeries, error) {
+	parser := expfmt.TextParser{}
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	now := float64(time.Now().Unix())
+	series := []DatadogSeries{}
+	add := func(name string, m *dto.Metric, value float64, tags ...string) {
+		timestamp := now
+		if m.TimestampMs != nil {
+			timestamp = float64(m.GetTimestampMs() / 1000)
+		}
+		for _, lp := range m.GetLabel() {
+			if !datadogDroppedLabels[lp.GetName()] {
+				tags = append(tags, lp.GetName()+":"+lp.GetValue())
+			}
+		}
+		series = append(series, DatadogSeries{
+			Metric: DatadogMetricName(name),
+			Points: [][2]float64{{timestamp, value}},
+			Type:   "gauge",
+			Tags:   append(tags, extraTags...),
+		})
+	}
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_SUMMARY:
+				add(name+".count", m, float64(m.GetSummary().GetSampleCount()))
+				add(name+".sum", m, m.GetSummary().GetSampleSum())
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name+".quantile", m, q.GetValue(), "quantile:"+strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64))
+				}
+			case dto.MetricType_HISTOGRAM:
+				add(name+".count", m, float64(m.GetHistogram().GetSampleCount()))
+				add(name+".sum", m, m.GetHistogram().GetSampleSum())
+			default:
+				add(name, m, seriesValue(m))
+			}
+		}
+	}
+	return series, nil
+}
+
+// StartDatadogPush pushes the metrics of the configured tenants on the interval,
+// only the leader pushes when the leader election is enabled
+func StartDatadogPush() {
+	cfg := util.GetConfig().Datadog
+	if len(cfg.Tenants) == 0 {
+		return
+	}
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	logger.Infof("push the metrics of %d tenants to Datadog at interval %v", len(cfg.Tenants), interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if util.IsLeader() {
+				for _, t := range util.GetConfig().Datadog.Tenants {
+					if err := PushDatadogMetrics(t); err != nil {
+						logger.Errorf("failed to push the metrics of tenant %s to Datadog %v", t.Tenant, err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// PushDatadogMetrics pushes the cached metrics of a tenant, filtered by the tenant's metric allowlist,
+// to the DogStatsD agent or the series API of the tenant
+func PushDatadogMetrics(t util.DatadogTenant) (err error) {
+	defer func() {
+		if err != nil {
+			datadogPushes.WithLabelValues(t.Tenant, "error").Inc()
+		} else {
+			datadogPushes.WithLabelValues(t.Tenant, "ok").Inc()
+		}
+	}()
+	data, err := GetTenantPromMetrics(t.Tenant)
+	if err != nil {
+		return err
+	}
+	data = FilterMetricNames(data, util.TenantSettingsOf(t.Tenant).MetricAllowlist)
+	series, err := DatadogMetrics(data, t.Tags)
+	if err != nil {
+		return err
+	}
+	if t.StatsdAddress != "" {
+		return sendStatsd(t.StatsdAddress, series)
+	}
+	return postDatadogSeries(t, series)
+}
+
+// postDatadogSeries sends the series to the v1 series API of the tenant's site
+func postDatadogSeries(t util.DatadogTenant, series []DatadogSeries) error {
+	body, err := json.Marshal(DatadogPayload{Series: series})
+	if err != nil {
+		return err
+	}
+	site := util.AssignString(t.Site, defaultDatadogSite)
+	apiURL := "https://api." + site + "/api/v1/series"
+	if strings.HasPrefix(site, "http://") || strings.HasPrefix(site, "https://") {
+		apiURL = strings.TrimSuffix(site, "/") + "/api/v1/series"
+	}
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", t.APIKey)
+	resp, err := datadogClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("datadog series API responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// statsdTagEscaper replaces the separators of the DogStatsD datagram in a tag
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+
+// sendStatsd sends the series as DogStatsD gauges
+func sendStatsd(address string, series []DatadogSeries) error {
+	lines := make([]string, 0, len(series))
+	for _, s := range series {
+		line := s.Metric + ":" + strconv.FormatFloat(s.Points[0][1], 'g', -1, 64) + "|g"
+		if len(s.Tags) > 0 {
+			tags := make([]string, len(s.Tags))
+			for i, tag := range s.Tags {
+				tags[i] = statsdTagEscaper.Replace(tag)
+			}
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+	return writeStatsd(address, lines)
+}
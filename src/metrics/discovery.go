@@ -0,0 +1,91 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Kubernetes service discovery of the federated Prometheus
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/datastax/burnell/src/k8s"
+	"github.com/datastax/burnell/src/util"
+)
+
+// federationTarget is the discovered federated Prometheus URL
+var federationTarget atomic.Value
+
+func init() {
+	// the discovered target is not known until the discovery starts, only the configured URL is probed
+	util.RegisterStartupProbe(util.ProbePrometheus, func() error {
+		if util.GetConfig().FederatedPromURL == "" {
+			return nil
+		}
+		return util.ProbeURL(util.GetConfig().FederatedPromURL)
+	})
+}
+
+// FederatedPromURL returns the discovered federated Prometheus URL, or the configured FederatedPromURL
+func FederatedPromURL() string {
+	if url, ok := federationTarget.Load().(string); ok && url != "" {
+		return url
+	}
+	return util.GetConfig().FederatedPromURL
+}
+
+// initDiscovery starts the periodic discovery of the federated Prometheus service
+// if a label selector is configured; it returns whether the discovery is enabled
+func initDiscovery() bool {
+	cfg := util.GetConfig()
+	if cfg.FederatedPromSelector == "" {
+		return false
+	}
+	client, err := k8s.GetK8sClient()
+	if err != nil {
+		logger.Errorf("federated prometheus discovery is disabled, failed to get k8s clientset %v", err)
+		return false
+	}
+	namespace := util.AssignString(cfg.FederatedPromNamespace, cfg.PulsarNamespace, "default")
+	path := util.AssignString(cfg.FederatedPromPath, "/federate")
+	interval := time.Duration(util.GetEnvInt("FederatedPromDiscoveryIntervalSeconds", 30)) * time.Second
+
+	discover := func() {
+		url, err := client.DiscoverServiceURL(namespace, cfg.FederatedPromSelector, cfg.FederatedPromPort, path)
+		if err != nil {
+			// keep the last known target until a new one is discovered
+			logger.Errorf("federated prometheus discovery error %v", err)
+			return
+		}
+		if current := FederatedPromURL(); current != url {
+			logger.Infof("discovered federated prometheus %s replaces %s", url, current)
+			federationTarget.Store(url)
+		}
+	}
+	discover()
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			discover()
+		}
+	}()
+	return true
+}
@@ -0,0 +1,54 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the active/standby upstream failover
+
+import (
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	failoverEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "burnell_upstream_failover_total",
+		Help: "The number of failovers to the standby and failbacks to the primary per cluster",
+	}, []string{"cluster", "to"})
+
+	standbyActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "burnell_upstream_standby_active",
+		Help: "Whether the cluster is served by its standby endpoints",
+	}, []string{"cluster"})
+)
+
+func init() {
+	prometheus.MustRegister(failoverEvents, standbyActive)
+	util.SetFailoverListener(func(cluster string, standby bool) {
+		if standby {
+			failoverEvents.WithLabelValues(cluster, "standby").Inc()
+			standbyActive.WithLabelValues(cluster).Set(1)
+		} else {
+			failoverEvents.WithLabelValues(cluster, "primary").Inc()
+			standbyActive.WithLabelValues(cluster).Set(0)
+		}
+	})
+}
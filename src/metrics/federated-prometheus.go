@@ -24,18 +24,25 @@ package metrics
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"hash/fnv"
+	"io"
+	"net"
 	"net/http"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/datastax/burnell/src/util"
 	"github.com/hashicorp/go-memdb"
 	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //Usage is the data usage per single tenant
@@ -47,6 +54,8 @@ type Usage struct {
 	TotalBytesOut    uint64    `json:"totalBytesOut"`
 	MsgInBacklog     uint64    `json:"msgInBacklog"`
 	UpdatedAt        time.Time `json:"updatedAt"`
+	// Labels are the cost allocation labels of a namespace
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // TopicPerBrokerUsage is the usage for topic on each individual broker
@@ -64,21 +73,58 @@ type TopicPerBrokerUsage struct {
 	UpdatedAt        time.Time `json:"updatedAt"`
 }
 
-// TenantPromMetrics is a cache for Tenant Prometheus metrics data
+// TenantPromMetrics is the series of a tenant in a scrape with the cache validators of the tenant's metrics
 type TenantPromMetrics struct {
-	promData   []byte
+	series  []series
+	rawSize int
+	etag    string
+	modTime time.Time
+}
+
+// series is a sample line of the federation payload with the index of its metric family,
+// the line shares the payload buffer of the scrape
+type series struct {
+	family int
+	line   []byte
+}
+
+// metricsSnapshot is the federated metrics of a scrape split per tenant. The scraper builds a snapshot once
+// per scrape and swaps it in atomically, a snapshot is immutable once it is stored.
+type metricsSnapshot struct {
+	// families are the comment lines of every metric family in the payload order
+	families [][]byte
+	tenants  map[string]*TenantPromMetrics
+	// names are the sorted tenants, the series without a namespace label are under the empty name
+	names []string
+	// etag and modTime are the cache validators of the metrics of all the tenants
+	etag       string
+	modTime    time.Time
+	size       int
 	updateTime time.Time
 }
 
+// scrapeValidator is the cache validators returned by the federation endpoint
+type scrapeValidator struct {
+	etag         string
+	lastModified string
+}
+
 var (
 	// Tenant and its cache are not threadsafe
 
 	tenants     = make(map[string]bool)
 	tenantsLock = sync.RWMutex{}
 
-	cacheLock = sync.RWMutex{}
-	// the the cache for raw prometheus data
-	cache = make(map[string]*TenantPromMetrics)
+	// the cache of the prometheus data is the snapshot of the last scrape swapped atomically,
+	// the readers never lock while the scrapes are serialized by the scrape lock
+	cache      atomic.Value
+	scrapeLock = sync.Mutex{}
+	// scrapeTrigger asks the scraper for a scrape ahead of the interval
+	scrapeTrigger = make(chan struct{}, 1)
+
+	validatorsLock = sync.RWMutex{}
+	// the validators for conditional scraping per federation url
+	scrapeValidators = make(map[string]scrapeValidator)
 )
 
 var tenantMetricNames = map[string]bool{
@@ -89,28 +135,222 @@ var tenantMetricNames = map[string]bool{
 	"pulsar_msg_backlog":        true,
 }
 
-var logger = log.WithFields(log.Fields{"app": "burnell,federated-prom-scraper"})
+var logger = util.ModuleLogger("metrics").WithFields(log.Fields{"app": "burnell,federated-prom-scraper"})
+
+// SetCache replaces the cache with a federation payload split per tenant the same as a scrape,
+// the tenants' metrics are written through to the shared cache if it is enabled
+func SetCache(data []byte) {
+	scrapeLock.Lock()
+	defer scrapeLock.Unlock()
+	storeSnapshot(newMetricsSnapshot(data, loadSnapshot(), time.Now()))
+}
+
+// storeSnapshot swaps in the snapshot of a scrape
+func storeSnapshot(snapshot *metricsSnapshot) {
+	cache.Store(snapshot)
+	util.TrackCacheEntry(metricsCacheName, metricsSnapshotKey, int64(snapshot.residentSize()))
+	storeSharedCache(snapshot)
+}
+
+// loadSnapshot returns the snapshot of the last scrape, nil before the first scrape or after an eviction
+func loadSnapshot() *metricsSnapshot {
+	snapshot, _ := cache.Load().(*metricsSnapshot)
+	return snapshot
+}
+
+const (
+	// metricsCacheName is the metrics cache in the cache memory budget
+	metricsCacheName = "metrics"
+	// metricsSnapshotKey is the single entry of the metrics snapshot in the cache memory budget
+	metricsSnapshotKey = "snapshot"
+)
+
+func init() {
+	util.RegisterBudgetedCache(metricsCacheName, func(string) {
+		cache.Store((*metricsSnapshot)(nil))
+	})
+}
+
+// newMetricsSnapshot splits a federation payload into the series of every tenant, the tenant of a series is
+// the first part of its namespace label. The modification time of the tenant metrics unchanged since
+// the previous snapshot is kept.
+func newMetricsSnapshot(data []byte, previous *metricsSnapshot, now time.Time) *metricsSnapshot {
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	snapshot := &metricsSnapshot{
+		tenants:    make(map[string]*TenantPromMetrics),
+		size:       len(data),
+		updateTime: now,
+	}
+	hashes := make(map[string]hash.Hash64)
+	lastFamilies := make(map[string]int)
+	family, headerStart := -1, -1
+	for start := 0; start < len(data); {
+		end := bytes.IndexByte(data[start:], '\n') + start + 1
+		line := data[start:end]
+		switch {
+		case len(bytes.TrimSpace(line)) == 0:
+		case line[0] == '#':
+			if headerStart < 0 {
+				headerStart = start
+			}
+		default:
+			if headerStart >= 0 || family < 0 {
+				if headerStart < 0 {
+					headerStart = start
+				}
+				snapshot.families = append(snapshot.families, data[headerStart:start])
+				family = len(snapshot.families) - 1
+				headerStart = -1
+			}
+			tenant := seriesTenant(line)
+			metrics, ok := snapshot.tenants[string(tenant)]
+			if !ok {
+				metrics = &TenantPromMetrics{}
+				snapshot.tenants[string(tenant)] = metrics
+				hashes[string(tenant)] = fnv.New64a()
+				lastFamilies[string(tenant)] = -1
+			}
+			h := hashes[string(tenant)]
+			if lastFamilies[string(tenant)] != family {
+				lastFamilies[string(tenant)] = family
+				h.Write(snapshot.families[family])
+				metrics.rawSize += len(snapshot.families[family])
+			}
+			h.Write(line)
+			metrics.rawSize += len(line)
+			metrics.series = append(metrics.series, series{family: family, line: line})
+		}
+		start = end
+	}
+	if headerStart >= 0 {
+		snapshot.families = append(snapshot.families, data[headerStart:])
+	}
+
+	all := fnv.New64a()
+	all.Write(data)
+	snapshot.etag = fmt.Sprintf(`"%x"`, all.Sum64())
+	snapshot.modTime = now
+	if previous != nil && previous.etag == snapshot.etag {
+		snapshot.modTime = previous.modTime
+	}
+	for tenant, metrics := range snapshot.tenants {
+		snapshot.names = append(snapshot.names, tenant)
+		metrics.etag = fmt.Sprintf(`"%x"`, hashes[tenant].Sum64())
+		metrics.modTime = now
+		if previous != nil {
+			if last, ok := previous.tenants[tenant]; ok && last.etag == metrics.etag {
+				metrics.modTime = last.modTime
+			}
+		}
+	}
+	sort.Strings(snapshot.names)
+	return snapshot
+}
+
+// seriesTenant returns the tenant of a series line, or an empty tenant without the namespace label
+func seriesTenant(line []byte) []byte {
+	start, end, ok := namespaceLabelValue(line)
+	if !ok {
+		return nil
+	}
+	if i := bytes.IndexByte(line[start:end], '/'); i >= 0 {
+		end = start + i
+	}
+	return line[start:end]
+}
+
+// data returns the metrics of a tenant, or of all the tenants for the SuperRole, in the Prometheus text format
+func (s *metricsSnapshot) data(tenant string) []byte {
+	if tenant == SuperRole {
+		return s.allData()
+	}
+	metrics, ok := s.tenants[tenant]
+	if !ok {
+		return []byte{}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, metrics.rawSize))
+	family := -1
+	for _, series := range metrics.series {
+		if series.family != family {
+			family = series.family
+			buf.Write(s.families[family])
+		}
+		buf.Write(series.line)
+	}
+	return buf.Bytes()
+}
+
+// allData returns the metrics of all the tenants grouped by the metric family in the payload order
+func (s *metricsSnapshot) allData() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, s.size))
+	// the series of a tenant are in the family order, so a cursor per tenant walks them once
+	cursors := make([]int, len(s.names))
+	for family, header := range s.families {
+		buf.Write(header)
+		for i, tenant := range s.names {
+			list := s.tenants[tenant].series
+			for ; cursors[i] < len(list) && list[cursors[i]].family == family; cursors[i]++ {
+				buf.Write(list[cursors[i]].line)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// seriesOverhead is the size of a series entry, the family index and the line slice, on top of its line in the payload buffer
+const seriesOverhead = 32
+
+// residentSize returns the size of the payload buffer and the series entries in memory
+func (s *metricsSnapshot) residentSize() int {
+	size := s.size
+	for _, metrics := range s.tenants {
+		size += cap(metrics.series) * seriesOverhead
+	}
+	return size
+}
 
-// SetCache sets the federated prom cache
-func SetCache(tenant string, data []byte) {
-	cacheLock.Lock()
-	cache[tenant] = &TenantPromMetrics{
-		updateTime: time.Now(),
-		promData:   data,
+// CacheSize returns the payload size and the resident size of the metrics cache in bytes
+func CacheSize() (int, int) {
+	snapshot := loadSnapshot()
+	if snapshot == nil {
+		return 0, 0
 	}
-	cacheLock.Unlock()
+	return snapshot.size, snapshot.residentSize()
 }
 
-// GetCache gets the federated prom cache
+// GetCache gets the federated prom cache of a tenant, or of all the tenants for the SuperRole.
+// The cache TTL can be overridden per tenant. Before the first scrape, a tenant's metrics are read from
+// the shared cache if it is enabled, a shared entry is served as is without installing it locally.
 func GetCache(tenant string) ([]byte, error) {
-	cacheLock.RLock()
-	defer cacheLock.RUnlock()
-	if metrics, ok := cache[tenant]; ok {
-		if time.Since(metrics.updateTime) < scrapeInterval {
-			return metrics.promData, nil
+	ttl := util.TenantSettingsOf(tenant).ScrapeCacheTTL(scrapeInterval)
+	snapshot := loadSnapshot()
+	if snapshot != nil && time.Since(snapshot.updateTime) < ttl {
+		util.TouchCacheEntry(metricsCacheName, metricsSnapshotKey)
+		return snapshot.data(tenant), nil
+	}
+	if snapshot == nil && tenant != SuperRole {
+		if entry, ok := loadSharedCache(tenant); ok && time.Since(entry.UpdateTime) < ttl {
+			return entry.Data, nil
 		}
 	}
-	return nil, fmt.Errorf("error")
+	return nil, fmt.Errorf("missing or expired metrics cache of tenant %s", tenant)
+}
+
+// GetCacheValidators returns the ETag and the last modified time of a tenant's cache
+func GetCacheValidators(tenant string) (string, time.Time, bool) {
+	snapshot := loadSnapshot()
+	if snapshot == nil {
+		return "", time.Time{}, false
+	}
+	if tenant == SuperRole {
+		return snapshot.etag, snapshot.modTime, true
+	}
+	if metrics, ok := snapshot.tenants[tenant]; ok {
+		return metrics.etag, metrics.modTime, true
+	}
+	return "", time.Time{}, false
 }
 
 var usageDb *memdb.MemDB
@@ -120,26 +360,59 @@ const (
 
 	scrapeInterval = 60 * time.Second
 
+	// the connection settings of the scraper, a scrape is bounded by the scrape timeout instead
+	scrapeDialTimeout     = 10 * time.Second
+	scrapeHeaderTimeout   = 30 * time.Second
+	scrapeIdleConnTimeout = 3 * scrapeInterval
+	// scrapeTriggerBackoff is the minimum time between a scrape and a scrape requested ahead of the interval
+	scrapeTriggerBackoff = 5 * time.Second
+
 	// SuperRole is a tenant name used to track access to Prometheus metrics
 	SuperRole = "SuperRole"
 )
 
 // Init initializes
 func Init() {
+	if err := InitNamespaceRewrites(util.GetConfig().NamespaceRewrites); err != nil {
+		logger.Errorf("namespace rewrite rules are disabled because of error %v", err)
+	}
+	SetCardinalityLimits(util.GetEnvInt("MaxSeriesPerMetric", 0), util.GetEnvInt("MaxSeriesPerTenant", 0))
+	SetMaxScrapeLineBytes(util.GetEnvInt("MaxScrapeLineBytes", 0))
+	SetMaxScrapeBytes(util.GetEnvInt("MaxScrapeBytes", 0))
 
-	url := util.Config.FederatedPromURL
+	discovered := initDiscovery()
+	url := FederatedPromURL()
 	interval := time.Duration(util.GetEnvInt("ScrapeFederatedPromIntervalSeconds", 60)) * time.Second
-	if url != "" && util.IsStatsMode() {
+	startScraper(interval)
+	if (url != "" || discovered) && util.IsStatsMode() {
 		logger.Infof("Federated Prometheus URL %s at interval %v", url, interval)
+		if !util.FeatureEnabled(util.FeatureAlerting) {
+			logger.Infof("alert rules are disabled by the %s feature gate", util.FeatureAlerting)
+		} else if err := InitAlertRules(util.GetConfig().AlertRules); err != nil {
+			logger.Errorf("alert rules are disabled because of error %v", err)
+		}
+		StartStripeReporter()
+		if util.FeatureEnabled(util.FeatureRemoteWrite) {
+			StartDatadogPush()
+			StartStatsdPush()
+		} else {
+			logger.Infof("Datadog and StatsD pushes are disabled by the %s feature gate", util.FeatureRemoteWrite)
+		}
+		StartCloudWatchExport()
 		go func() {
 			InitUsageDbTable()
-			logger.Infof("Build tenant usage")
-			BuildTenantUsage()
+			// only the leader scrapes and rolls up the usage when the leader election is enabled
+			if util.IsLeader() {
+				logger.Infof("Build tenant usage")
+				BuildTenantUsage()
+			}
 			ticker := time.NewTicker(5 * interval)
 			for {
 				select {
 				case <-ticker.C:
-					BuildTenantUsage()
+					if util.IsLeader() {
+						BuildTenantUsage()
+					}
 				}
 			}
 		}()
@@ -188,85 +461,294 @@ func InitUsageDbTable() error {
 	return err
 }
 
-// FilterFederatedMetrics collects the metrics the subject is allowed to access
+// FilterFederatedMetrics collects the metrics the subject is allowed to access, the series with a namespace label
+// starting with the subject and their type definitions. The lines are matched in place without a regex or a copy.
 func FilterFederatedMetrics(byteData []byte, subject string) string {
 	var str strings.Builder
-	scanner := bufio.NewScanner(strings.NewReader(string(byteData)))
-
-	pattern := fmt.Sprintf(`.*,namespace="%s.*`, subject)
-	typeDefPattern := fmt.Sprintf(`^# TYPE .*`)
-	typeDef := ""
-	for scanner.Scan() {
-		text := scanner.Text()
-		matched, err := regexp.MatchString(typeDefPattern, text)
-		if matched && err == nil {
-			typeDef = text
+	typeDefPrefix := []byte("# TYPE ")
+	firstLabel := []byte(`{namespace="` + subject)
+	otherLabel := []byte(`,namespace="` + subject)
+	var typeDef []byte
+	for len(byteData) > 0 {
+		line := byteData
+		if i := bytes.IndexByte(byteData, '\n'); i >= 0 {
+			line, byteData = byteData[:i], byteData[i+1:]
 		} else {
-			matched, err = regexp.MatchString(pattern, text)
-			if matched && err == nil {
-				if typeDef == "" {
-					str.WriteString(text)
-					str.WriteString("\n")
-				} else {
-					str.WriteString(typeDef)
-					str.WriteString("\n")
-					str.WriteString(text)
-					str.WriteString("\n")
-					typeDef = ""
-				}
+			byteData = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasPrefix(line, typeDefPrefix) {
+			typeDef = line
+		} else if bytes.Contains(line, firstLabel) || bytes.Contains(line, otherLabel) {
+			if typeDef != nil {
+				str.Write(typeDef)
+				str.WriteByte('\n')
+				typeDef = nil
 			}
+			str.Write(line)
+			str.WriteByte('\n')
 		}
 	}
 	return str.String()
 }
 
-// GetTenantPromMetrics gets tenant prometheus metrics
+// GetTenantPromMetrics gets tenant prometheus metrics from the cache. An expired cache is served while the scraper
+// is asked to scrape ahead of the interval, so the request path never writes the cache.
 func GetTenantPromMetrics(tenant string) ([]byte, error) {
 	log.Infof("get tenant prom metrics %s", tenant)
 	if data, err := GetCache(tenant); err == nil {
 		return data, nil
 	}
 
-	var url string
-	baseURL := util.Config.FederatedPromURL
+	requestScrape()
+	if snapshot := loadSnapshot(); snapshot != nil {
+		logger.Debugf("serve the expired metrics cache of tenant %s until the next scrape", tenant)
+		return snapshot.data(tenant), nil
+	}
+	// cold start fallback, a synchronous scrape of the tenant is bounded by a shorter timeout and not cached
+	timeout := time.Duration(util.GetEnvInt("ColdStartScrapeTimeoutSeconds", 30)) * time.Second
+	return scrapeTenant(tenant, timeout)
+}
+
+// ForceScrape re-scrapes the federated metrics immediately regardless of the cache state and returns the tenant metrics,
+// the tenant usage is rebuilt as well for the SuperRole in the stats mode
+func ForceScrape(tenant string) ([]byte, error) {
+	snapshot, err := scrapeAll(false, scrapeTimeout())
+	if err != nil {
+		return nil, err
+	}
+	if tenant == SuperRole && usageDb != nil {
+		BuildTenantUsage()
+	}
+	return snapshot.data(tenant), nil
+}
+
+// startScraper scrapes the federated metrics of all the tenants at the interval, or ahead of the interval
+// once a reader finds the cache expired
+func startScraper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			last := time.Now()
+			if FederatedPromURL() != "" {
+				if _, err := scrapeAll(true, scrapeTimeout()); err != nil {
+					logger.Errorf("federated metrics scrape error %v", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-scrapeTrigger:
+				if wait := scrapeTriggerBackoff - time.Since(last); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+	}()
+}
+
+// requestScrape asks the scraper for a scrape ahead of the interval without waiting for it
+func requestScrape() {
+	select {
+	case scrapeTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// scrapeURL returns the federation url of the metrics of a tenant, or of all the tenants for the SuperRole
+func scrapeURL(tenant string) string {
+	baseURL := FederatedPromURL()
 	if tenant == SuperRole {
-		url = baseURL + "/?match[]={job=~\"broker.*\"}"
-	} else {
-		url = fmt.Sprintf("%s/?match[]={namespace=~\"%s/.*\"}", baseURL, tenant)
+		return baseURL + "/?match[]={job=~\"broker.*\"}&match[]={namespace=~\".+\"}"
 	}
-	data, err := scrapeJob(url)
-	if err == nil {
-		SetCache(tenant, data)
-		return data, nil
+	return fmt.Sprintf("%s/?match[]={namespace=~\"%s/.*\"}", baseURL, tenant)
+}
+
+// scrapeAll scrapes the federated metrics of all the tenants, then builds the snapshot of the scrape
+// and stores it once. The scrapes are serialized so there is a single writer of the cache.
+func scrapeAll(conditional bool, timeout time.Duration) (*metricsSnapshot, error) {
+	scrapeLock.Lock()
+	defer scrapeLock.Unlock()
+	previous := loadSnapshot()
+	conditional = conditional && previous != nil
+
+	ctx, span := util.StartSpan(context.Background(), "scrape tenants", trace.SpanKindInternal,
+		attribute.Bool("conditional", conditional))
+	data, notModified, err := scrapeJob(ctx, scrapeURL(SuperRole), conditional, timeout)
+	span.SetAttributes(attribute.Bool("not_modified", notModified), attribute.Int("bytes", len(data)))
+	util.EndSpan(span, 0, err)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	if notModified {
+		// skip the snapshot rebuild since the federation payload is unchanged
+		refreshed := *previous
+		refreshed.updateTime = time.Now()
+		storeSnapshot(&refreshed)
+		return &refreshed, nil
+	}
+	snapshot := newMetricsSnapshot(data, previous, time.Now())
+	storeSnapshot(snapshot)
+	return snapshot, nil
+}
+
+// scrapeTenant scrapes the federated metrics of a tenant without caching them
+func scrapeTenant(tenant string, timeout time.Duration) ([]byte, error) {
+	ctx, span := util.StartSpan(context.Background(), "scrape tenant", trace.SpanKindInternal,
+		attribute.String("tenant", tenant))
+	data, _, err := scrapeJob(ctx, scrapeURL(tenant), false, timeout)
+	span.SetAttributes(attribute.Int("bytes", len(data)))
+	util.EndSpan(span, 0, err)
+	return data, err
 }
 
 // scrapeJob(url+"/?match[]={job=~\"broker.*\"}") + scrapeJob(url+"/?match[]={job=~\"function.*\"}")
 
-func scrapeJob(url string) ([]byte, error) {
-	client := &http.Client{Timeout: 600 * time.Second}
+// scrapeJob scrapes the url, a conditional scrape sends the validators of the last response
+// and returns true if the payload is not modified
+func scrapeJob(ctx context.Context, url string, conditional bool, timeout time.Duration) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
 	// All prometheus jobs
 	// req, err := http.NewRequest("GET", url+"/?match[]={__name__=~\"..*\"}", nil)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if conditional {
+		validatorsLock.RLock()
+		v, ok := scrapeValidators[url]
+		validatorsLock.RUnlock()
+		if ok && v.etag != "" {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if ok && v.lastModified != "" {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
 	}
 
-	resp, err := client.Do(req)
+	resp, err := scrapeClient().Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
 		logger.Errorf("broker stats collection error %s", err.Error())
-		return nil, err
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, true, nil
 	}
 	if resp.StatusCode > 299 {
-		return nil, fmt.Errorf("failure status code %v", resp.StatusCode)
+		return nil, false, fmt.Errorf("failure status code %v", resp.StatusCode)
 	}
 
-	return ioutil.ReadAll(resp.Body)
+	validatorsLock.Lock()
+	scrapeValidators[url] = scrapeValidator{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	validatorsLock.Unlock()
+
+	data, err := ingestScrape(resp.Body)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logger.Errorf("scrape %s is cancelled after the timeout %v", url, timeout)
+	}
+	return data, false, err
+}
+
+var (
+	scraperClient     *http.Client
+	scraperClientOnce sync.Once
+)
+
+// scrapeClient returns the http client shared by the scrapes, the connections to the federated Prometheus
+// are kept alive between the scrapes. It has no overall timeout since every scrape carries its own deadline.
+func scrapeClient() *http.Client {
+	scraperClientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: scrapeDialTimeout, KeepAlive: 30 * time.Second}
+		scraperClient = &http.Client{Transport: util.NewTracingTransport(&http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          16,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       scrapeIdleConnTimeout,
+			TLSHandshakeTimeout:   scrapeDialTimeout,
+			ResponseHeaderTimeout: scrapeHeaderTimeout,
+			ExpectContinueTimeout: 1 * time.Second,
+		})}
+	})
+	return scraperClient
+}
+
+// scrapeTimeout bounds a scrape to the scrape interval unless ScrapeTimeoutSeconds is set,
+// so that an overrunning scrape is cancelled rather than piling up with the next one
+func scrapeTimeout() time.Duration {
+	interval := util.GetEnvInt("ScrapeFederatedPromIntervalSeconds", 60)
+	return time.Duration(util.GetEnvInt("ScrapeTimeoutSeconds", interval)) * time.Second
+}
+
+// defaultMaxScrapeLineBytes is the longest line accepted in a federation payload unless it is configured
+const defaultMaxScrapeLineBytes = 1024 * 1024
+
+var maxScrapeLineBytes int32 = defaultMaxScrapeLineBytes
+
+// SetMaxScrapeLineBytes sets the longest line accepted in a federation payload, 0 or less resets the default
+func SetMaxScrapeLineBytes(size int) {
+	if size <= 0 {
+		size = defaultMaxScrapeLineBytes
+	}
+	atomic.StoreInt32(&maxScrapeLineBytes, int32(size))
+}
+
+// defaultMaxScrapeBytes is the largest federation payload accepted unless it is configured
+const defaultMaxScrapeBytes = 256 * 1024 * 1024
+
+var maxScrapeBytes int64 = defaultMaxScrapeBytes
+
+// SetMaxScrapeBytes sets the largest federation payload accepted, 0 or less resets the default
+func SetMaxScrapeBytes(size int) {
+	if size <= 0 {
+		size = defaultMaxScrapeBytes
+	}
+	atomic.StoreInt64(&maxScrapeBytes, int64(size))
+}
+
+// ingestScrape reads the federation payload line by line as it streams, the namespace labels are normalized
+// and the series over the cardinality limits are dropped before a line is buffered. A payload with a line
+// longer than the max line size or larger than the max payload size is rejected. The buffer grows with the
+// admitted lines only, the content length claimed by the upstream is not trusted.
+func ingestScrape(body io.Reader) ([]byte, error) {
+	maxLine := int(atomic.LoadInt32(&maxScrapeLineBytes))
+	maxBytes := atomic.LoadInt64(&maxScrapeBytes)
+	var buf bytes.Buffer
+	limiter := newCardinalityLimiter()
+	// one byte over the cap is read to tell a payload of exactly the max size from a larger one
+	limited := &io.LimitedReader{R: body, N: maxBytes + 1}
+	scanner := bufio.NewScanner(limited)
+	initial := 64 * 1024
+	if initial > maxLine {
+		initial = maxLine
+	}
+	scanner.Buffer(make([]byte, 0, initial), maxLine)
+	for scanner.Scan() {
+		line := normalizeNamespaceLine(scanner.Bytes())
+		if limiter.admit(line) {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, fmt.Errorf("federated metrics line exceeds the max line size of %d bytes", maxLine)
+		}
+		return nil, err
+	}
+	if limited.N <= 0 {
+		return nil, fmt.Errorf("federated metrics payload exceeds the max size of %d bytes", maxBytes)
+	}
+	limiter.done()
+	return buf.Bytes(), nil
 }
 
 // BuildTenantUsage builds the tenant usage
@@ -283,6 +765,8 @@ func BuildTenantUsage() {
 		logger.Errorf("reading text format failed: %v", err)
 		return
 	}
+	EvaluateAlertRules(metricFamilies)
+	RollupUsageStatements(metricFamilies, time.Now())
 	for label, mf := range metricFamilies {
 		if _, ok := tenantMetricNames[label]; ok {
 			for _, entry := range mf.GetMetric() {
@@ -361,6 +845,18 @@ func GetTenantsUsage() ([]Usage, error) {
 	return tenantsUsage, nil
 }
 
+// TenantNames returns the sorted names of the tenants seen in the usage
+func TenantNames() []string {
+	tenantsLock.RLock()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	tenantsLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
 // GetTenantUsage get tenant's usage
 func GetTenantUsage(tenant string) (*Usage, error) {
 	usage := Usage{
@@ -410,6 +906,7 @@ func GetTenantNamespacesUsage(tenant string) ([]Usage, error) {
 				usage = Usage{
 					Name:      key,
 					UpdatedAt: time.Now(),
+					Labels:    util.GetCostLabels(tenant, p.Namespace),
 				}
 			}
 			usage.TotalBytesIn = usage.TotalBytesIn + p.TotalBytesIn
@@ -0,0 +1,138 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Kafka exporter style names of the key Pulsar metrics
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// kafkaMetricName maps a Pulsar metric to the name of the Kafka exporters' equivalent metric
+type kafkaMetricName struct {
+	pulsar string
+	kafka  string
+	help   string
+}
+
+// kafkaMetricNames are the translated metrics, the consumer lag is named after the kafka_exporter
+// and the topic throughput and size after the JMX exporter of the brokers
+var kafkaMetricNames = []kafkaMetricName{
+	{"pulsar_subscription_back_log", "kafka_consumergroup_lag", "Current approximate lag of a consumer group at topic/partition"},
+	{"pulsar_in_messages_total", "kafka_server_brokertopicmetrics_messagesin_total", "Messages in of a topic/partition"},
+	{"pulsar_in_bytes_total", "kafka_server_brokertopicmetrics_bytesin_total", "Bytes in of a topic/partition"},
+	{"pulsar_out_bytes_total", "kafka_server_brokertopicmetrics_bytesout_total", "Bytes out of a topic/partition"},
+	{"pulsar_storage_size", "kafka_log_log_size", "Size of the log of a topic/partition in bytes"},
+}
+
+// KafkaMetricNames translates the key Pulsar metrics of the Prometheus text format data to the Kafka exporters'
+// names and labels, the other metrics are dropped. A subscription is a consumergroup, and a partitioned topic
+// is split into the topic and the partition labels. The namespace and cluster labels are kept.
+func KafkaMetricNames(data []byte) ([]byte, error) {
+	selected := make(map[string]*bytes.Buffer, len(kafkaMetricNames))
+	for _, m := range kafkaMetricNames {
+		selected[m.pulsar] = &bytes.Buffer{}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		name := ""
+		if fields := bytes.Fields(line); len(fields) >= 3 && line[0] == '#' && bytes.Equal(fields[1], []byte("TYPE")) {
+			name = string(fields[2])
+		} else if len(line) > 0 && line[0] != '#' {
+			name = seriesName(line)
+		}
+		if buf, ok := selected[name]; ok {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	for _, m := range kafkaMetricNames {
+		if selected[m.pulsar].Len() == 0 {
+			continue
+		}
+		parser := expfmt.TextParser{}
+		metricFamilies, err := parser.TextToMetricFamilies(selected[m.pulsar])
+		if err != nil {
+			return nil, err
+		}
+		mf, ok := metricFamilies[m.pulsar]
+		if !ok {
+			continue
+		}
+		name, help := m.kafka, m.help
+		kafka := &dto.MetricFamily{Name: &name, Help: &help, Type: mf.Type}
+		for _, metric := range mf.GetMetric() {
+			metric.Label = kafkaLabels(metric.GetLabel())
+			kafka.Metric = append(kafka.Metric, metric)
+		}
+		if _, err := expfmt.MetricFamilyToText(&out, kafka); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// kafkaLabels maps the labels of a Pulsar topic series to the labels of a Kafka topic partition
+func kafkaLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	values := map[string]string{}
+	for _, lp := range labels {
+		switch lp.GetName() {
+		case "cluster", "namespace":
+			values[lp.GetName()] = lp.GetValue()
+		case "subscription":
+			values["consumergroup"] = lp.GetValue()
+		case "topic":
+			topic, partition := lp.GetValue(), "0"
+			if i := strings.LastIndex(topic, "/"); i >= 0 {
+				topic = topic[i+1:]
+			}
+			if i := strings.LastIndex(topic, "-partition-"); i > 0 {
+				if _, err := strconv.Atoi(topic[i+len("-partition-"):]); err == nil {
+					topic, partition = topic[:i], topic[i+len("-partition-"):]
+				}
+			}
+			values["topic"], values["partition"] = topic, partition
+		}
+	}
+	mapped := []*dto.LabelPair{}
+	// the label pairs are in the sorted order of the names
+	for _, name := range []string{"cluster", "consumergroup", "namespace", "partition", "topic"} {
+		if value, ok := values[name]; ok {
+			name, value := name, value
+			mapped = append(mapped, &dto.LabelPair{Name: &name, Value: &value})
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,64 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the cache memory budget
+
+import (
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheBudgetDesc = prometheus.NewDesc("burnell_cache_memory_budget_bytes",
+		"The memory budget of the caches, 0 is unlimited", nil, nil)
+	cacheBytesDesc = prometheus.NewDesc("burnell_cache_memory_bytes",
+		"The estimated memory per cache tracked by the budget", []string{"cache"}, nil)
+	cacheEntriesDesc = prometheus.NewDesc("burnell_cache_entries",
+		"The number of entries per cache tracked by the budget", []string{"cache"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("burnell_cache_evictions_total",
+		"The number of least recently used entries evicted over the memory budget per cache", []string{"cache"}, nil)
+)
+
+// memoryBudgetCollector collects the cache memory budget at scrape time
+type memoryBudgetCollector struct{}
+
+func (memoryBudgetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheBudgetDesc
+	ch <- cacheBytesDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheEvictionsDesc
+}
+
+func (memoryBudgetCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := util.GetMemoryBudgetStats()
+	ch <- prometheus.MustNewConstMetric(cacheBudgetDesc, prometheus.GaugeValue, float64(stats.BudgetBytes))
+	for cache, bytes := range stats.Bytes {
+		ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(bytes), cache)
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries[cache]), cache)
+		ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions[cache]), cache)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(memoryBudgetCollector{})
+}
@@ -0,0 +1,138 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Namespace label normalization of the federated metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+type namespaceRewrite struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+// clusterQualifiedNamespace is the built-in rule to rewrite tenant/cluster/namespace to tenant/namespace
+var clusterQualifiedNamespace = namespaceRewrite{
+	pattern: regexp.MustCompile(`^([^/]+)/[^/]+/([^/]+)$`),
+	replace: "$1/$2",
+}
+
+var (
+	namespaceRewritesLock = sync.RWMutex{}
+	namespaceRewrites     = []namespaceRewrite{clusterQualifiedNamespace}
+
+	namespaceLabel = []byte(`namespace="`)
+)
+
+// InitNamespaceRewrites compiles the configured rewrite rules, they are evaluated before the built-in cluster qualified name rule
+func InitNamespaceRewrites(rules []util.NamespaceRewrite) error {
+	rewrites := make([]namespaceRewrite, 0, len(rules)+1)
+	for _, r := range rules {
+		pattern, err := regexp.Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("invalid namespace rewrite rule %s error %v", r.Match, err)
+		}
+		rewrites = append(rewrites, namespaceRewrite{pattern: pattern, replace: r.Replace})
+	}
+	rewrites = append(rewrites, clusterQualifiedNamespace)
+
+	namespaceRewritesLock.Lock()
+	namespaceRewrites = rewrites
+	namespaceRewritesLock.Unlock()
+	return nil
+}
+
+// NormalizeNamespace applies the first matching rewrite rule to a namespace
+func NormalizeNamespace(namespace string) string {
+	namespaceRewritesLock.RLock()
+	defer namespaceRewritesLock.RUnlock()
+	for _, r := range namespaceRewrites {
+		if r.pattern.MatchString(namespace) {
+			return r.pattern.ReplaceAllString(namespace, r.replace)
+		}
+	}
+	return namespace
+}
+
+// NormalizeNamespaceLabels rewrites the namespace label of every series in the Prometheus text data
+func NormalizeNamespaceLabels(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		buf.Write(normalizeNamespaceLine(scanner.Bytes()))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func normalizeNamespaceLine(line []byte) []byte {
+	valueStart, valueEnd, ok := namespaceLabelValue(line)
+	if !ok {
+		return line
+	}
+	value := string(line[valueStart:valueEnd])
+	normalized := NormalizeNamespace(value)
+	if normalized == value {
+		return line
+	}
+	rewritten := make([]byte, 0, len(line)-len(value)+len(normalized))
+	rewritten = append(rewritten, line[:valueStart]...)
+	rewritten = append(rewritten, normalized...)
+	rewritten = append(rewritten, line[valueEnd:]...)
+	return rewritten
+}
+
+// namespaceLabelValue locates the value of the namespace label in a series line
+func namespaceLabelValue(line []byte) (int, int, bool) {
+	if len(line) == 0 || line[0] == '#' {
+		return 0, 0, false
+	}
+	for offset := 0; offset < len(line); {
+		i := bytes.Index(line[offset:], namespaceLabel)
+		if i < 0 {
+			return 0, 0, false
+		}
+		start := offset + i
+		if start == 0 || (line[start-1] != '{' && line[start-1] != ',') {
+			// other labels such as exported_namespace
+			offset = start + len(namespaceLabel)
+			continue
+		}
+		valueStart := start + len(namespaceLabel)
+		valueEnd := bytes.IndexByte(line[valueStart:], '"')
+		if valueEnd < 0 {
+			return 0, 0, false
+		}
+		return valueStart, valueStart + valueEnd, true
+	}
+	return 0, 0, false
+}
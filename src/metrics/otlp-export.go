@@ -0,0 +1,266 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// OTLP/HTTP push of the burnell self metrics to an OpenTelemetry collector
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultOTLPMetricsPath = "/v1/metrics"
+	otlpScopeName          = "github.com/datastax/burnell"
+	otlpExportTimeout      = 30 * time.Second
+)
+
+// processStart is the start time of the cumulative sums
+var processStart = time.Now()
+
+// StartOTLPExport pushes the self metrics on the interval, every replica pushes its own metrics
+func StartOTLPExport() error {
+	cfg := util.GetConfig().OTLPMetrics
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	if !util.FeatureEnabled(util.FeatureRemoteWrite) {
+		logger.Infof("OTLP metrics export is disabled by the %s feature gate", util.FeatureRemoteWrite)
+		return nil
+	}
+	client, err := otlpHTTPClient(cfg)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	logger.Infof("export the self metrics to %s at interval %v", cfg.Endpoint, interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			if err := PushOTLPMetrics(client, prometheus.DefaultGatherer, now); err != nil {
+				logger.Errorf("failed to export the self metrics over otlp %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func otlpHTTPClient(cfg util.OTLPMetrics) (*http.Client, error) {
+	client := &http.Client{Timeout: otlpExportTimeout}
+	if cfg.Insecure {
+		return client, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+	caFile := util.AssignString(cfg.TLSCAFile, util.GetConfig().TrustStore)
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the otlp CA file %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the otlp CA file %s", caFile)
+		}
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the otlp client certificate %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	return client, nil
+}
+
+// PushOTLPMetrics gathers the metrics and sends them as a protobuf export request
+func PushOTLPMetrics(client *http.Client, gatherer prometheus.Gatherer, now time.Time) error {
+	cfg := util.GetConfig().OTLPMetrics
+	families, err := gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return err
+	}
+	body, err := proto.Marshal(OTLPMetricsRequest(families, now))
+	if err != nil {
+		return err
+	}
+	scheme := "https://"
+	if cfg.Insecure {
+		scheme = "http://"
+	}
+	req, err := http.NewRequest(http.MethodPost, scheme+cfg.Endpoint+util.AssignString(cfg.URLPath, defaultOTLPMetricsPath), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("otlp export status %d %s", resp.StatusCode, string(data))
+	}
+	return nil
+}
+
+// OTLPMetricsRequest converts the Prometheus metric families to an OTLP export request. A counter is a cumulative
+// monotonic sum since the process start, a gauge or an untyped metric is a gauge, and a histogram and a summary
+// keep their types. The resource has the service name, the replica as the service instance, and the cluster.
+func OTLPMetricsRequest(families []*dto.MetricFamily, now time.Time) *colmetricspb.ExportMetricsServiceRequest {
+	cfg := util.GetConfig()
+	serviceName := util.AssignString(cfg.OTLPMetrics.ServiceName, util.AssignString(cfg.Tracing.ServiceName, "burnell"))
+	start, ts := uint64(processStart.UnixNano()), uint64(now.UnixNano())
+
+	metrics := []*metricspb.Metric{}
+	for _, family := range families {
+		metric := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{IsMonotonic: true, AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}
+			for _, m := range family.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, otlpNumber(m, start, ts, m.GetCounter().GetValue()))
+			}
+			metric.Data = &metricspb.Metric_Sum{Sum: sum}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, otlpNumber(m, start, ts, value))
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+		case dto.MetricType_HISTOGRAM:
+			histogram := &metricspb.Histogram{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}
+			for _, m := range family.GetMetric() {
+				histogram.DataPoints = append(histogram.DataPoints, otlpHistogram(m, start, ts))
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, m := range family.GetMetric() {
+				point := &metricspb.SummaryDataPoint{
+					Attributes:        otlpAttributes(m.GetLabel()),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      ts,
+					Count:             m.GetSummary().GetSampleCount(),
+					Sum:               m.GetSummary().GetSampleSum(),
+				}
+				for _, q := range m.GetSummary().GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues,
+						&metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				summary.DataPoints = append(summary.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Summary{Summary: summary}
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				otlpString("service.name", serviceName),
+				otlpString("service.instance.id", util.LeaderIdentity()),
+				otlpString("pulsar.cluster", cfg.ClusterName),
+			}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func otlpString(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func otlpAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, label := range labels {
+		attributes = append(attributes, otlpString(label.GetName(), label.GetValue()))
+	}
+	return attributes
+}
+
+func otlpNumber(m *dto.Metric, start, ts uint64, value float64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        otlpAttributes(m.GetLabel()),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      ts,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+// otlpHistogram converts the cumulative Prometheus buckets to the counts per bucket, the +Inf bucket is implicit
+func otlpHistogram(m *dto.Metric, start, ts uint64) *metricspb.HistogramDataPoint {
+	h := m.GetHistogram()
+	buckets := append([]*dto.Bucket{}, h.GetBucket()...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+	sum := h.GetSampleSum()
+	point := &metricspb.HistogramDataPoint{
+		Attributes:        otlpAttributes(m.GetLabel()),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      ts,
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+	}
+	var cumulative uint64
+	for _, b := range buckets {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-cumulative)
+		cumulative = b.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-cumulative)
+	return point
+}
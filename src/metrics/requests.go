@@ -0,0 +1,63 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the request latency and the slow requests
+
+import (
+	"strconv"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "burnell_http_request_duration_seconds",
+		Help:    "The latency of the HTTP requests per route",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "code"})
+
+	requestPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "burnell_http_request_phase_seconds",
+		Help:    "The time spent in the auth, policy, upstream, and serialization phases of the HTTP requests",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"phase"})
+
+	slowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "burnell_http_slow_requests_total",
+		Help: "The number of HTTP requests over the slow request threshold per route",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, requestPhaseDuration, slowRequests)
+	util.SetRequestObserver(func(o util.RequestObservation) {
+		requestDuration.WithLabelValues(o.Route, o.Method, strconv.Itoa(o.Status)).Observe(o.Duration.Seconds())
+		for phase, d := range o.Phases {
+			requestPhaseDuration.WithLabelValues(phase).Observe(d.Seconds())
+		}
+		if o.Slow {
+			slowRequests.WithLabelValues(o.Route).Inc()
+		}
+	})
+}
@@ -0,0 +1,295 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Scheduled export of the usage rollups, the audit archives, and the tenant metric snapshots to an S3 compatible bucket
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// kinds of the exported objects
+const (
+	S3ExportUsage   = "usage"
+	S3ExportAudit   = "audit"
+	S3ExportMetrics = "metrics"
+)
+
+const (
+	defaultS3PathTemplate = "burnell/{kind}/{tenant}/{date}/{time}-{replica}.{ext}"
+	// s3AuditClusterTenant is the tenant of the audit events without a tenant, such as the cluster operations
+	s3AuditClusterTenant = "_cluster"
+	// s3AuditArchiveSize is the number of the audit events kept between the exports, the oldest are dropped beyond it
+	s3AuditArchiveSize = 100000
+)
+
+var s3PlaceholderPattern = regexp.MustCompile(`\{[a-z]+\}`)
+
+var s3Exports = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "burnell_s3_exports_total",
+	Help: "The number of the objects exported to the S3 compatible bucket per kind and result",
+}, []string{"kind", "result"})
+
+func init() {
+	prometheus.MustRegister(s3Exports)
+}
+
+// S3UsageRollup is the exported usage of a tenant
+type S3UsageRollup struct {
+	Tenant     Usage            `json:"tenant"`
+	Namespaces []Usage          `json:"namespaces"`
+	Statements []UsageStatement `json:"statements"`
+}
+
+// s3AuditArchive keeps the audit events of this replica until the next export
+type s3AuditArchive struct {
+	sync.Mutex
+	events []audit.Event
+}
+
+var auditArchive = &s3AuditArchive{}
+var auditArchiveOnce sync.Once
+
+func (a *s3AuditArchive) Name() string {
+	return "s3-archive"
+}
+
+func (a *s3AuditArchive) Send(e audit.Event) error {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.events) >= s3AuditArchiveSize {
+		a.events = a.events[1:]
+	}
+	a.events = append(a.events, e)
+	return nil
+}
+
+// take removes the archived events
+func (a *s3AuditArchive) take() []audit.Event {
+	a.Lock()
+	defer a.Unlock()
+	events := a.events
+	a.events = nil
+	return events
+}
+
+// restore puts back the events of a failed export ahead of the events archived since
+func (a *s3AuditArchive) restore(events []audit.Event) {
+	a.Lock()
+	defer a.Unlock()
+	a.events = append(events, a.events...)
+	if len(a.events) > s3AuditArchiveSize {
+		a.events = a.events[len(a.events)-s3AuditArchiveSize:]
+	}
+}
+
+// s3ExportKind returns whether the kind is exported, all kinds are exported by default
+func s3ExportKind(cfg util.S3Export, kind string) bool {
+	return len(cfg.Kinds) == 0 || util.StrContains(cfg.Kinds, kind)
+}
+
+// StartS3Export exports to the bucket on the interval. Every replica exports its audit archive, only the leader
+// exports the usage and the metric snapshots and applies the retention when the leader election is enabled.
+func StartS3Export() {
+	cfg := util.GetConfig().S3Export
+	if cfg.Bucket == "" {
+		return
+	}
+	if s3ExportKind(cfg, S3ExportAudit) {
+		auditArchiveOnce.Do(func() { audit.AddSink(auditArchive) })
+	}
+	interval := time.Duration(cfg.IntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	logger.Infof("export to the s3 bucket %s at interval %v", cfg.Bucket, interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			if _, err := ExportToS3(now); err != nil {
+				logger.Errorf("failed to export to the s3 bucket %v", err)
+			}
+			if util.IsLeader() && cfg.RetentionDays > 0 {
+				if _, err := ApplyS3Retention(now); err != nil {
+					logger.Errorf("failed to apply the s3 retention %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// S3ObjectKey renders the path template of an object
+func S3ObjectKey(template, kind, tenant, ext string, now time.Time) string {
+	now = now.UTC()
+	replica := strings.NewReplacer(":", "-", "/", "-").Replace(util.LeaderIdentity())
+	return strings.NewReplacer(
+		"{kind}", kind,
+		"{tenant}", tenant,
+		"{date}", now.Format("2006-01-02"),
+		"{year}", now.Format("2006"),
+		"{month}", now.Format("01"),
+		"{day}", now.Format("02"),
+		"{time}", now.Format("150405"),
+		"{replica}", replica,
+		"{ext}", ext,
+	).Replace(template)
+}
+
+// ExportToS3 writes the objects of the configured kinds and returns their keys, an error does not stop the
+// export of the other objects and the last error is returned
+func ExportToS3(now time.Time) ([]string, error) {
+	cfg := util.GetConfig().S3Export
+	client := util.NewS3Client(cfg)
+	template := util.AssignString(cfg.PathTemplate, defaultS3PathTemplate)
+	keys := []string{}
+	var lastErr error
+	put := func(kind, tenant, ext, contentType string, body []byte) error {
+		key := S3ObjectKey(template, kind, tenant, ext, now)
+		if err := client.PutObject(key, contentType, body); err != nil {
+			s3Exports.WithLabelValues(kind, "error").Inc()
+			lastErr = err
+			return err
+		}
+		s3Exports.WithLabelValues(kind, "ok").Inc()
+		keys = append(keys, key)
+		return nil
+	}
+
+	if s3ExportKind(cfg, S3ExportAudit) {
+		events := auditArchive.take()
+		byTenant := map[string][]audit.Event{}
+		for _, e := range events {
+			tenant := util.AssignString(e.Tenant, s3AuditClusterTenant)
+			byTenant[tenant] = append(byTenant[tenant], e)
+		}
+		failed := []audit.Event{}
+		for tenant, tenantEvents := range byTenant {
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			for _, e := range tenantEvents {
+				encoder.Encode(e)
+			}
+			if put(S3ExportAudit, tenant, "jsonl", "application/x-ndjson", buf.Bytes()) != nil {
+				failed = append(failed, tenantEvents...)
+			}
+		}
+		if len(failed) > 0 {
+			auditArchive.restore(failed)
+		}
+	}
+
+	if !util.IsLeader() {
+		return keys, lastErr
+	}
+	for _, tenant := range TenantNames() {
+		if s3ExportKind(cfg, S3ExportUsage) {
+			if rollup, err := tenantUsageRollup(tenant, now); err != nil {
+				lastErr = err
+			} else if body, err := json.Marshal(rollup); err != nil {
+				lastErr = err
+			} else {
+				put(S3ExportUsage, tenant, "json", "application/json", body)
+			}
+		}
+		if s3ExportKind(cfg, S3ExportMetrics) {
+			if data, err := GetTenantPromMetrics(tenant); err != nil {
+				lastErr = err
+			} else if len(data) > 0 {
+				put(S3ExportMetrics, tenant, "prom", "text/plain; version=0.0.4", data)
+			}
+		}
+	}
+	return keys, lastErr
+}
+
+func tenantUsageRollup(tenant string, now time.Time) (S3UsageRollup, error) {
+	usage, err := GetTenantUsage(tenant)
+	if err != nil {
+		return S3UsageRollup{}, err
+	}
+	namespaces, err := GetTenantNamespacesUsage(tenant)
+	if err != nil {
+		return S3UsageRollup{}, err
+	}
+	return S3UsageRollup{
+		Tenant:     *usage,
+		Namespaces: namespaces,
+		Statements: GetUsageStatements(tenant, UsageCycle(now)),
+	}, nil
+}
+
+// s3TemplatePattern matches the keys rendered from the path template, so the retention never deletes the other
+// objects of the bucket
+func s3TemplatePattern(template string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, loc := range s3PlaceholderPattern.FindAllStringIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		pattern.WriteString("[^/]+")
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+// ApplyS3Retention deletes the exported objects older than the retention days and returns the number deleted
+func ApplyS3Retention(now time.Time) (int, error) {
+	cfg := util.GetConfig().S3Export
+	if cfg.RetentionDays <= 0 {
+		return 0, nil
+	}
+	client := util.NewS3Client(cfg)
+	template := util.AssignString(cfg.PathTemplate, defaultS3PathTemplate)
+	// the static prefix of the template narrows the list
+	prefix := template
+	if loc := s3PlaceholderPattern.FindStringIndex(template); loc != nil {
+		prefix = template[:loc[0]]
+	}
+	objects, err := client.ListObjects(prefix)
+	if err != nil {
+		return 0, err
+	}
+	pattern := s3TemplatePattern(template)
+	expiry := now.Add(-time.Duration(cfg.RetentionDays) * 24 * time.Hour)
+	deleted := 0
+	for _, object := range objects {
+		if !object.LastModified.Before(expiry) || !pattern.MatchString(object.Key) {
+			continue
+		}
+		if err := client.DeleteObject(object.Key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,54 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Scheduled job tasks of the usage statements and the report exports
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	// TaskUsageRollup closes the usage statements of the past cycles even without a scrape in the new cycle
+	TaskUsageRollup = "usage-rollup"
+	// TaskReportExport exports the reports of the configured kinds to the S3 bucket
+	TaskReportExport = "report-export"
+)
+
+func init() {
+	util.RegisterJobTask(TaskUsageRollup, false, func(now time.Time, params map[string]string) (string, error) {
+		RollupUsageStatements(nil, now)
+		return "rolled up the usage statements of cycle " + UsageCycle(now), nil
+	})
+	// every replica exports its audit archive, the export of the leader also has the usage and the metric snapshots
+	util.RegisterJobTask(TaskReportExport, true, func(now time.Time, params map[string]string) (string, error) {
+		if util.GetConfig().S3Export.Bucket == "" {
+			return "", errors.New("no s3 export bucket is configured")
+		}
+		keys, err := ExportToS3(now)
+		return fmt.Sprintf("exported %d objects", len(keys)), err
+	})
+}
@@ -0,0 +1,102 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// The federated metrics cache is written through to the shared cache so the replicas serve
+// the same scrape and a restarted replica warms without scraping.
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sharedMetricsTTL keeps a shared entry long enough to serve as the stale cache on a scrape failure
+const sharedMetricsTTL = 10 * scrapeInterval
+
+// sharedPromMetrics is the shared cache entry of a tenant's federated metrics
+type sharedPromMetrics struct {
+	Data       []byte    `json:"data"`
+	ETag       string    `json:"etag"`
+	ModTime    time.Time `json:"modTime"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_shared_cache_hits_total",
+		Help: "Shared cache lookups found in the shared cache",
+	}, func() float64 { return float64(util.GetSharedCacheStats().Hits) }))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_shared_cache_misses_total",
+		Help: "Shared cache lookups missing in the shared cache",
+	}, func() float64 { return float64(util.GetSharedCacheStats().Misses) }))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_shared_cache_errors_total",
+		Help: "Shared cache calls failed over to the local cache",
+	}, func() float64 { return float64(util.GetSharedCacheStats().Errors) }))
+}
+
+func sharedMetricsKey(tenant string) string {
+	return "metrics:" + tenant
+}
+
+// storeSharedCache writes the metrics of every tenant in a snapshot through to the shared cache
+func storeSharedCache(snapshot *metricsSnapshot) {
+	if stats := util.GetSharedCacheStats(); !stats.Enabled || !stats.Available {
+		return
+	}
+	for _, tenant := range snapshot.names {
+		if tenant == "" {
+			continue
+		}
+		metrics := snapshot.tenants[tenant]
+		entry, err := json.Marshal(sharedPromMetrics{
+			Data:       snapshot.data(tenant),
+			ETag:       metrics.etag,
+			ModTime:    metrics.modTime,
+			UpdateTime: snapshot.updateTime,
+		})
+		if err != nil {
+			logger.Errorf("failed to marshal the shared metrics cache of tenant %s error %v", tenant, err)
+			continue
+		}
+		util.SharedCacheSet(sharedMetricsKey(tenant), entry, sharedMetricsTTL)
+	}
+}
+
+// loadSharedCache reads the shared cache entry of a tenant, the entry is not installed in the local cache
+// since only the scraper writes the local cache
+func loadSharedCache(tenant string) (sharedPromMetrics, bool) {
+	entry := sharedPromMetrics{}
+	data, ok := util.SharedCacheGet(sharedMetricsKey(tenant))
+	if !ok {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logger.Errorf("invalid shared metrics cache of tenant %s error %v", tenant, err)
+		return entry, false
+	}
+	return entry, true
+}
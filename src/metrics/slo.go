@@ -0,0 +1,81 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the SLO burn rates per route class
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sloRequestsDesc = prometheus.NewDesc("burnell_slo_requests_total",
+		"The number of requests per route class", []string{"class"}, nil)
+	sloErrorsDesc = prometheus.NewDesc("burnell_slo_errors_total",
+		"The number of requests with a 5xx status per route class", []string{"class"}, nil)
+	sloSlowDesc = prometheus.NewDesc("burnell_slo_slow_requests_total",
+		"The number of requests over the latency objective per route class", []string{"class"}, nil)
+	sloBurnRateDesc = prometheus.NewDesc("burnell_slo_burn_rate",
+		"The error budget burn rate per route class, objective, and window", []string{"class", "slo", "window"}, nil)
+)
+
+// sloCollector collects the SLO status of the configured route classes at scrape time
+type sloCollector struct{}
+
+func (sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sloRequestsDesc
+	ch <- sloErrorsDesc
+	ch <- sloSlowDesc
+	ch <- sloBurnRateDesc
+}
+
+func (sloCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range util.GetSLOStatus() {
+		ch <- prometheus.MustNewConstMetric(sloRequestsDesc, prometheus.CounterValue, float64(s.Requests), s.Class)
+		ch <- prometheus.MustNewConstMetric(sloErrorsDesc, prometheus.CounterValue, float64(s.Errors), s.Class)
+		ch <- prometheus.MustNewConstMetric(sloSlowDesc, prometheus.CounterValue, float64(s.Slow), s.Class)
+		for _, window := range util.SLOWindows {
+			label := WindowLabel(window)
+			ch <- prometheus.MustNewConstMetric(sloBurnRateDesc, prometheus.GaugeValue, s.AvailabilityBurnRate[window], s.Class, "availability", label)
+			ch <- prometheus.MustNewConstMetric(sloBurnRateDesc, prometheus.GaugeValue, s.LatencyBurnRate[window], s.Class, "latency", label)
+		}
+	}
+}
+
+// WindowLabel formats a duration as a Prometheus range in its largest whole unit up to hours, such as 30m or 6h
+func WindowLabel(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+func init() {
+	prometheus.MustRegister(sloCollector{})
+}
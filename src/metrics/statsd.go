@@ -0,0 +1,115 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// StatsD push of the tenant usage summary to the StatsD daemons configured in the tenant settings
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// maxStatsdPacket fits a StatsD datagram in a single packet of a typical MTU
+const maxStatsdPacket = 1432
+
+// StartStatsdPush pushes the usage summary of every tenant with a StatsD host in its settings on the interval,
+// only the leader pushes when the leader election is enabled since the leader builds the usage
+func StartStatsdPush() {
+	interval := time.Duration(util.GetEnvInt("StatsdPushIntervalSeconds", 60)) * time.Second
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if !util.IsLeader() {
+				continue
+			}
+			for _, tenant := range TenantNames() {
+				if util.TenantSettingsOf(tenant).StatsdHost == "" {
+					continue
+				}
+				if err := PushStatsdUsage(tenant); err != nil {
+					logger.Errorf("failed to push the usage of tenant %s to statsd %v", tenant, err)
+				}
+			}
+		}
+	}()
+}
+
+// PushStatsdUsage pushes the fields of the tenant usage summary as StatsD gauges, such as
+// burnell.ming-luo.totalBytesIn, to the StatsD daemon of the tenant settings
+func PushStatsdUsage(tenant string) error {
+	settings := util.TenantSettingsOf(tenant)
+	usage, err := GetTenantUsage(tenant)
+	if err != nil {
+		return err
+	}
+	prefix := util.AssignString(settings.StatsdPrefix, "burnell."+strings.ReplaceAll(tenant, ".", "_"))
+	gauge := func(name string, value uint64) string {
+		return prefix + "." + name + ":" + strconv.FormatUint(value, 10) + "|g"
+	}
+	lines := []string{
+		gauge("totalMessagesIn", usage.TotalMessagesIn),
+		gauge("totalBytesIn", usage.TotalBytesIn),
+		gauge("totalMessagesOut", usage.TotalMessagesOut),
+		gauge("totalBytesOut", usage.TotalBytesOut),
+		gauge("msgInBacklog", usage.MsgInBacklog),
+	}
+	port := settings.StatsdPort
+	if port == 0 {
+		port = 8125
+	}
+	return writeStatsd(net.JoinHostPort(settings.StatsdHost, strconv.Itoa(port)), lines)
+}
+
+// writeStatsd sends the lines batched into UDP datagrams
+func writeStatsd(address string, lines []string) error {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsdPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
@@ -0,0 +1,238 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Stripe metered billing. The reporter sets the usage record of a cycle to the total of the usage statement, with the
+// start of the statement as the timestamp, so a repeated report after a restart replaces the record instead of
+// adding to it. The idempotency key of a usage record is derived from the statement total.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// StripeReport is a usage record reported, or logged in the dry run, to a subscription item
+type StripeReport struct {
+	Tenant           string    `json:"tenant"`
+	Customer         string    `json:"customer"`
+	SubscriptionItem string    `json:"subscriptionItem"`
+	Metric           string    `json:"metric"`
+	Cycle            string    `json:"cycle"`
+	Quantity         int64     `json:"quantity"`
+	Total            int64     `json:"total"`
+	IdempotencyKey   string    `json:"idempotencyKey"`
+	DryRun           bool      `json:"dryRun,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	ReportedAt       time.Time `json:"reportedAt"`
+}
+
+const (
+	defaultStripeURL = "https://api.stripe.com"
+	maxStripeReports = 1000
+)
+
+var (
+	stripeLock = sync.Mutex{}
+	// the totals reported by tenant, subscription item, and cycle
+	stripeReported = make(map[string]int64)
+	stripeReports  = []StripeReport{}
+
+	stripeClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// billingQuantity is the total of a billing metric in a statement in whole units
+func billingQuantity(metric string, s UsageStatement) int64 {
+	switch metric {
+	case "bytes_in_gb":
+		return int64(math.Floor(float64(s.BytesIn) / 1e9))
+	case "bytes_out_gb":
+		return int64(math.Floor(float64(s.BytesOut) / 1e9))
+	case "transfer_gb":
+		return int64(math.Floor(float64(s.BytesIn+s.BytesOut) / 1e9))
+	case "storage_gb_hours":
+		return int64(math.Floor(s.StorageGBHours))
+	case "peak_topics":
+		return int64(s.PeakTopics)
+	}
+	return 0
+}
+
+// StartStripeReporter reports the usage on the interval if the Stripe integration is enabled,
+// only the leader reports when the leader election is enabled
+func StartStripeReporter() {
+	cfg := util.GetConfig().Stripe
+	if !cfg.Enabled {
+		return
+	}
+	interval := time.Duration(cfg.IntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	logger.Infof("report the usage to Stripe at interval %v dry run %v", interval, cfg.DryRun)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if util.IsLeader() {
+				ReportStripeUsage(time.Now())
+			}
+		}
+	}()
+}
+
+// ReportStripeUsage reports the changed statement totals of the current and the previous cycles of every billing
+// account, it returns the reports of this run
+func ReportStripeUsage(now time.Time) []StripeReport {
+	cfg := util.GetConfig().Stripe
+	current := UsageCycle(now)
+	previous := UsageCycle(time.Date(now.UTC().Year(), now.UTC().Month(), 1, 0, 0, 0, 0, time.UTC).Add(-time.Hour))
+	reports := []StripeReport{}
+	for _, account := range util.ListBillingAccounts() {
+		for _, cycle := range []string{previous, current} {
+			statements := GetUsageStatements(account.Tenant, cycle)
+			if len(statements) == 0 {
+				continue
+			}
+			s := statements[0]
+			for metric, item := range account.Items {
+				key := account.Tenant + "|" + item + "|" + cycle
+				total := billingQuantity(metric, s)
+				reported := stripeReportedTotal(key)
+				if total <= reported {
+					continue
+				}
+				digest := sha256.Sum256([]byte(key + "|" + strconv.FormatInt(total, 10)))
+				report := StripeReport{
+					Tenant:           account.Tenant,
+					Customer:         account.Customer,
+					SubscriptionItem: item,
+					Metric:           metric,
+					Cycle:            cycle,
+					Quantity:         total,
+					Total:            total,
+					IdempotencyKey:   "burnell-" + hex.EncodeToString(digest[:16]),
+					DryRun:           cfg.DryRun,
+					ReportedAt:       now,
+				}
+				if cfg.DryRun {
+					logger.Infof("dry run Stripe usage record %d of %s for tenant %s item %s", report.Quantity, metric, account.Tenant, item)
+				} else if err := postStripeUsage(cfg, report, s.From); err != nil {
+					report.Error = err.Error()
+					logger.Errorf("failed to report Stripe usage of tenant %s item %s error %v", account.Tenant, item, err)
+				} else {
+					setStripeReportedTotal(key, total)
+				}
+				reports = append(reports, report)
+			}
+		}
+	}
+
+	stripeLock.Lock()
+	stripeReports = append(stripeReports, reports...)
+	if over := len(stripeReports) - maxStripeReports; over > 0 {
+		stripeReports = stripeReports[over:]
+	}
+	stripeLock.Unlock()
+	return reports
+}
+
+// stripeReportedTotal is the total reported to a subscription item in a cycle, it is shared across the leaders by
+// the shared cache only to skip the unchanged totals
+func stripeReportedTotal(key string) int64 {
+	stripeLock.Lock()
+	total, ok := stripeReported[key]
+	stripeLock.Unlock()
+	if ok {
+		return total
+	}
+	if data, found := util.SharedCacheGet("stripe-reported:" + key); found {
+		if err := json.Unmarshal(data, &total); err == nil {
+			return total
+		}
+	}
+	return 0
+}
+
+func setStripeReportedTotal(key string, total int64) {
+	stripeLock.Lock()
+	stripeReported[key] = total
+	stripeLock.Unlock()
+	if data, err := json.Marshal(total); err == nil {
+		util.SharedCacheSet("stripe-reported:"+key, data, statementRetention())
+	}
+}
+
+func postStripeUsage(cfg util.Stripe, report StripeReport, timestamp time.Time) error {
+	form := url.Values{}
+	form.Set("quantity", strconv.FormatInt(report.Quantity, 10))
+	form.Set("timestamp", strconv.FormatInt(timestamp.Unix(), 10))
+	form.Set("action", "set")
+	endpoint := fmt.Sprintf("%s/v1/subscription_items/%s/usage_records",
+		strings.TrimSuffix(util.AssignString(cfg.APIURL, defaultStripeURL), "/"), url.PathEscape(report.SubscriptionItem))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	req.Header.Set("Idempotency-Key", report.IdempotencyKey)
+	resp, err := stripeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failure status code %v %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// GetStripeReports returns the recent reports, the latest first
+func GetStripeReports() []StripeReport {
+	stripeLock.Lock()
+	defer stripeLock.Unlock()
+	reports := make([]StripeReport, 0, len(stripeReports))
+	for i := len(stripeReports) - 1; i >= 0; i-- {
+		reports = append(reports, stripeReports[i])
+	}
+	return reports
+}
+
+// ResetStripeReports drops the reported totals and the recent reports
+func ResetStripeReports() {
+	stripeLock.Lock()
+	stripeReported = make(map[string]int64)
+	stripeReports = []StripeReport{}
+	stripeLock.Unlock()
+}
@@ -0,0 +1,147 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Subscription lag report computed from the federated metrics cache
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// SubscriptionLag is the backlog and the estimated time to drain of a subscription,
+// the partitions of a partitioned topic are summed
+type SubscriptionLag struct {
+	Topic        string  `json:"topic"`
+	Namespace    string  `json:"namespace"`
+	Subscription string  `json:"subscription"`
+	Backlog      float64 `json:"backlog"`
+	RateOut      float64 `json:"rateOut"`
+	// TimeToDrainSeconds is the backlog divided by the rate out, it is null if a backlog is not consumed
+	TimeToDrainSeconds *float64 `json:"timeToDrainSeconds"`
+}
+
+// SubscriptionLagSorts are the sort keys of the subscription lag report
+var SubscriptionLagSorts = []string{"backlog", "drain", "rate-out", "name"}
+
+// GetSubscriptionLag returns the subscription lag report of a tenant sorted by a key in SubscriptionLagSorts,
+// descending unless ascending is set
+func GetSubscriptionLag(tenant, by string, ascending bool) ([]SubscriptionLag, error) {
+	data, err := GetTenantPromMetrics(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return SubscriptionLagReport(data, tenant, by, ascending)
+}
+
+// SubscriptionLagReport computes the subscription lag report of a tenant from the Prometheus text format data
+func SubscriptionLagReport(data []byte, tenant, by string, ascending bool) ([]SubscriptionLag, error) {
+	less, ok := map[string]func(a, b SubscriptionLag) bool{
+		"backlog":  func(a, b SubscriptionLag) bool { return a.Backlog < b.Backlog },
+		"rate-out": func(a, b SubscriptionLag) bool { return a.RateOut < b.RateOut },
+		"name":     func(a, b SubscriptionLag) bool { return a.Topic+"/"+a.Subscription < b.Topic+"/"+b.Subscription },
+		"drain":    func(a, b SubscriptionLag) bool { return drainSeconds(a) < drainSeconds(b) },
+	}[by]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sort %s, the sorts are %v", by, SubscriptionLagSorts)
+	}
+
+	var selected bytes.Buffer
+	for _, name := range []string{"pulsar_subscription_back_log", "pulsar_subscription_msg_rate_out"} {
+		selected.Write(selectMetricFamily(data, name))
+	}
+	parser := expfmt.TextParser{}
+	metricFamilies, err := parser.TextToMetricFamilies(&selected)
+	if err != nil {
+		return nil, err
+	}
+
+	lags := make(map[string]*SubscriptionLag)
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			var namespace, topic, subscription string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "namespace":
+					namespace = lp.GetValue()
+				case "topic":
+					topic = lp.GetValue()
+				case "subscription":
+					subscription = lp.GetValue()
+				}
+			}
+			if topic == "" || subscription == "" || strings.Split(namespace, "/")[0] != tenant {
+				continue
+			}
+			if i := strings.LastIndex(topic, "-partition-"); i > 0 {
+				topic = topic[:i]
+			}
+			key := topic + "|" + subscription
+			lag, ok := lags[key]
+			if !ok {
+				lag = &SubscriptionLag{Topic: topic, Namespace: namespace, Subscription: subscription}
+				lags[key] = lag
+			}
+			if name == "pulsar_subscription_back_log" {
+				lag.Backlog += seriesValue(m)
+			} else {
+				lag.RateOut += seriesValue(m)
+			}
+		}
+	}
+
+	report := make([]SubscriptionLag, 0, len(lags))
+	for _, lag := range lags {
+		if lag.Backlog == 0 {
+			zero := float64(0)
+			lag.TimeToDrainSeconds = &zero
+		} else if lag.RateOut > 0 {
+			seconds := lag.Backlog / lag.RateOut
+			lag.TimeToDrainSeconds = &seconds
+		}
+		report = append(report, *lag)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if less(report[i], report[j]) == less(report[j], report[i]) {
+			// ties are ordered by name
+			return report[i].Topic+"/"+report[i].Subscription < report[j].Topic+"/"+report[j].Subscription
+		}
+		if ascending {
+			return less(report[i], report[j])
+		}
+		return less(report[j], report[i])
+	})
+	return report, nil
+}
+
+// drainSeconds is the time to drain of a subscription, a backlog not consumed never drains
+func drainSeconds(lag SubscriptionLag) float64 {
+	if lag.TimeToDrainSeconds == nil {
+		return math.Inf(1)
+	}
+	return *lag.TimeToDrainSeconds
+}
@@ -0,0 +1,111 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Per topic stats computed from the federated metrics cache
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TopicMetrics are the key stats of a topic, the stats of the partitions are summed into the partitioned topic
+type TopicMetrics struct {
+	RateIn        float64 `json:"rateIn"`
+	RateOut       float64 `json:"rateOut"`
+	ThroughputIn  float64 `json:"throughputIn"`
+	ThroughputOut float64 `json:"throughputOut"`
+	Backlog       float64 `json:"backlog"`
+	StorageSize   float64 `json:"storageSize"`
+}
+
+// topicMetricNames are the Pulsar metrics of the topic stats
+var topicMetricNames = []string{"pulsar_rate_in", "pulsar_rate_out", "pulsar_throughput_in", "pulsar_throughput_out",
+	"pulsar_msg_backlog", "pulsar_storage_size"}
+
+// GetTopicMetrics returns the stats of the topics of a tenant by the topic full name from the metrics cache
+func GetTopicMetrics(tenant string) (map[string]TopicMetrics, error) {
+	data, err := GetTenantPromMetrics(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return TenantTopicMetrics(data, tenant)
+}
+
+// TenantTopicMetrics returns the stats of the topics of a tenant in the Prometheus text format data,
+// the partitions are summed by the partitioned topic name
+func TenantTopicMetrics(data []byte, tenant string) (map[string]TopicMetrics, error) {
+	var selected bytes.Buffer
+	for _, name := range topicMetricNames {
+		selected.Write(selectMetricFamily(data, name))
+	}
+	parser := expfmt.TextParser{}
+	metricFamilies, err := parser.TextToMetricFamilies(&selected)
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make(map[string]TopicMetrics)
+	for _, name := range topicMetricNames {
+		mf, ok := metricFamilies[name]
+		if !ok {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var namespace, topic string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "namespace":
+					namespace = lp.GetValue()
+				case "topic":
+					topic = lp.GetValue()
+				}
+			}
+			if topic == "" || strings.Split(namespace, "/")[0] != tenant {
+				continue
+			}
+			if i := strings.LastIndex(topic, "-partition-"); i > 0 {
+				topic = topic[:i]
+			}
+			t := topics[topic]
+			value := seriesValue(m)
+			switch name {
+			case "pulsar_rate_in":
+				t.RateIn += value
+			case "pulsar_rate_out":
+				t.RateOut += value
+			case "pulsar_throughput_in":
+				t.ThroughputIn += value
+			case "pulsar_throughput_out":
+				t.ThroughputOut += value
+			case "pulsar_msg_backlog":
+				t.Backlog += value
+			case "pulsar_storage_size":
+				t.StorageSize += value
+			}
+			topics[topic] = t
+		}
+	}
+	return topics, nil
+}
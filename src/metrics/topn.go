@@ -0,0 +1,142 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Top-N rankings of topics and namespaces computed from the federated metrics cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TopNMetrics maps the ranking dimensions to the Pulsar metric names
+var TopNMetrics = map[string]string{
+	"backlog":        "pulsar_msg_backlog",
+	"rate-in":        "pulsar_rate_in",
+	"rate-out":       "pulsar_rate_out",
+	"throughput-in":  "pulsar_throughput_in",
+	"throughput-out": "pulsar_throughput_out",
+	"storage":        "pulsar_storage_size",
+}
+
+// TopEntry is a ranked topic or namespace
+type TopEntry struct {
+	Name   string  `json:"name"`
+	Tenant string  `json:"tenant"`
+	Value  float64 `json:"value"`
+}
+
+// TopN ranks the topics, or namespaces if the group is namespace, of a tenant by a dimension defined in TopNMetrics.
+// The SuperRole tenant ranks across the cluster.
+func TopN(tenant, by, group string, n int) ([]TopEntry, error) {
+	metricName, ok := TopNMetrics[by]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ranking dimension %s", by)
+	}
+	if group != "topic" && group != "namespace" {
+		return nil, fmt.Errorf("unsupported group %s", group)
+	}
+	data, err := GetTenantPromMetrics(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return RankMetric(data, metricName, tenant, group, n)
+}
+
+// RankMetric ranks the series of a metric in the Prometheus text data, summed by topic or namespace,
+// the tenant filters series by the namespace label unless it is SuperRole
+func RankMetric(data []byte, metricName, tenant, group string, n int) ([]TopEntry, error) {
+	parser := expfmt.TextParser{}
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(selectMetricFamily(data, metricName)))
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]*TopEntry)
+	if mf, ok := metricFamilies[metricName]; ok {
+		for _, m := range mf.GetMetric() {
+			var namespace, topic string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "namespace":
+					namespace = lp.GetValue()
+				case "topic":
+					topic = lp.GetValue()
+				}
+			}
+			seriesTenant := strings.Split(namespace, "/")[0]
+			if seriesTenant == "" || (tenant != SuperRole && seriesTenant != tenant) {
+				continue
+			}
+			key := topic
+			if group == "namespace" {
+				key = namespace
+			}
+			if key == "" {
+				continue
+			}
+			entry, ok := totals[key]
+			if !ok {
+				entry = &TopEntry{Name: key, Tenant: seriesTenant}
+				totals[key] = entry
+			}
+			entry.Value += seriesValue(m)
+		}
+	}
+
+	entries := make([]TopEntry, 0, len(totals))
+	for _, v := range totals {
+		entries = append(entries, *v)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value == entries[j].Value {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Value > entries[j].Value
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
+
+// selectMetricFamily extracts the lines of a single metric family so that only those lines are parsed
+func selectMetricFamily(data []byte, metricName string) []byte {
+	var buf bytes.Buffer
+	typeDef := "# TYPE " + metricName + " "
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.HasPrefix(line, []byte(typeDef)) ||
+			(bytes.HasPrefix(line, []byte(metricName)) && len(line) > len(metricName) &&
+				(line[len(metricName)] == '{' || line[len(metricName)] == ' ')) {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
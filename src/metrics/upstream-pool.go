@@ -0,0 +1,67 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the upstream connection pool
+
+import (
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	stat := func(value func(util.UpstreamPoolStats) int64) func() float64 {
+		return func() float64 {
+			return float64(value(util.GetUpstreamPoolStats()))
+		}
+	}
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_upstream_dials_total",
+			Help: "The number of connections dialed to the brokers and function workers",
+		}, stat(func(s util.UpstreamPoolStats) int64 { return s.Dials })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "burnell_upstream_open_connections",
+			Help: "The number of open connections to the brokers and function workers",
+		}, stat(func(s util.UpstreamPoolStats) int64 { return s.OpenConns })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_upstream_reused_connections_total",
+			Help: "The number of upstream requests served by a pooled connection",
+		}, stat(func(s util.UpstreamPoolStats) int64 { return s.ReusedConns })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_upstream_new_connections_total",
+			Help: "The number of upstream requests served by a new connection",
+		}, stat(func(s util.UpstreamPoolStats) int64 { return s.NewConns })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_upstream_tls_handshakes_total",
+			Help: "The number of TLS handshakes to the brokers and function workers",
+		}, stat(func(s util.UpstreamPoolStats) int64 { return s.TLSHandshakes })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_upstream_tls_resumed_total",
+			Help: "The number of TLS handshakes resuming a cached session",
+		}, stat(func(s util.UpstreamPoolStats) int64 { return s.TLSResumed })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_upstream_coalesced_requests_total",
+			Help: "The number of upstream GETs served by the response of a concurrent identical GET",
+		}, func() float64 { return float64(util.CoalescedRequests()) }),
+	)
+}
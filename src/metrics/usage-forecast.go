@@ -0,0 +1,207 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Usage history, trends, and forecasts. The rollups keep a daily usage history of every tenant, and the forecasts
+// project the least squares trend lines of the history.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// DailyUsage is the usage of a tenant in a day in UTC
+type DailyUsage struct {
+	Date     string `json:"date"`
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	// StorageBytes is the storage size at the last scrape of the day
+	StorageBytes float64 `json:"storageBytes"`
+	// OffloadedBytes is the offloaded size at the last scrape of the day
+	OffloadedBytes float64 `json:"offloadedBytes"`
+	PeakThroughput float64 `json:"peakThroughputBytesPerSecond"`
+}
+
+// StorageHistory is the daily storage of a tenant, the growth is the total storage change over the history
+type StorageHistory struct {
+	Tenant      string         `json:"tenant"`
+	GrowthBytes float64        `json:"growthBytes"`
+	Daily       []DailyStorage `json:"daily"`
+}
+
+// DailyStorage is the storage size and the offloaded size of a tenant at the end of a day in UTC
+type DailyStorage struct {
+	Date           string  `json:"date"`
+	StorageBytes   float64 `json:"storageBytes"`
+	OffloadedBytes float64 `json:"offloadedBytes"`
+	TotalBytes     float64 `json:"totalBytes"`
+}
+
+// TrendLine is the least squares trend of a daily value projected over the horizon
+type TrendLine struct {
+	Current     float64 `json:"current"`
+	SlopePerDay float64 `json:"slopePerDay"`
+	Projected   float64 `json:"projected"`
+}
+
+// UsageForecast projects the storage and the peak throughput of a tenant
+type UsageForecast struct {
+	Tenant         string    `json:"tenant"`
+	HistoryDays    int       `json:"historyDays"`
+	HorizonDays    int       `json:"horizonDays"`
+	StorageBytes   TrendLine `json:"storageBytes"`
+	PeakThroughput TrendLine `json:"peakThroughputBytesPerSecond"`
+	GeneratedAt    time.Time `json:"generatedAt"`
+}
+
+const (
+	usageDateFormat         = "2006-01-02"
+	defaultUsageHistoryDays = 90
+	// DefaultForecastHorizonDays is the default horizon of the forecasts
+	DefaultForecastHorizonDays = 30
+)
+
+func usageHistoryDays() int {
+	if days := util.GetConfig().UsageStatements.HistoryDays; days > 0 {
+		return days
+	}
+	return defaultUsageHistoryDays
+}
+
+// addDaily adds a scrape to the usage of the day, the days out of the history retention are dropped
+func (r *usageRollup) addDaily(now time.Time, bytesIn, bytesOut uint64, storage, offloaded, throughput float64) {
+	date := now.UTC().Format(usageDateFormat)
+	if n := len(r.Daily); n == 0 || r.Daily[n-1].Date != date {
+		r.Daily = append(r.Daily, DailyUsage{Date: date})
+	}
+	d := &r.Daily[len(r.Daily)-1]
+	d.BytesIn += bytesIn
+	d.BytesOut += bytesOut
+	d.StorageBytes = storage
+	d.OffloadedBytes = offloaded
+	if throughput > d.PeakThroughput {
+		d.PeakThroughput = throughput
+	}
+	cutoff := now.UTC().AddDate(0, 0, -usageHistoryDays()).Format(usageDateFormat)
+	for len(r.Daily) > 0 && r.Daily[0].Date <= cutoff {
+		r.Daily = r.Daily[1:]
+	}
+}
+
+// trendLine fits the values by the day offsets with the least squares, and projects the value at the horizon
+// after the last day. A projection is never negative.
+func trendLine(days, values []float64, horizon int) TrendLine {
+	n := len(values)
+	if n == 0 {
+		return TrendLine{}
+	}
+	line := TrendLine{Current: values[n-1], Projected: values[n-1]}
+	if n < 2 {
+		return line
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range values {
+		sumX += days[i]
+		sumY += values[i]
+		sumXY += days[i] * values[i]
+		sumXX += days[i] * days[i]
+	}
+	denominator := float64(n)*sumXX - sumX*sumX
+	if denominator == 0 {
+		return line
+	}
+	line.SlopePerDay = (float64(n)*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - line.SlopePerDay*sumX) / float64(n)
+	line.Projected = intercept + line.SlopePerDay*(days[n-1]+float64(horizon))
+	if line.Projected < 0 {
+		line.Projected = 0
+	}
+	return line
+}
+
+func forecast(tenant string, daily []DailyUsage, horizon int, now time.Time) UsageForecast {
+	f := UsageForecast{Tenant: tenant, HistoryDays: len(daily), HorizonDays: horizon, GeneratedAt: now}
+	if len(daily) == 0 {
+		return f
+	}
+	first, _ := time.Parse(usageDateFormat, daily[0].Date)
+	days := make([]float64, len(daily))
+	storage := make([]float64, len(daily))
+	throughput := make([]float64, len(daily))
+	for i, d := range daily {
+		date, _ := time.Parse(usageDateFormat, d.Date)
+		days[i] = date.Sub(first).Hours() / 24
+		storage[i], throughput[i] = d.StorageBytes, d.PeakThroughput
+	}
+	f.StorageBytes = trendLine(days, storage, horizon)
+	f.PeakThroughput = trendLine(days, throughput, horizon)
+	return f
+}
+
+// GetUsageForecasts returns the forecasts of a tenant, or all tenants if the tenant is empty, over the horizon days
+func GetUsageForecasts(tenant string, horizon int) []UsageForecast {
+	now := time.Now()
+	forecasts := []UsageForecast{}
+	statementLock.RLock()
+	for t, rollup := range usageRollups {
+		if tenant == "" || tenant == t {
+			forecasts = append(forecasts, forecast(t, rollup.Daily, horizon, now))
+		}
+	}
+	statementLock.RUnlock()
+	sort.Slice(forecasts, func(i, j int) bool { return forecasts[i].Tenant < forecasts[j].Tenant })
+	return forecasts
+}
+
+// GetStorageHistory returns the daily storage of a tenant, or all tenants if the tenant is empty, over the last days
+// of the history, all the retained days if days is not positive
+func GetStorageHistory(tenant string, days int) []StorageHistory {
+	histories := []StorageHistory{}
+	statementLock.RLock()
+	for t, rollup := range usageRollups {
+		if tenant != "" && tenant != t {
+			continue
+		}
+		daily := rollup.Daily
+		if days > 0 && len(daily) > days {
+			daily = daily[len(daily)-days:]
+		}
+		h := StorageHistory{Tenant: t, Daily: make([]DailyStorage, 0, len(daily))}
+		for _, d := range daily {
+			h.Daily = append(h.Daily, DailyStorage{
+				Date:           d.Date,
+				StorageBytes:   d.StorageBytes,
+				OffloadedBytes: d.OffloadedBytes,
+				TotalBytes:     d.StorageBytes + d.OffloadedBytes,
+			})
+		}
+		if n := len(h.Daily); n > 0 {
+			h.GrowthBytes = h.Daily[n-1].TotalBytes - h.Daily[0].TotalBytes
+		}
+		histories = append(histories, h)
+	}
+	statementLock.RUnlock()
+	sort.Slice(histories, func(i, j int) bool { return histories[i].Tenant < histories[j].Tenant })
+	return histories
+}
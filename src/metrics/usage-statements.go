@@ -0,0 +1,495 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Monthly usage statements of the tenants rolled up from the federated metrics scrapes.
+// Every rollup adds the counter deltas since the previous scrape to the statement of the current cycle,
+// and the statements of the previous cycle are closed once a scrape falls in a new cycle.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// UsageStatement is the usage of a tenant in a billing cycle, a calendar month in UTC
+type UsageStatement struct {
+	Tenant         string    `json:"tenant"`
+	Cycle          string    `json:"cycle"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	BytesIn        uint64    `json:"bytesIn"`
+	BytesOut       uint64    `json:"bytesOut"`
+	StorageGBHours float64   `json:"storageGbHours"`
+	// PeakThroughput is the highest bytes in and out per second between two scrapes
+	PeakThroughput float64 `json:"peakThroughputBytesPerSecond"`
+	PeakTopics     int     `json:"peakTopics"`
+	Topics         int     `json:"topics"`
+	Final          bool    `json:"final"`
+	// Allocations split the bytes and the storage by the cost labels of the namespaces
+	Allocations []CostAllocation `json:"allocations,omitempty"`
+}
+
+// CostAllocation is the usage of the namespaces with the same cost labels, the unlabeled namespaces have no labels
+type CostAllocation struct {
+	Labels         map[string]string `json:"labels,omitempty"`
+	BytesIn        uint64            `json:"bytesIn"`
+	BytesOut       uint64            `json:"bytesOut"`
+	StorageGBHours float64           `json:"storageGbHours"`
+}
+
+// allocation returns the allocation of the labels, it is inserted in the order of the label keys if it does not exist
+func (s *UsageStatement) allocation(labels map[string]string) *CostAllocation {
+	key := util.CostLabelKey(labels)
+	i := sort.Search(len(s.Allocations), func(i int) bool {
+		return util.CostLabelKey(s.Allocations[i].Labels) >= key
+	})
+	if i == len(s.Allocations) || util.CostLabelKey(s.Allocations[i].Labels) != key {
+		s.Allocations = append(s.Allocations, CostAllocation{})
+		copy(s.Allocations[i+1:], s.Allocations[i:])
+		s.Allocations[i] = CostAllocation{Labels: labels}
+	}
+	return &s.Allocations[i]
+}
+
+// usageRollup is the open statement of a tenant and the counters of the last scrape
+type usageRollup struct {
+	Statement  UsageStatement              `json:"statement"`
+	BytesIn    uint64                      `json:"bytesIn"`
+	BytesOut   uint64                      `json:"bytesOut"`
+	Namespaces map[string]namespaceCounter `json:"namespaces"`
+	LastAt     time.Time                   `json:"lastAt"`
+	// Daily is the usage history of the trends
+	Daily []DailyUsage `json:"daily"`
+	// SchemaVersion is the usage schema version of the stored rollup, the baseline version has none
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+}
+
+type namespaceCounter struct {
+	BytesIn  uint64  `json:"bytesIn"`
+	BytesOut uint64  `json:"bytesOut"`
+	Storage  float64 `json:"-"`
+}
+
+type tenantScrape struct {
+	bytesIn    uint64
+	bytesOut   uint64
+	storage    float64
+	offloaded  float64
+	topics     map[string]bool
+	namespaces map[string]namespaceCounter
+}
+
+const (
+	// UsageCycleFormat is the format of a billing cycle
+	UsageCycleFormat = "2006-01"
+
+	defaultStatementRetentionMonths = 13
+	statementPushAttempts           = 3
+)
+
+var (
+	statementLock = sync.RWMutex{}
+	usageRollups  = make(map[string]*usageRollup)
+	// the closed statements by cycle and tenant
+	closedStatements = make(map[string]map[string]UsageStatement)
+
+	statementClient = &http.Client{Timeout: 30 * time.Second}
+	// statementRetryDelay is the base delay between the push attempts
+	statementRetryDelay = 5 * time.Second
+)
+
+// UsageCycle is the billing cycle of a time
+func UsageCycle(t time.Time) string {
+	return t.UTC().Format(UsageCycleFormat)
+}
+
+func statementRetention() time.Duration {
+	months := util.GetConfig().UsageStatements.RetentionMonths
+	if months <= 0 {
+		months = defaultStatementRetentionMonths
+	}
+	return time.Duration(months) * 31 * 24 * time.Hour
+}
+
+// counterDelta is the increase of a counter, a counter lower than the last value has been reset by a broker restart
+func counterDelta(current, last uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+func scrapeTenants(metricFamilies map[string]*dto.MetricFamily) map[string]*tenantScrape {
+	scrapes := make(map[string]*tenantScrape)
+	for _, name := range []string{"pulsar_in_bytes_total", "pulsar_out_bytes_total", "pulsar_storage_size", "pulsar_storage_offloaded_size"} {
+		mf, ok := metricFamilies[name]
+		if !ok {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var namespace, topic string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "namespace":
+					namespace = lp.GetValue()
+				case "topic":
+					topic = lp.GetValue()
+				}
+			}
+			tenant := strings.Split(namespace, "/")[0]
+			if tenant == "" {
+				continue
+			}
+			s, ok := scrapes[tenant]
+			if !ok {
+				s = &tenantScrape{topics: make(map[string]bool), namespaces: make(map[string]namespaceCounter)}
+				scrapes[tenant] = s
+			}
+			if topic != "" {
+				s.topics[topic] = true
+			}
+			value := seriesValue(m)
+			ns := s.namespaces[namespace]
+			switch name {
+			case "pulsar_in_bytes_total":
+				s.bytesIn += uint64(value)
+				ns.BytesIn += uint64(value)
+			case "pulsar_out_bytes_total":
+				s.bytesOut += uint64(value)
+				ns.BytesOut += uint64(value)
+			case "pulsar_storage_size":
+				s.storage += value
+				ns.Storage += value
+			default:
+				s.offloaded += value
+			}
+			s.namespaces[namespace] = ns
+		}
+	}
+	return scrapes
+}
+
+// RollupUsageStatements adds a scrape at the time now to the statements of the tenants
+func RollupUsageStatements(metricFamilies map[string]*dto.MetricFamily, now time.Time) {
+	scrapes := scrapeTenants(metricFamilies)
+	cycle := UsageCycle(now)
+	closed := []UsageStatement{}
+
+	statementLock.Lock()
+	for tenant, scrape := range scrapes {
+		if _, ok := usageRollups[tenant]; !ok {
+			usageRollups[tenant] = loadUsageRollup(tenant)
+		}
+		if usageRollups[tenant] == nil {
+			// the first scrape is the baseline of the counters
+			usageRollups[tenant] = &usageRollup{
+				Statement:  UsageStatement{Tenant: tenant, Cycle: cycle, From: now, To: now},
+				BytesIn:    scrape.bytesIn,
+				BytesOut:   scrape.bytesOut,
+				Namespaces: scrape.namespaces,
+				LastAt:     now,
+			}
+		}
+	}
+	for tenant, rollup := range usageRollups {
+		if rollup.Statement.Cycle != cycle {
+			statement := rollup.Statement
+			statement.Final = true
+			closed = append(closed, statement)
+			if _, ok := closedStatements[statement.Cycle]; !ok {
+				closedStatements[statement.Cycle] = make(map[string]UsageStatement)
+			}
+			closedStatements[statement.Cycle][tenant] = statement
+			rollup.Statement = UsageStatement{Tenant: tenant, Cycle: cycle, From: now, To: now}
+		}
+		scrape, ok := scrapes[tenant]
+		if !ok {
+			continue
+		}
+		var deltaIn, deltaOut uint64
+		var throughput float64
+		statement := &rollup.Statement
+		if elapsed := now.Sub(rollup.LastAt); elapsed > 0 {
+			deltaIn, deltaOut = counterDelta(scrape.bytesIn, rollup.BytesIn), counterDelta(scrape.bytesOut, rollup.BytesOut)
+			throughput = float64(deltaIn+deltaOut) / elapsed.Seconds()
+			statement.BytesIn += deltaIn
+			statement.BytesOut += deltaOut
+			statement.StorageGBHours += scrape.storage / 1e9 * elapsed.Hours()
+			if throughput > statement.PeakThroughput {
+				statement.PeakThroughput = throughput
+			}
+			allocateUsage(tenant, statement, rollup.Namespaces, scrape.namespaces, elapsed)
+		}
+		rollup.addDaily(now, deltaIn, deltaOut, scrape.storage, scrape.offloaded, throughput)
+		statement.Topics = len(scrape.topics)
+		if statement.Topics > statement.PeakTopics {
+			statement.PeakTopics = statement.Topics
+		}
+		statement.To = now
+		rollup.BytesIn, rollup.BytesOut, rollup.LastAt = scrape.bytesIn, scrape.bytesOut, now
+		rollup.Namespaces = scrape.namespaces
+		storeUsageRollup(tenant, rollup)
+	}
+	cutoff := UsageCycle(now.Add(-statementRetention()))
+	for c := range closedStatements {
+		if c < cutoff {
+			delete(closedStatements, c)
+		}
+	}
+	statementLock.Unlock()
+
+	if len(closed) > 0 {
+		sortStatements(closed)
+		for _, s := range closed {
+			if data, err := json.Marshal(s); err == nil {
+				util.SharedCacheSet("usage-statement:"+s.Cycle+":"+s.Tenant, data, statementRetention())
+			}
+		}
+		logger.Infof("closed %d usage statements of cycle %s", len(closed), closed[0].Cycle)
+		if util.GetConfig().UsageStatements.Destination != "" {
+			go pushUsageStatements(closed)
+		}
+	}
+}
+
+// allocateUsage adds the namespace deltas to the allocations of the namespace cost labels at the scrape.
+// The namespaces are baselines if the last scrape has no namespace counters.
+func allocateUsage(tenant string, statement *UsageStatement, last, current map[string]namespaceCounter, elapsed time.Duration) {
+	if last == nil {
+		return
+	}
+	for namespace, c := range current {
+		prev := last[namespace]
+		labels := util.GetCostLabels(tenant, strings.TrimPrefix(namespace, tenant+"/"))
+		a := statement.allocation(labels)
+		a.BytesIn += counterDelta(c.BytesIn, prev.BytesIn)
+		a.BytesOut += counterDelta(c.BytesOut, prev.BytesOut)
+		a.StorageGBHours += c.Storage / 1e9 * elapsed.Hours()
+	}
+}
+
+// loadUsageRollup resumes the open statement of a tenant rolled up by the previous leader
+func loadUsageRollup(tenant string) *usageRollup {
+	data, ok := util.SharedCacheGet("usage-rollup:" + tenant)
+	if !ok {
+		return nil
+	}
+	rollup, err := decodeUsageRollup(data)
+	if err != nil {
+		logger.Errorf("failed to load the usage rollup of tenant %s %v", tenant, err)
+		return nil
+	}
+	return rollup
+}
+
+// decodeUsageRollup parses a stored rollup and migrates it from its schema version to the version of the release
+func decodeUsageRollup(data []byte) (*usageRollup, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	version := util.BaselineSchemaVersion
+	if v, ok := doc["schemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	latest := util.LatestSchemaVersion(util.UsageSchema)
+	if version != latest {
+		if err := util.MigrateDocument(util.UsageSchema, doc, version, latest); err != nil {
+			return nil, err
+		}
+		doc["schemaVersion"] = latest
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	var rollup usageRollup
+	if err := json.Unmarshal(data, &rollup); err != nil {
+		return nil, err
+	}
+	return &rollup, nil
+}
+
+func storeUsageRollup(tenant string, rollup *usageRollup) {
+	if latest := util.LatestSchemaVersion(util.UsageSchema); latest > util.BaselineSchemaVersion {
+		rollup.SchemaVersion = latest
+	}
+	if data, err := json.Marshal(rollup); err == nil {
+		util.SharedCacheSet("usage-rollup:"+tenant, data, statementRetention())
+	}
+}
+
+func sortStatements(statements []UsageStatement) {
+	sort.Slice(statements, func(i, j int) bool {
+		if statements[i].Cycle == statements[j].Cycle {
+			return statements[i].Tenant < statements[j].Tenant
+		}
+		return statements[i].Cycle < statements[j].Cycle
+	})
+}
+
+// GetUsageStatements returns the statements of a cycle, the open statements of the current cycle are not final.
+// An empty tenant returns the statements of all tenants.
+func GetUsageStatements(tenant, cycle string) []UsageStatement {
+	statements := []UsageStatement{}
+	statementLock.RLock()
+	for t, rollup := range usageRollups {
+		if rollup.Statement.Cycle == cycle && (tenant == "" || tenant == t) {
+			statements = append(statements, rollup.Statement)
+		}
+	}
+	for t, s := range closedStatements[cycle] {
+		if tenant == "" || tenant == t {
+			statements = append(statements, s)
+		}
+	}
+	statementLock.RUnlock()
+
+	if len(statements) == 0 && tenant != "" {
+		if data, ok := util.SharedCacheGet("usage-statement:" + cycle + ":" + tenant); ok {
+			var s UsageStatement
+			if err := json.Unmarshal(data, &s); err == nil {
+				statements = append(statements, s)
+			}
+		}
+	}
+	sortStatements(statements)
+	return statements
+}
+
+// ResetUsageStatements drops the rollups and the closed statements
+func ResetUsageStatements() {
+	statementLock.Lock()
+	usageRollups = make(map[string]*usageRollup)
+	closedStatements = make(map[string]map[string]UsageStatement)
+	statementLock.Unlock()
+}
+
+// WriteUsageStatementsCSV writes the statements in CSV with a header row
+func WriteUsageStatementsCSV(w io.Writer, statements []UsageStatement) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"tenant", "cycle", "from", "to", "bytes_in", "bytes_out", "storage_gb_hours",
+		"peak_throughput_bytes_per_second", "peak_topics", "topics", "final"})
+	for _, s := range statements {
+		writer.Write([]string{
+			s.Tenant,
+			s.Cycle,
+			s.From.UTC().Format(time.RFC3339),
+			s.To.UTC().Format(time.RFC3339),
+			strconv.FormatUint(s.BytesIn, 10),
+			strconv.FormatUint(s.BytesOut, 10),
+			strconv.FormatFloat(s.StorageGBHours, 'f', 6, 64),
+			strconv.FormatFloat(s.PeakThroughput, 'f', 2, 64),
+			strconv.Itoa(s.PeakTopics),
+			strconv.Itoa(s.Topics),
+			strconv.FormatBool(s.Final),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteCostAllocationsCSV writes a row per cost allocation of the statements with a header row,
+// the labels are in the canonical form of name=value pairs joined by commas
+func WriteCostAllocationsCSV(w io.Writer, statements []UsageStatement) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"tenant", "cycle", "labels", "bytes_in", "bytes_out", "storage_gb_hours", "final"})
+	for _, s := range statements {
+		for _, a := range s.Allocations {
+			writer.Write([]string{
+				s.Tenant,
+				s.Cycle,
+				util.CostLabelKey(a.Labels),
+				strconv.FormatUint(a.BytesIn, 10),
+				strconv.FormatUint(a.BytesOut, 10),
+				strconv.FormatFloat(a.StorageGBHours, 'f', 6, 64),
+				strconv.FormatBool(s.Final),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// pushUsageStatements posts the closed statements to the destination, it retries with a linear backoff
+func pushUsageStatements(statements []UsageStatement) {
+	cfg := util.GetConfig().UsageStatements
+	var body bytes.Buffer
+	contentType := "application/json"
+	if strings.EqualFold(cfg.Format, "csv") {
+		contentType = "text/csv"
+		write := WriteUsageStatementsCSV
+		if cfg.SplitByLabels {
+			write = WriteCostAllocationsCSV
+		}
+		if err := write(&body, statements); err != nil {
+			logger.Errorf("failed to write usage statements error %v", err)
+			return
+		}
+	} else if err := json.NewEncoder(&body).Encode(statements); err != nil {
+		logger.Errorf("failed to marshal usage statements error %v", err)
+		return
+	}
+
+	var err error
+	for attempt := 1; attempt <= statementPushAttempts; attempt++ {
+		if err = postUsageStatements(cfg, contentType, body.Bytes()); err == nil {
+			logger.Infof("pushed %d usage statements to the destination", len(statements))
+			return
+		}
+		logger.Warnf("failed to push usage statements attempt %d error %v", attempt, err)
+		time.Sleep(time.Duration(attempt) * statementRetryDelay)
+	}
+	logger.Errorf("gave up pushing %d usage statements error %v", len(statements), err)
+}
+
+func postUsageStatements(cfg util.UsageStatements, contentType string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, cfg.Destination, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := statementClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("failure status code %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package metrics
+
+// Self-metrics of the token verification pool
+
+import (
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	stat := func(value func(util.VerificationPoolStats) int64) func() float64 {
+		return func() float64 {
+			return float64(value(util.GetVerificationPoolStats()))
+		}
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "burnell_token_verification_workers",
+			Help: "The number of workers of the token verification pool",
+		}, stat(func(s util.VerificationPoolStats) int64 { return s.Workers })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "burnell_token_verification_active",
+			Help: "The number of token verifications running",
+		}, stat(func(s util.VerificationPoolStats) int64 { return s.Active })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "burnell_token_verification_queue_depth",
+			Help: "The number of token verifications waiting for a worker",
+		}, stat(func(s util.VerificationPoolStats) int64 { return s.Queued })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_token_verifications_total",
+			Help: "The number of token verifications run by the pool",
+		}, stat(func(s util.VerificationPoolStats) int64 { return s.Verified })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "burnell_token_verifications_shed_total",
+			Help: "The number of token verifications shed with 503 because the pool is overloaded",
+		}, stat(func(s util.VerificationPoolStats) int64 { return s.Shed })),
+	)
+}
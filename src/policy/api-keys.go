@@ -0,0 +1,207 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// API key store. The key records with the secret digests are stored on a topic in the same way as the tenant plans,
+// and resolved from the registry in util.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/util"
+)
+
+// APIKeyRequest is the request to create an API key
+type APIKeyRequest struct {
+	Name        string   `json:"name"`
+	Subject     string   `json:"subject"`
+	Namespaces  []string `json:"namespaces"`
+	Permissions []string `json:"permissions"`
+	// Exp is the duration of the key such as 30d, empty does not expire
+	Exp string `json:"exp"`
+}
+
+// APIKeyHandler is the API key store backed by a topic
+type APIKeyHandler struct {
+	client    pulsar.Client
+	topicName string
+	logger    *log.Entry
+}
+
+// APIKeyStore is the global API key store, it is nil until the policy is initialized
+var APIKeyStore *APIKeyHandler
+
+// apiKeyMACProperty is the message property of the HMAC of an API key record
+const apiKeyMACProperty = "mac"
+
+// InitAPIKeyStore starts the API key listener on the APIKeyTopic. The records are signed with the IntegrityKey,
+// and the store is disabled without it.
+func InitAPIKeyStore(client pulsar.Client) error {
+	if !util.IntegrityKeyConfigured() {
+		log.Warnf("IntegrityKey is not configured, the API keys are disabled")
+		return nil
+	}
+	s := &APIKeyHandler{
+		client:    client,
+		topicName: util.AssignString(util.GetConfig().APIKeyTopic, "persistent://public/default/burnell-api-keys"),
+		logger:    log.WithFields(log.Fields{"app": "apikeystore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.apiKeyListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.apiKeyListener(sig)
+			}
+		}
+	}()
+	APIKeyStore = s
+	return nil
+}
+
+func (s *APIKeyHandler) apiKeyListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("API key store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("API key store reader error %v", err)
+			return err
+		}
+		if !util.VerifyRecordMAC(s.topicName, data.Payload(), data.Properties()[apiKeyMACProperty]) {
+			s.logger.Errorf("API key record %s has an invalid signature, it is skipped", data.Key())
+			continue
+		}
+		key := util.APIKey{}
+		if err = json.Unmarshal(data.Payload(), &key); err != nil {
+			s.logger.Errorf("API key unmarshal error %v", err)
+			continue
+		}
+		util.ApplyAPIKey(key)
+	}
+}
+
+// NewAPIKey validates the request and generates a key of the tenant, the key string is only returned once
+func NewAPIKey(tenant, subject string, req APIKeyRequest) (string, util.APIKey, error) {
+	for _, ns := range req.Namespaces {
+		parts := strings.Split(ns, "/")
+		if len(parts) != 2 || parts[0] != tenant || parts[1] == "" {
+			return "", util.APIKey{}, fmt.Errorf("namespace %s must be in the format of %s/namespace", ns, tenant)
+		}
+	}
+	for _, p := range req.Permissions {
+		if p != icrypto.PermissionRead && p != icrypto.PermissionWrite {
+			return "", util.APIKey{}, fmt.Errorf("invalid permission %s", p)
+		}
+	}
+	if len(req.Namespaces) > 0 && len(req.Permissions) == 0 {
+		req.Permissions = []string{icrypto.PermissionRead, icrypto.PermissionWrite}
+	}
+	var ttl time.Duration
+	if req.Exp != "" {
+		var err error
+		if ttl, _, err = icrypto.ValidateClaims(req.Exp, "rs256"); err != nil {
+			return "", util.APIKey{}, err
+		}
+	}
+
+	keyStr, key, err := util.NewAPIKey(tenant, subject)
+	if err != nil {
+		return "", util.APIKey{}, err
+	}
+	key.Name, key.Namespaces, key.Permissions = req.Name, req.Namespaces, req.Permissions
+	if ttl > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(ttl)
+	}
+	return keyStr, key, nil
+}
+
+// CreateAPIKey generates and stores a key of the tenant, the key string is only returned once
+func (s *APIKeyHandler) CreateAPIKey(tenant, subject string, req APIKeyRequest) (string, util.APIKey, error) {
+	keyStr, key, err := NewAPIKey(tenant, subject, req)
+	if err != nil {
+		return "", util.APIKey{}, err
+	}
+	if err := s.send(key); err != nil {
+		return "", util.APIKey{}, err
+	}
+	key.Hash = ""
+	return keyStr, key, nil
+}
+
+// RevokeAPIKey deletes a key of the tenant
+func (s *APIKeyHandler) RevokeAPIKey(tenant, id string) error {
+	key, ok := util.GetAPIKey(id)
+	if !ok || key.Tenant != tenant {
+		return fmt.Errorf("API key %s is not found", id)
+	}
+	return s.send(util.APIKey{ID: id, Tenant: tenant, Deleted: true})
+}
+
+func (s *APIKeyHandler) send(key util.APIKey) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload:    data,
+		Key:        key.ID,
+		Properties: map[string]string{apiKeyMACProperty: util.RecordMAC(s.topicName, data)},
+	}
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	util.ApplyAPIKey(key)
+	return nil
+}
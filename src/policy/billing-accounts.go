@@ -0,0 +1,142 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Billing account store. The accounts are stored on a topic in the same way as the tenant plans,
+// and resolved from the registry in util.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// BillingAccountHandler is the billing account store backed by a topic
+type BillingAccountHandler struct {
+	client    pulsar.Client
+	topicName string
+	logger    *log.Entry
+}
+
+// BillingAccountStore is the global billing account store, it is nil until the policy is initialized
+var BillingAccountStore *BillingAccountHandler
+
+// InitBillingAccountStore starts the billing account listener on the BillingAccountTopic
+func InitBillingAccountStore(client pulsar.Client) error {
+	s := &BillingAccountHandler{
+		client:    client,
+		topicName: util.AssignString(util.GetConfig().BillingAccountTopic, "persistent://public/default/burnell-billing-accounts"),
+		logger:    log.WithFields(log.Fields{"app": "billingaccountstore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.billingAccountListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.billingAccountListener(sig)
+			}
+		}
+	}()
+	BillingAccountStore = s
+	return nil
+}
+
+func (s *BillingAccountHandler) billingAccountListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("billing account store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("billing account store reader error %v", err)
+			return err
+		}
+		account := util.BillingAccount{}
+		if err = json.Unmarshal(data.Payload(), &account); err != nil {
+			s.logger.Errorf("billing account unmarshal error %v", err)
+			continue
+		}
+		util.ApplyBillingAccount(account)
+	}
+}
+
+// PutBillingAccount creates or replaces the billing account of a tenant
+func (s *BillingAccountHandler) PutBillingAccount(tenant string, account util.BillingAccount) (util.BillingAccount, error) {
+	account.Tenant, account.UpdatedAt, account.Deleted = tenant, time.Now(), false
+	if err := account.Validate(); err != nil {
+		return util.BillingAccount{}, err
+	}
+	return account, s.send(account)
+}
+
+// DeleteBillingAccount stops the billing of a tenant
+func (s *BillingAccountHandler) DeleteBillingAccount(tenant string) error {
+	if _, ok := util.GetBillingAccount(tenant); !ok {
+		return fmt.Errorf("tenant %s has no billing account", tenant)
+	}
+	return s.send(util.BillingAccount{Tenant: tenant, Deleted: true, UpdatedAt: time.Now()})
+}
+
+func (s *BillingAccountHandler) send(account util.BillingAccount) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     account.Tenant,
+	}
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	util.ApplyBillingAccount(account)
+	return nil
+}
@@ -0,0 +1,63 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// brokerHealthTimeout is the timeout of a broker health check
+const brokerHealthTimeout = 5 * time.Second
+
+// CheckBrokerHealth runs the health check of the admin REST API of a broker
+func CheckBrokerHealth(broker string) error {
+	urlString := broker
+	if !strings.HasPrefix(urlString, "http") {
+		urlString = "http://" + urlString
+	}
+	healthURL := util.SingleJoinSlash(urlString, "admin/v2/brokers/health")
+	ctx, cancel := context.WithTimeout(context.Background(), brokerHealthTimeout)
+	defer cancel()
+	newRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return err
+	}
+	newRequest.Header.Add("user-agent", "burnell")
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	response, err := util.UpstreamClient().Do(newRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("health check status code %d %s", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Cost allocation label store. The labels are stored on a topic in the same way as the tenant plans,
+// and resolved from the registry in util.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// CostLabelHandler is the cost label store backed by a topic
+type CostLabelHandler struct {
+	client    pulsar.Client
+	topicName string
+	logger    *log.Entry
+}
+
+// CostLabelStore is the global cost label store, it is nil until the policy is initialized
+var CostLabelStore *CostLabelHandler
+
+// InitCostLabelStore starts the cost label listener on the CostLabelTopic
+func InitCostLabelStore(client pulsar.Client) error {
+	s := &CostLabelHandler{
+		client:    client,
+		topicName: util.AssignString(util.GetConfig().CostLabelTopic, "persistent://public/default/burnell-cost-labels"),
+		logger:    log.WithFields(log.Fields{"app": "costlabelstore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.costLabelListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.costLabelListener(sig)
+			}
+		}
+	}()
+	CostLabelStore = s
+	return nil
+}
+
+func (s *CostLabelHandler) costLabelListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("cost label store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("cost label store reader error %v", err)
+			return err
+		}
+		labels := util.NamespaceCostLabels{}
+		if err = json.Unmarshal(data.Payload(), &labels); err != nil {
+			s.logger.Errorf("cost label unmarshal error %v", err)
+			continue
+		}
+		util.ApplyCostLabels(labels)
+	}
+}
+
+// PutCostLabels replaces the labels of a namespace
+func (s *CostLabelHandler) PutCostLabels(tenant, namespace string, labels map[string]string) (util.NamespaceCostLabels, error) {
+	if err := util.ValidateCostLabels(labels); err != nil {
+		return util.NamespaceCostLabels{}, err
+	}
+	l := util.NamespaceCostLabels{Tenant: tenant, Namespace: namespace, Labels: labels, UpdatedAt: time.Now()}
+	return l, s.send(l)
+}
+
+// DeleteCostLabels removes the labels of a namespace
+func (s *CostLabelHandler) DeleteCostLabels(tenant, namespace string) error {
+	if util.GetCostLabels(tenant, namespace) == nil {
+		return fmt.Errorf("namespace %s/%s has no cost labels", tenant, namespace)
+	}
+	return s.send(util.NamespaceCostLabels{Tenant: tenant, Namespace: namespace, Deleted: true, UpdatedAt: time.Now()})
+}
+
+func (s *CostLabelHandler) send(labels util.NamespaceCostLabels) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     labels.Tenant + "/" + labels.Namespace,
+	}
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	util.ApplyCostLabels(labels)
+	return nil
+}
@@ -0,0 +1,142 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Per tenant configuration overrides.
+// The overrides are stored on a topic in the same way as the tenant plans, and merged over the global defaults by util.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// TenantOverridesHandler is the tenant override store backed by a topic
+type TenantOverridesHandler struct {
+	client    pulsar.Client
+	topicName string
+	logger    *log.Entry
+}
+
+// OverridesStore is the global tenant override store, it is nil until the policy is initialized
+var OverridesStore *TenantOverridesHandler
+
+// InitOverridesStore starts the override listener on the TenantOverridesTopic
+func InitOverridesStore(client pulsar.Client) error {
+	s := &TenantOverridesHandler{
+		client:    client,
+		topicName: util.AssignString(util.GetConfig().TenantOverridesTopic, "persistent://public/default/tenant-overrides"),
+		logger:    log.WithFields(log.Fields{"app": "overridesstore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.overridesListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.overridesListener(sig)
+			}
+		}
+	}()
+	OverridesStore = s
+	return nil
+}
+
+func (s *TenantOverridesHandler) overridesListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("overrides store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("overrides store reader error %v", err)
+			return err
+		}
+		overrides := util.TenantOverrides{}
+		if err = json.Unmarshal(data.Payload(), &overrides); err != nil {
+			s.logger.Errorf("overrides unmarshal error %v", err)
+			continue
+		}
+		util.ApplyTenantOverrides(overrides)
+	}
+}
+
+// PutOverrides creates or replaces the overrides of a tenant
+func (s *TenantOverridesHandler) PutOverrides(tenant string, settings util.TenantSettings) (util.TenantOverrides, error) {
+	if err := settings.Validate(); err != nil {
+		return util.TenantOverrides{}, err
+	}
+	overrides := util.TenantOverrides{Tenant: tenant, Settings: settings, UpdatedAt: time.Now()}
+	return overrides, s.send(overrides)
+}
+
+// DeleteOverrides reverts a tenant to the global defaults
+func (s *TenantOverridesHandler) DeleteOverrides(tenant string) error {
+	if _, ok := util.GetTenantOverrides(tenant); !ok {
+		return fmt.Errorf("tenant %s has no overrides", tenant)
+	}
+	return s.send(util.TenantOverrides{Tenant: tenant, Deleted: true, UpdatedAt: time.Now()})
+}
+
+func (s *TenantOverridesHandler) send(overrides util.TenantOverrides) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     overrides.Tenant,
+	}
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	util.ApplyTenantOverrides(overrides)
+	return nil
+}
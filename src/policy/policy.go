@@ -26,6 +26,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/datastax/burnell/src/audit"
 	"github.com/datastax/burnell/src/util"
 	"github.com/kafkaesque-io/pulsar-beam/src/db"
 )
@@ -202,13 +203,53 @@ func Initialize() {
 	if err := TenantManager.Setup(); err != nil {
 		log.Fatal(err)
 	}
+	if err := InitShards(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitSecretStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitOverridesStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitAPIKeyStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitWebhookStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitCostLabelStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitBillingAccountStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if err := InitSchemaVersionStore(TenantManager.client); err != nil {
+		log.Fatal(err)
+	}
+	if topic := util.GetConfig().AuditTopic; topic != "" {
+		audit.AddSink(audit.NewPulsarSink(TenantManager.client, topic, util.GetConfig().AuditBufferSize))
+	}
+	if es := util.GetConfig().AuditElasticsearch; len(es.URLs) > 0 {
+		audit.AddSink(audit.NewElasticsearchSink(audit.ElasticsearchOptions{
+			URLs:        es.URLs,
+			Username:    es.Username,
+			Password:    es.Password,
+			APIKey:      es.APIKey,
+			IndexPrefix: es.IndexPrefix,
+			Shards:      es.Shards,
+			Replicas:    es.Replicas,
+			BulkSize:    es.BulkSize,
+			BufferSize:  es.BufferSize,
+		}))
+	}
 
 	if util.GetConfig().PulsarBeamTopic != "" {
 
 		PulsarBeamManager = db.PulsarHandler{}
 		PulsarBeamManager.PulsarURL = util.GetConfig().PulsarURL
 		PulsarBeamManager.TopicName = util.GetConfig().PulsarBeamTopic
-		PulsarBeamManager.PulsarToken = util.GetConfig().PulsarToken
+		PulsarBeamManager.PulsarToken = util.PulsarToken()
 		if err := PulsarBeamManager.Init(); err != nil {
 			log.Fatal(err)
 		}
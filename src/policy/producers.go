@@ -0,0 +1,193 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Cached producers to publish the messages of the tenants with the burnell credentials
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	producerIdleTimeout = 5 * time.Minute
+	maxCachedProducers  = 100
+	produceSendTimeout  = 10 * time.Second
+)
+
+var produceLog = log.WithFields(log.Fields{"app": "producers"})
+
+// ErrPolicyTopic is the error to produce to a topic used by burnell
+var ErrPolicyTopic = errors.New("the topic is reserved for burnell")
+
+// ErrNoPulsarClient is the error to produce before the Pulsar client is initialized
+var ErrNoPulsarClient = errors.New("pulsar client is not initialized")
+
+// ProduceMessage is a message published to a tenant topic
+type ProduceMessage struct {
+	Payload    []byte
+	Key        string
+	Properties map[string]string
+	EventTime  time.Time
+}
+
+type cachedProducer struct {
+	producer pulsar.Producer
+	err      error
+	// created is closed once the producer is created or failed
+	created  chan struct{}
+	lastUsed time.Time
+	// refs is the number of in-flight sends, an evicted producer is closed after the last one
+	refs    int
+	evicted bool
+}
+
+// producers are cached by the topic, an idle producer is evicted at the next produce
+var producers = struct {
+	sync.Mutex
+	topics map[string]*cachedProducer
+}{topics: map[string]*cachedProducer{}}
+
+// topicProducer returns the cached producer of the topic or creates one, the producer must be released after the
+// send. A producer is created once outside the lock, the concurrent produces to the topic wait for the creation.
+// The least recently used producer is evicted to keep the cache within the limit.
+func topicProducer(topic string) (*cachedProducer, error) {
+	if TenantManager.client == nil {
+		return nil, ErrNoPulsarClient
+	}
+	producers.Lock()
+	now := time.Now()
+	if p, ok := producers.topics[topic]; ok {
+		p.lastUsed = now
+		p.refs++
+		producers.Unlock()
+		<-p.created
+		if p.err != nil {
+			p.release()
+			return nil, p.err
+		}
+		return p, nil
+	}
+
+	var lru string
+	var closing []*cachedProducer
+	for name, p := range producers.topics {
+		if now.Sub(p.lastUsed) > producerIdleTimeout {
+			closing = evictProducer(name, closing)
+		} else if lru == "" || p.lastUsed.Before(producers.topics[lru].lastUsed) {
+			lru = name
+		}
+	}
+	if len(producers.topics) >= maxCachedProducers {
+		closing = evictProducer(lru, closing)
+	}
+	p := &cachedProducer{created: make(chan struct{}), lastUsed: now, refs: 1}
+	producers.topics[topic] = p
+	producers.Unlock()
+	for _, c := range closing {
+		c.producer.Close()
+	}
+
+	p.producer, p.err = TenantManager.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:       topic,
+		SendTimeout: produceSendTimeout,
+		Properties:  map[string]string{"producer": "burnell"},
+	})
+	close(p.created)
+	if p.err != nil {
+		// the failed producer is dropped so the next produce retries
+		producers.Lock()
+		if producers.topics[topic] == p {
+			delete(producers.topics, topic)
+		}
+		producers.Unlock()
+		p.release()
+		return nil, p.err
+	}
+	return p, nil
+}
+
+// evictProducer removes the producer of the topic from the cache and appends it to the producers to close
+// if it has no in-flight sends, otherwise it is closed by the last release. The producers lock must be held.
+func evictProducer(topic string, closing []*cachedProducer) []*cachedProducer {
+	p := producers.topics[topic]
+	delete(producers.topics, topic)
+	p.evicted = true
+	if p.refs == 0 {
+		closing = append(closing, p)
+	}
+	return closing
+}
+
+// release ends a send with the producer, the last send of an evicted producer closes it
+func (p *cachedProducer) release() {
+	producers.Lock()
+	p.refs--
+	closing := p.evicted && p.refs == 0 && p.producer != nil
+	producers.Unlock()
+	if closing {
+		p.producer.Close()
+	}
+}
+
+// Produce publishes a message to the topic full name. A synchronous produce waits for the broker acknowledgement and
+// returns the message id, otherwise the message is queued and a failure is only logged.
+func Produce(ctx context.Context, topic string, msg ProduceMessage, waitAck bool) (string, error) {
+	if IsPolicyTopic(topic) {
+		return "", ErrPolicyTopic
+	}
+	p, err := topicProducer(topic)
+	if err != nil {
+		return "", err
+	}
+	pm := &pulsar.ProducerMessage{
+		Payload:    msg.Payload,
+		Key:        msg.Key,
+		Properties: msg.Properties,
+		EventTime:  msg.EventTime,
+	}
+	if !waitAck {
+		p.producer.SendAsync(context.Background(), pm, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+			p.release()
+			if err != nil {
+				produceLog.Errorf("failed to produce to %s error %v", topic, err)
+			}
+		})
+		return "", nil
+	}
+
+	defer p.release()
+	ctx, cancel := context.WithTimeout(ctx, produceSendTimeout)
+	defer cancel()
+	id, err := p.producer.Send(ctx, pm)
+	if err != nil {
+		return "", err
+	}
+	return util.MessageID{LedgerID: id.LedgerID(), EntryID: id.EntryID(), Partition: id.PartitionIdx(),
+		BatchIndex: id.BatchIdx()}.String(), nil
+}
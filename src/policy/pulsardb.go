@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -40,6 +41,70 @@ import (
 // the signal to track if the liveness of the reader process
 type liveSignal struct{}
 
+// StoreLoadTimeout is the wait for the stores to load their topics before a snapshot or a migration
+const StoreLoadTimeout = 2 * time.Minute
+
+// the topics of the stores that have not read up to the end of their topic since the start
+var loadingStores = struct {
+	sync.Mutex
+	topics map[string]bool
+}{topics: map[string]bool{}}
+
+// trackStoreLoad marks the store of a topic as loading until its listener reads up to the end of the topic
+func trackStoreLoad(topic string) {
+	loadingStores.Lock()
+	loadingStores.topics[topic] = true
+	storeTopics[topic] = true
+	loadingStores.Unlock()
+}
+
+// storeTopics are the topics of all initialized policy stores, guarded by the loadingStores lock
+var storeTopics = make(map[string]bool)
+
+// IsPolicyTopic returns whether the topic is a policy store or the audit topic of burnell
+func IsPolicyTopic(topic string) bool {
+	if topic == util.GetConfig().AuditTopic {
+		return true
+	}
+	loadingStores.Lock()
+	defer loadingStores.Unlock()
+	return storeTopics[topic]
+}
+
+// markStoreLoaded marks a loading store as loaded once its reader has no more messages
+func markStoreLoaded(topic string, reader pulsar.Reader) {
+	loadingStores.Lock()
+	loading := loadingStores.topics[topic]
+	loadingStores.Unlock()
+	if loading && !reader.HasNext() {
+		loadingStores.Lock()
+		delete(loadingStores.topics, topic)
+		loadingStores.Unlock()
+	}
+}
+
+// WaitForStores waits until the policy stores have loaded their topics, it returns an error with the topics
+// still loading at the timeout
+func WaitForStores(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		loadingStores.Lock()
+		loading := []string{}
+		for topic := range loadingStores.topics {
+			loading = append(loading, topic)
+		}
+		loadingStores.Unlock()
+		if len(loading) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			sort.Strings(loading)
+			return fmt.Errorf("policy stores are still loading %s", strings.Join(loading, ", "))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 /**
  * Data design - we use a topic as a database table to store tenant document.
 **/
@@ -59,7 +124,7 @@ func (s *TenantPolicyHandler) Setup() error {
 	s.tenants = make(map[string]TenantPlan)
 	pulsarURL := util.GetConfig().PulsarURL
 	s.topicName = util.AssignString(util.GetConfig().TenantManagmentTopic, "persistent://public/default/tenants-management")
-	tokenStr := util.GetConfig().PulsarToken
+	tokenStr := util.PulsarToken()
 
 	clientOpt := pulsar.ClientOptions{
 		URL:               pulsarURL,
@@ -68,7 +133,10 @@ func (s *TenantPolicyHandler) Setup() error {
 	}
 
 	if tokenStr != "" {
-		clientOpt.Authentication = pulsar.NewAuthenticationToken(tokenStr)
+		// the supplier picks up the refreshed token
+		clientOpt.Authentication = pulsar.NewAuthenticationTokenFromSupplier(func() (string, error) {
+			return util.PulsarToken(), nil
+		})
 	}
 
 	if strings.HasPrefix(pulsarURL, "pulsar+ssl://") {
@@ -85,6 +153,7 @@ func (s *TenantPolicyHandler) Setup() error {
 		return err
 	}
 
+	trackStoreLoad(s.topicName)
 	go func() {
 		sig := make(chan *liveSignal)
 		go s.dbListener(sig)
@@ -120,6 +189,7 @@ func (s *TenantPolicyHandler) dbListener(sig chan *liveSignal) error {
 
 	// infinite loop to receive messages
 	for {
+		markStoreLoaded(s.topicName, reader)
 		data, err := reader.Next(ctx)
 		if err != nil {
 			log.Errorf("tenant db listener reader error %v", err)
@@ -209,6 +279,18 @@ func (s *TenantPolicyHandler) GetTenant(tenantName string) (TenantPlan, error) {
 	return TenantPlan{}, fmt.Errorf("tenant not found in database")
 }
 
+// ListTenants returns the tenant plans of the database sorted by the name
+func (s *TenantPolicyHandler) ListTenants() []TenantPlan {
+	s.tenantsLock.RLock()
+	list := make([]TenantPlan, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		list = append(list, t)
+	}
+	s.tenantsLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
 // GetOrCreateTenant gets a tenant. It creates a tenant with free plan if it does not exist in cache only.
 func (s *TenantPolicyHandler) GetOrCreateTenant(tenantName string) (TenantPlan, error) {
 	t, err := s.GetTenant(tenantName)
@@ -243,7 +325,11 @@ func (s *TenantPolicyHandler) DeleteTenant(tenantName string) (TenantPlan, error
 }
 
 // EvaluateFeatureCode evaluate if the feature is supported under the tenant
+// The features of the tenant overrides take precedence over the plan feature codes.
 func (s *TenantPolicyHandler) EvaluateFeatureCode(tenant, featureCode string) bool {
+	if features := util.TenantSettingsOf(tenant).Features; len(features) > 0 {
+		return IsFeatureSupported(featureCode, strings.Join(features, ","))
+	}
 	if tenant, err := s.GetTenant(tenant); err == nil {
 		return IsFeatureSupported(featureCode, tenant.Policy.FeatureCodes)
 	}
@@ -362,7 +448,7 @@ func (s *TenantPolicyHandler) GetFunctionsLimit(tenant string) int {
 
 // AdminAPIGETRespStringArray is a template tenant call that returns an array of string
 func AdminAPIGETRespStringArray(subroute string) ([]string, error) {
-	requestURL := util.SingleJoinSlash(util.SingleJoinSlash(util.Config.BrokerProxyURL, "/admin/v2"), subroute)
+	requestURL := util.SingleJoinSlash(util.SingleJoinSlash(util.DefaultAdminURL(), "/admin/v2"), subroute)
 	log.Infof(requestURL)
 	empty := make([]string, 1)
 	newRequest, err := http.NewRequest(http.MethodGet, requestURL, nil)
@@ -371,10 +457,8 @@ func AdminAPIGETRespStringArray(subroute string) ([]string, error) {
 		return empty, err
 	}
 	newRequest.Header.Add("X-Proxy", "burnell")
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -0,0 +1,248 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Schema version store. The applied schema version of every store is kept on a topic, and the leader migrates the
+// policy stores to the version of the release once they are loaded.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// SchemaVersion is the applied schema version of a store
+type SchemaVersion struct {
+	Store     string    `json:"store"`
+	Version   int       `json:"version"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// SchemaStatus is the applied and the latest version of a store with its migrations
+type SchemaStatus struct {
+	Store      string           `json:"store"`
+	Applied    int              `json:"applied"`
+	Latest     int              `json:"latest"`
+	AppliedAt  *time.Time       `json:"appliedAt,omitempty"`
+	Migrations []util.Migration `json:"migrations"`
+}
+
+// SchemaVersionHandler is the schema version store backed by a topic
+type SchemaVersionHandler struct {
+	client       pulsar.Client
+	topicName    string
+	versions     map[string]SchemaVersion
+	versionsLock sync.RWMutex
+	logger       *log.Entry
+}
+
+// SchemaVersionStore is the global schema version store, it is nil until the policy is initialized
+var SchemaVersionStore *SchemaVersionHandler
+
+// migrationLock serializes the migrations of the policy stores
+var migrationLock = sync.Mutex{}
+
+// InitSchemaVersionStore starts the schema version listener on the SchemaVersionTopic
+func InitSchemaVersionStore(client pulsar.Client) error {
+	s := &SchemaVersionHandler{
+		client:    client,
+		topicName: util.AssignString(util.GetConfig().SchemaVersionTopic, "persistent://public/default/burnell-schema-versions"),
+		versions:  make(map[string]SchemaVersion),
+		logger:    log.WithFields(log.Fields{"app": "schemaversionstore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.schemaVersionListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.schemaVersionListener(sig)
+			}
+		}
+	}()
+	SchemaVersionStore = s
+	return nil
+}
+
+func (s *SchemaVersionHandler) schemaVersionListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("schema version store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("schema version store reader error %v", err)
+			return err
+		}
+		version := SchemaVersion{}
+		if err = json.Unmarshal(data.Payload(), &version); err != nil {
+			s.logger.Errorf("schema version unmarshal error %v", err)
+			continue
+		}
+		s.apply(version)
+	}
+}
+
+func (s *SchemaVersionHandler) apply(version SchemaVersion) {
+	s.versionsLock.Lock()
+	s.versions[version.Store] = version
+	s.versionsLock.Unlock()
+}
+
+// AppliedVersion returns the applied schema version of a store, the baseline if no migration has been applied
+func (s *SchemaVersionHandler) AppliedVersion(store string) SchemaVersion {
+	s.versionsLock.RLock()
+	defer s.versionsLock.RUnlock()
+	if version, ok := s.versions[store]; ok {
+		return version
+	}
+	return SchemaVersion{Store: store, Version: util.BaselineSchemaVersion}
+}
+
+// SetVersion records the applied schema version of a store
+func (s *SchemaVersionHandler) SetVersion(store string, version int) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	record := SchemaVersion{Store: store, Version: version, AppliedAt: time.Now()}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     store,
+	}
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	s.apply(record)
+	return nil
+}
+
+// GetSchemaStatus returns the schema versions of the stores. The usage records are migrated when they are read,
+// so the usage schema is always applied at the latest version.
+func GetSchemaStatus() []SchemaStatus {
+	list := []SchemaStatus{}
+	for _, store := range util.SchemaStores() {
+		status := SchemaStatus{
+			Store:      store,
+			Applied:    util.LatestSchemaVersion(store),
+			Latest:     util.LatestSchemaVersion(store),
+			Migrations: util.ListMigrations(store),
+		}
+		if store == util.PolicySchema && SchemaVersionStore != nil {
+			applied := SchemaVersionStore.AppliedVersion(store)
+			status.Applied = applied.Version
+			if !applied.AppliedAt.IsZero() {
+				status.AppliedAt = &applied.AppliedAt
+			}
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// MigratePolicyStores migrates the records of the policy stores from the applied version to the target version.
+// The records are exported as a snapshot at the applied version, migrated, and restored with the pruning of the
+// records the migrations remove. It returns the applied version before the migration.
+func MigratePolicyStores(target int) (int, RestoreReport, error) {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+	if SchemaVersionStore == nil {
+		return 0, RestoreReport{}, fmt.Errorf("policy store %s is not initialized", "schemaVersions")
+	}
+	from := SchemaVersionStore.AppliedVersion(util.PolicySchema).Version
+	if from == target {
+		return from, RestoreReport{}, nil
+	}
+	snapshot := ExportSnapshot()
+	migrated, err := migrateSnapshot(snapshot, target)
+	if err != nil {
+		return from, RestoreReport{}, err
+	}
+	report, err := RestoreSnapshot(migrated, false, true)
+	if err != nil {
+		return from, report, err
+	}
+	log.Infof("migrated the policy stores from schema version %d to %d", from, target)
+	return from, report, SchemaVersionStore.SetVersion(util.PolicySchema, target)
+}
+
+// migrateSnapshot migrates a snapshot through its JSON document
+func migrateSnapshot(s Snapshot, target int) (Snapshot, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return decodeSnapshot(data, target)
+}
+
+// StartMigrations migrates the policy stores to the version of the release once they are loaded and the replica
+// is the leader. A store written by a newer release is left as is.
+func StartMigrations() {
+	go func() {
+		if err := WaitForStores(StoreLoadTimeout); err != nil {
+			log.Errorf("schema migrations are not started %v", err)
+			return
+		}
+		for !util.IsLeader() {
+			time.Sleep(10 * time.Second)
+		}
+		latest := util.LatestSchemaVersion(util.PolicySchema)
+		applied := SchemaVersionStore.AppliedVersion(util.PolicySchema).Version
+		if applied > latest {
+			log.Errorf("policy stores are at schema version %d newer than the release version %d, "+
+				"run the migrate mode of the newer release to revert", applied, latest)
+			return
+		}
+		if _, _, err := MigratePolicyStores(latest); err != nil {
+			log.Errorf("failed to migrate the policy stores %v", err)
+		}
+	}()
+}
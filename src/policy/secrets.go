@@ -0,0 +1,275 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Tenant secrets referenced by the connector configs.
+// The secrets are encrypted and stored on a topic in the same way as the tenant plans.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/util"
+)
+
+// TenantSecret is a named secret of a tenant
+type TenantSecret struct {
+	Tenant string `json:"tenant"`
+	Name   string `json:"name"`
+	// Value is the encrypted and base64 encoded secret
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SecretMeta is the secret without the value returned by the list API
+type SecretMeta struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TenantSecretHandler is the secret store backed by a topic
+type TenantSecretHandler struct {
+	client      pulsar.Client
+	topicName   string
+	aes         icrypto.AES
+	secrets     map[string]TenantSecret
+	secretsLock sync.RWMutex
+	logger      *log.Entry
+}
+
+// SecretStore is the global tenant secret store, it is nil until the policy is initialized
+var SecretStore *TenantSecretHandler
+
+// SecretNamePattern restricts the secret names to the characters allowed in ${secret:name} references
+var SecretNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// InitSecretStore starts the secret store listener on the TenantSecretTopic. The store is disabled without
+// the SecretEncryptionKey.
+func InitSecretStore(client pulsar.Client) error {
+	cfg := util.GetConfig()
+	key := cfg.SecretEncryptionKey
+	switch len(key) {
+	case 0:
+		log.Warnf("SecretEncryptionKey is not configured, the tenant secrets and the webhooks are disabled")
+		return nil
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("SecretEncryptionKey must be 16, 24, or 32 bytes long")
+	}
+	s := &TenantSecretHandler{
+		client:    client,
+		topicName: util.AssignString(cfg.TenantSecretTopic, "persistent://public/default/tenant-secrets"),
+		aes:       icrypto.AES{DefaultSalt: key},
+		secrets:   make(map[string]TenantSecret),
+		logger:    log.WithFields(log.Fields{"app": "secretstore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.secretListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.secretListener(sig)
+			}
+		}
+	}()
+	SecretStore = s
+	return nil
+}
+
+func secretKey(tenant, name string) string {
+	return tenant + "/" + name
+}
+
+func (s *TenantSecretHandler) secretListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("secret store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("secret store reader error %v", err)
+			return err
+		}
+		secret := TenantSecret{}
+		if err = json.Unmarshal(data.Payload(), &secret); err != nil {
+			s.logger.Errorf("secret unmarshal error %v", err)
+			continue
+		}
+		s.apply(secret)
+	}
+}
+
+func (s *TenantSecretHandler) apply(secret TenantSecret) {
+	s.secretsLock.Lock()
+	defer s.secretsLock.Unlock()
+	if secret.Deleted {
+		delete(s.secrets, secretKey(secret.Tenant, secret.Name))
+	} else {
+		s.secrets[secretKey(secret.Tenant, secret.Name)] = secret
+	}
+}
+
+// PutSecret creates or updates a tenant secret
+func (s *TenantSecretHandler) PutSecret(tenant, name, value string) (SecretMeta, error) {
+	if !SecretNamePattern.MatchString(name) {
+		return SecretMeta{}, fmt.Errorf("secret name %s is invalid, allowed characters are letters, digits, '.', '_', and '-'", name)
+	}
+	encrypted, err := s.encrypt(value)
+	if err != nil {
+		return SecretMeta{}, err
+	}
+	secret := TenantSecret{Tenant: tenant, Name: name, Value: encrypted, UpdatedAt: time.Now()}
+	if err := s.send(secret); err != nil {
+		return SecretMeta{}, err
+	}
+	return SecretMeta{Name: name, UpdatedAt: secret.UpdatedAt}, nil
+}
+
+// DeleteSecret deletes a tenant secret
+func (s *TenantSecretHandler) DeleteSecret(tenant, name string) error {
+	s.secretsLock.RLock()
+	_, ok := s.secrets[secretKey(tenant, name)]
+	s.secretsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("secret %s is not found", name)
+	}
+	return s.send(TenantSecret{Tenant: tenant, Name: name, Deleted: true, UpdatedAt: time.Now()})
+}
+
+// ListSecrets returns the secret names of a tenant
+func (s *TenantSecretHandler) ListSecrets(tenant string) []SecretMeta {
+	s.secretsLock.RLock()
+	defer s.secretsLock.RUnlock()
+	list := []SecretMeta{}
+	for _, secret := range s.secrets {
+		if secret.Tenant == tenant {
+			list = append(list, SecretMeta{Name: secret.Name, UpdatedAt: secret.UpdatedAt})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetSecret returns the decrypted value of a tenant secret
+func (s *TenantSecretHandler) GetSecret(tenant, name string) (string, bool) {
+	s.secretsLock.RLock()
+	secret, ok := s.secrets[secretKey(tenant, name)]
+	s.secretsLock.RUnlock()
+	if !ok {
+		return "", false
+	}
+	value, err := s.decrypt(secret.Value)
+	if err != nil {
+		s.logger.Errorf("failed to decrypt secret %s of tenant %s %v", name, tenant, err)
+		return "", false
+	}
+	return value, true
+}
+
+// TenantSecrets returns the decrypted values of the secrets of a tenant by the name
+func (s *TenantSecretHandler) TenantSecrets(tenant string) map[string]string {
+	s.secretsLock.RLock()
+	names := []string{}
+	for _, secret := range s.secrets {
+		if secret.Tenant == tenant {
+			names = append(names, secret.Name)
+		}
+	}
+	s.secretsLock.RUnlock()
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		if value, ok := s.GetSecret(tenant, name); ok {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+func (s *TenantSecretHandler) send(secret TenantSecret) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     secretKey(secret.Tenant, secret.Name),
+	}
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	s.apply(secret)
+	return nil
+}
+
+func (s *TenantSecretHandler) encrypt(value string) (string, error) {
+	encrypted, err := s.aes.EncryptWithDefaultKey([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+func (s *TenantSecretHandler) decrypt(value string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	decrypted, err := s.aes.DecryptWithDefaultKey(decoded)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
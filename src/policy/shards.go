@@ -0,0 +1,220 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Tenant shards across burnell replicas.
+// Every replica heartbeats its membership to a topic next to the tenant policy topic
+// and owns the tenants whose name hash modulo the number of live replicas is its index.
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// Replica is a burnell replica in the shard membership
+type Replica struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ReplicaShards coordinates the tenant shards across replicas
+type ReplicaShards struct {
+	client      pulsar.Client
+	topicName   string
+	self        Replica
+	ttl         time.Duration
+	members     map[string]Replica
+	membersLock sync.RWMutex
+	logger      *log.Entry
+}
+
+// Shards is the global shard coordinator, it is nil if sharding is disabled
+var Shards *ReplicaShards
+
+// InitShards starts the membership heartbeat and listener if ReplicaShardTopic is configured
+func InitShards(client pulsar.Client) error {
+	cfg := util.GetConfig()
+	if cfg.ReplicaShardTopic == "" {
+		return nil
+	}
+	id, err := os.Hostname()
+	if err != nil || id == "" {
+		if id, err = util.NewUUID(); err != nil {
+			return err
+		}
+	}
+	ttl := time.Duration(util.GetEnvInt("ReplicaShardTTLSeconds", 30)) * time.Second
+	s := &ReplicaShards{
+		client:    client,
+		topicName: cfg.ReplicaShardTopic,
+		self:      Replica{ID: id, Address: cfg.ReplicaAddress},
+		ttl:       ttl,
+		members:   make(map[string]Replica),
+		logger:    log.WithFields(log.Fields{"app": "replica-shards"}),
+	}
+
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.membershipListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.membershipListener(sig)
+			}
+		}
+	}()
+	go s.heartbeat()
+	Shards = s
+	s.logger.Infof("replica %s at %s joins tenant shards", id, cfg.ReplicaAddress)
+	return nil
+}
+
+func (s *ReplicaShards) heartbeat() {
+	ticker := time.NewTicker(s.ttl / 3)
+	for {
+		if err := s.sendHeartbeat(); err != nil {
+			s.logger.Errorf("replica heartbeat error %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (s *ReplicaShards) sendHeartbeat() error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	self := s.self
+	self.UpdatedAt = time.Now()
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	if _, err = producer.Send(context.Background(), &pulsar.ProducerMessage{Payload: data, Key: self.ID}); err != nil {
+		return err
+	}
+	s.updateMember(self)
+	return nil
+}
+
+func (s *ReplicaShards) membershipListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("replica membership listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("replica membership reader error %v", err)
+			return err
+		}
+		r := Replica{}
+		if err = json.Unmarshal(data.Payload(), &r); err != nil {
+			s.logger.Errorf("replica membership unmarshal error %v", err)
+			continue
+		}
+		s.updateMember(r)
+	}
+}
+
+func (s *ReplicaShards) updateMember(r Replica) {
+	s.membersLock.Lock()
+	defer s.membersLock.Unlock()
+	if existing, ok := s.members[r.ID]; ok && existing.UpdatedAt.After(r.UpdatedAt) {
+		return
+	}
+	s.members[r.ID] = r
+}
+
+// LiveReplicas returns the replicas with a recent heartbeat sorted by ID
+func (s *ReplicaShards) LiveReplicas() []Replica {
+	s.membersLock.RLock()
+	defer s.membersLock.RUnlock()
+	live := []Replica{}
+	for _, r := range s.members {
+		if time.Since(r.UpdatedAt) < s.ttl {
+			live = append(live, r)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].ID < live[j].ID
+	})
+	return live
+}
+
+// Owner returns the replica owning the tenant and whether it is this replica
+func (s *ReplicaShards) Owner(tenant string) (Replica, bool) {
+	live := s.LiveReplicas()
+	if len(live) == 0 {
+		return s.self, true
+	}
+	owner := live[ShardIndex(tenant, len(live))]
+	return owner, owner.ID == s.self.ID
+}
+
+// ShardOwner returns the address of the replica owning the tenant, it is empty if the tenant is owned by this replica
+// or sharding is disabled
+func ShardOwner(tenant string) string {
+	if Shards == nil {
+		return ""
+	}
+	owner, self := Shards.Owner(tenant)
+	if self || owner.Address == "" {
+		return ""
+	}
+	return owner.Address
+}
+
+// ShardIndex is the deterministic shard index of a tenant among n replicas
+func ShardIndex(tenant string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(tenant))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,492 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Snapshots of the policy stores. A snapshot is a versioned copy of the tenant plans, overrides, API keys,
+// webhooks, cost labels, billing accounts, and secrets, restored into the same or another environment.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// Snapshot is a copy of the policy stores at the schema version of the policy stores. The API keys have their digests and the webhooks have their signing
+// secrets, and the secrets stay encrypted with the SecretEncryptionKey, so a snapshot must be kept as a secret.
+type Snapshot struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Cluster       string    `json:"cluster,omitempty"`
+	// SecretKeyFingerprint identifies the SecretEncryptionKey of the secrets
+	SecretKeyFingerprint string                     `json:"secretKeyFingerprint"`
+	Tenants              []TenantPlan               `json:"tenants"`
+	Overrides            []util.TenantOverrides     `json:"overrides"`
+	APIKeys              []util.APIKey              `json:"apiKeys"`
+	Webhooks             []util.Webhook             `json:"webhooks"`
+	CostLabels           []util.NamespaceCostLabels `json:"costLabels"`
+	BillingAccounts      []util.BillingAccount      `json:"billingAccounts"`
+	Secrets              []TenantSecret             `json:"secrets"`
+}
+
+// RestoreCounts are the records of a store restored from a snapshot
+type RestoreCounts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+}
+
+// RestoreReport is the outcome of a restore, or the changes a dry run would make
+type RestoreReport struct {
+	SchemaVersion int                      `json:"schemaVersion"`
+	DryRun        bool                     `json:"dryRun"`
+	Prune         bool                     `json:"prune"`
+	Stores        map[string]RestoreCounts `json:"stores"`
+}
+
+// snapshotRecord is a record of a store keyed by its identity
+type snapshotRecord struct {
+	key   string
+	value interface{}
+}
+
+// snapshotStore restores the records of a store, the records are compared by their JSON
+type snapshotStore struct {
+	name  string
+	ready func() bool
+	// disabled is set if the store is disabled without its key, it can only restore an empty list
+	disabled func() bool
+	records  func(s Snapshot) []snapshotRecord
+	current  func() []snapshotRecord
+	put      func(value interface{}) error
+	remove   func(value interface{}) error
+}
+
+func secretKeyFingerprint() string {
+	sum := sha256.Sum256([]byte(util.GetConfig().SecretEncryptionKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ExportSnapshot copies the policy stores of this replica into a snapshot
+func ExportSnapshot() Snapshot {
+	version := util.LatestSchemaVersion(util.PolicySchema)
+	if SchemaVersionStore != nil {
+		// the records are at the applied version until the leader migrates them
+		if applied := SchemaVersionStore.AppliedVersion(util.PolicySchema).Version; applied < version {
+			version = applied
+		}
+	}
+	s := Snapshot{
+		SchemaVersion:        version,
+		CreatedAt:            time.Now().UTC(),
+		Cluster:              util.GetConfig().ClusterName,
+		SecretKeyFingerprint: secretKeyFingerprint(),
+		Tenants:              TenantManager.ListTenants(),
+		Overrides:            util.ListTenantOverrides(),
+		APIKeys:              util.SnapshotAPIKeys(),
+		Webhooks:             util.SnapshotWebhooks(),
+		CostLabels:           util.ListAllCostLabels(),
+		BillingAccounts:      util.ListBillingAccounts(),
+		Secrets:              []TenantSecret{},
+	}
+	if SecretStore != nil {
+		SecretStore.secretsLock.RLock()
+		for _, secret := range SecretStore.secrets {
+			s.Secrets = append(s.Secrets, secret)
+		}
+		SecretStore.secretsLock.RUnlock()
+	}
+	sort.Slice(s.Overrides, func(i, j int) bool { return s.Overrides[i].Tenant < s.Overrides[j].Tenant })
+	sort.Slice(s.APIKeys, func(i, j int) bool { return s.APIKeys[i].ID < s.APIKeys[j].ID })
+	sort.Slice(s.Webhooks, func(i, j int) bool { return s.Webhooks[i].ID < s.Webhooks[j].ID })
+	sort.Slice(s.CostLabels, func(i, j int) bool {
+		return s.CostLabels[i].Tenant+"/"+s.CostLabels[i].Namespace < s.CostLabels[j].Tenant+"/"+s.CostLabels[j].Namespace
+	})
+	sort.Slice(s.BillingAccounts, func(i, j int) bool { return s.BillingAccounts[i].Tenant < s.BillingAccounts[j].Tenant })
+	sort.Slice(s.Secrets, func(i, j int) bool {
+		return secretKey(s.Secrets[i].Tenant, s.Secrets[i].Name) < secretKey(s.Secrets[j].Tenant, s.Secrets[j].Name)
+	})
+	return s
+}
+
+// BackupToFile waits for the stores to load and writes their snapshot to a file readable by the owner only
+func BackupToFile(path string) (Snapshot, error) {
+	if err := WaitForStores(StoreLoadTimeout); err != nil {
+		return Snapshot{}, err
+	}
+	snapshot := ExportSnapshot()
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return Snapshot{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, os.Rename(tmp.Name(), path)
+}
+
+// RestoreFromFile waits for the stores to load and restores the snapshot of a file
+func RestoreFromFile(path string, dryRun, prune bool) (RestoreReport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	snapshot, err := DecodeSnapshot(data)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	if err := WaitForStores(StoreLoadTimeout); err != nil {
+		return RestoreReport{}, err
+	}
+	return RestoreSnapshot(snapshot, dryRun, prune)
+}
+
+// DecodeSnapshot parses a snapshot and migrates it from its schema version to the version of the release
+func DecodeSnapshot(data []byte) (Snapshot, error) {
+	return decodeSnapshot(data, util.LatestSchemaVersion(util.PolicySchema))
+}
+
+func decodeSnapshot(data []byte, target int) (Snapshot, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Snapshot{}, fmt.Errorf("invalid snapshot %v", err)
+	}
+	version, _ := doc["schemaVersion"].(float64)
+	if err := validateSchemaVersion(int(version)); err != nil {
+		return Snapshot{}, err
+	}
+	if err := util.MigrateDocument(util.PolicySchema, doc, int(version), target); err != nil {
+		return Snapshot{}, err
+	}
+	doc["schemaVersion"] = target
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(migrated, &s); err != nil {
+		return Snapshot{}, fmt.Errorf("invalid snapshot %v", err)
+	}
+	return s, nil
+}
+
+func validateSchemaVersion(version int) error {
+	latest := util.LatestSchemaVersion(util.PolicySchema)
+	if version <= 0 {
+		return errors.New("snapshot has no schema version")
+	}
+	if version > latest {
+		return fmt.Errorf("snapshot schema version %d is newer than the supported version %d", version, latest)
+	}
+	return nil
+}
+
+// ValidateSnapshot checks the schema version of a snapshot and the encryption key of its secrets
+func ValidateSnapshot(s Snapshot) error {
+	if err := validateSchemaVersion(s.SchemaVersion); err != nil {
+		return err
+	}
+	if len(s.Secrets) > 0 && s.SecretKeyFingerprint != secretKeyFingerprint() {
+		return errors.New("snapshot secrets are encrypted with a different SecretEncryptionKey")
+	}
+	return nil
+}
+
+// RestoreSnapshot creates or replaces the records of a snapshot in the policy stores. The records missing in the
+// snapshot are kept unless prune is set. A dry run only reports the changes.
+func RestoreSnapshot(s Snapshot, dryRun, prune bool) (RestoreReport, error) {
+	report := RestoreReport{SchemaVersion: s.SchemaVersion, DryRun: dryRun, Prune: prune, Stores: map[string]RestoreCounts{}}
+	if err := ValidateSnapshot(s); err != nil {
+		return report, err
+	}
+	stores := snapshotStores()
+	if !dryRun {
+		for _, store := range stores {
+			if store.disabled != nil && store.disabled() && len(store.records(s)) == 0 {
+				continue
+			}
+			if !store.ready() {
+				return report, fmt.Errorf("policy store %s is not initialized", store.name)
+			}
+		}
+	}
+	for _, store := range stores {
+		counts, err := restoreStore(store, s, dryRun, prune)
+		report.Stores[store.name] = counts
+		if err != nil {
+			return report, fmt.Errorf("failed to restore %s %v", store.name, err)
+		}
+	}
+	return report, nil
+}
+
+func restoreStore(store snapshotStore, s Snapshot, dryRun, prune bool) (RestoreCounts, error) {
+	counts := RestoreCounts{}
+	current := map[string][]byte{}
+	currentValues := map[string]interface{}{}
+	for _, r := range store.current() {
+		data, err := json.Marshal(r.value)
+		if err != nil {
+			return counts, err
+		}
+		current[r.key], currentValues[r.key] = data, r.value
+	}
+	restored := map[string]bool{}
+	for _, r := range store.records(s) {
+		restored[r.key] = true
+		data, err := json.Marshal(r.value)
+		if err != nil {
+			return counts, err
+		}
+		existing, ok := current[r.key]
+		switch {
+		case ok && bytes.Equal(existing, data):
+			counts.Unchanged++
+			continue
+		case ok:
+			counts.Updated++
+		default:
+			counts.Created++
+		}
+		if !dryRun {
+			if err := store.put(r.value); err != nil {
+				return counts, err
+			}
+		}
+	}
+	if !prune {
+		return counts, nil
+	}
+	keys := []string{}
+	for key := range current {
+		if !restored[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		counts.Deleted++
+		if !dryRun {
+			if err := store.remove(currentValues[key]); err != nil {
+				return counts, err
+			}
+		}
+	}
+	return counts, nil
+}
+
+// snapshotStores are the stores in the restore order, the tenants come first
+func snapshotStores() []snapshotStore {
+	return []snapshotStore{
+		{
+			name:  "tenants",
+			ready: func() bool { return TenantManager.client != nil },
+			records: func(s Snapshot) []snapshotRecord {
+				records := []snapshotRecord{}
+				for _, t := range s.Tenants {
+					// the update time is reset by every write
+					t.UpdatedAt = time.Time{}
+					records = append(records, snapshotRecord{t.Name, t})
+				}
+				return records
+			},
+			current: func() []snapshotRecord {
+				records := []snapshotRecord{}
+				for _, t := range TenantManager.ListTenants() {
+					t.UpdatedAt = time.Time{}
+					records = append(records, snapshotRecord{t.Name, t})
+				}
+				return records
+			},
+			put: func(v interface{}) error {
+				_, err := TenantManager.updateDb(v.(TenantPlan))
+				return err
+			},
+			remove: func(v interface{}) error {
+				_, err := TenantManager.DeleteTenant(v.(TenantPlan).Name)
+				return err
+			},
+		},
+		{
+			name:  "overrides",
+			ready: func() bool { return OverridesStore != nil },
+			records: func(s Snapshot) []snapshotRecord {
+				return overridesRecords(s.Overrides)
+			},
+			current: func() []snapshotRecord { return overridesRecords(util.ListTenantOverrides()) },
+			put:     func(v interface{}) error { return OverridesStore.send(v.(util.TenantOverrides)) },
+			remove:  func(v interface{}) error { return OverridesStore.DeleteOverrides(v.(util.TenantOverrides).Tenant) },
+		},
+		{
+			name:     "apiKeys",
+			ready:    func() bool { return APIKeyStore != nil },
+			disabled: func() bool { return !util.IntegrityKeyConfigured() },
+			records: func(s Snapshot) []snapshotRecord {
+				return apiKeyRecords(s.APIKeys)
+			},
+			current: func() []snapshotRecord { return apiKeyRecords(util.SnapshotAPIKeys()) },
+			put:     func(v interface{}) error { return APIKeyStore.send(v.(util.APIKey)) },
+			remove: func(v interface{}) error {
+				key := v.(util.APIKey)
+				return APIKeyStore.RevokeAPIKey(key.Tenant, key.ID)
+			},
+		},
+		{
+			name:     "webhooks",
+			ready:    func() bool { return WebhookStore != nil },
+			disabled: func() bool { return util.GetConfig().SecretEncryptionKey == "" },
+			records: func(s Snapshot) []snapshotRecord {
+				return webhookRecords(s.Webhooks)
+			},
+			current: func() []snapshotRecord { return webhookRecords(util.SnapshotWebhooks()) },
+			put: func(v interface{}) error {
+				hook := v.(util.Webhook)
+				if err := WebhookStore.send(hook); err != nil {
+					return err
+				}
+				util.ApplyWebhook(hook)
+				return nil
+			},
+			remove: func(v interface{}) error {
+				hook := v.(util.Webhook)
+				return WebhookStore.DeleteWebhook(hook.Tenant, hook.ID)
+			},
+		},
+		{
+			name:  "costLabels",
+			ready: func() bool { return CostLabelStore != nil },
+			records: func(s Snapshot) []snapshotRecord {
+				return costLabelRecords(s.CostLabels)
+			},
+			current: func() []snapshotRecord { return costLabelRecords(util.ListAllCostLabels()) },
+			put:     func(v interface{}) error { return CostLabelStore.send(v.(util.NamespaceCostLabels)) },
+			remove: func(v interface{}) error {
+				l := v.(util.NamespaceCostLabels)
+				return CostLabelStore.DeleteCostLabels(l.Tenant, l.Namespace)
+			},
+		},
+		{
+			name:  "billingAccounts",
+			ready: func() bool { return BillingAccountStore != nil },
+			records: func(s Snapshot) []snapshotRecord {
+				return billingAccountRecords(s.BillingAccounts)
+			},
+			current: func() []snapshotRecord { return billingAccountRecords(util.ListBillingAccounts()) },
+			put:     func(v interface{}) error { return BillingAccountStore.send(v.(util.BillingAccount)) },
+			remove: func(v interface{}) error {
+				return BillingAccountStore.DeleteBillingAccount(v.(util.BillingAccount).Tenant)
+			},
+		},
+		{
+			name:     "secrets",
+			ready:    func() bool { return SecretStore != nil },
+			disabled: func() bool { return util.GetConfig().SecretEncryptionKey == "" },
+			records: func(s Snapshot) []snapshotRecord {
+				return secretRecords(s.Secrets)
+			},
+			current: func() []snapshotRecord {
+				if SecretStore == nil {
+					return nil
+				}
+				SecretStore.secretsLock.RLock()
+				defer SecretStore.secretsLock.RUnlock()
+				secrets := make([]TenantSecret, 0, len(SecretStore.secrets))
+				for _, secret := range SecretStore.secrets {
+					secrets = append(secrets, secret)
+				}
+				return secretRecords(secrets)
+			},
+			put: func(v interface{}) error { return SecretStore.send(v.(TenantSecret)) },
+			remove: func(v interface{}) error {
+				secret := v.(TenantSecret)
+				return SecretStore.DeleteSecret(secret.Tenant, secret.Name)
+			},
+		},
+	}
+}
+
+func overridesRecords(list []util.TenantOverrides) []snapshotRecord {
+	records := make([]snapshotRecord, 0, len(list))
+	for _, o := range list {
+		records = append(records, snapshotRecord{o.Tenant, o})
+	}
+	return records
+}
+
+func apiKeyRecords(list []util.APIKey) []snapshotRecord {
+	records := make([]snapshotRecord, 0, len(list))
+	for _, key := range list {
+		records = append(records, snapshotRecord{key.ID, key})
+	}
+	return records
+}
+
+func webhookRecords(list []util.Webhook) []snapshotRecord {
+	records := make([]snapshotRecord, 0, len(list))
+	for _, hook := range list {
+		records = append(records, snapshotRecord{hook.ID, hook})
+	}
+	return records
+}
+
+func costLabelRecords(list []util.NamespaceCostLabels) []snapshotRecord {
+	records := make([]snapshotRecord, 0, len(list))
+	for _, l := range list {
+		records = append(records, snapshotRecord{l.Tenant + "/" + l.Namespace, l})
+	}
+	return records
+}
+
+func billingAccountRecords(list []util.BillingAccount) []snapshotRecord {
+	records := make([]snapshotRecord, 0, len(list))
+	for _, a := range list {
+		records = append(records, snapshotRecord{a.Tenant, a})
+	}
+	return records
+}
+
+func secretRecords(list []TenantSecret) []snapshotRecord {
+	records := make([]snapshotRecord, 0, len(list))
+	for _, secret := range list {
+		records = append(records, snapshotRecord{secretKey(secret.Tenant, secret.Name), secret})
+	}
+	return records
+}
@@ -61,7 +61,7 @@ func IsTenant(tenant string) bool {
 
 func updateTenants() error {
 
-	requestURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, "admin/v2/tenants")
+	requestURL := util.SingleJoinSlash(util.DefaultAdminURL(), "admin/v2/tenants")
 	log.Infof("request route %s ", requestURL)
 
 	// Update the headers to allow for SSL redirection
@@ -70,11 +70,9 @@ func updateTenants() error {
 		return err
 	}
 	newRequest.Header.Add("X-Proxy", "burnell")
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
 
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
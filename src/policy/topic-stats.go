@@ -29,6 +29,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
@@ -40,6 +41,10 @@ var statsLog = log.WithFields(log.Fields{"app": "broker stats cache"})
 
 var topicStatsDB *memdb.MemDB
 
+// statsRefreshed is closed and replaced at every refresh of the topic stats cache
+var statsRefreshed = make(chan struct{})
+var statsRefreshedLock sync.Mutex
+
 const (
 	topicStatsDBTable = "topic-stats"
 )
@@ -86,14 +91,17 @@ func InitTopicStatsDB() error {
 						Indexer: &memdb.StringFieldIndex{Field: "Tenant"},
 					},
 					"namespace": &memdb.IndexSchema{
-						Name:    "namespace",
-						Unique:  false,
-						Indexer: &memdb.StringFieldIndex{Field: "Namespace"},
+						Name:   "namespace",
+						Unique: false,
+						// the field can be empty, which fails the insert without AllowMissing
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Namespace"},
 					},
 					"topic": &memdb.IndexSchema{
-						Name:    "topic",
-						Unique:  false,
-						Indexer: &memdb.StringFieldIndex{Field: "Topic"},
+						Name:         "topic",
+						Unique:       false,
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Topic"},
 					},
 				},
 			},
@@ -135,17 +143,15 @@ func CountTopics(tenant string) (map[string][]string, int) {
 
 // GetBrokers gets a list of broker IP or fqdn
 func GetBrokers() []string {
-	requestBrokersURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, "admin/v2/brokers/"+util.Config.ClusterName)
+	requestBrokersURL := util.SingleJoinSlash(util.DefaultAdminURL(), "admin/v2/brokers/"+util.GetConfig().ClusterName)
 	// Update the headers to allow for SSL redirection
 	newRequest, err := http.NewRequest(http.MethodGet, requestBrokersURL, nil)
 	if err != nil {
 		statsLog.Errorf("make http request brokers %s error %v", requestBrokersURL, err)
 		return []string{}
 	}
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -224,10 +230,8 @@ func brokerStatsTopicsQuery(urlString string) (map[string]string, error) {
 		return partitionTopicNames, err
 	}
 	newRequest.Header.Add("user-agent", "burnell")
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -312,16 +316,14 @@ func getTopicsFromNamespace(path string, isPersistent bool) ([]string, error) {
 	if !isPersistent {
 		paths = "admin/v2/non-persistent/" + path
 	}
-	requestBrokersURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, paths)
+	requestBrokersURL := util.SingleJoinSlash(util.DefaultAdminURL(), paths)
 	newRequest, err := http.NewRequest(http.MethodGet, requestBrokersURL, nil)
 	if err != nil {
 		statsLog.Errorf("make http request a single topic stats %s error %v", requestBrokersURL, err)
 		return nil, err
 	}
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -358,11 +360,10 @@ func getSingleTopicStats(topicFullname string, isPartitionTopic bool) (interface
 	topicType := util.ConditionAssign(strings.HasPrefix(topicFullname, "persistent://"), "persistent/", "non-persistent/")
 	paths := "admin/v2/" + topicType + tenant + "/" + ns + "/" + topic + statsRoute
 
-	requestBrokersURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, paths)
+	requestBrokersURL := util.SingleJoinSlash(util.DefaultAdminURL(), paths)
 
-	client := *http.DefaultClient
-	// keep authorization header for the redirect
-	client.CheckRedirect = util.PreserveHeaderForRedirect
+	// the shared client keeps authorization header for the redirect
+	client := util.UpstreamClient()
 
 	// Update the headers to allow for SSL redirection
 	newRequest, err := http.NewRequest(http.MethodGet, requestBrokersURL, nil)
@@ -370,7 +371,7 @@ func getSingleTopicStats(topicFullname string, isPartitionTopic bool) (interface
 		statsLog.Errorf("make http request a single topic stats %s error %v", requestBrokersURL, err)
 		return nil, err
 	}
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -403,17 +404,63 @@ func getSingleTopicStats(topicFullname string, isPartitionTopic bool) (interface
 func CacheTopicStatsWorker() {
 	interval := time.Duration(util.GetEnvInt("StatsPullIntervalSecond", 9)) * time.Second
 	go func() {
-		brokersStatsTopicQuery()
+		RefreshTopicStats()
 		ticker := time.NewTicker(interval)
 		for {
 			select {
 			case <-ticker.C:
-				brokersStatsTopicQuery()
+				RefreshTopicStats()
 			}
 		}
 	}()
 }
 
+// RefreshTopicStats polls the topic stats of all brokers into the cache and wakes up the stats watchers
+func RefreshTopicStats() {
+	brokersStatsTopicQuery()
+
+	statsRefreshedLock.Lock()
+	close(statsRefreshed)
+	statsRefreshed = make(chan struct{})
+	statsRefreshedLock.Unlock()
+}
+
+// TopicStatsRefreshed returns a channel that is closed at the next refresh of the topic stats cache
+func TopicStatsRefreshed() <-chan struct{} {
+	statsRefreshedLock.Lock()
+	defer statsRefreshedLock.Unlock()
+	return statsRefreshed
+}
+
+// TopicSubscriptions returns the subscriptions with the name prefix of the cached topic stats, keyed by the topic
+// full name. The partitions of a partitioned topic are listed on their own.
+func TopicSubscriptions(prefix string) map[string][]string {
+	topics := map[string][]string{}
+	if topicStatsDB == nil {
+		return topics
+	}
+	txn := topicStatsDB.Txn(false)
+	defer txn.Abort()
+	result, err := txn.Get(topicStatsDBTable, "id")
+	if err != nil {
+		return topics
+	}
+	for i := result.Next(); i != nil; i = result.Next() {
+		p, ok := i.(*TopicStats)
+		if !ok || strings.HasPrefix(p.ID, util.PartitionPrefix) {
+			continue
+		}
+		data, _ := p.Data.(map[string]interface{})
+		subs, _ := data["subscriptions"].(map[string]interface{})
+		for name := range subs {
+			if strings.HasPrefix(name, prefix) {
+				topics[p.ID] = append(topics[p.ID], name)
+			}
+		}
+	}
+	return topics
+}
+
 // PaginateTopicStats paginate topic statistics returns based on offset and page size limit
 func PaginateTopicStats(tenant string, offset, pageSize int, mandatoryTopics []string) (int, int, map[string]interface{}) {
 	txn := topicStatsDB.Txn(false)
@@ -557,10 +604,8 @@ func brokerStatsQuery(urlString, subRoute string, respChan chan BrokerStats) {
 		return
 	}
 	newRequest.Header.Add("user-agent", "burnell")
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -0,0 +1,172 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+// Notification webhook store. The webhooks are stored on a topic in the same way as the tenant plans,
+// with the signing secrets encrypted by the tenant secret key, and delivered from the registry in util.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// WebhookRequest is the request to register a webhook
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// WebhookHandler is the webhook store backed by a topic
+type WebhookHandler struct {
+	client    pulsar.Client
+	topicName string
+	secrets   *TenantSecretHandler
+	logger    *log.Entry
+}
+
+// WebhookStore is the global webhook store, it is nil until the policy is initialized
+var WebhookStore *WebhookHandler
+
+// InitWebhookStore starts the webhook listener on the WebhookTopic, it requires the secret store for the encryption
+// and is disabled without it
+func InitWebhookStore(client pulsar.Client) error {
+	if SecretStore == nil {
+		log.Warnf("webhook store requires the secret store, the webhooks are disabled")
+		return nil
+	}
+	s := &WebhookHandler{
+		client:    client,
+		topicName: util.AssignString(util.GetConfig().WebhookTopic, "persistent://public/default/burnell-webhooks"),
+		secrets:   SecretStore,
+		logger:    log.WithFields(log.Fields{"app": "webhookstore"}),
+	}
+
+	trackStoreLoad(s.topicName)
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.webhookListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.webhookListener(sig)
+			}
+		}
+	}()
+	WebhookStore = s
+	return nil
+}
+
+func (s *WebhookHandler) webhookListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("webhook store listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		markStoreLoaded(s.topicName, reader)
+		data, err := reader.Next(ctx)
+		if err != nil {
+			s.logger.Errorf("webhook store reader error %v", err)
+			return err
+		}
+		hook := util.Webhook{}
+		if err = json.Unmarshal(data.Payload(), &hook); err != nil {
+			s.logger.Errorf("webhook unmarshal error %v", err)
+			continue
+		}
+		if !hook.Deleted {
+			if hook.Secret, err = s.secrets.decrypt(hook.Secret); err != nil {
+				s.logger.Errorf("failed to decrypt the secret of webhook %s %v", hook.ID, err)
+				continue
+			}
+		}
+		util.ApplyWebhook(hook)
+	}
+}
+
+// CreateWebhook registers a webhook of the tenant, or an operator webhook if the tenant is empty.
+// The signing secret is only returned once.
+func (s *WebhookHandler) CreateWebhook(tenant string, req WebhookRequest) (util.Webhook, error) {
+	hook, err := util.NewWebhook(tenant, req.URL, req.Events)
+	if err != nil {
+		return util.Webhook{}, err
+	}
+	stored := hook
+	if stored.Secret, err = s.secrets.encrypt(hook.Secret); err != nil {
+		return util.Webhook{}, err
+	}
+	if err := s.send(stored); err != nil {
+		return util.Webhook{}, err
+	}
+	util.ApplyWebhook(hook)
+	return hook, nil
+}
+
+// DeleteWebhook deletes a webhook of the tenant
+func (s *WebhookHandler) DeleteWebhook(tenant, id string) error {
+	hook, ok := util.GetWebhook(id)
+	if !ok || hook.Tenant != tenant {
+		return fmt.Errorf("webhook %s is not found", id)
+	}
+	hook = util.Webhook{ID: id, Tenant: tenant, Deleted: true}
+	if err := s.send(hook); err != nil {
+		return err
+	}
+	util.ApplyWebhook(hook)
+	return nil
+}
+
+func (s *WebhookHandler) send(hook util.Webhook) error {
+	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     hook.ID,
+	}
+	_, err = producer.Send(context.Background(), &msg)
+	return err
+}
@@ -0,0 +1,249 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package pulsarproxy
+
+// Minimal Pulsar binary protocol decoder for the commands the proxy inspects.
+// A frame is [totalSize uint32][commandSize uint32][BaseCommand protobuf][optional payload],
+// where totalSize covers everything after itself. Only the fields required for authorization
+// are decoded; frames are always forwarded byte for byte.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MaxFrameSize guards against malformed frame sizes, the broker default maxMessageSize is 5MB
+const MaxFrameSize = 64 << 20
+
+// CommandType is the BaseCommand.Type in PulsarApi.proto. The command field number
+// in BaseCommand is the same as its type value.
+type CommandType int
+
+// Pulsar binary protocol command types inspected by the proxy
+const (
+	CommandConnect              CommandType = 2
+	CommandConnected            CommandType = 3
+	CommandSubscribe            CommandType = 4
+	CommandProducer             CommandType = 5
+	CommandError                CommandType = 14
+	CommandPartitionedMetadata  CommandType = 21
+	CommandLookup               CommandType = 23
+	CommandGetTopicsOfNamespace CommandType = 32
+	CommandGetSchema            CommandType = 34
+	CommandAuthResponse         CommandType = 37
+	CommandGetOrCreateSchema    CommandType = 39
+)
+
+// ServerError codes in PulsarApi.proto
+const (
+	AuthenticationError = 3
+	AuthorizationError  = 4
+)
+
+// topicFields maps a topic scoped command to the field numbers of the topic and request id,
+// a topic scoped command without a topic is denied
+var topicFields = map[CommandType][2]protowire.Number{
+	CommandSubscribe:           {1, 5},
+	CommandProducer:            {1, 3},
+	CommandPartitionedMetadata: {1, 2},
+	CommandLookup:              {1, 2},
+	CommandGetSchema:           {2, 1},
+	CommandGetOrCreateSchema:   {2, 1},
+}
+
+// Command is the decoded subset of a BaseCommand
+type Command struct {
+	Type CommandType
+	// Topic is the topic of topic scoped commands
+	Topic string
+	// Namespace is the tenant/namespace of CommandGetTopicsOfNamespace
+	Namespace string
+	RequestID uint64
+	// HasRequestID is false when the command does not carry a request id
+	HasRequestID bool
+	// AuthMethodName and AuthData are the credentials of CommandConnect and CommandAuthResponse
+	AuthMethodName string
+	AuthData       []byte
+}
+
+// ReadFrame reads a complete frame including the total size prefix
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	totalSize := binary.BigEndian.Uint32(size[:])
+	if totalSize < 4 || totalSize > MaxFrameSize {
+		return nil, fmt.Errorf("invalid frame size %d", totalSize)
+	}
+	frame := make([]byte, 4+totalSize)
+	copy(frame, size[:])
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ParseFrame decodes the command of a frame read by ReadFrame
+func ParseFrame(frame []byte) (Command, error) {
+	if len(frame) < 8 {
+		return Command{}, errors.New("frame too short")
+	}
+	cmdSize := binary.BigEndian.Uint32(frame[4:8])
+	if uint64(cmdSize) > uint64(len(frame)-8) {
+		return Command{}, fmt.Errorf("invalid command size %d", cmdSize)
+	}
+	return parseBaseCommand(frame[8 : 8+cmdSize])
+}
+
+func parseBaseCommand(b []byte) (Command, error) {
+	cmd := Command{}
+	// a repeated message field is merged by the broker, which is the same as decoding the concatenation
+	// of every occurrence, so the proxy sees the command the broker executes
+	messages := map[protowire.Number][]byte{}
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+		if num == 1 && typ == protowire.VarintType {
+			cmd.Type = CommandType(n)
+		} else if typ == protowire.BytesType {
+			messages[num] = append(messages[num], v...)
+		}
+	})
+	if err != nil {
+		return cmd, err
+	}
+	// the command message field number equals the command type
+	body := messages[protowire.Number(cmd.Type)]
+
+	switch cmd.Type {
+	case CommandConnect:
+		err = walkFields(body, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+			switch num {
+			case 3:
+				cmd.AuthData = v
+			case 5:
+				cmd.AuthMethodName = string(v)
+			}
+		})
+	case CommandAuthResponse:
+		var authData []byte
+		err = walkFields(body, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+			if num == 2 {
+				authData = v
+			}
+		})
+		if err == nil {
+			err = walkFields(authData, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+				switch num {
+				case 1:
+					cmd.AuthMethodName = string(v)
+				case 2:
+					cmd.AuthData = v
+				}
+			})
+		}
+	case CommandGetTopicsOfNamespace:
+		err = walkFields(body, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+			switch num {
+			case 1:
+				cmd.Namespace = string(v)
+			case 2:
+				cmd.RequestID, cmd.HasRequestID = n, true
+			}
+		})
+	default:
+		if fields, ok := topicFields[cmd.Type]; ok {
+			err = walkFields(body, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+				switch num {
+				case fields[0]:
+					cmd.Topic = string(v)
+				case fields[1]:
+					cmd.RequestID, cmd.HasRequestID = n, true
+				}
+			})
+		}
+	}
+	return cmd, err
+}
+
+// walkFields calls fn with the value of every bytes or varint field of a protobuf message
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, typ, nil, v)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, typ, v, 0)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// ErrorFrame encodes a CommandError frame
+func ErrorFrame(requestID uint64, serverError int, message string) []byte {
+	var body []byte
+	body = protowire.AppendTag(body, 1, protowire.VarintType)
+	body = protowire.AppendVarint(body, requestID)
+	body = protowire.AppendTag(body, 2, protowire.VarintType)
+	body = protowire.AppendVarint(body, uint64(serverError))
+	body = protowire.AppendTag(body, 3, protowire.BytesType)
+	body = protowire.AppendString(body, message)
+	return CommandFrame(CommandError, body)
+}
+
+// CommandFrame wraps an encoded command message into a BaseCommand frame
+func CommandFrame(cmdType CommandType, body []byte) []byte {
+	var cmd []byte
+	cmd = protowire.AppendTag(cmd, 1, protowire.VarintType)
+	cmd = protowire.AppendVarint(cmd, uint64(cmdType))
+	cmd = protowire.AppendTag(cmd, protowire.Number(cmdType), protowire.BytesType)
+	cmd = protowire.AppendBytes(cmd, body)
+
+	frame := make([]byte, 8, 8+len(cmd))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(4+len(cmd)))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(cmd)))
+	return append(frame, cmd...)
+}
@@ -0,0 +1,333 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package pulsarproxy
+
+// TCP proxy of the Pulsar binary protocol with token inspection
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/route"
+	"github.com/datastax/burnell/src/util"
+)
+
+const handshakeTimeout = 30 * time.Second
+
+// noRequestID is the request id of errors replied to commands without one, such as CommandConnect
+const noRequestID = math.MaxUint64
+
+// Start listens the Pulsar binary protocol on BinaryProxyPort, it is a no-op if the port is not configured.
+// The listener is TLS if the cert and key files are configured.
+func Start() error {
+	cfg := util.GetConfig()
+	if cfg.BinaryProxyPort == "" || !util.FeatureEnabled(util.FeatureBinaryProxy) {
+		return nil
+	}
+	upstream := util.AssignString(cfg.BinaryProxyUpstream, cfg.PulsarURL)
+	if upstream == "" {
+		return errors.New("BinaryProxyUpstream or PulsarURL is required by the binary protocol proxy")
+	}
+
+	address := ":" + cfg.BinaryProxyPort
+	var listener net.Listener
+	var err error
+	if len(cfg.CertFile) > 1 && len(cfg.KeyFile) > 1 {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = util.NewReloadableTLSConfig(cfg.CertFile, cfg.KeyFile); err != nil {
+			return err
+		}
+		listener, err = tls.Listen("tcp", address, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("pulsar binary protocol proxy listens on %s, upstream %s", address, upstream)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Errorf("binary protocol proxy accept error %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go handleConn(conn, upstream)
+		}
+	}()
+	return nil
+}
+
+// session is a client connection spliced to the upstream
+type session struct {
+	client   net.Conn
+	upstream net.Conn
+	// clientMu serializes the frames written to the client by both directions
+	clientMu sync.Mutex
+	subjects string
+	scope    *icrypto.DelegationScope
+}
+
+func handleConn(client net.Conn, upstreamURL string) {
+	defer client.Close()
+	s := &session{client: client}
+
+	// the first frame must be CommandConnect
+	client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	frame, err := ReadFrame(client)
+	if err != nil {
+		log.Errorf("binary protocol proxy handshake from %s error %v", client.RemoteAddr(), err)
+		return
+	}
+	cmd, err := ParseFrame(frame)
+	if err != nil || cmd.Type != CommandConnect {
+		log.Errorf("binary protocol proxy expects CommandConnect from %s", client.RemoteAddr())
+		return
+	}
+	if err := s.authenticate(cmd); err != nil {
+		log.Errorf("binary protocol proxy authentication from %s failed %v", client.RemoteAddr(), err)
+		s.writeClient(ErrorFrame(noRequestID, AuthenticationError, err.Error()))
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	upstreamURL = s.upstreamURL(upstreamURL)
+	upstream, err := dialUpstream(upstreamURL)
+	if err != nil {
+		log.Errorf("binary protocol proxy failed to connect upstream %s error %v", upstreamURL, err)
+		s.writeClient(ErrorFrame(noRequestID, 0, "upstream is not available"))
+		return
+	}
+	defer upstream.Close()
+	s.upstream = upstream
+	if _, err := upstream.Write(frame); err != nil {
+		return
+	}
+
+	go s.pipeUpstream()
+	s.pipeClient()
+}
+
+// authenticate verifies the token of CommandConnect or CommandAuthResponse
+func (s *session) authenticate(cmd Command) error {
+	if !util.IsPulsarJWTEnabled() {
+		s.subjects = util.DummySuperRole
+		return nil
+	}
+	if cmd.AuthMethodName != "token" {
+		return fmt.Errorf("unsupported auth method %s", cmd.AuthMethodName)
+	}
+	tokenStr := strings.TrimSpace(string(cmd.AuthData))
+	ip, _, _ := net.SplitHostPort(s.client.RemoteAddr().String())
+	if _, banned := util.AuthBanned(ip, icrypto.UnverifiedSubject(tokenStr)); banned {
+		return fmt.Errorf("too many failed authentications")
+	}
+	verified, err := util.JWTAuth.VerifyToken(tokenStr)
+	if err == nil && verified.Binding != nil {
+		err = verified.Binding.Verify(s.clientCert(), ip)
+	}
+	if err != nil {
+		util.RecordAuthFailure(ip, icrypto.FailedTokenSubject(tokenStr, verified, err))
+		return err
+	}
+	// a refreshed token must belong to the same subject
+	if s.subjects != "" && s.subjects != verified.Subject {
+		return fmt.Errorf("refreshed token subject %s does not match %s", verified.Subject, s.subjects)
+	}
+	s.subjects, s.scope = verified.Subject, verified.Scope
+	return nil
+}
+
+// clientCert returns the client certificate of a TLS connection, it is nil if the client presents none
+func (s *session) clientCert() *x509.Certificate {
+	conn, ok := s.client.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return certs[0]
+	}
+	return nil
+}
+
+// upstreamURL resolves the service URL of the cluster serving the subject's tenant
+func (s *session) upstreamURL(defaultURL string) string {
+	case1, case2 := route.ExtractTenant(s.subjects)
+	for _, tenant := range []string{case1, case2} {
+		if util.TenantCluster(tenant) != "" {
+			return util.BrokerServiceURL(tenant)
+		}
+	}
+	return defaultURL
+}
+
+// pipeClient forwards the client frames to the upstream after inspecting the topic commands
+func (s *session) pipeClient() {
+	defer s.upstream.Close()
+	for {
+		frame, err := ReadFrame(s.client)
+		if err != nil {
+			return
+		}
+		cmd, err := ParseFrame(frame)
+		if err != nil {
+			log.Errorf("binary protocol proxy failed to parse frame from %s error %v", s.client.RemoteAddr(), err)
+			return
+		}
+		if cmd.Type == CommandAuthResponse {
+			if err := s.authenticate(cmd); err != nil {
+				log.Errorf("binary protocol proxy re-authentication of %s failed %v", s.subjects, err)
+				s.writeClient(ErrorFrame(noRequestID, AuthenticationError, err.Error()))
+				return
+			}
+		} else if err := s.authorize(cmd); err != nil {
+			log.Errorf("binary protocol proxy denies %s %v", s.subjects, err)
+			if !cmd.HasRequestID {
+				return
+			}
+			if s.writeClient(ErrorFrame(cmd.RequestID, AuthorizationError, err.Error())) != nil {
+				return
+			}
+			continue
+		}
+		if _, err := s.upstream.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// pipeUpstream forwards the upstream frames to the client
+func (s *session) pipeUpstream() {
+	defer s.client.Close()
+	for {
+		frame, err := ReadFrame(s.upstream)
+		if err != nil {
+			return
+		}
+		if s.writeClient(frame) != nil {
+			return
+		}
+	}
+}
+
+func (s *session) writeClient(frame []byte) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	_, err := s.client.Write(frame)
+	return err
+}
+
+// the permissions of the commands are the same as the REST routes of the messages
+var (
+	readPermission  = route.MustParseRoutePermission("tenant:read-messages", route.TenantFromPath)
+	writePermission = route.MustParseRoutePermission("tenant:write-messages", route.TenantFromPath)
+)
+
+// authorize verifies the subject against the tenant of topic and namespace scoped commands
+func (s *session) authorize(cmd Command) error {
+	if !util.IsPulsarJWTEnabled() {
+		return nil
+	}
+	return AuthorizeCommand(context.Background(), cmd, s.subjects, s.scope)
+}
+
+// AuthorizeCommand authorizes a topic or namespace scoped command with the RBAC engine, the producer and
+// the schema creation are writes and the others are reads. A topic scoped command without a topic is denied.
+func AuthorizeCommand(ctx context.Context, cmd Command, subjects string, scope *icrypto.DelegationScope) error {
+	var tenant, namespace string
+	if _, ok := topicFields[cmd.Type]; ok {
+		if cmd.Topic == "" {
+			return fmt.Errorf("command %d requires a topic", cmd.Type)
+		}
+		tenant, namespace = TopicNamespace(cmd.Topic)
+	} else if cmd.Type == CommandGetTopicsOfNamespace {
+		parts := strings.SplitN(cmd.Namespace, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid namespace %s", cmd.Namespace)
+		}
+		tenant, namespace = parts[0], parts[1]
+	} else {
+		return nil
+	}
+
+	permission := readPermission
+	if cmd.Type == CommandProducer || cmd.Type == CommandGetOrCreateSchema {
+		permission = writePermission
+	}
+	if decision := route.AuthorizeTenant(ctx, permission, subjects, scope, tenant, namespace); !decision.Allowed {
+		return errors.New(decision.Reason)
+	}
+	return nil
+}
+
+// TopicNamespace returns the tenant and namespace of a topic name in either
+// the full persistent://tenant/namespace/topic, the tenant/namespace/topic, or the short topic format
+func TopicNamespace(topic string) (string, string) {
+	if tenant, namespace, _, err := util.ExtractPartsFromTopicFn(topic); err == nil {
+		return tenant, namespace
+	}
+	parts := strings.Split(topic, "/")
+	if len(parts) == 3 {
+		return parts[0], parts[1]
+	}
+	// the default namespace of a short topic name
+	return "public", "default"
+}
+
+// dialUpstream connects to a pulsar:// or pulsar+ssl:// service URL
+func dialUpstream(serviceURL string) (net.Conn, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: handshakeTimeout, KeepAlive: 30 * time.Second}
+	switch u.Scheme {
+	case "pulsar":
+		return dialer.Dial("tcp", u.Host)
+	case "pulsar+ssl":
+		tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if trustStore := util.GetConfig().TrustStore; trustStore != "" {
+			pem, err := ioutil.ReadFile(trustStore)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(pem)
+		}
+		return tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+	}
+	return nil, fmt.Errorf("unsupported upstream scheme %s", u.Scheme)
+}
@@ -0,0 +1,111 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package rbac
+
+// The engine delegating the decisions to an Open Policy Agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// OPAEngine queries the OPA data API with the request as the input.
+// The result is either a boolean or an object with the allow and reason fields.
+type OPAEngine struct {
+	url    string
+	client *http.Client
+}
+
+// opaInput is the request with the tenants of the subjects and the super roles
+type opaInput struct {
+	Request
+	SubjectTenants map[string][]string `json:"subjectTenants"`
+	SuperRoles     []string            `json:"superRoles"`
+}
+
+// NewOPAEngine creates the engine of the OPA decision URL
+func NewOPAEngine(url string, timeoutMs int) (*OPAEngine, error) {
+	if url == "" {
+		return nil, fmt.Errorf("RBAC opaURL is required by the opa engine")
+	}
+	if timeoutMs <= 0 {
+		timeoutMs = 500
+	}
+	return &OPAEngine{url: url, client: &http.Client{Timeout: time.Duration(timeoutMs) * time.Millisecond}}, nil
+}
+
+// Authorize queries the OPA decision, any error denies the request
+func (e *OPAEngine) Authorize(ctx context.Context, req Request) Decision {
+	input := opaInput{Request: req, SubjectTenants: make(map[string][]string), SuperRoles: util.SuperRoles}
+	for _, subject := range req.Subjects {
+		input.SubjectTenants[subject] = SubjectTenants(subject)
+	}
+	data, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return Decision{Reason: err.Error()}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(data))
+	if err != nil {
+		return Decision{Reason: err.Error()}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return Decision{Reason: fmt.Sprintf("OPA query error %v", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{Reason: fmt.Sprintf("OPA query status %d", resp.StatusCode)}
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Decision{Reason: fmt.Sprintf("OPA response error %v", err)}
+	}
+	var allowed bool
+	if err := json.Unmarshal(result.Result, &allowed); err == nil {
+		return opaDecision(allowed, "")
+	}
+	var object struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(result.Result, &object); err != nil {
+		return Decision{Reason: "OPA result is undefined or malformed"}
+	}
+	return opaDecision(object.Allow, object.Reason)
+}
+
+func opaDecision(allowed bool, reason string) Decision {
+	if !allowed && reason == "" {
+		reason = "denied by the OPA policy"
+	}
+	return Decision{Allowed: allowed, Role: "opa", Reason: reason}
+}
@@ -0,0 +1,307 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package rbac
+
+// Role based access control. A request is allowed by a role binding of one of its subjects that grants
+// the permission on the tenant and the namespace of the request, or by an external OPA policy.
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// the actions of the permissions derived from the HTTP methods
+const (
+	ActionRead  = "read"
+	ActionWrite = "write"
+)
+
+// the built-in roles
+const (
+	RoleSuperuser   = "superuser"
+	RoleTenantOwner = "tenant-owner"
+)
+
+// the special subject and tenants of the role bindings
+const (
+	SubjectSuperRoles = "$superroles"
+	TenantAny         = "*"
+	TenantSelf        = "$self"
+)
+
+// Request is an access to a resource. The tenant is empty for a cluster resource.
+type Request struct {
+	Subjects  []string `json:"subjects"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Resource  string   `json:"resource"`
+	Action    string   `json:"action"`
+}
+
+// Permission is the resource:action of the request
+func (req Request) Permission() string {
+	return req.Resource + ":" + req.Action
+}
+
+// Decision is the outcome of an authorization, the subject and the role that allowed the request
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Subject string `json:"subject,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Engine makes the authorization decisions
+type Engine interface {
+	Authorize(ctx context.Context, req Request) Decision
+}
+
+var (
+	engineLock = sync.RWMutex{}
+	engine     Engine
+
+	// SubjectTenants maps a subject to the tenants it owns, it is set by the route package
+	SubjectTenants = func(subject string) []string { return []string{subject} }
+)
+
+// Init sets up the engine of the configuration
+func Init(cfg util.RBAC) error {
+	e, err := NewEngine(cfg)
+	if err != nil {
+		return err
+	}
+	SetEngine(e)
+	return nil
+}
+
+// NewEngine creates the engine of the configuration
+func NewEngine(cfg util.RBAC) (Engine, error) {
+	switch cfg.Engine {
+	case "", "builtin":
+		return NewRoleEngine(cfg.Roles, cfg.Bindings, cfg.ReplaceDefaultBindings)
+	case "opa":
+		return NewOPAEngine(cfg.OPAURL, cfg.OPATimeoutMs)
+	}
+	return nil, fmt.Errorf("unknown RBAC engine %s, it must be builtin or opa", cfg.Engine)
+}
+
+// SetEngine replaces the engine, nil restores the built-in roles with the default bindings
+func SetEngine(e Engine) {
+	engineLock.Lock()
+	engine = e
+	engineLock.Unlock()
+}
+
+// Authorize makes the decision of a request with the engine
+func Authorize(ctx context.Context, req Request) Decision {
+	engineLock.RLock()
+	e := engine
+	engineLock.RUnlock()
+	if e == nil {
+		e = defaultEngine
+	}
+	return e.Authorize(ctx, req)
+}
+
+var defaultEngine, _ = NewRoleEngine(nil, nil, false)
+
+type permission struct {
+	resource, action string
+}
+
+func (p permission) grants(resource, action string) bool {
+	return (p.resource == "*" || p.resource == resource) && (p.action == "*" || p.action == action)
+}
+
+// ParsePermission parses a permission in the format of resource:action
+func ParsePermission(str string) (string, string, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("permission %s must be in the format of resource:action", str)
+	}
+	return parts[0], parts[1], nil
+}
+
+// RoleEngine is the built-in engine of the roles and the role bindings
+type RoleEngine struct {
+	roles    map[string][]permission
+	bindings []util.RBACBinding
+}
+
+// NewRoleEngine validates the roles and the bindings over the built-in ones
+func NewRoleEngine(roles []util.RBACRole, bindings []util.RBACBinding, replaceDefaultBindings bool) (*RoleEngine, error) {
+	e := &RoleEngine{roles: map[string][]permission{
+		RoleSuperuser:   {{"*", "*"}},
+		RoleTenantOwner: {{"*", "*"}},
+	}}
+	for _, role := range roles {
+		if role.Name == "" {
+			return nil, fmt.Errorf("RBAC role name is required")
+		}
+		permissions := []permission{}
+		for _, p := range role.Permissions {
+			resource, action, err := ParsePermission(p)
+			if err != nil {
+				return nil, fmt.Errorf("RBAC role %s %v", role.Name, err)
+			}
+			permissions = append(permissions, permission{resource, action})
+		}
+		e.roles[role.Name] = permissions
+	}
+	if !replaceDefaultBindings {
+		e.bindings = []util.RBACBinding{
+			{Role: RoleSuperuser, Subjects: []string{SubjectSuperRoles}, Tenants: []string{TenantAny}},
+			{Role: RoleTenantOwner, Subjects: []string{"*"}, Tenants: []string{TenantSelf}},
+		}
+	}
+	for _, b := range bindings {
+		if _, ok := e.roles[b.Role]; !ok {
+			return nil, fmt.Errorf("RBAC binding refers to an undefined role %s", b.Role)
+		}
+		for _, pattern := range b.Subjects {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("RBAC binding of role %s has a malformed subject pattern %s", b.Role, pattern)
+			}
+		}
+		for _, pattern := range b.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("RBAC binding of role %s has a malformed namespace pattern %s", b.Role, pattern)
+			}
+		}
+		if len(b.Tenants) == 0 {
+			b.Tenants = []string{TenantSelf}
+		}
+		e.bindings = append(e.bindings, b)
+	}
+	return e, nil
+}
+
+// Authorize allows a request if a binding of any subject grants the permission on the tenant and the namespace
+// of the request
+func (e *RoleEngine) Authorize(ctx context.Context, req Request) Decision {
+	for _, subject := range req.Subjects {
+		subject = strings.TrimSpace(subject)
+		if subject == "" {
+			continue
+		}
+		for _, b := range e.bindings {
+			if !bindsSubject(b, subject) || !bindsTenant(b, subject, req.Tenant) || !bindsNamespace(b, req.Namespace) {
+				continue
+			}
+			for _, p := range e.roles[b.Role] {
+				if p.grants(req.Resource, req.Action) {
+					return Decision{Allowed: true, Subject: subject, Role: b.Role}
+				}
+			}
+		}
+	}
+	scope := "the cluster"
+	if req.Tenant != "" && req.Namespace != "" {
+		scope = "namespace " + req.Tenant + "/" + req.Namespace
+	} else if req.Tenant != "" {
+		scope = "tenant " + req.Tenant
+	}
+	return Decision{Reason: fmt.Sprintf("no role grants %s on %s", req.Permission(), scope)}
+}
+
+func bindsSubject(b util.RBACBinding, subject string) bool {
+	for _, pattern := range b.Subjects {
+		if pattern == SubjectSuperRoles {
+			if util.StrContains(util.SuperRoles, subject) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func bindsTenant(b util.RBACBinding, subject, tenant string) bool {
+	for _, t := range b.Tenants {
+		switch t {
+		case TenantAny:
+			return true
+		case TenantSelf:
+			if tenant != "" && util.StrContains(SubjectTenants(subject), tenant) {
+				return true
+			}
+		default:
+			if t == tenant {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bindsNamespace(b util.RBACBinding, namespace string) bool {
+	if len(b.Namespaces) == 0 {
+		return true
+	}
+	if namespace == "" {
+		return false
+	}
+	for _, pattern := range b.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RolesGranting lists the roles of the engine that grant the permission, it is empty for an external engine
+func RolesGranting(resource, action string) []string {
+	engineLock.RLock()
+	e := engine
+	engineLock.RUnlock()
+	if e == nil {
+		e = defaultEngine
+	}
+	if roleEngine, ok := e.(*RoleEngine); ok {
+		return roleEngine.RolesGranting(resource, action)
+	}
+	return nil
+}
+
+// RolesGranting lists the roles that grant the permission in the name order
+func (e *RoleEngine) RolesGranting(resource, action string) []string {
+	names := []string{}
+	for name, permissions := range e.roles {
+		for _, p := range permissions {
+			if p.grants(resource, action) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,130 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAccessLogMaxSizeMB  = 100
+	defaultAccessLogMaxBackups = 7
+	accessLogTimeFormat        = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogWriter is nil if the access log is disabled
+var accessLogWriter io.Writer
+
+// InitAccessLog opens the access log file if configured
+func InitAccessLog() error {
+	cfg := util.GetConfig().AccessLog
+	if cfg.File == "" {
+		return nil
+	}
+	maxSize := cfg.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = defaultAccessLogMaxSizeMB
+	}
+	maxBackups := cfg.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = defaultAccessLogMaxBackups
+	}
+	f, err := util.NewRotatingFile(cfg.File, int64(maxSize)<<20, time.Duration(cfg.RotateHours)*time.Hour, maxBackups)
+	if err != nil {
+		return err
+	}
+	accessLogWriter = f
+	return nil
+}
+
+// AccessLog middleware writes a line per request to the access log, and pushes it to Loki if enabled
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLogWriter == nil && accessLogLoki == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		line := accessLogLine(r, recorder.status, recorder.bytes, start)
+		if accessLogWriter != nil {
+			io.WriteString(accessLogWriter, line)
+		}
+		if accessLogLoki != nil {
+			route := ""
+			if current := mux.CurrentRoute(r); current != nil {
+				route, _ = current.GetPathTemplate()
+			}
+			pushAccessLog(requestTenant(r), route, r.Header.Get(injectedSubs), start, strings.TrimSuffix(line, "\n"))
+		}
+	})
+}
+
+// accessLogLine formats a request in the Apache combined format followed by the quoted subject and tenant,
+// an empty value is logged as -
+func accessLogLine(r *http.Request, status, size int, start time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	subject := r.Header.Get(injectedSubs)
+	tenant := requestTenant(r)
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.Itoa(size)
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s %s %s\n",
+		orDash(host),
+		orDash(subject),
+		start.Format(accessLogTimeFormat),
+		quote(r.Method+" "+util.RedactURI(r.RequestURI)+" "+r.Proto),
+		status,
+		bytes,
+		quote(r.Referer()),
+		quote(r.UserAgent()),
+		quote(subject),
+		quote(tenant),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote quotes a field with the embedded quotes and backslashes escaped
+func quote(s string) string {
+	s = strings.ReplaceAll(orDash(s), `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
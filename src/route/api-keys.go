@@ -0,0 +1,163 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// API key authentication and the API key management endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+// APIKeyResponse is the created API key, the key string is only returned once
+type APIKeyResponse struct {
+	Key string `json:"key"`
+	util.APIKey
+}
+
+// requestAPIKey returns the API key of the X-API-Key header, or of the bearer token in the API key format
+func requestAPIKey(r *http.Request) string {
+	if keyStr := strings.TrimSpace(r.Header.Get(util.APIKeyHeader)); keyStr != "" {
+		return keyStr
+	}
+	if tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1)); util.IsAPIKey(tokenStr) {
+		return tokenStr
+	}
+	return ""
+}
+
+// apiKeySubjectAndScope resolves an API key into the same identity as a verified token,
+// a key restricted to namespaces has a delegation scope
+func apiKeySubjectAndScope(r *http.Request, ip, keyStr string) (string, *icrypto.DelegationScope, error) {
+	if retryAfter, banned := util.AuthBanned(ip, ""); banned {
+		requestLog(r).Warnf("reject the request of the banned source %s", ip)
+		return "", nil, authBannedError{retryAfter: retryAfter}
+	}
+	key, err := util.ResolveAPIKey(keyStr)
+	if err != nil {
+		util.RecordAuthFailure(ip, "")
+		return "", nil, err
+	}
+	notifyTokenExpiring(key.Subject, key.ExpiresAt)
+	return key.Subject, apiKeyScope(key), nil
+}
+
+func apiKeyScope(key util.APIKey) *icrypto.DelegationScope {
+	if len(key.Namespaces) == 0 {
+		return nil
+	}
+	return &icrypto.DelegationScope{Namespaces: key.Namespaces, Permissions: key.Permissions, ParentID: "apikey:" + key.ID}
+}
+
+// APIKeysHandler lists the API keys of a tenant with GET, creates a key with POST, and revokes a key with DELETE.
+// A key is created for the caller's subject, a super role can create a key for another subject of the tenant.
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	subject := r.Header.Get(injectedSubs)
+	if r.Method == http.MethodGet {
+		data, err := json.Marshal(util.ListAPIKeys(tenant))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	if policy.APIKeyStore == nil {
+		util.ResponseErrorJSON(fmt.Errorf("API key store is not initialized"), w, http.StatusServiceUnavailable)
+		return
+	}
+	// an API key cannot create or revoke the keys
+	if requestAPIKey(r) != "" {
+		util.ResponseErrorJSON(fmt.Errorf("API keys are managed with a token"), w, http.StatusForbidden)
+		return
+	}
+	event := audit.Event{Subject: subject, Tenant: tenant, RemoteAddr: r.RemoteAddr}
+
+	if r.Method == http.MethodDelete {
+		event.Action, event.Resource = "apikey.revoke", vars["id"]
+		if err := policy.APIKeyStore.RevokeAPIKey(tenant, vars["id"]); err != nil {
+			event.Outcome, event.Reason = audit.Failed, err.Error()
+			audit.Record(event)
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		event.Outcome = audit.Succeeded
+		audit.Record(event)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req policy.APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	keySubject := subject
+	if req.Subject != "" && req.Subject != subject {
+		if !util.StrContains(util.SuperRoles, subject) || !VerifySubject(tenant, req.Subject) {
+			util.ResponseErrorJSON(fmt.Errorf("a key can only be created for the caller's subject"), w, http.StatusForbidden)
+			return
+		}
+		keySubject = req.Subject
+	}
+	event.Action = "apikey.create"
+	if req.Name != "" {
+		// a named key is created once so that a retried request does not issue another key
+		for _, key := range util.ListAPIKeys(tenant) {
+			if key.Name == req.Name {
+				util.ResponseErrorJSON(fmt.Errorf("API key %s already exists with the id %s", req.Name, key.ID), w, http.StatusConflict)
+				return
+			}
+		}
+	}
+	keyStr, key, err := policy.APIKeyStore.CreateAPIKey(tenant, keySubject, req)
+	if err != nil {
+		event.Outcome, event.Reason = audit.Failed, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	event.Resource, event.Outcome = key.ID, audit.Succeeded
+	audit.Record(event)
+	log.Infof("subject %s created API key %s of subject %s", subject, key.ID, keySubject)
+
+	data, err := json.Marshal(APIKeyResponse{Key: keyStr, APIKey: key})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
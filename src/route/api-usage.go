@@ -0,0 +1,74 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Admin endpoints of the per subject API usage analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// APIUsageHandler returns the daily summaries of the subjects, filtered by the from, to, and subject query parameters
+func APIUsageHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("invalid date %s, the format is 2006-01-02", date), w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := json.Marshal(util.GetAPIUsage(from, to, query.Get("subject")))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// APITopTalkersHandler returns the subjects with the highest request rate over the last five minutes
+func APITopTalkersHandler(w http.ResponseWriter, r *http.Request) {
+	n := util.APITopTalkers()
+	if str := r.URL.Query().Get("n"); str != "" {
+		var err error
+		if n, err = strconv.Atoi(str); err != nil || n <= 0 {
+			util.ResponseErrorJSON(fmt.Errorf("invalid n %s", str), w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := json.Marshal(util.GetAPITopTalkers(n))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
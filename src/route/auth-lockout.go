@@ -0,0 +1,114 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Rejection of the requests from the banned source IPs and subjects, and the admin endpoint of the bans
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/util"
+)
+
+// authBannedError is the error of a request from a banned source IP or subject
+type authBannedError struct {
+	retryAfter time.Duration
+}
+
+func (e authBannedError) Error() string {
+	return "too many failed authentications"
+}
+
+// clientIP returns the source IP of a request. The X-Forwarded-For header is only trusted from one of
+// the trusted proxies, the source IP is its rightmost address that is not a trusted proxy.
+func clientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !util.GetConfig().AuthLockout.TrustForwardedFor || !util.IsTrustedProxy(host) {
+		return host
+	}
+	hops := []string{}
+	for _, forwarded := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(forwarded, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !util.IsTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// remoteHost returns the IP of the peer of a request
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// respondAuthBanned responds 429 with the time left of the ban if the error is a ban
+func respondAuthBanned(w http.ResponseWriter, err error) bool {
+	banned, ok := err.(authBannedError)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(banned.retryAfter.Seconds())+1))
+	http.Error(w, banned.Error(), http.StatusTooManyRequests)
+	return true
+}
+
+// AuthBansHandler lists the active bans, or lifts the ban of the kind and value in the path with DELETE,
+// all the bans without them
+func AuthBansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		kind, value := mux.Vars(r)["kind"], mux.Vars(r)["value"]
+		cleared := util.ClearAuthBan(kind, value)
+		audit.Record(audit.Event{Subject: r.Header.Get(injectedSubs), Action: "auth.bans.clear",
+			Resource: strings.TrimSuffix(kind+":"+value, ":"), Outcome: audit.Succeeded, RemoteAddr: r.RemoteAddr})
+		data, _ := json.Marshal(map[string]int{"cleared": cleared})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	data, err := json.Marshal(util.GetAuthBans())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
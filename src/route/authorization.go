@@ -0,0 +1,125 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Authorization of the authenticated subjects by the RBAC engine
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/datastax/burnell/src/rbac"
+)
+
+// routeResources maps the route prefixes to the RBAC resources of the routes without a declared resource,
+// the longest matching prefix wins. A route without a matching prefix is the resource of the first segment
+// of its path template.
+var routeResources = map[string]string{
+	"/admin":            "admin",
+	"/admin/v2":         "pulsar-admin",
+	"/admin/v3":         "pulsar-admin",
+	"/lookup":           "pulsar-admin",
+	"/metrics":          "metrics",
+	"/pulsarmetrics":    "metrics",
+	"/function-metrics": "metrics",
+	"/alerts":           "metrics",
+	"/subscriptionlag":  "metrics",
+	"/function-logs":    "function-logs",
+	"/function-status":  "function-logs",
+	"/tenantsusage":     "usage",
+	"/namespacesusage":  "usage",
+	"/usagestatements":  "usage",
+	"/costlabels":       "usage",
+	"/usageforecast":    "usage",
+	"/storagehistory":   "usage",
+	"/topics":           "stats",
+	"/k/tenant":         "tenant-policy",
+	"/k/overrides":      "tenant-policy",
+	"/subject":          "tokens",
+}
+
+func init() {
+	rbac.SubjectTenants = func(subject string) []string {
+		case1, case2 := ExtractTenant(subject)
+		if case1 == case2 {
+			return []string{case1}
+		}
+		return []string{case1, case2}
+	}
+}
+
+// templateResource returns the RBAC resource of a route path template
+func templateResource(tpl string) string {
+	resource, matched := "", ""
+	for prefix, res := range routeResources {
+		if (tpl == prefix || strings.HasPrefix(tpl, prefix+"/")) && len(prefix) > len(matched) {
+			resource, matched = res, prefix
+		}
+	}
+	if resource != "" {
+		return resource
+	}
+	return strings.SplitN(strings.TrimPrefix(tpl, "/"), "/", 2)[0]
+}
+
+// routeResource returns the RBAC resource of the matched route
+func routeResource(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return templateResource(tpl)
+		}
+	}
+	return templateResource(r.URL.Path)
+}
+
+// methodAction returns the RBAC action of the request method
+func methodAction(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return rbac.ActionRead
+	}
+	return rbac.ActionWrite
+}
+
+// authorize decides the access of the comma separated subjects to the resource on the tenant,
+// an empty tenant is a cluster resource. The resource and the action are derived from the route when empty.
+func authorize(r *http.Request, subjects, tenant, resource, action string) rbac.Decision {
+	if resource == "" {
+		resource = routeResource(r)
+	}
+	if action == "" {
+		action = methodAction(r.Method)
+	}
+	req := rbac.Request{
+		Subjects:  strings.Split(subjects, ","),
+		Tenant:    tenant,
+		Namespace: mux.Vars(r)["namespace"],
+		Resource:  resource,
+		Action:    action,
+	}
+	decision := rbac.Authorize(r.Context(), req)
+	if !decision.Allowed {
+		requestLog(r).Warnf("subjects %s are denied %s, %s", subjects, req.Permission(), decision.Reason)
+	}
+	return decision
+}
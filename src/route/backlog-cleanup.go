@@ -0,0 +1,192 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Tenant skip, expiry, and clear of the subscription backlogs with guardrails
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// backlog cleanup operations, named after the admin REST API routes
+const (
+	skipOperation     = "skip"
+	expireOperation   = "expireMessages"
+	clearAllOperation = "skip_all"
+)
+
+const (
+	// ConfirmationHeader carries the confirmation token of a dry run
+	ConfirmationHeader = "X-Confirmation-Token"
+
+	defaultMaxCleanupMessages  = 100000
+	defaultConfirmationSeconds = 300
+)
+
+// BacklogCleanupEstimate is the dry run result of a backlog cleanup
+type BacklogCleanupEstimate struct {
+	Operation    string `json:"operation"`
+	Topic        string `json:"topic"`
+	Subscription string `json:"subscription"`
+	Backlog      int64  `json:"backlog"`
+	// EstimatedMessages is the number of the messages to skip or clear, and the upper bound of the expired messages
+	EstimatedMessages int64     `json:"estimatedMessages"`
+	ConfirmationToken string    `json:"confirmationToken"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+}
+
+// subscriptionBacklog gets the backlog of a subscription, the stats of a partitioned topic are aggregated by the broker
+func subscriptionBacklog(topicURL, subscription string) (int64, int, error) {
+	var stats struct {
+		Subscriptions map[string]struct {
+			MsgBacklog int64 `json:"msgBacklog"`
+		} `json:"subscriptions"`
+	}
+	status, err := getAdminJSON(util.SingleJoinSlash(topicURL, "stats"), &stats)
+	if status == http.StatusNotFound {
+		status, err = getAdminJSON(util.SingleJoinSlash(topicURL, "partitioned-stats?perPartition=false"), &stats)
+	}
+	if err != nil {
+		if status == http.StatusNotFound {
+			return 0, http.StatusNotFound, fmt.Errorf("topic is not found")
+		}
+		return 0, http.StatusBadGateway, fmt.Errorf("failed to get topic stats %v", err)
+	}
+	sub, ok := stats.Subscriptions[subscription]
+	if !ok {
+		return 0, http.StatusNotFound, fmt.Errorf("subscription %s is not found", subscription)
+	}
+	return sub.MsgBacklog, 0, nil
+}
+
+// BacklogCleanupHandler skips, expires, or clears the backlog of a subscription on behalf of a tenant. A tenant must
+// get a dry run estimate with the dryRun query parameter first, and send its confirmation token in the
+// X-Confirmation-Token header. A call over the message limit is rejected. The super roles bypass the guardrails.
+// Every attempt is audited.
+func BacklogCleanupHandler(operation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		tenant, namespace, topic, subscription := vars["tenant"], vars["namespace"], vars["topic"], vars["subscription"]
+		resource := fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, topic)
+		subject := r.Header.Get(injectedSubs)
+		event := audit.Event{Subject: subject, Tenant: tenant, Action: "subscription." + operation,
+			Resource: resource + "/" + subscription, RemoteAddr: r.RemoteAddr}
+		deny := func(status int, err error) {
+			event.Outcome, event.Reason = audit.Denied, err.Error()
+			audit.Record(event)
+			util.ResponseErrorJSON(err, w, status)
+		}
+
+		var amount int64
+		switch operation {
+		case skipOperation:
+			n, err := strconv.ParseInt(vars["count"], 10, 64)
+			if err != nil || n < 1 {
+				deny(http.StatusUnprocessableEntity, fmt.Errorf("the number of messages to skip must be positive"))
+				return
+			}
+			amount = n
+		case expireOperation:
+			n, err := strconv.ParseInt(vars["seconds"], 10, 64)
+			if err != nil || n < 1 {
+				deny(http.StatusUnprocessableEntity, fmt.Errorf("the expiry time must be positive seconds"))
+				return
+			}
+			amount = n
+		}
+		// the confirmation is bound to the subject, the operation, the subscription, and the amount
+		key := fmt.Sprintf("%s|%s|%s|%d", subject, event.Action, event.Resource, amount)
+
+		topicURL := util.SingleJoinSlash(util.AdminURL(tenant), fmt.Sprintf("admin/v2/persistent/%s/%s/%s", tenant, namespace, topic))
+		_, role := ExtractTenant(subject)
+		superRole := util.StrContains(util.SuperRoles, role)
+		dryRun := r.URL.Query().Get("dryRun") == "true"
+		if !superRole || dryRun {
+			backlog, status, err := subscriptionBacklog(topicURL, subscription)
+			if err != nil {
+				deny(status, err)
+				return
+			}
+			estimate := backlog
+			if operation == skipOperation && amount < backlog {
+				estimate = amount
+			}
+			cfg := util.GetConfig().BacklogCleanup
+			max := cfg.MaxMessagesPerCall
+			if max <= 0 {
+				max = defaultMaxCleanupMessages
+			}
+			if !superRole && estimate > max {
+				deny(http.StatusUnprocessableEntity, fmt.Errorf("%d messages are over the limit of %d messages per call, skip the backlog in smaller steps", estimate, max))
+				return
+			}
+
+			if dryRun {
+				ttl := time.Duration(cfg.ConfirmationTTLSeconds) * time.Second
+				if ttl <= 0 {
+					ttl = defaultConfirmationSeconds * time.Second
+				}
+				token, expiresAt, err := util.NewConfirmation(key, ttl)
+				if err != nil {
+					util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+					return
+				}
+				event.Action += ".dry-run"
+				event.Outcome, event.Reason = audit.Allowed, fmt.Sprintf("estimated %d of %d messages", estimate, backlog)
+				audit.Record(event)
+				data, _ := json.Marshal(BacklogCleanupEstimate{
+					Operation:         operation,
+					Topic:             resource,
+					Subscription:      subscription,
+					Backlog:           backlog,
+					EstimatedMessages: estimate,
+					ConfirmationToken: token,
+					ExpiresAt:         expiresAt,
+				})
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(data)
+				return
+			}
+
+			if err := util.ConsumeConfirmation(r.Header.Get(ConfirmationHeader), key); err != nil {
+				deny(http.StatusPreconditionRequired, fmt.Errorf("%v, get a confirmation token with dryRun=true first", err))
+				return
+			}
+		}
+
+		event.Outcome = audit.Allowed
+		audit.Record(event)
+		cleanupRoute := fmt.Sprintf("subscription/%s/%s", subscription, operation)
+		if operation != clearAllOperation {
+			cleanupRoute += "/" + strconv.FormatInt(amount, 10)
+		}
+		httpProxy(util.SingleJoinSlash(topicURL, cleanupRoute), w, r)
+	}
+}
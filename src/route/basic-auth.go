@@ -0,0 +1,76 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// HTTP basic-auth compatibility for the monitoring tools that cannot attach a bearer token
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/util"
+)
+
+// basicAuthChallenge is the WWW-Authenticate header of the routes accepting basic-auth
+const basicAuthChallenge = `Basic realm="burnell", charset="UTF-8"`
+
+// errBasicAuthNotAccepted is the error of the basic-auth credentials on a route that only accepts tokens
+var errBasicAuthNotAccepted = errors.New("basic-auth is not accepted on this route")
+
+// acceptsBasicAuth checks if the route accepts basic-auth, only the read routes of the configured resources do
+func (h *PermissionHandler) acceptsBasicAuth(r *http.Request) bool {
+	resource, action := h.Permission.Resource, h.Permission.Action
+	if resource == "" {
+		resource = routeResource(r)
+	}
+	if action == "" {
+		action = methodAction(r.Method)
+	}
+	return action == rbac.ActionRead && util.BasicAuthAccepts(resource)
+}
+
+// subjectAndScope authenticates a request by the basic-auth credentials on the routes accepting them,
+// otherwise by the bearer token or the API key
+func (h *PermissionHandler) subjectAndScope(r *http.Request) (string, *icrypto.DelegationScope, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return tokenSubjectAndScope(r)
+	}
+	if !h.acceptsBasicAuth(r) {
+		return "", nil, errBasicAuthNotAccepted
+	}
+	defer util.StartPhase(r.Context(), util.PhaseAuth)()
+	ip := clientIP(r)
+	if retryAfter, banned := util.AuthBanned(ip, ""); banned {
+		requestLog(r).Warnf("reject the request of the banned source %s", ip)
+		return "", nil, authBannedError{retryAfter: retryAfter}
+	}
+	subject, err := util.VerifyBasicAuth(username, password)
+	if err != nil {
+		requestLog(r).Warnf("basic-auth of user %s failed", username)
+		util.RecordAuthFailure(ip, "")
+		return "", nil, err
+	}
+	return subject, nil, nil
+}
@@ -0,0 +1,111 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// BillingAccountsHandler lists the billing accounts
+func BillingAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(util.ListBillingAccounts())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// BillingAccountHandler gets the billing account of a tenant with GET, and replaces or deletes it with PUT or DELETE
+func BillingAccountHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	if r.Method == http.MethodGet {
+		account, ok := util.GetBillingAccount(tenant)
+		if !ok {
+			util.ResponseErrorJSON(errors.New("billing account not found"), w, http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(account)
+		w.Write(data)
+		return
+	}
+
+	if policy.BillingAccountStore == nil {
+		util.ResponseErrorJSON(errors.New("billing account store is not available"), w, http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var account util.BillingAccount
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+			return
+		}
+		account, err := policy.BillingAccountStore.PutBillingAccount(tenant, account)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		log.Infof("subject %s updated billing account of tenant %s", r.Header.Get(injectedSubs), tenant)
+		data, _ := json.Marshal(account)
+		w.Write(data)
+	case http.MethodDelete:
+		if err := policy.BillingAccountStore.DeleteBillingAccount(tenant); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		log.Infof("subject %s deleted billing account of tenant %s", r.Header.Get(injectedSubs), tenant)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// StripeReportsHandler lists the recent Stripe usage reports with GET, and reports the usage now with POST
+func StripeReportsHandler(w http.ResponseWriter, r *http.Request) {
+	var reports []metrics.StripeReport
+	if r.Method == http.MethodPost {
+		if !util.GetConfig().Stripe.Enabled {
+			util.ResponseErrorJSON(errors.New("Stripe integration is not enabled"), w, http.StatusNotImplemented)
+			return
+		}
+		log.Infof("subject %s requested a Stripe usage report", r.Header.Get(injectedSubs))
+		reports = metrics.ReportStripeUsage(time.Now())
+	} else {
+		reports = metrics.GetStripeReports()
+	}
+	data, err := json.Marshal(reports)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
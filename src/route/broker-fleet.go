@@ -0,0 +1,144 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+// BrokerHealth is the health check result and the metrics of a broker
+type BrokerHealth struct {
+	metrics.BrokerMetrics
+	Up    bool   `json:"up"`
+	Error string `json:"error,omitempty"`
+}
+
+// BrokerFleet is the health of all the brokers of the cluster
+type BrokerFleet struct {
+	Total         int            `json:"total"`
+	Up            int            `json:"up"`
+	Down          int            `json:"down"`
+	Topics        int            `json:"topics"`
+	RateIn        float64        `json:"rateIn"`
+	RateOut       float64        `json:"rateOut"`
+	ThroughputIn  float64        `json:"throughputIn"`
+	ThroughputOut float64        `json:"throughputOut"`
+	ErrorRate     float64        `json:"errorRate"`
+	MetricsError  string         `json:"metricsError,omitempty"`
+	Brokers       []BrokerHealth `json:"brokers"`
+	GeneratedAt   time.Time      `json:"generatedAt"`
+}
+
+// brokerKey matches a broker of the admin REST API with the broker label of the metrics, it is the host name
+// without the port and the domain to match the pod name, or the IP address and the port to match the instance
+func brokerKey(broker string) string {
+	host := broker
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	if net.ParseIP(name) != nil {
+		return host
+	}
+	return strings.SplitN(name, ".", 2)[0]
+}
+
+// BrokerFleetHandler combines the health checks of the active brokers with the per broker metrics
+// into a single view of the broker fleet
+func BrokerFleetHandler(w http.ResponseWriter, r *http.Request) {
+	fleet := BrokerFleet{GeneratedAt: time.Now()}
+	brokerMetrics, err := metrics.GetBrokerFleetMetrics()
+	if err != nil {
+		requestLog(r).Warnf("broker fleet view without metrics because of error %v", err)
+		fleet.MetricsError = err.Error()
+	}
+	byKey := make(map[string]metrics.BrokerMetrics)
+	for _, m := range brokerMetrics {
+		byKey[brokerKey(m.Broker)] = m
+	}
+
+	brokers := policy.GetBrokers()
+	fleet.Brokers = make([]BrokerHealth, len(brokers))
+	var wg sync.WaitGroup
+	for i, broker := range brokers {
+		wg.Add(1)
+		go func(i int, broker string) {
+			defer wg.Done()
+			health := BrokerHealth{BrokerMetrics: metrics.BrokerMetrics{Broker: broker}, Up: true}
+			if err := policy.CheckBrokerHealth(broker); err != nil {
+				health.Up, health.Error = false, err.Error()
+			}
+			fleet.Brokers[i] = health
+		}(i, broker)
+	}
+	wg.Wait()
+
+	for i := range fleet.Brokers {
+		key := brokerKey(fleet.Brokers[i].Broker)
+		if m, ok := byKey[key]; ok {
+			m.Broker = fleet.Brokers[i].Broker
+			fleet.Brokers[i].BrokerMetrics = m
+			delete(byKey, key)
+		}
+	}
+	// a broker reporting metrics but missing from the active brokers is down
+	for _, m := range byKey {
+		fleet.Brokers = append(fleet.Brokers, BrokerHealth{BrokerMetrics: m, Error: "not an active broker of the cluster"})
+	}
+	sort.Slice(fleet.Brokers, func(i, j int) bool { return fleet.Brokers[i].Broker < fleet.Brokers[j].Broker })
+
+	for _, b := range fleet.Brokers {
+		fleet.Total++
+		if b.Up {
+			fleet.Up++
+		} else {
+			fleet.Down++
+		}
+		fleet.Topics += b.Topics
+		fleet.RateIn += b.RateIn
+		fleet.RateOut += b.RateOut
+		fleet.ThroughputIn += b.ThroughputIn
+		fleet.ThroughputOut += b.ThroughputOut
+		fleet.ErrorRate += b.ErrorRate
+	}
+
+	data, err := json.Marshal(fleet)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
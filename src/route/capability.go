@@ -0,0 +1,130 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// minimum upstream broker versions required by admin v3 APIs
+const (
+	TransactionsMinVersion = "2.8.0"
+	PackagesMinVersion     = "2.8.0"
+)
+
+const brokerVersionTTL = 5 * time.Minute
+
+// brokerVersionCache caches the upstream broker version reported by /admin/v2/brokers/version
+type brokerVersionCache struct {
+	sync.RWMutex
+	version   string
+	updatedAt time.Time
+}
+
+var brokerVersion = &brokerVersionCache{}
+
+// BrokerVersion returns the upstream broker version, probing the broker when the cached value is stale
+func BrokerVersion() (string, error) {
+	brokerVersion.RLock()
+	version, updatedAt := brokerVersion.version, brokerVersion.updatedAt
+	brokerVersion.RUnlock()
+	if version != "" && time.Since(updatedAt) < brokerVersionTTL {
+		return version, nil
+	}
+
+	probed, err := probeBrokerVersion()
+	if err != nil {
+		// serve the last known version rather than failing the request
+		if version != "" {
+			return version, nil
+		}
+		return "", err
+	}
+	brokerVersion.Lock()
+	brokerVersion.version = probed
+	brokerVersion.updatedAt = time.Now()
+	brokerVersion.Unlock()
+	return probed, nil
+}
+
+func probeBrokerVersion() (string, error) {
+	requestURL := util.SingleJoinSlash(util.DefaultAdminURL(), "admin/v2/brokers/version")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	newRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return "", err
+	}
+	newRequest.Header.Add("X-Proxy", "burnell")
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+
+	response, err := util.UpstreamClient().Do(newRequest)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("broker version probe returns status code %d", response.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	version := strings.Trim(strings.TrimSpace(string(body)), "\"")
+	if version == "" {
+		return "", errors.New("broker reports an empty version")
+	}
+	return version, nil
+}
+
+// RequireBrokerVersion middleware rejects requests to an admin API the upstream broker does not support
+// with 501 Not Implemented instead of proxying them to an opaque 404 from the broker.
+// Requests are passed through if the broker version cannot be determined.
+func RequireBrokerVersion(feature, minVersion string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, err := BrokerVersion()
+		if err != nil {
+			log.Warnf("unable to determine broker version for %s, error %v", feature, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if util.CompareVersions(version, minVersion) < 0 {
+			util.ResponseErrorJSON(fmt.Errorf("%s admin API requires Pulsar %s or later, the upstream broker version is %s",
+				feature, minVersion, version), w, http.StatusNotImplemented)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
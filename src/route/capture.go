@@ -0,0 +1,140 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// cappedBuffer keeps the first limit bytes written
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.Len(); room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return c.Buffer.Write(p)
+}
+
+// capturedBody tees the request body read by the handler
+type capturedBody struct {
+	io.ReadCloser
+	body *cappedBuffer
+}
+
+func (c *capturedBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.body.Write(p[:n])
+	return n, err
+}
+
+// Capture middleware captures the sampled requests and the requests of the captured subjects with the responses
+func Capture(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		candidate, sampled := util.CaptureCandidate(r.URL.Path)
+		if !candidate || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		limit := util.CaptureBodyLimit()
+		reqBody := &cappedBuffer{limit: limit}
+		if r.Body != nil {
+			r.Body = &capturedBody{ReadCloser: r.Body, body: reqBody}
+		}
+		reqHeaders := r.Header.Clone()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK, body: &cappedBuffer{limit: limit}}
+		next.ServeHTTP(recorder, r)
+
+		// the subject is injected by the authentication middleware
+		subject := r.Header.Get(injectedSubs)
+		if !sampled && !util.IsCapturedSubject(subject) {
+			return
+		}
+		util.StoreCapture(util.CapturedExchange{
+			Time:            start,
+			RequestID:       r.Header.Get(requestIDHeader),
+			Subject:         subject,
+			Method:          r.Method,
+			URI:             util.RedactURI(r.URL.RequestURI()),
+			RequestHeaders:  reqHeaders,
+			RequestBody:     reqBody.String(),
+			Status:          recorder.status,
+			ResponseHeaders: recorder.Header().Clone(),
+			ResponseBody:    recorder.body.String(),
+			Truncated:       reqBody.truncated || recorder.body.truncated,
+			DurationMs:      time.Since(start).Milliseconds(),
+		})
+	})
+}
+
+// CaptureHandler lists the captured exchanges from the newest, optionally of a subject.
+// PUT changes the capture mode with the sampleRate and the comma separated subjects query parameters,
+// DELETE disables the capture and clears the captured exchanges.
+func CaptureHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		rate, err := strconv.ParseFloat(queryParamString(params, "sampleRate", "0"), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			util.ResponseErrorJSON(errors.New("sampleRate must be between 0 and 1"), w, http.StatusUnprocessableEntity)
+			return
+		}
+		var subjects []string
+		if str := queryParamString(params, "subjects", ""); str != "" {
+			subjects = strings.Split(str, ",")
+		}
+		util.SetCaptureSettings(util.CaptureSettings{SampleRate: rate, Subjects: subjects})
+		requestLog(r).Warnf("request capture sample rate %.3f subjects %v", rate, subjects)
+	case http.MethodDelete:
+		util.SetCaptureSettings(util.CaptureSettings{})
+		util.ClearCaptures()
+	}
+
+	data, err := json.Marshal(struct {
+		util.CaptureSettings
+		Captures []util.CapturedExchange `json:"captures"`
+	}{util.GetCaptureSettings(), util.GetCaptures(queryParamString(params, "subject", ""))})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,84 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// CostLabelsRequest is the request to replace the cost allocation labels of a namespace
+type CostLabelsRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// CostLabelsHandler lists the labeled namespaces of a tenant with GET, and replaces or deletes the cost
+// allocation labels of a namespace with PUT or DELETE
+func CostLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace := vars["tenant"], vars["namespace"]
+	if r.Method == http.MethodGet {
+		data, err := json.Marshal(util.ListCostLabels(tenant))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	if policy.CostLabelStore == nil {
+		util.ResponseErrorJSON(errors.New("cost label store is not available"), w, http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req CostLabelsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+			return
+		}
+		labels, err := policy.CostLabelStore.PutCostLabels(tenant, namespace, req.Labels)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		log.Infof("subject %s updated cost labels of namespace %s/%s", r.Header.Get(injectedSubs), tenant, namespace)
+		data, _ := json.Marshal(labels)
+		w.Write(data)
+	case http.MethodDelete:
+		if err := policy.CostLabelStore.DeleteCostLabels(tenant, namespace); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		log.Infof("subject %s deleted cost labels of namespace %s/%s", r.Header.Get(injectedSubs), tenant, namespace)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,86 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// CSRFHeader is the header of the CSRF token of the session
+const CSRFHeader = "X-CSRF-Token"
+
+// CSRFProtect requires the CSRF token of the session on the state changing requests authenticated by
+// a session cookie. The requests with a token or an API key are not checked, since a browser never attaches
+// them to a cross site request. The exempt paths of the pure API clients refuse the session cookie instead.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !csrfRequired(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, ok := requestSessionCookie(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if csrfExempt(r) {
+			requestLog(r).Warnf("reject the session cookie authentication on the CSRF exempt path %s", r.URL.Path)
+			http.Error(w, "session cookie authentication is not accepted on this path", http.StatusForbidden)
+			return
+		}
+		session, err := util.GetSession(id)
+		if err != nil {
+			// the authentication rejects the invalid session
+			next.ServeHTTP(w, r)
+			return
+		}
+		csrfToken := r.Header.Get(CSRFHeader)
+		if csrfToken == "" || subtle.ConstantTimeCompare([]byte(csrfToken), []byte(session.CSRFToken)) != 1 {
+			requestLog(r).Warnf("reject the request of subject %s with an invalid CSRF token", session.Token.Subject)
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func csrfRequired(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// csrfExempt checks if the request is on a path of the pure API clients, which only authenticate by a token or an API key
+func csrfExempt(r *http.Request) bool {
+	for _, prefix := range util.GetConfig().Sessions.CSRFExemptPaths {
+		if prefix != "" && strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sync"
+
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+var publishExpvarsOnce sync.Once
+
+// publishExpvars exposes the cache and upstream connection pool sizes along with the memstats and cmdline expvars
+func publishExpvars() {
+	publishExpvarsOnce.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() interface{} {
+			return runtime.NumGoroutine()
+		}))
+		expvar.Publish("metricsCache", expvar.Func(func() interface{} {
+			raw, resident := metrics.CacheSize()
+			return map[string]interface{}{
+				"rawBytes":      raw,
+				"residentBytes": resident,
+			}
+		}))
+		expvar.Publish("leader", expvar.Func(func() interface{} {
+			return util.GetLeaderState()
+		}))
+		expvar.Publish("sharedCache", expvar.Func(func() interface{} {
+			return util.GetSharedCacheStats()
+		}))
+		expvar.Publish("upstreamPool", expvar.Func(func() interface{} {
+			return util.GetUpstreamPoolStats()
+		}))
+		expvar.Publish("authLockout", expvar.Func(func() interface{} {
+			return util.GetAuthLockoutStats()
+		}))
+	})
+}
+
+// GoroutineDumpHandler dumps the stacks of all goroutines in the panic format
+func GoroutineDumpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// diagnosticRoutes adds the pprof, expvar, and goroutine dump endpoints for the super roles
+func diagnosticRoutes(router *mux.Router) {
+	publishExpvars()
+	router.Path("/admin/debug/pprof/").Methods(http.MethodGet).Name("pprof index").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(pprof.Index)))
+	router.Path("/admin/debug/pprof/cmdline").Methods(http.MethodGet).Name("pprof cmdline").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(pprof.Cmdline)))
+	router.Path("/admin/debug/pprof/profile").Methods(http.MethodGet).Name("pprof cpu profile").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(pprof.Profile)))
+	router.Path("/admin/debug/pprof/symbol").Methods(http.MethodGet, http.MethodPost).Name("pprof symbol").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(pprof.Symbol)))
+	router.Path("/admin/debug/pprof/trace").Methods(http.MethodGet).Name("pprof trace").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(pprof.Trace)))
+	router.Path("/admin/debug/pprof/{profile}").Methods(http.MethodGet).Name("pprof profile").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pprof.Handler(mux.Vars(r)["profile"]).ServeHTTP(w, r)
+	})))
+	router.Path("/admin/debug/vars").Methods(http.MethodGet).Name("expvar").Handler(Require("superuser:read-admin", TenantNone, expvar.Handler()))
+	router.Path("/admin/debug/goroutines").Methods(http.MethodGet).Name("goroutine dump").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(GoroutineDumpHandler)))
+}
+
+// DiagnosticsRouter creates the routes of the separate diagnostics listener
+func DiagnosticsRouter() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+	router.Use(RequestID)
+	diagnosticRoutes(router)
+	return router
+}
@@ -0,0 +1,206 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Dead letter and retry topic inspection of a subscription
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPeekCount = 10
+	maxPeekCount     = 100
+	propertyHeader   = "X-Pulsar-Property-"
+)
+
+// DeadLetterTopic is the stats of a dead letter or retry topic
+type DeadLetterTopic struct {
+	Topic       string `json:"topic"`
+	Exists      bool   `json:"exists"`
+	MsgInCount  int64  `json:"msgInCounter"`
+	StorageSize int64  `json:"storageSize"`
+	BacklogSize int64  `json:"backlogSize"`
+}
+
+// DeadLetterResponse is the dead letter and retry topics of a subscription
+type DeadLetterResponse struct {
+	Topic        string          `json:"topic"`
+	Subscription string          `json:"subscription"`
+	DeadLetter   DeadLetterTopic `json:"deadLetter"`
+	Retry        DeadLetterTopic `json:"retry"`
+}
+
+// PeekedMessage is a message peeked from a topic
+type PeekedMessage struct {
+	MessageID   string            `json:"messageId"`
+	PublishTime string            `json:"publishTime,omitempty"`
+	Key         string            `json:"key,omitempty"`
+	Properties  map[string]string `json:"properties"`
+	// Payload is base64 encoded
+	Payload string `json:"payload"`
+}
+
+// deadLetterTopics returns the dead letter and retry topic names, which can be overridden by the
+// dlqTopic and retryTopic query parameters. An override is a topic name in the same tenant and namespace.
+func deadLetterTopics(r *http.Request) (string, string, error) {
+	vars := mux.Vars(r)
+	params := r.URL.Query()
+	dlq, retry := util.DeadLetterTopicNames(vars["topic"], vars["subscription"])
+	dlq, retry = queryParamString(params, "dlqTopic", dlq), queryParamString(params, "retryTopic", retry)
+	if strings.Contains(dlq, "/") || strings.Contains(retry, "/") {
+		return "", "", fmt.Errorf("dead letter and retry topics must be in the namespace %s/%s", vars["tenant"], vars["namespace"])
+	}
+	return dlq, retry, nil
+}
+
+func persistentTopicURL(tenant, namespace, topic string) string {
+	return util.SingleJoinSlash(util.AdminURL(tenant),
+		fmt.Sprintf("admin/v2/persistent/%s/%s/%s", tenant, namespace, url.PathEscape(topic)))
+}
+
+func deadLetterTopicStats(tenant, namespace, topic string) (DeadLetterTopic, error) {
+	stats := DeadLetterTopic{Topic: fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, topic)}
+	status, err := getAdminJSON(util.SingleJoinSlash(persistentTopicURL(tenant, namespace, topic), "stats"), &stats)
+	if status == http.StatusNotFound {
+		return stats, nil
+	} else if err != nil {
+		return stats, err
+	}
+	stats.Exists = true
+	return stats, nil
+}
+
+// DeadLetterHandler locates the dead letter and retry topics of a subscription and returns their stats
+func DeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace := vars["tenant"], vars["namespace"]
+	dlq, retry, err := deadLetterTopics(r)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp := DeadLetterResponse{
+		Topic:        fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, vars["topic"]),
+		Subscription: vars["subscription"],
+	}
+	if resp.DeadLetter, err = deadLetterTopicStats(tenant, namespace, dlq); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadGateway)
+		return
+	}
+	if resp.Retry, err = deadLetterTopicStats(tenant, namespace, retry); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadGateway)
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// DeadLetterPeekHandler returns the most recent messages of the dead letter topic, or the retry topic
+// with ?type=retry. The number of messages is specified by ?count=, 10 by default and 100 at most.
+func DeadLetterPeekHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace := vars["tenant"], vars["namespace"]
+	dlq, retry, err := deadLetterTopics(r)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	topic := dlq
+	if strings.EqualFold(queryParamString(r.URL.Query(), "type", "dlq"), "retry") {
+		topic = retry
+	}
+	count := queryParamInt(r.URL.Query(), "count", defaultPeekCount)
+	if count < 1 || count > maxPeekCount {
+		util.ResponseErrorJSON(fmt.Errorf("count must be between 1 and %d", maxPeekCount), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	topicURL := persistentTopicURL(tenant, namespace, topic)
+	messages, _, err := examineMessages(count, 0, func(position int) string {
+		return util.SingleJoinSlash(topicURL, "examinemessage?initialPosition=latest&messagePosition="+strconv.Itoa(position))
+	})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadGateway)
+		return
+	}
+
+	data, err := json.Marshal(messages)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// examineMessages gets the messages at the positions from 1 to count, until a position is beyond the available
+// messages or the payloads reach maxBytes if it is positive. It returns whether the messages are cut by maxBytes.
+func examineMessages(count, maxBytes int, positionURL func(position int) string) ([]PeekedMessage, bool, error) {
+	messages := []PeekedMessage{}
+	size := 0
+	for position := 1; position <= count; position++ {
+		status, header, body, err := getAdmin(positionURL(position))
+		if status == http.StatusNotFound || status == http.StatusPreconditionFailed || status == http.StatusConflict {
+			// the topic does not exist, or the position is beyond the available messages
+			return messages, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		if size += len(body); maxBytes > 0 && size > maxBytes {
+			return messages, true, nil
+		}
+		messages = append(messages, peekedMessage(header, body))
+	}
+	return messages, false, nil
+}
+
+// peekedMessage builds a message from the examined message response headers and payload
+func peekedMessage(header http.Header, payload []byte) PeekedMessage {
+	msg := PeekedMessage{
+		MessageID:   header.Get("X-Pulsar-Message-ID"),
+		PublishTime: header.Get("X-Pulsar-publish-time"),
+		Key:         header.Get("X-Pulsar-partition-key"),
+		Properties:  make(map[string]string),
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+	}
+	for name, values := range header {
+		// the header names are canonicalized by the http client
+		if strings.HasPrefix(name, propertyHeader) && len(values) > 0 {
+			msg.Properties[strings.TrimPrefix(name, propertyHeader)] = values[0]
+		}
+	}
+	return msg
+}
@@ -0,0 +1,79 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Authorization and audit of the function log access
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/logclient"
+	"github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/util"
+)
+
+// a worker ID is a host name the log server address is built from
+var workerIDPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// functionLogAccess authorizes the access to the logs of the function in the path and audits it.
+// One of the token subjects must be granted the function-logs permission on the function namespace by the RBAC engine,
+// a role binding restricted to other namespaces of the tenant does not grant it, and the function must be deployed
+// in that namespace.
+// It responds with the error and returns false if the access is denied.
+func functionLogAccess(w http.ResponseWriter, r *http.Request, action string) (logclient.FunctionType, bool) {
+	vars := mux.Vars(r)
+	tenant, namespace, funcName := vars["tenant"], vars["namespace"], vars["function"]
+	subjects := r.Header.Get(injectedSubs)
+	resource := tenant + "/" + namespace + "/" + funcName
+	if instance := util.AssignString(vars["instance"], r.URL.Query().Get("instance")); instance != "" {
+		resource += "/" + instance
+	}
+	event := audit.Event{Subject: subjects, Tenant: tenant, Action: action, Resource: resource, RemoteAddr: r.RemoteAddr}
+	deny := func(status int, reason string) {
+		event.Outcome, event.Reason = audit.Denied, reason
+		audit.Record(event)
+		http.Error(w, reason, status)
+	}
+
+	if util.IsPulsarJWTEnabled() {
+		if decision := authorize(r, subjects, tenant, "function-logs", rbac.ActionRead); !decision.Allowed {
+			deny(http.StatusForbidden, decision.Reason)
+			return logclient.FunctionType{}, false
+		}
+	}
+	if workerID := r.URL.Query().Get("workerid"); workerID != "" && !workerIDPattern.MatchString(workerID) {
+		deny(http.StatusBadRequest, "invalid workerid")
+		return logclient.FunctionType{}, false
+	}
+	fn, err := logclient.LookupFunction(tenant, namespace, funcName)
+	if err != nil {
+		deny(http.StatusNotFound, err.Error())
+		return logclient.FunctionType{}, false
+	}
+	event.Outcome = audit.Allowed
+	audit.Record(event)
+	return fn, true
+}
@@ -0,0 +1,217 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Live tail of a function instance log over a websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/datastax/burnell/src/logclient"
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	tailDefaultBytes     = 16 * 1024
+	tailMaxBytes         = 256 * 1024
+	tailDefaultInterval  = time.Second
+	tailMinInterval      = 250 * time.Millisecond
+	tailDefaultHeartbeat = 15 * time.Second
+	tailMaxRetryInterval = 30 * time.Second
+	// a client not reading within the write timeout is disconnected and resumes with its last cursor
+	tailWriteTimeout = 10 * time.Second
+)
+
+// tailMessage is a message of the live tail, the type is logs, heartbeat, or error.
+// Cursor is the resume token of the lines sent so far.
+type tailMessage struct {
+	Type string `json:"type"`
+	Logs string `json:"logs,omitempty"`
+	// Records are the structured entries of the logs when requested
+	Records []logclient.LogRecord `json:"records,omitempty"`
+	Cursor  string                `json:"cursor,omitempty"`
+	Rotated bool                  `json:"rotated,omitempty"`
+	Gap     bool                  `json:"gap,omitempty"`
+	Error   string                `json:"error,omitempty"`
+	Time    time.Time             `json:"time"`
+}
+
+var tailUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     websocketOriginAllowed,
+}
+
+// FunctionLogTailHandler streams the lines appended to a function instance log over a websocket
+func FunctionLogTailHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace, funcName := vars["tenant"], vars["namespace"], vars["function"]
+	params := r.URL.Query()
+	instance, err := strconv.Atoi(util.AssignString(params.Get("instance"), "0"))
+	if err != nil || instance < 0 {
+		http.Error(w, "invalid instance", http.StatusBadRequest)
+		return
+	}
+	bytes := int64(queryParamInt(params, "bytes", tailDefaultBytes))
+	interval := time.Duration(queryParamInt(params, "intervalms", int(tailDefaultInterval/time.Millisecond))) * time.Millisecond
+	heartbeat := time.Duration(queryParamInt(params, "heartbeat", int(tailDefaultHeartbeat/time.Second))) * time.Second
+	if bytes <= 0 || bytes > tailMaxBytes || interval < tailMinInterval || heartbeat < time.Second {
+		http.Error(w, fmt.Sprintf("bytes must be between 1 and %d, intervalms at least %d, and heartbeat at least 1 second",
+			tailMaxBytes, tailMinInterval/time.Millisecond), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := functionLogAccess(w, r, "function.logs.tail"); !ok {
+		return
+	}
+	tailer, err := logclient.NewLogTailer(tenant+namespace+funcName, params.Get("workerid"), instance, params.Get("resume"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer tailer.Close()
+
+	conn, err := tailUpgrader.Upgrade(util.NewStreamWriter(w, r, tailWriteTimeout), r, nil)
+	if err != nil {
+		// the upgrader has responded with the error
+		log.Errorf("failed to upgrade the function log tail of %s/%s/%s error %v", tenant, namespace, funcName, err)
+		return
+	}
+	defer conn.Close()
+	log.Infof("tail %s/%s/%s instance %d log", tenant, namespace, funcName, instance)
+	streamFunctionLog(conn, tailer, bytes, interval, heartbeat, params.Get("structured") == "true")
+}
+
+// streamFunctionLog sends the new lines until the client goes away. The next lines are only read after the previous
+// ones are written, so a slow client holds back the reads rather than the lines piling up in burnell.
+func streamFunctionLog(conn *websocket.Conn, tailer *logclient.LogTailer, bytes int64, interval, heartbeat time.Duration, structured bool) {
+	// the client messages are discarded, a read error means the client has gone away
+	done := make(chan struct{})
+	conn.SetReadLimit(1024)
+	conn.SetReadDeadline(time.Now().Add(3 * heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(3 * heartbeat))
+	})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg tailMessage) error {
+		msg.Time = time.Now()
+		conn.SetWriteDeadline(msg.Time.Add(tailWriteTimeout))
+		return conn.WriteJSON(msg)
+	}
+	beat := time.NewTicker(heartbeat)
+	defer beat.Stop()
+	lastSent := time.Now()
+	retry := interval
+	for {
+		wait := interval
+		res, err := tailer.Next(bytes)
+		if err != nil {
+			if err := send(tailMessage{Type: "error", Error: err.Error(), Cursor: tailer.Cursor()}); err != nil {
+				return
+			}
+			lastSent = time.Now()
+			wait, retry = retry, retry*2
+			if retry > tailMaxRetryInterval {
+				retry = tailMaxRetryInterval
+			}
+		} else {
+			retry = interval
+			if res.Logs != "" || res.Rotated {
+				msg := tailMessage{Type: "logs", Logs: res.Logs, Cursor: res.Cursor, Rotated: res.Rotated, Gap: res.Gap}
+				if structured {
+					msg.Records = logclient.ParseLogRecords(res.Logs)
+				}
+				if err := send(msg); err != nil {
+					return
+				}
+				lastSent = time.Now()
+			}
+			if res.Logs != "" {
+				// catch up without waiting while there are lines to read
+				wait = 0
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		for waiting := true; waiting; {
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+				waiting = false
+			case <-beat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailWriteTimeout)); err != nil {
+					timer.Stop()
+					return
+				}
+				// a browser client cannot see the pings, an idle stream sends a heartbeat message
+				if time.Since(lastSent) >= heartbeat {
+					if err := send(tailMessage{Type: "heartbeat", Cursor: tailer.Cursor()}); err != nil {
+						timer.Stop()
+						return
+					}
+					lastSent = time.Now()
+				}
+			}
+		}
+	}
+}
+
+// websocketQueryToken sets the Authorization header of a websocket upgrade from the token query parameter,
+// since a browser cannot set the headers of a websocket request
+func websocketQueryToken(next http.Handler) http.Handler {
+	return queryTokenHandler{next: next}
+}
+
+type queryTokenHandler struct {
+	next http.Handler
+}
+
+func (h queryTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// Unwrap returns the handler the token is passed to
+func (h queryTokenHandler) Unwrap() http.Handler {
+	return h.next
+}
@@ -0,0 +1,71 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// GitOps push webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/workflow"
+)
+
+const maxWebhookBytes = 1 << 20
+
+// GitOpsWebhookHandler triggers a GitOps sync on a push to the configured branch. The GitHub or GitLab
+// webhook must be signed with the webhook secret.
+func GitOpsWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := util.GetConfig().GitOps
+	if cfg.Repository == "" || cfg.WebhookSecret == "" {
+		util.ResponseErrorJSON(errors.New("gitops webhook is not configured"), w, http.StatusNotImplemented)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBytes))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	if !workflow.VerifyGitWebhook(cfg.WebhookSecret, r.Header, body) {
+		util.ResponseErrorJSON(errors.New("invalid webhook signature"), w, http.StatusUnauthorized)
+		return
+	}
+	var push struct {
+		Ref string `json:"ref"`
+	}
+	json.Unmarshal(body, &push)
+	if push.Ref != workflow.GitOpsBranchRef() {
+		// a ping or a push to another branch
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"triggered":false}`))
+		return
+	}
+	log.Infof("gitops webhook push to %s", push.Ref)
+	workflow.TriggerGitOpsSync()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"triggered":true}`))
+}
@@ -30,13 +30,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/datastax/burnell/src/icrypto"
 	"github.com/datastax/burnell/src/logclient"
 	"github.com/datastax/burnell/src/metrics"
 	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/rbac"
 	"github.com/datastax/burnell/src/util"
 	"github.com/gorilla/mux"
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
@@ -56,6 +59,23 @@ type TokenServerResponse struct {
 	Token   string `json:"token"`
 }
 
+// DelegationRequest is the json request body to derive a delegated token
+type DelegationRequest struct {
+	Namespaces  []string `json:"namespaces"`
+	Permissions []string `json:"permissions"`
+	Exp         string   `json:"exp"`
+}
+
+// DelegationResponse is the json object for a delegated token
+type DelegationResponse struct {
+	Subject     string   `json:"subject"`
+	Token       string   `json:"token"`
+	ParentID    string   `json:"parentJti"`
+	Namespaces  []string `json:"namespaces"`
+	Permissions []string `json:"permissions"`
+	ExpiresAt   int64    `json:"expiresAt,omitempty"`
+}
+
 // TopicStatsResponse struct
 type TopicStatsResponse struct {
 	Tenant    string                 `json:"tenant"`
@@ -74,6 +94,12 @@ type AdminProxyHandler struct {
 // Init initializes database
 func Init() {
 	InitCache()
+	if err := rbac.Init(util.GetConfig().RBAC); err != nil {
+		log.Fatalf("invalid RBAC configuration %v", err)
+	}
+	if err := util.ValidateBasicAuth(util.GetConfig().BasicAuth); err != nil {
+		log.Fatalf("invalid basic-auth configuration %v", err)
+	}
 	// CacheTopicStatsWorker()
 	// topicStats = make(map[string]map[string]interface{})
 }
@@ -100,9 +126,15 @@ func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
 		return
 	}
+	binding, err := queryTokenBinding(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
 
-	tokenString, err := util.JWTAuth.GenerateToken(subject, exp, alg)
+	tokenString, err := util.JWTAuth.GenerateBoundToken(subject, exp, alg, tokenClaimVars(subject, params), binding)
 	if err != nil {
+		log.Errorf("failed to generate token for subject %s error %v", subject, err)
 		util.ResponseErrorJSON(errors.New("failed to generate token"), w, http.StatusInternalServerError)
 	} else {
 		respJSON, err := json.Marshal(&TokenServerResponse{
@@ -119,15 +151,132 @@ func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// tokenClaimVars builds the variables to compute the derived claims in the claims template
+// query parameters other than exp and alg are available as param.<name>
+func tokenClaimVars(subject string, params url.Values) map[string]string {
+	_, tenant := ExtractTenant(subject)
+	vars := map[string]string{
+		"sub":    subject,
+		"tenant": tenant,
+	}
+	for k, v := range params {
+		if k != "exp" && k != "alg" && len(v) > 0 {
+			vars["param."+k] = v[0]
+		}
+	}
+	return vars
+}
+
+// DelegateTokenHandler derives a narrower token from the bearer token
+// the delegated token is restricted to a subset of namespaces and permissions and cannot outlive the parent token
+func DelegateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.IsPulsarJWTEnabled() {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+	verified, err := verifyToken(tokenStr)
+	if err == nil {
+		err = verifyTokenBinding(r, verified)
+	}
+	if respondVerificationOverloaded(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	subject := verified.Subject
+
+	var req DelegationRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	for _, ns := range req.Namespaces {
+		parts := strings.Split(ns, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			util.ResponseErrorJSON(fmt.Errorf("namespace %s must be in the format of tenant/namespace", ns), w, http.StatusUnprocessableEntity)
+			return
+		}
+		if !VerifySubject(parts[0], subject) {
+			util.ResponseErrorJSON(fmt.Errorf("namespace %s does not belong to the token subject", ns), w, http.StatusForbidden)
+			return
+		}
+	}
+	if req.Exp == "" {
+		req.Exp = "0m"
+	}
+	exp, _, err := icrypto.ValidateClaims(req.Exp, "rs256")
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	tokenString, scope, expiry, err := util.JWTAuth.DelegateToken(tokenStr, icrypto.DelegationScope{
+		Namespaces:  req.Namespaces,
+		Permissions: req.Permissions,
+	}, exp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	log.Infof("subject %s delegated a token from parent jti %s for namespaces %v", subject, scope.ParentID, scope.Namespaces)
+
+	resp := DelegationResponse{
+		Subject:     subject,
+		Token:       tokenString,
+		ParentID:    scope.ParentID,
+		Namespaces:  scope.Namespaces,
+		Permissions: scope.Permissions,
+	}
+	if !expiry.IsZero() {
+		resp.ExpiresAt = expiry.Unix()
+	}
+	respJSON, err := json.Marshal(&resp)
+	if err != nil {
+		util.ResponseErrorJSON(errors.New("failed to marshal token response json object"), w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(respJSON)
+}
+
 // StatusPage replies with basic status code
 func StatusPage(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
+// FeatureGatesHandler lists the feature gates and their status
+func FeatureGatesHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(util.GetFeatureGates())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ReadinessHandler replies 503 until the startup dependency probes complete, the body is the readiness of the dependencies
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := util.GetReadiness()
+	data, err := json.Marshal(readiness)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
+
 // DirectBrokerProxyHandler - Pulsar broker admin REST API
 func DirectBrokerProxyHandler(w http.ResponseWriter, r *http.Request) {
-	requestURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, r.URL.RequestURI())
+	requestURL := util.SingleJoinSlash(util.AdminURL(requestTenant(r)), r.URL.RequestURI())
 	httpProxy(requestURL, w, r)
 }
 
@@ -144,7 +293,9 @@ func DirectFunctionProxyHandler(w http.ResponseWriter, r *http.Request) {
 		isSuperUser := util.StrContains(util.SuperRoles, role)
 		vars := mux.Vars(r)
 		if tenant, ok := vars["tenant"]; ok {
+			endPolicy := util.StartPhase(r.Context(), util.PhasePolicy)
 			limit := policy.TenantManager.GetFunctionsLimit(tenant)
+			endPolicy()
 			log.Infof("tenant %s with function limit %d, actual counts %d, is superuser %v", tenant, logclient.TenantFunctionCount(tenant), limit, isSuperUser)
 			if logclient.TenantFunctionCount(tenant) >= limit && !isSuperUser {
 				http.Error(w, "over the number of function limit under the current plan, please upgrade your plan", http.StatusPaymentRequired)
@@ -153,7 +304,7 @@ func DirectFunctionProxyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	requestURL := util.SingleJoinSlash(util.Config.FunctionProxyURL, r.URL.RequestURI())
+	requestURL := util.SingleJoinSlash(util.FunctionURL(requestTenant(r)), r.URL.RequestURI())
 	httpProxy(requestURL, w, r)
 }
 
@@ -235,11 +386,11 @@ func cachedGetProxy(r *http.Request) ([]byte, int, error) {
 	//if entry, err := HTTPCache.Get(key); err == nil {
 	//	return entry, http.StatusOK, nil
 	//}
-	requestURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, r.URL.RequestURI())
-	log.Infof("request route %s to proxy %v\n\tdestination url is %s", r.URL.RequestURI(), util.BrokerProxyURL, requestURL)
+	requestURL := util.SingleJoinSlash(util.AdminURL(requestTenant(r)), r.URL.RequestURI())
+	requestLog(r).WithField("upstream", requestURL).Infof("proxy request route %s", r.URL.RequestURI())
 
 	// Update the headers to allow for SSL redirection
-	newRequest, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	newRequest, err := http.NewRequestWithContext(r.Context(), http.MethodGet, requestURL, nil)
 	if err != nil {
 		// util.ResponseErrorJSON(errors.New("failed to set proxy request"), w, http.StatusInternalServerError)
 		return nil, http.StatusInternalServerError, err
@@ -249,49 +400,40 @@ func cachedGetProxy(r *http.Request) ([]byte, int, error) {
 	newRequest.Header.Set("X-Proxy", "burnell")
 	//r.Host = util.ProxyURL.Host
 	//r.RequestURI = util.ProxyURL.RequestURI() + requestRoute
-	newRequest.Header.Set("Authorization", "Bearer "+util.Config.PulsarToken)
+	newRequest.Header.Set("Authorization", "Bearer "+util.PulsarToken())
 
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
-	response, err := client.Do(newRequest)
-	if response != nil {
-		defer response.Body.Close()
-	}
+	response, err := util.CoalesceGet(util.UpstreamClient(), newRequest, nil)
 	if err != nil {
 		log.Errorf("%v", err)
 		return nil, http.StatusInternalServerError, errors.New("proxy failure")
 	}
-
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, http.StatusInternalServerError, errors.New("failed to read proxy response body")
-	}
+	body := response.Body
 
 	/*err = HTTPCache.Set(key, body)
 	if err != nil {
 		log.Errorf("Could not write into cache: %v", err)
 	}
-	log.Debugf("set in cache key is %s", key)
+	logger.Debugf("set in cache key is %s", key)
 	*/
 
 	return body, response.StatusCode, nil
 }
 
 func httpProxy(requestURL string, w http.ResponseWriter, r *http.Request) {
-	log.Infof("request route %s to proxy %v\n\tmethod %v destination url is %s", r.URL.RequestURI(), util.BrokerProxyURL, r.Method, requestURL)
+	logger := requestLog(r).WithField("upstream", requestURL)
+	logger.Infof("proxy request route %s", r.URL.RequestURI())
 
 	body, err := ioutil.ReadAll(r.Body)
 	if body != nil {
 		defer r.Body.Close()
 	}
 	if err != nil {
-		log.Infof("%s Error reading body: %v", requestURL, err)
+		logger.Infof("error reading body: %v", err)
 		http.Error(w, "can't read body", http.StatusBadRequest)
 		return
 	}
 	// Update the headers to allow for SSL redirection
-	newRequest, err := http.NewRequest(r.Method, requestURL, bytes.NewBuffer(body))
+	newRequest, err := http.NewRequestWithContext(r.Context(), r.Method, requestURL, bytes.NewBuffer(body))
 	if err != nil {
 		util.ResponseErrorJSON(errors.New("failed to set proxy request"), w, http.StatusInternalServerError)
 		return
@@ -302,45 +444,92 @@ func httpProxy(requestURL string, w http.ResponseWriter, r *http.Request) {
 	newRequest.Header = r.Header
 	newRequest.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
 	newRequest.Header.Set("X-Proxy", "burnell")
-	newRequest.Header.Set("Authorization", "Bearer "+util.Config.PulsarToken)
+	newRequest.Header.Set("Authorization", "Bearer "+util.PulsarToken())
 
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
+	// a large response is streamed with a pooled buffer, a multi-MB stats response is never held in memory
+	response, err := util.CoalesceGet(util.UpstreamClient(), newRequest, func(response *http.Response) {
+		w.WriteHeader(response.StatusCode)
+		if _, err := util.CopyBuffered(w, response.Body); err != nil {
+			logger.Errorf("failed to stream proxy response body %v", err)
+		}
+	})
+	if err != nil {
+		logger.Errorf("%v", err)
+		util.ResponseErrorJSON(errors.New("proxy failure"), w, http.StatusInternalServerError)
+		return
 	}
-	response, err := client.Do(newRequest)
 	if response != nil {
-		defer response.Body.Close()
+		w.WriteHeader(response.StatusCode)
+		w.Write(response.Body)
 	}
+}
+
+// getAdmin gets a resource from the admin REST API with the super role token
+func getAdmin(requestURL string) (int, http.Header, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
 	if err != nil {
-		log.Errorf("%v", err)
-		util.ResponseErrorJSON(errors.New("proxy failure"), w, http.StatusInternalServerError)
-		return
+		return 0, nil, nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	resp, err := util.CoalesceGet(util.UpstreamClient(), req, nil)
+	if err != nil {
+		return 0, nil, nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, resp.Header, nil, fmt.Errorf("%s returns status code %d", requestURL, resp.StatusCode)
+	}
+	return resp.StatusCode, resp.Header, resp.Body, nil
+}
 
-	body, err = ioutil.ReadAll(response.Body)
+// getAdminJSON gets a json object from the admin REST API with the super role token
+func getAdminJSON(requestURL string, v interface{}) (int, error) {
+	status, _, body, err := getAdmin(requestURL)
 	if err != nil {
-		util.ResponseErrorJSON(errors.New("failed to read proxy response body"), w, http.StatusInternalServerError)
-		return
+		return status, err
 	}
+	return status, json.Unmarshal(body, v)
+}
 
-	w.WriteHeader(response.StatusCode)
-	w.Write(body)
-	return
+// sendAdmin sends a request with an optional json body to the admin REST API with the super role token.
+// A status code other than 2xx is an error.
+func sendAdmin(method, requestURL string, v interface{}) (int, error) {
+	var body io.Reader
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	resp, err := util.UpstreamClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("%s %s returns status code %d %s", method, requestURL, resp.StatusCode, string(msg))
+	}
+	return resp.StatusCode, nil
 }
 
 func getTenantNameList() ([]string, error) {
-	requestURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, "admin/v2/tenants")
+	requestURL := util.SingleJoinSlash(util.DefaultAdminURL(), "admin/v2/tenants")
 	newRequest, err := http.NewRequest(http.MethodGet, requestURL, nil)
 	if err != nil {
 		// util.ResponseErrorJSON(errors.New("failed to set proxy request"), w, http.StatusInternalServerError)
 		return nil, err
 	}
 	newRequest.Header.Add("X-Proxy", "burnell")
-	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	newRequest.Header.Add("Authorization", "Bearer "+util.PulsarToken())
 
-	client := &http.Client{
-		CheckRedirect: util.PreserveHeaderForRedirect,
-	}
+	client := util.UpstreamClient()
 	response, err := client.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
@@ -427,11 +616,15 @@ func limitEnforceProxyHandler(w http.ResponseWriter, r *http.Request, eval func(
 	}
 	vars := mux.Vars(r)
 	if tenant, ok := vars["tenant"]; ok {
-		if ok, err := eval(tenant); err != nil {
+		endPolicy := util.StartPhase(r.Context(), util.PhasePolicy)
+		ok, err := eval(tenant)
+		endPolicy()
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 		} else if ok {
 			DirectBrokerProxyHandler(w, r)
 		} else {
+			notifyQuotaBreached(r, tenant)
 			http.Error(w, "over the quota limit", http.StatusPaymentRequired)
 		}
 	} else {
@@ -442,17 +635,16 @@ func limitEnforceProxyHandler(w http.ResponseWriter, r *http.Request, eval func(
 // FunctionStatusHandler returns a function's status including worker ID as the FunctionLogHandler sees
 func FunctionStatusHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	tenant, ok := vars["tenant"]
-	namespace, ok2 := vars["namespace"]
-	funcName, ok3 := vars["function"]
+	_, ok := vars["tenant"]
+	_, ok2 := vars["namespace"]
+	_, ok3 := vars["function"]
 	if !(ok && ok2 && ok3) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	funcType, ok := logclient.ReadFunctionMap(tenant + namespace + funcName)
+	funcType, ok := functionLogAccess(w, r, "function.status")
 	if !ok {
-		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 	responseBody, err := json.Marshal(funcType)
@@ -483,6 +675,9 @@ func FunctionLogsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
+	if _, ok := functionLogAccess(w, r, "function.logs"); !ok {
+		return
+	}
 
 	var reqObj logclient.FunctionLogRequest
 	u, _ := url.Parse(r.URL.String())
@@ -503,16 +698,39 @@ func FunctionLogsHandler(w http.ResponseWriter, r *http.Request) {
 	if strs, ok := params["workerid"]; ok {
 		workerID = strs[0]
 	}
+	filter, err := functionLogFilter(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, hasCursor := params["cursor"]
+	if hasCursor && (reqObj.BackwardPosition > 0 || reqObj.ForwardPosition > 0 || !filter.IsEmpty()) {
+		http.Error(w, "cursor cannot be specified with positions or a search", http.StatusBadRequest)
+		return
+	}
 
-	clientRes, err := logclient.GetFunctionLog(tenant+namespace+funcName, workerID, instance, reqObj)
+	var clientRes logclient.FunctionLogResponse
+	if hasCursor {
+		clientRes, err = logclient.ReadFunctionLogCursor(tenant+namespace+funcName, workerID, instance, params.Get("cursor"), reqObj.Bytes)
+	} else if filter.IsEmpty() {
+		clientRes, err = logclient.GetFunctionLog(tenant+namespace+funcName, workerID, instance, reqObj)
+	} else {
+		clientRes, err = logclient.SearchFunctionLog(tenant+namespace+funcName, workerID, instance, reqObj, filter)
+	}
 	if err != nil {
 		if err == logclient.ErrNotFoundFunction || strings.HasSuffix(err.Error(), "no such file or directory") {
 			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if err == logclient.ErrInvalidLogCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		} else {
 			http.Error(w, "log server returned "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
+	if params.Get("structured") == "true" {
+		clientRes.Records = logclient.ParseLogRecords(clientRes.Logs)
+	}
 	// fmt.Printf("pos %d, %d\n", clientRes.BackwardPosition, clientRes.ForwardPosition)
 	jsonResponse, err := json.Marshal(clientRes)
 	if err != nil {
@@ -521,13 +739,103 @@ func FunctionLogsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if clientRes.Logs == "" {
+	// an empty read still returns the cursor
+	if clientRes.Logs == "" && !hasCursor {
 		w.WriteHeader(http.StatusNoContent)
 	}
 	w.Write(jsonResponse)
 	return
 }
 
+// FunctionLogArchiveHandler downloads the logs of every function instance as a gzip compressed tar archive
+func FunctionLogArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace, funcName := vars["tenant"], vars["namespace"], vars["function"]
+	maxBytes := int64(queryParamInt(r.URL.Query(), "maxbytes", logclient.DefaultArchiveBytes))
+	if maxBytes <= 0 || maxBytes > logclient.MaxArchiveBytes {
+		http.Error(w, fmt.Sprintf("maxbytes must be between 1 and %d", logclient.MaxArchiveBytes), http.StatusBadRequest)
+		return
+	}
+
+	fn, ok := functionLogAccess(w, r, "function.logs.archive")
+	if !ok {
+		return
+	}
+	status, err := logclient.GetFunctionStatus(fn)
+	if err != nil {
+		http.Error(w, "failed to get function instances "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	instances := status.Instances
+	log.WithField("app", "FunctionLogArchiveHandler").Infof("archive %s/%s/%s logs of %d instances", tenant, namespace, funcName, len(instances))
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s-%s-logs.tar.gz\"", tenant, namespace, funcName))
+	if err := logclient.WriteFunctionLogArchive(w, fn, instances, maxBytes); err != nil {
+		// the archive is cut short since the response has been started
+		log.Errorf("failed to write %s/%s/%s log archive error %v", tenant, namespace, funcName, err)
+	}
+}
+
+// FunctionMergedLogsHandler merges the logs of every function instance in the order of their timestamps
+func FunctionMergedLogsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	bytes := int64(queryParamInt(params, "bytes", logclient.DefaultMergeBytes))
+	if bytes <= 0 || bytes > logclient.MaxMergeBytes {
+		http.Error(w, fmt.Sprintf("bytes must be between 1 and %d", logclient.MaxMergeBytes), http.StatusBadRequest)
+		return
+	}
+	positions, err := instancePositions(params.Get("positions"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fn, ok := functionLogAccess(w, r, "function.logs.merged")
+	if !ok {
+		return
+	}
+	status, err := logclient.GetFunctionStatus(fn)
+	if err != nil {
+		http.Error(w, "failed to get function instances "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	instances := status.Instances
+
+	merged := logclient.MergeFunctionLogs(fn, instances, positions, bytes)
+	jsonResponse, err := json.Marshal(merged)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// instancePositions parses the comma separated instance:backwardpos pairs, an empty value returns a nil map
+func instancePositions(value string) (map[int]int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	positions := make(map[int]int64)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid position %s, expected instance:backwardpos", pair)
+		}
+		instance, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance in position %s", pair)
+		}
+		pos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backwardpos in position %s", pair)
+		}
+		positions[instance] = pos
+	}
+	return positions, nil
+}
+
 // PulsarFederatedPrometheusHandler exposes pulsar federated prometheus metrics
 func PulsarFederatedPrometheusHandler(w http.ResponseWriter, r *http.Request) {
 	subject := r.Header.Get("injectedSubs")
@@ -546,15 +854,83 @@ func PulsarFederatedPrometheusHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", http.StatusForbidden)
 	}
 	*/
-	tenantFederatedPrometheus(tenant, w)
+	tenantFederatedPrometheus(tenant, w, r)
 }
 
-func tenantFederatedPrometheus(tenant string, w http.ResponseWriter) {
+// FunctionMetricsHandler exposes the function runtime metrics of the tenant in the path or of the subject,
+// in the Prometheus text format or in JSON with format=json. A super role subject gets all the functions.
+func FunctionMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := mux.Vars(r)["tenant"]
+	if !ok {
+		subject := r.Header.Get("injectedSubs")
+		if subject == "" {
+			http.Error(w, "missing subject", http.StatusUnauthorized)
+			return
+		}
+		_, tenant = ExtractTenant(subject)
+		if util.StrContains(util.SuperRoles, tenant) {
+			tenant = ""
+		}
+	}
+
+	functionMetrics := logclient.GetFunctionMetrics(tenant)
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		data, err := json.Marshal(functionMetrics)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(logclient.FunctionMetricsText(functionMetrics))
+}
+
+func tenantFederatedPrometheus(tenant string, w http.ResponseWriter, r *http.Request) {
 	data, err := metrics.GetTenantPromMetrics(tenant)
 	if err != nil {
 		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 		return
 	}
+	if allowlist := util.TenantSettingsOf(tenant).MetricAllowlist; len(allowlist) > 0 && tenant != metrics.SuperRole {
+		data = metrics.FilterMetricNames(data, allowlist)
+	}
+	naming := queryParamString(r.URL.Query(), "naming", "pulsar")
+	if naming != "pulsar" && naming != "kafka" {
+		util.ResponseErrorJSON(fmt.Errorf("unsupported naming %s, the namings are pulsar and kafka", naming), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if etag, modTime, ok := metrics.GetCacheValidators(tenant); ok {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		if notModified(r, etag, modTime) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if naming == "kafka" && len(data) > 1 {
+		if data, err = metrics.KafkaMetricNames(data); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.URL.Query().Get("format") == "datadog" {
+		series, err := metrics.DatadogMetrics(data, nil)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		respJSON, err := json.Marshal(metrics.DatadogPayload{Series: series})
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respJSON)
+		return
+	}
 
 	if len(data) > 1 {
 		w.WriteHeader(http.StatusOK)
@@ -574,7 +950,110 @@ func PulsarFederatedDebugPrometheusHandler(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	tenant, _ := vars["tenant"]
 	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
-	tenantFederatedPrometheus(tenant, w)
+	tenantFederatedPrometheus(tenant, w, r)
+}
+
+// ScrapeResponse is the json object for an on-demand scrape
+type ScrapeResponse struct {
+	Tenant     string `json:"tenant"`
+	Bytes      int    `json:"bytes"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// LogLevelHandler gets, sets, or resets the runtime log level of the process or the modules.
+// PUT takes the level, the optional comma separated modules, and the optional revert duration as query parameters.
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		params := r.URL.Query()
+		level, err := log.ParseLevel(strings.ToLower(queryParamString(params, "level", "")))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		revert := util.LogLevelRevert()
+		if str := queryParamString(params, "duration", ""); str != "" {
+			if revert, err = time.ParseDuration(str); err != nil || revert < 0 {
+				util.ResponseErrorJSON(fmt.Errorf("invalid duration %s", str), w, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		var modules []string
+		if str := queryParamString(params, "modules", ""); str != "" {
+			modules = strings.Split(str, ",")
+		}
+		util.SetLogLevel(level, modules, revert)
+	case http.MethodDelete:
+		util.ResetLogLevel()
+	}
+
+	data, err := json.Marshal(util.GetLogLevel())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// ConfigHandler returns the effective configuration with the secrets redacted and the source of each key
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := util.GetEffectiveConfig()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// ForceScrapeHandler re-scrapes the federated metrics immediately for all or a tenant
+func ForceScrapeHandler(w http.ResponseWriter, r *http.Request) {
+	if metrics.FederatedPromURL() == "" {
+		http.Error(w, "federated prometheus is not configured", http.StatusNotImplemented)
+		return
+	}
+	u, _ := url.Parse(r.URL.String())
+	tenant := queryParamString(u.Query(), "tenant", metrics.SuperRole)
+
+	start := time.Now()
+	data, err := metrics.ForceScrape(tenant)
+	if err != nil {
+		log.Errorf("on-demand scrape of %s error %v", tenant, err)
+		util.ResponseErrorJSON(err, w, http.StatusBadGateway)
+		return
+	}
+	respJSON, err := json.Marshal(&ScrapeResponse{
+		Tenant:     tenant,
+		Bytes:      len(data),
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+	if err != nil {
+		http.Error(w, "failed to marshal scrape response", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJSON)
+}
+
+// notModified evaluates the conditional request headers, If-None-Match takes precedence over If-Modified-Since
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, v := range strings.Split(match, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == etag || v == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !modTime.Truncate(time.Second).After(since)
+	}
+	return false
 }
 
 // TenantUsageHandler returns tenant usage
@@ -604,6 +1083,61 @@ func TenantUsageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(data))
 }
 
+// TopMetricsHandler ranks topics or namespaces by backlog, rate, throughput, or storage
+// a superuser token without a tenant in the route ranks across the cluster
+func TopMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, ok := vars["tenant"]
+	if !ok {
+		subject := r.Header.Get(injectedSubs)
+		if subject == "" {
+			http.Error(w, "missing subject", http.StatusUnauthorized)
+			return
+		}
+		_, tenant = ExtractTenant(subject)
+		if util.StrContains(util.SuperRoles, tenant) {
+			tenant = metrics.SuperRole
+		}
+	}
+
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	by := queryParamString(params, "by", "backlog")
+	group := queryParamString(params, "group", "topic")
+	n := queryParamInt(params, "n", 10)
+	if _, ok := metrics.TopNMetrics[by]; !ok || (group != "topic" && group != "namespace") || n < 1 {
+		http.Error(w, "invalid by, group, or n query parameter", http.StatusUnprocessableEntity)
+		return
+	}
+
+	entries, err := metrics.TopN(tenant, by, group, n)
+	if err != nil {
+		log.Errorf("failed to rank %s by %s error %v", tenant, by, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, "failed to marshal top metrics", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// AlertsHandler returns the firing alerts of a tenant or all tenants
+func AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	data, err := json.Marshal(metrics.GetFiringAlerts(vars["tenant"]))
+	if err != nil {
+		log.Errorf("marshal alerts error %s", err.Error())
+		http.Error(w, "failed to marshal alerts", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 // TenantTopicStatsHandler returns tenant topic statistics
 func TenantTopicStatsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -616,7 +1150,7 @@ func TenantTopicStatsHandler(w http.ResponseWriter, r *http.Request) {
 	params := u.Query()
 	offset := queryParamInt(params, "offset", 0)
 	pageSize := queryParamInt(params, "limit", 50)
-	log.Debugf("offset %d limit %d", offset, pageSize)
+	logger.Debugf("offset %d limit %d", offset, pageSize)
 
 	// body specifies a list of must required topic,
 	// the handler makes extra calls to retreive those stats if they are not in the cache
@@ -676,6 +1210,40 @@ func GroupTopicsByNamespaceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// functionLogFilter builds the search filter from the match, regex, level, since, until, limit, and scanbytes query parameters
+func functionLogFilter(params url.Values) (logclient.FunctionLogFilter, error) {
+	filter := logclient.FunctionLogFilter{
+		Substring:    params.Get("match"),
+		MaxMatches:   queryParamInt(params, "limit", logclient.DefaultSearchMatches),
+		MaxScanBytes: int64(queryParamInt(params, "scanbytes", logclient.DefaultSearchScanBytes)),
+	}
+	if filter.MaxScanBytes > logclient.MaxSearchScanBytes {
+		filter.MaxScanBytes = logclient.MaxSearchScanBytes
+	}
+	if expr := params.Get("regex"); expr != "" {
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid regex %v", err)
+		}
+		filter.Regex = regex
+	}
+	for _, level := range strings.Split(params.Get("level"), ",") {
+		if level = strings.ToUpper(strings.TrimSpace(level)); level != "" {
+			filter.Levels = append(filter.Levels, level)
+		}
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := params.Get(name); value != "" {
+			ts, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s is not an RFC3339 time %v", name, err)
+			}
+			*t = ts
+		}
+	}
+	return filter, nil
+}
+
 func queryParamInt(params url.Values, name string, defaultV int) int {
 	if str, ok := params[name]; ok {
 		if n, err := strconv.Atoi(str[0]); err == nil {
@@ -703,6 +1271,20 @@ func TenantManagementHandler(w http.ResponseWriter, r *http.Request) {
 	var newPlan policy.TenantPlan
 	var err error
 
+	if r.Method != http.MethodGet {
+		// the If-Match of an update or a delete is evaluated against the current plan
+		provisioningLock.Lock()
+		defer provisioningLock.Unlock()
+		etag := ""
+		if current, err := policy.TenantManager.GetTenant(tenant); err == nil {
+			etag = resourceETag(current)
+		}
+		if preconditionFailed(r, etag) {
+			util.ResponseErrorJSON(fmt.Errorf("tenant %s does not match the precondition", tenant), w, http.StatusPreconditionFailed)
+			return
+		}
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		tenants, err := getTenantNameList()
@@ -751,6 +1333,9 @@ func TenantManagementHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if data, err := json.Marshal(newPlan); err == nil {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("ETag", resourceETag(newPlan))
+		}
 		w.Write(data)
 	}
 }
@@ -901,6 +1486,129 @@ func extractEvalTenant(requiredSubject, tokenSub string) bool {
 	return requiredSubject == subCase1 || requiredSubject == subCase2
 }
 
+// SecretRequest is the body to create or update a tenant secret
+type SecretRequest struct {
+	Value string `json:"value"`
+}
+
+// TenantSecretsHandler lists, creates, updates, and deletes the tenant secrets referenced by the connector configs.
+// The secret values are write only.
+func TenantSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	if policy.SecretStore == nil {
+		util.ResponseErrorJSON(errors.New("secret store is not available"), w, http.StatusServiceUnavailable)
+		return
+	}
+	vars := mux.Vars(r)
+	tenant, name := vars["tenant"], vars["name"]
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := json.Marshal(policy.SecretStore.ListSecrets(tenant))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+
+	case http.MethodPut:
+		var req SecretRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == "" {
+			util.ResponseErrorJSON(errors.New("secret value is required"), w, http.StatusUnprocessableEntity)
+			return
+		}
+		meta, err := policy.SecretStore.PutSecret(tenant, name, req.Value)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		log.Infof("subject %s updated secret %s of tenant %s", r.Header.Get(injectedSubs), name, tenant)
+		data, _ := json.Marshal(meta)
+		w.Write(data)
+
+	case http.MethodDelete:
+		if err := policy.SecretStore.DeleteSecret(tenant, name); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		log.Infof("subject %s deleted secret %s of tenant %s", r.Header.Get(injectedSubs), name, tenant)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// TenantOverridesResponse is the override layer of a tenant and its settings merged over the global defaults
+type TenantOverridesResponse struct {
+	Overrides *util.TenantOverrides `json:"overrides"`
+	Effective util.TenantSettings   `json:"effective"`
+}
+
+// TenantOverridesHandler gets, replaces, or deletes the configuration overrides of a tenant
+func TenantOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	if policy.OverridesStore == nil {
+		util.ResponseErrorJSON(errors.New("overrides store is not available"), w, http.StatusServiceUnavailable)
+		return
+	}
+	tenant := mux.Vars(r)["tenant"]
+
+	switch r.Method {
+	case http.MethodPut:
+		var settings util.TenantSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("invalid tenant settings %v", err), w, http.StatusUnprocessableEntity)
+			return
+		}
+		if _, err := policy.OverridesStore.PutOverrides(tenant, settings); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		log.Infof("subject %s updated overrides of tenant %s", r.Header.Get(injectedSubs), tenant)
+	case http.MethodDelete:
+		if err := policy.OverridesStore.DeleteOverrides(tenant); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		log.Infof("subject %s deleted overrides of tenant %s", r.Header.Get(injectedSubs), tenant)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	resp := TenantOverridesResponse{Effective: util.TenantSettingsOf(tenant)}
+	if o, ok := util.GetTenantOverrides(tenant); ok {
+		resp.Overrides = &o
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// ListTenantOverridesHandler lists the overrides of all tenants
+func ListTenantOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(util.ListTenantOverrides())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// requestTenant returns the tenant in the route, or the tenant of the token subject
+// to resolve the cluster serving the request
+func requestTenant(r *http.Request) string {
+	if tenant, ok := mux.Vars(r)["tenant"]; ok {
+		return tenant
+	}
+	case1, case2 := ExtractTenant(r.Header.Get(injectedSubs))
+	if util.TenantCluster(case1) != "" {
+		return case1
+	}
+	return case2
+}
+
 // ExtractTenant attempts to extract tenant based on delimiter `-` and `-client-`
 // so that it will covercases such as 1. chris-datastax-12345qbc
 // 2. chris-datastax-client-12345qbc
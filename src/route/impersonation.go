@@ -0,0 +1,89 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Impersonation lets a support engineer reproduce the view of a subject with their own credentials.
+// It is read only, behind the Impersonation feature gate, and every attempt is audited with both identities.
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/util"
+)
+
+// ImpersonateHeader is the request header of the subject to impersonate
+const ImpersonateHeader = "X-Impersonate-Subject"
+
+// ImpersonatedByHeader is the response header of an impersonated request, it is the impersonator's subjects
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// impersonatedSubjectPattern is a single subject, alphanumeric and hyphen
+var impersonatedSubjectPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// impersonationResource is the RBAC resource granted on the cluster to impersonate the subjects
+const impersonationResource = "impersonation"
+
+// impersonate replaces the authenticated subjects with the impersonated subject. The impersonator must be granted
+// impersonation:read on the cluster and authenticate without a delegation scope.
+func impersonate(r *http.Request, subjects string, scope *icrypto.DelegationScope, target string) (string, error) {
+	_, tenant := ExtractTenant(target)
+	event := audit.Event{
+		Subject:    subjects,
+		OnBehalfOf: target,
+		Tenant:     tenant,
+		Action:     "impersonate",
+		Resource:   r.Method + " " + r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+	}
+	err := impersonationAllowed(r, subjects, scope, target)
+	if err != nil {
+		event.Outcome, event.Reason = audit.Denied, err.Error()
+		audit.Record(event)
+		return "", err
+	}
+	event.Outcome = audit.Allowed
+	audit.Record(event)
+	return target, nil
+}
+
+func impersonationAllowed(r *http.Request, subjects string, scope *icrypto.DelegationScope, target string) error {
+	switch {
+	case !util.FeatureEnabled(util.FeatureImpersonation):
+		return fmt.Errorf("impersonation is disabled")
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return fmt.Errorf("impersonation is read only")
+	case scope != nil:
+		return fmt.Errorf("a delegated token or a scoped API key cannot impersonate")
+	case !impersonatedSubjectPattern.MatchString(target):
+		return fmt.Errorf("invalid subject %s to impersonate", target)
+	case util.StrContains(util.SuperRoles, target):
+		return fmt.Errorf("super role %s cannot be impersonated", target)
+	case !authorize(r, subjects, "", impersonationResource, rbac.ActionRead).Allowed:
+		return fmt.Errorf("subjects are not authorized to impersonate")
+	}
+	return nil
+}
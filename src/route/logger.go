@@ -22,11 +22,15 @@
 package route
 
 import (
-	"log"
 	"net/http"
 	"time"
+
+	"github.com/datastax/burnell/src/util"
 )
 
+// logger of the route module
+var logger = util.ModuleLogger("route")
+
 // Logger logs http traffic.
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -34,12 +38,6 @@ func Logger(inner http.Handler, name string) http.Handler {
 
 		inner.ServeHTTP(w, r)
 
-		log.Printf(
-			"%s\t%s\t%s\t%s",
-			r.Method,
-			r.RequestURI,
-			name,
-			time.Since(start),
-		)
+		requestLog(r).WithField("uri", util.RedactURI(r.RequestURI)).WithField("duration", time.Since(start).String()).Info(name)
 	})
 }
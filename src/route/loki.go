@@ -0,0 +1,72 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Grafana Loki push of the audit events and the access log
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/util"
+)
+
+// accessLogLoki is nil unless the access log is pushed to Loki
+var accessLogLoki *util.LokiClient
+
+// lokiAuditSink pushes the audit events as json lines, labeled by the tenant, the action as the route, and the subject
+type lokiAuditSink struct {
+	client *util.LokiClient
+}
+
+func (s lokiAuditSink) Name() string {
+	return "loki"
+}
+
+func (s lokiAuditSink) Send(e audit.Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.client.Push(map[string]string{"tenant": e.Tenant, "route": e.Action, "subject": e.Subject}, e.Time, string(line))
+	return nil
+}
+
+// InitLoki starts the Loki push of the audit events and the access log if configured
+func InitLoki() {
+	cfg := util.GetConfig().Loki
+	if cfg.URL == "" {
+		return
+	}
+	if cfg.Audit {
+		audit.AddSink(lokiAuditSink{client: util.NewLokiClient(cfg, "burnell-audit")})
+	}
+	if cfg.AccessLog {
+		accessLogLoki = util.NewLokiClient(cfg, "burnell-access")
+	}
+}
+
+// pushAccessLog pushes an access log line labeled by the tenant, the route template, and the subject
+func pushAccessLog(tenant, route, subject string, start time.Time, line string) {
+	accessLogLoki.Push(map[string]string{"tenant": tenant, "route": route, "subject": subject}, start, line)
+}
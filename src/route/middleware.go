@@ -23,92 +23,220 @@ package route
 
 //middleware includes auth, rate limit, and etc.
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/util"
 	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
 )
 
+// forwardedByHeader marks a request forwarded by another replica to prevent forwarding loops
+const forwardedByHeader = "X-Burnell-Forwarded"
+
 // Rate is the default global rate limit
 // This rate only limits the rate hitting on endpoint
 // It does not limit the underline resource access
 var Rate = NewSema(200)
 
-// AuthVerifyJWT Authenticate middleware function that extracts the subject in JWT
+// AuthVerifyJWT Authenticate middleware function that extracts the subject in JWT.
+// It is the authenticated scope permission of an undeclared resource.
 func AuthVerifyJWT(next http.Handler) http.Handler {
+	return &PermissionHandler{Permission: RoutePermission{Scope: ScopeAuthenticated, Tenant: TenantNone}, next: next}
+}
+
+// AuthVerifyTenantJWT Authenticate middleware function that extracts the subject in JWT.
+// It is the tenant scope permission on the path tenant, the resource is derived from the route.
+func AuthVerifyTenantJWT(next http.Handler) http.Handler {
+	return &PermissionHandler{Permission: RoutePermission{Scope: ScopeTenant, Tenant: TenantFromPath}, next: next}
+}
+
+// SuperRoleRequired ensures token has the super user subject.
+// It is the superuser scope permission, the resource is derived from the route.
+func SuperRoleRequired(next http.Handler) http.Handler {
+	return &PermissionHandler{Permission: RoutePermission{Scope: ScopeSuperuser, Tenant: TenantNone}, next: next}
+}
+
+// tokenSubjectAndScope verifies the bearer token of a request, the time spent is the auth phase of the request
+func tokenSubjectAndScope(r *http.Request) (string, *icrypto.DelegationScope, error) {
+	defer util.StartPhase(r.Context(), util.PhaseAuth)()
+	tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+	// a banned source is rejected before the costly signature verification
+	ip := clientIP(r)
+	if keyStr := requestAPIKey(r); keyStr != "" {
+		return apiKeySubjectAndScope(r, ip, keyStr)
+	}
+	if id, ok := requestSessionCookie(r); ok {
+		return sessionSubjectAndScope(r, id)
+	}
+	if retryAfter, banned := util.AuthBanned(ip, icrypto.UnverifiedSubject(tokenStr)); banned {
+		requestLog(r).Warnf("reject the request of the banned source %s", ip)
+		return "", nil, authBannedError{retryAfter: retryAfter}
+	}
+	verified, err := verifyToken(tokenStr)
+	if err == nil {
+		err = verifyTokenBinding(r, verified)
+	}
+	if err != nil && tokenStr != "" && err != util.ErrVerificationOverloaded {
+		util.RecordAuthFailure(ip, icrypto.FailedTokenSubject(tokenStr, verified, err))
+	}
+	if err == nil {
+		notifyTokenExpiring(verified.Subject, verified.ExpiresAt)
+	}
+	return verified.Subject, verified.Scope, err
+}
+
+// authorizeScope checks a delegated token scope against the tenant/namespace and the method of the request.
+// A token without delegation scope is not restricted.
+func authorizeScope(r *http.Request, scope *icrypto.DelegationScope) bool {
+	if scope == nil {
+		return true
+	}
+	vars := mux.Vars(r)
+	tenant, namespace := vars["tenant"], vars["namespace"]
+	if tenant == "" || namespace == "" || !scope.AllowsNamespace(tenant+"/"+namespace) {
+		return false
+	}
+	permission := icrypto.PermissionWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		permission = icrypto.PermissionRead
+	}
+	return scope.AllowsPermission(permission)
+}
+
+// ShardForward forwards the request of a tenant owned by another replica when the tenant shards are enabled.
+// It must be chained after an authentication middleware that injects the subject.
+func ShardForward(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !util.IsPulsarJWTEnabled() {
-			r.Header.Set(injectedSubs, util.DummySuperRole)
+		if r.Header.Get(forwardedByHeader) != "" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
-		subjects, err := util.JWTAuth.GetTokenSubject(tokenStr)
-
-		if err == nil {
-			log.Infof("Authenticated with subjects %s", subjects)
-			r.Header.Set(injectedSubs, subjects)
+		tenant, ok := mux.Vars(r)["tenant"]
+		if !ok {
+			_, tenant = ExtractTenant(r.Header.Get(injectedSubs))
+		}
+		if tenant == "" || util.StrContains(util.SuperRoles, tenant) {
 			next.ServeHTTP(w, r)
-		} else {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-
+		address := policy.ShardOwner(tenant)
+		if address == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Debugf("forward tenant %s request to replica %s", tenant, address)
+		forwardToReplica(address, w, r, next)
 	})
 }
 
-// AuthVerifyTenantJWT Authenticate middleware function that extracts the subject in JWT
-func AuthVerifyTenantJWT(next http.Handler) http.Handler {
+// LeaderForward forwards the request served from the state built by the leader, such as the tenant usage and alerts,
+// when this replica is a follower. It must be chained after an authentication middleware.
+func LeaderForward(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !util.IsPulsarJWTEnabled() {
-			r.Header.Set(injectedSubs, util.DummySuperRole)
+		address := util.LeaderAddress()
+		if address == "" || r.Header.Get(forwardedByHeader) != "" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
-		subjects, err := util.JWTAuth.GetTokenSubject(tokenStr)
-
-		if err != nil {
-			http.Error(w, "failed to obtain subject", http.StatusUnauthorized)
-			return
-		}
+		logger.Debugf("forward request %s to the leader %s", r.URL.Path, address)
+		forwardToReplica(address, w, r, next)
+	})
+}
 
-		log.Infof("Authenticated with subjects %s to match tenant", subjects)
-		r.Header.Set(injectedSubs, subjects)
-		vars := mux.Vars(r)
-		if tenantName, ok := vars["tenant"]; ok {
-			if VerifySubject(tenantName, subjects) {
-				next.ServeHTTP(w, r)
-				return
-			}
-			log.Errorf("Authenticated subjects %s does not match tenant %s", subjects, tenantName)
-		}
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// forwardToReplica proxies the request to another replica, the request is served locally if the replica is unreachable
+func forwardToReplica(address string, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	target, err := url.Parse(address)
+	if err != nil {
+		log.Errorf("invalid replica address %s error %v", address, err)
+		next.ServeHTTP(w, r)
 		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.BufferPool = util.ProxyBufferPool
+	director := proxy.Director
+	// the headers are only changed on the upstream copy of the request, the local fallback keeps the subject
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(forwardedByHeader, "burnell")
+		req.Header.Del(injectedSubs)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		// serve locally if the replica is unreachable
+		log.Errorf("forward to replica %s error %v", address, err)
+		next.ServeHTTP(w, r)
+	}
+	proxy.ServeHTTP(w, r)
+}
 
+// RequireReady responds 503 to the requests other than the liveness and readiness probes until the replica is ready,
+// so the routes are not served before the stores and the background loops are started
+func RequireReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !util.IsReady() && r.URL.Path != "/liveness" && r.URL.Path != "/readiness" {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "the replica is starting", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
-// SuperRoleRequired ensures token has the super user subject
-func SuperRoleRequired(next http.Handler) http.Handler {
+// LimitRequestBody rejects or truncates a request body over the maximum size of the route and the tenant plan
+func LimitRequestBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !util.IsPulsarJWTEnabled() {
-			r.Header.Set(injectedSubs, util.DummySuperRole)
-			next.ServeHTTP(w, r)
+		limit := maxBodyBytes(r)
+		if r.ContentLength > limit {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
 			return
 		}
-		tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
-		subject, err := util.JWTAuth.GetTokenSubject(tokenStr)
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
 
-		if err == nil && util.StrContains(util.SuperRoles, subject) {
-			log.Infof("superroles Authenticated")
-			next.ServeHTTP(w, r)
-		} else {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// maxBodyBytes is the route limit of the longest matching path prefix or the default limit,
+// capped by the limit of the tenant's plan type
+func maxBodyBytes(r *http.Request) int64 {
+	limits := util.GetConfig().RequestLimits
+	limit := limits.MaxBodyBytes
+	if limit <= 0 {
+		limit = util.DefaultMaxBodyBytes
+	}
+	routeLimits := limits.RouteMaxBodyBytes
+	if routeLimits == nil {
+		routeLimits = util.DefaultRouteMaxBodyBytes
+	}
+	matched := ""
+	for prefix, v := range routeLimits {
+		if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > len(matched) {
+			matched, limit = prefix, v
 		}
-
-	})
+	}
+	if tenant, ok := mux.Vars(r)["tenant"]; ok && len(limits.TierMaxBodyBytes) > 0 {
+		endPolicy := util.StartPhase(r.Context(), util.PhasePolicy)
+		plan, err := policy.TenantManager.GetTenant(tenant)
+		endPolicy()
+		if err == nil {
+			if tierLimit, ok := limits.TierMaxBodyBytes[plan.PlanType]; ok && tierLimit < limit {
+				limit = tierLimit
+			}
+		}
+	}
+	return limit
 }
 
 // AuthHeaderRequired is a very weak auth to verify token existence only.
@@ -128,6 +256,8 @@ func AuthHeaderRequired(next http.Handler) http.Handler {
 // NoAuth bypasses the auth middleware
 func NoAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the subject header is only set by the authentication middlewares
+		r.Header.Del(injectedSubs)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -146,6 +276,170 @@ func LimitRate(next http.Handler) http.Handler {
 	})
 }
 
+// tenantLimiterIdle is how long a tenant limiter is kept without a request
+const tenantLimiterIdle = 10 * time.Minute
+
+// tenantLimiter is the rate limiter of a tenant with the settings it is created with
+type tenantLimiter struct {
+	limiter  *rate.Limiter
+	rps      float64
+	burst    int
+	lastUsed time.Time
+}
+
+var (
+	tenantLimiters      = make(map[string]*tenantLimiter)
+	tenantLimitersLock  sync.Mutex
+	tenantLimitersSwept time.Time
+)
+
+// allowTenantRequest evaluates the rate limit of a tenant, the limiter is re-created once the tenant settings change
+// and dropped once it is idle
+func allowTenantRequest(tenant string) bool {
+	settings := util.TenantSettingsOf(tenant)
+	if settings.RequestsPerSecond <= 0 {
+		return true
+	}
+	burst := settings.RequestBurst
+	if burst <= 0 {
+		burst = int(math.Ceil(settings.RequestsPerSecond))
+	}
+	now := time.Now()
+	tenantLimitersLock.Lock()
+	if now.Sub(tenantLimitersSwept) >= tenantLimiterIdle {
+		for key, l := range tenantLimiters {
+			if now.Sub(l.lastUsed) >= tenantLimiterIdle {
+				delete(tenantLimiters, key)
+			}
+		}
+		tenantLimitersSwept = now
+	}
+	l, ok := tenantLimiters[tenant]
+	if !ok || l.rps != settings.RequestsPerSecond || l.burst != burst {
+		l = &tenantLimiter{limiter: rate.NewLimiter(rate.Limit(settings.RequestsPerSecond), burst), rps: settings.RequestsPerSecond, burst: burst}
+		tenantLimiters[tenant] = l
+	}
+	l.lastUsed = now
+	tenantLimitersLock.Unlock()
+	return l.limiter.Allow()
+}
+
+// subjectTenant returns the tenant of the authenticated subjects whose rate limit applies,
+// it is empty for a super role
+func subjectTenant(subjects string) string {
+	for _, subject := range strings.Split(subjects, ",") {
+		subject = strings.TrimSpace(subject)
+		if subject == "" || util.StrContains(util.SuperRoles, subject) {
+			continue
+		}
+		_, tenant := ExtractTenant(subject)
+		return tenant
+	}
+	return ""
+}
+
+// limitTenantRate rejects an authenticated request over the rate limit of the tenant of its subject
+func limitTenantRate(w http.ResponseWriter, subjects string) bool {
+	tenant := subjectTenant(subjects)
+	if tenant == "" || allowTenantRequest(tenant) {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	util.ResponseErrorJSON(fmt.Errorf("tenant %s is over the rate limit", tenant), w, http.StatusTooManyRequests)
+	return true
+}
+
+// connectorConfigParts are the multipart form parts of the source and sink configs
+var connectorConfigParts = []string{"sourceConfig", "sinkConfig"}
+
+// InjectConnectorSecrets replaces the ${secret:name} references in the source and sink configs
+// with the tenant secrets before the connector is created or updated, and redacts the secret values
+// in the responses of the GET requests.
+func InjectConnectorSecrets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := mux.Vars(r)["tenant"]
+		if r.Method == http.MethodGet {
+			redactConnectorSecrets(next, tenant, w, r)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			util.ResponseErrorJSON(errors.New("failed to read connector body"), w, http.StatusBadRequest)
+			return
+		}
+
+		lookup := func(name string) (string, bool) {
+			if policy.SecretStore == nil {
+				return "", false
+			}
+			return policy.SecretStore.GetSecret(tenant, name)
+		}
+		body, contentType, err := util.ResolveMultipartSecretRefs(body, r.Header.Get("Content-Type"), connectorConfigParts, lookup)
+		if err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("tenant %s connector config error %v", tenant, err), w, http.StatusUnprocessableEntity)
+			return
+		}
+		r.Header.Set("Content-Type", contentType)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactConnectorSecrets buffers the response to replace the injected secret values with their references
+func redactConnectorSecrets(next http.Handler, tenant string, w http.ResponseWriter, r *http.Request) {
+	if policy.SecretStore == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	secrets := policy.SecretStore.TenantSecrets(tenant)
+	if len(secrets) == 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+	// a compressed upstream response cannot be redacted
+	r.Header.Del("Accept-Encoding")
+	buffered := &bufferedResponse{header: w.Header()}
+	next.ServeHTTP(buffered, r)
+	body := util.RedactSecretValues(buffered.body.Bytes(), secrets)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(buffered.statusCode())
+	w.Write(body)
+}
+
+// bufferedResponse holds a response until it is complete
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
 // ResponseJSONContentType sets JSON as the response content type
 func ResponseJSONContentType(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,87 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Schema versions of the persistent stores and the on-demand migration of the policy stores
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+// MigrationResponse is the outcome of a migration of the policy stores
+type MigrationResponse struct {
+	From   int                  `json:"from"`
+	To     int                  `json:"to"`
+	Report policy.RestoreReport `json:"report"`
+}
+
+// SchemaMigrationsHandler returns the schema versions of the stores, or migrates the policy stores on POST to the
+// version query parameter, default to the version of the release. A lower version reverts the migrations.
+func SchemaMigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	var body interface{} = policy.GetSchemaStatus()
+	if r.Method == http.MethodPost {
+		target := util.LatestSchemaVersion(util.PolicySchema)
+		if v := r.URL.Query().Get("version"); v != "" {
+			var err error
+			if target, err = strconv.Atoi(v); err != nil {
+				util.ResponseErrorJSON(errors.New("version must be an integer"), w, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		if target < util.BaselineSchemaVersion || target > util.LatestSchemaVersion(util.PolicySchema) {
+			util.ResponseErrorJSON(fmt.Errorf("version must be between %d and %d", util.BaselineSchemaVersion,
+				util.LatestSchemaVersion(util.PolicySchema)), w, http.StatusUnprocessableEntity)
+			return
+		}
+		event := audit.Event{
+			Subject:    r.Header.Get(injectedSubs),
+			Action:     "policy.migrate",
+			Resource:   fmt.Sprintf("schema version %d", target),
+			RemoteAddr: r.RemoteAddr,
+			Outcome:    audit.Succeeded,
+		}
+		from, report, err := policy.MigratePolicyStores(target)
+		if err != nil {
+			event.Outcome, event.Reason = audit.Failed, err.Error()
+		}
+		audit.Record(event)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		body = MigrationResponse{From: from, To: target, Report: report}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
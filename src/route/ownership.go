@@ -0,0 +1,151 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Cached topic ownership and namespace bundle lookups. The lookups of a namespace are invalidated by the unload and
+// the split of its bundles and topics through this proxy, and they are shared across the replicas by the shared cache
+// if it is enabled.
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultOwnershipCacheTTL = 60 * time.Second
+	maxOwnershipLookups      = 10000
+)
+
+type ownershipLookup struct {
+	body      []byte
+	expiresAt time.Time
+}
+
+var (
+	ownershipLock = sync.RWMutex{}
+	// the lookups by the generation of the namespace and the request path
+	ownershipLookups = make(map[string]ownershipLookup)
+	// the local generations of the namespaces, the shared cache has the generations across the replicas
+	ownershipGenerations = make(map[string]string)
+)
+
+func ownershipCacheTTL() time.Duration {
+	if seconds := util.GetConfig().OwnershipCacheSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultOwnershipCacheTTL
+}
+
+// ownershipGeneration is the generation of the lookups of a namespace, an invalidation starts a new generation
+func ownershipGeneration(namespace string) string {
+	if data, ok := util.SharedCacheGet("ownership-gen:" + namespace); ok {
+		return string(data)
+	}
+	ownershipLock.RLock()
+	defer ownershipLock.RUnlock()
+	return ownershipGenerations[namespace]
+}
+
+// InvalidateOwnership drops the cached lookups of a namespace
+func InvalidateOwnership(namespace string) {
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ownershipLock.Lock()
+	ownershipGenerations[namespace] = generation
+	ownershipLock.Unlock()
+	util.SharedCacheSet("ownership-gen:"+namespace, []byte(generation), 24*time.Hour)
+}
+
+// OwnershipLookupHandler proxies the topic lookup, the topic bundle lookup, and the namespace bundles of the admin
+// REST API with a cache, so that the repeated lookups during an incident triage do not load the brokers
+func OwnershipLookupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["tenant"] + "/" + vars["namespace"]
+	key := ownershipGeneration(namespace) + "@" + r.URL.Path
+	now := time.Now()
+
+	ownershipLock.RLock()
+	cached, ok := ownershipLookups[key]
+	ownershipLock.RUnlock()
+	if !ok || !now.Before(cached.expiresAt) {
+		if data, found := util.SharedCacheGet("ownership:" + key); found {
+			cached, ok = ownershipLookup{body: data, expiresAt: now.Add(ownershipCacheTTL())}, true
+			cacheOwnershipLookup(key, cached)
+		} else {
+			ok = false
+		}
+	}
+	if ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Burnell-Cache", "hit")
+		w.Write(cached.body)
+		return
+	}
+
+	status, _, body, err := getAdmin(util.SingleJoinSlash(util.AdminURL(vars["tenant"]), r.URL.Path))
+	if err != nil {
+		requestLog(r).Errorf("ownership lookup %s error %v", r.URL.Path, err)
+		util.ResponseErrorJSON(err, w, upstreamStatus(status))
+		return
+	}
+	ttl := ownershipCacheTTL()
+	cacheOwnershipLookup(key, ownershipLookup{body: body, expiresAt: now.Add(ttl)})
+	util.SharedCacheSet("ownership:"+key, body, ttl)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Burnell-Cache", "miss")
+	w.Write(body)
+}
+
+// cacheOwnershipLookup adds a lookup to the local cache, the expired lookups are evicted when the cache is full
+func cacheOwnershipLookup(key string, lookup ownershipLookup) {
+	ownershipLock.Lock()
+	defer ownershipLock.Unlock()
+	if len(ownershipLookups) >= maxOwnershipLookups {
+		now := time.Now()
+		for k, v := range ownershipLookups {
+			if !now.Before(v.expiresAt) {
+				delete(ownershipLookups, k)
+			}
+		}
+		if len(ownershipLookups) >= maxOwnershipLookups {
+			ownershipLookups = make(map[string]ownershipLookup)
+		}
+	}
+	ownershipLookups[key] = lookup
+}
+
+// InvalidateOwnershipOnSuccess invalidates the cached lookups of the namespace in the route
+// after a successful unload or split
+func InvalidateOwnershipOnSuccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status < 300 {
+			vars := mux.Vars(r)
+			InvalidateOwnership(vars["tenant"] + "/" + vars["namespace"])
+		}
+	})
+}
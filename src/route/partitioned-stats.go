@@ -0,0 +1,151 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// partitionStatsConcurrency is the number of the partition stats requested at the same time
+const partitionStatsConcurrency = 8
+
+// upstreamStatus is the response status of a failed admin REST API call, a call without a response is a bad gateway
+func upstreamStatus(status int) int {
+	if status == 0 {
+		return http.StatusBadGateway
+	}
+	return status
+}
+
+// mergeTopicStats adds the stats of a partition to the aggregated stats. The numbers are summed, the lists are
+// appended, the objects such as the subscriptions are merged by the key, and the first value of the others is kept.
+func mergeTopicStats(dst, src map[string]interface{}) {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				merged := make(map[string]interface{})
+				mergeTopicStats(merged, v)
+				dst[key] = merged
+			case []interface{}:
+				dst[key] = append([]interface{}{}, v...)
+			default:
+				dst[key] = value
+			}
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			if n, ok := existing.(float64); ok {
+				dst[key] = n + v
+			}
+		case []interface{}:
+			if list, ok := existing.([]interface{}); ok {
+				dst[key] = append(list, v...)
+			}
+		case map[string]interface{}:
+			if m, ok := existing.(map[string]interface{}); ok {
+				mergeTopicStats(m, v)
+			}
+		}
+	}
+}
+
+// PartitionedTopicStatsHandler aggregates the stats of all the partitions of a partitioned topic on behalf of a
+// tenant, the same as the partitioned stats of the admin REST API. The perPartition query parameter, default to
+// true, adds the stats of every partition.
+func PartitionedTopicStatsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace, topic := vars["tenant"], vars["namespace"], vars["topic"]
+	domain := "persistent"
+	if strings.HasPrefix(r.URL.Path, "/admin/v2/non-persistent/") {
+		domain = "non-persistent"
+	}
+	adminURL := util.AdminURL(tenant)
+	topicPath := fmt.Sprintf("admin/v2/%s/%s/%s/%s", domain, tenant, namespace, topic)
+
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	if status, err := getAdminJSON(util.SingleJoinSlash(adminURL, topicPath+"/partitions"), &metadata); err != nil {
+		util.ResponseErrorJSON(err, w, upstreamStatus(status))
+		return
+	}
+	if metadata.Partitions == 0 {
+		util.ResponseErrorJSON(fmt.Errorf("%s is not a partitioned topic", topic), w, http.StatusNotFound)
+		return
+	}
+
+	partitions := make([]map[string]interface{}, metadata.Partitions)
+	errs := make([]error, metadata.Partitions)
+	statuses := make([]int, metadata.Partitions)
+	semaphore := make(chan struct{}, partitionStatsConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < metadata.Partitions; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			partitionPath := fmt.Sprintf("%s-partition-%d/stats", topicPath, i)
+			statuses[i], errs[i] = getAdminJSON(util.SingleJoinSlash(adminURL, partitionPath), &partitions[i])
+		}(i)
+	}
+	wg.Wait()
+
+	aggregated := make(map[string]interface{})
+	perPartition := make(map[string]interface{})
+	for i, stats := range partitions {
+		if errs[i] != nil {
+			requestLog(r).Errorf("failed to get the stats of partition %d of topic %s error %v", i, topicPath, errs[i])
+			util.ResponseErrorJSON(errs[i], w, upstreamStatus(statuses[i]))
+			return
+		}
+		mergeTopicStats(aggregated, stats)
+		perPartition[fmt.Sprintf("%s://%s/%s/%s-partition-%d", domain, tenant, namespace, topic, i)] = stats
+	}
+	if size, ok := aggregated["averageMsgSize"].(float64); ok {
+		aggregated["averageMsgSize"] = size / float64(metadata.Partitions)
+	}
+	aggregated["metadata"] = metadata
+	if r.URL.Query().Get("perPartition") != "false" {
+		aggregated["partitions"] = perPartition
+	}
+
+	data, err := json.Marshal(aggregated)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
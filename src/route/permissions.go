@@ -0,0 +1,351 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Declarative permissions of the routes. A route declares the permission it requires at the registration,
+// a single middleware enforces it, and the declarations are listed in a permissions matrix for auditors.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/util"
+)
+
+// the scopes of the route permissions
+const (
+	// ScopePublic routes are served without authentication
+	ScopePublic = "public"
+	// ScopeAuthenticated routes require a verified subject, the handler filters the response by the subject
+	ScopeAuthenticated = "authenticated"
+	// ScopeTenant routes are authorized on the tenants extracted by the tenant strategy
+	ScopeTenant = "tenant"
+	// ScopeSuperuser routes are cluster resources
+	ScopeSuperuser = "superuser"
+)
+
+// TenantStrategy extracts the tenants of a request to authorize a tenant scoped permission
+type TenantStrategy string
+
+const (
+	// TenantNone is the strategy of the permissions without a tenant
+	TenantNone TenantStrategy = "none"
+	// TenantFromPath is the {tenant} variable of the route path
+	TenantFromPath TenantStrategy = "path"
+	// TenantFromSubject is the tenants owned by the authenticated subjects
+	TenantFromSubject TenantStrategy = "subject"
+)
+
+// RoutePermission is the permission declared by a route. The action is derived from the request method
+// when it is empty, and the resource is derived from the route path template when it is empty.
+type RoutePermission struct {
+	Scope    string
+	Action   string
+	Resource string
+	Tenant   TenantStrategy
+}
+
+// ParseRoutePermission parses a declaration in the format of scope:action-resource, such as tenant:read-metrics
+// and superuser:write-policy. The action is optional, tenant:pulsar-admin is read for GET and HEAD and write
+// for the other methods.
+func ParseRoutePermission(declaration string, tenant TenantStrategy) (RoutePermission, error) {
+	parts := strings.SplitN(declaration, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return RoutePermission{}, fmt.Errorf("permission %s must be in the format of scope:action-resource", declaration)
+	}
+	p := RoutePermission{Scope: parts[0], Resource: parts[1], Tenant: tenant}
+	if action := strings.SplitN(parts[1], "-", 2); len(action) == 2 &&
+		(action[0] == rbac.ActionRead || action[0] == rbac.ActionWrite) {
+		p.Action, p.Resource = action[0], action[1]
+	}
+	switch p.Scope {
+	case ScopeTenant:
+		if tenant != TenantFromPath && tenant != TenantFromSubject {
+			return RoutePermission{}, fmt.Errorf("permission %s requires the path or subject tenant strategy", declaration)
+		}
+	case ScopePublic, ScopeAuthenticated, ScopeSuperuser:
+		if tenant != TenantNone {
+			return RoutePermission{}, fmt.Errorf("permission %s does not take a tenant strategy", declaration)
+		}
+	default:
+		return RoutePermission{}, fmt.Errorf("unknown scope %s, it must be public, authenticated, tenant, or superuser", p.Scope)
+	}
+	return p, nil
+}
+
+// MustParseRoutePermission parses a declaration made at the start up, it panics on a malformed declaration
+func MustParseRoutePermission(declaration string, tenant TenantStrategy) RoutePermission {
+	p, err := ParseRoutePermission(declaration, tenant)
+	if err != nil {
+		panic(fmt.Sprintf("route permission %v", err))
+	}
+	return p
+}
+
+// String is the declaration of the permission
+func (p RoutePermission) String() string {
+	if p.Action == "" {
+		return p.Scope + ":" + p.Resource
+	}
+	return p.Scope + ":" + p.Action + "-" + p.Resource
+}
+
+// PermissionHandler is the middleware that authenticates a request and authorizes the declared permission
+type PermissionHandler struct {
+	Permission RoutePermission
+	next       http.Handler
+}
+
+// Require declares the permission of a route and the strategy to extract the tenant of a tenant scoped permission.
+// It panics on a malformed declaration since the routes are declared at the start up.
+func Require(permission string, tenant TenantStrategy, next http.Handler) *PermissionHandler {
+	return &PermissionHandler{Permission: MustParseRoutePermission(permission, tenant), next: next}
+}
+
+func (h *PermissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := h.Permission
+	if p.Scope == ScopePublic {
+		// the subject header is only set by the authentication
+		r.Header.Del(injectedSubs)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if !util.IsPulsarJWTEnabled() {
+		r.Header.Set(injectedSubs, util.DummySuperRole)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	subjects, scope, err := h.subjectAndScope(r)
+	if respondAuthBanned(w, err) || respondVerificationOverloaded(w, err) {
+		return
+	}
+	if err != nil {
+		if h.acceptsBasicAuth(r) {
+			w.Header().Set("WWW-Authenticate", basicAuthChallenge)
+		}
+		http.Error(w, "failed to obtain subject", http.StatusUnauthorized)
+		return
+	}
+	if target := r.Header.Get(ImpersonateHeader); target != "" {
+		impersonator := subjects
+		if subjects, err = impersonate(r, subjects, scope, target); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r.Header.Del(ImpersonateHeader)
+		w.Header().Set(ImpersonatedByHeader, impersonator)
+	}
+	switch {
+	case p.Scope == ScopeTenant && !authorizeScope(r, scope):
+		http.Error(w, "delegated token is not scoped to this resource", http.StatusForbidden)
+		return
+	// a delegated token never carries the super role privilege
+	case p.Scope == ScopeSuperuser && scope != nil, p.Scope == ScopeAuthenticated && !authorizeScope(r, scope):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	requestLog(r).Infof("Authenticated with subjects %s for the %s scope", subjects, p.Scope)
+	r.Header.Set(injectedSubs, subjects)
+
+	if p.Scope != ScopeAuthenticated && !h.authorized(r, subjects) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if limitTenantRate(w, subjects) {
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// authorized decides the permission on any of the tenants of the strategy, a superuser permission is on the cluster
+func (h *PermissionHandler) authorized(r *http.Request, subjects string) bool {
+	tenants := []string{""}
+	switch h.Permission.Tenant {
+	case TenantFromPath:
+		tenant := mux.Vars(r)["tenant"]
+		if tenant == "" {
+			requestLog(r).Errorf("route %s declares the path tenant strategy without a tenant", r.URL.Path)
+			return false
+		}
+		tenants = []string{tenant}
+	case TenantFromSubject:
+		tenants = []string{}
+		for _, subject := range strings.Split(subjects, ",") {
+			for _, tenant := range rbac.SubjectTenants(strings.TrimSpace(subject)) {
+				if !util.StrContains(tenants, tenant) {
+					tenants = append(tenants, tenant)
+				}
+			}
+		}
+	}
+	for _, tenant := range tenants {
+		if authorize(r, subjects, tenant, h.Permission.Resource, h.Permission.Action).Allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizeTenant decides a tenant scoped permission outside of a route, such as a command of the binary protocol
+// proxy, the same as a route declaring it. A delegation scope must cover the namespace and the action, and
+// the RBAC engine must grant the permission on the tenant and the namespace.
+func AuthorizeTenant(ctx context.Context, p RoutePermission, subjects string, scope *icrypto.DelegationScope, tenant, namespace string) rbac.Decision {
+	if p.Scope != ScopeTenant || tenant == "" || namespace == "" {
+		return rbac.Decision{Reason: fmt.Sprintf("%s requires a tenant and a namespace", p)}
+	}
+	action := util.AssignString(p.Action, rbac.ActionRead)
+	if scope != nil {
+		permission := icrypto.PermissionRead
+		if action == rbac.ActionWrite {
+			permission = icrypto.PermissionWrite
+		}
+		if !scope.AllowsNamespace(tenant+"/"+namespace) || !scope.AllowsPermission(permission) {
+			return rbac.Decision{Reason: fmt.Sprintf("delegated token is not scoped to %s/%s", tenant, namespace)}
+		}
+	}
+	req := rbac.Request{Subjects: strings.Split(subjects, ","), Tenant: tenant, Namespace: namespace,
+		Resource: p.Resource, Action: action}
+	decision := rbac.Authorize(ctx, req)
+	if !decision.Allowed {
+		logger.Warnf("subjects %s are denied %s, %s", subjects, req.Permission(), decision.Reason)
+	}
+	return decision
+}
+
+// Unwrap returns the handler that the permission is enforced for
+func (h *PermissionHandler) Unwrap() http.Handler {
+	return h.next
+}
+
+// PermissionEntry is a row of the permissions matrix, the permission required by a method of a route
+type PermissionEntry struct {
+	Name       string   `json:"name,omitempty"`
+	Path       string   `json:"path"`
+	Prefix     bool     `json:"prefix,omitempty"`
+	Method     string   `json:"method"`
+	Scope      string   `json:"scope"`
+	Permission string   `json:"permission,omitempty"`
+	Tenant     string   `json:"tenant,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+}
+
+// ScopeUndeclared is the scope of a route that authenticates the requests in its handler
+const ScopeUndeclared = "undeclared"
+
+// PermissionMatrix lists the permissions of the routes in the registration order, which is the matching order.
+// The roles granting a permission are listed for the built-in RBAC engine.
+func PermissionMatrix(router *mux.Router) []PermissionEntry {
+	entries := []PermissionEntry{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		regexp, _ := route.GetPathRegexp()
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"*"}
+		}
+		handler := routePermission(route.GetHandler())
+		for _, method := range methods {
+			entry := PermissionEntry{
+				Name:   route.GetName(),
+				Path:   tpl,
+				Prefix: !strings.HasSuffix(regexp, "$"),
+				Method: method,
+				Scope:  ScopeUndeclared,
+			}
+			if handler != nil {
+				p := handler.Permission
+				entry.Scope = p.Scope
+				if p.Resource == "" {
+					p.Resource = templateResource(tpl)
+				}
+				if p.Action == "" {
+					p.Action = methodAction(method)
+				}
+				entry.Permission = p.Resource + ":" + p.Action
+				if p.Tenant != TenantNone {
+					entry.Tenant = string(p.Tenant)
+				}
+				if p.Scope == ScopeTenant || p.Scope == ScopeSuperuser {
+					entry.Roles = rbac.RolesGranting(p.Resource, p.Action)
+				}
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries
+}
+
+// routePermission finds the permission middleware of a route handler through the wrapping handlers
+func routePermission(h http.Handler) *PermissionHandler {
+	for h != nil {
+		switch handler := h.(type) {
+		case *PermissionHandler:
+			return handler
+		case interface{ Unwrap() http.Handler }:
+			h = handler.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// permissionRouter is the router of the permissions matrix
+var permissionRouter *mux.Router
+
+// PermissionMatrixHandler responds the permissions matrix of the routes, filtered by the optional scope and
+// resource query parameters
+func PermissionMatrixHandler(w http.ResponseWriter, r *http.Request) {
+	if permissionRouter == nil {
+		util.ResponseErrorJSON(fmt.Errorf("the routes are not set up"), w, http.StatusServiceUnavailable)
+		return
+	}
+	scope, resource := r.URL.Query().Get("scope"), r.URL.Query().Get("resource")
+	entries := []PermissionEntry{}
+	for _, entry := range PermissionMatrix(permissionRouter) {
+		if scope != "" && entry.Scope != scope {
+			continue
+		}
+		if resource != "" && !strings.HasPrefix(entry.Permission, resource+":") {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,129 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// REST produce endpoint of the tenant topics
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// produceMaxPayloadBytes is the default maximum message size of Pulsar
+const produceMaxPayloadBytes = 5 * 1024 * 1024
+
+// ProduceRequest is a message to publish, the payload is base64 encoded
+type ProduceRequest struct {
+	Payload    string            `json:"payload"`
+	Key        string            `json:"key,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	EventTime  *time.Time        `json:"eventTime,omitempty"`
+}
+
+// ProduceResponse is the published message, the message id is only returned by a synchronous produce
+type ProduceResponse struct {
+	Topic     string `json:"topic"`
+	MessageID string `json:"messageId,omitempty"`
+}
+
+// ProduceHandler publishes a message to a tenant topic with the burnell credentials. The produce waits for the
+// broker acknowledgement unless the sync query parameter is false.
+func ProduceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, namespace, topic := vars["tenant"], vars["namespace"], vars["topic"]
+	topicFn := fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, topic)
+	event := audit.Event{Subject: r.Header.Get(injectedSubs), Tenant: tenant, Action: "topic.produce", Resource: topicFn,
+		RemoteAddr: r.RemoteAddr}
+	fail := func(err error, status int) {
+		event.Outcome, event.Reason = audit.Failed, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, status)
+	}
+
+	if strings.HasPrefix(topic, "__") {
+		fail(fmt.Errorf("topic %s is a system topic", topic), http.StatusUnprocessableEntity)
+		return
+	}
+	waitAck := r.URL.Query().Get("sync") != "false"
+	var req ProduceRequest
+	// the base64 payload is a third larger than the message
+	body := http.MaxBytesReader(w, r.Body, produceMaxPayloadBytes*4/3+64*1024)
+	if err := json.NewDecoder(body).Decode(&req); err != nil && err != io.EOF {
+		fail(fmt.Errorf("invalid produce request %v", err), http.StatusBadRequest)
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(req.Payload)
+	if err != nil || len(payload) == 0 {
+		fail(errors.New("payload must be non-empty base64 encoded data"), http.StatusBadRequest)
+		return
+	}
+	if len(payload) > produceMaxPayloadBytes {
+		fail(fmt.Errorf("payload is over %d bytes", produceMaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	for name := range req.Properties {
+		if name == "" {
+			fail(errors.New("property name must not be empty"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	msg := policy.ProduceMessage{Payload: payload, Key: req.Key, Properties: req.Properties}
+	if req.EventTime != nil {
+		msg.EventTime = *req.EventTime
+	}
+	id, err := policy.Produce(r.Context(), topicFn, msg, waitAck)
+	switch {
+	case err == policy.ErrPolicyTopic:
+		fail(err, http.StatusForbidden)
+		return
+	case err == policy.ErrNoPulsarClient:
+		fail(err, http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		requestLog(r).Errorf("failed to produce to %s error %v", topicFn, err)
+		fail(errors.New("failed to produce the message"), http.StatusBadGateway)
+		return
+	}
+	event.Outcome, event.Reason = audit.Succeeded, id
+	audit.Record(event)
+
+	data, _ := json.Marshal(ProduceResponse{Topic: topicFn, MessageID: id})
+	w.Header().Set("Content-Type", "application/json")
+	if waitAck {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	w.Write(data)
+}
@@ -0,0 +1,259 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Provisioning API of tenants, namespaces, and tokens with stable IDs and the ETag concurrency control
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/workflow"
+	"github.com/gorilla/mux"
+)
+
+const maxProvisioningBytes = 1 << 20
+
+// provisioningLock serializes the writes between reading the current resource and applying the desired one,
+// the routes are served by the leader
+var provisioningLock sync.Mutex
+
+// resourceETag is the strong ETag of the JSON representation. The key of a created token is left out since
+// it is only returned once.
+func resourceETag(v interface{}) string {
+	if token, ok := v.(*workflow.ProvisionedToken); ok {
+		c := *token
+		c.Key = ""
+		v = c
+	}
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func etagMatches(list, etag string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditionFailed evaluates If-Match and If-None-Match against the ETag of the current resource, an empty
+// ETag is a missing resource
+func preconditionFailed(r *http.Request, etag string) bool {
+	if match := r.Header.Get("If-Match"); match != "" && (etag == "" || !etagMatches(match, etag)) {
+		return true
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && etag != "" && etagMatches(match, etag) {
+		return true
+	}
+	return false
+}
+
+func provisioningError(w http.ResponseWriter, err error) {
+	var pe *workflow.ProvisionError
+	if errors.As(err, &pe) {
+		util.ResponseErrorJSON(err, w, pe.StatusCode)
+		return
+	}
+	util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+}
+
+// serveProvisioned serves GET, PUT, and DELETE of a resource. GET of a missing resource is not found, and DELETE
+// of a missing resource succeeds so that a retry is idempotent. get returns nil when the resource is missing.
+func serveProvisioned(w http.ResponseWriter, r *http.Request, resource string,
+	get func() (interface{}, error), put func(body []byte) (interface{}, bool, error), del func() error) {
+	if r.Method != http.MethodGet {
+		provisioningLock.Lock()
+		defer provisioningLock.Unlock()
+	}
+	current, err := get()
+	if err != nil {
+		provisioningError(w, err)
+		return
+	}
+	etag := ""
+	if current != nil {
+		etag = resourceETag(current)
+		w.Header().Set("ETag", etag)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if current == nil {
+			util.ResponseErrorJSON(fmt.Errorf("%s is not found", resource), w, http.StatusNotFound)
+			return
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeProvisioned(w, http.StatusOK, current)
+	case http.MethodPut:
+		if preconditionFailed(r, etag) {
+			util.ResponseErrorJSON(fmt.Errorf("%s does not match the precondition", resource), w, http.StatusPreconditionFailed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxProvisioningBytes))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+			return
+		}
+		updated, created, err := put(body)
+		if err != nil {
+			provisioningError(w, err)
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		w.Header().Set("ETag", resourceETag(updated))
+		writeProvisioned(w, status, updated)
+	case http.MethodDelete:
+		if preconditionFailed(r, etag) {
+			util.ResponseErrorJSON(fmt.Errorf("%s does not match the precondition", resource), w, http.StatusPreconditionFailed)
+			return
+		}
+		if current != nil {
+			if err := del(); err != nil {
+				provisioningError(w, err)
+				return
+			}
+		}
+		w.Header().Del("ETag")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeProvisioned(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// decodeProvisioned decodes the desired resource, the ID is optional but it must match the path
+func decodeProvisioned(body []byte, v interface{}, id func() string, expectedID string) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &workflow.ProvisionError{StatusCode: http.StatusUnprocessableEntity, Err: err}
+	}
+	if actual := id(); actual != "" && actual != expectedID {
+		return &workflow.ProvisionError{StatusCode: http.StatusUnprocessableEntity,
+			Err: fmt.Errorf("id %s does not match the path %s", actual, expectedID)}
+	}
+	return nil
+}
+
+// ProvisionedTenantHandler gets, creates or replaces, and deletes a tenant with its plan and overrides
+func ProvisionedTenantHandler(w http.ResponseWriter, r *http.Request) {
+	name, subject := mux.Vars(r)["tenant"], r.Header.Get(injectedSubs)
+	var current *workflow.ProvisionedTenant
+	serveProvisioned(w, r, "tenant "+name, func() (interface{}, error) {
+		var err error
+		if current, err = workflow.GetProvisionedTenant(name); current == nil {
+			return nil, err
+		}
+		return current, nil
+	}, func(body []byte) (interface{}, bool, error) {
+		var desired workflow.ProvisionedTenant
+		if err := decodeProvisioned(body, &desired, func() string { return desired.ID }, name); err != nil {
+			return nil, false, err
+		}
+		updated, err := workflow.PutProvisionedTenant(name, desired, current, subject)
+		return updated, current == nil, err
+	}, func() error {
+		return workflow.DeleteProvisionedTenant(name, subject)
+	})
+}
+
+// ProvisionedNamespaceHandler gets, creates or replaces, and deletes a namespace with its policies
+func ProvisionedNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	vars, subject := mux.Vars(r), r.Header.Get(injectedSubs)
+	tenant, namespace := vars["tenant"], vars["namespace"]
+	var current *workflow.ProvisionedNamespace
+	serveProvisioned(w, r, "namespace "+tenant+"/"+namespace, func() (interface{}, error) {
+		var err error
+		if current, err = workflow.GetProvisionedNamespace(tenant, namespace); current == nil {
+			return nil, err
+		}
+		return current, nil
+	}, func(body []byte) (interface{}, bool, error) {
+		var desired workflow.ProvisionedNamespace
+		if err := decodeProvisioned(body, &desired, func() string { return desired.ID }, tenant+"/"+namespace); err != nil {
+			return nil, false, err
+		}
+		updated, err := workflow.PutProvisionedNamespace(tenant, namespace, desired, current, subject)
+		return updated, current == nil, err
+	}, func() error {
+		return workflow.DeleteProvisionedNamespace(tenant, namespace, subject)
+	})
+}
+
+// ProvisionedTokenHandler gets, creates, and revokes a named token of a tenant. The key is only returned when
+// the token is created.
+func ProvisionedTokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars, subject := mux.Vars(r), r.Header.Get(injectedSubs)
+	tenant, name := vars["tenant"], vars["name"]
+	var current *workflow.ProvisionedToken
+	serveProvisioned(w, r, "token "+tenant+"/"+name, func() (interface{}, error) {
+		if current = workflow.GetProvisionedToken(tenant, name); current == nil {
+			return nil, nil
+		}
+		return current, nil
+	}, func(body []byte) (interface{}, bool, error) {
+		var desired workflow.ProvisionedToken
+		if err := json.Unmarshal(body, &desired); err != nil {
+			return nil, false, &workflow.ProvisionError{StatusCode: http.StatusUnprocessableEntity, Err: err}
+		}
+		if desired.Name != "" && desired.Name != name {
+			return nil, false, &workflow.ProvisionError{StatusCode: http.StatusUnprocessableEntity,
+				Err: fmt.Errorf("name %s does not match the path %s", desired.Name, name)}
+		}
+		if current != nil && desired.ID != "" && desired.ID != current.ID {
+			return nil, false, &workflow.ProvisionError{StatusCode: http.StatusConflict,
+				Err: fmt.Errorf("token %s has the id %s", name, current.ID)}
+		}
+		if desired.Subject != "" && !VerifySubject(tenant, desired.Subject) {
+			return nil, false, &workflow.ProvisionError{StatusCode: http.StatusUnprocessableEntity,
+				Err: fmt.Errorf("subject %s does not belong to tenant %s", desired.Subject, tenant)}
+		}
+		return workflow.PutProvisionedToken(tenant, name, desired, current, subject)
+	}, func() error {
+		return workflow.DeleteProvisionedToken(tenant, *current, subject)
+	})
+}
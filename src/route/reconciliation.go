@@ -0,0 +1,63 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Report and on-demand run of the manifest reconciliation
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/workflow"
+)
+
+// ReconciliationHandler returns the last reconciliation report, or runs a reconciliation on POST.
+// The dryRun query parameter of a POST defaults to the configured dry run.
+func ReconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	report := workflow.LastReconcileReport()
+	if r.Method == http.MethodPost {
+		if util.GetConfig().BootstrapManifest == "" && util.GetConfig().GitOps.Repository == "" {
+			util.ResponseErrorJSON(errors.New("no bootstrap manifest or gitops repository is configured"), w, http.StatusNotImplemented)
+			return
+		}
+		dryRun := util.GetConfig().Reconciliation.DryRun
+		if v := r.URL.Query().Get("dryRun"); v != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				util.ResponseErrorJSON(errors.New("dryRun must be a boolean"), w, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		log.Infof("subject %s requested a reconciliation dry run %v", r.Header.Get(injectedSubs), dryRun)
+		report = workflow.RunReconciliation(dryRun)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
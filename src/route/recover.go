@@ -0,0 +1,78 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// errorTags are the context of a reported error
+func errorTags(r *http.Request, status int) map[string]string {
+	name := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			name = tpl
+		}
+	}
+	return map[string]string{
+		"route":      name,
+		"method":     r.Method,
+		"status":     fmt.Sprintf("%d", status),
+		"subject":    r.Header.Get(injectedSubs),
+		"request_id": r.Header.Get(requestIDHeader),
+		"upstream":   util.RequestUpstream(r.Context()),
+	}
+}
+
+// Recover middleware recovers the handler panics, and reports the panics and the 5xx responses
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the timings record the upstream host of the report
+		ctx, _ := util.WithRequestTimings(r.Context())
+		r = r.WithContext(ctx)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				if recorder.status >= http.StatusInternalServerError {
+					util.ReportServerError(fmt.Errorf("%d response to %s %s", recorder.status, r.Method, r.URL.Path), errorTags(r, recorder.status))
+				}
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// an intentional abort of the response
+				panic(recovered)
+			}
+			requestLog(r).WithField("stack", string(debug.Stack())).Errorf("panic %v", recovered)
+			util.ReportPanic(r.Context(), recovered, errorTags(r, http.StatusInternalServerError))
+			if recorder.bytes == 0 {
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
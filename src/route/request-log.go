@@ -0,0 +1,65 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the request id to the upstream and back to the client
+const requestIDHeader = "X-Request-Id"
+
+// RequestID middleware assigns a request id to a request without one
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = util.NewRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestLog returns a log entry with the request id, the authenticated subject, the route name, and the trace id of a request
+func requestLog(r *http.Request) *log.Entry {
+	fields := log.Fields{
+		"request_id": r.Header.Get(requestIDHeader),
+		"method":     r.Method,
+	}
+	if subject := r.Header.Get(injectedSubs); subject != "" {
+		fields["subject"] = subject
+	}
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		fields["route"] = route.GetName()
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+	return logger.WithFields(fields)
+}
@@ -35,9 +35,11 @@ func HealerRouter() *mux.Router {
 	log.Warnf("set up healer routes")
 
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(RequestID)
 
-	router.Path("/liveness").Methods(http.MethodGet).Name("liveness").Handler(NoAuth(Logger(http.HandlerFunc(StatusPage), "liveness")))
-	router.Path("/metrics").Methods(http.MethodGet).Name("metrics").Handler(NoAuth(promhttp.Handler()))
+	router.Path("/liveness").Methods(http.MethodGet).Name("liveness").Handler(Require("public:read-health", TenantNone, Logger(http.HandlerFunc(StatusPage), "liveness")))
+	router.Path("/readiness").Methods(http.MethodGet).Name("readiness").Handler(Require("public:read-health", TenantNone, http.HandlerFunc(ReadinessHandler)))
+	router.Path("/metrics").Methods(http.MethodGet).Name("metrics").Handler(Require("public:read-metrics", TenantNone, promhttp.Handler()))
 	return router
 }
 
@@ -46,66 +48,191 @@ func NewRouter() *mux.Router {
 	log.Warnf("set up proxy routes")
 
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(RequestID)
+	router.Use(Recover)
+	router.Use(AccessLog)
+	router.Use(Tracing)
+	router.Use(SlowRequest)
+	router.Use(LimitRequestBody)
+	router.Use(Capture)
+	router.Use(CSRFProtect)
 
 	// Order of routes definition matters
-
-	router.Path("/liveness").Methods(http.MethodGet).Name("liveness").Handler(NoAuth(Logger(http.HandlerFunc(StatusPage), "liveness")))
-	router.Path("/subject/{sub}").Methods(http.MethodGet).Name("token server").Handler(SuperRoleRequired(Logger(http.HandlerFunc(TokenSubjectHandler), "token server")))
+	// Every route declares its permission in the format of scope:action-resource and the tenant strategy,
+	// the action is derived from the method when it is omitted
+
+	router.Path("/liveness").Methods(http.MethodGet).Name("liveness").Handler(Require("public:read-health", TenantNone, Logger(http.HandlerFunc(StatusPage), "liveness")))
+	router.Path("/readiness").Methods(http.MethodGet).Name("readiness").Handler(Require("public:read-health", TenantNone, http.HandlerFunc(ReadinessHandler)))
+	router.Path("/subject/{sub}").Methods(http.MethodGet).Name("token server").Handler(Require("superuser:read-tokens", TenantNone, Logger(http.HandlerFunc(TokenSubjectHandler), "token server")))
+	router.Path("/delegate").Methods(http.MethodPost).Name("token delegation").Handler(AuthHeaderRequired(Logger(http.HandlerFunc(DelegateTokenHandler), "token delegation")))
+	router.Path("/session/login").Methods(http.MethodPost).Name("session login").Handler(AuthHeaderRequired(Logger(http.HandlerFunc(SessionLoginHandler), "session login")))
+	router.Path("/session/logout").Methods(http.MethodPost).Name("session logout").Handler(Require("public:write-session", TenantNone, Logger(http.HandlerFunc(SessionLogoutHandler), "session logout")))
+	router.Path("/session").Methods(http.MethodGet).Name("session").Handler(Require("authenticated:read-session", TenantNone, http.HandlerFunc(SessionHandler)))
 	router.PathPrefix("/ws/").Name("websocket proxy proxy").
 		Handler(http.HandlerFunc(WebsocketAuthProxyHandler))
-	router.Path("/metrics").Methods(http.MethodGet).Name("metrics").Handler(NoAuth(promhttp.Handler()))
-	router.Path("/tenantsusage").Methods(http.MethodGet).Name("tenants usage").Handler(SuperRoleRequired(http.HandlerFunc(TenantUsageHandler)))
-	router.Path("/namespacesusage/{tenant}").Methods(http.MethodGet).Name("tenant namespaces usage").Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantUsageHandler)))
+	router.Path("/metrics").Methods(http.MethodGet).Name("metrics").Handler(Require("public:read-metrics", TenantNone, promhttp.Handler()))
+	router.Path("/tenantsusage").Methods(http.MethodGet).Name("tenants usage").Handler(Require("superuser:read-usage", TenantNone, LeaderForward(http.HandlerFunc(TenantUsageHandler))))
+	router.Path("/namespacesusage/{tenant}").Methods(http.MethodGet).Name("tenant namespaces usage").Handler(Require("tenant:read-usage", TenantFromPath, LeaderForward(http.HandlerFunc(TenantUsageHandler))))
+	router.Path("/usagestatements").Methods(http.MethodGet).Name("usage statements").Handler(Require("superuser:read-usage", TenantNone, LeaderForward(http.HandlerFunc(UsageStatementsHandler))))
+	router.Path("/usagestatements/{tenant}").Methods(http.MethodGet).Name("tenant usage statements").Handler(Require("tenant:read-usage", TenantFromPath, LeaderForward(http.HandlerFunc(UsageStatementsHandler))))
+	router.Path("/usageforecast").Methods(http.MethodGet).Name("usage forecasts").Handler(Require("superuser:read-usage", TenantNone, LeaderForward(http.HandlerFunc(UsageForecastHandler))))
+	router.Path("/usageforecast/{tenant}").Methods(http.MethodGet).Name("tenant usage forecast").Handler(Require("tenant:read-usage", TenantFromPath, LeaderForward(http.HandlerFunc(UsageForecastHandler))))
+	router.Path("/storagehistory").Methods(http.MethodGet).Name("storage histories").Handler(Require("superuser:read-usage", TenantNone, LeaderForward(http.HandlerFunc(StorageHistoryHandler))))
+	router.Path("/storagehistory/{tenant}").Methods(http.MethodGet).Name("tenant storage history").Handler(Require("tenant:read-usage", TenantFromPath, LeaderForward(http.HandlerFunc(StorageHistoryHandler))))
+	router.Path("/costlabels/{tenant}").Methods(http.MethodGet).Name("tenant cost labels").Handler(Require("tenant:read-usage", TenantFromPath, http.HandlerFunc(CostLabelsHandler)))
+	router.Path("/costlabels/{tenant}/{namespace}").Methods(http.MethodPut, http.MethodDelete).Name("namespace cost labels").Handler(Require("tenant:write-usage", TenantFromPath, http.HandlerFunc(CostLabelsHandler)))
+	router.Path("/admin/scrape").Methods(http.MethodPost).Name("on-demand scrape").Handler(Require("superuser:write-admin", TenantNone, http.HandlerFunc(ForceScrapeHandler)))
+	router.Path("/admin/loglevel").Methods(http.MethodGet, http.MethodPut, http.MethodDelete).Name("log level").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(LogLevelHandler)))
+	router.Path("/admin/captures").Methods(http.MethodGet, http.MethodPut, http.MethodDelete).Name("request capture").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(CaptureHandler)))
+	router.Path("/admin/config").Methods(http.MethodGet).Name("effective config").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(ConfigHandler)))
+	router.Path("/admin/featuregates").Methods(http.MethodGet).Name("feature gates").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(FeatureGatesHandler)))
+	router.Path("/admin/auth/bans").Methods(http.MethodGet, http.MethodDelete).Name("auth bans").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(AuthBansHandler)))
+	router.Path("/admin/auth/bans/{kind}/{value}").Methods(http.MethodDelete).Name("auth ban").Handler(Require("superuser:write-admin", TenantNone, http.HandlerFunc(AuthBansHandler)))
+	router.Path("/admin/api-usage").Methods(http.MethodGet).Name("api usage").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(APIUsageHandler)))
+	router.Path("/admin/api-usage/top").Methods(http.MethodGet).Name("api top talkers").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(APITopTalkersHandler)))
+	router.Path("/admin/permissions").Methods(http.MethodGet).Name("permissions matrix").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(PermissionMatrixHandler)))
+	router.Path("/admin/reconciliation").Methods(http.MethodGet, http.MethodPost).Name("manifest reconciliation").Handler(Require("superuser:admin", TenantNone, LeaderForward(http.HandlerFunc(ReconciliationHandler))))
+	router.Path("/admin/policy/snapshot").Methods(http.MethodGet, http.MethodPost).Name("policy snapshot").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(PolicySnapshotHandler)))
+	router.Path("/admin/schema").Methods(http.MethodGet, http.MethodPost).Name("schema migrations").Handler(Require("superuser:admin", TenantNone, LeaderForward(http.HandlerFunc(SchemaMigrationsHandler))))
+	router.Path("/admin/scheduler/jobs").Methods(http.MethodGet).Name("scheduled jobs").Handler(Require("superuser:read-admin", TenantNone, LeaderForward(http.HandlerFunc(ScheduledJobsHandler))))
+	router.Path("/admin/scheduler/jobs/{job}/runs").Methods(http.MethodGet, http.MethodPost).Name("scheduled job runs").Handler(Require("superuser:admin", TenantNone, LeaderForward(http.HandlerFunc(ScheduledJobRunsHandler))))
+	router.Path("/gitops/webhook").Methods(http.MethodPost).Name("gitops webhook").Handler(Require("public:write-gitops", TenantNone, LeaderForward(http.HandlerFunc(GitOpsWebhookHandler))))
+	if util.GetConfig().DiagnosticsAddress == "" {
+		diagnosticRoutes(router)
+	}
+	router.Path("/metrics/top").Methods(http.MethodGet).Name("top metrics").Handler(Require("tenant:read-metrics", TenantFromSubject, ShardForward(http.HandlerFunc(TopMetricsHandler))))
+	router.Path("/metrics/top/{tenant}").Methods(http.MethodGet).Name("tenant top metrics").Handler(Require("tenant:read-metrics", TenantFromPath, ShardForward(http.HandlerFunc(TopMetricsHandler))))
+	router.Path("/secrets/{tenant}").Methods(http.MethodGet).Name("tenant secrets").Handler(Require("tenant:read-secrets", TenantFromPath, http.HandlerFunc(TenantSecretsHandler)))
+	router.Path("/secrets/{tenant}/{name}").Methods(http.MethodPut, http.MethodDelete).Name("tenant secret").Handler(Require("tenant:write-secrets", TenantFromPath, http.HandlerFunc(TenantSecretsHandler)))
+	router.Path("/apikeys/{tenant}").Methods(http.MethodGet, http.MethodPost).Name("tenant api keys").Handler(Require("tenant:apikeys", TenantFromPath, http.HandlerFunc(APIKeysHandler)))
+	router.Path("/apikeys/{tenant}/{id}").Methods(http.MethodDelete).Name("tenant api key").Handler(Require("tenant:write-apikeys", TenantFromPath, http.HandlerFunc(APIKeysHandler)))
+	router.Path("/webhooks/{tenant}").Methods(http.MethodGet, http.MethodPost).Name("tenant webhooks").Handler(Require("tenant:webhooks", TenantFromPath, http.HandlerFunc(WebhooksHandler)))
+	router.Path("/webhooks/{tenant}/{id}").Methods(http.MethodDelete).Name("tenant webhook").Handler(Require("tenant:write-webhooks", TenantFromPath, http.HandlerFunc(WebhooksHandler)))
+	router.Path("/admin/webhooks").Methods(http.MethodGet, http.MethodPost).Name("operator webhooks").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(WebhooksHandler)))
+	router.Path("/admin/webhooks/deliveries").Methods(http.MethodGet).Name("webhook deliveries").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(WebhookDeliveriesHandler)))
+	router.Path("/admin/webhooks/{id}").Methods(http.MethodDelete).Name("operator webhook").Handler(Require("superuser:write-admin", TenantNone, http.HandlerFunc(WebhooksHandler)))
+	router.Path("/admin/brokers/fleet").Methods(http.MethodGet).Name("broker fleet").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(BrokerFleetHandler)))
+	router.Path("/admin/billing/accounts").Methods(http.MethodGet).Name("billing accounts").Handler(Require("superuser:read-admin", TenantNone, http.HandlerFunc(BillingAccountsHandler)))
+	router.Path("/admin/billing/accounts/{tenant}").Methods(http.MethodGet, http.MethodPut, http.MethodDelete).Name("billing account").Handler(Require("superuser:admin", TenantNone, http.HandlerFunc(BillingAccountHandler)))
+	router.Path("/admin/billing/stripe/reports").Methods(http.MethodGet, http.MethodPost).Name("stripe reports").Handler(Require("superuser:admin", TenantNone, LeaderForward(http.HandlerFunc(StripeReportsHandler))))
+	router.Path("/alerts").Methods(http.MethodGet).Name("alerts").Handler(Require("superuser:read-metrics", TenantNone, LeaderForward(http.HandlerFunc(AlertsHandler))))
+	router.Path("/alerts/{tenant}").Methods(http.MethodGet).Name("tenant alerts").Handler(Require("tenant:read-metrics", TenantFromPath, LeaderForward(http.HandlerFunc(AlertsHandler))))
+	router.Path("/subscriptionlag/{tenant}").Methods(http.MethodGet).Name("subscription lag").Handler(Require("tenant:read-metrics", TenantFromPath, ShardForward(http.HandlerFunc(SubscriptionLagHandler))))
 	router.Path("/pulsarmetrics/{tenant}").Methods(http.MethodGet).Name("pulsar metrics").
-		Handler(SuperRoleRequired(http.HandlerFunc(PulsarFederatedDebugPrometheusHandler)))
+		Handler(Require("superuser:read-metrics", TenantNone, ShardForward(http.HandlerFunc(PulsarFederatedDebugPrometheusHandler))))
 	router.Path("/pulsarmetrics").Methods(http.MethodGet).Name("pulsar metrics").
-		Handler(AuthVerifyJWT(http.HandlerFunc(PulsarFederatedPrometheusHandler)))
+		Handler(Require("tenant:read-metrics", TenantFromSubject, ShardForward(http.HandlerFunc(PulsarFederatedPrometheusHandler))))
+	router.Path("/prometheus/sd").Methods(http.MethodGet).Name("prometheus service discovery").
+		Handler(Require("superuser:read-metrics", TenantNone, LeaderForward(http.HandlerFunc(PrometheusSDHandler))))
+	router.Path("/function-metrics").Methods(http.MethodGet).Name("function metrics").
+		Handler(Require("tenant:read-metrics", TenantFromSubject, http.HandlerFunc(FunctionMetricsHandler)))
+	router.Path("/function-metrics/{tenant}").Methods(http.MethodGet).Name("tenant function metrics").
+		Handler(Require("tenant:read-metrics", TenantFromPath, http.HandlerFunc(FunctionMetricsHandler)))
 
 	// Tenant policy management URL
 	router.Path("/k/tenant/{tenant}").Methods(http.MethodGet).Name("kafkaesque tenant management GET").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantManagementHandler)))
+		Handler(Require("tenant:read-tenant-policy", TenantFromPath, http.HandlerFunc(TenantManagementHandler)))
 	router.Path("/k/tenant/{tenant}").Methods(http.MethodDelete, http.MethodPost).Name("kafkaesque tenant management").
-		Handler(SuperRoleRequired(http.HandlerFunc(TenantManagementHandler)))
+		Handler(Require("superuser:write-tenant-policy", TenantNone, http.HandlerFunc(TenantManagementHandler)))
+	router.Path("/k/tenant/{tenant}/overrides").Methods(http.MethodGet).Name("tenant overrides GET").
+		Handler(Require("tenant:read-tenant-policy", TenantFromPath, http.HandlerFunc(TenantOverridesHandler)))
+	router.Path("/k/tenant/{tenant}/overrides").Methods(http.MethodPut, http.MethodDelete).Name("tenant overrides").
+		Handler(Require("superuser:write-tenant-policy", TenantNone, http.HandlerFunc(TenantOverridesHandler)))
+	router.Path("/k/overrides").Methods(http.MethodGet).Name("tenant overrides list").
+		Handler(Require("superuser:read-tenant-policy", TenantNone, http.HandlerFunc(ListTenantOverridesHandler)))
+
+	// Provisioning API
+	router.Path("/provisioning/v1/tenants/{tenant}").Methods(http.MethodGet).Name("provisioned tenant GET").
+		Handler(Require("superuser:read-provisioning", TenantNone, LeaderForward(http.HandlerFunc(ProvisionedTenantHandler))))
+	router.Path("/provisioning/v1/tenants/{tenant}").Methods(http.MethodPut, http.MethodDelete).Name("provisioned tenant").
+		Handler(Require("superuser:write-provisioning", TenantNone, LeaderForward(http.HandlerFunc(ProvisionedTenantHandler))))
+	router.Path("/provisioning/v1/tenants/{tenant}/namespaces/{namespace}").Methods(http.MethodGet).Name("provisioned namespace GET").
+		Handler(Require("superuser:read-provisioning", TenantNone, LeaderForward(http.HandlerFunc(ProvisionedNamespaceHandler))))
+	router.Path("/provisioning/v1/tenants/{tenant}/namespaces/{namespace}").Methods(http.MethodPut, http.MethodDelete).Name("provisioned namespace").
+		Handler(Require("superuser:write-provisioning", TenantNone, LeaderForward(http.HandlerFunc(ProvisionedNamespaceHandler))))
+	router.Path("/provisioning/v1/tenants/{tenant}/tokens/{name}").Methods(http.MethodGet).Name("provisioned token GET").
+		Handler(Require("superuser:read-provisioning", TenantNone, LeaderForward(http.HandlerFunc(ProvisionedTokenHandler))))
+	router.Path("/provisioning/v1/tenants/{tenant}/tokens/{name}").Methods(http.MethodPut, http.MethodDelete).Name("provisioned token").
+		Handler(Require("superuser:write-provisioning", TenantNone, LeaderForward(http.HandlerFunc(ProvisionedTokenHandler))))
 
 	if util.GetConfig().PulsarBeamTopic != "" {
 		// Pulsar Beam topic and webhook management URL
 		router.Path("/pulsarbeam/v2/topic").Methods(http.MethodGet).Name("Pulsar Beam Get a topic").
-			Handler(AuthVerifyJWT(http.HandlerFunc(PulsarBeamGetTopicHandler)))
+			Handler(Require("tenant:read-pulsarbeam", TenantFromSubject, http.HandlerFunc(PulsarBeamGetTopicHandler)))
 		router.Path("/pulsarbeam/v2/topic").Methods(http.MethodDelete).Name("Pulsar Beam Delete a topic").
-			Handler(AuthVerifyJWT(http.HandlerFunc(PulsarBeamDeleteTopicHandler)))
+			Handler(Require("tenant:write-pulsarbeam", TenantFromSubject, http.HandlerFunc(PulsarBeamDeleteTopicHandler)))
 		router.Path("/pulsarbeam/v2/topic/{topicKey}").Methods(http.MethodGet).Name("Pulsar Beam Get a topic").
-			Handler(AuthVerifyJWT(http.HandlerFunc(PulsarBeamGetTopicHandler)))
+			Handler(Require("tenant:read-pulsarbeam", TenantFromSubject, http.HandlerFunc(PulsarBeamGetTopicHandler)))
 		router.Path("/pulsarbeam/v2/topic/{topicKey}").Methods(http.MethodDelete).Name("Pulsar Beam Delete a topic").
-			Handler(AuthVerifyJWT(http.HandlerFunc(PulsarBeamDeleteTopicHandler)))
+			Handler(Require("tenant:write-pulsarbeam", TenantFromSubject, http.HandlerFunc(PulsarBeamDeleteTopicHandler)))
 		router.Path("/pulsarbeam/v2/topic").Methods(http.MethodPost).Name("Pulsar Beam Update a topic").
-			Handler(AuthVerifyJWT(http.HandlerFunc(PulsarBeamUpdateTopicHandler)))
+			Handler(Require("tenant:write-pulsarbeam", TenantFromSubject, http.HandlerFunc(PulsarBeamUpdateTopicHandler)))
 	}
 
 	// Collect tenant topics statistics in one call
 	router.Path("/stats/topics/{tenant}").Methods(http.MethodGet).Name("tenant topic stats").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantTopicStatsHandler)))
+		Handler(Require("tenant:read-stats", TenantFromPath, http.HandlerFunc(TenantTopicStatsHandler)))
+	// Stream the tenant topic stats as server-sent events at every cache refresh
+	router.Path("/stats/topics/{tenant}/stream").Methods(http.MethodGet).Name("tenant topic stats stream").
+		Handler(Require("tenant:read-stats", TenantFromPath, http.HandlerFunc(TopicStatsStreamHandler)))
+
+	// List tenant topics with their stats in one call
+	router.Path("/topics/{tenant}").Methods(http.MethodGet).Name("tenant topics").
+		Handler(Require("tenant:read-stats", TenantFromPath, ShardForward(http.HandlerFunc(TenantTopicsHandler))))
+
+	// Inspect the dead letter and retry topics of a subscription
+	router.Path("/dlq/{tenant}/{namespace}/{topic}/{subscription}").Methods(http.MethodGet).Name("dead letter topics").
+		Handler(Require("tenant:read-dlq", TenantFromPath, http.HandlerFunc(DeadLetterHandler)))
+	router.Path("/dlq/{tenant}/{namespace}/{topic}/{subscription}/peek").Methods(http.MethodGet).Name("dead letter peek").
+		Handler(Require("tenant:read-dlq", TenantFromPath, http.HandlerFunc(DeadLetterPeekHandler)))
+	// Publish a message to a tenant topic with the burnell credentials
+	router.Path("/v1/produce/{tenant}/{namespace}/{topic}").Methods(http.MethodPost).Name("produce").
+		Handler(Require("tenant:write-messages", TenantFromPath, http.HandlerFunc(ProduceHandler)))
+	// Peek the latest messages of a tenant topic, or consume them from a throwaway subscription on the leader
+	router.Path("/v1/peek/{tenant}/{namespace}/{topic}").Methods(http.MethodGet).Name("topic peek").
+		Handler(Require("tenant:read-messages", TenantFromPath, http.HandlerFunc(TopicPeekHandler)))
+	router.Path("/v1/consume/{tenant}/{namespace}/{topic}").Methods(http.MethodPost, http.MethodDelete).Name("topic consume").
+		Handler(Require("tenant:read-messages", TenantFromPath, LeaderForward(http.HandlerFunc(TopicConsumeHandler))))
+	// Read a topic over a websocket from a start position, with the burnell token to Pulsar
+	router.Path("/reader/v2/{domain:persistent|non-persistent}/{tenant}/{namespace}/{topic}").Methods(http.MethodGet).Name("topic reader").
+		Handler(websocketQueryToken(Require("tenant:read-messages", TenantFromPath, http.HandlerFunc(TopicReaderHandler))))
 
 	// Retrieve function logs, instance is optional and default to 0
 	router.Path("/function-logs/{tenant}/{namespace}/{function}").Methods(http.MethodGet).Name("function-logs").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(FunctionLogsHandler)))
+		Handler(Require("tenant:read-function-logs", TenantFromPath, http.HandlerFunc(FunctionLogsHandler)))
+	// Download the logs of all instances as a tar.gz archive, registered ahead of the instance route
+	router.Path("/function-logs/{tenant}/{namespace}/{function}/archive").Methods(http.MethodGet).Name("function-logs-archive").
+		Handler(Require("tenant:read-function-logs", TenantFromPath, http.HandlerFunc(FunctionLogArchiveHandler)))
+	// Follow the log of an instance over a websocket, registered ahead of the instance route
+	router.Path("/function-logs/{tenant}/{namespace}/{function}/tail").Methods(http.MethodGet).Name("function-logs-tail").
+		Handler(websocketQueryToken(Require("tenant:read-function-logs", TenantFromPath, http.HandlerFunc(FunctionLogTailHandler))))
+	// Merge the logs of all instances chronologically, registered ahead of the instance route
+	router.Path("/function-logs/{tenant}/{namespace}/{function}/merged").Methods(http.MethodGet).Name("function-logs-merged").
+		Handler(Require("tenant:read-function-logs", TenantFromPath, http.HandlerFunc(FunctionMergedLogsHandler)))
 	router.Path("/function-logs/{tenant}/{namespace}/{function}/{instance}").Methods(http.MethodGet).Name("function-logs").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(FunctionLogsHandler)))
+		Handler(Require("tenant:read-function-logs", TenantFromPath, http.HandlerFunc(FunctionLogsHandler)))
 	router.Path("/function-status/{tenant}/{namespace}/{function}").Methods(http.MethodGet).Name("function-logs-status").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(FunctionStatusHandler)))
+		Handler(Require("tenant:read-function-logs", TenantFromPath, http.HandlerFunc(FunctionStatusHandler)))
 
 	// aggregated topics under namespaces
 	router.Path("/admin/v2/topics/{tenant}").Methods(http.MethodGet).Name("topics-grouped-by-namespaces").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(GroupTopicsByNamespaceHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(GroupTopicsByNamespaceHandler)))
+
+	// cached topic ownership lookups
+	router.Path("/lookup/v2/topic/{domain:persistent|non-persistent}/{tenant}/{namespace}/{topic}").Methods(http.MethodGet).
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(OwnershipLookupHandler)))
+	router.Path("/lookup/v2/topic/{domain:persistent|non-persistent}/{tenant}/{namespace}/{topic}/bundle").Methods(http.MethodGet).
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(OwnershipLookupHandler)))
 
 	// Pulsar Admin REST API proxy
 	//
 	// /bookies/
 	router.PathPrefix("/admin/v2/bookies").Methods(http.MethodGet, http.MethodPost, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 
 	// /broker-stats
 	router.PathPrefix("/admin/v2/broker-stats").Methods(http.MethodGet).
-		Handler(SuperRoleRequired(http.HandlerFunc(BrokerAggregatorHandler)))
+		Handler(Require("superuser:read-pulsar-admin", TenantNone, http.HandlerFunc(BrokerAggregatorHandler)))
 	// Exception is broker-resource-availability/{tenant}/{namespace}
 	// since "org.apache.pulsar.broker.loadbalance.impl.ModularLoadManagerWrapper does not support this operation"
 	// we would not support this for now
@@ -114,196 +241,243 @@ func NewRouter() *mux.Router {
 	// /brokers
 	//
 	router.PathPrefix("/admin/v2/brokers").Methods(http.MethodGet, http.MethodPost, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 
 	//
 	// /clusters
 	//
 	router.PathPrefix("/admin/v2/clusters").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("superuser:pulsar-admin", TenantNone, http.HandlerFunc(CachedProxyHandler)))
 
 	//
 	// /namespaces
 	// list of routes in the look up order from more restricted to relaxed including JWT role authorization
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/maxConsumersPerSubscription").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/maxConsumersPerTopic").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/maxProducersPerTopic").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/maxUnackedMessagesPerSubscription").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/messageTTL").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/offloadDeletionLagMs").Methods(http.MethodPut, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/offloadPolicies").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/offloadThreshold").Methods(http.MethodPut).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/schemaAutoUpdateCompatibilityStrategy").Methods(http.MethodPut).
-		Handler(SuperRoleRequired(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(NamespacePolicyProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/schemaCompatibilityStrategy").Methods(http.MethodPut).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(NamespacePolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/schemaValidationEnforced").Methods(http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(NamespacePolicyProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(NamespacePolicyProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/deduplication").Methods(http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(DirectBrokerProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/permissions/{role}").Methods(http.MethodPost, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/persistence").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/replication").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/replicatorDispatchRate").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/retention").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/subscribeRate").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/subscriptionAuthMode").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/subscriptionDispatchRate").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/unload").Methods(http.MethodPut).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, InvalidateOwnershipOnSuccess(http.HandlerFunc(DirectBrokerProxyHandler))))
+	router.Path("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/unload").Methods(http.MethodPut).
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, InvalidateOwnershipOnSuccess(http.HandlerFunc(DirectBrokerProxyHandler))))
+	router.Path("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/split").Methods(http.MethodPut).
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, InvalidateOwnershipOnSuccess(http.HandlerFunc(DirectBrokerProxyHandler))))
+	// cached namespace bundles
+	router.Path("/admin/v2/namespaces/{tenant}/{namespace}/bundles").Methods(http.MethodGet).
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(OwnershipLookupHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}").Methods(http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/split").Methods(http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/unload").Methods(http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/clearBacklog").Methods(http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/clearBacklog/{subscription}").Methods(http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/{bundle}/unsubscribe/{subscription}").Methods(http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectBrokerProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/autoSubscriptionCreation").Methods(http.MethodDelete, http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/autoTopicCreation").Methods(http.MethodDelete, http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/backlogQuota").Methods(http.MethodDelete, http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/backlogQuotaMap").Methods(http.MethodGet).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 
 	// this includes clearBacklog/{subscription}
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/clearBacklog").Methods(http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/antiAffinity").Methods(http.MethodGet, http.MethodPost, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/compactionThreshold").Methods(http.MethodGet, http.MethodPut).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/delayedDelivery").Methods(http.MethodGet, http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 
 	// including admin/v2/namespaces/{tenant}/{namespace}/dispatchRate,
 	// including admin/v2/namespaces/{tenant}/{namespace}/isAllowAutoUpdateSchema
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}").Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(NamespaceLimitEnforceProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(NamespaceLimitEnforceProxyHandler)))
 
 	router.PathPrefix("/admin/v2/namespaces/{tenant}").Methods(http.MethodGet, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 
 	// 2. routes require superroles access
 	// including admin/v2/namespaces/{cluster}/antiAffinity/{group}
 	// admin/v2/namespaces/{property}/{namespace}/persistence/bookieAffinity
 	//
 	router.PathPrefix("/admin/v2/namespaces").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("superuser:pulsar-admin", TenantNone, http.HandlerFunc(CachedProxyHandler)))
 
 	//
 	// persistent topic
 	//
+	// compaction and offload triggers with guardrails
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/compaction").Methods(http.MethodPut).
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, TopicOperationHandler(compactionOperation)))
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/offload").Methods(http.MethodPut).
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, TopicOperationHandler(offloadOperation)))
+	// subscription backlog skip, expiry, and clear with guardrails
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/subscription/{subscription}/skip/{count}").Methods(http.MethodPost).
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, BacklogCleanupHandler(skipOperation)))
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/subscription/{subscription}/expireMessages/{seconds}").Methods(http.MethodPost).
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, BacklogCleanupHandler(expireOperation)))
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/subscription/{subscription}/skip_all").Methods(http.MethodPost).
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, BacklogCleanupHandler(clearAllOperation)))
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/partitioned-stats").Methods(http.MethodGet).
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(PartitionedTopicStatsHandler)))
+	router.Path("/admin/v2/persistent/{tenant}/{namespace}/{topic}/unload").Methods(http.MethodPut).
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, InvalidateOwnershipOnSuccess(http.HandlerFunc(TopicProxyHandler))))
 	router.PathPrefix("/admin/v2/persistent/{tenant}/{namespace}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TopicProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(TopicProxyHandler)))
 
 	// /admin/v2/persistent/{tenant}/{namespace}/partitioned
 
 	// non-persistent topic
+	router.Path("/admin/v2/non-persistent/{tenant}/{namespace}/{topic}/partitioned-stats").Methods(http.MethodGet).
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(PartitionedTopicStatsHandler)))
+	router.Path("/admin/v2/non-persistent/{tenant}/{namespace}/{topic}/unload").Methods(http.MethodPut).
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, InvalidateOwnershipOnSuccess(http.HandlerFunc(TopicProxyHandler))))
 	router.PathPrefix("/admin/v2/non-persistent/{tenant}/{namespace}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TopicProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(TopicProxyHandler)))
 
 	//
 	// /resource-quotas
 	//
 	router.PathPrefix("/admin/v2/resource-quotas").Methods(http.MethodGet, http.MethodPost, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("superuser:pulsar-admin", TenantNone, http.HandlerFunc(CachedProxyHandler)))
 
 	//
 	// /schemas
 	//
 	router.PathPrefix("/admin/v2/schemas/{tenant}/{namespace}/{topic}/compatibility").Methods(http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 	router.PathPrefix("/admin/v2/schemas/{tenant}/{namespace}/{topic}/schema").Methods(http.MethodGet, http.MethodPost, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, ValidateSchemaUpload(http.HandlerFunc(CachedProxyHandler))))
 	router.PathPrefix("/admin/v2/schemas/{tenant}/{namespace}/{topic}/schema/{version}").Methods(http.MethodGet).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 	router.PathPrefix("/admin/v2/schemas/{tenant}/{namespace}/{topic}/schemas").Methods(http.MethodGet).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 	router.PathPrefix("/admin/v2/schemas/{tenant}/{namespace}/{topic}/version").Methods(http.MethodPost).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:write-pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 		// catch all routes
 	router.PathPrefix("/admin/v2/schemas/{tenant}").Methods(http.MethodGet, http.MethodPost, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 
 	//
 	// /tenants
 	//
 	router.PathPrefix("/admin/v2/tenants/{tenant}").Methods(http.MethodGet).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromPath, http.HandlerFunc(CachedProxyHandler)))
 	router.PathPrefix("/admin/v2/tenants").Methods(http.MethodGet).
-		Handler(AuthVerifyJWT(http.HandlerFunc(RestrictedTenantsProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromSubject, http.HandlerFunc(RestrictedTenantsProxyHandler)))
 	router.PathPrefix("/admin/v2/tenants").Methods(http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(SuperRoleRequired(http.HandlerFunc(CachedProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(CachedProxyHandler)))
 
 	//
 	// /functions including v2 for backward compatibility
 	//
 	// routes /admin/v3/functions/connectors is not supported by proxy 8443 either
 	router.PathPrefix("/admin/v3/functions/{tenant}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(DirectFunctionProxyHandler)))
 
 	router.PathPrefix("/admin/v2/functions/{tenant}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, http.HandlerFunc(DirectFunctionProxyHandler)))
 
 	//
 	// /sources
 	//
 	router.PathPrefix("/admin/v3/sources/builtinsources").Methods(http.MethodGet).
-		Handler(AuthVerifyJWT(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromSubject, http.HandlerFunc(DirectFunctionProxyHandler)))
 
 	router.PathPrefix("/admin/v3/sources/reloadBuiltInSources").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectFunctionProxyHandler)))
 
 	router.PathPrefix("/admin/v3/sources/{tenant}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, InjectConnectorSecrets(http.HandlerFunc(DirectFunctionProxyHandler))))
 
 	//
 	// /sinks
 	//
 	router.PathPrefix("/admin/v3/sinks/builtinsinks").Methods(http.MethodGet).
-		Handler(AuthVerifyJWT(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("tenant:read-pulsar-admin", TenantFromSubject, http.HandlerFunc(DirectFunctionProxyHandler)))
 
 	router.PathPrefix("/admin/v3/sinks/reloadBuiltInSinks").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("superuser:write-pulsar-admin", TenantNone, http.HandlerFunc(DirectFunctionProxyHandler)))
 
 	router.PathPrefix("/admin/v3/sinks/{tenant}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(DirectFunctionProxyHandler)))
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, InjectConnectorSecrets(http.HandlerFunc(DirectFunctionProxyHandler))))
+
+	//
+	// /transactions v3
+	//
+	// transaction buffer and pending ack stats are topic scoped
+	for _, stats := range []string{"transactionInBufferStats", "transactionInPendingAckStats",
+		"transactionBufferStats", "pendingAckStats", "pendingAckInternalStats"} {
+		router.PathPrefix("/admin/v3/transactions/" + stats + "/{tenant}/{namespace}").Methods(http.MethodGet).
+			Handler(Require("tenant:read-pulsar-admin", TenantFromPath, RequireBrokerVersion("transactions", TransactionsMinVersion, http.HandlerFunc(DirectBrokerProxyHandler))))
+	}
+	// coordinator stats, transaction metadata and slow transactions span across tenants
+	router.PathPrefix("/admin/v3/transactions").Methods(http.MethodGet).
+		Handler(Require("superuser:read-pulsar-admin", TenantNone, RequireBrokerVersion("transactions", TransactionsMinVersion, http.HandlerFunc(DirectBrokerProxyHandler))))
+
+	//
+	// /packages v3
+	//
+	router.PathPrefix("/admin/v3/packages/{type}/{tenant}/{namespace}").Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete).
+		Handler(Require("tenant:pulsar-admin", TenantFromPath, RequireBrokerVersion("packages", PackagesMinVersion, http.HandlerFunc(DirectBrokerProxyHandler))))
 
 	// TODO rate limit can be added per route basis
 	router.Use(LimitRate)
 
 	router.Use(ResponseJSONContentType)
 
+	permissionRouter = router
 	log.Warnf("router added")
 	return router
 }
@@ -0,0 +1,188 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Scheduled job tasks of the API keys and the local caches, and the scheduler admin endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	// TaskKeyRotationReminder notifies the API keys and the signing key older than the maxAgeDays parameter
+	TaskKeyRotationReminder = "key-rotation-reminder"
+	// TaskStaleTokenCleanup revokes the API keys expired for longer than the graceDays parameter
+	TaskStaleTokenCleanup = "stale-token-cleanup"
+	// TaskCacheCompaction removes the expired verified tokens and sessions of the replica
+	TaskCacheCompaction = "cache-compaction"
+
+	defaultKeyRotationDays = 90
+)
+
+func init() {
+	util.RegisterJobTask(TaskKeyRotationReminder, false, remindKeyRotation)
+	util.RegisterJobTask(TaskStaleTokenCleanup, false, cleanupStaleTokens)
+	util.RegisterJobTask(TaskCacheCompaction, true, compactCaches)
+}
+
+// remindKeyRotation notifies a rotation of every API key and of the signing key older than the maximum age
+func remindKeyRotation(now time.Time, params map[string]string) (string, error) {
+	days, err := util.JobParamInt(params, "maxAgeDays", defaultKeyRotationDays)
+	if err != nil {
+		return "", err
+	}
+	maxAge := time.Duration(days) * 24 * time.Hour
+	due := 0
+	for _, key := range util.ListAllAPIKeys() {
+		if age := now.Sub(key.CreatedAt); age > maxAge {
+			due++
+			util.Notify(util.EventKeyRotationDue, key.Tenant, key.ID, util.NotificationCooldown(), map[string]interface{}{
+				"kind":      "api-key",
+				"id":        key.ID,
+				"name":      key.Name,
+				"subject":   key.Subject,
+				"createdAt": key.CreatedAt,
+				"ageDays":   int(age.Hours() / 24),
+			})
+		}
+	}
+	if util.IsPulsarJWTEnabled() {
+		if info, err := os.Stat(util.GetConfig().PulsarPrivateKey); err == nil {
+			if age := now.Sub(info.ModTime()); age > maxAge {
+				due++
+				log.Warnf("the signing key has not been rotated for %d days", int(age.Hours()/24))
+				util.Notify(util.EventKeyRotationDue, "", "signing-key", util.NotificationCooldown(), map[string]interface{}{
+					"kind":      "signing-key",
+					"updatedAt": info.ModTime(),
+					"ageDays":   int(age.Hours() / 24),
+				})
+			}
+		}
+	}
+	return fmt.Sprintf("%d keys are due for rotation", due), nil
+}
+
+// cleanupStaleTokens revokes the API keys past their expiry and the grace period
+func cleanupStaleTokens(now time.Time, params map[string]string) (string, error) {
+	days, err := util.JobParamInt(params, "graceDays", 0)
+	if err != nil {
+		return "", err
+	}
+	if policy.APIKeyStore == nil {
+		return "", errors.New("API keys are not enabled")
+	}
+	cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+	revoked := 0
+	for _, key := range util.ListAllAPIKeys() {
+		if key.ExpiresAt.IsZero() || key.ExpiresAt.After(cutoff) {
+			continue
+		}
+		if err := policy.APIKeyStore.RevokeAPIKey(key.Tenant, key.ID); err != nil {
+			return fmt.Sprintf("revoked %d expired API keys", revoked), err
+		}
+		revoked++
+	}
+	return fmt.Sprintf("revoked %d expired API keys", revoked), nil
+}
+
+// compactCaches removes the expired entries of the verified token cache and the sessions
+func compactCaches(now time.Time, params map[string]string) (string, error) {
+	tokens := 0
+	for i := range verifiedTokens {
+		shard := &verifiedTokens[i]
+		var removed []string
+		shard.lock.Lock()
+		for k, v := range shard.tokens {
+			if !now.Before(v.expiresAt) {
+				delete(shard.tokens, k)
+				removed = append(removed, k)
+			}
+		}
+		shard.lock.Unlock()
+		for _, k := range removed {
+			util.ForgetCacheEntry(tokenCacheName, k)
+		}
+		tokens += len(removed)
+	}
+	sessions := util.CompactSessions(now)
+	return fmt.Sprintf("removed %d verified tokens and %d sessions", tokens, sessions), nil
+}
+
+// ScheduledJobsHandler returns the scheduled jobs with their next and last runs
+func ScheduledJobsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(util.GetScheduledJobs())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// ScheduledJobRunsHandler returns the run history of a job, or runs the job now on POST
+func ScheduledJobRunsHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["job"]
+	var body interface{}
+	if r.Method == http.MethodPost {
+		log.Infof("subject %s requested a run of the scheduled job %s", r.Header.Get(injectedSubs), name)
+		run, err := util.RunScheduledJob(name)
+		switch err {
+		case nil:
+			body = run
+		case util.ErrJobNotFound:
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		case util.ErrJobRunning:
+			util.ResponseErrorJSON(err, w, http.StatusConflict)
+			return
+		default:
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		found := false
+		for _, job := range util.GetScheduledJobs() {
+			found = found || job.Name == name
+		}
+		if !found {
+			util.ResponseErrorJSON(util.ErrJobNotFound, w, http.StatusNotFound)
+			return
+		}
+		body = util.GetJobHistory(name)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,112 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Schema upload pre-checks before the upload reaches the broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/schema"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// schema validation levels of the SchemaValidation config
+const (
+	schemaValidationSyntax        = "syntax"
+	schemaValidationCompatibility = "compatibility"
+)
+
+// ValidateSchemaUpload middleware validates a schema upload is well formed, and optionally compatible with
+// the latest schema of the topic, before it is forwarded to the broker. It is disabled unless SchemaValidation
+// is either syntax or compatibility.
+func ValidateSchemaUpload(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := strings.ToLower(util.GetConfig().SchemaValidation)
+		if r.Method != http.MethodPost || (level != schemaValidationSyntax && level != schemaValidationCompatibility) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			util.ResponseErrorJSON(errors.New("failed to read schema body"), w, http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var payload schema.Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("schema body must be a json object with type, schema, and properties: %v", err), w, http.StatusUnprocessableEntity)
+			return
+		}
+		if err := schema.Validate(payload); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if level == schemaValidationCompatibility {
+			vars := mux.Vars(r)
+			tenant, namespace, topic := vars["tenant"], vars["namespace"], vars["topic"]
+			if err := checkSchemaCompatibility(tenant, namespace, topic, payload); err != nil {
+				util.ResponseErrorJSON(err, w, http.StatusConflict)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkSchemaCompatibility verifies the schema against the latest schema of the topic with the namespace strategy.
+// The check is skipped if the latest schema or the strategy cannot be retrieved, so the broker remains the authority.
+func checkSchemaCompatibility(tenant, namespace, topic string, candidate schema.Payload) error {
+	adminURL := util.AdminURL(tenant)
+	// the latest schema definition is returned in the data field
+	var resp struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+	}
+	status, err := getAdminJSON(util.SingleJoinSlash(adminURL, fmt.Sprintf("admin/v2/schemas/%s/%s/%s/schema", tenant, namespace, topic)), &resp)
+	if status == http.StatusNotFound {
+		// the first schema of the topic
+		return nil
+	} else if err != nil {
+		log.Warnf("skip schema compatibility check of %s/%s/%s, failed to get the latest schema %v", tenant, namespace, topic, err)
+		return nil
+	}
+	latest := schema.Payload{Type: resp.Type, Schema: resp.Data}
+
+	var strategy string
+	if _, err := getAdminJSON(util.SingleJoinSlash(adminURL, fmt.Sprintf("admin/v2/namespaces/%s/%s/schemaCompatibilityStrategy", tenant, namespace)), &strategy); err != nil {
+		log.Warnf("schema compatibility strategy of %s/%s is unavailable, assume the default %v", tenant, namespace, err)
+	}
+	return schema.Compatible(latest, candidate, strategy)
+}
@@ -0,0 +1,76 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Prometheus HTTP service discovery of the tenant metrics endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/util"
+)
+
+// PrometheusSDTargetGroup is a target group of the Prometheus http_sd_config
+type PrometheusSDTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// PrometheusSDHandler lists a scrape target of the federated metrics per tenant, so that a central Prometheus
+// discovers the tenants with an http_sd_config instead of a static scrape config per tenant.
+func PrometheusSDHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := util.GetConfig().PrometheusSD
+	target := util.AssignString(cfg.Target, r.Host)
+	scheme := cfg.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+	}
+	cluster := util.GetConfig().ClusterName
+
+	groups := []PrometheusSDTargetGroup{}
+	for _, tenant := range metrics.TenantNames() {
+		labels := map[string]string{}
+		for k, v := range cfg.Labels {
+			labels[k] = v
+		}
+		if cluster != "" {
+			labels["cluster"] = cluster
+		}
+		labels["tenant"] = tenant
+		labels["__scheme__"] = scheme
+		labels["__metrics_path__"] = "/pulsarmetrics/" + tenant
+		groups = append(groups, PrometheusSDTargetGroup{Targets: []string{target}, Labels: labels})
+	}
+
+	data, err := json.Marshal(groups)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
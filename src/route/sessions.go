@@ -0,0 +1,168 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/util"
+)
+
+// SessionResponse is the json object of a browser session
+type SessionResponse struct {
+	Subject   string `json:"subject"`
+	ExpiresAt int64  `json:"expiresAt"`
+	CSRFToken string `json:"csrfToken"`
+}
+
+// requestSessionCookie returns the session cookie that authenticates the request.
+// A request with a token or an API key is authenticated by them instead of the cookie.
+func requestSessionCookie(r *http.Request) (string, bool) {
+	if !util.SessionsEnabled() || requestAPIKey(r) != "" ||
+		strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1)) != "" {
+		return "", false
+	}
+	cookie, err := r.Cookie(util.SessionCookieName())
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// sessionSubjectAndScope authenticates the request by the session cookie.
+// An expired session is a normal end of a browser session, so it is not recorded as an auth failure.
+func sessionSubjectAndScope(r *http.Request, id string) (string, *icrypto.DelegationScope, error) {
+	session, err := util.GetSession(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := verifyTokenBinding(r, session.Token); err != nil {
+		return "", nil, err
+	}
+	return session.Token.Subject, session.Token.Scope, nil
+}
+
+func sessionCookie(value string, expires time.Time) *http.Cookie {
+	cfg := util.GetConfig().Sessions
+	sameSite := http.SameSiteStrictMode
+	if strings.EqualFold(cfg.SameSite, "lax") {
+		sameSite = http.SameSiteLaxMode
+	}
+	cookie := &http.Cookie{
+		Name:     util.SessionCookieName(),
+		Value:    value,
+		Path:     "/",
+		Domain:   cfg.CookieDomain,
+		HttpOnly: true,
+		Secure:   !cfg.InsecureCookie,
+		SameSite: sameSite,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	return cookie
+}
+
+// SessionLoginHandler validates the bearer token once and issues an HttpOnly session cookie,
+// so that the browser does not keep the token.
+func SessionLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !util.SessionsEnabled() || !util.IsPulsarJWTEnabled() {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+	// a banned source is rejected before the costly signature verification, the same as a bearer token request
+	ip := clientIP(r)
+	if retryAfter, banned := util.AuthBanned(ip, icrypto.UnverifiedSubject(tokenStr)); banned {
+		requestLog(r).Warnf("reject the session login of the banned source %s", ip)
+		respondAuthBanned(w, authBannedError{retryAfter: retryAfter})
+		return
+	}
+	verified, err := verifyToken(tokenStr)
+	if err == nil {
+		err = verifyTokenBinding(r, verified)
+	}
+	if respondVerificationOverloaded(w, err) {
+		return
+	}
+	if err != nil {
+		if tokenStr != "" {
+			util.RecordAuthFailure(ip, icrypto.FailedTokenSubject(tokenStr, verified, err))
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, session, err := util.NewSession(verified)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnauthorized)
+		return
+	}
+	requestLog(r).Infof("subject %s logged in a browser session until %v", verified.Subject, session.ExpiresAt)
+	http.SetCookie(w, sessionCookie(id, session.ExpiresAt))
+
+	data, err := json.Marshal(SessionResponse{Subject: verified.Subject, ExpiresAt: session.ExpiresAt.Unix(), CSRFToken: session.CSRFToken})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// SessionLogoutHandler closes the session of the cookie and clears the cookie
+func SessionLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(util.SessionCookieName()); err == nil {
+		util.CloseSession(cookie.Value)
+	}
+	http.SetCookie(w, sessionCookie("", time.Time{}))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionHandler returns the session of the cookie
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(util.SessionCookieName())
+	if err != nil {
+		http.Error(w, "no session", http.StatusNotFound)
+		return
+	}
+	session, err := util.GetSession(cookie.Value)
+	if err != nil {
+		http.Error(w, "no session", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(SessionResponse{Subject: session.Token.Subject, ExpiresAt: session.ExpiresAt.Unix(), CSRFToken: session.CSRFToken})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
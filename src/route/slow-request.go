@@ -0,0 +1,77 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// SlowRequest middleware measures the latency breakdown of every request,
+// and logs the requests over the slow request threshold
+func SlowRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, timings := util.WithRequestTimings(r.Context())
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK, timings: timings}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(recorder, r)
+
+		name, matched := r.URL.Path, false
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				name, matched = tpl, true
+			}
+		}
+		o := util.RequestObservation{
+			Route:    name,
+			Matched:  matched,
+			Subject:  r.Header.Get(injectedSubs),
+			Method:   r.Method,
+			Status:   recorder.status,
+			Duration: time.Since(start),
+			Phases:   timings.Phases(),
+		}
+		// a websocket session is long lived by design
+		o.Slow = o.Duration > util.SlowRequestThreshold() && recorder.status != http.StatusSwitchingProtocols
+		util.ObserveRequest(o)
+
+		if o.Slow {
+			fields := log.Fields{
+				"uri":         util.RedactURI(r.URL.RequestURI()),
+				"status":      o.Status,
+				"duration_ms": o.Duration.Milliseconds(),
+			}
+			var accounted time.Duration
+			for phase, d := range o.Phases {
+				fields[phase+"_ms"] = d.Milliseconds()
+				accounted += d
+			}
+			fields["other_ms"] = (o.Duration - accounted).Milliseconds()
+			requestLog(r).WithFields(fields).Warn("slow request")
+		}
+	})
+}
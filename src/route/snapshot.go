@@ -0,0 +1,107 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Export and restore of the policy store snapshots
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+// PolicySnapshotHandler downloads a snapshot of the policy stores, or restores a snapshot on POST.
+// The dryRun query parameter reports the changes without writing them, and prune deletes the records
+// missing in the snapshot.
+func PolicySnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		snapshot := policy.ExportSnapshot()
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="burnell-snapshot-%s.json"`, snapshot.CreatedAt.Format("20060102T150405Z")))
+		w.Write(data)
+		return
+	}
+
+	query := r.URL.Query()
+	flags := map[string]bool{}
+	for _, name := range []string{"dryRun", "prune"} {
+		if v := query.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				util.ResponseErrorJSON(fmt.Errorf("%s must be a boolean", name), w, http.StatusUnprocessableEntity)
+				return
+			}
+			flags[name] = b
+		}
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || !json.Valid(body) {
+		util.ResponseErrorJSON(errors.New("invalid snapshot"), w, http.StatusBadRequest)
+		return
+	}
+	// a snapshot of an older schema version is migrated before the restore
+	snapshot, err := policy.DecodeSnapshot(body)
+	if err == nil {
+		err = policy.ValidateSnapshot(snapshot)
+	}
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	event := audit.Event{
+		Subject:    r.Header.Get(injectedSubs),
+		Action:     "policy.restore",
+		Resource:   "snapshot " + snapshot.CreatedAt.UTC().Format(time.RFC3339),
+		RemoteAddr: r.RemoteAddr,
+	}
+	report, err := policy.RestoreSnapshot(snapshot, flags["dryRun"], flags["prune"])
+	if !report.DryRun {
+		event.Outcome = audit.Succeeded
+		if err != nil {
+			event.Outcome, event.Reason = audit.Failed, err.Error()
+		}
+		audit.Record(event)
+	}
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
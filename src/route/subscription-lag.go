@@ -0,0 +1,63 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// SubscriptionLagHandler returns the backlog and the estimated time to drain of the subscriptions of a tenant,
+// sorted by the sort query parameter default to backlog, in the descending order unless the order is asc.
+// The n query parameter limits the number of subscriptions.
+func SubscriptionLagHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	params := r.URL.Query()
+	by := queryParamString(params, "sort", "backlog")
+	order := queryParamString(params, "order", "desc")
+	n := queryParamInt(params, "n", 0)
+	if !util.StrContains(metrics.SubscriptionLagSorts, by) || (order != "asc" && order != "desc") || n < 0 {
+		http.Error(w, "invalid sort, order, or n query parameter", http.StatusUnprocessableEntity)
+		return
+	}
+
+	report, err := metrics.GetSubscriptionLag(tenant, by, order == "asc")
+	if err != nil {
+		requestLog(r).Errorf("failed to compute the subscription lag of tenant %s error %v", tenant, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	if n > 0 && len(report) > n {
+		report = report[:n]
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
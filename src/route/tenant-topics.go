@@ -0,0 +1,160 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// TopicSummary is a topic of a tenant with its key stats
+type TopicSummary struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Partitions is zero for a non-partitioned topic
+	Partitions int `json:"partitions"`
+	metrics.TopicMetrics
+}
+
+// TenantTopicsResponse is a page of the topics of a tenant sorted by name
+type TenantTopicsResponse struct {
+	Tenant       string         `json:"tenant"`
+	Offset       int            `json:"offset"`
+	Total        int            `json:"total"`
+	MetricsError string         `json:"metricsError,omitempty"`
+	Topics       []TopicSummary `json:"topics"`
+}
+
+// listTenantTopics lists the topics of the namespaces of a tenant from the admin REST API with a call per namespace,
+// the partitions are grouped into the partitioned topics
+func listTenantTopics(tenant, namespace string) (map[string]*TopicSummary, int, error) {
+	adminURL := util.AdminURL(tenant)
+	namespaces := []string{tenant + "/" + url.PathEscape(namespace)}
+	if namespace == "" {
+		if status, err := getAdminJSON(util.SingleJoinSlash(adminURL, "admin/v2/namespaces/"+url.PathEscape(tenant)), &namespaces); err != nil {
+			return nil, status, err
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var status int
+	var listErr error
+	topics := make(map[string]*TopicSummary)
+	for _, ns := range namespaces {
+		wg.Add(1)
+		go func(ns string) {
+			defer wg.Done()
+			names := []string{}
+			code, err := getAdminJSON(util.SingleJoinSlash(adminURL, "admin/v2/namespaces/"+ns+"/topics"), &names)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				status, listErr = code, err
+				return
+			}
+			for _, name := range names {
+				partitions := 0
+				if i := strings.LastIndex(name, "-partition-"); i > 0 {
+					name, partitions = name[:i], 1
+				}
+				if t, ok := topics[name]; ok {
+					t.Partitions += partitions
+				} else {
+					topics[name] = &TopicSummary{Name: name, Namespace: ns, Partitions: partitions}
+				}
+			}
+		}(ns)
+	}
+	wg.Wait()
+	return topics, status, listErr
+}
+
+// TenantTopicsHandler returns a page of the topics of a tenant with the rates, the backlog, and the storage size
+// from the metrics cache, so that the stats do not need a call per topic. The namespace query parameter limits the
+// topics to a namespace.
+func TenantTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	params := r.URL.Query()
+	offset := queryParamInt(params, "offset", 0)
+	limit := queryParamInt(params, "limit", 50)
+	if strings.Contains(params.Get("namespace"), "/") {
+		util.ResponseErrorJSON(fmt.Errorf("namespace must be the local name without the tenant"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if offset < 0 || limit < 1 {
+		util.ResponseErrorJSON(fmt.Errorf("offset must not be negative and limit must be positive"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	topics, status, err := listTenantTopics(tenant, params.Get("namespace"))
+	if err != nil {
+		requestLog(r).Errorf("failed to list the topics of tenant %s error %v", tenant, err)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		util.ResponseErrorJSON(err, w, status)
+		return
+	}
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp := TenantTopicsResponse{Tenant: tenant, Total: len(names), Topics: []TopicSummary{}}
+	stats, err := metrics.GetTopicMetrics(tenant)
+	if err != nil {
+		requestLog(r).Warnf("topics of tenant %s without stats because of error %v", tenant, err)
+		resp.MetricsError = err.Error()
+	}
+	end := offset + limit
+	if end > len(names) {
+		end = len(names)
+	}
+	for i := offset; i < end; i++ {
+		topic := *topics[names[i]]
+		topic.TopicMetrics = stats[topic.Name]
+		resp.Topics = append(resp.Topics, topic)
+	}
+	resp.Offset = end
+	if offset > end {
+		resp.Offset = offset
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
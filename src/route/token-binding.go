@@ -0,0 +1,81 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Verification of the tokens bound to a client certificate or network ranges
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/util"
+)
+
+// requestClientCert returns the client certificate of the TLS connection, or of the header forwarded by
+// a TLS terminating load balancer among the trusted proxies. It is nil if the client presents no certificate.
+func requestClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0]
+	}
+	header := util.GetConfig().TokenBinding.ClientCertHeader
+	if header == "" || r.Header.Get(header) == "" || !util.IsTrustedProxy(remoteHost(r)) {
+		return nil
+	}
+	pemStr, err := url.QueryUnescape(r.Header.Get(header))
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(pemStr))
+	if block == nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// verifyTokenBinding checks a bound token is presented with its client certificate and from its network ranges
+func verifyTokenBinding(r *http.Request, verified icrypto.VerifiedToken) error {
+	if verified.Binding == nil {
+		return nil
+	}
+	if err := verified.Binding.Verify(requestClientCert(r), clientIP(r)); err != nil {
+		requestLog(r).Warnf("reject the bound token of subject %s, %v", verified.Subject, err)
+		return err
+	}
+	return nil
+}
+
+// queryTokenBinding parses the binding of a token to mint from the cnf and allowed_cidrs query parameters
+func queryTokenBinding(params url.Values) (*icrypto.TokenBinding, error) {
+	cidrs := []string{}
+	if str := params.Get("allowed_cidrs"); str != "" {
+		cidrs = strings.Split(str, ",")
+	}
+	return icrypto.NewTokenBinding(params.Get("cnf"), cidrs)
+}
@@ -0,0 +1,180 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Verified token cache, a local cache in front of the shared cache. It is only enabled with the shared cache.
+// Tokens are keyed by their digest so neither cache holds a usable token. The local cache is sharded by
+// the digest with a lock per shard, so a burst of verifications does not contend on a single lock.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/util"
+)
+
+const (
+	maxVerifiedTokens = 10000
+	// tokenCacheShards is a power of two, a token is in the shard of the first byte of its digest
+	tokenCacheShards = 32
+
+	// tokenCacheName is the token cache in the cache memory budget
+	tokenCacheName = "tokens"
+	// cachedTokenOverhead is the estimated size of a cached token besides its key and subject
+	cachedTokenOverhead = 256
+)
+
+type cachedToken struct {
+	verified  icrypto.VerifiedToken
+	expiresAt time.Time
+}
+
+type tokenCacheShard struct {
+	lock   sync.RWMutex
+	tokens map[string]cachedToken
+}
+
+var verifiedTokens [tokenCacheShards]tokenCacheShard
+
+func init() {
+	for i := range verifiedTokens {
+		verifiedTokens[i].tokens = make(map[string]cachedToken)
+	}
+	util.RegisterBudgetedCache(tokenCacheName, func(key string) {
+		shard := tokenShard(key)
+		shard.lock.Lock()
+		delete(shard.tokens, key)
+		shard.lock.Unlock()
+	})
+}
+
+// tokenShard returns the shard of a hex encoded token digest
+func tokenShard(key string) *tokenCacheShard {
+	var b byte
+	if len(key) >= 2 {
+		if decoded, err := hex.DecodeString(key[:2]); err == nil {
+			b = decoded[0]
+		}
+	}
+	return &verifiedTokens[b&(tokenCacheShards-1)]
+}
+
+// verifyToken verifies a token, a verified token is cached up to the cache TTL but never beyond its own expiry
+func verifyToken(tokenStr string) (icrypto.VerifiedToken, error) {
+	ttl := util.VerifiedTokenTTL()
+	if ttl == 0 {
+		return verifyTokenSignature(tokenStr)
+	}
+	sum := sha256.Sum256([]byte(tokenStr))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	shard := tokenShard(key)
+	shard.lock.RLock()
+	cached, ok := shard.tokens[key]
+	shard.lock.RUnlock()
+	if ok && now.Before(cached.expiresAt) {
+		util.TouchCacheEntry(tokenCacheName, key)
+		return cached.verified, nil
+	}
+
+	if data, ok := util.SharedCacheGetSigned("token:" + key); ok {
+		verified := icrypto.VerifiedToken{}
+		if err := json.Unmarshal(data, &verified); err == nil && (verified.ExpiresAt.IsZero() || now.Before(verified.ExpiresAt)) {
+			cacheVerifiedToken(key, verified, tokenCacheExpiry(now, ttl, verified))
+			return verified, nil
+		}
+	}
+
+	verified, err := verifyTokenSignature(tokenStr)
+	if err != nil {
+		return verified, err
+	}
+	expiresAt := tokenCacheExpiry(now, ttl, verified)
+	cacheVerifiedToken(key, verified, expiresAt)
+	if data, err := json.Marshal(verified); err == nil {
+		util.SharedCacheSetSigned("token:"+key, data, expiresAt.Sub(now))
+	}
+	return verified, nil
+}
+
+// verifyTokenSignature verifies a token on a worker of the bounded verification pool
+func verifyTokenSignature(tokenStr string) (verified icrypto.VerifiedToken, err error) {
+	if poolErr := util.RunTokenVerification(func() {
+		verified, err = util.JWTAuth.VerifyToken(tokenStr)
+	}); poolErr != nil {
+		return icrypto.VerifiedToken{}, poolErr
+	}
+	return verified, err
+}
+
+// respondVerificationOverloaded responds 503 if the error is a token verification shed by the pool
+func respondVerificationOverloaded(w http.ResponseWriter, err error) bool {
+	if err != util.ErrVerificationOverloaded {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+func tokenCacheExpiry(now time.Time, ttl time.Duration, verified icrypto.VerifiedToken) time.Time {
+	expiresAt := now.Add(ttl)
+	if !verified.ExpiresAt.IsZero() && verified.ExpiresAt.Before(expiresAt) {
+		return verified.ExpiresAt
+	}
+	return expiresAt
+}
+
+// cacheVerifiedToken adds a token to the local cache, the expired tokens of a shard are evicted when the shard is full
+func cacheVerifiedToken(key string, verified icrypto.VerifiedToken, expiresAt time.Time) {
+	var removed []string
+	shard := tokenShard(key)
+	shard.lock.Lock()
+	if len(shard.tokens) >= maxVerifiedTokens/tokenCacheShards {
+		now := time.Now()
+		for k, v := range shard.tokens {
+			if !now.Before(v.expiresAt) {
+				delete(shard.tokens, k)
+				removed = append(removed, k)
+			}
+		}
+		if len(shard.tokens) >= maxVerifiedTokens/tokenCacheShards {
+			for k := range shard.tokens {
+				removed = append(removed, k)
+			}
+			shard.tokens = make(map[string]cachedToken)
+		}
+	}
+	shard.tokens[key] = cachedToken{verified: verified, expiresAt: expiresAt}
+	shard.lock.Unlock()
+
+	for _, k := range removed {
+		util.ForgetCacheEntry(tokenCacheName, k)
+	}
+	util.TrackCacheEntry(tokenCacheName, key, int64(cachedTokenOverhead+len(key)+len(verified.Subject)))
+}
@@ -0,0 +1,185 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Tenant triggered topic compaction and offload with guardrails
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// topic operations
+const (
+	compactionOperation = "compaction"
+	offloadOperation    = "offload"
+)
+
+const (
+	defaultTopicOpCooldown         = 1 * time.Hour
+	defaultTopicOpPerTenantPerHour = 10
+	defaultMinCompactionBacklog    = 64 << 20
+	defaultMinOffloadStorage       = 1 << 30
+)
+
+var (
+	topicOpGuards     = make(map[string]*util.OperationGuard)
+	topicOpGuardsOnce sync.Once
+)
+
+func topicOpGuard(operation string) *util.OperationGuard {
+	topicOpGuardsOnce.Do(func() {
+		cfg := util.GetConfig().TopicOperations
+		cooldown := defaultTopicOpCooldown
+		if cfg.CooldownSeconds > 0 {
+			cooldown = time.Duration(cfg.CooldownSeconds) * time.Second
+		}
+		hourly := defaultTopicOpPerTenantPerHour
+		if cfg.MaxPerTenantPerHour > 0 {
+			hourly = cfg.MaxPerTenantPerHour
+		}
+		for _, op := range []string{compactionOperation, offloadOperation} {
+			topicOpGuards[op] = util.NewOperationGuard(cooldown, hourly)
+		}
+	})
+	return topicOpGuards[operation]
+}
+
+// topicStats is the subset of the persistent topic stats the guardrails evaluate
+type topicStats struct {
+	StorageSize int64 `json:"storageSize"`
+	BacklogSize int64 `json:"backlogSize"`
+}
+
+// TopicOperationHandler triggers compaction or offload of a persistent topic on behalf of a tenant.
+// The operation is rejected if the topic is under the size threshold, or it is throttled by the cooldown
+// and the tenant hourly quota. The super roles bypass the guardrails. Every attempt is audited.
+func TopicOperationHandler(operation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		tenant, namespace, topic := vars["tenant"], vars["namespace"], vars["topic"]
+		resource := fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, topic)
+		subject := r.Header.Get(injectedSubs)
+		event := audit.Event{Subject: subject, Tenant: tenant, Action: "topic." + operation, Resource: resource, RemoteAddr: r.RemoteAddr}
+
+		topicURL := util.SingleJoinSlash(util.AdminURL(tenant), fmt.Sprintf("admin/v2/persistent/%s/%s/%s", tenant, namespace, topic))
+		_, role := ExtractTenant(subject)
+		guarded := !util.StrContains(util.SuperRoles, role)
+		if guarded {
+			if status, err := evaluateTopicOperation(operation, tenant, resource, topicURL); err != nil {
+				event.Outcome, event.Reason = audit.Denied, err.Error()
+				audit.Record(event)
+				util.ResponseErrorJSON(err, w, status)
+				return
+			}
+		}
+		// an operation failed upstream is not counted against the tenant
+		release := func() {
+			if guarded {
+				topicOpGuard(operation).Release(tenant, resource)
+			}
+		}
+
+		if operation == offloadOperation {
+			if err := setOffloadMessageID(r, topicURL); err != nil {
+				release()
+				event.Outcome, event.Reason = audit.Failed, err.Error()
+				audit.Record(event)
+				util.ResponseErrorJSON(err, w, http.StatusBadGateway)
+				return
+			}
+		}
+		event.Outcome = audit.Allowed
+		audit.Record(event)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		httpProxy(util.SingleJoinSlash(topicURL, operation), recorder, r)
+		if recorder.status >= http.StatusInternalServerError {
+			release()
+		}
+	}
+}
+
+// evaluateTopicOperation applies the size threshold and the throttling guardrails
+func evaluateTopicOperation(operation, tenant, resource, topicURL string) (int, error) {
+	cfg := util.GetConfig().TopicOperations
+	var stats topicStats
+	if status, err := getAdminJSON(util.SingleJoinSlash(topicURL, "stats"), &stats); err != nil {
+		if status == http.StatusNotFound {
+			return http.StatusNotFound, fmt.Errorf("topic is not found")
+		}
+		return http.StatusBadGateway, fmt.Errorf("failed to get topic stats %v", err)
+	}
+
+	switch operation {
+	case compactionOperation:
+		min := cfg.MinCompactionBacklogBytes
+		if min <= 0 {
+			min = defaultMinCompactionBacklog
+		}
+		if stats.BacklogSize < min {
+			return http.StatusUnprocessableEntity, fmt.Errorf("topic backlog %d bytes is below the compaction threshold %d bytes", stats.BacklogSize, min)
+		}
+	case offloadOperation:
+		min := cfg.MinOffloadStorageBytes
+		if min <= 0 {
+			min = defaultMinOffloadStorage
+		}
+		if stats.StorageSize < min {
+			return http.StatusUnprocessableEntity, fmt.Errorf("topic storage %d bytes is below the offload threshold %d bytes", stats.StorageSize, min)
+		}
+	}
+
+	if err := topicOpGuard(operation).Allow(tenant, resource); err != nil {
+		return http.StatusTooManyRequests, err
+	}
+	return 0, nil
+}
+
+// setOffloadMessageID offloads up to the last message of the topic if the request does not specify a message id
+func setOffloadMessageID(r *http.Request, topicURL string) error {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		var messageID map[string]interface{}
+		if _, err := getAdminJSON(util.SingleJoinSlash(topicURL, "lastMessageId"), &messageID); err != nil {
+			return fmt.Errorf("failed to get the last message id %v", err)
+		}
+		if body, err = json.Marshal(messageID); err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/json")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
@@ -0,0 +1,402 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Debugging peek and throwaway subscription consume of the tenant topics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// peekMaxBytes caps the payloads returned by a call
+	peekMaxBytes = 1024 * 1024
+	// a tenant can peek or consume once a second with a burst of 10 calls
+	peekRatePerSecond = 1
+	peekRateBurst     = 10
+
+	debugSubscriptionPrefix    = "burnell-debug-"
+	debugSubscriptionTTL       = 5 * time.Minute
+	maxDebugSubscriptionsPerNs = 5
+	// debugSubscriptionMaxAge is the longest lifetime of a throwaway subscription, a subscription unknown
+	// to the replica is swept once it is older, such as one left over by a restart
+	debugSubscriptionMaxAge = time.Hour
+)
+
+// PeekResponse is the messages of a peek or a consume, the subscription and its expiry are of a consume
+type PeekResponse struct {
+	Topic        string          `json:"topic"`
+	Subscription string          `json:"subscription,omitempty"`
+	ExpiresAt    *time.Time      `json:"expiresAt,omitempty"`
+	Messages     []PeekedMessage `json:"messages"`
+	// Truncated is true if there are more messages than returned within the size limit
+	Truncated bool `json:"truncated"`
+}
+
+// debugSubscription is a throwaway subscription created by a consume, which is deleted once it expires
+type debugSubscription struct {
+	topicURL  string
+	createdAt time.Time
+	expiresAt time.Time
+	timer     *time.Timer
+	busy      bool
+}
+
+var debugSubscriptions = struct {
+	sync.Mutex
+	subs map[string]*debugSubscription
+}{subs: map[string]*debugSubscription{}}
+
+var peekLimiters = struct {
+	sync.Mutex
+	tenants map[string]*rate.Limiter
+}{tenants: map[string]*rate.Limiter{}}
+
+func allowPeek(tenant string) bool {
+	peekLimiters.Lock()
+	l, ok := peekLimiters.tenants[tenant]
+	if !ok {
+		l = rate.NewLimiter(peekRatePerSecond, peekRateBurst)
+		peekLimiters.tenants[tenant] = l
+	}
+	peekLimiters.Unlock()
+	return l.Allow()
+}
+
+// debugTopicAccess checks the topic of a debugging read and records the audit event. It returns the event to
+// record the outcome, the topic full name, and whether the request can proceed.
+func debugTopicAccess(w http.ResponseWriter, r *http.Request, action string) (audit.Event, string, bool) {
+	vars := mux.Vars(r)
+	tenant, namespace, topic := vars["tenant"], vars["namespace"], vars["topic"]
+	topicFn := fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, topic)
+	event := audit.Event{Subject: r.Header.Get(injectedSubs), Tenant: tenant, Action: action, Resource: topicFn,
+		RemoteAddr: r.RemoteAddr}
+	deny := func(err error, status int) {
+		event.Outcome, event.Reason = audit.Denied, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, status)
+	}
+
+	if policy.IsPolicyTopic(topicFn) {
+		deny(policy.ErrPolicyTopic, http.StatusForbidden)
+		return event, topicFn, false
+	}
+	if !allowPeek(tenant) {
+		w.Header().Set("Retry-After", "1")
+		deny(fmt.Errorf("tenant %s is over the rate limit of the message peeks", tenant), http.StatusTooManyRequests)
+		return event, topicFn, false
+	}
+	return event, topicFn, true
+}
+
+// peekCount returns the count query parameter, 10 by default and 100 at most
+func peekCount(r *http.Request) (int, error) {
+	count := queryParamInt(r.URL.Query(), "count", defaultPeekCount)
+	if count < 1 || count > maxPeekCount {
+		return 0, fmt.Errorf("count must be between 1 and %d", maxPeekCount)
+	}
+	return count, nil
+}
+
+// TopicPeekHandler returns the most recent messages of a topic without a subscription
+func TopicPeekHandler(w http.ResponseWriter, r *http.Request) {
+	event, topicFn, ok := debugTopicAccess(w, r, "topic.peek")
+	if !ok {
+		return
+	}
+	fail := func(err error, status int) {
+		event.Outcome, event.Reason = audit.Failed, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, status)
+	}
+	count, err := peekCount(r)
+	if err != nil {
+		fail(err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	vars := mux.Vars(r)
+	topicURL := persistentTopicURL(vars["tenant"], vars["namespace"], vars["topic"])
+	messages, truncated, err := examineMessages(count, peekMaxBytes, func(position int) string {
+		return util.SingleJoinSlash(topicURL, "examinemessage?initialPosition=latest&messagePosition="+strconv.Itoa(position))
+	})
+	if err != nil {
+		requestLog(r).Errorf("failed to peek %s error %v", topicFn, err)
+		fail(errors.New("failed to peek the messages"), http.StatusBadGateway)
+		return
+	}
+	event.Outcome, event.Reason = audit.Succeeded, fmt.Sprintf("%d messages", len(messages))
+	audit.Record(event)
+	writePeekResponse(w, PeekResponse{Topic: topicFn, Messages: messages, Truncated: truncated})
+}
+
+// TopicConsumeHandler consumes the messages of a topic from a throwaway subscription. The subscription is created
+// at the earliest or the latest message by the first call, and the next calls continue with the subscription
+// query parameter. The subscription is deleted after 5 minutes without a call, an hour after its creation,
+// or by a DELETE.
+func TopicConsumeHandler(w http.ResponseWriter, r *http.Request) {
+	event, topicFn, ok := debugTopicAccess(w, r, "topic.consume")
+	if !ok {
+		return
+	}
+	fail := func(err error, status int) {
+		event.Outcome, event.Reason = audit.Failed, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, status)
+	}
+	vars := mux.Vars(r)
+	tenant, namespace, topic := vars["tenant"], vars["namespace"], vars["topic"]
+	topicURL := persistentTopicURL(tenant, namespace, topic)
+	params := r.URL.Query()
+	name := params.Get("subscription")
+	event.Resource += "/" + name
+
+	if r.Method == http.MethodDelete {
+		sub, status, err := acquireDebugSubscription(name, topicURL)
+		if err != nil {
+			fail(err, status)
+			return
+		}
+		deleteDebugSubscription(name, sub)
+		event.Outcome = audit.Succeeded
+		audit.Record(event)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	count, err := peekCount(r)
+	if err != nil {
+		fail(err, http.StatusUnprocessableEntity)
+		return
+	}
+	var sub *debugSubscription
+	var status int
+	if name == "" {
+		start := util.AssignString(params.Get("start"), "earliest")
+		if start != "earliest" && start != "latest" {
+			fail(errors.New("start must be earliest or latest"), http.StatusUnprocessableEntity)
+			return
+		}
+		name, sub, status, err = createDebugSubscription(topicURL, tenant+"/"+namespace, start)
+		event.Resource += name
+	} else {
+		sub, status, err = acquireDebugSubscription(name, topicURL)
+	}
+	if err != nil {
+		fail(err, status)
+		return
+	}
+
+	subURL := util.SingleJoinSlash(topicURL, "subscription/"+name)
+	messages, truncated, err := examineMessages(count, peekMaxBytes, func(position int) string {
+		return util.SingleJoinSlash(subURL, "position/"+strconv.Itoa(position))
+	})
+	if err == nil && len(messages) > 0 {
+		// the returned messages are acknowledged, the next call continues after them
+		_, err = sendAdmin(http.MethodPost, util.SingleJoinSlash(subURL, "skip/"+strconv.Itoa(len(messages))), nil)
+	}
+	expiresAt := releaseDebugSubscription(name, sub)
+	if err != nil {
+		requestLog(r).Errorf("failed to consume %s from %s error %v", topicFn, name, err)
+		fail(errors.New("failed to consume the messages"), http.StatusBadGateway)
+		return
+	}
+	event.Outcome, event.Reason = audit.Succeeded, fmt.Sprintf("%d messages", len(messages))
+	audit.Record(event)
+	writePeekResponse(w, PeekResponse{Topic: topicFn, Subscription: name, ExpiresAt: &expiresAt, Messages: messages,
+		Truncated: truncated})
+}
+
+func writePeekResponse(w http.ResponseWriter, res PeekResponse) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// createDebugSubscription creates a throwaway subscription of the topic, up to 5 per namespace. The subscription is
+// returned in use.
+func createDebugSubscription(topicURL, namespace, start string) (string, *debugSubscription, int, error) {
+	// the creation time in the name lets a sweep tell a left over subscription from one in use by another replica
+	b := make([]byte, 6)
+	rand.Read(b)
+	createdAt := time.Now()
+	name := debugSubscriptionPrefix + strconv.FormatInt(createdAt.Unix(), 10) + "-" + hex.EncodeToString(b)
+
+	// the subscription holds its slot of the namespace quota in use while it is created
+	sub := &debugSubscription{topicURL: topicURL, createdAt: createdAt, busy: true}
+	debugSubscriptions.Lock()
+	inNamespace := 0
+	for _, s := range debugSubscriptions.subs {
+		if strings.Contains(s.topicURL, "/persistent/"+namespace+"/") {
+			inNamespace++
+		}
+	}
+	if inNamespace >= maxDebugSubscriptionsPerNs {
+		debugSubscriptions.Unlock()
+		return "", nil, http.StatusTooManyRequests,
+			fmt.Errorf("namespace %s has %d debug subscriptions, delete one or wait for the expiry", namespace, inNamespace)
+	}
+	debugSubscriptions.subs[name] = sub
+	debugSubscriptions.Unlock()
+
+	var position interface{}
+	if start == "earliest" {
+		position = util.MessageID{LedgerID: -1, EntryID: -1, Partition: -1, BatchIndex: -1}
+	}
+	status, err := sendAdmin(http.MethodPut, util.SingleJoinSlash(topicURL, "subscription/"+name), position)
+	if err != nil || status == http.StatusNotFound {
+		debugSubscriptions.Lock()
+		delete(debugSubscriptions.subs, name)
+		debugSubscriptions.Unlock()
+	}
+	if status == http.StatusNotFound {
+		return "", nil, http.StatusNotFound, errors.New("topic not found")
+	} else if err != nil {
+		return "", nil, http.StatusBadGateway, err
+	}
+	return name, sub, http.StatusOK, nil
+}
+
+// acquireDebugSubscription marks a throwaway subscription of the topic in use, so the calls do not read
+// the same messages concurrently
+func acquireDebugSubscription(name, topicURL string) (*debugSubscription, int, error) {
+	debugSubscriptions.Lock()
+	defer debugSubscriptions.Unlock()
+	sub, ok := debugSubscriptions.subs[name]
+	if !ok || sub.topicURL != topicURL {
+		return nil, http.StatusNotFound, fmt.Errorf("debug subscription %s is not found or has expired", name)
+	}
+	if sub.busy {
+		return nil, http.StatusConflict, fmt.Errorf("debug subscription %s is in use", name)
+	}
+	sub.busy = true
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	return sub, http.StatusOK, nil
+}
+
+// releaseDebugSubscription releases a subscription in use and restarts its expiry, within the longest lifetime
+func releaseDebugSubscription(name string, sub *debugSubscription) time.Time {
+	debugSubscriptions.Lock()
+	defer debugSubscriptions.Unlock()
+	sub.busy = false
+	ttl := debugSubscriptionTTL
+	if remaining := time.Until(sub.createdAt.Add(debugSubscriptionMaxAge)); remaining < ttl {
+		ttl = remaining
+	}
+	sub.expiresAt = time.Now().Add(ttl).UTC()
+	sub.timer = time.AfterFunc(ttl, func() {
+		if acquired, _, err := acquireDebugSubscription(name, sub.topicURL); err == nil {
+			deleteDebugSubscription(name, acquired)
+		}
+	})
+	return sub.expiresAt
+}
+
+// deleteDebugSubscription deletes an acquired subscription from the topic. It is forgotten even if the delete fails
+// so that a broken topic does not hold the namespace quota.
+func deleteDebugSubscription(name string, sub *debugSubscription) {
+	if _, err := sendAdmin(http.MethodDelete, util.SingleJoinSlash(sub.topicURL, "subscription/"+name), nil); err != nil {
+		log.Errorf("failed to delete the debug subscription %s error %v", name, err)
+	}
+	debugSubscriptions.Lock()
+	delete(debugSubscriptions.subs, name)
+	debugSubscriptions.Unlock()
+}
+
+// debugSubscriptionCreated returns the creation time in the name of a throwaway subscription
+func debugSubscriptionCreated(name string) (time.Time, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(name, debugSubscriptionPrefix), "-", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// StartDebugSubscriptionSweep sweeps the left over throwaway subscriptions after every refresh of the topic stats
+// cache, at most once per subscription expiry. Only the leader sweeps when the leader election is enabled.
+func StartDebugSubscriptionSweep() {
+	go func() {
+		for {
+			<-policy.TopicStatsRefreshed()
+			if util.IsLeader() {
+				SweepDebugSubscriptions()
+			}
+			time.Sleep(debugSubscriptionTTL)
+		}
+	}()
+}
+
+// SweepDebugSubscriptions deletes the throwaway subscriptions of the cached topic stats that are unknown to
+// the replica and past the longest lifetime, such as the ones left over by a restart. It returns the number
+// of the deleted subscriptions.
+func SweepDebugSubscriptions() int {
+	deleted := 0
+	for topicFn, names := range policy.TopicSubscriptions(debugSubscriptionPrefix) {
+		tenant, namespace, topic, err := util.ExtractPartsFromTopicFn(topicFn)
+		if err != nil || !strings.HasPrefix(topicFn, "persistent://") {
+			continue
+		}
+		topicURL := persistentTopicURL(tenant, namespace, topic)
+		for _, name := range names {
+			debugSubscriptions.Lock()
+			_, inUse := debugSubscriptions.subs[name]
+			debugSubscriptions.Unlock()
+			// a subscription without the creation time is of an earlier version
+			if createdAt, ok := debugSubscriptionCreated(name); inUse || (ok && time.Since(createdAt) < debugSubscriptionMaxAge) {
+				continue
+			}
+			if _, err := sendAdmin(http.MethodDelete, util.SingleJoinSlash(topicURL, "subscription/"+name), nil); err != nil {
+				log.Errorf("failed to sweep the debug subscription %s of %s error %v", name, topicFn, err)
+				continue
+			}
+			log.Infof("swept the left over debug subscription %s of %s", name, topicFn)
+			deleted++
+		}
+	}
+	return deleted
+}
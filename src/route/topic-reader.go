@@ -0,0 +1,174 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Topic reader websocket proxy with a burnell controlled start position
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	wsproxy "github.com/koding/websocketproxy"
+)
+
+// readerParams are the reader settings passed through to the Pulsar websocket reader endpoint
+var readerParams = []string{"receiverQueueSize", "readerName"}
+
+// TopicReaderHandler proxies the Pulsar websocket reader of a topic. The start position is resolved and validated by
+// burnell, and the reader connects to Pulsar with the burnell token, so the client only needs a tenant token.
+func TopicReaderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	domain, tenant, namespace, topic := vars["domain"], vars["tenant"], vars["namespace"], vars["topic"]
+	event := audit.Event{Subject: r.Header.Get(injectedSubs), Tenant: tenant, Action: "topic.read",
+		Resource: fmt.Sprintf("%s://%s/%s/%s", domain, tenant, namespace, topic), RemoteAddr: r.RemoteAddr}
+
+	if policy.IsPolicyTopic(event.Resource) {
+		event.Outcome, event.Reason = audit.Denied, policy.ErrPolicyTopic.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(policy.ErrPolicyTopic, w, http.StatusForbidden)
+		return
+	}
+	position, status, err := readerStartPosition(r)
+	if err != nil {
+		event.Outcome, event.Reason = audit.Failed, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, status)
+		return
+	}
+	proxyURL, err := url.Parse(util.AssignString(util.GetConfig().WebsocketURL, "ws://localhost:8000"))
+	if err != nil {
+		util.ResponseErrorJSON(errors.New("malformed websocket URL"), w, http.StatusInternalServerError)
+		return
+	}
+	event.Outcome, event.Reason = audit.Succeeded, "start at "+position
+	audit.Record(event)
+
+	params := url.Values{}
+	for _, name := range readerParams {
+		if v := r.URL.Query().Get(name); v != "" {
+			params.Set(name, v)
+		}
+	}
+	params.Set("messageId", position)
+	backend := func(r *http.Request) *url.URL {
+		u := *proxyURL
+		u.Path = fmt.Sprintf("/ws/v2/reader/%s/%s/%s/%s", domain, tenant, namespace, url.PathEscape(topic))
+		u.RawQuery = params.Encode()
+		return &u
+	}
+	director := func(incoming *http.Request, out http.Header) {
+		if token := util.PulsarToken(); token != "" {
+			out.Set("Authorization", "Bearer "+token)
+		}
+	}
+	proxy := &wsproxy.WebsocketProxy{
+		Backend:  backend,
+		Director: director,
+		Upgrader: &websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     websocketOriginAllowed,
+		},
+	}
+	requestLog(r).Infof("read %s from %s", event.Resource, position)
+	proxy.ServeHTTP(util.NewStreamWriter(w, r, websocketWriteTimeout), r)
+}
+
+// readerStartPosition returns the messageId parameter of the Pulsar reader from one of the start, messageId, or
+// timestamp query parameters. The position defaults to the latest message.
+func readerStartPosition(r *http.Request) (string, int, error) {
+	vars := mux.Vars(r)
+	domain, tenant, namespace, topic := vars["domain"], vars["tenant"], vars["namespace"], vars["topic"]
+	params := r.URL.Query()
+	var set int
+	for _, name := range []string{"start", "messageId", "timestamp"} {
+		if params.Get(name) != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", http.StatusBadRequest, errors.New("only one of start, messageId, and timestamp can be specified")
+	}
+
+	if start := util.AssignString(params.Get("start"), "latest"); set == 0 || params.Get("start") != "" {
+		if start != "earliest" && start != "latest" {
+			return "", http.StatusBadRequest, errors.New("start must be earliest or latest")
+		}
+		return start, http.StatusOK, nil
+	}
+	if domain != "persistent" {
+		return "", http.StatusUnprocessableEntity,
+			errors.New("a non-persistent topic can only be read from the earliest or the latest message")
+	}
+
+	if s := params.Get("messageId"); s != "" {
+		id, err := util.ParseMessageID(s)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		// a message id of another partition would move the reader out of the authorized topic
+		if id.Partition >= 0 && id.Partition != util.TopicPartitionIndex(topic) {
+			return "", http.StatusUnprocessableEntity, fmt.Errorf("message id %s is not of the topic %s", id, topic)
+		}
+		return id.Base64(), http.StatusOK, nil
+	}
+
+	ts, err := parseReaderTimestamp(params.Get("timestamp"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if ts.After(time.Now()) {
+		return "", http.StatusUnprocessableEntity, errors.New("timestamp is in the future")
+	}
+	id := util.MessageID{Partition: -1, BatchIndex: -1}
+	requestURL := util.SingleJoinSlash(persistentTopicURL(tenant, namespace, topic),
+		"messageid/"+strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10))
+	status, err := getAdminJSON(requestURL, &id)
+	if status == http.StatusNotFound {
+		return "", http.StatusNotFound, fmt.Errorf("topic %s not found", topic)
+	} else if err != nil {
+		requestLog(r).Errorf("failed to resolve the message id of %s/%s/%s at %v error %v", tenant, namespace, topic, ts, err)
+		return "", http.StatusBadGateway, errors.New("failed to resolve the message id of the timestamp")
+	}
+	return id.Base64(), http.StatusOK, nil
+}
+
+// parseReaderTimestamp parses a RFC3339 time or Unix milliseconds
+func parseReaderTimestamp(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil && ms >= 0 {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(s)); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("timestamp %s must be RFC3339 or Unix milliseconds", s)
+}
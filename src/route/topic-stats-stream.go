@@ -0,0 +1,166 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+// Server-sent events stream of the tenant topic stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	topicStatsStreamMaxTopics    = 50
+	topicStatsStreamMaxPerTenant = 20
+	topicStatsStreamHeartbeat    = 15 * time.Second
+	// topicStatsStreamWriteTimeout bounds every event write, the stream itself is not bound by the server write timeout
+	topicStatsStreamWriteTimeout = 10 * time.Second
+)
+
+// TopicStatsSnapshot is the data of a topic stats event
+type TopicStatsSnapshot struct {
+	Tenant      string                 `json:"tenant"`
+	Total       int                    `json:"total"`
+	Data        map[string]interface{} `json:"data"`
+	GeneratedAt time.Time              `json:"generatedAt"`
+}
+
+var topicStatsStreams = make(map[string]int)
+var topicStatsStreamsLock sync.Mutex
+
+// TopicStatsStreamHandler streams the topic stats snapshot of a tenant as server-sent events. A snapshot is sent
+// on connect and after every refresh of the topic stats cache that changes the stats of the selected topics.
+func TopicStatsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	params := r.URL.Query()
+	topics, namespace := params["topic"], params.Get("namespace")
+	if len(topics) > topicStatsStreamMaxTopics {
+		util.ResponseErrorJSON(fmt.Errorf("at most %d topics can be streamed", topicStatsStreamMaxTopics), w, http.StatusBadRequest)
+		return
+	}
+	for _, topic := range topics {
+		// a listed topic missing from the cache is polled from the admin API, so it must be of the tenant
+		if topicTenant, _, _, err := util.ExtractPartsFromTopicFn(topic); err != nil || topicTenant != tenant {
+			util.ResponseErrorJSON(fmt.Errorf("topic %s is not a topic full name of the tenant %s", topic, tenant), w, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		util.ResponseErrorJSON(errors.New("streaming is not supported"), w, http.StatusInternalServerError)
+		return
+	}
+
+	topicStatsStreamsLock.Lock()
+	if topicStatsStreams[tenant] >= topicStatsStreamMaxPerTenant {
+		topicStatsStreamsLock.Unlock()
+		util.ResponseErrorJSON(fmt.Errorf("the tenant has %d topic stats streams open", topicStatsStreamMaxPerTenant), w, http.StatusTooManyRequests)
+		return
+	}
+	topicStatsStreams[tenant]++
+	topicStatsStreamsLock.Unlock()
+	defer func() {
+		topicStatsStreamsLock.Lock()
+		if topicStatsStreams[tenant]--; topicStatsStreams[tenant] <= 0 {
+			delete(topicStatsStreams, tenant)
+		}
+		topicStatsStreamsLock.Unlock()
+	}()
+
+	stream := util.NewStreamWriter(w, r, topicStatsStreamWriteTimeout)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// a reverse proxy must not buffer the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	stream.Flush()
+
+	heartbeat := time.NewTicker(topicStatsStreamHeartbeat)
+	defer heartbeat.Stop()
+	var last []byte
+	for id := 1; ; {
+		// the channel is taken before the snapshot, so a refresh in between is not missed
+		refreshed := policy.TopicStatsRefreshed()
+		snapshot := topicStatsSnapshot(tenant, namespace, topics)
+		// the map keys are marshaled in order, an unchanged snapshot is skipped
+		stats, err := json.Marshal(snapshot.Data)
+		if err != nil {
+			requestLog(r).Errorf("failed to marshal the topic stats of %s error %v", tenant, err)
+			return
+		}
+		if !bytes.Equal(stats, last) {
+			last = stats
+			data, _ := json.Marshal(snapshot)
+			if _, err := fmt.Fprintf(stream, "id: %d\nevent: stats\ndata: %s\n\n", id, data); err != nil {
+				return
+			}
+			stream.Flush()
+			id++
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(stream, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				stream.Flush()
+			case <-refreshed:
+				waiting = false
+			}
+		}
+	}
+}
+
+// topicStatsSnapshot returns the cached stats of the tenant topics in the namespace, or of the listed topics
+func topicStatsSnapshot(tenant, namespace string, topics []string) TopicStatsSnapshot {
+	snapshot := TopicStatsSnapshot{Tenant: tenant, Data: make(map[string]interface{}), GeneratedAt: time.Now().UTC()}
+	_, _, all := policy.PaginateTopicStats(tenant, 0, math.MaxInt32, topics)
+	selected := make(map[string]bool)
+	for _, topic := range topics {
+		selected[topic], selected[util.PartitionPrefix+topic] = true, true
+	}
+	for name, stats := range all {
+		if len(topics) > 0 && !selected[name] {
+			continue
+		}
+		if namespace != "" && !strings.Contains(name, "://"+tenant+"/"+namespace+"/") {
+			continue
+		}
+		snapshot.Data[strings.TrimPrefix(name, util.PartitionPrefix)] = stats
+	}
+	snapshot.Total = len(snapshot.Data)
+	return snapshot
+}
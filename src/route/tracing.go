@@ -0,0 +1,112 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing middleware starts a server span per request as a child of the incoming W3C traceparent
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				name = tpl
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := util.StartSpan(ctx, r.Method+" "+name, trace.SpanKindServer,
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(name),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+			attribute.String("request_id", r.Header.Get(requestIDHeader)),
+		)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		// the subject is injected by the authentication middleware
+		if subject := r.Header.Get(injectedSubs); subject != "" {
+			span.SetAttributes(attribute.String("subject", subject))
+		}
+		util.EndSpan(span, recorder.status, nil)
+	})
+}
+
+// statusRecorder records the response status code and body size
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	// timings collects the time spent writing the body as the serialization phase if set
+	timings *util.RequestTimings
+	// body captures the response body up to its limit if set
+	body *cappedBuffer
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.timings != nil {
+		start := time.Now()
+		defer func() { s.timings.Add(util.PhaseSerialization, time.Since(start)) }()
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += n
+	if s.body != nil {
+		s.body.Write(p[:n])
+	}
+	return n, err
+}
+
+// Flush supports the streaming responses
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack supports the websocket proxy
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
@@ -0,0 +1,143 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// UsageStatementsHandler returns the usage statements of a cycle in JSON or CSV, the cycle query parameter
+// default to the current cycle and the format query parameter is json or csv. The split=labels query parameter
+// returns a CSV row per cost allocation. A route without a tenant returns the statements of all tenants.
+func UsageStatementsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cycle := query.Get("cycle")
+	if cycle == "" {
+		cycle = metrics.UsageCycle(time.Now())
+	} else if _, err := time.Parse(metrics.UsageCycleFormat, cycle); err != nil {
+		util.ResponseErrorJSON(fmt.Errorf("invalid cycle %s, the format is 2006-01", cycle), w, http.StatusBadRequest)
+		return
+	}
+	tenant := mux.Vars(r)["tenant"]
+	statements := metrics.GetUsageStatements(tenant, cycle)
+
+	name := "usage-" + cycle
+	if tenant != "" {
+		name = "usage-" + tenant + "-" + cycle
+	}
+	switch format := strings.ToLower(query.Get("format")); format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+		write := metrics.WriteUsageStatementsCSV
+		if query.Get("split") == "labels" {
+			write = metrics.WriteCostAllocationsCSV
+		}
+		if err := write(w, statements); err != nil {
+			requestLog(r).Errorf("failed to write usage statements error %v", err)
+		}
+	case "", "json":
+		data, err := json.Marshal(statements)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+		w.Write(data)
+	default:
+		util.ResponseErrorJSON(fmt.Errorf("unsupported format %s, it must be json or csv", format), w, http.StatusBadRequest)
+	}
+}
+
+// UsageForecastHandler returns the storage and peak throughput forecasts projected by the trends of the daily usage,
+// over the days query parameter default to 30. A route without a tenant returns the forecasts of all tenants.
+func UsageForecastHandler(w http.ResponseWriter, r *http.Request) {
+	horizon := metrics.DefaultForecastHorizonDays
+	if str := r.URL.Query().Get("days"); str != "" {
+		var err error
+		if horizon, err = strconv.Atoi(str); err != nil || horizon < 1 || horizon > 365 {
+			util.ResponseErrorJSON(fmt.Errorf("invalid days %s, it must be 1 to 365", str), w, http.StatusBadRequest)
+			return
+		}
+	}
+	tenant, ok := mux.Vars(r)["tenant"]
+	forecasts := metrics.GetUsageForecasts(tenant, horizon)
+	var data []byte
+	var err error
+	if ok {
+		if len(forecasts) == 0 {
+			util.ResponseErrorJSON(fmt.Errorf("tenant %s has no usage history", tenant), w, http.StatusNotFound)
+			return
+		}
+		data, err = json.Marshal(forecasts[0])
+	} else {
+		data, err = json.Marshal(forecasts)
+	}
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// StorageHistoryHandler returns the daily storage and offloaded sizes over the days query parameter, default to all
+// the retained days. A route without a tenant returns the histories of all tenants.
+func StorageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	days := 0
+	if str := r.URL.Query().Get("days"); str != "" {
+		var err error
+		if days, err = strconv.Atoi(str); err != nil || days < 1 {
+			util.ResponseErrorJSON(fmt.Errorf("invalid days %s, it must be a positive integer", str), w, http.StatusBadRequest)
+			return
+		}
+	}
+	tenant, ok := mux.Vars(r)["tenant"]
+	histories := metrics.GetStorageHistory(tenant, days)
+	var data []byte
+	var err error
+	if ok {
+		if len(histories) == 0 {
+			util.ResponseErrorJSON(fmt.Errorf("tenant %s has no usage history", tenant), w, http.StatusNotFound)
+			return
+		}
+		data, err = json.Marshal(histories[0])
+	} else {
+		data, err = json.Marshal(histories)
+	}
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
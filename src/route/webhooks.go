@@ -0,0 +1,146 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// WebhooksHandler lists the webhooks of a tenant with GET, registers a webhook with POST, and deletes a webhook
+// with DELETE. A route without a tenant manages the operator webhooks, which receive the events of all tenants.
+func WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	if r.Method == http.MethodGet {
+		data, err := json.Marshal(util.ListWebhooks(tenant))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	if policy.WebhookStore == nil {
+		util.ResponseErrorJSON(fmt.Errorf("webhook store is not initialized"), w, http.StatusServiceUnavailable)
+		return
+	}
+	event := audit.Event{Subject: r.Header.Get(injectedSubs), Tenant: tenant, RemoteAddr: r.RemoteAddr}
+
+	if r.Method == http.MethodDelete {
+		event.Action, event.Resource = "webhook.delete", vars["id"]
+		if err := policy.WebhookStore.DeleteWebhook(tenant, vars["id"]); err != nil {
+			event.Outcome, event.Reason = audit.Failed, err.Error()
+			audit.Record(event)
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		event.Outcome = audit.Succeeded
+		audit.Record(event)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req policy.WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	event.Action = "webhook.create"
+	hook, err := policy.WebhookStore.CreateWebhook(tenant, req)
+	if err != nil {
+		event.Outcome, event.Reason = audit.Failed, err.Error()
+		audit.Record(event)
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	event.Resource, event.Outcome = hook.ID, audit.Succeeded
+	audit.Record(event)
+
+	data, err := json.Marshal(hook)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// WebhookDeliveriesHandler returns the recent webhook deliveries filtered by the tenant and status query parameters
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "", util.DeliveryPending, util.DeliverySucceeded, util.DeliveryFailed:
+	default:
+		util.ResponseErrorJSON(fmt.Errorf("invalid status %s", status), w, http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(util.GetWebhookDeliveries(query.Get("tenant"), status))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// notifyTokenExpiring notifies the tenant of a token used within the warning window before its expiry,
+// once per token
+func notifyTokenExpiring(subject string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		return
+	}
+	warning := time.Duration(util.GetConfig().Notifications.TokenExpiryWarningHours) * time.Hour
+	if warning <= 0 {
+		warning = 72 * time.Hour
+	}
+	remaining := time.Until(expiresAt)
+	if remaining <= 0 || remaining > warning {
+		return
+	}
+	_, tenant := ExtractTenant(subject)
+	util.Notify(util.EventTokenExpiring, tenant, subject+"|"+expiresAt.UTC().Format(time.RFC3339), warning,
+		map[string]interface{}{"subject": subject, "expiresAt": expiresAt.UTC()})
+}
+
+// notifyQuotaBreached notifies the tenant of a request rejected over the plan limit
+func notifyQuotaBreached(r *http.Request, tenant string) {
+	key := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			key = tpl
+		}
+	}
+	util.Notify(util.EventQuotaBreached, tenant, key, util.NotificationCooldown(), map[string]interface{}{
+		"subject": r.Header.Get(injectedSubs),
+		"method":  r.Method,
+		"path":    r.URL.Path,
+	})
+}
@@ -22,15 +22,40 @@
 package route
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/datastax/burnell/src/icrypto"
 	"github.com/datastax/burnell/src/util"
 	"github.com/gorilla/websocket"
 	wsproxy "github.com/koding/websocketproxy"
 )
 
+// websocketWriteTimeout bounds every message write of a proxied websocket
+const websocketWriteTimeout = 30 * time.Second
+
+// websocketOriginAllowed checks the Origin of a websocket upgrade against the host and the WebsocketAllowedOrigins.
+// A request without the Origin header is not from a browser and is allowed.
+func websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range util.GetConfig().WebsocketAllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
 // WebsocketAuthProxyHandler is the websocket proxy
 func WebsocketAuthProxyHandler(w http.ResponseWriter, r *http.Request) {
 	proxyURLStr := util.AssignString(util.GetConfig().WebsocketURL, "ws://localhost:8000")
@@ -46,15 +71,40 @@ func WebsocketAuthProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// an API key or a delegated token is exchanged for a short lived token of its subject after its scope is
+	// enforced, since Pulsar only accepts the tokens and is unaware of the scope
+	upstreamToken, status, err := websocketAPIKeyToken(r)
+	if err == nil && upstreamToken == "" {
+		upstreamToken, status, err = websocketDelegatedToken(r)
+	}
+	if err != nil {
+		requestLog(r).Errorf("websocket credential error %v", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if upstreamToken == "" && websocketBoundTokenRejected(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	backend := func(r *http.Request) *url.URL {
 		// Shallow copy
 		u := proxyURL
 		u.Fragment = r.URL.Fragment
 		u.Path = r.URL.Path
 		u.RawQuery = r.URL.RawQuery
+		if upstreamToken != "" {
+			params := r.URL.Query()
+			params.Del("token")
+			u.RawQuery = params.Encode()
+		}
 		return u
 	}
 	director := func(incoming *http.Request, out http.Header) {
+		if upstreamToken != "" {
+			out.Set("Authorization", "Bearer "+upstreamToken)
+			return
+		}
 		u, _ := url.Parse(incoming.URL.String())
 		params := u.Query()
 		if tokenStr, ok := params["token"]; ok {
@@ -74,5 +124,103 @@ func WebsocketAuthProxyHandler(w http.ResponseWriter, r *http.Request) {
 		Director: director,
 		Upgrader: &upgrader,
 	}
-	proxy.ServeHTTP(w, r)
+	proxy.ServeHTTP(util.NewStreamWriter(w, r, websocketWriteTimeout), r)
+}
+
+// websocketAPIKeyToken resolves the API key in the token query parameter or the X-API-Key header,
+// and generates a token of the key subject. It returns an empty token if the request has no API key
+// or the JWT authentication is disabled.
+func websocketAPIKeyToken(r *http.Request) (string, int, error) {
+	keyStr := r.Header.Get(util.APIKeyHeader)
+	if token := r.URL.Query().Get("token"); util.IsAPIKey(token) {
+		keyStr = token
+	}
+	if keyStr == "" || !util.IsPulsarJWTEnabled() {
+		return "", http.StatusOK, nil
+	}
+	subject, scope, err := apiKeySubjectAndScope(r, clientIP(r), keyStr)
+	if banned, ok := err.(authBannedError); ok {
+		return "", http.StatusTooManyRequests, banned
+	}
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	return websocketExchangeToken(r, subject, scope, "API key")
+}
+
+// websocketDelegatedToken generates a token of the subject of a delegated token within its scope. It returns an empty
+// token if the request has no delegated token, a token failing the verification is left to Pulsar to reject.
+func websocketDelegatedToken(r *http.Request) (string, int, error) {
+	tokenStr := websocketRequestToken(r)
+	if tokenStr == "" || !util.IsPulsarJWTEnabled() {
+		return "", http.StatusOK, nil
+	}
+	verified, err := verifyToken(tokenStr)
+	if err != nil || verified.Scope == nil {
+		return "", http.StatusOK, nil
+	}
+	if err := verifyTokenBinding(r, verified); err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	return websocketExchangeToken(r, verified.Subject, verified.Scope, "delegated token")
+}
+
+// websocketExchangeToken checks the scope against the topic of the websocket path, and generates a token of the
+// subject valid for 10 minutes
+func websocketExchangeToken(r *http.Request, subject string, scope *icrypto.DelegationScope, credential string) (string, int, error) {
+	if scope != nil {
+		namespace, permission := websocketTopicScope(r.URL.Path)
+		if !scope.AllowsNamespace(namespace) || !scope.AllowsPermission(permission) {
+			return "", http.StatusForbidden, fmt.Errorf("%s is not scoped to %s %s", credential, permission, namespace)
+		}
+	}
+	ttl, alg, err := icrypto.ValidateClaims("10m", "rs256")
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	token, err := util.JWTAuth.GenerateToken(subject, ttl, alg)
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to generate the token of the %s", credential)
+	}
+	return token, http.StatusOK, nil
+}
+
+// websocketBoundTokenRejected checks the binding of the token passed to Pulsar, which is unaware of the binding.
+// A token failing the verification is left to Pulsar to reject.
+func websocketBoundTokenRejected(r *http.Request) bool {
+	if !util.IsPulsarJWTEnabled() {
+		return false
+	}
+	tokenStr := websocketRequestToken(r)
+	if tokenStr == "" {
+		return false
+	}
+	verified, err := verifyToken(tokenStr)
+	return err == nil && verifyTokenBinding(r, verified) != nil
+}
+
+// websocketRequestToken returns the token in the token query parameter or the Authorization header
+func websocketRequestToken(r *http.Request) string {
+	if tokenStr := r.URL.Query().Get("token"); tokenStr != "" {
+		return tokenStr
+	}
+	return strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+}
+
+// websocketTopicScope returns the tenant/namespace of the topic in a websocket path, such as
+// /ws/v2/consumer/persistent/{tenant}/{namespace}/{topic}/{subscription}, and the permission of the endpoint
+func websocketTopicScope(path string) (string, string) {
+	permission := icrypto.PermissionRead
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		switch segment {
+		case "producer":
+			permission = icrypto.PermissionWrite
+		case "persistent", "non-persistent":
+			if i+2 < len(segments) {
+				return segments[i+1] + "/" + segments[i+2], permission
+			}
+		}
+	}
+	return "", permission
 }
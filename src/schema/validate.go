@@ -0,0 +1,236 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package schema
+
+// Pre-checks of Pulsar schema uploads, well-formedness and compatibility against the latest schema
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Pulsar schema compatibility strategies
+const (
+	Undefined          = "UNDEFINED"
+	AlwaysIncompatible = "ALWAYS_INCOMPATIBLE"
+	AlwaysCompatible   = "ALWAYS_COMPATIBLE"
+	Backward           = "BACKWARD"
+	Forward            = "FORWARD"
+	Full               = "FULL"
+)
+
+// Payload is the schema upload body of POST /admin/v2/schemas/{tenant}/{namespace}/{topic}/schema
+type Payload struct {
+	Type       string            `json:"type"`
+	Schema     string            `json:"schema"`
+	Properties map[string]string `json:"properties"`
+}
+
+// primitive schema types carry no schema definition
+var primitiveTypes = map[string]bool{
+	"NONE": true, "STRING": true, "BYTES": true, "BOOLEAN": true, "INT8": true, "INT16": true, "INT32": true,
+	"INT64": true, "FLOAT": true, "DOUBLE": true, "DATE": true, "TIME": true, "TIMESTAMP": true,
+	"INSTANT": true, "LOCAL_DATE": true, "LOCAL_TIME": true, "LOCAL_DATE_TIME": true,
+}
+
+// Validate verifies the schema definition is well formed for its type
+func Validate(p Payload) error {
+	schemaType := strings.ToUpper(p.Type)
+	switch {
+	case primitiveTypes[schemaType], schemaType == "KEY_VALUE", schemaType == "AUTO_PUBLISH":
+		return nil
+	case schemaType == "AVRO", schemaType == "JSON", schemaType == "PROTOBUF":
+		// JSON and PROTOBUF schemas are defined in the Avro schema format
+		if strings.TrimSpace(p.Schema) == "" {
+			return fmt.Errorf("%s schema definition is empty", schemaType)
+		}
+		if _, err := goavro.NewCodec(p.Schema); err != nil {
+			return fmt.Errorf("%s schema is not a valid Avro schema definition: %v", schemaType, err)
+		}
+		return nil
+	case schemaType == "PROTOBUF_NATIVE":
+		return validateProtobufNative(p.Schema)
+	case schemaType == "":
+		return fmt.Errorf("schema type is required")
+	}
+	return fmt.Errorf("unsupported schema type %s", p.Type)
+}
+
+// protobufNativeSchema is the schema definition of PROTOBUF_NATIVE
+type protobufNativeSchema struct {
+	FileDescriptorSet      string `json:"fileDescriptorSet"`
+	RootMessageTypeName    string `json:"rootMessageTypeName"`
+	RootFileDescriptorName string `json:"rootFileDescriptorName"`
+}
+
+func validateProtobufNative(definition string) error {
+	var s protobufNativeSchema
+	if err := json.Unmarshal([]byte(definition), &s); err != nil {
+		return fmt.Errorf("PROTOBUF_NATIVE schema must be a json object: %v", err)
+	}
+	if s.FileDescriptorSet == "" || s.RootMessageTypeName == "" || s.RootFileDescriptorName == "" {
+		return fmt.Errorf("PROTOBUF_NATIVE schema requires fileDescriptorSet, rootMessageTypeName, and rootFileDescriptorName")
+	}
+	data, err := base64.StdEncoding.DecodeString(s.FileDescriptorSet)
+	if err != nil {
+		return fmt.Errorf("PROTOBUF_NATIVE fileDescriptorSet is not base64 encoded: %v", err)
+	}
+	var fds descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &fds); err != nil {
+		return fmt.Errorf("PROTOBUF_NATIVE fileDescriptorSet is not a valid FileDescriptorSet: %v", err)
+	}
+	for _, file := range fds.GetFile() {
+		if file.GetName() != s.RootFileDescriptorName {
+			continue
+		}
+		for _, msg := range file.GetMessageType() {
+			if strings.TrimPrefix(file.GetPackage()+"."+msg.GetName(), ".") == s.RootMessageTypeName {
+				return nil
+			}
+		}
+		return fmt.Errorf("PROTOBUF_NATIVE root message %s is not found in %s", s.RootMessageTypeName, s.RootFileDescriptorName)
+	}
+	return fmt.Errorf("PROTOBUF_NATIVE root file descriptor %s is not found in fileDescriptorSet", s.RootFileDescriptorName)
+}
+
+// avroField is a field of an Avro record schema
+type avroField struct {
+	Name    string          `json:"name"`
+	Type    json.RawMessage `json:"type"`
+	Default json.RawMessage `json:"default"`
+}
+
+type avroRecord struct {
+	Type   string      `json:"type"`
+	Fields []avroField `json:"fields"`
+}
+
+// Compatible verifies the candidate schema against the latest schema of the topic with the compatibility strategy.
+// Only the latest schema is checked for the transitive strategies. The record fields are compared for
+// the Avro based schemas; the other schema types are required to be identical unless always compatible.
+func Compatible(latest, candidate Payload, strategy string) error {
+	strategy = strings.TrimSuffix(strings.ToUpper(strategy), "_TRANSITIVE")
+	if strategy == "" || strategy == Undefined {
+		// the broker falls back to the namespace schema auto update strategy, which is FULL by default
+		strategy = Full
+	}
+	if strategy == AlwaysCompatible {
+		return nil
+	}
+	if !strings.EqualFold(latest.Type, candidate.Type) {
+		return fmt.Errorf("schema type change from %s to %s is incompatible under %s compatibility", latest.Type, candidate.Type, strategy)
+	}
+	if latest.Schema == candidate.Schema {
+		return nil
+	}
+	if strategy == AlwaysIncompatible {
+		return fmt.Errorf("schema change is not allowed under %s compatibility", strategy)
+	}
+
+	schemaType := strings.ToUpper(candidate.Type)
+	if schemaType != "AVRO" && schemaType != "JSON" && schemaType != "PROTOBUF" {
+		return fmt.Errorf("%s schema change is not allowed under %s compatibility", schemaType, strategy)
+	}
+	var oldRecord, newRecord avroRecord
+	if json.Unmarshal([]byte(latest.Schema), &oldRecord) != nil || json.Unmarshal([]byte(candidate.Schema), &newRecord) != nil ||
+		oldRecord.Type != "record" || newRecord.Type != "record" {
+		// leave the non record schema evolution to the broker
+		return nil
+	}
+
+	oldFields, newFields := fieldMap(oldRecord), fieldMap(newRecord)
+	if strategy == Backward || strategy == Full {
+		// the new schema reads the data written by the latest schema
+		if err := readable(newFields, oldFields, "added", strategy); err != nil {
+			return err
+		}
+	}
+	if strategy == Forward || strategy == Full {
+		// the latest schema reads the data written by the new schema
+		if err := readable(oldFields, newFields, "removed", strategy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldMap(r avroRecord) map[string]avroField {
+	fields := make(map[string]avroField, len(r.Fields))
+	for _, f := range r.Fields {
+		fields[f.Name] = f
+	}
+	return fields
+}
+
+// readable verifies the reader fields can decode the data written with the writer fields
+func readable(reader, writer map[string]avroField, change, strategy string) error {
+	for name, rf := range reader {
+		wf, ok := writer[name]
+		if !ok {
+			if rf.Default == nil {
+				return fmt.Errorf("field %s is %s without a default value, it breaks %s compatibility", name, change, strategy)
+			}
+			continue
+		}
+		if !promotable(wf.Type, rf.Type) {
+			return fmt.Errorf("field %s changes type from %s to %s, it breaks %s compatibility", name, compact(wf.Type), compact(rf.Type), strategy)
+		}
+	}
+	return nil
+}
+
+// Avro primitive type promotions from the writer to the reader type
+var promotions = map[string][]string{
+	`"int"`:    {`"long"`, `"float"`, `"double"`},
+	`"long"`:   {`"float"`, `"double"`},
+	`"float"`:  {`"double"`},
+	`"string"`: {`"bytes"`},
+	`"bytes"`:  {`"string"`},
+}
+
+func promotable(writer, reader json.RawMessage) bool {
+	w, r := compact(writer), compact(reader)
+	if w == r {
+		return true
+	}
+	for _, t := range promotions[w] {
+		if t == r {
+			return true
+		}
+	}
+	return false
+}
+
+func compact(raw json.RawMessage) string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return string(raw)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
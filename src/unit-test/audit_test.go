@@ -0,0 +1,188 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/datastax/burnell/src/audit"
+)
+
+type memorySink struct {
+	events []Event
+}
+
+func (m *memorySink) Name() string { return "memory" }
+
+func (m *memorySink) Send(e Event) error {
+	m.events = append(m.events, e)
+	return nil
+}
+
+func TestAuditRecord(t *testing.T) {
+	sink := &memorySink{}
+	AddSink(sink)
+
+	Record(Event{Subject: "ming-luo-client-1234", Tenant: "ming-luo", Action: "topic.compaction",
+		Resource: "persistent://ming-luo/ns/topic1", Outcome: Denied, Reason: "below threshold"})
+	equals(t, 1, len(sink.events))
+	equals(t, "topic.compaction", sink.events[0].Action)
+	equals(t, Denied, sink.events[0].Outcome)
+	assert(t, !sink.events[0].Time.IsZero(), "event time is set")
+}
+
+func TestBufferedSink(t *testing.T) {
+	var lock sync.Mutex
+	published := []string{}
+	started := make(chan struct{}, 10)
+	gate := make(chan struct{})
+	failed := false
+	sink := NewBufferedSink("test", 3, func(e Event) error {
+		started <- struct{}{}
+		<-gate
+		lock.Lock()
+		defer lock.Unlock()
+		if e.Action == "a2" && !failed {
+			failed = true
+			return errors.New("broker is down")
+		}
+		published = append(published, e.Action)
+		return nil
+	})
+
+	errNil(t, sink.Send(Event{Action: "a0"}))
+	<-started
+	// a0 is being published while a1 to a4 are buffered, a1 is dropped over the buffer size
+	for _, action := range []string{"a1", "a2", "a3", "a4"} {
+		errNil(t, sink.Send(Event{Action: action}))
+	}
+	buffered, dropped := sink.Stats()
+	equals(t, 3, buffered)
+	equals(t, int64(2), dropped)
+	close(gate)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if buffered, _ = sink.Stats(); buffered == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	// a2 is retried after the failure
+	equals(t, []string{"a0", "a2", "a3", "a4"}, published)
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	var lock sync.Mutex
+	var template map[string]interface{}
+	indexed := map[string]string{}
+	bulks := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Header.Get("Authorization") != "ApiKey aWQ6a2V5" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/_index_template/compliance":
+			json.Unmarshal(body, &template)
+		case "/_bulk":
+			bulks++
+			scanner := bufio.NewScanner(bytes.NewReader(body))
+			items := []string{}
+			for scanner.Scan() {
+				var action map[string]map[string]string
+				json.Unmarshal(scanner.Bytes(), &action)
+				scanner.Scan()
+				status := 201
+				// the first bulk is partially rejected by an overloaded node
+				if bulks == 1 && len(items) == 1 {
+					status = 429
+				} else {
+					indexed[action["index"]["_index"]+"/"+action["index"]["_id"]] = scanner.Text()
+				}
+				items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+			}
+			fmt.Fprintf(w, `{"errors":%v,"items":[%s]}`, bulks == 1, strings.Join(items, ","))
+		}
+	}))
+	defer server.Close()
+
+	sink := NewElasticsearchSink(ElasticsearchOptions{URLs: []string{server.URL}, APIKey: "aWQ6a2V5",
+		IndexPrefix: "compliance", Replicas: 2, BulkSize: 10})
+	day := time.Date(2024, 3, 7, 23, 0, 0, 0, time.UTC)
+	errNil(t, sink.Send(Event{Time: day, Subject: "ops", Tenant: "ming-luo", Action: "tenant.update", Outcome: Succeeded}))
+	errNil(t, sink.Send(Event{Time: day.Add(2 * time.Hour), Subject: "ops", Tenant: "ming-luo", Action: "token.issue", Outcome: Denied}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if buffered, _ := sink.Stats(); buffered == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	equals(t, 2, bulks)
+	// the retried bulk overwrites the document indexed by the first bulk
+	equals(t, 2, len(indexed))
+	daily := map[string]bool{}
+	for key := range indexed {
+		daily[strings.Split(key, "/")[0]] = true
+	}
+	equals(t, map[string]bool{"compliance-2024.03.07": true, "compliance-2024.03.08": true}, daily)
+
+	equals(t, []interface{}{"compliance-*"}, template["index_patterns"])
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	equals(t, float64(2), settings["number_of_replicas"])
+	_, ok := settings["number_of_shards"]
+	assert(t, !ok, "the cluster default shards")
+}
+
+func TestBulkBodyIDs(t *testing.T) {
+	e := Event{Time: time.Unix(1700000000, 0), Subject: "ops", Action: "tenant.delete", Outcome: Allowed}
+	first, err := BulkBody("burnell-audit", []Event{e})
+	errNil(t, err)
+	second, err := BulkBody("burnell-audit", []Event{e})
+	errNil(t, err)
+	equals(t, string(first), string(second))
+	e.Outcome = Denied
+	third, err := BulkBody("burnell-audit", []Event{e})
+	errNil(t, err)
+	assert(t, strings.Split(string(first), "\n")[0] != strings.Split(string(third), "\n")[0], "a different event has a different id")
+	assert(t, strings.Contains(string(first), `"_index":"burnell-audit-2023.11.14"`), "daily index")
+}
@@ -0,0 +1,151 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/datastax/burnell/src/icrypto"
+	. "github.com/datastax/burnell/src/pulsarproxy"
+	"github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/util"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestBinaryProtocolFrames(t *testing.T) {
+	// CommandConnect with a token
+	var connect []byte
+	connect = protowire.AppendTag(connect, 1, protowire.BytesType)
+	connect = protowire.AppendString(connect, "Pulsar Go 0.7.0")
+	connect = protowire.AppendTag(connect, 3, protowire.BytesType)
+	connect = protowire.AppendString(connect, "my.jwt.token")
+	connect = protowire.AppendTag(connect, 4, protowire.VarintType)
+	connect = protowire.AppendVarint(connect, 17)
+	connect = protowire.AppendTag(connect, 5, protowire.BytesType)
+	connect = protowire.AppendString(connect, "token")
+
+	frame, err := ReadFrame(bytes.NewReader(CommandFrame(CommandConnect, connect)))
+	errNil(t, err)
+	cmd, err := ParseFrame(frame)
+	errNil(t, err)
+	equals(t, CommandConnect, cmd.Type)
+	equals(t, "token", cmd.AuthMethodName)
+	equals(t, "my.jwt.token", string(cmd.AuthData))
+
+	// CommandProducer carries the topic in field 1 and the request id in field 3
+	var producer []byte
+	producer = protowire.AppendTag(producer, 1, protowire.BytesType)
+	producer = protowire.AppendString(producer, "persistent://ming-luo/namespace2/topic1")
+	producer = protowire.AppendTag(producer, 2, protowire.VarintType)
+	producer = protowire.AppendVarint(producer, 7)
+	producer = protowire.AppendTag(producer, 3, protowire.VarintType)
+	producer = protowire.AppendVarint(producer, 42)
+
+	// frames are read one at a time off the stream
+	produceFrame := CommandFrame(CommandProducer, producer)
+	frame, err = ReadFrame(bytes.NewReader(append(produceFrame, CommandFrame(CommandConnect, connect)...)))
+	errNil(t, err)
+	equals(t, produceFrame, frame)
+	cmd, err = ParseFrame(frame)
+	errNil(t, err)
+	equals(t, CommandProducer, cmd.Type)
+	equals(t, "persistent://ming-luo/namespace2/topic1", cmd.Topic)
+	equals(t, uint64(42), cmd.RequestID)
+	assert(t, cmd.HasRequestID, "producer has a request id")
+
+	cmd, err = ParseFrame(ErrorFrame(42, AuthorizationError, "denied"))
+	errNil(t, err)
+	equals(t, CommandError, cmd.Type)
+
+	_, err = ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert(t, err != nil, "reject oversized frame")
+
+	tenant, ns := TopicNamespace("persistent://ming-luo/namespace2/topic1")
+	equals(t, "ming-luo", tenant)
+	equals(t, "namespace2", ns)
+	tenant, ns = TopicNamespace("ming-luo/namespace2/topic1-partition-0")
+	equals(t, "ming-luo", tenant)
+	equals(t, "namespace2", ns)
+	tenant, ns = TopicNamespace("topic1")
+	equals(t, "public", tenant)
+	equals(t, "default", ns)
+}
+
+// repeatedCommandFrame encodes a BaseCommand with the command message split over two occurrences
+func repeatedCommandFrame(cmdType CommandType, first, second []byte) []byte {
+	var cmd []byte
+	cmd = protowire.AppendTag(cmd, 1, protowire.VarintType)
+	cmd = protowire.AppendVarint(cmd, uint64(cmdType))
+	for _, body := range [][]byte{first, second} {
+		cmd = protowire.AppendTag(cmd, protowire.Number(cmdType), protowire.BytesType)
+		cmd = protowire.AppendBytes(cmd, body)
+	}
+	frame := make([]byte, 8, 8+len(cmd))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(4+len(cmd)))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(cmd)))
+	return append(frame, cmd...)
+}
+
+func TestBinaryProxyAuthorization(t *testing.T) {
+	superRoles := util.SuperRoles
+	util.SuperRoles = []string{"superuser"}
+	defer func() { util.SuperRoles = superRoles }()
+	ctx := context.Background()
+
+	// the topic in the first occurrence of the command message is merged by the broker
+	var topic, requestID []byte
+	topic = protowire.AppendTag(topic, 1, protowire.BytesType)
+	topic = protowire.AppendString(topic, "persistent://other/ns/orders")
+	requestID = protowire.AppendTag(requestID, 3, protowire.VarintType)
+	requestID = protowire.AppendVarint(requestID, 9)
+	cmd, err := ParseFrame(repeatedCommandFrame(CommandProducer, topic, requestID))
+	errNil(t, err)
+	equals(t, "persistent://other/ns/orders", cmd.Topic)
+	equals(t, uint64(9), cmd.RequestID)
+	assert(t, AuthorizeCommand(ctx, cmd, "ming-luo-client-1234", nil) != nil, "merged topic of another tenant")
+
+	// a topic scoped command without a topic is denied
+	cmd, err = ParseFrame(repeatedCommandFrame(CommandProducer, requestID, requestID))
+	errNil(t, err)
+	equals(t, "", cmd.Topic)
+	assert(t, AuthorizeCommand(ctx, cmd, "superuser", nil) != nil, "producer without a topic")
+	assert(t, AuthorizeCommand(ctx, Command{Type: CommandGetTopicsOfNamespace}, "superuser", nil) != nil, "namespace is required")
+
+	own := Command{Type: CommandProducer, Topic: "persistent://ming-luo/ns/orders"}
+	errNil(t, AuthorizeCommand(ctx, own, "ming-luo-client-1234", nil))
+	errNil(t, AuthorizeCommand(ctx, Command{Type: CommandGetTopicsOfNamespace, Namespace: "ming-luo/ns"}, "ming-luo-client-1234", nil))
+	readOnly := &icrypto.DelegationScope{Namespaces: []string{"ming-luo/ns"}, Permissions: []string{icrypto.PermissionRead}}
+	assert(t, AuthorizeCommand(ctx, own, "ming-luo-client-1234", readOnly) != nil, "read only delegated token produces")
+	errNil(t, AuthorizeCommand(ctx, Command{Type: CommandLookup, Topic: own.Topic}, "ming-luo-client-1234", readOnly))
+
+	// the role bindings of the RBAC engine apply, the same as the message routes
+	engine, err := rbac.NewRoleEngine([]util.RBACRole{{Name: "reader", Permissions: []string{"messages:read"}}},
+		[]util.RBACBinding{{Role: "reader", Subjects: []string{"analytics"}, Tenants: []string{"ming-luo"}}}, false)
+	errNil(t, err)
+	rbac.SetEngine(engine)
+	defer rbac.SetEngine(nil)
+	errNil(t, AuthorizeCommand(ctx, Command{Type: CommandSubscribe, Topic: own.Topic}, "analytics", nil))
+	assert(t, AuthorizeCommand(ctx, own, "analytics", nil) != nil, "a reader cannot produce")
+}
@@ -0,0 +1,461 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/util"
+	. "github.com/datastax/burnell/src/workflow"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+const bootstrapManifest = `
+tenants:
+- name: acme
+  adminRoles: [acme-admin]
+  namespaces:
+  - name: orders
+    retentionMinutes: 1440
+    retentionSizeMB: -1
+    messageTTLSeconds: 3600
+    permissions:
+      acme-app: [produce, consume]
+  - name: existing
+- name: globex
+  allowedClusters: [east]
+tokens:
+- subject: acme-app
+  file: %s/acme-app.jwt
+- subject: acme-admin
+  file: %s/acme-admin.jwt
+  expiry: 8760h
+`
+
+func TestBootstrapManifest(t *testing.T) {
+	var lock sync.Mutex
+	tenants := map[string]string{"public": "", "acme": ""}
+	namespaces := map[string][]string{"acme": {"acme/existing"}}
+	calls := map[string]string{}
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		path := strings.TrimPrefix(r.URL.Path, "/admin/v2/")
+		parts := strings.Split(path, "/")
+		switch {
+		case r.Method == http.MethodGet && path == "tenants":
+			names := []string{}
+			for name := range tenants {
+				names = append(names, name)
+			}
+			json.NewEncoder(w).Encode(names)
+		case r.Method == http.MethodGet && parts[0] == "namespaces":
+			json.NewEncoder(w).Encode(append([]string{}, namespaces[parts[1]]...))
+		case r.Method == http.MethodPut && parts[0] == "tenants":
+			tenants[parts[1]] = string(body)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut && parts[0] == "namespaces" && len(parts) == 3:
+			namespaces[parts[1]] = append(namespaces[parts[1]], parts[1]+"/"+parts[2])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			calls[r.Method+" "+path] = string(body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer admin.Close()
+
+	adminURL, clusterName, jwtAuth := util.Config.BrokerProxyURL, util.Config.ClusterName, util.JWTAuth
+	defer func() {
+		util.Config.BrokerProxyURL, util.Config.ClusterName, util.JWTAuth = adminURL, clusterName, jwtAuth
+	}()
+	util.Config.BrokerProxyURL, util.Config.ClusterName = admin.URL, "west"
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(t, err)
+	util.JWTAuth = keys
+
+	dir, err := ioutil.TempDir("", "bootstrap")
+	errNil(t, err)
+	defer os.RemoveAll(dir)
+	// the existing token is kept
+	errNil(t, ioutil.WriteFile(filepath.Join(dir, "acme-admin.jwt"), []byte("existing"), 0600))
+	manifestFile := filepath.Join(dir, "manifest.yaml")
+	errNil(t, ioutil.WriteFile(manifestFile, []byte(strings.ReplaceAll(bootstrapManifest, "%s", dir)), 0600))
+	m, err := LoadManifest(manifestFile)
+	errNil(t, err)
+
+	sink := &memorySink{}
+	audit.AddSink(sink)
+	created, err := Bootstrap(m)
+	errNil(t, err)
+	equals(t, []string{"namespace/acme/orders", "tenant/globex", "token/acme-app"}, created)
+
+	equals(t, `{"adminRoles":null,"allowedClusters":["east"]}`, tenants["globex"])
+	equals(t, `{"retentionSizeInMB":-1,"retentionTimeInMinutes":1440}`, calls["POST namespaces/acme/orders/retention"])
+	equals(t, "3600", calls["POST namespaces/acme/orders/messageTTL"])
+	equals(t, `["produce","consume"]`, calls["POST namespaces/acme/orders/permissions/acme-app"])
+	_, ok := calls["POST namespaces/acme/existing/retention"]
+	assert(t, !ok, "the existing namespace is not changed")
+
+	token, err := ioutil.ReadFile(filepath.Join(dir, "acme-app.jwt"))
+	errNil(t, err)
+	subject, err := keys.GetTokenSubject(string(token))
+	errNil(t, err)
+	equals(t, "acme-app", subject)
+	token, _ = ioutil.ReadFile(filepath.Join(dir, "acme-admin.jwt"))
+	equals(t, "existing", string(token))
+
+	events := 0
+	for _, e := range sink.events {
+		if e.Action == "bootstrap.create" {
+			events++
+		}
+	}
+	equals(t, 3, events)
+
+	// a second run finds every resource
+	created, err = Bootstrap(m)
+	errNil(t, err)
+	equals(t, 0, len(created))
+}
+
+func TestBootstrapManifestValidation(t *testing.T) {
+	errNil(t, Manifest{Tenants: []TenantSpec{{Name: "acme", Namespaces: []NamespaceSpec{{Name: "ns1"}}}}}.Validate())
+	assert(t, Manifest{Tenants: []TenantSpec{{Name: "acme/ns1"}}}.Validate() != nil, "invalid tenant name")
+	assert(t, Manifest{Tenants: []TenantSpec{{Name: "acme"}, {Name: "acme"}}}.Validate() != nil, "duplicate tenant")
+	assert(t, Manifest{Tokens: []TokenSpec{{Subject: "acme-app", Expiry: "1 year"}}}.Validate() != nil, "invalid expiry")
+}
+
+// fakePulsarAdmin keeps the tenants, namespaces, and namespace policies of the admin REST API
+type fakePulsarAdmin struct {
+	sync.Mutex
+	tenants    map[string]json.RawMessage
+	namespaces map[string]map[string]json.RawMessage
+	posts      int
+}
+
+func (f *fakePulsarAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/v2/"), "/")
+	writeKeys := func(prefix string, m map[string]json.RawMessage) {
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, prefix+k)
+		}
+		json.NewEncoder(w).Encode(keys)
+	}
+	switch {
+	case parts[0] == "tenants" && len(parts) == 1:
+		writeKeys("", f.tenants)
+	case parts[0] == "tenants" && r.Method == http.MethodGet:
+		if _, ok := f.tenants[parts[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(f.tenants[parts[1]])
+	case parts[0] == "tenants" && r.Method == http.MethodDelete:
+		for name := range f.namespaces {
+			if strings.HasPrefix(name, parts[1]+"/") {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		delete(f.tenants, parts[1])
+	case parts[0] == "tenants":
+		if r.Method == http.MethodPost {
+			f.posts++
+		}
+		f.tenants[parts[1]] = body
+	case parts[0] == "namespaces" && f.tenants[parts[1]] == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case parts[0] == "namespaces" && len(parts) == 2:
+		ns := map[string]json.RawMessage{}
+		for name := range f.namespaces {
+			if strings.HasPrefix(name, parts[1]+"/") {
+				ns[name] = nil
+			}
+		}
+		writeKeys("", ns)
+	case parts[0] == "namespaces" && len(parts) == 3 && r.Method == http.MethodDelete:
+		delete(f.namespaces, parts[1]+"/"+parts[2])
+	case parts[0] == "namespaces" && len(parts) == 3:
+		f.namespaces[parts[1]+"/"+parts[2]] = map[string]json.RawMessage{}
+	case parts[0] == "namespaces":
+		policies := f.namespaces[parts[1]+"/"+parts[2]]
+		policy := strings.Join(parts[3:], "/")
+		if r.Method == http.MethodGet {
+			if policy == "permissions" {
+				permissions := map[string]json.RawMessage{}
+				for k, v := range policies {
+					if strings.HasPrefix(k, "permissions/") {
+						permissions[strings.TrimPrefix(k, "permissions/")] = v
+					}
+				}
+				json.NewEncoder(w).Encode(permissions)
+				return
+			}
+			w.Write(policies[policy])
+			return
+		}
+		f.posts++
+		if r.Method == http.MethodDelete {
+			delete(policies, policy)
+			return
+		}
+		policies[policy] = body
+	}
+}
+
+func TestReconcileManifest(t *testing.T) {
+	admin := &fakePulsarAdmin{
+		tenants: map[string]json.RawMessage{
+			"acme": json.RawMessage(`{"adminRoles":["old-admin"],"allowedClusters":["west"]}`),
+		},
+		namespaces: map[string]map[string]json.RawMessage{
+			"acme/orders": {
+				"retention":  json.RawMessage(`{"retentionTimeInMinutes":60,"retentionSizeInMB":-1}`),
+				"messageTTL": json.RawMessage(`3600`),
+			},
+		},
+	}
+	server := httptest.NewServer(admin)
+	defer server.Close()
+	adminURL, clusterName := util.Config.BrokerProxyURL, util.Config.ClusterName
+	defer func() { util.Config.BrokerProxyURL, util.Config.ClusterName = adminURL, clusterName }()
+	util.Config.BrokerProxyURL, util.Config.ClusterName = server.URL, "west"
+
+	m := Manifest{Tenants: []TenantSpec{
+		{Name: "acme", AdminRoles: []string{"acme-admin"}, Namespaces: []NamespaceSpec{{
+			Name: "orders", RetentionMinutes: 1440, RetentionSizeMB: -1, MessageTTLSeconds: 3600,
+			Permissions: map[string][]string{"acme-app": {"produce", "consume"}},
+		}}},
+		{Name: "globex", Namespaces: []NamespaceSpec{{Name: "events"}}},
+	}}
+	resources := func(report ReconcileReport) []string {
+		names := []string{}
+		for _, d := range report.Drifts {
+			names = append(names, d.Resource)
+		}
+		return names
+	}
+
+	sink := &memorySink{}
+	audit.AddSink(sink)
+	report := Reconcile(m, true)
+	equals(t, "", report.Error)
+	expected := []string{"tenant/acme", "namespace/acme/orders/retention", "namespace/acme/orders/permissions/acme-app",
+		"tenant/globex", "namespace/globex/events"}
+	equals(t, expected, resources(report))
+	equals(t, 0, admin.posts)
+	_, ok := admin.tenants["globex"]
+	assert(t, !ok, "a dry run does not create the tenant")
+	equals(t, "reconcile.drift", sink.events[len(sink.events)-1].Action)
+	equals(t, "globex", sink.events[len(sink.events)-1].Tenant)
+
+	report = Reconcile(m, false)
+	equals(t, "", report.Error)
+	equals(t, expected, resources(report))
+	for _, d := range report.Drifts {
+		assert(t, d.Fixed, "fixed "+d.Resource)
+	}
+	equals(t, `{"adminRoles":["acme-admin"],"allowedClusters":["west"]}`, string(admin.tenants["acme"]))
+	equals(t, `["consume","produce"]`, string(admin.namespaces["acme/orders"]["permissions/acme-app"]))
+	equals(t, "reconcile.fix", sink.events[len(sink.events)-1].Action)
+
+	report = Reconcile(m, false)
+	equals(t, 0, len(report.Drifts))
+}
+
+func TestGitOpsSync(t *testing.T) {
+	repo, err := ioutil.TempDir("", "gitops-repo")
+	errNil(t, err)
+	defer os.RemoveAll(repo)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		assert(t, err == nil, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(manifest string) string {
+		errNil(t, os.MkdirAll(filepath.Join(repo, "tenants"), 0755))
+		errNil(t, ioutil.WriteFile(filepath.Join(repo, "tenants", "manifest.yaml"), []byte(manifest), 0644))
+		git("add", "-A")
+		git("commit", "-q", "-m", "manifest")
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "-q", "-b", "release")
+	first := commit("tenants:\n- name: acme\n  namespaces:\n  - name: orders\n")
+
+	admin := &fakePulsarAdmin{tenants: map[string]json.RawMessage{}, namespaces: map[string]map[string]json.RawMessage{}}
+	server := httptest.NewServer(admin)
+	defer server.Close()
+	checkout, err := ioutil.TempDir("", "gitops-checkout")
+	errNil(t, err)
+	defer os.RemoveAll(checkout)
+	adminURL, gitops := util.Config.BrokerProxyURL, util.Config.GitOps
+	defer func() { util.Config.BrokerProxyURL, util.Config.GitOps = adminURL, gitops }()
+	util.Config.BrokerProxyURL = server.URL
+	util.Config.GitOps = util.GitOps{Repository: "file://" + repo, Branch: "release", Path: "tenants/manifest.yaml",
+		Dir: filepath.Join(checkout, "clone")}
+
+	sink := &memorySink{}
+	audit.AddSink(sink)
+	report, applied := SyncGitOps()
+	equals(t, "", report.Error)
+	assert(t, applied, "the first commit is applied")
+	equals(t, first, report.Revision)
+	equals(t, 2, len(report.Drifts))
+	_, ok := admin.namespaces["acme/orders"]
+	assert(t, ok, "the namespace is created")
+	equals(t, "revision "+first, sink.events[len(sink.events)-1].Reason)
+
+	_, applied = SyncGitOps()
+	assert(t, !applied, "the same commit is not applied again")
+
+	second := commit("tenants:\n- name: acme\n  namespaces:\n  - name: orders\n  - name: invoices\n")
+	report, applied = SyncGitOps()
+	equals(t, "", report.Error)
+	assert(t, applied, "a new commit is applied")
+	equals(t, second, report.Revision)
+	equals(t, []string{"namespace/acme/invoices"}, []string{report.Drifts[0].Resource})
+	equals(t, "revision "+second, sink.events[len(sink.events)-1].Reason)
+
+	report = RunReconciliation(true)
+	equals(t, second, report.Revision)
+	equals(t, 0, len(report.Drifts))
+}
+
+func TestVerifyGitWebhook(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write(body)
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	assert(t, VerifyGitWebhook("webhook-secret", header, body), "a GitHub signature")
+	assert(t, !VerifyGitWebhook("other-secret", header, body), "a signature of another secret")
+	assert(t, !VerifyGitWebhook("webhook-secret", header, []byte(`{"ref":"refs/heads/other"}`)), "a tampered body")
+
+	header = http.Header{}
+	header.Set("X-Gitlab-Token", "webhook-secret")
+	assert(t, VerifyGitWebhook("webhook-secret", header, body), "a GitLab token")
+	assert(t, !VerifyGitWebhook("", header, body), "no secret is configured")
+	assert(t, !VerifyGitWebhook("webhook-secret", http.Header{}, body), "an unsigned webhook")
+}
+
+func TestSyncOperator(t *testing.T) {
+	admin := &fakePulsarAdmin{
+		tenants:    map[string]json.RawMessage{},
+		namespaces: map[string]map[string]json.RawMessage{},
+	}
+	server := httptest.NewServer(admin)
+	defer server.Close()
+	adminURL, clusterName, pulsarNamespace := util.Config.BrokerProxyURL, util.Config.ClusterName, util.Config.PulsarNamespace
+	defer func() {
+		util.Config.BrokerProxyURL, util.Config.ClusterName, util.Config.PulsarNamespace = adminURL, clusterName, pulsarNamespace
+	}()
+	util.Config.BrokerProxyURL, util.Config.ClusterName = server.URL, "west"
+	superRoles := util.SuperRoles
+	util.SuperRoles = []string{"superuser", "acme-root"}
+	defer func() { util.SuperRoles = superRoles }()
+
+	resource := func(kind, name string, generation int64, spec map[string]interface{}) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		obj.SetAPIVersion("burnell.datastax.com/v1alpha1")
+		obj.SetKind(kind)
+		obj.SetNamespace("pulsar-tenants")
+		obj.SetName(name)
+		obj.SetGeneration(generation)
+		return obj
+	}
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		resource("PulsarTenant", "acme", 1, map[string]interface{}{"adminRoles": []interface{}{"acme-admin"}}),
+		resource("PulsarNamespacePolicy", "orders", 2, map[string]interface{}{"tenant": "acme", "retentionMinutes": int64(1440)}),
+		resource("PulsarTenant", "globex", 1, map[string]interface{}{}),
+		resource("PulsarNamespacePolicy", "events", 1, map[string]interface{}{"tenant": "globex"}),
+		resource("PulsarNamespacePolicy", "invalid", 1, map[string]interface{}{"tenant": "acme", "name": "a/b"}),
+		resource("PulsarToken", "superuser", 1, map[string]interface{}{"subject": "acme-root"}),
+		resource("PulsarToken", "other-tenant", 1, map[string]interface{}{"subject": "acme-corp-client-12345"}),
+	)
+	ready := func(gvr schema.GroupVersionResource, name string) (map[string]interface{}, int64) {
+		obj, err := client.Resource(gvr).Namespace("pulsar-tenants").Get(context.TODO(), name, meta_v1.GetOptions{})
+		errNil(t, err)
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+		equals(t, 1, len(conditions))
+		return conditions[0].(map[string]interface{}), observed
+	}
+
+	assertErr(t, "the operator requires the watched namespace and its tenant", SyncOperator(client, "", "acme"))
+	errNil(t, SyncOperator(client, "pulsar-tenants", "acme"))
+	equals(t, `{"adminRoles":["acme-admin"],"allowedClusters":["west"]}`, string(admin.tenants["acme"]))
+	equals(t, `{"retentionSizeInMB":0,"retentionTimeInMinutes":1440}`, string(admin.namespaces["acme/orders"]["retention"]))
+
+	c, observed := ready(TenantResource, "acme")
+	equals(t, "True", c["status"])
+	equals(t, "Reconciled", c["reason"])
+	equals(t, int64(1), observed)
+	c, observed = ready(NamespacePolicyResource, "orders")
+	equals(t, "True", c["status"])
+	equals(t, int64(2), observed)
+	transition := c["lastTransitionTime"]
+	_, created := admin.tenants["globex"]
+	assert(t, !created, "a tenant that is not mapped to the namespace")
+	c, _ = ready(TenantResource, "globex")
+	equals(t, "False", c["status"])
+	equals(t, "Forbidden", c["reason"])
+	c, _ = ready(NamespacePolicyResource, "events")
+	equals(t, "Forbidden", c["reason"])
+	equals(t, "tenant globex is not allowed in namespace pulsar-tenants", c["message"])
+	c, _ = ready(NamespacePolicyResource, "invalid")
+	equals(t, "InvalidSpec", c["reason"])
+	c, _ = ready(TokenResource, "superuser")
+	equals(t, "Forbidden", c["reason"])
+	c, _ = ready(TokenResource, "other-tenant")
+	equals(t, "Forbidden", c["reason"])
+
+	errNil(t, SyncOperator(client, "pulsar-tenants", "acme"))
+	c, _ = ready(NamespacePolicyResource, "orders")
+	equals(t, "in sync", c["message"])
+	equals(t, transition, c["lastTransitionTime"])
+}
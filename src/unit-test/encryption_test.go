@@ -22,8 +22,15 @@
 package tests
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"testing"
 	"time"
 
@@ -138,3 +145,199 @@ func TestJWTRSASignAndVerifyWithPEMKey(t *testing.T) {
 	equals(t, expireOffset, 3600)
 
 }
+
+func TestClaimsTemplate(t *testing.T) {
+	authen, err := LoadRSAKeyPair("./example_private_key", "./example_public_key.pub")
+	errNil(t, err)
+
+	authen.ClaimsTemplate = &ClaimsTemplate{
+		Static:   map[string]interface{}{"iss": "burnell"},
+		Derived:  map[string]string{"role": "{sub}", "scope": "tenant:{tenant}", "team": "{param.team}"},
+		Required: []string{"role"},
+	}
+	errNil(t, authen.ClaimsTemplate.Validate())
+
+	tokenString, err := authen.GenerateTokenWithVars("chris-datastax-12345qbc", time.Hour, jwt.SigningMethodRS256,
+		map[string]string{"sub": "chris-datastax-12345qbc", "tenant": "chris-datastax"})
+	errNil(t, err)
+	token, err := authen.DecodeToken(tokenString)
+	errNil(t, err)
+	claims := token.Claims.(jwt.MapClaims)
+	equals(t, "burnell", claims["iss"])
+	equals(t, "chris-datastax-12345qbc", claims["role"])
+	equals(t, "tenant:chris-datastax", claims["scope"])
+	_, ok := claims["team"]
+	assert(t, !ok, "derived claim with missing variable is omitted")
+	assert(t, claims["exp"] != nil, "exp is still set")
+
+	authen.ClaimsTemplate.Required = []string{"team"}
+	_, err = authen.GenerateToken("myadmin", 0, jwt.SigningMethodRS256)
+	assertErr(t, "missing required claim team", err)
+
+	authen.ClaimsTemplate = &ClaimsTemplate{Static: map[string]interface{}{"sub": "other"}}
+	assert(t, authen.ClaimsTemplate.Validate() != nil, "sub is a reserved claim")
+	for _, name := range []string{"dlg", "jti", "psub"} {
+		authen.ClaimsTemplate = &ClaimsTemplate{Derived: map[string]string{name: "{sub}"}}
+		assert(t, authen.ClaimsTemplate.Validate() != nil, name+" is a reserved claim")
+	}
+}
+
+func TestDelegateToken(t *testing.T) {
+	authen, err := NewRSAKeyPair()
+	errNil(t, err)
+
+	parent, err := authen.GenerateToken("ming-luo", 5*time.Hour, jwt.SigningMethodRS256)
+	errNil(t, err)
+
+	_, _, _, err = authen.DelegateToken(parent, DelegationScope{}, time.Hour)
+	assert(t, err != nil, "namespace is required")
+	_, _, _, err = authen.DelegateToken(parent, DelegationScope{Namespaces: []string{"ming-luo/ci"}, Permissions: []string{"admin"}}, time.Hour)
+	assert(t, err != nil, "invalid permission")
+
+	child, scope, expiry, err := authen.DelegateToken(parent, DelegationScope{Namespaces: []string{"ming-luo/ci", "ming-luo/dev"}}, 10*time.Hour)
+	errNil(t, err)
+	equals(t, 2, len(scope.Permissions))
+	assert(t, expiry.Before(time.Now().Add(5*time.Hour+time.Minute)), "delegated token cannot outlive the parent")
+	equals(t, TokenID(jwt.MapClaims{}, parent), scope.ParentID)
+
+	subject, childScope, err := authen.GetTokenSubjectAndScope(child)
+	errNil(t, err)
+	equals(t, "ming-luo", subject)
+	// Pulsar sees a distinct subject
+	childToken, err := authen.DecodeToken(child)
+	errNil(t, err)
+	equals(t, "delegated:"+childToken.Claims.(jwt.MapClaims)["jti"].(string), childToken.Claims.(jwt.MapClaims)["sub"])
+	assert(t, childScope.AllowsNamespace("ming-luo/ci"), "delegated namespace")
+	assert(t, !childScope.AllowsNamespace("ming-luo/prod"), "namespace outside of the scope")
+	verified, err := authen.VerifyToken(child)
+	errNil(t, err)
+	equals(t, expiry.Unix(), verified.ExpiresAt.Unix())
+
+	_, parentScope, err := authen.GetTokenSubjectAndScope(parent)
+	errNil(t, err)
+	assert(t, parentScope == nil, "parent token is not scoped")
+
+	// nested delegation can only narrow the scope
+	_, _, _, err = authen.DelegateToken(child, DelegationScope{Namespaces: []string{"ming-luo/prod"}}, time.Hour)
+	assert(t, err != nil, "namespace not granted to the parent")
+	grandChild, grandScope, _, err := authen.DelegateToken(child, DelegationScope{Namespaces: []string{"ming-luo/ci"}, Permissions: []string{PermissionRead}}, time.Hour)
+	errNil(t, err)
+	assert(t, !grandScope.AllowsPermission(PermissionWrite), "narrowed permission")
+	equals(t, childToken.Claims.(jwt.MapClaims)["jti"], grandScope.ParentID)
+	subject, _, err = authen.GetTokenSubjectAndScope(grandChild)
+	errNil(t, err)
+	equals(t, "ming-luo", subject)
+	_, _, _, err = authen.DelegateToken(grandChild, DelegationScope{Namespaces: []string{"ming-luo/ci"}, Permissions: []string{PermissionWrite}}, time.Hour)
+	assert(t, err != nil, "permission not granted to the parent")
+}
+
+func TestFailedTokenSubject(t *testing.T) {
+	authen, err := NewRSAKeyPair()
+	errNil(t, err)
+	other, err := NewRSAKeyPair()
+	errNil(t, err)
+
+	expiredClaims := jwt.MapClaims{"sub": "ming-luo", "exp": time.Now().Add(-time.Minute).Unix()}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodRS256, expiredClaims).SignedString(authen.PrivateKey)
+	errNil(t, err)
+	verified, err := authen.VerifyToken(expired)
+	assert(t, err != nil, "expired token")
+	equals(t, "ming-luo", FailedTokenSubject(expired, verified, err))
+
+	// a token signed by another key does not account for its subject, even expired
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodRS256, expiredClaims).SignedString(other.PrivateKey)
+	errNil(t, err)
+	verified, err = authen.VerifyToken(forged)
+	assert(t, err != nil, "forged token")
+	equals(t, "", FailedTokenSubject(forged, verified, err))
+	verified, err = authen.VerifyToken("not-a-token")
+	equals(t, "", FailedTokenSubject("not-a-token", verified, err))
+
+	// a verified token failing its binding accounts for its subject
+	equals(t, "ming-luo", FailedTokenSubject(forged, VerifiedToken{Subject: "ming-luo"}, errors.New("binding")))
+}
+
+// selfSignedCert creates a client certificate for the token binding
+func selfSignedCert(t *testing.T, cn string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	errNil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	errNil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	errNil(t, err)
+	return cert
+}
+
+func TestTokenBinding(t *testing.T) {
+	authen, err := NewRSAKeyPair()
+	errNil(t, err)
+	cert, other := selfSignedCert(t, "client"), selfSignedCert(t, "other")
+
+	_, err = NewTokenBinding("not-a-digest", nil)
+	assert(t, err != nil, "malformed thumbprint")
+	_, err = NewTokenBinding("", []string{"10.0.0.1"})
+	assert(t, err != nil, "malformed network range")
+	binding, err := NewTokenBinding("", nil)
+	errNil(t, err)
+	assert(t, binding == nil, "no binding")
+
+	binding, err = NewTokenBinding(CertThumbprint(cert), []string{"10.0.0.0/8", " 192.168.1.0/24"})
+	errNil(t, err)
+	token, err := authen.GenerateBoundToken("ming-luo", time.Hour, jwt.SigningMethodRS256, map[string]string{"sub": "ming-luo"}, binding)
+	errNil(t, err)
+	verified, err := authen.VerifyToken(token)
+	errNil(t, err)
+	equals(t, binding, verified.Binding)
+	decoded, err := authen.DecodeToken(token)
+	errNil(t, err)
+	cnf := decoded.Claims.(jwt.MapClaims)["cnf"].(map[string]interface{})
+	equals(t, CertThumbprint(cert), cnf["x5t#S256"])
+
+	errNil(t, verified.Binding.Verify(cert, "10.1.2.3"))
+	errNil(t, verified.Binding.Verify(cert, "192.168.1.20"))
+	assert(t, verified.Binding.Verify(nil, "10.1.2.3") != nil, "missing client certificate")
+	assert(t, verified.Binding.Verify(other, "10.1.2.3") != nil, "another client certificate")
+	assert(t, verified.Binding.Verify(cert, "172.16.0.1") != nil, "out of the network ranges")
+
+	// a delegated token keeps the binding of the parent
+	child, _, _, err := authen.DelegateToken(token, DelegationScope{Namespaces: []string{"ming-luo/ci"}}, time.Hour)
+	errNil(t, err)
+	verified, err = authen.VerifyToken(child)
+	errNil(t, err)
+	equals(t, binding, verified.Binding)
+
+	unbound, err := authen.GenerateToken("ming-luo", time.Hour, jwt.SigningMethodRS256)
+	errNil(t, err)
+	verified, err = authen.VerifyToken(unbound)
+	errNil(t, err)
+	assert(t, verified.Binding == nil, "unbound token")
+
+	// the binding of a delegated token is the parent's regardless of the claims template
+	for _, name := range []string{"cnf", "allowed_cidrs"} {
+		assert(t, (&ClaimsTemplate{Static: map[string]interface{}{name: "x"}}).Validate() != nil, name+" is a reserved claim")
+	}
+	template := authen.ClaimsTemplate
+	authen.ClaimsTemplate = &ClaimsTemplate{Static: map[string]interface{}{"allowed_cidrs": []string{"0.0.0.0/0"}}}
+	child, _, _, err = authen.DelegateToken(token, DelegationScope{Namespaces: []string{"ming-luo/ci"}}, time.Hour)
+	errNil(t, err)
+	verified, err = authen.VerifyToken(child)
+	errNil(t, err)
+	equals(t, binding, verified.Binding)
+	child, _, _, err = authen.DelegateToken(unbound, DelegationScope{Namespaces: []string{"ming-luo/ci"}}, time.Hour)
+	errNil(t, err)
+	verified, err = authen.VerifyToken(child)
+	errNil(t, err)
+	assert(t, verified.Binding == nil, "a delegated token of an unbound parent is unbound")
+	authen.ClaimsTemplate = template
+
+	malformed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "ming-luo", "allowed_cidrs": "10.0.0.0/8"}).SignedString(authen.PrivateKey)
+	errNil(t, err)
+	_, err = authen.VerifyToken(malformed)
+	assert(t, err != nil, "a malformed binding fails the verification")
+}
@@ -22,20 +22,41 @@
 package tests
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/icrypto"
 	. "github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestFederatedPromProcess(t *testing.T) {
 	dat, err := ioutil.ReadFile("./tenantusage.dat")
 	errNil(t, err)
 
-	SetCache("victor", dat)
+	SetCache(dat)
 	rc := FilterFederatedMetrics(dat, "victor")
 	parts := strings.Split(rc, "\n")
 	equals(t, 1, len(parts))
@@ -55,7 +76,7 @@ func TestTenantUsage(t *testing.T) {
 	dat, err := ioutil.ReadFile("./tenantusage.dat")
 	errNil(t, err)
 
-	SetCache(SuperRole, dat)
+	SetCache(dat)
 	err = InitUsageDbTable()
 	errNil(t, err)
 
@@ -100,7 +121,7 @@ func TestTenantNamespaceUsage(t *testing.T) {
 	// dat, err := ioutil.ReadFile("./useast2-aws.dat")
 	errNil(t, err)
 
-	SetCache(SuperRole, dat)
+	SetCache(dat)
 	err = InitUsageDbTable()
 	errNil(t, err)
 
@@ -143,3 +164,1203 @@ func TestTenantNamespaceUsage(t *testing.T) {
 	}
 	assert(t, found, "tenant matched")
 }
+
+func TestAlertRules(t *testing.T) {
+	err := InitAlertRules([]util.AlertRule{{Name: "bad", Expr: "pulsar_msg_backlog >> 5"}})
+	assert(t, err != nil, "invalid expression")
+	err = InitAlertRules([]util.AlertRule{{Name: "bad", Expr: "pulsar_msg_backlog > 5", By: "cluster"}})
+	assert(t, err != nil, "invalid aggregation")
+
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	SetCache(dat)
+	err = InitUsageDbTable()
+	errNil(t, err)
+
+	err = InitAlertRules([]util.AlertRule{
+		{Name: "backlog", Expr: `pulsar_msg_backlog{app="pulsar"} > 5`, By: "tenant", For: 2, Tenants: []string{"ming-luo"}},
+		{Name: "quiet", Expr: "pulsar_msg_backlog > 100", By: "namespace"},
+	})
+	errNil(t, err)
+
+	BuildTenantUsage()
+	equals(t, 0, len(GetFiringAlerts("")))
+
+	BuildTenantUsage()
+	alerts := GetFiringAlerts("ming-luo")
+	equals(t, 1, len(alerts))
+	equals(t, "backlog", alerts[0].Rule)
+	equals(t, "ming-luo", alerts[0].Key)
+	equals(t, float64(6), alerts[0].Value)
+	equals(t, AlertFiring, alerts[0].Status)
+	equals(t, 0, len(GetFiringAlerts("chris-kafkaesque-io")))
+
+	// replacing the rules resets the alert states
+	err = InitAlertRules([]util.AlertRule{})
+	errNil(t, err)
+	equals(t, 0, len(GetFiringAlerts("")))
+}
+
+func TestTopNRanking(t *testing.T) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+
+	entries, err := RankMetric(dat, TopNMetrics["rate-in"], SuperRole, "topic", 3)
+	errNil(t, err)
+	equals(t, 3, len(entries))
+	assert(t, entries[0].Value >= entries[1].Value && entries[1].Value >= entries[2].Value, "ranked in descending order")
+
+	entries, err = RankMetric(dat, TopNMetrics["backlog"], "ming-luo", "namespace", 0)
+	errNil(t, err)
+	equals(t, 2, len(entries))
+	equals(t, float64(6), entries[0].Value+entries[1].Value)
+	for _, v := range entries {
+		equals(t, "ming-luo", v.Tenant)
+		assert(t, strings.HasPrefix(v.Name, "ming-luo/"), "tenant namespace")
+	}
+
+	entries, err = RankMetric(dat, TopNMetrics["storage"], "no-such-tenant", "topic", 10)
+	errNil(t, err)
+	equals(t, 0, len(entries))
+}
+
+func TestNamespaceLabelNormalization(t *testing.T) {
+	dat, err := ioutil.ReadFile("./namespace-labels.dat")
+	errNil(t, err)
+
+	errNil(t, InitNamespaceRewrites(nil))
+	equals(t, "ming-luo/legacy", NormalizeNamespace("ming-luo/useast2-aws/legacy"))
+	equals(t, "ming-luo/namespace2", NormalizeNamespace("ming-luo/namespace2"))
+
+	normalized := string(NormalizeNamespaceLabels(dat))
+	assert(t, strings.Contains(normalized, `namespace="ming-luo/legacy"`), "cluster qualified namespace is rewritten")
+	assert(t, strings.Contains(normalized, `{namespace="ming-luo/first",`), "namespace as the first label is rewritten")
+	assert(t, strings.Contains(normalized, `exported_namespace="victor/useast2-aws/ns"`), "other labels are intact")
+	assert(t, strings.Contains(normalized, `topic="persistent://ming-luo/useast2-aws/legacy/orders"`), "topic label is intact")
+
+	filtered := FilterFederatedMetrics([]byte(normalized), "ming-luo")
+	equals(t, 4, len(strings.Split(strings.TrimSpace(filtered), "\n")))
+	equals(t, "", FilterFederatedMetrics([]byte(normalized), "victor"))
+
+	// configured rules are evaluated before the built-in rule
+	err = InitNamespaceRewrites([]util.NamespaceRewrite{{Match: `^astra-prod-([^/]+)/(.+)$`, Replace: "$1/$2"}})
+	errNil(t, err)
+	normalized = string(NormalizeNamespaceLabels(dat))
+	assert(t, strings.Contains(normalized, `namespace="ming-luo/default"`), "configured rewrite rule")
+	assert(t, strings.Contains(normalized, `namespace="public/default"`), "built-in rewrite rule")
+
+	err = InitNamespaceRewrites([]util.NamespaceRewrite{{Match: `(`}})
+	assert(t, err != nil, "invalid rewrite rule")
+	errNil(t, InitNamespaceRewrites(nil))
+}
+
+func TestCardinalityLimits(t *testing.T) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	countSeries := func(data []byte, prefix string) int {
+		count := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, prefix) {
+				count++
+			}
+		}
+		return count
+	}
+
+	SetCardinalityLimits(0, 0)
+	equals(t, countSeries(dat, "pulsar_"), countSeries(LimitCardinality(dat), "pulsar_"))
+
+	SetCardinalityLimits(5, 0)
+	limited := LimitCardinality(dat)
+	equals(t, 5, countSeries(limited, "pulsar_msg_backlog{"))
+	equals(t, 5, countSeries(limited, "pulsar_rate_in{"))
+	equals(t, 1, countSeries(limited, "# TYPE pulsar_msg_backlog "))
+
+	SetCardinalityLimits(0, 10)
+	limited = LimitCardinality(dat)
+	tenantCount := 0
+	for _, line := range strings.Split(string(limited), "\n") {
+		if strings.Contains(line, `namespace="ming-luo/`) {
+			tenantCount++
+		}
+	}
+	equals(t, 10, tenantCount)
+	SetCardinalityLimits(0, 0)
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	SetCache(dat)
+
+	for _, tenant := range []string{"ming-luo", "chris-kafkaesque-io"} {
+		data, err := GetCache(tenant)
+		errNil(t, err)
+		equals(t, regexFilterFederatedMetrics(dat, tenant+"/"), FilterFederatedMetrics(data, tenant+"/"))
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			assert(t, strings.HasPrefix(line, "#") || strings.Contains(line, `namespace="`+tenant+`/`), "only the tenant's series "+line)
+		}
+	}
+	data, err := GetCache("no-such-tenant")
+	errNil(t, err)
+	equals(t, 0, len(data))
+
+	// the metrics of all the tenants parse the same as the payload
+	parser := expfmt.TextParser{}
+	expected, err := parser.TextToMetricFamilies(bytes.NewReader(dat))
+	errNil(t, err)
+	data, err = GetCache(SuperRole)
+	errNil(t, err)
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	errNil(t, err)
+	equals(t, len(expected), len(families))
+	for name, mf := range expected {
+		equals(t, len(mf.GetMetric()), len(families[name].GetMetric()))
+	}
+
+	raw, resident := CacheSize()
+	equals(t, len(dat), raw)
+	assert(t, resident > raw, "the series entries are counted in the resident size")
+}
+
+// regexFilterFederatedMetrics is the regex matching of the metrics filter, the reference of the in place matching
+func regexFilterFederatedMetrics(byteData []byte, subject string) string {
+	var str strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(byteData))
+	pattern := regexp.MustCompile(`.*[{,]namespace="` + regexp.QuoteMeta(subject) + `.*`)
+	typeDef := ""
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.HasPrefix(text, "# TYPE ") {
+			typeDef = text
+		} else if pattern.MatchString(text) {
+			if typeDef != "" {
+				str.WriteString(typeDef + "\n")
+				typeDef = ""
+			}
+			str.WriteString(text + "\n")
+		}
+	}
+	return str.String()
+}
+
+func TestFilterFederatedMetricsMatchesRegex(t *testing.T) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	for _, subject := range []string{"ming-luo", "chris-kafkaesque-io", "support-kafkaesque-io", "victor", ""} {
+		equals(t, regexFilterFederatedMetrics(dat, subject), FilterFederatedMetrics(dat, subject))
+	}
+	crlf := []byte("# TYPE pulsar_rate_in gauge\r\npulsar_rate_in{namespace=\"acme/ns\"} 1\r\npulsar_rate_in{namespace=\"other/ns\"} 2")
+	equals(t, "# TYPE pulsar_rate_in gauge\npulsar_rate_in{namespace=\"acme/ns\"} 1\n", FilterFederatedMetrics(crlf, "acme"))
+}
+
+func benchmarkFilter(b *testing.B, filter func([]byte, string) string) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	if err != nil {
+		b.Fatal(err)
+	}
+	large := bytes.Repeat(dat, 50)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(large)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter(large, "chris-kafkaesque-io")
+	}
+}
+
+func BenchmarkFilterFederatedMetrics(b *testing.B) {
+	benchmarkFilter(b, FilterFederatedMetrics)
+}
+
+func BenchmarkFilterFederatedMetricsRegex(b *testing.B) {
+	benchmarkFilter(b, regexFilterFederatedMetrics)
+}
+
+func BenchmarkCache(b *testing.B) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	if err != nil {
+		b.Fatal(err)
+	}
+	large := bytes.Repeat(dat, 50)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SetCache(large)
+		if _, err := GetCache("chris-kafkaesque-io"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	_, resident := CacheSize()
+	b.ReportMetric(float64(resident), "resident-bytes")
+}
+
+func TestCacheValidators(t *testing.T) {
+	_, _, ok := GetCacheValidators("no-such-tenant")
+	assert(t, !ok, "no validators without cache")
+
+	SetCache([]byte("pulsar_msg_backlog{namespace=\"etag-tenant/ns\"} 1\npulsar_msg_backlog{namespace=\"other/ns\"} 1\n"))
+	etag1, modTime, ok := GetCacheValidators("etag-tenant")
+	assert(t, ok, "validators of cached tenant")
+	assert(t, strings.HasPrefix(etag1, `"`) && strings.HasSuffix(etag1, `"`), "quoted etag")
+	assert(t, !modTime.IsZero(), "last modified time")
+
+	// a change of another tenant keeps the validators
+	SetCache([]byte("pulsar_msg_backlog{namespace=\"etag-tenant/ns\"} 1\npulsar_msg_backlog{namespace=\"other/ns\"} 2\n"))
+	etag2, modTime2, _ := GetCacheValidators("etag-tenant")
+	equals(t, etag1, etag2)
+	equals(t, modTime, modTime2)
+	etagAll, _, ok := GetCacheValidators(SuperRole)
+	assert(t, ok, "validators of all the tenants")
+
+	SetCache([]byte("pulsar_msg_backlog{namespace=\"etag-tenant/ns\"} 2\npulsar_msg_backlog{namespace=\"other/ns\"} 2\n"))
+	etag3, _, _ := GetCacheValidators("etag-tenant")
+	assert(t, etag1 != etag3, "etag changes with the payload")
+	etagAll2, _, _ := GetCacheValidators(SuperRole)
+	assert(t, etagAll != etagAll2, "etag of all the tenants changes with the payload")
+	_, _, ok = GetCacheValidators("no-such-tenant")
+	assert(t, !ok, "no validators of a tenant without metrics")
+}
+
+// evictMetricsCache drops the metrics cache by tracking an entry over the cache memory budget
+func evictMetricsCache() {
+	budget := util.Config.CacheMemoryBudgetMB
+	util.Config.CacheMemoryBudgetMB = 1
+	util.TrackCacheEntry("evict-test", "evict", 2*1024*1024)
+	util.Config.CacheMemoryBudgetMB = budget
+}
+
+func TestOnDemandScrape(t *testing.T) {
+	value := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value < 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "pulsar_msg_backlog{namespace=\"scrape-tenant/ns\",topic=\"persistent://scrape-tenant/ns/t\"} %d\n", value)
+	}))
+	defer server.Close()
+	util.Config.FederatedPromURL = server.URL
+	defer func() { util.Config.FederatedPromURL = "" }()
+
+	// cold start performs a synchronous scrape that is not cached
+	evictMetricsCache()
+	data, err := GetTenantPromMetrics("scrape-tenant")
+	errNil(t, err)
+	assert(t, strings.HasSuffix(string(data), "} 1\n"), "cold start scrape")
+	_, _, cached := GetCacheValidators("scrape-tenant")
+	assert(t, !cached, "the request path does not write the cache")
+
+	value = 2
+	data, err = ForceScrape("scrape-tenant")
+	errNil(t, err)
+	assert(t, strings.HasSuffix(string(data), "} 2\n"), "forced scrape")
+
+	value = 3
+	data, err = GetTenantPromMetrics("scrape-tenant")
+	errNil(t, err)
+	assert(t, strings.HasSuffix(string(data), "} 2\n"), "cached metrics")
+
+	value = -1
+	_, err = ForceScrape("scrape-tenant")
+	assert(t, err != nil, "failed scrape")
+	data, err = GetTenantPromMetrics("scrape-tenant")
+	errNil(t, err)
+	assert(t, strings.HasSuffix(string(data), "} 2\n"), "cache is intact after a failed scrape")
+}
+
+func TestMetricAllowlist(t *testing.T) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	equals(t, dat, FilterMetricNames(dat, nil))
+
+	filtered := string(FilterMetricNames(dat, []string{"pulsar_msg_backlog", "pulsar_rate_"}))
+	assert(t, strings.Contains(filtered, "# TYPE pulsar_msg_backlog "), "allowed TYPE line")
+	assert(t, strings.Contains(filtered, "\npulsar_rate_in{"), "allowed series")
+	assert(t, !strings.Contains(filtered, "pulsar_consumer_available_permits"), "filtered metric")
+	for _, line := range strings.Split(filtered, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			assert(t, strings.HasPrefix(line, "pulsar_msg_backlog") || strings.HasPrefix(line, "pulsar_rate_"), line)
+		}
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	redis := miniredis.RunT(t)
+	errNil(t, util.InitSharedCache(util.SharedCache{Address: redis.Addr(), RetryAfterSeconds: 60}))
+	defer util.InitSharedCache(util.SharedCache{})
+	equals(t, 60*time.Second, util.VerifiedTokenTTL())
+
+	dat := []byte("pulsar_msg_backlog{namespace=\"shared-a/ns\"} 1\npulsar_msg_backlog{namespace=\"shared-c/ns\"} 1\n")
+	SetCache(dat)
+	assert(t, redis.Exists("burnell:metrics:shared-a"), "cache written through")
+	assert(t, redis.Exists("burnell:metrics:shared-c"), "cache of every tenant written through")
+
+	// another replica's entry is served before the first scrape here
+	evictMetricsCache()
+	entry, err := redis.Get("burnell:metrics:shared-a")
+	errNil(t, err)
+	redis.Set("burnell:metrics:shared-b", entry)
+	data, err := GetCache("shared-b")
+	errNil(t, err)
+	equals(t, "pulsar_msg_backlog{namespace=\"shared-a/ns\"} 1\n", string(data))
+	_, _, ok := GetCacheValidators("shared-b")
+	assert(t, !ok, "shared entry is not installed locally")
+	_, err = GetCache("shared-missing")
+	assert(t, err != nil, "missing in both caches")
+	stats := util.GetSharedCacheStats()
+	assert(t, stats.Enabled && stats.Available, "shared cache available")
+	equals(t, uint64(1), stats.Hits)
+
+	// an unavailable shared cache falls back to the local cache
+	redis.Close()
+	_, err = GetCache("shared-d")
+	assert(t, err != nil, "missing in the local cache")
+	SetCache(dat)
+	data, err = GetCache("shared-c")
+	errNil(t, err)
+	equals(t, "pulsar_msg_backlog{namespace=\"shared-c/ns\"} 1\n", string(data))
+	stats = util.GetSharedCacheStats()
+	assert(t, !stats.Available, "fall back to the local cache after an error")
+	equals(t, uint64(1), stats.Errors)
+}
+
+func TestSignedSharedCache(t *testing.T) {
+	redis := miniredis.RunT(t)
+	errNil(t, util.InitSharedCache(util.SharedCache{Address: redis.Addr(), RetryAfterSeconds: 60}))
+	defer util.InitSharedCache(util.SharedCache{})
+	integrityKey := util.Config.IntegrityKey
+	defer func() { util.Config.IntegrityKey = integrityKey }()
+
+	// nothing is shared or trusted without the key
+	util.Config.IntegrityKey = ""
+	util.SharedCacheSetSigned("signed:a", []byte("value"), time.Minute)
+	assert(t, !redis.Exists("burnell:signed:a"), "not shared without the key")
+	redis.Set("burnell:signed:a", "value")
+	_, ok := util.SharedCacheGetSigned("signed:a")
+	assert(t, !ok, "not trusted without the key")
+
+	util.Config.IntegrityKey = "integrity-key"
+	util.SharedCacheSetSigned("signed:a", []byte("value"), time.Minute)
+	data, ok := util.SharedCacheGetSigned("signed:a")
+	assert(t, ok, "signed entry")
+	equals(t, "value", string(data))
+
+	// a forged or a moved entry is a miss
+	entry, err := redis.Get("burnell:signed:a")
+	errNil(t, err)
+	redis.Set("burnell:signed:b", entry)
+	_, ok = util.SharedCacheGetSigned("signed:b")
+	assert(t, !ok, "entry moved to another key")
+	redis.Set("burnell:signed:a", strings.Repeat("0", 64)+"forged")
+	_, ok = util.SharedCacheGetSigned("signed:a")
+	assert(t, !ok, "forged entry")
+
+	// a session forged in the shared cache is rejected
+	sum := sha256.Sum256([]byte("forged-session"))
+	forged, _ := json.Marshal(util.Session{Token: icrypto.VerifiedToken{Subject: "superuser"}, ExpiresAt: time.Now().Add(time.Hour)})
+	redis.Set("burnell:session:"+hex.EncodeToString(sum[:]), strings.Repeat("0", 64)+string(forged))
+	_, err = util.GetSession("forged-session")
+	equals(t, util.ErrInvalidSession, err)
+}
+
+func TestUsageStatements(t *testing.T) {
+	ResetUsageStatements()
+	defer ResetUsageStatements()
+	pushed := make(chan []byte, 1)
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		equals(t, "text/csv", r.Header.Get("Content-Type"))
+		equals(t, "Bearer billing", r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		pushed <- body
+	}))
+	defer destination.Close()
+	statementsCfg := util.Config.UsageStatements
+	util.Config.UsageStatements = util.UsageStatements{
+		Destination: destination.URL,
+		Format:      "csv",
+		Headers:     map[string]string{"Authorization": "Bearer billing"},
+	}
+	defer func() { util.Config.UsageStatements = statementsCfg }()
+
+	scrape := func(bytesIn, bytesOut, storage int, at time.Time) {
+		text := fmt.Sprintf(`# TYPE pulsar_in_bytes_total counter
+pulsar_in_bytes_total{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+pulsar_in_bytes_total{namespace="acme/ns",topic="persistent://acme/ns/b"} 0
+# TYPE pulsar_out_bytes_total counter
+pulsar_out_bytes_total{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+# TYPE pulsar_storage_size gauge
+pulsar_storage_size{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+`, bytesIn, bytesOut, storage)
+		parser := expfmt.TextParser{}
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		errNil(t, err)
+		RollupUsageStatements(mfs, at)
+	}
+
+	t0 := time.Date(2026, 9, 30, 23, 0, 0, 0, time.UTC)
+	scrape(1000, 500, 2e9, t0)
+	scrape(4600, 500, 2e9, t0.Add(30*time.Minute))
+	statements := GetUsageStatements("acme", "2026-09")
+	equals(t, 1, len(statements))
+	equals(t, uint64(3600), statements[0].BytesIn)
+	equals(t, float64(2), statements[0].PeakThroughput)
+	equals(t, float64(1), statements[0].StorageGBHours)
+	equals(t, 2, statements[0].Topics)
+	assert(t, !statements[0].Final, "the statement of the current cycle is open")
+
+	// the counter reset by a broker restart in the next cycle
+	scrape(100, 600, 2e9, t0.Add(90*time.Minute))
+	statements = GetUsageStatements("", "2026-09")
+	equals(t, 1, len(statements))
+	assert(t, statements[0].Final, "the statement of the previous cycle is closed")
+	equals(t, uint64(3600), statements[0].BytesIn)
+	statements = GetUsageStatements("acme", "2026-10")
+	equals(t, uint64(100), statements[0].BytesIn)
+	equals(t, uint64(100), statements[0].BytesOut)
+
+	select {
+	case body := <-pushed:
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		equals(t, 2, len(lines))
+		assert(t, strings.HasPrefix(lines[0], "tenant,cycle,from,to,bytes_in"), "the csv header row")
+		assert(t, strings.HasPrefix(lines[1], "acme,2026-09,"), "the closed statement row")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the closed statements are not pushed")
+	}
+}
+
+func TestCostAllocations(t *testing.T) {
+	ResetUsageStatements()
+	defer ResetUsageStatements()
+	assert(t, util.ValidateCostLabels(map[string]string{"Team": "payments"}) != nil, "an upper case label name")
+	assert(t, util.ValidateCostLabels(map[string]string{"team": "a,b"}) != nil, "a label value with a comma")
+	labels := map[string]string{"team": "payments", "cost-center": "cc-42"}
+	errNil(t, util.ValidateCostLabels(labels))
+	util.ApplyCostLabels(util.NamespaceCostLabels{Tenant: "acme", Namespace: "payments", Labels: labels})
+	defer util.ApplyCostLabels(util.NamespaceCostLabels{Tenant: "acme", Namespace: "payments", Deleted: true})
+	equals(t, "cost-center=cc-42,team=payments", util.CostLabelKey(labels))
+
+	scrape := func(payments, other int, at time.Time) {
+		text := fmt.Sprintf(`# TYPE pulsar_in_bytes_total counter
+pulsar_in_bytes_total{namespace="acme/payments",topic="persistent://acme/payments/a"} %d
+pulsar_in_bytes_total{namespace="acme/other",topic="persistent://acme/other/a"} %d
+# TYPE pulsar_storage_size gauge
+pulsar_storage_size{namespace="acme/payments",topic="persistent://acme/payments/a"} 1000000000
+`, payments, other)
+		parser := expfmt.TextParser{}
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		errNil(t, err)
+		RollupUsageStatements(mfs, at)
+	}
+	t0 := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	scrape(100, 100, t0)
+	scrape(400, 150, t0.Add(time.Hour))
+
+	statements := GetUsageStatements("acme", "2026-10")
+	equals(t, 1, len(statements))
+	equals(t, uint64(350), statements[0].BytesIn)
+	allocations := statements[0].Allocations
+	equals(t, 2, len(allocations))
+	equals(t, 0, len(allocations[0].Labels))
+	equals(t, uint64(50), allocations[0].BytesIn)
+	equals(t, labels, allocations[1].Labels)
+	equals(t, uint64(300), allocations[1].BytesIn)
+	equals(t, float64(1), allocations[1].StorageGBHours)
+
+	var buf bytes.Buffer
+	errNil(t, WriteCostAllocationsCSV(&buf, statements))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	equals(t, 3, len(lines))
+	equals(t, `acme,2026-10,"cost-center=cc-42,team=payments",300,0,1.000000,false`, lines[2])
+}
+
+func TestUsageForecast(t *testing.T) {
+	ResetUsageStatements()
+	defer ResetUsageStatements()
+	statementsCfg := util.Config.UsageStatements
+	util.Config.UsageStatements = util.UsageStatements{HistoryDays: 4}
+	defer func() { util.Config.UsageStatements = statementsCfg }()
+
+	t0 := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 6; day++ {
+		text := fmt.Sprintf(`# TYPE pulsar_in_bytes_total counter
+pulsar_in_bytes_total{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+# TYPE pulsar_storage_size gauge
+pulsar_storage_size{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+`, day*86400*100, (day+1)*1000000000)
+		parser := expfmt.TextParser{}
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		errNil(t, err)
+		RollupUsageStatements(mfs, t0.AddDate(0, 0, day))
+	}
+
+	forecasts := GetUsageForecasts("acme", 30)
+	equals(t, 1, len(forecasts))
+	f := forecasts[0]
+	equals(t, 4, f.HistoryDays)
+	equals(t, float64(6e9), f.StorageBytes.Current)
+	equals(t, float64(1e9), f.StorageBytes.SlopePerDay)
+	equals(t, float64(36e9), f.StorageBytes.Projected)
+	equals(t, float64(100), f.PeakThroughput.Current)
+	equals(t, float64(0), f.PeakThroughput.SlopePerDay)
+	equals(t, 0, len(GetUsageForecasts("victor", 30)))
+}
+
+func TestStorageHistory(t *testing.T) {
+	ResetUsageStatements()
+	defer ResetUsageStatements()
+	statementsCfg := util.Config.UsageStatements
+	util.Config.UsageStatements = util.UsageStatements{HistoryDays: 3}
+	defer func() { util.Config.UsageStatements = statementsCfg }()
+
+	t0 := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 5; day++ {
+		text := fmt.Sprintf(`# TYPE pulsar_storage_size gauge
+pulsar_storage_size{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+pulsar_storage_size{namespace="acme/ns",topic="persistent://acme/ns/b"} 1000
+# TYPE pulsar_storage_offloaded_size gauge
+pulsar_storage_offloaded_size{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+`, (day+1)*1000, day*500)
+		parser := expfmt.TextParser{}
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		errNil(t, err)
+		RollupUsageStatements(mfs, t0.AddDate(0, 0, day))
+	}
+
+	histories := GetStorageHistory("acme", 0)
+	equals(t, 1, len(histories))
+	h := histories[0]
+	equals(t, 3, len(h.Daily))
+	equals(t, "2026-10-03", h.Daily[0].Date)
+	equals(t, float64(4000), h.Daily[0].StorageBytes)
+	equals(t, float64(1000), h.Daily[0].OffloadedBytes)
+	equals(t, float64(6000), h.Daily[2].StorageBytes)
+	equals(t, float64(2000), h.Daily[2].OffloadedBytes)
+	equals(t, float64(8000), h.Daily[2].TotalBytes)
+	equals(t, float64(3000), h.GrowthBytes)
+
+	h = GetStorageHistory("acme", 2)[0]
+	equals(t, 2, len(h.Daily))
+	equals(t, float64(1500), h.GrowthBytes)
+	equals(t, 0, len(GetStorageHistory("victor", 0)))
+}
+
+func TestSubscriptionLag(t *testing.T) {
+	dat := []byte(`# TYPE pulsar_subscription_back_log gauge
+pulsar_subscription_back_log{namespace="acme/ns",topic="persistent://acme/ns/a-partition-0",subscription="s1"} 600
+pulsar_subscription_back_log{namespace="acme/ns",topic="persistent://acme/ns/a-partition-1",subscription="s1"} 400
+pulsar_subscription_back_log{namespace="acme/ns",topic="persistent://acme/ns/b",subscription="s2"} 50
+pulsar_subscription_back_log{namespace="acme/ns",topic="persistent://acme/ns/c",subscription="s3"} 0
+pulsar_subscription_back_log{namespace="victor/ns",topic="persistent://victor/ns/d",subscription="s4"} 9000
+# TYPE pulsar_subscription_msg_rate_out gauge
+pulsar_subscription_msg_rate_out{namespace="acme/ns",topic="persistent://acme/ns/a-partition-0",subscription="s1"} 6
+pulsar_subscription_msg_rate_out{namespace="acme/ns",topic="persistent://acme/ns/a-partition-1",subscription="s1"} 4
+pulsar_subscription_msg_rate_out{namespace="acme/ns",topic="persistent://acme/ns/b",subscription="s2"} 0
+`)
+	report, err := SubscriptionLagReport(dat, "acme", "backlog", false)
+	errNil(t, err)
+	equals(t, 3, len(report))
+	equals(t, "persistent://acme/ns/a", report[0].Topic)
+	equals(t, float64(1000), report[0].Backlog)
+	equals(t, float64(10), report[0].RateOut)
+	equals(t, float64(100), *report[0].TimeToDrainSeconds)
+	assert(t, report[1].TimeToDrainSeconds == nil, "expected a backlog without consumption never drains")
+	equals(t, float64(0), *report[2].TimeToDrainSeconds)
+
+	report, err = SubscriptionLagReport(dat, "acme", "drain", false)
+	errNil(t, err)
+	equals(t, "s2", report[0].Subscription)
+	equals(t, "s1", report[1].Subscription)
+
+	report, err = SubscriptionLagReport(dat, "acme", "name", true)
+	errNil(t, err)
+	equals(t, "s1", report[0].Subscription)
+	equals(t, "s3", report[2].Subscription)
+
+	_, err = SubscriptionLagReport(dat, "acme", "size", false)
+	assert(t, err != nil, "expected an unsupported sort error")
+}
+
+func TestStripeUsageReports(t *testing.T) {
+	ResetUsageStatements()
+	defer ResetUsageStatements()
+	ResetStripeReports()
+	defer ResetStripeReports()
+
+	received := []*http.Request{}
+	quantities := []string{}
+	stripe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = append(received, r)
+		quantities = append(quantities, r.PostForm.Get("quantity"))
+		w.Write([]byte(`{"id":"mbur_1"}`))
+	}))
+	defer stripe.Close()
+	stripeCfg := util.Config.Stripe
+	util.Config.Stripe = util.Stripe{Enabled: true, APIKey: "sk_test", APIURL: stripe.URL}
+	defer func() { util.Config.Stripe = stripeCfg }()
+
+	util.ApplyBillingAccount(util.BillingAccount{Tenant: "acme", Customer: "cus_1", Items: map[string]string{"bytes_in_gb": "si_in"}})
+	defer util.ApplyBillingAccount(util.BillingAccount{Tenant: "acme", Deleted: true})
+
+	now := time.Date(2026, 10, 10, 12, 0, 0, 0, time.UTC)
+	rollup := func(bytesIn int64, at time.Time) {
+		text := fmt.Sprintf(`# TYPE pulsar_in_bytes_total counter
+pulsar_in_bytes_total{namespace="acme/ns",topic="persistent://acme/ns/a"} %d
+`, bytesIn)
+		parser := expfmt.TextParser{}
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		errNil(t, err)
+		RollupUsageStatements(mfs, at)
+	}
+	rollup(0, now)
+	rollup(2500000000, now.Add(time.Hour))
+
+	reports := ReportStripeUsage(now.Add(time.Hour))
+	equals(t, 1, len(reports))
+	equals(t, int64(2), reports[0].Quantity)
+	equals(t, "", reports[0].Error)
+	equals(t, 1, len(received))
+	equals(t, "/v1/subscription_items/si_in/usage_records", received[0].URL.Path)
+	equals(t, "Bearer sk_test", received[0].Header.Get("Authorization"))
+	equals(t, reports[0].IdempotencyKey, received[0].Header.Get("Idempotency-Key"))
+	equals(t, "2", quantities[0])
+
+	// an unchanged total is not reported again
+	equals(t, 0, len(ReportStripeUsage(now.Add(2*time.Hour))))
+
+	rollup(4000000000, now.Add(3*time.Hour))
+	reports = ReportStripeUsage(now.Add(3 * time.Hour))
+	equals(t, 1, len(reports))
+	equals(t, int64(4), reports[0].Total)
+	equals(t, 2, len(GetStripeReports()))
+
+	// the record of the cycle is set to the total, so a report repeated after a restart is not billed twice
+	ResetStripeReports()
+	equals(t, 1, len(ReportStripeUsage(now.Add(4*time.Hour))))
+	equals(t, []string{"2", "4", "4"}, quantities)
+	for _, r := range received {
+		equals(t, "set", r.PostForm.Get("action"))
+		equals(t, strconv.FormatInt(now.Unix(), 10), r.PostForm.Get("timestamp"))
+	}
+
+	// the dry run logs the records without sending them
+	ResetStripeReports()
+	util.Config.Stripe.DryRun = true
+	reports = ReportStripeUsage(now.Add(3 * time.Hour))
+	equals(t, 1, len(reports))
+	assert(t, reports[0].DryRun, "expected a dry run report")
+	equals(t, 3, len(received))
+}
+
+func TestStreamingScrape(t *testing.T) {
+	longLine := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE pulsar_msg_backlog gauge\n")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "pulsar_msg_backlog{namespace=\"stream-tenant/cluster1/ns\",topic=\"persistent://stream-tenant/ns/t%d\"} %d\n", i, i)
+		}
+		if longLine {
+			fmt.Fprintf(w, "pulsar_msg_backlog{namespace=\"stream-tenant/ns\",topic=\"%s\"} 1\n", strings.Repeat("t", 256))
+		}
+	}))
+	defer server.Close()
+	util.Config.FederatedPromURL = server.URL
+	defer func() { util.Config.FederatedPromURL = "" }()
+	SetCardinalityLimits(3, 0)
+	defer SetCardinalityLimits(0, 0)
+	SetMaxScrapeLineBytes(200)
+	defer SetMaxScrapeLineBytes(0)
+
+	data, err := ForceScrape("stream-tenant")
+	errNil(t, err)
+	equals(t, 3, strings.Count(string(data), "pulsar_msg_backlog{"))
+	assert(t, strings.HasPrefix(string(data), "# TYPE pulsar_msg_backlog gauge\n"), "type definition is kept")
+	assert(t, !strings.Contains(string(data), "cluster1"), "namespace label is normalized while streaming")
+
+	longLine = true
+	_, err = ForceScrape("stream-tenant")
+	assert(t, err != nil && strings.Contains(err.Error(), "max line size"), "a line over the max size rejects the scrape")
+	cached, err := GetTenantPromMetrics("stream-tenant")
+	errNil(t, err)
+	equals(t, string(data), string(cached))
+
+	longLine = false
+	SetMaxScrapeBytes(100)
+	defer SetMaxScrapeBytes(0)
+	_, err = ForceScrape("stream-tenant")
+	assert(t, err != nil && strings.Contains(err.Error(), "max size"), "a payload over the max size rejects the scrape")
+	cached, err = GetTenantPromMetrics("stream-tenant")
+	errNil(t, err)
+	equals(t, string(data), string(cached))
+}
+
+func TestScrapeClientReuse(t *testing.T) {
+	var conns, slowScrape int32
+	slow := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slowScrape) == 1 {
+			<-slow
+		}
+		fmt.Fprint(w, "pulsar_msg_backlog{namespace=\"reuse-tenant/ns\",topic=\"persistent://reuse-tenant/ns/t\"} 1\n")
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	defer close(slow)
+	util.Config.FederatedPromURL = server.URL
+	defer func() { util.Config.FederatedPromURL = "" }()
+
+	for i := 0; i < 3; i++ {
+		_, err := ForceScrape("reuse-tenant")
+		errNil(t, err)
+	}
+	equals(t, int32(1), atomic.LoadInt32(&conns))
+
+	// a scrape overrunning the timeout is cancelled
+	os.Setenv("ScrapeTimeoutSeconds", "1")
+	defer os.Unsetenv("ScrapeTimeoutSeconds")
+	atomic.StoreInt32(&slowScrape, 1)
+	start := time.Now()
+	_, err := ForceScrape("reuse-tenant")
+	assert(t, err != nil, "overrunning scrape is cancelled")
+	assert(t, time.Since(start) < 5*time.Second, "scrape is cancelled at the timeout")
+}
+
+func TestMetricsCacheMemoryBudget(t *testing.T) {
+	util.Config.CacheMemoryBudgetMB = 1
+	defer func() { util.Config.CacheMemoryBudgetMB = 0 }()
+
+	data := bytes.Repeat([]byte("pulsar_msg_backlog{namespace=\"budget/ns\"} 1\n"), 600*1024/45)
+	SetCache(data)
+	cached, err := GetCache("budget")
+	errNil(t, err)
+	equals(t, len(data), len(cached))
+
+	util.TrackCacheEntry("budget-other", "1", 600*1024)
+	_, err = GetCache("budget")
+	assert(t, err != nil, "least recently used metrics cache is evicted")
+	_, _, ok := GetCacheValidators("budget")
+	assert(t, !ok, "evicted cache has no validators")
+	assert(t, util.GetMemoryBudgetStats().Evictions["metrics"] > 0, "eviction is counted")
+}
+
+func TestCacheReadsDuringRebuilds(t *testing.T) {
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	SetCache(dat)
+	expected, err := GetCache("ming-luo")
+	errNil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			SetCache(dat)
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+			data, err := GetCache("ming-luo")
+			errNil(t, err)
+			equals(t, len(expected), len(data))
+			_, _, ok := GetCacheValidators("ming-luo")
+			assert(t, ok, "the entry is never missing while the cache is rebuilt")
+		}
+	}
+}
+
+// BenchmarkCacheReadsDuringScrapes reads a tenant cache in parallel while the cache is rebuilt by scrapes
+func BenchmarkCacheReadsDuringScrapes(b *testing.B) {
+	data := []byte("pulsar_msg_backlog{namespace=\"bench-tenant/ns\"} 1\n")
+	for i := 0; i < 100; i++ {
+		data = append(data, fmt.Sprintf("pulsar_msg_backlog{namespace=\"bench-scrape-%d/ns\"} 1\n", i)...)
+	}
+	SetCache(data)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				SetCache(data)
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := GetCache("bench-tenant"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestKafkaMetricNames(t *testing.T) {
+	text := `# TYPE pulsar_subscription_back_log gauge
+pulsar_subscription_back_log{cluster="useast2",namespace="ming-luo/ns",topic="persistent://ming-luo/ns/orders-partition-2",subscription="billing",instance="broker-0"} 42 1590157763983
+pulsar_subscription_back_log{cluster="useast2",namespace="ming-luo/ns",topic="persistent://ming-luo/ns/audit",subscription="archiver"} 7
+# TYPE pulsar_in_bytes_total untyped
+pulsar_in_bytes_total{namespace="ming-luo/ns",topic="persistent://ming-luo/ns/audit"} 1024
+# TYPE pulsar_rate_in gauge
+pulsar_rate_in{namespace="ming-luo/ns",topic="persistent://ming-luo/ns/audit"} 3
+`
+	data, err := KafkaMetricNames([]byte(text))
+	errNil(t, err)
+	translated := string(data)
+	assert(t, strings.Contains(translated, "# TYPE kafka_consumergroup_lag gauge\n"), translated)
+	assert(t, strings.Contains(translated,
+		`kafka_consumergroup_lag{cluster="useast2",consumergroup="billing",namespace="ming-luo/ns",partition="2",topic="orders"} 42 1590157763983`), translated)
+	assert(t, strings.Contains(translated,
+		`kafka_consumergroup_lag{cluster="useast2",consumergroup="archiver",namespace="ming-luo/ns",partition="0",topic="audit"} 7`), translated)
+	assert(t, strings.Contains(translated,
+		`kafka_server_brokertopicmetrics_bytesin_total{namespace="ming-luo/ns",partition="0",topic="audit"} 1024`), translated)
+	assert(t, !strings.Contains(translated, "pulsar_"), "untranslated metrics are dropped")
+
+	dat, err := ioutil.ReadFile("./tenantusage.dat")
+	errNil(t, err)
+	data, err = KafkaMetricNames(dat)
+	errNil(t, err)
+	assert(t, bytes.Contains(data, []byte("kafka_server_brokertopicmetrics_bytesin_total{")), "translated federated metrics")
+}
+
+func TestDatadogMetrics(t *testing.T) {
+	text := `# TYPE pulsar_subscription_back_log gauge
+pulsar_subscription_back_log{instance="broker-0",namespace="dd-acme/ns",topic="persistent://dd-acme/ns/orders",subscription="billing"} 42 1590157763983
+# TYPE pulsar_storage_write_latency summary
+pulsar_storage_write_latency{namespace="dd-acme/ns",quantile="0.99"} 12.5
+pulsar_storage_write_latency_sum{namespace="dd-acme/ns"} 300
+pulsar_storage_write_latency_count{namespace="dd-acme/ns"} 40
+`
+	series, err := DatadogMetrics([]byte(text), []string{"env:prod"})
+	errNil(t, err)
+	byName := map[string]DatadogSeries{}
+	for _, s := range series {
+		byName[s.Metric] = s
+	}
+	lag, ok := byName["pulsar.subscription_back_log"]
+	assert(t, ok, "gauge series")
+	equals(t, [][2]float64{{1590157763, 42}}, lag.Points)
+	equals(t, "gauge", lag.Type)
+	equals(t, []string{"namespace:dd-acme/ns", "topic:persistent://dd-acme/ns/orders", "subscription:billing", "env:prod"}, lag.Tags)
+	equals(t, float64(40), byName["pulsar.storage_write_latency.count"].Points[0][1])
+	equals(t, float64(300), byName["pulsar.storage_write_latency.sum"].Points[0][1])
+	equals(t, []string{"quantile:0.99", "namespace:dd-acme/ns", "env:prod"}, byName["pulsar.storage_write_latency.quantile"].Tags)
+
+	SetCache([]byte(text))
+	// the series API of the tenant's account
+	posted := make(chan DatadogPayload, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		equals(t, "/api/v1/series", r.URL.Path)
+		equals(t, "dd-key", r.Header.Get("DD-API-KEY"))
+		var payload DatadogPayload
+		errNil(t, json.NewDecoder(r.Body).Decode(&payload))
+		posted <- payload
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+	errNil(t, PushDatadogMetrics(util.DatadogTenant{Tenant: "dd-acme", APIKey: "dd-key", Site: api.URL}))
+	equals(t, len(series), len((<-posted).Series))
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	assertErr(t, "datadog series API responded 403", PushDatadogMetrics(util.DatadogTenant{Tenant: "dd-acme", APIKey: "bad", Site: forbidden.URL}))
+
+	// a DogStatsD agent
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	errNil(t, err)
+	defer conn.Close()
+	errNil(t, PushDatadogMetrics(util.DatadogTenant{Tenant: "dd-acme", StatsdAddress: conn.LocalAddr().String(), Tags: []string{"env:prod"}}))
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	errNil(t, err)
+	assert(t, strings.Contains(string(buf[:n]),
+		"pulsar.subscription_back_log:42|g|#namespace:dd-acme/ns,topic:persistent://dd-acme/ns/orders,subscription:billing,env:prod"), string(buf[:n]))
+}
+
+func TestStatsdUsagePush(t *testing.T) {
+	errNil(t, InitUsageDbTable())
+	errNil(t, UpdatePerBrokerTenantUsage("persistent://statsd-acme/ns/orders", "broker-0", "pulsar_in_bytes_total", 2048))
+	errNil(t, UpdatePerBrokerTenantUsage("persistent://statsd-acme/ns/orders", "broker-0", "pulsar_msg_backlog", 7))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	errNil(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	settings := util.TenantSettings{StatsdHost: "127.0.0.1", StatsdPort: port, StatsdPrefix: "legacy.acme"}
+	errNil(t, settings.Validate())
+	util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "statsd-acme", Settings: settings})
+	defer util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "statsd-acme", Deleted: true})
+
+	errNil(t, PushStatsdUsage("statsd-acme"))
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	errNil(t, err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	equals(t, 5, len(lines))
+	assert(t, strings.Contains(string(buf[:n]), "legacy.acme.totalBytesIn:2048|g"), string(buf[:n]))
+	assert(t, strings.Contains(string(buf[:n]), "legacy.acme.msgInBacklog:7|g"), string(buf[:n]))
+
+	assert(t, util.TenantSettings{StatsdPort: 70000}.Validate() != nil, "invalid port")
+}
+
+func TestCloudWatchEMF(t *testing.T) {
+	text := `# TYPE pulsar_msg_backlog gauge
+pulsar_msg_backlog{namespace="cw-acme/ns1",topic="persistent://cw-acme/ns1/a"} 3
+pulsar_msg_backlog{namespace="cw-acme/ns1",topic="persistent://cw-acme/ns1/b"} 4
+pulsar_msg_backlog{namespace="cw-acme/ns2",topic="persistent://cw-acme/ns2/a"} 1
+pulsar_msg_backlog{namespace="other/ns1",topic="persistent://other/ns1/a"} 100
+# TYPE pulsar_rate_in gauge
+pulsar_rate_in{namespace="cw-acme/ns1",topic="persistent://cw-acme/ns1/a"} 2.5
+# TYPE pulsar_rate_out gauge
+pulsar_rate_out{namespace="cw-acme/ns1",topic="persistent://cw-acme/ns1/a"} 9
+`
+	settings := util.TenantSettings{CloudWatchMetrics: []string{"pulsar_msg_backlog", "pulsar_rate_in"}}
+	errNil(t, settings.Validate())
+	now := time.Unix(1700000000, 0)
+	records, err := CloudWatchEMFRecords("cw-acme", []byte(text), settings, now)
+	errNil(t, err)
+	equals(t, 2, len(records))
+
+	var record map[string]interface{}
+	errNil(t, json.Unmarshal(records[0], &record))
+	equals(t, "cw-acme/ns1", record["Namespace"])
+	equals(t, float64(7), record["pulsar_msg_backlog"])
+	equals(t, 2.5, record["pulsar_rate_in"])
+	_, ok := record["pulsar_rate_out"]
+	assert(t, !ok, "only the selected metrics")
+	aws := record["_aws"].(map[string]interface{})
+	equals(t, float64(1700000000000), aws["Timestamp"])
+	directive := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	equals(t, "Pulsar/cw-acme", directive["Namespace"])
+	equals(t, []interface{}{[]interface{}{"Tenant", "Namespace"}}, directive["Dimensions"])
+	equals(t, 2, len(directive["Metrics"].([]interface{})))
+
+	// the records are sent to the CloudWatch agent
+	SetCache([]byte(text))
+	util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "cw-acme", Settings: settings})
+	defer util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "cw-acme", Deleted: true})
+	agent, err := net.Listen("tcp", "127.0.0.1:0")
+	errNil(t, err)
+	defer agent.Close()
+	cwCfg := util.Config.CloudWatchEMF
+	util.Config.CloudWatchEMF = util.CloudWatchEMF{Endpoint: "tcp://" + agent.Addr().String()}
+	defer func() { util.Config.CloudWatchEMF = cwCfg }()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := agent.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		lines := []string{}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+	errNil(t, ExportCloudWatchEMF("cw-acme"))
+	lines := <-received
+	equals(t, 2, len(lines))
+	assert(t, strings.Contains(lines[1], `"Namespace":"cw-acme/ns2"`), lines[1])
+
+	util.Config.CloudWatchEMF = util.CloudWatchEMF{Endpoint: "http://127.0.0.1:25888"}
+	assertErr(t, "unsupported cloudwatch endpoint http://127.0.0.1:25888", ExportCloudWatchEMF("cw-acme"))
+}
+
+func TestS3Export(t *testing.T) {
+	type s3Object struct {
+		body     []byte
+		modified time.Time
+	}
+	objects := map[string]s3Object{}
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=exporter/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/reports/")
+		switch r.Method {
+		case http.MethodPut:
+			if r.Header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" ||
+				r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "key-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			objects[key] = s3Object{body: body, modified: time.Now()}
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			fmt.Fprint(w, "<ListBucketResult>")
+			for k, o := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>", k, o.modified.Format(time.RFC3339))
+				}
+			}
+			fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+		}
+	}))
+	defer server.Close()
+
+	original := util.Config.S3Export
+	defer func() { util.Config.S3Export = original }()
+	util.Config.S3Export = util.S3Export{
+		Endpoint:             server.URL,
+		Bucket:               "reports",
+		PathStyle:            true,
+		AccessKeyID:          "exporter",
+		SecretAccessKey:      "secret",
+		PathTemplate:         "exports/{tenant}/{year}/{month}/{kind}-{day}.{ext}",
+		ServerSideEncryption: "aws:kms",
+		KMSKeyID:             "key-1",
+		RetentionDays:        30,
+		IntervalMinutes:      600,
+	}
+	StartS3Export()
+
+	errNil(t, InitUsageDbTable())
+	errNil(t, UpdatePerBrokerTenantUsage("persistent://s3-acme/ns1/topic", "broker-1", "pulsar_in_bytes_total", 512))
+	SetCache([]byte("pulsar_msg_backlog{namespace=\"s3-acme/ns1\"} 3\n"))
+	audit.Record(audit.Event{Subject: "admin", Tenant: "s3-acme", Action: "tenant.update", Outcome: audit.Succeeded})
+
+	now := time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC)
+	// the tenants of the other tests have no metrics to scrape, so only the keys are checked
+	keys, _ := ExportToS3(now)
+	for _, key := range []string{"exports/s3-acme/2024/03/audit-07.jsonl", "exports/s3-acme/2024/03/usage-07.json", "exports/s3-acme/2024/03/metrics-07.prom"} {
+		assert(t, util.StrContains(keys, key), "exported "+key)
+		_, ok := objects[key]
+		assert(t, ok, "stored "+key)
+	}
+
+	var event audit.Event
+	errNil(t, json.Unmarshal(objects["exports/s3-acme/2024/03/audit-07.jsonl"].body, &event))
+	equals(t, "tenant.update", event.Action)
+	var rollup S3UsageRollup
+	errNil(t, json.Unmarshal(objects["exports/s3-acme/2024/03/usage-07.json"].body, &rollup))
+	equals(t, uint64(512), rollup.Tenant.TotalBytesIn)
+	equals(t, "s3-acme/ns1", rollup.Namespaces[0].Name)
+
+	// the audit archive is emptied by the export
+	keys, _ = ExportToS3(now)
+	assert(t, util.StrContains(keys, "exports/s3-acme/2024/03/usage-07.json"), "usage exported again")
+	assert(t, !util.StrContains(keys, "exports/s3-acme/2024/03/audit-07.jsonl"), "no audit events since the export")
+
+	// only the expired objects rendered from the template are deleted
+	lock.Lock()
+	objects["exports/s3-acme/2023/01/usage-01.json"] = s3Object{modified: now.AddDate(0, -2, 0)}
+	objects["exports/manual-report.csv"] = s3Object{modified: now.AddDate(0, -2, 0)}
+	lock.Unlock()
+	deleted, err := ApplyS3Retention(time.Now())
+	errNil(t, err)
+	equals(t, 1, deleted)
+	_, ok := objects["exports/manual-report.csv"]
+	assert(t, ok, "an object outside of the template is kept")
+	_, ok = objects["exports/s3-acme/2024/03/usage-07.json"]
+	assert(t, ok, "an object within the retention is kept")
+}
+
+func TestOTLPMetricsExport(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total", Help: "requests"}, []string{"code"})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency_seconds", Buckets: []float64{0.1, 1}})
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_inflight"})
+	registry.MustRegister(requests, latency, inflight)
+	requests.WithLabelValues("200").Add(3)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+	inflight.Set(2)
+
+	var received colmetricspb.ExportMetricsServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("Authorization") != "Bearer collector" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	original := util.Config.OTLPMetrics
+	defer func() { util.Config.OTLPMetrics = original }()
+	util.Config.OTLPMetrics = util.OTLPMetrics{
+		Endpoint:    strings.TrimPrefix(server.URL, "http://"),
+		Insecure:    true,
+		Headers:     map[string]string{"Authorization": "Bearer collector"},
+		ServiceName: "burnell-test",
+	}
+	errNil(t, PushOTLPMetrics(server.Client(), registry, time.Now()))
+
+	equals(t, 1, len(received.ResourceMetrics))
+	resource := received.ResourceMetrics[0]
+	equals(t, "service.name", resource.Resource.Attributes[0].Key)
+	equals(t, "burnell-test", resource.Resource.Attributes[0].Value.GetStringValue())
+	metrics := resource.ScopeMetrics[0].Metrics
+	equals(t, 3, len(metrics))
+	for _, m := range metrics {
+		switch m.Name {
+		case "test_requests_total":
+			sum := m.GetSum()
+			assert(t, sum.IsMonotonic, "a counter is monotonic")
+			equals(t, 3.0, sum.DataPoints[0].GetAsDouble())
+			equals(t, "code", sum.DataPoints[0].Attributes[0].Key)
+			assert(t, sum.DataPoints[0].StartTimeUnixNano < sum.DataPoints[0].TimeUnixNano, "cumulative since the start")
+		case "test_latency_seconds":
+			point := m.GetHistogram().DataPoints[0]
+			equals(t, uint64(3), point.Count)
+			equals(t, []float64{0.1, 1}, point.ExplicitBounds)
+			equals(t, []uint64{1, 1, 1}, point.BucketCounts)
+		case "test_inflight":
+			equals(t, 2.0, m.GetGauge().DataPoints[0].GetAsDouble())
+		default:
+			t.Fatalf("unexpected metric %s", m.Name)
+		}
+	}
+
+	util.Config.OTLPMetrics.Headers = nil
+	err := PushOTLPMetrics(server.Client(), registry, time.Now())
+	assert(t, err != nil && strings.Contains(err.Error(), "status 400"), "a rejected export is an error")
+}
+
+func TestSLOWindowLabel(t *testing.T) {
+	for _, c := range []struct {
+		window time.Duration
+		label  string
+	}{
+		{5 * time.Minute, "5m"},
+		{30 * time.Minute, "30m"},
+		{time.Hour, "1h"},
+		{6 * time.Hour, "6h"},
+		{24 * time.Hour, "24h"},
+		{90 * time.Minute, "90m"},
+		{45 * time.Second, "45s"},
+	} {
+		equals(t, c.label, WindowLabel(c.window))
+	}
+}
@@ -0,0 +1,619 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	. "github.com/datastax/burnell/src/logclient"
+	"github.com/datastax/burnell/src/logstream"
+	"github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/route"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+)
+
+// fakeLogServer serves a log file, a read returns the chunk between the backward and the forward index
+type fakeLogServer struct {
+	logstream.UnimplementedLogStreamServer
+	content string
+	mu      sync.Mutex
+	// files serves a content by the file name instead of the content
+	files map[string]string
+}
+
+func (s *fakeLogServer) Read(ctx context.Context, req *logstream.ReadRequest) (*logstream.LogLines, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content := s.content
+	if s.files != nil {
+		c, ok := s.files[req.File]
+		if !ok {
+			return nil, fmt.Errorf("open %s: no such file or directory", req.File)
+		}
+		content = c
+	}
+	size := int64(len(content))
+	if req.Direction == logstream.ReadRequest_FORWARD {
+		start := req.ForwardIndex
+		if start > size {
+			start = size
+		}
+		end := start + req.Bytes
+		if end > size {
+			end = size
+		}
+		return &logstream.LogLines{Logs: content[start:end], BackwardIndex: start, ForwardIndex: end}, nil
+	}
+	end := req.BackwardIndex
+	if end <= 0 || end > size {
+		end = size
+	}
+	start := end - req.Bytes
+	if start < 0 {
+		start = 0
+	}
+	return &logstream.LogLines{Logs: content[start:end], BackwardIndex: start, ForwardIndex: end}, nil
+}
+
+// appendFile appends the lines to a file served by the log server
+func (s *fakeLogServer) appendFile(file, lines string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[file] += lines
+}
+
+// startFakeLogServer starts a log server and points the log server port to it, the worker ID is 127.0.0.1
+func startFakeLogServer(t *testing.T, content string) func() {
+	return startLogServer(t, &fakeLogServer{content: content})
+}
+
+// startLogServer starts a log server and points the log server port to it
+func startLogServer(t *testing.T, logServer *fakeLogServer) func() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	errNil(t, err)
+	server := grpc.NewServer()
+	logstream.RegisterLogStreamServer(server, logServer)
+	go server.Serve(listener)
+	port := util.Config.LogServerPort
+	util.Config.LogServerPort = fmt.Sprintf(":%d", listener.Addr().(*net.TCPAddr).Port)
+	return func() {
+		server.Stop()
+		util.Config.LogServerPort = port
+	}
+}
+
+// functionLogContent generates info entries every second with an error and its stack trace every 100 entries
+func functionLogContent(entries int) string {
+	var b strings.Builder
+	start := time.Date(2021, 5, 4, 18, 0, 0, 0, time.UTC)
+	for i := 0; i < entries; i++ {
+		ts := start.Add(time.Duration(i) * time.Second).Format("2006-01-02T15:04:05.000-0700")
+		if i%100 == 99 {
+			fmt.Fprintf(&b, "%s [public/default/fn-0] ERROR function - failed message %d\n", ts, i)
+			b.WriteString("java.lang.IllegalStateException: bad input\n\tat org.example.Fn.process(Fn.java:42)\n")
+		} else {
+			fmt.Fprintf(&b, "%s [public/default/fn-0] INFO  function - processed message %d\n", ts, i)
+		}
+	}
+	return b.String()
+}
+
+func TestFunctionLogSearch(t *testing.T) {
+	content := functionLogContent(3000)
+	defer startFakeLogServer(t, content)()
+
+	// the latest errors with their stack traces
+	res, err := SearchFunctionLog("", "127.0.0.1", 0, FunctionLogRequest{}, FunctionLogFilter{Levels: []string{"ERROR"}, MaxMatches: 2})
+	errNil(t, err)
+	equals(t, 2, res.Matches)
+	assert(t, strings.HasPrefix(res.Logs, "2021-05-04T18:48:19.000+0000"), "older error first")
+	assert(t, strings.Contains(res.Logs, "failed message 2899\n") && strings.HasSuffix(res.Logs, "failed message 2999\njava.lang.IllegalStateException: bad input\n\tat org.example.Fn.process(Fn.java:42)\n"), "errors with stack traces")
+	equals(t, int64(len(content)), res.ForwardPosition)
+
+	// the next page continues backward without a duplicate
+	next, err := SearchFunctionLog("", "127.0.0.1", 0, FunctionLogRequest{BackwardPosition: res.BackwardPosition}, FunctionLogFilter{Levels: []string{"ERROR"}, MaxMatches: 2})
+	errNil(t, err)
+	equals(t, 2, next.Matches)
+	assert(t, strings.Contains(next.Logs, "failed message 2699\n") && strings.Contains(next.Logs, "failed message 2799\n"), "previous page")
+
+	// forward search over many chunks with a time range and a regex
+	since := time.Date(2021, 5, 4, 18, 10, 0, 0, time.UTC)
+	filter := FunctionLogFilter{Regex: regexp.MustCompile(`message \d*00$`), Since: since, Until: since.Add(10 * time.Minute)}
+	res, err = SearchFunctionLog("", "127.0.0.1", 0, FunctionLogRequest{ForwardPosition: 1}, filter)
+	errNil(t, err)
+	assert(t, strings.HasPrefix(res.Logs, "2021-05-04T18:10:00.000+0000") && strings.HasSuffix(res.Logs, "processed message 1200\n"), "inclusive time range")
+	equals(t, 7, res.Matches)
+	assert(t, res.ScannedBytes < int64(len(content)), "stops after the time range")
+
+	// the scan budget bounds the search
+	res, err = SearchFunctionLog("", "127.0.0.1", 0, FunctionLogRequest{}, FunctionLogFilter{Substring: "no such line", MaxScanBytes: 100000})
+	errNil(t, err)
+	equals(t, 0, res.Matches)
+	assert(t, res.ScannedBytes >= 100000 && res.ScannedBytes < 200000, "bounded scan")
+	assert(t, res.BackwardPosition > 0, "resume position")
+}
+
+func TestPythonFunctionLogSearch(t *testing.T) {
+	content := "[2020-03-30 12:31:56 +0000] [INFO] log.py: started\n" +
+		"[2020-03-30 12:31:57 +0000] [ERROR] log.py: Traceback (most recent call last):\n" +
+		"[2020-03-30 12:31:57 +0000] [ERROR] log.py: main()\n" +
+		"[2020-03-30 12:31:58 +0000] [WARNING] log.py: retry\n"
+	defer startFakeLogServer(t, content)()
+
+	res, err := SearchFunctionLog("", "127.0.0.1", 0, FunctionLogRequest{}, FunctionLogFilter{Levels: []string{"ERROR", "WARN"}})
+	errNil(t, err)
+	equals(t, 3, res.Matches)
+	res, err = SearchFunctionLog("", "127.0.0.1", 0, FunctionLogRequest{}, FunctionLogFilter{Since: time.Date(2020, 3, 30, 12, 31, 57, 0, time.UTC)})
+	errNil(t, err)
+	equals(t, 3, res.Matches)
+	assert(t, !strings.Contains(res.Logs, "started"), "before the time range")
+}
+
+func TestFunctionLogArchive(t *testing.T) {
+	content := functionLogContent(30000)
+	defer startFakeLogServer(t, content)()
+
+	fn := FunctionType{Tenant: "public", Namespace: "default", FunctionName: "fn"}
+	instances := []FuncInstance{
+		{InstanceID: 0, Status: FuncInstanceStatus{WorkerID: "127.0.0.1"}},
+		{InstanceID: 1, Status: FuncInstanceStatus{WorkerID: "127.0.0.1"}},
+	}
+	maxBytes := int64(len(content)) + 1000
+
+	var buf bytes.Buffer
+	errNil(t, WriteFunctionLogArchive(&buf, fn, instances, maxBytes))
+	gz, err := gzip.NewReader(&buf)
+	errNil(t, err)
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		errNil(t, err)
+		data, err := io.ReadAll(tr)
+		errNil(t, err)
+		files[hdr.Name] = data
+	}
+	equals(t, 3, len(files))
+
+	// the first instance log is complete and the second one is cut to the remaining cap
+	equals(t, content, string(files["public/default/fn/fn-0.log"]))
+	equals(t, content[len(content)-1000:], string(files["public/default/fn/fn-1.log"]))
+
+	var manifest ArchiveManifest
+	errNil(t, json.Unmarshal(files["public/default/fn/manifest.json"], &manifest))
+	equals(t, 2, len(manifest.Instances))
+	equals(t, int64(len(content)), manifest.Instances[0].Bytes)
+	assert(t, !manifest.Instances[0].Truncated, "complete instance log")
+	equals(t, int64(1000), manifest.Instances[1].Bytes)
+	assert(t, manifest.Instances[1].Truncated, "truncated instance log")
+}
+
+func TestMergeFunctionLogs(t *testing.T) {
+	// instance 0 logs at the even seconds and instance 1 logs at the odd seconds with a stack trace every 10 entries
+	start := time.Date(2021, 5, 4, 18, 0, 0, 0, time.UTC)
+	var logs [2]strings.Builder
+	for i := 0; i < 400; i++ {
+		ts := start.Add(time.Duration(i) * time.Second).Format("2006-01-02T15:04:05.000-0700")
+		fmt.Fprintf(&logs[i%2], "%s INFO  function - message %d\n", ts, i)
+		if i%20 == 19 {
+			logs[1].WriteString("java.lang.IllegalStateException: bad input\n\tat org.example.Fn.process(Fn.java:42)\n")
+		}
+	}
+	files := map[string]string{
+		logstream.FunctionLogPath("public", "default", "merge-fn", "0"): logs[0].String(),
+		logstream.FunctionLogPath("public", "default", "merge-fn", "1"): logs[1].String(),
+	}
+	defer startLogServer(t, &fakeLogServer{files: files})()
+
+	fn := FunctionType{Tenant: "public", Namespace: "default", FunctionName: "merge-fn"}
+	WriteFunctionMapIfNotExist("publicdefaultmerge-fn", fn)
+	instances := []FuncInstance{
+		{InstanceID: 0, Status: FuncInstanceStatus{WorkerID: "127.0.0.1"}},
+		{InstanceID: 1, Status: FuncInstanceStatus{WorkerID: "127.0.0.1"}},
+	}
+
+	// the whole logs are merged in the order of the timestamps with the instance labels
+	merged := MergeFunctionLogs(fn, instances, nil, 1<<20)
+	equals(t, 400, merged.Entries)
+	lines := strings.Split(strings.TrimSuffix(merged.Logs, "\n"), "\n")
+	equals(t, 440, len(lines))
+	assert(t, strings.HasPrefix(lines[0], "[0] 2021-05-04T18:00:00.000+0000"), "oldest entry first")
+	assert(t, strings.HasPrefix(lines[1], "[1] 2021-05-04T18:00:01.000+0000"), "interleaved instance")
+	equals(t, "[1] java.lang.IllegalStateException: bad input", lines[20])
+	equals(t, int64(0), merged.Instances[0].BackwardPosition)
+	equals(t, int64(0), merged.Instances[1].BackwardPosition)
+
+	// small merges continue from the returned positions without missing or repeating an entry
+	var pages []string
+	var positions map[int]int64
+	for i := 0; i < 100; i++ {
+		merged := MergeFunctionLogs(fn, instances, positions, 1000)
+		pages = append([]string{merged.Logs}, pages...)
+		positions = map[int]int64{}
+		for _, instance := range merged.Instances {
+			equals(t, "", instance.Error)
+			if instance.BackwardPosition > 0 {
+				positions[instance.InstanceID] = instance.BackwardPosition
+			}
+		}
+		if len(positions) == 0 {
+			break
+		}
+	}
+	equals(t, strings.Join(lines, "\n")+"\n", strings.Join(pages, ""))
+}
+
+func TestFunctionLogCursor(t *testing.T) {
+	file := logstream.FunctionLogPath("public", "default", "cursor-fn", "0")
+	files := map[string]string{file: functionLogContent(100)}
+	defer startLogServer(t, &fakeLogServer{files: files})()
+	WriteFunctionMapIfNotExist("publicdefaultcursor-fn", FunctionType{Tenant: "public", Namespace: "default", FunctionName: "cursor-fn"})
+	read := func(cursor string) FunctionLogResponse {
+		res, err := ReadFunctionLogCursor("publicdefaultcursor-fn", "127.0.0.1", 0, cursor, 1<<20)
+		errNil(t, err)
+		return res
+	}
+
+	// an empty cursor reads the tail and the next read returns the appended lines
+	res := read("")
+	equals(t, files[file], res.Logs)
+	files[file] += "appended line 1\n"
+	res = read(res.Cursor)
+	equals(t, "appended line 1\n", res.Logs)
+	res = read(res.Cursor)
+	equals(t, "", res.Logs)
+
+	// the rest of a rotated file is read before the new file
+	files[file+".1"] = files[file] + "before rotation\n"
+	files[file] = "after rotation\n"
+	res = read(res.Cursor)
+	equals(t, "before rotation\n", res.Logs)
+	assert(t, !res.Rotated, "reads the rotated file")
+	res = read(res.Cursor)
+	equals(t, "after rotation\n", res.Logs)
+	assert(t, res.Rotated && !res.Gap, "moves to the new file")
+	lc, err := DecodeLogCursor(res.Cursor)
+	errNil(t, err)
+	equals(t, 1, lc.Seq)
+	equals(t, "", lc.Rotated)
+
+	// the lines of a rotated file removed by the log server are reported as a gap
+	delete(files, file+".1")
+	files[file] = "new file after a rotation with a longer first line than the previous one\n"
+	res = read(res.Cursor)
+	equals(t, files[file], res.Logs)
+	assert(t, res.Rotated && res.Gap, "gap after an unreadable rotation")
+
+	// a file truncated in place and grown beyond the cursor is read from its beginning
+	files[file] = "truncated and grown back with other lines, longer than the previous content of the file\n"
+	res = read(res.Cursor)
+	equals(t, files[file], res.Logs)
+	assert(t, res.Gap, "gap after a truncation")
+
+	_, err = ReadFunctionLogCursor("publicdefaultcursor-fn", "127.0.0.1", 0, "not a cursor", 1024)
+	equals(t, ErrInvalidLogCursor, err)
+}
+
+func TestFunctionLogTail(t *testing.T) {
+	file := logstream.FunctionLogPath("public", "default", "tail-fn", "0")
+	logServer := &fakeLogServer{files: map[string]string{file: "line 1\nline 2\n"}}
+	defer startLogServer(t, logServer)()
+	WriteFunctionMapIfNotExist("publicdefaulttail-fn", FunctionType{Tenant: "public", Namespace: "default", FunctionName: "tail-fn"})
+
+	router := mux.NewRouter()
+	router.Path("/function-logs/{tenant}/{namespace}/{function}/tail").Handler(http.HandlerFunc(route.FunctionLogTailHandler))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	tailURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/function-logs/public/default/tail-fn/tail?workerid=127.0.0.1&intervalms=250&heartbeat=1"
+
+	type message struct {
+		Type   string `json:"type"`
+		Logs   string `json:"logs"`
+		Cursor string `json:"cursor"`
+		Error  string `json:"error"`
+	}
+	// next reads the messages until one of the type
+	next := func(ws *websocket.Conn, msgType string) message {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg message
+			errNil(t, ws.ReadJSON(&msg))
+			equals(t, "", msg.Error)
+			if msg.Type == msgType {
+				return msg
+			}
+		}
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(tailURL, nil)
+	errNil(t, err)
+	equals(t, "line 1\nline 2\n", next(ws, "logs").Logs)
+	logServer.appendFile(file, "line 3\n")
+	msg := next(ws, "logs")
+	equals(t, "line 3\n", msg.Logs)
+
+	// an idle stream sends heartbeats with the cursor
+	equals(t, msg.Cursor, next(ws, "heartbeat").Cursor)
+	ws.Close()
+
+	// the lines appended while disconnected are sent after a resume
+	logServer.appendFile(file, "line 4\n")
+	ws, _, err = websocket.DefaultDialer.Dial(tailURL+"&resume="+msg.Cursor, nil)
+	errNil(t, err)
+	defer ws.Close()
+	equals(t, "line 4\n", next(ws, "logs").Logs)
+
+	_, res, err := websocket.DefaultDialer.Dial(tailURL+"&resume=invalid", nil)
+	assert(t, err != nil, "invalid resume token")
+	equals(t, http.StatusBadRequest, res.StatusCode)
+
+	// a browser page of another origin cannot open the stream unless the origin is allowed
+	origin := http.Header{"Origin": []string{"https://evil.example.com"}}
+	_, res, err = websocket.DefaultDialer.Dial(tailURL, origin)
+	assert(t, err != nil, "cross origin websocket")
+	equals(t, http.StatusForbidden, res.StatusCode)
+	util.Config.WebsocketAllowedOrigins = []string{"https://evil.example.com/"}
+	defer func() { util.Config.WebsocketAllowedOrigins = nil }()
+	ws, _, err = websocket.DefaultDialer.Dial(tailURL, origin)
+	errNil(t, err)
+	ws.Close()
+}
+
+func TestFunctionMetrics(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/v3/functions/metrics-tenant/ns/fn/stats":
+			w.Write([]byte(`{"receivedTotal":120,"processedSuccessfullyTotal":100,"systemExceptionsTotal":5,"userExceptionsTotal":15,
+				"avgProcessLatency":2.5,"lastInvocation":1620151200000,"instances":[
+				{"instanceId":0,"metrics":{"latestUserExceptions":[{"exceptionString":"bad input","timestampMs":1620151100000}]}},
+				{"instanceId":1,"metrics":{"latestSystemExceptions":[{"exceptionString":"timeout","timestampMs":1620151150000}]}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer worker.Close()
+	functionURL := util.Config.FunctionProxyURL
+	util.Config.FunctionProxyURL = worker.URL
+	defer func() { util.Config.FunctionProxyURL = functionURL }()
+	ResetFunctionMetricsCache()
+
+	WriteFunctionMapIfNotExist("metrics-tenantnsfn", FunctionType{Tenant: "metrics-tenant", Namespace: "ns", FunctionName: "fn", Component: "functions"})
+	WriteFunctionMapIfNotExist("metrics-tenantnsgone", FunctionType{Tenant: "metrics-tenant", Namespace: "ns", FunctionName: "gone", Component: "functions"})
+	metrics := GetFunctionMetrics("metrics-tenant")
+	equals(t, 2, len(metrics))
+	fn := metrics[0]
+	equals(t, "fn", fn.Name)
+	equals(t, 2, fn.Instances)
+	equals(t, int64(120), fn.ReceivedTotal)
+	equals(t, int64(20), fn.FailedTotal)
+	equals(t, 2.5, *fn.AvgProcessLatencyMs)
+	equals(t, time.Date(2021, 5, 4, 18, 0, 0, 0, time.UTC), *fn.LastInvocation)
+	equals(t, "timeout", fn.LastException.Message)
+	equals(t, 1, fn.LastException.InstanceID)
+	assert(t, fn.LastException.System, "system exception")
+	equals(t, "gone", metrics[1].Name)
+	assert(t, metrics[1].Error != "", "missing function stats")
+
+	text := string(FunctionMetricsText(metrics))
+	assert(t, strings.Contains(text, "# TYPE burnell_function_received_total counter\n"), "metric type")
+	assert(t, strings.Contains(text, `burnell_function_received_total{tenant="metrics-tenant",namespace="metrics-tenant/ns",function="fn"} 120`), "received total")
+	assert(t, strings.Contains(text, `burnell_function_last_invocation_timestamp_seconds{tenant="metrics-tenant",namespace="metrics-tenant/ns",function="fn"} 1.6201512e+09`), "last invocation")
+	assert(t, strings.Contains(text, `burnell_function_stats_up{tenant="metrics-tenant",namespace="metrics-tenant/ns",function="gone"} 0`), "stats down")
+	assert(t, !strings.Contains(text, `burnell_function_received_total{tenant="metrics-tenant",namespace="metrics-tenant/ns",function="gone"}`), "no totals without stats")
+	equals(t, 0, len(GetFunctionMetrics("other-tenant")))
+}
+
+func TestFunctionLogAccess(t *testing.T) {
+	// enable the JWT authorization
+	publicKey, superRoles := util.Config.PulsarPublicKey, util.SuperRoles
+	util.Config.PulsarPublicKey, util.SuperRoles = "public-key", []string{"superuser"}
+	defer func() { util.Config.PulsarPublicKey, util.SuperRoles = publicKey, superRoles }()
+	sink := &memorySink{}
+	audit.AddSink(sink)
+
+	WriteFunctionMapIfNotExist("ming-luonamespace2access-fn", FunctionType{Tenant: "ming-luo", Namespace: "namespace2", FunctionName: "access-fn"})
+	router := mux.NewRouter()
+	router.Path("/function-status/{tenant}/{namespace}/{function}").Handler(http.HandlerFunc(route.FunctionStatusHandler))
+	router.Path("/function-logs/{tenant}/{namespace}/{function}").Handler(http.HandlerFunc(route.FunctionLogsHandler))
+	status := func(path, subjects string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("injectedSubs", subjects)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	equals(t, http.StatusOK, status("/function-status/ming-luo/namespace2/access-fn", "ming-luo-client-1234"))
+	equals(t, http.StatusOK, status("/function-status/ming-luo/namespace2/access-fn", "other-client-1234,superuser"))
+	equals(t, http.StatusForbidden, status("/function-status/ming-luo/namespace2/access-fn", "other-client-1234"))
+	// the function map key of another tenant function does not grant the access
+	equals(t, http.StatusNotFound, status("/function-status/ming/-luonamespace2/access-fn", "ming-client-1234"))
+	equals(t, http.StatusBadRequest, status("/function-logs/ming-luo/namespace2/access-fn?workerid=evil.com:80/", "ming-luo-client-1234"))
+
+	outcomes := []string{}
+	for _, e := range sink.events {
+		if strings.HasSuffix(e.Resource, "/access-fn") {
+			outcomes = append(outcomes, e.Action+" "+e.Outcome)
+		}
+	}
+	equals(t, []string{"function.status allowed", "function.status allowed", "function.status denied",
+		"function.status denied", "function.logs denied"}, outcomes)
+
+	// a role binding of the namespace of the function
+	engine, err := rbac.NewRoleEngine([]util.RBACRole{{Name: "log-reader", Permissions: []string{"function-logs:read"}}},
+		[]util.RBACBinding{{Role: "log-reader", Subjects: []string{"oncall"}, Tenants: []string{"ming-luo"}, Namespaces: []string{"namespace2"}}}, false)
+	errNil(t, err)
+	rbac.SetEngine(engine)
+	defer rbac.SetEngine(nil)
+	equals(t, http.StatusOK, status("/function-status/ming-luo/namespace2/access-fn", "oncall"))
+	equals(t, http.StatusForbidden, status("/function-status/ming-luo/namespace3/access-fn", "oncall"))
+}
+
+func TestParseLogRecords(t *testing.T) {
+	records := ParseLogRecords(functionLogContent(100)[len(functionLogContent(98)):])
+	equals(t, 2, len(records))
+	equals(t, time.Date(2021, 5, 4, 18, 1, 38, 0, time.UTC), records[0].Time.UTC())
+	equals(t, "INFO", records[0].Level)
+	equals(t, "public/default/fn-0", records[0].Thread)
+	equals(t, "function", records[0].Logger)
+	equals(t, "processed message 98", records[0].Message)
+	equals(t, "ERROR", records[1].Level)
+	equals(t, "failed message 99", records[1].Message)
+	equals(t, []string{"java.lang.IllegalStateException: bad input", "\tat org.example.Fn.process(Fn.java:42)"}, records[1].StackTrace)
+
+	python := `[2020-03-30 12:31:56 +0000] [INFO] log.py: starting
+[2020-03-30 12:31:57 +0000] [ERROR] log.py: Traceback (most recent call last):
+[2020-03-30 12:31:57 +0000] [ERROR] log.py:   File "/pulsar/instances/python-instance/python_instance_main.py", line 211, in <module>
+[2020-03-30 12:31:57 +0000] [ERROR] log.py:     main()
+[2020-03-30 12:31:57 +0000] [ERROR] log.py: ValueError: bad input
+[2020-03-30 12:31:58 +0000] [INFO] log.py: restarted
+`
+	records = ParseLogRecords(python)
+	equals(t, 3, len(records))
+	equals(t, "log.py", records[0].Logger)
+	equals(t, "starting", records[0].Message)
+	equals(t, "ERROR", records[1].Level)
+	equals(t, "Traceback (most recent call last):", records[1].Message)
+	equals(t, []string{`  File "/pulsar/instances/python-instance/python_instance_main.py", line 211, in <module>`,
+		"    main()", "ValueError: bad input"}, records[1].StackTrace)
+	equals(t, "restarted", records[2].Message)
+}
+
+// decodeMsgpack decodes the subset of MessagePack of a forward message, an EventTime is decoded as time.Time
+func decodeMsgpack(b []byte) (interface{}, []byte) {
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return uint64(c), b[1:]
+	case c&0xf0 == 0x80, c&0xf0 == 0x90, c == 0xdc, c == 0xde:
+		n, rest := int(c&0x0f), b[1:]
+		if c == 0xdc || c == 0xde {
+			n, rest = int(b[1])<<8|int(b[2]), b[3:]
+		}
+		if c&0xf0 == 0x90 || c == 0xdc {
+			array := []interface{}{}
+			for i := 0; i < n; i++ {
+				var v interface{}
+				v, rest = decodeMsgpack(rest)
+				array = append(array, v)
+			}
+			return array, rest
+		}
+		m := map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			var k, v interface{}
+			k, rest = decodeMsgpack(rest)
+			v, rest = decodeMsgpack(rest)
+			m[k.(string)] = v
+		}
+		return m, rest
+	case c&0xe0 == 0xa0:
+		n := int(c & 0x1f)
+		return string(b[1 : 1+n]), b[1+n:]
+	case c == 0xd9:
+		n := int(b[1])
+		return string(b[2 : 2+n]), b[2+n:]
+	case c == 0xd7:
+		sec := int64(b[2])<<24 | int64(b[3])<<16 | int64(b[4])<<8 | int64(b[5])
+		nsec := int64(b[6])<<24 | int64(b[7])<<16 | int64(b[8])<<8 | int64(b[9])
+		return time.Unix(sec, nsec), b[10:]
+	}
+	panic(fmt.Sprintf("unsupported msgpack type %x", c))
+}
+
+func TestFluentForwardClient(t *testing.T) {
+	input, err := net.Listen("tcp", "127.0.0.1:0")
+	errNil(t, err)
+	defer input.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := input.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	at := time.Date(2021, 5, 4, 18, 0, 0, 123000000, time.UTC)
+	message := strings.Repeat("a long function log message ", 3)
+	client := NewFluentClient(input.Addr().String())
+	entries := []FluentEntry{
+		{Time: at, Record: map[string]string{"tenant": "ming-luo", "level": "ERROR", "message": message}},
+		{Time: at.Add(time.Second), Record: map[string]string{"tenant": "ming-luo", "message": "second"}},
+	}
+	// the connection is dialed in the background
+	err = client.Send("pulsar.functions.ming-luo.ns.exclaim", entries)
+	for deadline := time.Now().Add(5 * time.Second); err == ErrFluentNotConnected && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		err = client.Send("pulsar.functions.ming-luo.ns.exclaim", entries)
+	}
+	errNil(t, err)
+	errNil(t, client.Send("pulsar.functions.ming-luo.ns.exclaim", nil))
+	client.Close()
+
+	msg, rest := decodeMsgpack(<-received)
+	equals(t, 0, len(rest))
+	forward := msg.([]interface{})
+	equals(t, 3, len(forward))
+	equals(t, "pulsar.functions.ming-luo.ns.exclaim", forward[0])
+	records := forward[1].([]interface{})
+	equals(t, 2, len(records))
+	first := records[0].([]interface{})
+	assert(t, at.Equal(first[0].(time.Time)), "event time in nanoseconds")
+	equals(t, map[string]interface{}{"tenant": "ming-luo", "level": "ERROR", "message": message}, first[1])
+	equals(t, map[string]interface{}{"size": uint64(2)}, forward[2])
+
+	// a send fails fast while the input is unreachable
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	errNil(t, err)
+	closed.Close()
+	unreachable := NewFluentClient(closed.Addr().String())
+	defer unreachable.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		equals(t, ErrFluentNotConnected, unreachable.Send("pulsar.functions.ming-luo.ns.exclaim", entries))
+	}
+	assert(t, time.Since(start) < time.Second, "a send does not wait for the dial")
+}
@@ -22,9 +22,38 @@
 package tests
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/icrypto"
+	"github.com/datastax/burnell/src/metrics"
+	"github.com/datastax/burnell/src/policy"
 	. "github.com/datastax/burnell/src/route"
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/workflow"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestSubjectMatch(t *testing.T) {
@@ -65,3 +94,1666 @@ func TestSubjectMatch(t *testing.T) {
 	equals(t, t1, t2)
 
 }
+
+func TestSlowRequest(t *testing.T) {
+	util.Config.SlowRequestThresholdMs = 20
+	defer func() { util.Config.SlowRequestThresholdMs = 0 }()
+	var observed []util.RequestObservation
+	util.SetRequestObserver(func(o util.RequestObservation) { observed = append(observed, o) })
+	defer util.SetRequestObserver(nil)
+
+	router := mux.NewRouter()
+	router.Use(SlowRequest)
+	router.Path("/stats/{tenant}").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end := util.StartPhase(r.Context(), util.PhaseUpstream)
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		end()
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("ok"))
+	}))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats/ming-luo", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats/ming-luo?slow=1", nil))
+	equals(t, 2, len(observed))
+	equals(t, false, observed[0].Slow)
+
+	slow := observed[1]
+	equals(t, true, slow.Slow)
+	equals(t, "/stats/{tenant}", slow.Route)
+	equals(t, http.StatusAccepted, slow.Status)
+	assert(t, slow.Phases[util.PhaseUpstream] >= 30*time.Millisecond, "upstream phase")
+	_, ok := slow.Phases[util.PhaseSerialization]
+	assert(t, ok, "serialization phase")
+}
+
+func TestRequestCapture(t *testing.T) {
+	util.Config.RequestCapture = util.RequestCapture{MaxEntries: 2, MaxBodyBytes: 8}
+	defer func() { util.Config.RequestCapture = util.RequestCapture{} }()
+	util.SetCaptureSettings(util.CaptureSettings{Subjects: []string{"alice"}})
+	defer util.SetCaptureSettings(util.CaptureSettings{})
+	defer util.ClearCaptures()
+
+	router := mux.NewRouter()
+	router.Use(Capture)
+	router.PathPrefix("/").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("injectedSubs", r.URL.Query().Get("sub"))
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte("response"))
+	}))
+	send := func(path string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("request body"))
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("/stats/alice?sub=alice")
+	send("/stats/bob?sub=bob")
+	send("/delegate?sub=alice")
+	send("/apikeys/alice?sub=alice")
+	send("/session/login?sub=alice")
+	send("/webhooks/alice?sub=alice")
+	send("/admin/v3/sinks/alice/ns/sink?sub=alice")
+	send("/provisioning/v1/tenants/alice/tokens/ci?sub=alice")
+	captures := util.GetCaptures("")
+	equals(t, 1, len(captures))
+	c := captures[0]
+	equals(t, "alice", c.Subject)
+	equals(t, "request ", c.RequestBody)
+	equals(t, "response", c.ResponseBody)
+	equals(t, true, c.Truncated)
+	equals(t, []string{"[REDACTED]"}, c.RequestHeaders["Authorization"])
+	equals(t, []string{"[REDACTED]"}, c.ResponseHeaders["Set-Cookie"])
+
+	// the ring buffer keeps the newest entries
+	send("/stats/2?sub=alice")
+	send("/stats/3?sub=alice")
+	captures = util.GetCaptures("alice")
+	equals(t, 2, len(captures))
+	equals(t, "/stats/3?sub=alice", captures[0].URI)
+	equals(t, "/stats/2?sub=alice", captures[1].URI)
+	equals(t, 0, len(util.GetCaptures("bob")))
+}
+
+func TestRecoverReportsErrors(t *testing.T) {
+	var lock sync.Mutex
+	var events []string
+	sentryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		events = append(events, string(body))
+		lock.Unlock()
+	}))
+	defer sentryServer.Close()
+	util.Config.ErrorReporting = util.ErrorReporting{DSN: strings.Replace(sentryServer.URL, "http://", "http://public@", 1) + "/1", MaxEventsPerMinute: 2}
+	defer func() {
+		util.Config.ErrorReporting = util.ErrorReporting{}
+		util.InitErrorReporting("")
+	}()
+	errNil(t, util.InitErrorReporting("test"))
+
+	router := mux.NewRouter()
+	router.Use(Recover)
+	router.Path("/panic/{tenant}").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("tenant handler failure")
+	}))
+	router.Path("/ok").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	router.Path("/error").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/panic/ming-luo", nil))
+	equals(t, http.StatusInternalServerError, rr.Code)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/error", nil))
+	// over the rate limit
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/error", nil))
+	assert(t, util.FlushErrorReports(5*time.Second), "flush error reports")
+
+	lock.Lock()
+	defer lock.Unlock()
+	equals(t, 2, len(events))
+	all := strings.Join(events, "\n")
+	assert(t, strings.Contains(all, "tenant handler failure"), "panic message is reported")
+	assert(t, strings.Contains(all, "/panic/{tenant}"), "route tag is reported")
+	assert(t, strings.Contains(all, "503 response to GET /error"), "5xx is reported")
+}
+
+func TestDiagnosticsRoutes(t *testing.T) {
+	router := DiagnosticsRouter()
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	rr := get("/admin/debug/goroutines")
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "goroutine "), "goroutine dump")
+
+	rr = get("/admin/debug/vars")
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), `"metricsCache"`), "metrics cache expvar")
+	assert(t, strings.Contains(rr.Body.String(), `"upstreamPool"`), "upstream pool expvar")
+
+	rr = get("/admin/debug/pprof/heap?debug=1")
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "heap profile"), "heap profile")
+	equals(t, http.StatusOK, get("/admin/debug/pprof/").Code)
+}
+
+func TestLimitTenantRate(t *testing.T) {
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(t, err)
+	jwtAuth, publicKey, superRoles := util.JWTAuth, util.Config.PulsarPublicKey, util.SuperRoles
+	util.JWTAuth, util.Config.PulsarPublicKey, util.SuperRoles = keys, "public-key", []string{"superuser"}
+	defer func() {
+		util.JWTAuth, util.Config.PulsarPublicKey, util.SuperRoles = jwtAuth, publicKey, superRoles
+	}()
+	util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "ming-luo", Settings: util.TenantSettings{RequestsPerSecond: 0.001, RequestBurst: 2}})
+	defer util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "ming-luo", Deleted: true})
+
+	router := mux.NewRouter()
+	router.Path("/stats/{tenant}").Handler(Require("tenant:read-stats", TenantFromPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	status := func(tenant, subject string) int {
+		req := httptest.NewRequest(http.MethodGet, "/stats/"+tenant, nil)
+		if subject != "" {
+			token, err := keys.GenerateToken(subject, time.Hour, jwt.SigningMethodRS256)
+			errNil(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// an unauthenticated request is not counted against the tenant
+	for i := 0; i < 3; i++ {
+		equals(t, http.StatusUnauthorized, status("ming-luo", ""))
+	}
+	equals(t, http.StatusOK, status("ming-luo", "ming-luo-client-1234"))
+	equals(t, http.StatusOK, status("ming-luo", "ming-luo-client-1234"))
+	equals(t, http.StatusTooManyRequests, status("ming-luo", "ming-luo-client-1234"))
+	// the limit is the one of the subject tenant, a super role is unlimited
+	equals(t, http.StatusOK, status("ming-luo", "superuser"))
+	for i := 0; i < 5; i++ {
+		equals(t, http.StatusOK, status("abc", "abc-client-1234"))
+	}
+	// the limiter is re-created with the new settings
+	util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "ming-luo", Settings: util.TenantSettings{RequestsPerSecond: 0.001, RequestBurst: 3}})
+	equals(t, http.StatusOK, status("ming-luo", "ming-luo-client-1234"))
+}
+
+func TestRequireReady(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(RequireReady)
+	router.Path("/liveness").HandlerFunc(StatusPage)
+	router.Path("/stats/{tenant}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code
+	}
+
+	assert(t, !util.IsReady(), "the test replica is not started")
+	equals(t, http.StatusOK, get("/liveness"))
+	equals(t, http.StatusServiceUnavailable, get("/stats/ming-luo"))
+	util.MarkReady()
+	equals(t, http.StatusOK, get("/stats/ming-luo"))
+}
+
+func TestLeaderForward(t *testing.T) {
+	var forwarded, forwardedSubs string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded, forwardedSubs = r.Header.Get("X-Burnell-Forwarded"), r.Header.Get("injectedSubs")
+		w.Write([]byte("leader"))
+	}))
+	defer leader.Close()
+
+	router := mux.NewRouter()
+	router.Path("/tenantsusage").Handler(LeaderForward(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local " + r.Header.Get("injectedSubs")))
+	})))
+	get := func() string {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/tenantsusage", nil)
+		req.Header.Set("injectedSubs", "superuser")
+		router.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	equals(t, "local superuser", get())
+	util.EnableLeaderElection("http://burnell-0:8964")
+	defer util.SetLeader("http://burnell-0:8964")
+	util.SetLeader(leader.URL)
+	equals(t, "leader", get())
+	equals(t, "burnell", forwarded)
+	equals(t, "", forwardedSubs)
+
+	// an unreachable leader is served locally with the authenticated subject
+	util.SetLeader("http://127.0.0.1:1")
+	equals(t, "local superuser", get())
+}
+
+func TestAPIUsage(t *testing.T) {
+	now := time.Date(2021, 6, 1, 23, 58, 0, 0, time.UTC)
+	util.APIUsageNow = func() time.Time { return now }
+	util.Config.APIUsage = util.APIUsage{RetentionDays: 2, MaxSubjectsPerDay: 3,
+		RouteClasses: map[string][]string{"pulsar-admin": {"/admin/v2"}}}
+	defer func() {
+		util.APIUsageNow = time.Now
+		util.Config.APIUsage = util.APIUsage{}
+		util.ResetAPIUsage()
+	}()
+	util.ResetAPIUsage()
+
+	router := mux.NewRouter()
+	router.Use(SlowRequest)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sub := r.URL.Query().Get("sub"); sub != "" {
+			r.Header.Set("injectedSubs", sub)
+		}
+		if r.URL.Query().Get("deny") != "" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	router.Path("/stats/{tenant}").Handler(handler)
+	router.PathPrefix("/admin/v2/").Handler(handler)
+	send := func(path string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	for i := 0; i < 3; i++ {
+		send("/stats/ming-luo?sub=alice")
+	}
+	send("/stats/ming-luo?sub=alice&deny=1")
+	send("/admin/v2/tenants?sub=alice")
+	send("/admin/v2/tenants?sub=bob")
+	send("/stats/ming-luo")
+	send("/admin/v2/tenants?sub=mallory")
+	send("/stats/ming-luo?sub=eve")
+
+	usage := util.GetAPIUsage("", "", "")
+	equals(t, 4, len(usage))
+	alice := usage[0]
+	equals(t, "alice", alice.Subject)
+	equals(t, "2021-06-01", alice.Date)
+	equals(t, int64(5), alice.Requests)
+	equals(t, int64(1), alice.Denied)
+	equals(t, int64(5), alice.PeakPerMinute)
+	equals(t, int64(4), alice.Classes["stats"].Requests)
+	equals(t, int64(1), alice.Classes["pulsar-admin"].Requests)
+	// the subjects over the daily limit are counted as _other
+	equals(t, util.APIOtherSubject, usage[1].Subject)
+	equals(t, int64(2), usage[1].Requests)
+	equals(t, int64(1), usage[1].Classes["pulsar-admin"].Requests)
+	equals(t, 1, len(util.GetAPIUsage("", "", util.APIAnonymousSubject)))
+
+	talkers := util.GetAPITopTalkers(1)
+	equals(t, 1, len(talkers))
+	equals(t, "alice", talkers[0].Subject)
+	equals(t, float64(5)/300, talkers[0].RatePerSecond)
+
+	// the next days roll over the retention
+	now = now.Add(5 * time.Minute)
+	send("/stats/ming-luo?sub=bob")
+	equals(t, "bob", util.GetAPITopTalkers(0)[0].Subject)
+	now = now.Add(24 * time.Hour)
+	send("/stats/ming-luo?sub=bob")
+	usage = util.GetAPIUsage("2021-06-02", "", "bob")
+	equals(t, 2, len(usage))
+	equals(t, "2021-06-03", usage[1].Date)
+	equals(t, 0, len(util.GetAPIUsage("", "2021-06-01", "")))
+	equals(t, 1, len(util.GetAPITopTalkers(0)))
+
+	rr := httptest.NewRecorder()
+	APIUsageHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/api-usage?from=2021-06-03&subject=bob", nil))
+	equals(t, http.StatusOK, rr.Code)
+	var summaries []util.APISubjectUsage
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &summaries))
+	equals(t, 1, len(summaries))
+	equals(t, int64(1), summaries[0].Classes["stats"].Requests)
+
+	rr = httptest.NewRecorder()
+	APIUsageHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/api-usage?from=yesterday", nil))
+	equals(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	APITopTalkersHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/api-usage/top?n=0", nil))
+	equals(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAPIKeys(t *testing.T) {
+	publicKey, superRoles := util.Config.PulsarPublicKey, util.SuperRoles
+	util.Config.PulsarPublicKey, util.SuperRoles = "public-key", []string{"superuser"}
+	defer func() {
+		util.Config.PulsarPublicKey, util.SuperRoles = publicKey, superRoles
+		util.ClearAuthBan("", "")
+	}()
+
+	_, _, err := policy.NewAPIKey("ming-luo", "ming-luo-client-1234", policy.APIKeyRequest{Namespaces: []string{"other/ns1"}})
+	assert(t, err != nil, "namespace of another tenant")
+	_, _, err = policy.NewAPIKey("ming-luo", "ming-luo-client-1234", policy.APIKeyRequest{Permissions: []string{"admin"}})
+	assert(t, err != nil, "invalid permission")
+
+	scopedStr, scoped, err := policy.NewAPIKey("ming-luo", "ming-luo-client-1234",
+		policy.APIKeyRequest{Name: "ci", Namespaces: []string{"ming-luo/ns1"}, Permissions: []string{"read"}, Exp: "1h"})
+	errNil(t, err)
+	assert(t, util.IsAPIKey(scopedStr), "API key format")
+	assert(t, !strings.Contains(scoped.Hash, strings.SplitN(scopedStr, "_", 3)[2]), "only the digest is stored")
+	assert(t, scoped.ExpiresAt.After(time.Now().Add(59*time.Minute)), "expiry")
+	util.ApplyAPIKey(scoped)
+	superStr, super, err := policy.NewAPIKey("public", "superuser", policy.APIKeyRequest{})
+	errNil(t, err)
+	util.ApplyAPIKey(super)
+	expiredStr, expired, err := policy.NewAPIKey("ming-luo", "ming-luo-client-1234", policy.APIKeyRequest{})
+	errNil(t, err)
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	util.ApplyAPIKey(expired)
+
+	resolved, err := util.ResolveAPIKey(scopedStr)
+	errNil(t, err)
+	equals(t, "ming-luo-client-1234", resolved.Subject)
+	_, err = util.ResolveAPIKey(scopedStr + "x")
+	equals(t, util.ErrInvalidAPIKey, err)
+	_, err = util.ResolveAPIKey(expiredStr)
+	equals(t, util.ErrInvalidAPIKey, err)
+
+	router := mux.NewRouter()
+	subject := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("injectedSubs")))
+	})
+	router.Path("/stats/{tenant}/{namespace}").Handler(AuthVerifyTenantJWT(subject))
+	router.Path("/admin/config").Handler(SuperRoleRequired(subject))
+	send := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	keyHeader := func(key string) http.Header {
+		header := http.Header{}
+		header.Set(util.APIKeyHeader, key)
+		return header
+	}
+
+	rr := send(http.MethodGet, "/stats/ming-luo/ns1", keyHeader(scopedStr))
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "ming-luo-client-1234", rr.Body.String())
+	equals(t, http.StatusOK, send(http.MethodGet, "/stats/ming-luo/ns1", http.Header{"Authorization": {"Bearer " + scopedStr}}).Code)
+	equals(t, http.StatusForbidden, send(http.MethodGet, "/stats/ming-luo/ns2", keyHeader(scopedStr)).Code)
+	equals(t, http.StatusForbidden, send(http.MethodPost, "/stats/ming-luo/ns1", keyHeader(scopedStr)).Code)
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/stats/ming-luo/ns1", keyHeader(expiredStr)).Code)
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/admin/config", keyHeader(scopedStr)).Code)
+	equals(t, http.StatusOK, send(http.MethodGet, "/admin/config", keyHeader(superStr)).Code)
+
+	keys := util.ListAPIKeys("ming-luo")
+	equals(t, 2, len(keys))
+	equals(t, "", keys[0].Hash)
+
+	// a revoked key is rejected
+	util.ApplyAPIKey(util.APIKey{ID: scoped.ID, Tenant: "ming-luo", Deleted: true})
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/stats/ming-luo/ns1", keyHeader(scopedStr)).Code)
+	equals(t, 1, len(util.ListAPIKeys("ming-luo")))
+	util.ApplyAPIKey(util.APIKey{ID: super.ID, Deleted: true})
+	util.ApplyAPIKey(util.APIKey{ID: expired.ID, Deleted: true})
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("scrape-secret"), bcrypt.MinCost)
+	errNil(t, err)
+	users := []util.BasicAuthUser{{Username: "prometheus", PasswordHash: string(hash), Subject: "ming-luo-client-1234"}}
+	errNil(t, util.ValidateBasicAuth(util.BasicAuth{Users: users}))
+	assert(t, util.ValidateBasicAuth(util.BasicAuth{Users: []util.BasicAuthUser{{Username: "telegraf", PasswordHash: "plain", Subject: "s"}}}) != nil, "")
+	assert(t, util.ValidateBasicAuth(util.BasicAuth{Users: []util.BasicAuthUser{{Username: "telegraf", PasswordHash: string(hash)}}}) != nil, "")
+	assert(t, util.ValidateBasicAuth(util.BasicAuth{Users: append(users, users[0])}) != nil, "")
+
+	publicKey, superRoles, basicAuth := util.Config.PulsarPublicKey, util.SuperRoles, util.Config.BasicAuth
+	util.Config.PulsarPublicKey, util.SuperRoles = "public-key", []string{"superuser"}
+	util.Config.BasicAuth = util.BasicAuth{Users: users}
+	defer func() {
+		util.Config.PulsarPublicKey, util.SuperRoles, util.Config.BasicAuth = publicKey, superRoles, basicAuth
+	}()
+
+	subject := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("injectedSubs")))
+	})
+	router := mux.NewRouter()
+	router.Path("/pulsarmetrics").Methods(http.MethodGet).Handler(Require("tenant:read-metrics", TenantFromSubject, subject))
+	router.Path("/function-metrics/{tenant}").Methods(http.MethodGet).Handler(Require("tenant:read-metrics", TenantFromPath, subject))
+	router.Path("/stats/{tenant}").Methods(http.MethodGet).Handler(Require("tenant:read-stats", TenantFromPath, subject))
+	send := func(path, username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth(username, password)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("/pulsarmetrics", "prometheus", "scrape-secret")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "ming-luo-client-1234", rr.Body.String())
+	// a verified pair is cached
+	rr = send("/function-metrics/ming-luo", "prometheus", "scrape-secret")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, http.StatusUnauthorized, send("/function-metrics/other", "prometheus", "scrape-secret").Code)
+
+	rr = send("/pulsarmetrics", "prometheus", "wrong")
+	equals(t, http.StatusUnauthorized, rr.Code)
+	assert(t, strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Basic"), "expected the basic-auth challenge")
+	equals(t, http.StatusUnauthorized, send("/pulsarmetrics", "unknown", "scrape-secret").Code)
+
+	// basic-auth is only accepted on the configured resources
+	rr = send("/stats/ming-luo", "prometheus", "scrape-secret")
+	equals(t, http.StatusUnauthorized, rr.Code)
+	equals(t, "", rr.Header().Get("WWW-Authenticate"))
+	util.Config.BasicAuth.Resources = []string{"stats"}
+	equals(t, http.StatusOK, send("/stats/ming-luo", "prometheus", "scrape-secret").Code)
+	equals(t, http.StatusUnauthorized, send("/pulsarmetrics", "prometheus", "scrape-secret").Code)
+}
+
+func TestBoundTokenAuth(t *testing.T) {
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(t, err)
+	jwtAuth, publicKey, bindingCfg := util.JWTAuth, util.Config.PulsarPublicKey, util.Config.TokenBinding
+	lockoutCfg, trustedProxies := util.Config.AuthLockout, util.Config.TrustedProxies
+	util.JWTAuth, util.Config.PulsarPublicKey = keys, "public-key"
+	util.Config.TokenBinding = util.TokenBinding{ClientCertHeader: "X-SSL-Client-Cert"}
+	util.Config.AuthLockout = util.AuthLockout{FailuresPerIP: -1, TrustForwardedFor: true}
+	util.Config.TrustedProxies = []string{"192.0.2.10", "10.0.0.0/8"}
+	defer func() {
+		util.JWTAuth, util.Config.PulsarPublicKey, util.Config.TokenBinding = jwtAuth, publicKey, bindingCfg
+		util.Config.AuthLockout, util.Config.TrustedProxies = lockoutCfg, trustedProxies
+	}()
+
+	cert := selfSignedCert(t, "ming-luo-client")
+	binding, err := icrypto.NewTokenBinding(icrypto.CertThumbprint(cert), []string{"192.0.2.0/24"})
+	errNil(t, err)
+	bound, err := keys.GenerateBoundToken("ming-luo-client-1234", time.Hour, jwt.SigningMethodRS256, nil, binding)
+	errNil(t, err)
+	certHeader := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+
+	router := mux.NewRouter()
+	router.Path("/stats/{tenant}").Handler(AuthVerifyTenantJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	send := func(remoteAddr string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodGet, "/stats/ming-luo", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header = header
+		req.Header.Set("Authorization", "Bearer "+bound)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	equals(t, http.StatusOK, send("192.0.2.10:5000", http.Header{"X-Ssl-Client-Cert": {certHeader}}))
+	equals(t, http.StatusUnauthorized, send("192.0.2.10:5000", http.Header{}))
+	equals(t, http.StatusUnauthorized, send("198.51.100.7:5000", http.Header{"X-Ssl-Client-Cert": {certHeader}}))
+	// the certificate header and the source IP are only trusted from a trusted proxy
+	equals(t, http.StatusUnauthorized, send("192.0.2.11:5000", http.Header{"X-Ssl-Client-Cert": {certHeader}}))
+	equals(t, http.StatusOK, send("10.0.0.2:5000", http.Header{"X-Ssl-Client-Cert": {certHeader}, "X-Forwarded-For": {"192.0.2.11"}}))
+	equals(t, http.StatusUnauthorized, send("10.0.0.2:5000", http.Header{"X-Ssl-Client-Cert": {certHeader}, "X-Forwarded-For": {"192.0.2.11, 198.51.100.7"}}))
+	// a TLS connection presents the client certificate
+	req := httptest.NewRequest(http.MethodGet, "/stats/ming-luo", nil)
+	req.Header.Set("Authorization", "Bearer "+bound)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code)
+
+	// the binding is requested when the token is minted
+	mint := mux.NewRouter()
+	mint.Path("/subject/{sub}").HandlerFunc(TokenSubjectHandler)
+	rr = httptest.NewRecorder()
+	mint.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/subject/ming-luo-client-1234?allowed_cidrs=10.0.0.0/8&cnf="+icrypto.CertThumbprint(cert), nil))
+	equals(t, http.StatusOK, rr.Code)
+	var resp TokenServerResponse
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	verified, err := keys.VerifyToken(resp.Token)
+	errNil(t, err)
+	equals(t, []string{"10.0.0.0/8"}, verified.Binding.CIDRs)
+	rr = httptest.NewRecorder()
+	mint.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/subject/ming-luo-client-1234?allowed_cidrs=10.0.0.0", nil))
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestAuthLockoutSourceIP(t *testing.T) {
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(t, err)
+	jwtAuth, publicKey := util.JWTAuth, util.Config.PulsarPublicKey
+	lockoutCfg, trustedProxies := util.Config.AuthLockout, util.Config.TrustedProxies
+	util.JWTAuth, util.Config.PulsarPublicKey = keys, "public-key"
+	util.Config.AuthLockout = util.AuthLockout{FailuresPerIP: 1, TrustForwardedFor: true}
+	util.Config.TrustedProxies = []string{"10.0.0.0/8"}
+	defer func() {
+		util.JWTAuth, util.Config.PulsarPublicKey = jwtAuth, publicKey
+		util.Config.AuthLockout, util.Config.TrustedProxies = lockoutCfg, trustedProxies
+		util.ClearAuthBan("", "")
+	}()
+
+	router := mux.NewRouter()
+	router.Path("/stats/{tenant}").Handler(AuthVerifyTenantJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	bannedIP := func(remoteAddr, forwarded string) string {
+		util.ClearAuthBan("", "")
+		req := httptest.NewRequest(http.MethodGet, "/stats/ming-luo", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwarded)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		bans := util.GetAuthBans()
+		equals(t, 1, len(bans))
+		return bans[0].Value
+	}
+
+	// the rightmost address that is not a trusted proxy, a spoofed leftmost address is ignored
+	equals(t, "198.51.100.7", bannedIP("10.0.0.2:5000", "203.0.113.1, 198.51.100.7, 10.0.0.3"))
+	// the header of an untrusted peer is ignored
+	equals(t, "198.51.100.9", bannedIP("198.51.100.9:5000", "203.0.113.1"))
+}
+
+func TestSessions(t *testing.T) {
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(t, err)
+	jwtAuth, publicKey, sessionsCfg := util.JWTAuth, util.Config.PulsarPublicKey, util.Config.Sessions
+	util.JWTAuth, util.Config.PulsarPublicKey = keys, "public-key"
+	util.Config.Sessions = util.Sessions{Enabled: true, TTLMinutes: 60}
+	defer func() {
+		util.JWTAuth, util.Config.PulsarPublicKey, util.Config.Sessions = jwtAuth, publicKey, sessionsCfg
+		util.SessionNow = time.Now
+	}()
+	token, err := keys.GenerateToken("ming-luo-client-1234", 2*time.Hour, jwt.SigningMethodRS256)
+	errNil(t, err)
+
+	router := mux.NewRouter()
+	router.Path("/session/login").Methods(http.MethodPost).HandlerFunc(SessionLoginHandler)
+	router.Path("/session/logout").Methods(http.MethodPost).Handler(Require("public:write-session", TenantNone, http.HandlerFunc(SessionLogoutHandler)))
+	router.Path("/stats/{tenant}").Handler(AuthVerifyTenantJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	send := func(method, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/session/login", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code)
+	cookies := rr.Result().Cookies()
+	equals(t, 1, len(cookies))
+	cookie := cookies[0]
+	equals(t, util.DefaultSessionCookie, cookie.Name)
+	assert(t, cookie.HttpOnly && cookie.Secure, "the session cookie must be HttpOnly and Secure")
+	equals(t, http.SameSiteStrictMode, cookie.SameSite)
+	assert(t, !strings.Contains(rr.Body.String(), token), "the token must not be returned to the browser")
+	var resp SessionResponse
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	equals(t, "ming-luo-client-1234", resp.Subject)
+
+	equals(t, http.StatusOK, send(http.MethodGet, "/stats/ming-luo", cookie).Code)
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/stats/ming-luo", &http.Cookie{Name: cookie.Name, Value: "forged"}).Code)
+	equals(t, http.StatusUnauthorized, send(http.MethodPost, "/session/login", nil).Code)
+
+	// the session expires at the TTL
+	util.SessionNow = func() time.Time { return time.Now().Add(61 * time.Minute) }
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/stats/ming-luo", cookie).Code)
+	util.SessionNow = time.Now
+
+	// the session is capped at the token expiry
+	util.Config.Sessions.TTLMinutes = 600
+	short, err := keys.GenerateToken("ming-luo-client-1234", 10*time.Minute, jwt.SigningMethodRS256)
+	errNil(t, err)
+	verified, err := keys.VerifyToken(short)
+	errNil(t, err)
+	id, session, err := util.NewSession(verified)
+	errNil(t, err)
+	assert(t, !session.ExpiresAt.After(verified.ExpiresAt), "the session must not outlive the token")
+
+	// logout closes the session and clears the cookie
+	rr = send(http.MethodPost, "/session/logout", &http.Cookie{Name: cookie.Name, Value: id})
+	equals(t, http.StatusNoContent, rr.Code)
+	equals(t, -1, rr.Result().Cookies()[0].MaxAge)
+	_, err = util.GetSession(id)
+	equals(t, util.ErrInvalidSession, err)
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/stats/ming-luo", &http.Cookie{Name: cookie.Name, Value: id}).Code)
+
+	// the failed logins count toward the lockout, and a banned source cannot log in even with a valid token
+	lockoutCfg := util.Config.AuthLockout
+	util.Config.AuthLockout = util.AuthLockout{FailuresPerIP: 2}
+	defer func() {
+		util.Config.AuthLockout = lockoutCfg
+		util.ClearAuthBan("", "")
+	}()
+	login := func(bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/session/login", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	equals(t, http.StatusUnauthorized, login("not-a-token").Code)
+	equals(t, http.StatusUnauthorized, login("not-a-token").Code)
+	rr = login(token)
+	equals(t, http.StatusTooManyRequests, rr.Code)
+	assert(t, rr.Header().Get("Retry-After") != "", "a banned login carries Retry-After")
+	equals(t, 0, len(rr.Result().Cookies()))
+}
+
+func TestCSRFProtect(t *testing.T) {
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(t, err)
+	jwtAuth, publicKey, sessionsCfg := util.JWTAuth, util.Config.PulsarPublicKey, util.Config.Sessions
+	util.JWTAuth, util.Config.PulsarPublicKey = keys, "public-key"
+	util.Config.Sessions = util.Sessions{Enabled: true, CSRFExemptPaths: []string{"/api/"}}
+	defer func() {
+		util.JWTAuth, util.Config.PulsarPublicKey, util.Config.Sessions = jwtAuth, publicKey, sessionsCfg
+	}()
+	token, err := keys.GenerateToken("ming-luo-client-1234", time.Hour, jwt.SigningMethodRS256)
+	errNil(t, err)
+	verified, err := keys.VerifyToken(token)
+	errNil(t, err)
+	id, session, err := util.NewSession(verified)
+	errNil(t, err)
+	assert(t, session.CSRFToken != "", "a session must carry a CSRF token")
+
+	router := mux.NewRouter()
+	router.Use(CSRFProtect)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router.Path("/stats/{tenant}").Handler(AuthVerifyTenantJWT(ok))
+	router.Path("/api/{tenant}").Handler(AuthVerifyTenantJWT(ok))
+	send := func(method, path string, header http.Header, withCookie bool) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header = header
+		if withCookie {
+			req.AddCookie(&http.Cookie{Name: util.DefaultSessionCookie, Value: id})
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	equals(t, http.StatusOK, send(http.MethodGet, "/stats/ming-luo", http.Header{}, true))
+	equals(t, http.StatusForbidden, send(http.MethodPost, "/stats/ming-luo", http.Header{}, true))
+	equals(t, http.StatusForbidden, send(http.MethodPost, "/stats/ming-luo", http.Header{http.CanonicalHeaderKey(CSRFHeader): {"forged"}}, true))
+	equals(t, http.StatusOK, send(http.MethodPost, "/stats/ming-luo", http.Header{http.CanonicalHeaderKey(CSRFHeader): {session.CSRFToken}}, true))
+	// a bearer token is not attached by the browser, so it is not checked
+	equals(t, http.StatusOK, send(http.MethodPost, "/stats/ming-luo", http.Header{"Authorization": {"Bearer " + token}}, true))
+	// the exempt paths of the pure API clients refuse the session cookie, even with the CSRF token
+	equals(t, http.StatusForbidden, send(http.MethodDelete, "/api/ming-luo", http.Header{}, true))
+	equals(t, http.StatusForbidden, send(http.MethodDelete, "/api/ming-luo", http.Header{http.CanonicalHeaderKey(CSRFHeader): {session.CSRFToken}}, true))
+	equals(t, http.StatusOK, send(http.MethodGet, "/api/ming-luo", http.Header{}, true))
+	equals(t, http.StatusOK, send(http.MethodDelete, "/api/ming-luo", http.Header{"Authorization": {"Bearer " + token}}, true))
+}
+
+func TestBrokerFleet(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bookies unavailable", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	var up *httptest.Server
+	up = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/v2/brokers/fleet-cluster":
+			data, _ := json.Marshal([]string{strings.TrimPrefix(up.URL, "http://"), strings.TrimPrefix(down.URL, "http://")})
+			w.Write(data)
+		case "/admin/v2/brokers/health":
+			w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer up.Close()
+
+	adminURL, cluster := util.Config.BrokerProxyURL, util.Config.ClusterName
+	util.Config.BrokerProxyURL, util.Config.ClusterName = up.URL, "fleet-cluster"
+	defer func() { util.Config.BrokerProxyURL, util.Config.ClusterName = adminURL, cluster }()
+
+	upHost := strings.TrimPrefix(up.URL, "http://")
+	metrics.SetCache([]byte(`# TYPE pulsar_rate_in gauge
+pulsar_rate_in{instance="` + upHost + `",topic="persistent://acme/ns/a"} 10
+pulsar_rate_in{instance="` + upHost + `",topic="persistent://acme/ns/b"} 5
+pulsar_rate_in{kubernetes_pod_name="pulsar-broker-9",topic="persistent://acme/ns/c"} 1
+# TYPE pulsar_ml_AddEntryErrors gauge
+pulsar_ml_AddEntryErrors{instance="` + upHost + `",namespace="acme/ns"} 0.5
+`))
+
+	rr := httptest.NewRecorder()
+	BrokerFleetHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/brokers/fleet", nil))
+	equals(t, http.StatusOK, rr.Code)
+	var fleet BrokerFleet
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &fleet))
+	equals(t, 3, fleet.Total)
+	equals(t, 1, fleet.Up)
+	equals(t, 2, fleet.Down)
+	equals(t, 3, fleet.Topics)
+	equals(t, float64(16), fleet.RateIn)
+	equals(t, 0.5, fleet.ErrorRate)
+	for _, b := range fleet.Brokers {
+		switch b.Broker {
+		case strings.TrimPrefix(up.URL, "http://"):
+			assert(t, b.Up, "expected the healthy broker up")
+			equals(t, 2, b.Topics)
+			equals(t, float64(15), b.RateIn)
+		case strings.TrimPrefix(down.URL, "http://"):
+			assert(t, !b.Up, "expected the failed health check down")
+			assert(t, strings.Contains(b.Error, "bookies unavailable"), "expected the health check error")
+		case "pulsar-broker-9":
+			assert(t, !b.Up, "expected the inactive broker down")
+		default:
+			t.Fatalf("unexpected broker %s", b.Broker)
+		}
+	}
+}
+
+func TestTenantTopics(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/admin/v2/namespaces/acme":
+			body = []string{"acme/ns1", "acme/ns2"}
+		case "/admin/v2/namespaces/acme/ns1/topics":
+			body = []string{"persistent://acme/ns1/a-partition-0", "persistent://acme/ns1/a-partition-1", "persistent://acme/ns1/b"}
+		case "/admin/v2/namespaces/acme/ns2/topics":
+			body = []string{"persistent://acme/ns2/c"}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(body)
+		w.Write(data)
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	util.Config.BrokerProxyURL = admin.URL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+
+	metrics.SetCache([]byte(`# TYPE pulsar_rate_in gauge
+pulsar_rate_in{namespace="acme/ns1",topic="persistent://acme/ns1/a-partition-0"} 3
+pulsar_rate_in{namespace="acme/ns1",topic="persistent://acme/ns1/a-partition-1"} 4
+pulsar_rate_in{namespace="acme/ns2",topic="persistent://acme/ns2/c"} 1
+# TYPE pulsar_msg_backlog gauge
+pulsar_msg_backlog{namespace="acme/ns1",topic="persistent://acme/ns1/b"} 42
+`))
+
+	get := func(query string) TenantTopicsResponse {
+		rr := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/topics/acme"+query, nil), map[string]string{"tenant": "acme"})
+		TenantTopicsHandler(rr, req)
+		equals(t, http.StatusOK, rr.Code)
+		var resp TenantTopicsResponse
+		errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		return resp
+	}
+
+	resp := get("?limit=2")
+	equals(t, 3, resp.Total)
+	equals(t, 2, resp.Offset)
+	equals(t, "", resp.MetricsError)
+	equals(t, 2, len(resp.Topics))
+	equals(t, "persistent://acme/ns1/a", resp.Topics[0].Name)
+	equals(t, 2, resp.Topics[0].Partitions)
+	equals(t, float64(7), resp.Topics[0].RateIn)
+	equals(t, "persistent://acme/ns1/b", resp.Topics[1].Name)
+	equals(t, float64(42), resp.Topics[1].Backlog)
+
+	resp = get("?offset=2&limit=2")
+	equals(t, 3, resp.Offset)
+	equals(t, 1, len(resp.Topics))
+	equals(t, "acme/ns2", resp.Topics[0].Namespace)
+	equals(t, float64(1), resp.Topics[0].RateIn)
+
+	resp = get("?namespace=ns2")
+	equals(t, 1, resp.Total)
+
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/topics/victor", nil), map[string]string{"tenant": "victor"})
+	TenantTopicsHandler(rr, req)
+	equals(t, http.StatusNotFound, rr.Code)
+}
+
+func TestPartitionedTopicStats(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/v2/persistent/acme/ns/orders/partitions":
+			w.Write([]byte(`{"partitions":2}`))
+		case "/admin/v2/persistent/acme/ns/single/partitions":
+			w.Write([]byte(`{"partitions":0}`))
+		case "/admin/v2/persistent/acme/ns/orders-partition-0/stats":
+			w.Write([]byte(`{"msgRateIn":10,"averageMsgSize":100,"publishers":[{"producerName":"p0"}],
+				"subscriptions":{"billing":{"msgBacklog":5,"type":"Shared","consumers":[{"consumerName":"c0"}]}}}`))
+		case "/admin/v2/persistent/acme/ns/orders-partition-1/stats":
+			w.Write([]byte(`{"msgRateIn":5,"averageMsgSize":300,"publishers":[{"producerName":"p1"}],
+				"subscriptions":{"billing":{"msgBacklog":7,"type":"Shared","consumers":[{"consumerName":"c1"}]},"audit":{"msgBacklog":1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	util.Config.BrokerProxyURL = admin.URL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+
+	get := func(topic, query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/v2/persistent/acme/ns/"+topic+"/partitioned-stats"+query, nil)
+		PartitionedTopicStatsHandler(rr, mux.SetURLVars(req, map[string]string{"tenant": "acme", "namespace": "ns", "topic": topic}))
+		return rr
+	}
+
+	rr := get("orders", "")
+	equals(t, http.StatusOK, rr.Code)
+	var stats map[string]interface{}
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	equals(t, float64(15), stats["msgRateIn"])
+	equals(t, float64(200), stats["averageMsgSize"])
+	equals(t, 2, len(stats["publishers"].([]interface{})))
+	subscriptions := stats["subscriptions"].(map[string]interface{})
+	billing := subscriptions["billing"].(map[string]interface{})
+	equals(t, float64(12), billing["msgBacklog"])
+	equals(t, "Shared", billing["type"])
+	equals(t, 2, len(billing["consumers"].([]interface{})))
+	equals(t, float64(1), subscriptions["audit"].(map[string]interface{})["msgBacklog"])
+	equals(t, float64(2), stats["metadata"].(map[string]interface{})["partitions"])
+	partitions := stats["partitions"].(map[string]interface{})
+	equals(t, 2, len(partitions))
+	equals(t, float64(5), partitions["persistent://acme/ns/orders-partition-1"].(map[string]interface{})["msgRateIn"])
+
+	rr = get("orders", "?perPartition=false")
+	stats = nil
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	_, ok := stats["partitions"]
+	assert(t, !ok, "expected the stats without the partitions")
+
+	equals(t, http.StatusNotFound, get("single", "").Code)
+	equals(t, http.StatusNotFound, get("missing", "").Code)
+}
+
+func TestBacklogCleanup(t *testing.T) {
+	superRoles := util.SuperRoles
+	util.SuperRoles = []string{"superuser"}
+	defer func() { util.SuperRoles = superRoles }()
+	cleanupCfg := util.Config.BacklogCleanup
+	util.Config.BacklogCleanup = util.BacklogCleanup{MaxMessagesPerCall: 1000}
+	defer func() { util.Config.BacklogCleanup = cleanupCfg }()
+	sink := &memorySink{}
+	audit.AddSink(sink)
+
+	cleaned := []string{}
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/admin/v2/persistent/acme/ns/orders/stats":
+			w.Write([]byte(`{"subscriptions":{"billing":{"msgBacklog":500},"audit":{"msgBacklog":5000}}}`))
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/admin/v2/persistent/acme/ns/orders/subscription/"):
+			cleaned = append(cleaned, strings.TrimPrefix(r.URL.Path, "/admin/v2/persistent/acme/ns/orders/subscription/"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	util.Config.BrokerProxyURL = admin.URL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+
+	prefix := "/admin/v2/persistent/{tenant}/{namespace}/{topic}/subscription/{subscription}"
+	router := mux.NewRouter()
+	router.Path(prefix + "/skip/{count}").Handler(BacklogCleanupHandler("skip"))
+	router.Path(prefix + "/expireMessages/{seconds}").Handler(BacklogCleanupHandler("expireMessages"))
+	router.Path(prefix + "/skip_all").Handler(BacklogCleanupHandler("skip_all"))
+	post := func(path, subject, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/v2/persistent/acme/ns/orders/subscription/"+path, nil)
+		req.Header.Set("injectedSubs", subject)
+		if token != "" {
+			req.Header.Set(ConfirmationHeader, token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// a cleanup requires the confirmation token of a dry run
+	equals(t, http.StatusPreconditionRequired, post("billing/skip_all", "acme-client-1234", "").Code)
+	rr := post("billing/skip/200?dryRun=true", "acme-client-1234", "")
+	equals(t, http.StatusOK, rr.Code)
+	var estimate BacklogCleanupEstimate
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &estimate))
+	equals(t, int64(500), estimate.Backlog)
+	equals(t, int64(200), estimate.EstimatedMessages)
+	equals(t, 0, len(cleaned))
+
+	// the token is bound to the amount and is used once
+	equals(t, http.StatusPreconditionRequired, post("billing/skip/300", "acme-client-1234", estimate.ConfirmationToken).Code)
+	rr = post("billing/skip/200?dryRun=true", "acme-client-1234", "")
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &estimate))
+	equals(t, http.StatusNoContent, post("billing/skip/200", "acme-client-1234", estimate.ConfirmationToken).Code)
+	equals(t, http.StatusPreconditionRequired, post("billing/skip/200", "acme-client-1234", estimate.ConfirmationToken).Code)
+	equals(t, []string{"billing/skip/200"}, cleaned)
+
+	// a backlog over the limit per call is rejected
+	equals(t, http.StatusUnprocessableEntity, post("audit/skip_all?dryRun=true", "acme-client-1234", "").Code)
+	equals(t, http.StatusNotFound, post("missing/expireMessages/60?dryRun=true", "acme-client-1234", "").Code)
+	// the super roles bypass the guardrails
+	equals(t, http.StatusNoContent, post("audit/skip_all", "superuser", "").Code)
+	equals(t, []string{"billing/skip/200", "audit/skip_all"}, cleaned)
+
+	outcomes := []string{}
+	for _, e := range sink.events {
+		if strings.HasPrefix(e.Resource, "persistent://acme/ns/orders/") {
+			outcomes = append(outcomes, e.Action+" "+e.Outcome)
+		}
+	}
+	equals(t, []string{"subscription.skip_all denied", "subscription.skip.dry-run allowed", "subscription.skip denied",
+		"subscription.skip.dry-run allowed", "subscription.skip allowed", "subscription.skip denied",
+		"subscription.skip_all denied", "subscription.expireMessages denied", "subscription.skip_all allowed"}, outcomes)
+}
+
+func TestOwnershipLookupCache(t *testing.T) {
+	lookups := 0
+	owner := "broker-1"
+	unloadStatus := http.StatusNoContent
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lookup/v2/topic/persistent/acme/ns/orders":
+			lookups++
+			w.Write([]byte(`{"brokerUrl":"pulsar://` + owner + `:6650","httpUrl":"http://` + owner + `:8080"}`))
+		case "/admin/v2/namespaces/acme/ns/unload":
+			w.WriteHeader(unloadStatus)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	util.Config.BrokerProxyURL = admin.URL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+
+	router := mux.NewRouter()
+	router.Path("/lookup/v2/topic/{domain}/{tenant}/{namespace}/{topic}").Handler(http.HandlerFunc(OwnershipLookupHandler))
+	router.Path("/admin/v2/namespaces/{tenant}/{namespace}/unload").Handler(InvalidateOwnershipOnSuccess(http.HandlerFunc(DirectBrokerProxyHandler)))
+	request := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+	lookup := func() *httptest.ResponseRecorder {
+		return request(http.MethodGet, "/lookup/v2/topic/persistent/acme/ns/orders")
+	}
+
+	rr := lookup()
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "miss", rr.Header().Get("X-Burnell-Cache"))
+	rr = lookup()
+	equals(t, "hit", rr.Header().Get("X-Burnell-Cache"))
+	assert(t, strings.Contains(rr.Body.String(), "broker-1"), "expected the cached owner")
+	equals(t, 1, lookups)
+
+	// a failed unload keeps the lookups
+	unloadStatus = http.StatusInternalServerError
+	request(http.MethodPut, "/admin/v2/namespaces/acme/ns/unload")
+	equals(t, "hit", lookup().Header().Get("X-Burnell-Cache"))
+
+	// an unload moves the topics to other brokers
+	owner, unloadStatus = "broker-2", http.StatusNoContent
+	equals(t, http.StatusNoContent, request(http.MethodPut, "/admin/v2/namespaces/acme/ns/unload").Code)
+	rr = lookup()
+	equals(t, "miss", rr.Header().Get("X-Burnell-Cache"))
+	assert(t, strings.Contains(rr.Body.String(), "broker-2"), "expected the new owner")
+	equals(t, 2, lookups)
+
+	equals(t, http.StatusNotFound, request(http.MethodGet, "/lookup/v2/topic/persistent/acme/ns/missing").Code)
+}
+
+// discardResponseWriter drops the response body so that a benchmark measures the proxy alone
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(status int)      { d.status = status }
+
+func TestProxyStreamsResponse(t *testing.T) {
+	stats := strings.Repeat(`{"msgRateIn":1.0},`, 100000)
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(stats))
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	util.Config.BrokerProxyURL = admin.URL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+
+	rr := httptest.NewRecorder()
+	DirectBrokerProxyHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/v2/broker-stats/topics", nil))
+	equals(t, http.StatusAccepted, rr.Code)
+	equals(t, len(stats), rr.Body.Len())
+	equals(t, stats, rr.Body.String())
+
+	buf := util.ProxyBufferPool.Get()
+	equals(t, 32*1024, len(buf))
+	util.ProxyBufferPool.Put(buf)
+}
+
+func benchmarkProxy(b *testing.B, proxy func(http.ResponseWriter, *http.Request)) {
+	stats := []byte(strings.Repeat(`{"msgRateIn":1.0},`, 4*1024*1024/18))
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(stats)
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	util.Config.BrokerProxyURL = admin.URL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stats)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		proxy(&discardResponseWriter{header: http.Header{}}, httptest.NewRequest(http.MethodGet, "/admin/v2/broker-stats/topics", nil))
+	}
+}
+
+// BenchmarkBrokerProxy measures the allocations of a proxied multi-MB stats response
+func BenchmarkBrokerProxy(b *testing.B) {
+	benchmarkProxy(b, DirectBrokerProxyHandler)
+}
+
+// BenchmarkBrokerProxyReadAll is the baseline reading the whole response before writing it
+func BenchmarkBrokerProxyReadAll(b *testing.B) {
+	benchmarkProxy(b, func(w http.ResponseWriter, r *http.Request) {
+		resp, err := util.UpstreamClient().Get(util.SingleJoinSlash(util.Config.BrokerProxyURL, r.URL.RequestURI()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+	})
+}
+
+// tokenCacheRouter serves the tenant stats behind the verified token cache, which is enabled by the shared cache
+func tokenCacheRouter(tb testing.TB, tokens int) (*mux.Router, []string) {
+	redis := miniredis.RunT(tb)
+	errNil(tb, util.InitSharedCache(util.SharedCache{Address: redis.Addr(), RetryAfterSeconds: 60}))
+	keys, err := icrypto.NewRSAKeyPair()
+	errNil(tb, err)
+	jwtAuth, publicKey := util.JWTAuth, util.Config.PulsarPublicKey
+	util.JWTAuth, util.Config.PulsarPublicKey = keys, "public-key"
+	tb.Cleanup(func() {
+		util.JWTAuth, util.Config.PulsarPublicKey = jwtAuth, publicKey
+		util.InitSharedCache(util.SharedCache{})
+	})
+
+	issued := make([]string, tokens)
+	for i := range issued {
+		issued[i], err = keys.GenerateToken(fmt.Sprintf("ming-luo-client-%d", i), time.Hour, jwt.SigningMethodRS256)
+		errNil(tb, err)
+	}
+	router := mux.NewRouter()
+	router.Path("/stats/{tenant}").Handler(AuthVerifyTenantJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	return router, issued
+}
+
+func sendWithToken(router *mux.Router, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/stats/ming-luo", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestShardedTokenCache(t *testing.T) {
+	router, tokens := tokenCacheRouter(t, 64)
+	before := util.GetMemoryBudgetStats().Entries["tokens"]
+
+	var wg sync.WaitGroup
+	codes := make([]int, 4*len(tokens))
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = sendWithToken(router, tokens[i%len(tokens)])
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		equals(t, http.StatusOK, code)
+	}
+	equals(t, before+int64(len(tokens)), util.GetMemoryBudgetStats().Entries["tokens"])
+	equals(t, http.StatusUnauthorized, sendWithToken(router, tokens[0]+"x"))
+}
+
+// BenchmarkTokenCacheParallel verifies mostly cached tokens from all the procs, run it with -race to check the shards
+func BenchmarkTokenCacheParallel(b *testing.B) {
+	router, tokens := tokenCacheRouter(b, 1024)
+	for _, token := range tokens {
+		sendWithToken(router, token)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if code := sendWithToken(router, tokens[i%len(tokens)]); code != http.StatusOK {
+				b.Fatalf("unexpected status %d", code)
+			}
+			i += 7
+		}
+	})
+}
+
+func TestPrometheusSD(t *testing.T) {
+	errNil(t, metrics.InitUsageDbTable())
+	errNil(t, metrics.UpdatePerBrokerTenantUsage("persistent://sd-acme/ns/topic", "broker-0", "pulsar_in_bytes_total", 1))
+	sdCfg, cluster := util.Config.PrometheusSD, util.Config.ClusterName
+	defer func() { util.Config.PrometheusSD, util.Config.ClusterName = sdCfg, cluster }()
+	util.Config.ClusterName = "useast1"
+
+	discover := func() map[string]PrometheusSDTargetGroup {
+		req := httptest.NewRequest(http.MethodGet, "https://burnell.example.com/prometheus/sd", nil)
+		rr := httptest.NewRecorder()
+		PrometheusSDHandler(rr, req)
+		equals(t, http.StatusOK, rr.Code)
+		equals(t, "application/json", rr.Header().Get("Content-Type"))
+		var groups []PrometheusSDTargetGroup
+		errNil(t, json.Unmarshal(rr.Body.Bytes(), &groups))
+		byTenant := map[string]PrometheusSDTargetGroup{}
+		for _, g := range groups {
+			byTenant[g.Labels["tenant"]] = g
+		}
+		return byTenant
+	}
+
+	group, ok := discover()["sd-acme"]
+	assert(t, ok, "tenant target listed")
+	equals(t, []string{"burnell.example.com"}, group.Targets)
+	equals(t, "/pulsarmetrics/sd-acme", group.Labels["__metrics_path__"])
+	equals(t, "https", group.Labels["__scheme__"])
+	equals(t, "useast1", group.Labels["cluster"])
+
+	util.Config.PrometheusSD = util.PrometheusSD{Target: "burnell.svc:8964", Scheme: "http", Labels: map[string]string{"env": "prod", "tenant": "ignored"}}
+	group = discover()["sd-acme"]
+	equals(t, []string{"burnell.svc:8964"}, group.Targets)
+	equals(t, "http", group.Labels["__scheme__"])
+	equals(t, "prod", group.Labels["env"])
+}
+
+func TestKafkaNamingParameter(t *testing.T) {
+	metrics.SetCache([]byte(`# TYPE pulsar_subscription_back_log gauge
+pulsar_subscription_back_log{namespace="kafka-naming/ns",topic="persistent://kafka-naming/ns/orders",subscription="billing"} 5
+`))
+	router := mux.NewRouter()
+	router.Path("/pulsarmetrics/{tenant}").HandlerFunc(PulsarFederatedDebugPrometheusHandler)
+	send := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/pulsarmetrics/kafka-naming"+query, nil))
+		return rr
+	}
+
+	rr := send("")
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "pulsar_subscription_back_log{"), rr.Body.String())
+	rr = send("?naming=kafka")
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), `kafka_consumergroup_lag{consumergroup="billing",namespace="kafka-naming/ns",partition="0",topic="orders"} 5`), rr.Body.String())
+	equals(t, http.StatusUnprocessableEntity, send("?naming=datadog").Code)
+}
+
+func TestProvisioningAPI(t *testing.T) {
+	admin := &fakePulsarAdmin{tenants: map[string]json.RawMessage{}, namespaces: map[string]map[string]json.RawMessage{}}
+	server := httptest.NewServer(admin)
+	defer server.Close()
+	adminURL, clusterName := util.Config.BrokerProxyURL, util.Config.ClusterName
+	defer func() { util.Config.BrokerProxyURL, util.Config.ClusterName = adminURL, clusterName }()
+	util.Config.BrokerProxyURL, util.Config.ClusterName = server.URL, "west"
+
+	call := func(handler http.HandlerFunc, method string, vars map[string]string, body string, headers ...string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest(method, "/provisioning/v1", strings.NewReader(body)), vars)
+		req.Header.Set("injectedSubs", "superuser")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	acme := map[string]string{"tenant": "acme"}
+	equals(t, http.StatusNotFound, call(ProvisionedTenantHandler, http.MethodGet, acme, "").Code)
+	equals(t, http.StatusPreconditionFailed, call(ProvisionedTenantHandler, http.MethodPut, acme, `{}`, "If-Match", "*").Code)
+
+	rr := call(ProvisionedTenantHandler, http.MethodPut, acme, `{"adminRoles":["acme-admin"]}`)
+	equals(t, http.StatusCreated, rr.Code)
+	equals(t, `{"id":"acme","adminRoles":["acme-admin"],"allowedClusters":["west"]}`, rr.Body.String())
+	etag := rr.Header().Get("ETag")
+	assert(t, etag != "", "an etag")
+
+	// a retry is idempotent
+	rr = call(ProvisionedTenantHandler, http.MethodPut, acme, `{"id":"acme","adminRoles":["acme-admin"]}`)
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, etag, rr.Header().Get("ETag"))
+	equals(t, 0, admin.posts)
+	equals(t, http.StatusPreconditionFailed, call(ProvisionedTenantHandler, http.MethodPut, acme, `{}`, "If-None-Match", "*").Code)
+	equals(t, http.StatusNotModified, call(ProvisionedTenantHandler, http.MethodGet, acme, "", "If-None-Match", etag).Code)
+	equals(t, http.StatusUnprocessableEntity, call(ProvisionedTenantHandler, http.MethodPut, acme, `{"id":"globex"}`).Code)
+
+	equals(t, http.StatusPreconditionFailed, call(ProvisionedTenantHandler, http.MethodPut, acme, `{"adminRoles":["ops"]}`, "If-Match", `"stale"`).Code)
+	rr = call(ProvisionedTenantHandler, http.MethodPut, acme, `{"adminRoles":["ops"]}`, "If-Match", etag)
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, rr.Header().Get("ETag") != etag, "a new etag")
+	equals(t, 1, admin.posts)
+
+	orders := map[string]string{"tenant": "acme", "namespace": "orders"}
+	rr = call(ProvisionedNamespaceHandler, http.MethodPut, map[string]string{"tenant": "globex", "namespace": "orders"}, `{}`)
+	equals(t, http.StatusConflict, rr.Code)
+	rr = call(ProvisionedNamespaceHandler, http.MethodPut, orders, `{"retentionMinutes":60,"permissions":{"app":["produce","consume"]}}`)
+	equals(t, http.StatusCreated, rr.Code)
+	var ns workflow.ProvisionedNamespace
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &ns))
+	equals(t, "acme/orders", ns.ID)
+	equals(t, 60, ns.RetentionMinutes)
+	equals(t, []string{"consume", "produce"}, ns.Permissions["app"])
+	etag = rr.Header().Get("ETag")
+	equals(t, etag, call(ProvisionedNamespaceHandler, http.MethodGet, orders, "").Header().Get("ETag"))
+
+	equals(t, http.StatusConflict, call(ProvisionedTenantHandler, http.MethodDelete, acme, "").Code)
+	rr = call(ProvisionedNamespaceHandler, http.MethodPut, orders, `{"retentionMinutes":60}`, "If-Match", etag)
+	equals(t, http.StatusOK, rr.Code)
+	ns = workflow.ProvisionedNamespace{}
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &ns))
+	equals(t, 0, len(ns.Permissions))
+	equals(t, http.StatusNoContent, call(ProvisionedNamespaceHandler, http.MethodDelete, orders, "").Code)
+	equals(t, http.StatusNoContent, call(ProvisionedNamespaceHandler, http.MethodDelete, orders, "").Code)
+	equals(t, http.StatusNoContent, call(ProvisionedTenantHandler, http.MethodDelete, acme, "").Code)
+	equals(t, http.StatusNotFound, call(ProvisionedTenantHandler, http.MethodGet, acme, "").Code)
+
+	ci := map[string]string{"tenant": "acme", "name": "ci"}
+	equals(t, http.StatusNotFound, call(ProvisionedTokenHandler, http.MethodGet, ci, "").Code)
+	util.ApplyAPIKey(util.APIKey{ID: "provisioned-ci", Tenant: "acme", Subject: "acme-ci", Name: "ci",
+		Permissions: []string{"read"}, CreatedAt: time.Now()})
+	defer util.ApplyAPIKey(util.APIKey{ID: "provisioned-ci", Deleted: true})
+	rr = call(ProvisionedTokenHandler, http.MethodPut, ci, `{"subject":"acme-ci","permissions":["read"]}`)
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), `"id":"provisioned-ci"`), rr.Body.String())
+	equals(t, http.StatusConflict, call(ProvisionedTokenHandler, http.MethodPut, ci, `{"subject":"acme-ci","permissions":["read","write"]}`).Code)
+}
+
+func TestTopicReader(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/v2/persistent/acme/ns/orders/messageid/1620151200000" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"ledgerId":56,"entryId":78,"partitionIndex":-1}`))
+	}))
+	defer admin.Close()
+	pulsar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]string{"path": r.URL.Path, "query": r.URL.RawQuery, "auth": r.Header.Get("Authorization")})
+	}))
+	defer pulsar.Close()
+	cfg := util.Config
+	defer func() { util.Config = cfg }()
+	util.Config.BrokerProxyURL = admin.URL
+	util.Config.WebsocketURL = "ws" + strings.TrimPrefix(pulsar.URL, "http")
+	util.Config.PulsarToken = "burnell-token"
+
+	router := mux.NewRouter()
+	router.Path("/reader/v2/{domain:persistent|non-persistent}/{tenant}/{namespace}/{topic}").Handler(http.HandlerFunc(TopicReaderHandler))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	readerURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/reader/v2/"
+
+	read := func(path string) url.Values {
+		ws, _, err := websocket.DefaultDialer.Dial(readerURL+path, nil)
+		errNil(t, err)
+		defer ws.Close()
+		var upstream map[string]string
+		errNil(t, ws.ReadJSON(&upstream))
+		equals(t, "Bearer burnell-token", upstream["auth"])
+		assert(t, strings.HasPrefix(upstream["path"], "/ws/v2/reader/"), "pulsar reader path "+upstream["path"])
+		params, err := url.ParseQuery(upstream["query"])
+		errNil(t, err)
+		equals(t, "", params.Get("token"))
+		return params
+	}
+	equals(t, "latest", read("persistent/acme/ns/orders?token=tenant-token").Get("messageId"))
+	equals(t, "earliest", read("non-persistent/acme/ns/orders?start=earliest").Get("messageId"))
+	params := read("persistent/acme/ns/orders-partition-1?messageId=12:34:1&receiverQueueSize=10")
+	equals(t, util.MessageID{LedgerID: 12, EntryID: 34, Partition: 1, BatchIndex: -1}.Base64(), params.Get("messageId"))
+	equals(t, "10", params.Get("receiverQueueSize"))
+	params = read("persistent/acme/ns/orders?timestamp=2021-05-04T18:00:00Z")
+	equals(t, util.MessageID{LedgerID: 56, EntryID: 78, Partition: -1, BatchIndex: -1}.Base64(), params.Get("messageId"))
+	equals(t, params.Get("messageId"), read("persistent/acme/ns/orders?timestamp=1620151200000").Get("messageId"))
+
+	for path, status := range map[string]int{
+		"persistent/acme/ns/orders?start=middle":                    http.StatusBadRequest,
+		"persistent/acme/ns/orders?start=earliest&timestamp=0":      http.StatusBadRequest,
+		"persistent/acme/ns/orders?messageId=12":                    http.StatusBadRequest,
+		"persistent/acme/ns/orders-partition-1?messageId=12:34:2":   http.StatusUnprocessableEntity,
+		"persistent/acme/ns/orders?timestamp=2999-01-01T00:00:00Z":  http.StatusUnprocessableEntity,
+		"non-persistent/acme/ns/orders?messageId=12:34":             http.StatusUnprocessableEntity,
+		"persistent/acme/ns/missing?timestamp=2021-05-04T18:00:00Z": http.StatusNotFound,
+	} {
+		_, res, err := websocket.DefaultDialer.Dial(readerURL+path, nil)
+		assert(t, err != nil, "rejected "+path)
+		equals(t, status, res.StatusCode)
+	}
+}
+
+func TestTopicStatsStream(t *testing.T) {
+	var rateIn int64 = 1
+	admin := httptest.NewServer(nil)
+	defer admin.Close()
+	admin.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/v2/brokers/stream-cluster":
+			fmt.Fprintf(w, `["%s"]`, strings.TrimPrefix(admin.URL, "http://"))
+		case "/admin/v2/broker-stats/topics":
+			fmt.Fprintf(w, `{"acme/ns1":{"0x0_0xf":{"persistent":{"persistent://acme/ns1/a":{"msgRateIn":%d},"persistent://acme/ns1/b":{"msgRateIn":5}}}},
+				"other/ns":{"0x0_0xf":{"persistent":{"persistent://other/ns/x":{"msgRateIn":7}}}}}`, atomic.LoadInt64(&rateIn))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	adminURL, cluster := util.Config.BrokerProxyURL, util.Config.ClusterName
+	defer func() { util.Config.BrokerProxyURL, util.Config.ClusterName = adminURL, cluster }()
+	util.Config.BrokerProxyURL, util.Config.ClusterName = admin.URL, "stream-cluster"
+	errNil(t, policy.InitTopicStatsDB())
+	policy.RefreshTopicStats()
+
+	router := mux.NewRouter()
+	router.Path("/stats/topics/{tenant}/stream").Handler(http.HandlerFunc(TopicStatsStreamHandler))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/stats/topics/acme/stream?topic=persistent://other/ns/x")
+	errNil(t, err)
+	res.Body.Close()
+	equals(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/stats/topics/acme/stream?topic=persistent://acme/ns1/a", nil)
+	res, err = http.DefaultClient.Do(req)
+	errNil(t, err)
+	defer res.Body.Close()
+	equals(t, "text/event-stream", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+	next := func() (string, TopicStatsSnapshot) {
+		var id string
+		var snapshot TopicStatsSnapshot
+		for {
+			line, err := reader.ReadString('\n')
+			errNil(t, err)
+			if line == "\n" && id != "" {
+				return id, snapshot
+			} else if strings.HasPrefix(line, "id: ") {
+				id = strings.TrimSpace(strings.TrimPrefix(line, "id: "))
+			} else if strings.HasPrefix(line, "data: ") {
+				errNil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &snapshot))
+			}
+		}
+	}
+	id, snapshot := next()
+	equals(t, "1", id)
+	equals(t, "acme", snapshot.Tenant)
+	equals(t, 1, snapshot.Total)
+	equals(t, map[string]interface{}{"msgRateIn": float64(1)}, snapshot.Data["persistent://acme/ns1/a"])
+
+	// a refresh without changes of the selected topics is not sent
+	policy.RefreshTopicStats()
+	atomic.StoreInt64(&rateIn, 2)
+	policy.RefreshTopicStats()
+	id, snapshot = next()
+	equals(t, "2", id)
+	equals(t, map[string]interface{}{"msgRateIn": float64(2)}, snapshot.Data["persistent://acme/ns1/a"])
+}
+
+func TestProduce(t *testing.T) {
+	auditTopic := util.Config.AuditTopic
+	defer func() { util.Config.AuditTopic = auditTopic }()
+	util.Config.AuditTopic = "persistent://acme/ns/audit"
+
+	router := mux.NewRouter()
+	router.Path("/v1/produce/{tenant}/{namespace}/{topic}").Handler(http.HandlerFunc(ProduceHandler))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	produce := func(topic, body string) (int, string) {
+		res, err := http.Post(server.URL+"/v1/produce/acme/ns/"+topic, "application/json", strings.NewReader(body))
+		errNil(t, err)
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(data)
+	}
+
+	payload := `{"payload":"aGVsbG8=","key":"k1","properties":{"source":"webhook"}}`
+	for _, c := range []struct {
+		topic, body string
+		status      int
+	}{
+		{"__change_events", payload, http.StatusUnprocessableEntity},
+		{"orders", `{"payload":"not base64"}`, http.StatusBadRequest},
+		{"orders", `{"key":"k1"}`, http.StatusBadRequest},
+		{"orders", `{"payload":"aGVsbG8=","properties":{"":"v"}}`, http.StatusBadRequest},
+		{"audit", payload, http.StatusForbidden},
+		// the Pulsar client is not initialized in the test
+		{"orders", payload, http.StatusServiceUnavailable},
+	} {
+		status, body := produce(c.topic, c.body)
+		equals(t, c.status, status)
+		assert(t, strings.Contains(body, "error"), "error response "+body)
+	}
+}
+
+func TestTopicPeekAndConsume(t *testing.T) {
+	messages := []string{"m1", "m2", "m3", "m4", "m5"}
+	var lock sync.Mutex
+	cursor, deleted, created := 0, "", ""
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/admin/v2/persistent/acme/ns/orders/")
+		message := func(i int) {
+			if i < 0 || i >= len(messages) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("X-Pulsar-Message-ID", fmt.Sprintf("1:%d", i))
+			w.Header().Set("X-Pulsar-Property-Source", "test")
+			w.Write([]byte(messages[i]))
+		}
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "examinemessage":
+			n, _ := strconv.Atoi(r.URL.Query().Get("messagePosition"))
+			message(len(messages) - n)
+		case r.Method == http.MethodPut && len(parts) == 2:
+			body, _ := ioutil.ReadAll(r.Body)
+			created = parts[1] + " " + string(body)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && len(parts) == 4 && parts[2] == "position":
+			n, _ := strconv.Atoi(parts[3])
+			message(cursor + n - 1)
+		case r.Method == http.MethodPost && len(parts) == 4 && parts[2] == "skip":
+			n, _ := strconv.Atoi(parts[3])
+			cursor += n
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete && len(parts) == 2:
+			deleted = parts[1]
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer admin.Close()
+	adminURL, auditTopic := util.Config.BrokerProxyURL, util.Config.AuditTopic
+	defer func() { util.Config.BrokerProxyURL, util.Config.AuditTopic = adminURL, auditTopic }()
+	util.Config.BrokerProxyURL, util.Config.AuditTopic = admin.URL, "persistent://acme/ns/audit"
+
+	router := mux.NewRouter()
+	router.Path("/v1/peek/{tenant}/{namespace}/{topic}").Handler(http.HandlerFunc(TopicPeekHandler))
+	router.Path("/v1/consume/{tenant}/{namespace}/{topic}").Handler(http.HandlerFunc(TopicConsumeHandler))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	call := func(method, path string) (int, PeekResponse) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		errNil(t, err)
+		defer res.Body.Close()
+		var peeked PeekResponse
+		if res.StatusCode == http.StatusOK {
+			errNil(t, json.NewDecoder(res.Body).Decode(&peeked))
+		}
+		return res.StatusCode, peeked
+	}
+	payloads := func(res PeekResponse) []string {
+		list := []string{}
+		for _, m := range res.Messages {
+			data, err := base64.StdEncoding.DecodeString(m.Payload)
+			errNil(t, err)
+			equals(t, "test", m.Properties["Source"])
+			list = append(list, string(data))
+		}
+		return list
+	}
+
+	status, res := call(http.MethodGet, "/v1/peek/acme/ns/orders?count=2")
+	equals(t, http.StatusOK, status)
+	equals(t, []string{"m5", "m4"}, payloads(res))
+	equals(t, "1:4", res.Messages[0].MessageID)
+	assert(t, res.Subscription == "" && res.ExpiresAt == nil, "a peek has no subscription")
+
+	status, res = call(http.MethodPost, "/v1/consume/acme/ns/orders?count=3")
+	equals(t, http.StatusOK, status)
+	equals(t, []string{"m1", "m2", "m3"}, payloads(res))
+	assert(t, strings.HasPrefix(res.Subscription, "burnell-debug-"), "throwaway subscription "+res.Subscription)
+	equals(t, res.Subscription+` {"ledgerId":-1,"entryId":-1,"partitionIndex":-1,"batchIndex":-1}`, created)
+	assert(t, res.ExpiresAt.After(time.Now().Add(4*time.Minute)), "subscription expiry")
+	sub := res.Subscription
+
+	status, res = call(http.MethodPost, "/v1/consume/acme/ns/orders?subscription="+sub)
+	equals(t, http.StatusOK, status)
+	equals(t, []string{"m4", "m5"}, payloads(res))
+	status, res = call(http.MethodPost, "/v1/consume/acme/ns/orders?subscription="+sub)
+	equals(t, http.StatusOK, status)
+	equals(t, 0, len(res.Messages))
+
+	// a subscription is bound to its topic
+	status, _ = call(http.MethodPost, "/v1/consume/acme/ns/payments?subscription="+sub)
+	equals(t, http.StatusNotFound, status)
+	status, _ = call(http.MethodDelete, "/v1/consume/acme/ns/orders?subscription="+sub)
+	equals(t, http.StatusNoContent, status)
+	equals(t, sub, deleted)
+	status, _ = call(http.MethodPost, "/v1/consume/acme/ns/orders?subscription="+sub)
+	equals(t, http.StatusNotFound, status)
+
+	status, _ = call(http.MethodGet, "/v1/peek/acme/ns/audit")
+	equals(t, http.StatusForbidden, status)
+	status, _ = call(http.MethodGet, "/v1/peek/acme/ns/orders?count=101")
+	equals(t, http.StatusUnprocessableEntity, status)
+	for i := 0; i < 10; i++ {
+		call(http.MethodGet, "/v1/peek/flood/ns/orders?count=0")
+	}
+	status, _ = call(http.MethodGet, "/v1/peek/flood/ns/orders?count=0")
+	equals(t, http.StatusTooManyRequests, status)
+}
+
+func TestDebugSubscriptionQuota(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/admin/v2/persistent/quota/ns/orders/subscription/") {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer admin.Close()
+	adminURL := util.Config.BrokerProxyURL
+	defer func() { util.Config.BrokerProxyURL = adminURL }()
+	util.Config.BrokerProxyURL = admin.URL
+
+	router := mux.NewRouter()
+	router.Path("/v1/consume/{tenant}/{namespace}/{topic}").Handler(http.HandlerFunc(TopicConsumeHandler))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	consume := func(topic string) int {
+		res, err := http.Post(server.URL+"/v1/consume/quota/ns/"+topic, "application/json", nil)
+		errNil(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// a failed creation releases its slot of the namespace quota
+	equals(t, http.StatusNotFound, consume("missing"))
+	// the concurrent creations do not exceed the quota of 5
+	var wg sync.WaitGroup
+	statuses := make(chan int, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- consume("orders")
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	equals(t, map[int]int{http.StatusOK: 5, http.StatusTooManyRequests: 1}, counts)
+}
+
+func TestDebugSubscriptionSweep(t *testing.T) {
+	stale := fmt.Sprintf("burnell-debug-%d-0123456789ab", time.Now().Add(-2*time.Hour).Unix())
+	fresh := fmt.Sprintf("burnell-debug-%d-ba9876543210", time.Now().Unix())
+	legacy := "burnell-debug-cafe12345678"
+	var lock sync.Mutex
+	deleted := []string{}
+	admin := httptest.NewServer(nil)
+	defer admin.Close()
+	admin.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/admin/v2/brokers/sweep-cluster":
+			fmt.Fprintf(w, `["%s"]`, strings.TrimPrefix(admin.URL, "http://"))
+		case r.URL.Path == "/admin/v2/broker-stats/topics":
+			fmt.Fprintf(w, `{"acme/ns":{"0x0_0xf":{"persistent":{"persistent://acme/ns/orders":{"subscriptions":{"%s":{},"%s":{},"%s":{},"app":{}}}}}}}`,
+				stale, fresh, legacy)
+		case r.Method == http.MethodDelete:
+			lock.Lock()
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/admin/v2/persistent/acme/ns/orders/subscription/"))
+			lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	adminURL, cluster := util.Config.BrokerProxyURL, util.Config.ClusterName
+	defer func() { util.Config.BrokerProxyURL, util.Config.ClusterName = adminURL, cluster }()
+	util.Config.BrokerProxyURL, util.Config.ClusterName = admin.URL, "sweep-cluster"
+	errNil(t, policy.InitTopicStatsDB())
+	policy.RefreshTopicStats()
+
+	// the subscriptions past the longest lifetime and the ones without the creation time are left over
+	equals(t, 2, SweepDebugSubscriptions())
+	sort.Strings(deleted)
+	equals(t, []string{stale, legacy}, deleted)
+}
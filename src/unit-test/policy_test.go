@@ -22,8 +22,10 @@
 package tests
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/util"
@@ -84,3 +86,87 @@ func TestIsPartitionTopic(t *testing.T) {
 	assert(t, util.IsPersistentTopic("persistent://ming-luo/local-useast1-gcp/partition-topic2-partition-1o9"), "")
 	assert(t, !util.IsPersistentTopic("non-persistent://ming-luo/local-useast1-gcp/partition-topic2"), "")
 }
+
+func TestShardIndex(t *testing.T) {
+	equals(t, 0, ShardIndex("ming-luo", 0))
+	equals(t, 0, ShardIndex("ming-luo", 1))
+	equals(t, ShardIndex("ming-luo", 3), ShardIndex("ming-luo", 3))
+
+	counts := make([]int, 3)
+	for i := 0; i < 300; i++ {
+		index := ShardIndex(fmt.Sprintf("tenant-%d", i), 3)
+		assert(t, index >= 0 && index < 3, "shard index within the number of replicas")
+		counts[index]++
+	}
+	for _, c := range counts {
+		assert(t, c > 50, "tenants are spread across the replicas")
+	}
+
+	// tenant shard is owned locally if sharding is disabled
+	equals(t, "", ShardOwner("ming-luo"))
+}
+
+func TestPolicySnapshot(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	util.ApplyAPIKey(util.APIKey{ID: "k1", Tenant: "acme", Subject: "acme-admin", Hash: "digest", CreatedAt: created})
+	util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "acme", UpdatedAt: created})
+	util.ApplyCostLabels(util.NamespaceCostLabels{Tenant: "acme", Namespace: "ns1", Labels: map[string]string{"team": "a"}, UpdatedAt: created})
+	util.ApplyWebhook(util.Webhook{ID: "w1", Tenant: "acme", URL: "https://example.com/hook", Secret: "s1", CreatedAt: created})
+	defer func() {
+		util.ApplyAPIKey(util.APIKey{ID: "k1", Deleted: true})
+		util.ApplyTenantOverrides(util.TenantOverrides{Tenant: "acme", Deleted: true})
+		util.ApplyCostLabels(util.NamespaceCostLabels{Tenant: "acme", Namespace: "ns1", Deleted: true})
+		util.ApplyCostLabels(util.NamespaceCostLabels{Tenant: "acme", Namespace: "ns2", Deleted: true})
+		util.ResetWebhooks()
+	}()
+
+	snapshot := ExportSnapshot()
+	equals(t, util.LatestSchemaVersion(util.PolicySchema), snapshot.SchemaVersion)
+	equals(t, 1, len(snapshot.APIKeys))
+	equals(t, "digest", snapshot.APIKeys[0].Hash)
+	equals(t, 1, len(snapshot.Webhooks))
+	equals(t, "s1", snapshot.Webhooks[0].Secret)
+	equals(t, 1, len(snapshot.Overrides))
+	equals(t, 1, len(snapshot.CostLabels))
+
+	// a snapshot file round trips
+	data, err := json.Marshal(snapshot)
+	errNil(t, err)
+	var restored Snapshot
+	errNil(t, json.Unmarshal(data, &restored))
+	report, err := RestoreSnapshot(restored, true, true)
+	errNil(t, err)
+	equals(t, RestoreCounts{Unchanged: 1}, report.Stores["apiKeys"])
+	equals(t, RestoreCounts{Unchanged: 1}, report.Stores["webhooks"])
+
+	restored.CostLabels[0].Labels = map[string]string{"team": "b"}
+	restored.CostLabels = append(restored.CostLabels, util.NamespaceCostLabels{Tenant: "acme", Namespace: "ns2", Labels: map[string]string{"team": "c"}})
+	restored.Webhooks = nil
+	report, err = RestoreSnapshot(restored, true, false)
+	errNil(t, err)
+	equals(t, RestoreCounts{Created: 1, Updated: 1}, report.Stores["costLabels"])
+	equals(t, RestoreCounts{}, report.Stores["webhooks"])
+	report, err = RestoreSnapshot(restored, true, true)
+	errNil(t, err)
+	equals(t, RestoreCounts{Deleted: 1}, report.Stores["webhooks"])
+	equals(t, "a", util.GetCostLabels("acme", "ns1")["team"])
+
+	_, err = RestoreSnapshot(restored, false, false)
+	assertErr(t, "policy store tenants is not initialized", err)
+
+	latest := util.LatestSchemaVersion(util.PolicySchema)
+	restored.SchemaVersion = latest + 1
+	_, err = RestoreSnapshot(restored, true, false)
+	assertErr(t, fmt.Sprintf("snapshot schema version %d is newer than the supported version %d", latest+1, latest), err)
+	restored.SchemaVersion = 0
+	assertErr(t, "snapshot has no schema version", ValidateSnapshot(restored))
+	_, err = DecodeSnapshot([]byte(`{"tenants":[]}`))
+	assertErr(t, "snapshot has no schema version", err)
+	decoded, err := DecodeSnapshot([]byte(fmt.Sprintf(`{"schemaVersion":%d,"apiKeys":[{"id":"k2","tenant":"acme"}]}`, latest)))
+	errNil(t, err)
+	equals(t, "k2", decoded.APIKeys[0].ID)
+	restored.SchemaVersion = latest
+	restored.Secrets = []TenantSecret{{Tenant: "acme", Name: "password", Value: "encrypted"}}
+	restored.SecretKeyFingerprint = "other"
+	assertErr(t, "snapshot secrets are encrypted with a different SecretEncryptionKey", ValidateSnapshot(restored))
+}
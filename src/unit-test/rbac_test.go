@@ -0,0 +1,330 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/datastax/burnell/src/audit"
+	. "github.com/datastax/burnell/src/rbac"
+	"github.com/datastax/burnell/src/route"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+func TestRoleEngine(t *testing.T) {
+	superRoles := util.SuperRoles
+	util.SuperRoles = []string{"superuser"}
+	defer func() { util.SuperRoles = superRoles }()
+	ctx := context.Background()
+	allowed := func(e Engine, subject, tenant, resource, action string) bool {
+		return e.Authorize(ctx, Request{Subjects: []string{subject}, Tenant: tenant, Resource: resource, Action: action}).Allowed
+	}
+
+	e, err := NewRoleEngine(nil, nil, false)
+	errNil(t, err)
+	assert(t, allowed(e, "superuser", "", "admin", ActionWrite), "super role on the cluster")
+	assert(t, allowed(e, "superuser", "ming-luo", "metrics", ActionRead), "super role on a tenant")
+	assert(t, allowed(e, "ming-luo-client-1234", "ming-luo", "pulsar-admin", ActionWrite), "tenant owner")
+	assert(t, !allowed(e, "ming-luo-client-1234", "other", "metrics", ActionRead), "another tenant")
+	assert(t, !allowed(e, "ming-luo-client-1234", "", "metrics", ActionRead), "cluster resource")
+	decision := e.Authorize(ctx, Request{Subjects: []string{"other-client-1", "ming-luo-admin-1"}, Tenant: "ming-luo", Resource: "metrics", Action: ActionRead})
+	equals(t, Decision{Allowed: true, Subject: "ming-luo-admin-1", Role: RoleTenantOwner}, decision)
+
+	e, err = NewRoleEngine([]util.RBACRole{
+		{Name: RoleTenantOwner, Permissions: []string{"metrics:*", "function-logs:read"}},
+		{Name: "metrics-reader", Permissions: []string{"metrics:read"}},
+	}, []util.RBACBinding{
+		{Role: "metrics-reader", Subjects: []string{"grafana-*"}, Tenants: []string{TenantAny}},
+		{Role: "metrics-reader", Subjects: []string{"partner"}, Tenants: []string{"ming-luo"}},
+	}, false)
+	errNil(t, err)
+	assert(t, !allowed(e, "ming-luo-client-1234", "ming-luo", "pulsar-admin", ActionWrite), "replaced tenant owner role")
+	assert(t, allowed(e, "ming-luo-client-1234", "ming-luo", "function-logs", ActionRead), "replaced tenant owner role")
+	assert(t, allowed(e, "grafana-1", "", "metrics", ActionRead), "metrics reader on the cluster")
+	assert(t, allowed(e, "grafana-1", "other", "metrics", ActionRead), "metrics reader on any tenant")
+	assert(t, !allowed(e, "grafana-1", "other", "metrics", ActionWrite), "metrics reader cannot write")
+	assert(t, allowed(e, "partner", "ming-luo", "metrics", ActionRead), "binding of a tenant")
+	assert(t, !allowed(e, "partner", "other", "metrics", ActionRead), "binding of a tenant")
+
+	e, err = NewRoleEngine([]util.RBACRole{{Name: "log-reader", Permissions: []string{"function-logs:read"}}},
+		[]util.RBACBinding{{Role: "log-reader", Subjects: []string{"oncall"}, Tenants: []string{"ming-luo"}, Namespaces: []string{"prod-*"}}}, false)
+	errNil(t, err)
+	inNamespace := func(namespace string) Decision {
+		return e.Authorize(ctx, Request{Subjects: []string{"oncall"}, Tenant: "ming-luo", Namespace: namespace, Resource: "function-logs", Action: ActionRead})
+	}
+	assert(t, inNamespace("prod-east").Allowed, "binding of a namespace")
+	equals(t, "no role grants function-logs:read on namespace ming-luo/staging", inNamespace("staging").Reason)
+	assert(t, !inNamespace("").Allowed, "a namespace binding does not grant the tenant")
+
+	e, err = NewRoleEngine(nil, []util.RBACBinding{{Role: RoleSuperuser, Subjects: []string{"root"}, Tenants: []string{TenantAny}}}, true)
+	errNil(t, err)
+	assert(t, !allowed(e, "superuser", "", "admin", ActionRead), "default bindings are replaced")
+	assert(t, allowed(e, "root", "", "admin", ActionRead), "replacing binding")
+
+	_, err = NewRoleEngine(nil, []util.RBACBinding{{Role: "unknown"}}, false)
+	assert(t, err != nil, "undefined role")
+	_, err = NewRoleEngine(nil, []util.RBACBinding{{Role: RoleSuperuser, Subjects: []string{"root"}, Namespaces: []string{"["}}}, false)
+	assert(t, err != nil, "malformed namespace pattern")
+	_, err = NewRoleEngine([]util.RBACRole{{Name: "bad", Permissions: []string{"metrics"}}}, nil, false)
+	assert(t, err != nil, "malformed permission")
+	_, err = NewEngine(util.RBAC{Engine: "casbin"})
+	assert(t, err != nil, "unknown engine")
+	_, err = NewEngine(util.RBAC{Engine: "opa"})
+	assert(t, err != nil, "opa requires the URL")
+}
+
+func TestOPAEngine(t *testing.T) {
+	var input map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input map[string]interface{} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		input = body.Input
+		switch body.Input["resource"] {
+		case "metrics":
+			w.Write([]byte(`{"result": true}`))
+		case "admin":
+			w.Write([]byte(`{"result": {"allow": false, "reason": "admin is closed"}}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	e, err := NewEngine(util.RBAC{Engine: "opa", OPAURL: server.URL})
+	errNil(t, err)
+	req := Request{Subjects: []string{"ming-luo-client-1234"}, Tenant: "ming-luo", Resource: "metrics", Action: ActionRead}
+	assert(t, e.Authorize(context.Background(), req).Allowed, "allowed by OPA")
+	equals(t, "ming-luo", input["tenant"])
+	equals(t, map[string]interface{}{"ming-luo-client-1234": []interface{}{"ming-luo-client", "ming-luo"}}, input["subjectTenants"])
+
+	req.Resource = "admin"
+	equals(t, Decision{Role: "opa", Reason: "admin is closed"}, e.Authorize(context.Background(), req))
+	req.Resource = "secrets"
+	assert(t, !e.Authorize(context.Background(), req).Allowed, "undefined result is denied")
+
+	e, err = NewEngine(util.RBAC{Engine: "opa", OPAURL: "http://127.0.0.1:1/v1/data/burnell/allow"})
+	errNil(t, err)
+	assert(t, !e.Authorize(context.Background(), req).Allowed, "unreachable OPA is denied")
+}
+
+func TestRBACMiddleware(t *testing.T) {
+	publicKey, superRoles := util.Config.PulsarPublicKey, util.SuperRoles
+	util.Config.PulsarPublicKey, util.SuperRoles = "public-key", []string{"superuser"}
+	defer func() {
+		util.Config.PulsarPublicKey, util.SuperRoles = publicKey, superRoles
+		SetEngine(nil)
+	}()
+	errNil(t, Init(util.RBAC{
+		Roles:    []util.RBACRole{{Name: "auditor", Permissions: []string{"metrics:read", "admin:read"}}},
+		Bindings: []util.RBACBinding{{Role: "auditor", Subjects: []string{"auditor-*"}, Tenants: []string{TenantAny}}},
+	}))
+
+	keys := map[string]string{}
+	for _, subject := range []string{"auditor-1", "ming-luo-client-1234"} {
+		keyStr, key, err := util.NewAPIKey("public", subject)
+		errNil(t, err)
+		util.ApplyAPIKey(key)
+		defer util.ApplyAPIKey(util.APIKey{ID: key.ID, Deleted: true})
+		keys[subject] = keyStr
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	router.Path("/function-metrics/{tenant}").Handler(route.AuthVerifyTenantJWT(ok))
+	router.Path("/function-logs/{tenant}/{namespace}/{function}").Handler(route.AuthVerifyTenantJWT(ok))
+	router.Path("/admin/api-usage").Handler(route.SuperRoleRequired(ok))
+	router.Path("/k/tenant/{tenant}/overrides").Handler(route.SuperRoleRequired(ok))
+	status := func(method, path, subject string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(util.APIKeyHeader, keys[subject])
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	equals(t, http.StatusOK, status(http.MethodGet, "/function-metrics/ming-luo", "auditor-1"))
+	equals(t, http.StatusUnauthorized, status(http.MethodGet, "/function-logs/ming-luo/ns/fn", "auditor-1"))
+	equals(t, http.StatusOK, status(http.MethodGet, "/admin/api-usage", "auditor-1"))
+	equals(t, http.StatusUnauthorized, status(http.MethodDelete, "/admin/api-usage", "auditor-1"))
+
+	equals(t, http.StatusOK, status(http.MethodGet, "/function-logs/ming-luo/ns/fn", "ming-luo-client-1234"))
+	equals(t, http.StatusUnauthorized, status(http.MethodGet, "/function-metrics/other", "ming-luo-client-1234"))
+	// a super role route is a cluster resource even with a tenant in the path
+	equals(t, http.StatusUnauthorized, status(http.MethodPut, "/k/tenant/ming-luo/overrides", "ming-luo-client-1234"))
+}
+
+func TestRoutePermissions(t *testing.T) {
+	p, err := route.ParseRoutePermission("tenant:read-metrics", route.TenantFromPath)
+	errNil(t, err)
+	equals(t, route.RoutePermission{Scope: route.ScopeTenant, Action: ActionRead, Resource: "metrics", Tenant: route.TenantFromPath}, p)
+	equals(t, "tenant:read-metrics", p.String())
+	// the action is derived from the method when omitted
+	p, err = route.ParseRoutePermission("superuser:pulsar-admin", route.TenantNone)
+	errNil(t, err)
+	equals(t, "", p.Action)
+	equals(t, "pulsar-admin", p.Resource)
+
+	for _, invalid := range []struct {
+		declaration string
+		tenant      route.TenantStrategy
+	}{
+		{"read-metrics", route.TenantNone},
+		{"tenant:", route.TenantFromPath},
+		{"owner:read-metrics", route.TenantNone},
+		{"tenant:read-metrics", route.TenantNone},
+		{"superuser:write-policy", route.TenantFromPath},
+	} {
+		_, err := route.ParseRoutePermission(invalid.declaration, invalid.tenant)
+		assert(t, err != nil, "expected an error of the declaration "+invalid.declaration)
+	}
+
+	publicKey, superRoles := util.Config.PulsarPublicKey, util.SuperRoles
+	util.Config.PulsarPublicKey, util.SuperRoles = "public-key", []string{"superuser"}
+	defer func() {
+		util.Config.PulsarPublicKey, util.SuperRoles = publicKey, superRoles
+		SetEngine(nil)
+	}()
+	errNil(t, Init(util.RBAC{
+		Roles: []util.RBACRole{{Name: RoleTenantOwner, Permissions: []string{"stats:read", "pulsar-admin:read"}}},
+	}))
+
+	keyStr, key, err := util.NewAPIKey("public", "ming-luo-client-1234")
+	errNil(t, err)
+	util.ApplyAPIKey(key)
+	defer util.ApplyAPIKey(util.APIKey{ID: key.ID, Deleted: true})
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	router.Path("/health").Methods(http.MethodGet).Handler(route.Require("public:read-health", route.TenantNone, ok))
+	router.Path("/stats/{tenant}").Methods(http.MethodGet).Handler(route.Require("tenant:read-stats", route.TenantFromPath, ok))
+	router.Path("/metrics/top").Methods(http.MethodGet).Handler(route.Require("tenant:read-metrics", route.TenantFromSubject, ok))
+	router.PathPrefix("/admin/v2/namespaces/{tenant}").Methods(http.MethodGet, http.MethodPut).
+		Handler(route.Require("tenant:pulsar-admin", route.TenantFromPath, ok))
+	router.Path("/admin/config").Methods(http.MethodGet).Handler(route.Require("superuser:read-admin", route.TenantNone, ok))
+	router.PathPrefix("/ws/").Handler(ok)
+	status := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(util.APIKeyHeader, keyStr)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	equals(t, http.StatusOK, status(http.MethodGet, "/health"))
+	equals(t, http.StatusOK, status(http.MethodGet, "/stats/ming-luo"))
+	equals(t, http.StatusUnauthorized, status(http.MethodGet, "/stats/other"))
+	// the subject strategy authorizes on the tenants owned by the subject
+	equals(t, http.StatusUnauthorized, status(http.MethodGet, "/metrics/top"))
+	equals(t, http.StatusOK, status(http.MethodGet, "/admin/v2/namespaces/ming-luo/ns"))
+	equals(t, http.StatusUnauthorized, status(http.MethodPut, "/admin/v2/namespaces/ming-luo/ns"))
+	equals(t, http.StatusUnauthorized, status(http.MethodGet, "/admin/config"))
+
+	matrix := route.PermissionMatrix(router)
+	equals(t, 7, len(matrix))
+	equals(t, route.PermissionEntry{Path: "/health", Method: http.MethodGet, Scope: route.ScopePublic, Permission: "health:read"}, matrix[0])
+	equals(t, "subject", matrix[2].Tenant)
+	equals(t, []string{RoleSuperuser}, matrix[2].Roles)
+	equals(t, true, matrix[3].Prefix)
+	equals(t, "pulsar-admin:read", matrix[3].Permission)
+	equals(t, []string{RoleSuperuser, RoleTenantOwner}, matrix[3].Roles)
+	equals(t, "pulsar-admin:write", matrix[4].Permission)
+	equals(t, []string{RoleSuperuser}, matrix[4].Roles)
+	equals(t, "", matrix[5].Tenant)
+	equals(t, route.PermissionEntry{Path: "/ws/", Prefix: true, Method: "*", Scope: route.ScopeUndeclared}, matrix[6])
+}
+
+func TestImpersonation(t *testing.T) {
+	publicKey, superRoles := util.Config.PulsarPublicKey, util.SuperRoles
+	util.Config.PulsarPublicKey, util.SuperRoles = "public-key", []string{"superuser"}
+	defer func() {
+		util.Config.PulsarPublicKey, util.SuperRoles = publicKey, superRoles
+		util.SetFeatureGates("")
+		SetEngine(nil)
+	}()
+	errNil(t, Init(util.RBAC{
+		Roles:    []util.RBACRole{{Name: "support", Permissions: []string{"impersonation:read"}}},
+		Bindings: []util.RBACBinding{{Role: "support", Subjects: []string{"support-*"}, Tenants: []string{TenantAny}}},
+	}))
+	sink := &memorySink{}
+	audit.AddSink(sink)
+
+	keys := map[string]string{}
+	for _, subject := range []string{"superuser", "support-1", "ming-luo-client-1234"} {
+		keyStr, key, err := util.NewAPIKey("public", subject)
+		errNil(t, err)
+		util.ApplyAPIKey(key)
+		defer util.ApplyAPIKey(util.APIKey{ID: key.ID, Deleted: true})
+		keys[subject] = keyStr
+	}
+
+	view := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("injectedSubs") + r.Header.Get(route.ImpersonateHeader)))
+	})
+	router := mux.NewRouter()
+	router.Path("/metrics/top").Handler(route.Require("tenant:metrics", route.TenantFromSubject, view))
+	router.Path("/stats/{tenant}").Handler(route.Require("tenant:stats", route.TenantFromPath, view))
+	send := func(method, path, subject, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(util.APIKeyHeader, keys[subject])
+		req.Header.Set(route.ImpersonateHeader, target)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	equals(t, http.StatusForbidden, send(http.MethodGet, "/metrics/top", "superuser", "ming-luo-client-1234").Code)
+	errNil(t, util.SetFeatureGates("Impersonation=true"))
+
+	rr := send(http.MethodGet, "/metrics/top", "superuser", "ming-luo-client-1234")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "ming-luo-client-1234", rr.Body.String())
+	equals(t, "superuser", rr.Header().Get(route.ImpersonatedByHeader))
+	// the impersonated subject is authorized rather than the impersonator
+	equals(t, http.StatusUnauthorized, send(http.MethodGet, "/stats/other", "superuser", "ming-luo-client-1234").Code)
+	equals(t, http.StatusOK, send(http.MethodGet, "/stats/ming-luo", "support-1", "ming-luo-client-1234").Code)
+
+	equals(t, http.StatusForbidden, send(http.MethodPost, "/stats/ming-luo", "superuser", "ming-luo-client-1234").Code)
+	equals(t, http.StatusForbidden, send(http.MethodGet, "/stats/ming-luo", "ming-luo-client-1234", "ming-luo-admin-1").Code)
+	equals(t, http.StatusForbidden, send(http.MethodGet, "/metrics/top", "support-1", "superuser").Code)
+	equals(t, http.StatusForbidden, send(http.MethodGet, "/metrics/top", "support-1", "a,b").Code)
+
+	events := []audit.Event{}
+	for _, e := range sink.events {
+		if e.Action == "impersonate" {
+			events = append(events, e)
+		}
+	}
+	equals(t, 8, len(events))
+	equals(t, audit.Denied, events[0].Outcome)
+	equals(t, "impersonation is disabled", events[0].Reason)
+	equals(t, audit.Event{Time: events[1].Time, Subject: "superuser", OnBehalfOf: "ming-luo-client-1234", Tenant: "ming-luo",
+		Action: "impersonate", Resource: "GET /metrics/top", Outcome: audit.Allowed, RemoteAddr: "192.0.2.1:1234"}, events[1])
+	equals(t, "support-1", events[3].Subject)
+	equals(t, "impersonation is read only", events[4].Reason)
+}
@@ -0,0 +1,89 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	. "github.com/datastax/burnell/src/schema"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const userSchema = `{"type":"record","name":"User","fields":[{"name":"name","type":"string"},{"name":"age","type":"int"}]}`
+
+func TestSchemaValidation(t *testing.T) {
+	errNil(t, Validate(Payload{Type: "AVRO", Schema: userSchema}))
+	errNil(t, Validate(Payload{Type: "JSON", Schema: userSchema}))
+	errNil(t, Validate(Payload{Type: "STRING"}))
+
+	err := Validate(Payload{Type: "AVRO", Schema: `{"type":"record","name":"User","fields":[{"name":"age","type":"integer"}]}`})
+	assert(t, err != nil && strings.Contains(err.Error(), "not a valid Avro schema"), "unknown avro type")
+	err = Validate(Payload{Type: "AVRO"})
+	assert(t, err != nil && strings.Contains(err.Error(), "empty"), "missing definition")
+	err = Validate(Payload{Type: "XML", Schema: "<user/>"})
+	assert(t, err != nil && strings.Contains(err.Error(), "unsupported schema type"), "unknown schema type")
+
+	fds, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:        proto.String("user.proto"),
+		Package:     proto.String("example"),
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("User")}},
+	}}})
+	errNil(t, err)
+	encoded := base64.StdEncoding.EncodeToString(fds)
+	errNil(t, Validate(Payload{Type: "PROTOBUF_NATIVE", Schema: `{"fileDescriptorSet":"` + encoded +
+		`","rootMessageTypeName":"example.User","rootFileDescriptorName":"user.proto"}`}))
+	err = Validate(Payload{Type: "PROTOBUF_NATIVE", Schema: `{"fileDescriptorSet":"` + encoded +
+		`","rootMessageTypeName":"example.Order","rootFileDescriptorName":"user.proto"}`})
+	assert(t, err != nil && strings.Contains(err.Error(), "example.Order is not found"), "missing root message")
+}
+
+func TestSchemaCompatibility(t *testing.T) {
+	latest := Payload{Type: "AVRO", Schema: userSchema}
+	addedWithDefault := Payload{Type: "AVRO", Schema: `{"type":"record","name":"User","fields":[{"name":"name","type":"string"},{"name":"age","type":"int"},{"name":"email","type":["null","string"],"default":null}]}`}
+	addedNoDefault := Payload{Type: "AVRO", Schema: `{"type":"record","name":"User","fields":[{"name":"name","type":"string"},{"name":"age","type":"int"},{"name":"email","type":"string"}]}`}
+	removed := Payload{Type: "AVRO", Schema: `{"type":"record","name":"User","fields":[{"name":"name","type":"string"}]}`}
+	promoted := Payload{Type: "AVRO", Schema: `{"type":"record","name":"User","fields":[{"name":"name","type":"string"},{"name":"age","type":"long"}]}`}
+
+	errNil(t, Compatible(latest, latest, Full))
+	errNil(t, Compatible(latest, addedWithDefault, Full))
+	errNil(t, Compatible(latest, addedWithDefault, ""))
+
+	err := Compatible(latest, addedNoDefault, Backward)
+	assert(t, err != nil && strings.Contains(err.Error(), "field email is added without a default value"), "backward requires defaults")
+	errNil(t, Compatible(latest, addedNoDefault, Forward))
+
+	err = Compatible(latest, removed, "FORWARD_TRANSITIVE")
+	assert(t, err != nil && strings.Contains(err.Error(), "field age is removed"), "forward requires a default of the removed field")
+	errNil(t, Compatible(latest, removed, Backward))
+
+	errNil(t, Compatible(latest, promoted, Backward))
+	err = Compatible(latest, promoted, Full)
+	assert(t, err != nil && strings.Contains(err.Error(), "changes type"), "long cannot be read as int")
+
+	err = Compatible(latest, Payload{Type: "JSON", Schema: userSchema}, Backward)
+	assert(t, err != nil && strings.Contains(err.Error(), "type change"), "type change")
+	errNil(t, Compatible(latest, removed, AlwaysCompatible))
+	assert(t, Compatible(latest, addedWithDefault, AlwaysIncompatible) != nil, "always incompatible")
+}
@@ -0,0 +1,181 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// API keys, the opaque credentials alternate to JWT. Only the SHA-256 digest of a key secret is stored.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyHeader is the request header of an API key, a key is also accepted as the bearer token
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix identifies an API key among the bearer tokens, the format is bnl_{id}_{secret}
+const apiKeyPrefix = "bnl_"
+
+// ErrInvalidAPIKey is the error of an unknown, revoked, expired, or malformed API key
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey is the stored record of an API key mapped to a subject.
+// A key with namespaces is restricted to them and to the permissions in the same way as a delegated token.
+type APIKey struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant"`
+	Subject     string    `json:"subject"`
+	Name        string    `json:"name,omitempty"`
+	Namespaces  []string  `json:"namespaces,omitempty"`
+	Permissions []string  `json:"permissions,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// ExpiresAt is zero if the key does not expire
+	ExpiresAt time.Time `json:"expiresAt"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+var apiKeys = struct {
+	sync.RWMutex
+	keys map[string]APIKey
+}{keys: map[string]APIKey{}}
+
+// IsAPIKey checks if a credential is in the format of an API key rather than a JWT
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// NewAPIKey generates the key string and the record of a new API key, the key string is never stored
+func NewAPIKey(tenant, subject string) (string, APIKey, error) {
+	id, secret := make([]byte, 8), make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Tenant:    tenant,
+		Subject:   subject,
+		CreatedAt: time.Now(),
+	}
+	secretStr := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = apiKeyHash(secretStr)
+	return apiKeyPrefix + key.ID + "_" + secretStr, key, nil
+}
+
+func apiKeyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ApplyAPIKey adds, replaces, or removes a deleted API key in the local registry
+func ApplyAPIKey(key APIKey) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+	if key.Deleted {
+		delete(apiKeys.keys, key.ID)
+	} else {
+		apiKeys.keys[key.ID] = key
+	}
+}
+
+// ResolveAPIKey verifies an API key string and returns its record
+func ResolveAPIKey(keyStr string) (APIKey, error) {
+	if !IsAPIKey(keyStr) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	parts := strings.SplitN(strings.TrimPrefix(keyStr, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	apiKeys.RLock()
+	key, ok := apiKeys.keys[parts[0]]
+	apiKeys.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(apiKeyHash(parts[1]))) != 1 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	return key, nil
+}
+
+// GetAPIKey returns the record of an API key without the digest
+func GetAPIKey(id string) (APIKey, bool) {
+	apiKeys.RLock()
+	key, ok := apiKeys.keys[id]
+	apiKeys.RUnlock()
+	key.Hash = ""
+	return key, ok
+}
+
+// ListAllAPIKeys returns the API keys of all tenants without the digests
+func ListAllAPIKeys() []APIKey {
+	apiKeys.RLock()
+	defer apiKeys.RUnlock()
+	list := make([]APIKey, 0, len(apiKeys.keys))
+	for _, key := range apiKeys.keys {
+		key.Hash = ""
+		list = append(list, key)
+	}
+	return list
+}
+
+// SnapshotAPIKeys returns the API keys of all tenants with the digests, for the policy store snapshot
+func SnapshotAPIKeys() []APIKey {
+	apiKeys.RLock()
+	defer apiKeys.RUnlock()
+	list := make([]APIKey, 0, len(apiKeys.keys))
+	for _, key := range apiKeys.keys {
+		list = append(list, key)
+	}
+	return list
+}
+
+// ListAPIKeys returns the API keys of a tenant without the digests, sorted by the creation time
+func ListAPIKeys(tenant string) []APIKey {
+	apiKeys.RLock()
+	list := []APIKey{}
+	for _, key := range apiKeys.keys {
+		if key.Tenant == tenant {
+			key.Hash = ""
+			list = append(list, key)
+		}
+	}
+	apiKeys.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,301 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Per subject API usage analytics, the requests are aggregated by subject and route class into daily summaries
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the subjects of the unauthenticated requests and of the requests over the subject limit of a day
+const (
+	APIAnonymousSubject = "anonymous"
+	APIOtherSubject     = "_other"
+)
+
+// apiRateMinutes is the window of the request rate of the top talkers
+const apiRateMinutes = 5
+
+// APIClassUsage is the request counters of a route class
+type APIClassUsage struct {
+	Requests int64 `json:"requests"`
+	// Errors are the requests with a 5xx status
+	Errors int64 `json:"errors"`
+	// Denied are the requests rejected with a 401, 403, or 429 status
+	Denied int64 `json:"denied"`
+	// LatencyMs is the total latency of the requests
+	LatencyMs int64 `json:"latencyMs"`
+}
+
+// APISubjectUsage is the daily summary of a subject
+type APISubjectUsage struct {
+	Date          string                   `json:"date"`
+	Subject       string                   `json:"subject"`
+	Requests      int64                    `json:"requests"`
+	Errors        int64                    `json:"errors"`
+	Denied        int64                    `json:"denied"`
+	PeakPerMinute int64                    `json:"peakPerMinute"`
+	Classes       map[string]APIClassUsage `json:"classes"`
+}
+
+// APITalker is the request rate of a subject over the last five minutes
+type APITalker struct {
+	Subject       string  `json:"subject"`
+	Requests      int64   `json:"requests"`
+	RatePerSecond float64 `json:"ratePerSecond"`
+}
+
+type apiSubjectDay struct {
+	classes map[string]*APIClassUsage
+	peak    int64
+}
+
+type apiRate struct {
+	buckets [apiRateMinutes]struct{ minute, count int64 }
+	last    int64
+}
+
+var (
+	apiUsageLock   = sync.Mutex{}
+	apiUsageDays   = make(map[string]map[string]*apiSubjectDay)
+	apiUsageRates  = make(map[string]*apiRate)
+	apiClassTotals = make(map[string]*APIClassUsage)
+
+	// APIUsageNow is the clock of the API usage analytics, it can be replaced in tests
+	APIUsageNow = time.Now
+)
+
+func apiUsageSettings() (retention, maxSubjects int) {
+	cfg := GetConfig().APIUsage
+	retention, maxSubjects = cfg.RetentionDays, cfg.MaxSubjectsPerDay
+	if retention <= 0 {
+		retention = 7
+	}
+	if maxSubjects <= 0 {
+		maxSubjects = 10000
+	}
+	return retention, maxSubjects
+}
+
+// APITopTalkers returns the configured number of the top talkers
+func APITopTalkers() int {
+	if n := GetConfig().APIUsage.TopTalkers; n > 0 {
+		return n
+	}
+	return 10
+}
+
+// apiRouteClass classifies a route by the configured route prefixes, or by the first segment of its path template
+func apiRouteClass(route string, matched bool, classes map[string][]string) string {
+	if !matched {
+		return "unmatched"
+	}
+	class, matchedPrefix := "", ""
+	for c, prefixes := range classes {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(route, prefix) &&
+				(len(prefix) > len(matchedPrefix) || (len(prefix) == len(matchedPrefix) && c < class)) {
+				class, matchedPrefix = c, prefix
+			}
+		}
+	}
+	if class != "" {
+		return class
+	}
+	segment := strings.SplitN(strings.TrimPrefix(route, "/"), "/", 2)[0]
+	if segment == "" || strings.HasPrefix(segment, "{") {
+		return "other"
+	}
+	return segment
+}
+
+// recordAPIUsage counts a request against its subject and route class
+func recordAPIUsage(o RequestObservation) {
+	retention, maxSubjects := apiUsageSettings()
+	class := apiRouteClass(o.Route, o.Matched, GetConfig().APIUsage.RouteClasses)
+	subject := o.Subject
+	if subject == "" {
+		subject = APIAnonymousSubject
+	}
+	now := APIUsageNow().UTC()
+	date, minute := now.Format("2006-01-02"), now.Unix()/60
+
+	apiUsageLock.Lock()
+	defer apiUsageLock.Unlock()
+	day, ok := apiUsageDays[date]
+	if !ok {
+		day = make(map[string]*apiSubjectDay)
+		apiUsageDays[date] = day
+		pruneAPIUsage(now, retention, minute)
+	}
+	usage, ok := day[subject]
+	if !ok {
+		if len(day) >= maxSubjects {
+			subject = APIOtherSubject
+			usage = day[subject]
+		}
+		if usage == nil {
+			usage = &apiSubjectDay{classes: make(map[string]*APIClassUsage)}
+			day[subject] = usage
+		}
+	}
+	for _, counters := range []map[string]*APIClassUsage{usage.classes, apiClassTotals} {
+		c, ok := counters[class]
+		if !ok {
+			c = &APIClassUsage{}
+			counters[class] = c
+		}
+		c.add(o)
+	}
+
+	rate, ok := apiUsageRates[subject]
+	if !ok {
+		rate = &apiRate{}
+		apiUsageRates[subject] = rate
+	}
+	b := &rate.buckets[minute%apiRateMinutes]
+	if b.minute != minute {
+		b.minute, b.count = minute, 0
+	}
+	b.count++
+	rate.last = minute
+	if b.count > usage.peak {
+		usage.peak = b.count
+	}
+}
+
+func (c *APIClassUsage) add(o RequestObservation) {
+	c.Requests++
+	if o.Status >= 500 {
+		c.Errors++
+	}
+	if o.Status == 401 || o.Status == 403 || o.Status == 429 {
+		c.Denied++
+	}
+	c.LatencyMs += o.Duration.Milliseconds()
+}
+
+// pruneAPIUsage drops the days out of the retention, and the rates of the subjects idle over the rate window
+func pruneAPIUsage(now time.Time, retention int, minute int64) {
+	oldest := now.AddDate(0, 0, 1-retention).Format("2006-01-02")
+	for date := range apiUsageDays {
+		if date < oldest {
+			delete(apiUsageDays, date)
+		}
+	}
+	for subject, rate := range apiUsageRates {
+		if minute-rate.last >= apiRateMinutes {
+			delete(apiUsageRates, subject)
+		}
+	}
+}
+
+// GetAPIUsage returns the daily summaries between the dates, inclusive in the format of 2006-01-02.
+// An empty date is unbounded and an empty subject matches all the subjects.
+// The summaries are sorted by the date, then by the number of requests in descending order.
+func GetAPIUsage(from, to, subject string) []APISubjectUsage {
+	apiUsageLock.Lock()
+	summaries := []APISubjectUsage{}
+	for date, day := range apiUsageDays {
+		if (from != "" && date < from) || (to != "" && date > to) {
+			continue
+		}
+		for sub, usage := range day {
+			if subject != "" && sub != subject {
+				continue
+			}
+			s := APISubjectUsage{Date: date, Subject: sub, PeakPerMinute: usage.peak,
+				Classes: make(map[string]APIClassUsage, len(usage.classes))}
+			for class, c := range usage.classes {
+				s.Classes[class] = *c
+				s.Requests += c.Requests
+				s.Errors += c.Errors
+				s.Denied += c.Denied
+			}
+			summaries = append(summaries, s)
+		}
+	}
+	apiUsageLock.Unlock()
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Date != summaries[j].Date {
+			return summaries[i].Date < summaries[j].Date
+		}
+		if summaries[i].Requests != summaries[j].Requests {
+			return summaries[i].Requests > summaries[j].Requests
+		}
+		return summaries[i].Subject < summaries[j].Subject
+	})
+	return summaries
+}
+
+// GetAPITopTalkers returns up to n subjects with the highest request rate over the last five minutes
+func GetAPITopTalkers(n int) []APITalker {
+	minute := APIUsageNow().Unix() / 60
+	apiUsageLock.Lock()
+	talkers := []APITalker{}
+	for subject, rate := range apiUsageRates {
+		var requests int64
+		for _, b := range rate.buckets {
+			if minute-b.minute < apiRateMinutes && b.minute <= minute {
+				requests += b.count
+			}
+		}
+		if requests > 0 {
+			talkers = append(talkers, APITalker{Subject: subject, Requests: requests,
+				RatePerSecond: float64(requests) / (apiRateMinutes * 60)})
+		}
+	}
+	apiUsageLock.Unlock()
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].Requests != talkers[j].Requests {
+			return talkers[i].Requests > talkers[j].Requests
+		}
+		return talkers[i].Subject < talkers[j].Subject
+	})
+	if n > 0 && len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers
+}
+
+// GetAPIClassTotals returns the cumulative counters per route class since the start
+func GetAPIClassTotals() map[string]APIClassUsage {
+	apiUsageLock.Lock()
+	defer apiUsageLock.Unlock()
+	totals := make(map[string]APIClassUsage, len(apiClassTotals))
+	for class, c := range apiClassTotals {
+		totals[class] = *c
+	}
+	return totals
+}
+
+// ResetAPIUsage drops the daily summaries and the request rates
+func ResetAPIUsage() {
+	apiUsageLock.Lock()
+	apiUsageDays = make(map[string]map[string]*apiSubjectDay)
+	apiUsageRates = make(map[string]*apiRate)
+	apiUsageLock.Unlock()
+}
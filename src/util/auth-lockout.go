@@ -0,0 +1,251 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Temporary bans of the source IPs and the subjects with repeated token validation failures,
+// a banned request is rejected before the token signature is verified
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the kinds of banned keys
+const (
+	AuthBanIP      = "ip"
+	AuthBanSubject = "subject"
+)
+
+const maxAuthFailureKeys = 100000
+
+// AuthBan is a banned source IP or subject
+type AuthBan struct {
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// AuthLockoutStats are the counters of the auth lockout
+type AuthLockoutStats struct {
+	Failures   int64 `json:"failures"`
+	Bans       int64 `json:"bans"`
+	Rejections int64 `json:"rejections"`
+	Banned     int   `json:"banned"`
+}
+
+type authFailures struct {
+	count       int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+var (
+	authFailuresLock = sync.Mutex{}
+	authFailureKeys  = make(map[string]*authFailures)
+
+	authFailureCount   int64
+	authBanCount       int64
+	authRejectionCount int64
+
+	// AuthLockoutNow is the clock of the auth lockout, it can be replaced in tests
+	AuthLockoutNow = time.Now
+)
+
+func authLockoutSettings() (perIP, perSubject int, window, ban time.Duration) {
+	cfg := GetConfig().AuthLockout
+	perIP, perSubject = cfg.FailuresPerIP, cfg.FailuresPerSubject
+	if perIP == 0 {
+		perIP = 20
+	}
+	window = time.Duration(cfg.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	ban = time.Duration(cfg.BanSeconds) * time.Second
+	if ban <= 0 {
+		ban = 15 * time.Minute
+	}
+	return perIP, perSubject, window, ban
+}
+
+// IsTrustedProxy checks the IP against the TrustedProxies
+func IsTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range GetConfig().TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if proxyAddr := net.ParseIP(proxy); proxyAddr != nil && proxyAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthBanned checks the source IP and the subject against the bans, it returns the time left of a ban
+func AuthBanned(ip, subject string) (time.Duration, bool) {
+	now := AuthLockoutNow()
+	authFailuresLock.Lock()
+	defer authFailuresLock.Unlock()
+	for _, key := range authKeys(ip, subject) {
+		if f, ok := authFailureKeys[key]; ok && now.Before(f.bannedUntil) {
+			atomic.AddInt64(&authRejectionCount, 1)
+			return f.bannedUntil.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// RecordAuthFailure counts a failed token validation of the source IP and the subject claimed by the token,
+// a key reaching its threshold within the window is banned
+func RecordAuthFailure(ip, subject string) {
+	perIP, perSubject, window, ban := authLockoutSettings()
+	now := AuthLockoutNow()
+	atomic.AddInt64(&authFailureCount, 1)
+	authFailuresLock.Lock()
+	defer authFailuresLock.Unlock()
+	if len(authFailureKeys) >= maxAuthFailureKeys {
+		evictAuthFailures(now, window)
+	}
+	for _, key := range authKeys(ip, subject) {
+		threshold := perIP
+		if strings.HasPrefix(key, AuthBanSubject+":") {
+			threshold = perSubject
+		}
+		if threshold <= 0 {
+			continue
+		}
+		f, ok := authFailureKeys[key]
+		if !ok || now.Sub(f.windowStart) >= window {
+			f = &authFailures{windowStart: now, bannedUntil: bannedUntil(f)}
+			authFailureKeys[key] = f
+		}
+		f.count++
+		if f.count >= threshold && !now.Before(f.bannedUntil) {
+			f.bannedUntil = now.Add(ban)
+			atomic.AddInt64(&authBanCount, 1)
+		}
+	}
+}
+
+func bannedUntil(f *authFailures) time.Time {
+	if f == nil {
+		return time.Time{}
+	}
+	return f.bannedUntil
+}
+
+func authKeys(ip, subject string) []string {
+	keys := make([]string, 0, 2)
+	if ip != "" {
+		keys = append(keys, AuthBanIP+":"+ip)
+	}
+	if subject != "" {
+		keys = append(keys, AuthBanSubject+":"+subject)
+	}
+	return keys
+}
+
+// evictAuthFailures drops the keys out of their window and ban, then the failures of the keys
+// within their window if it is still full. The active bans are never dropped.
+func evictAuthFailures(now time.Time, window time.Duration) {
+	for key, f := range authFailureKeys {
+		if now.Sub(f.windowStart) >= window && !now.Before(f.bannedUntil) {
+			delete(authFailureKeys, key)
+		}
+	}
+	if len(authFailureKeys) < maxAuthFailureKeys {
+		return
+	}
+	for key, f := range authFailureKeys {
+		if !now.Before(f.bannedUntil) {
+			delete(authFailureKeys, key)
+		}
+	}
+}
+
+// GetAuthBans returns the active bans sorted by the kind and the value
+func GetAuthBans() []AuthBan {
+	now := AuthLockoutNow()
+	authFailuresLock.Lock()
+	bans := []AuthBan{}
+	for key, f := range authFailureKeys {
+		if now.Before(f.bannedUntil) {
+			kind, value := splitAuthKey(key)
+			bans = append(bans, AuthBan{Kind: kind, Value: value, Failures: f.count, Until: f.bannedUntil})
+		}
+	}
+	authFailuresLock.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Kind != bans[j].Kind {
+			return bans[i].Kind < bans[j].Kind
+		}
+		return bans[i].Value < bans[j].Value
+	})
+	return bans
+}
+
+// ClearAuthBan lifts the ban and resets the failures of a key, an empty kind clears all the keys.
+// It returns the number of cleared keys.
+func ClearAuthBan(kind, value string) int {
+	authFailuresLock.Lock()
+	defer authFailuresLock.Unlock()
+	if kind == "" {
+		n := len(authFailureKeys)
+		authFailureKeys = make(map[string]*authFailures)
+		return n
+	}
+	key := kind + ":" + value
+	if _, ok := authFailureKeys[key]; !ok {
+		return 0
+	}
+	delete(authFailureKeys, key)
+	return 1
+}
+
+func splitAuthKey(key string) (string, string) {
+	if i := strings.IndexByte(key, ':'); i > 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// GetAuthLockoutStats returns the counters of the auth lockout
+func GetAuthLockoutStats() AuthLockoutStats {
+	stats := AuthLockoutStats{
+		Failures:   atomic.LoadInt64(&authFailureCount),
+		Bans:       atomic.LoadInt64(&authBanCount),
+		Rejections: atomic.LoadInt64(&authRejectionCount),
+	}
+	stats.Banned = len(GetAuthBans())
+	return stats
+}
@@ -0,0 +1,114 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// HTTP basic-auth of the username and password pairs mapped to the subjects. The passwords are bcrypt hashes,
+// a verified pair is cached to spare the bcrypt cost on every scrape of a monitoring tool.
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidBasicAuth is the error of an unknown username or a wrong password
+var ErrInvalidBasicAuth = errors.New("invalid username or password")
+
+// DefaultBasicAuthResources are the resources accepting basic-auth, the tenant metrics
+var DefaultBasicAuthResources = []string{"metrics"}
+
+// basicAuthCacheTTL is how long a verified pair is accepted without the bcrypt comparison
+const basicAuthCacheTTL = 5 * time.Minute
+
+var basicAuthCache = struct {
+	sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}{verified: map[[sha256.Size]byte]time.Time{}}
+
+// BasicAuthNow is the clock of the verification cache
+var BasicAuthNow = time.Now
+
+// ValidateBasicAuth checks every user has a username, a subject, and a bcrypt password hash
+func ValidateBasicAuth(cfg BasicAuth) error {
+	usernames := map[string]bool{}
+	for _, user := range cfg.Users {
+		if user.Username == "" || user.Subject == "" {
+			return fmt.Errorf("basic-auth user requires the username and the subject")
+		}
+		if usernames[user.Username] {
+			return fmt.Errorf("basic-auth user %s is duplicated", user.Username)
+		}
+		usernames[user.Username] = true
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("basic-auth user %s password hash is not bcrypt %v", user.Username, err)
+		}
+	}
+	return nil
+}
+
+// BasicAuthAccepts checks if basic-auth is enabled on the resource
+func BasicAuthAccepts(resource string) bool {
+	cfg := GetConfig().BasicAuth
+	if len(cfg.Users) == 0 {
+		return false
+	}
+	resources := cfg.Resources
+	if len(resources) == 0 {
+		resources = DefaultBasicAuthResources
+	}
+	return StrContains(resources, resource)
+}
+
+// VerifyBasicAuth returns the subject of a username and password pair
+func VerifyBasicAuth(username, password string) (string, error) {
+	for _, user := range GetConfig().BasicAuth.Users {
+		if user.Username != username {
+			continue
+		}
+		// the hash is part of the key so that a rotated password invalidates the cached pair
+		key := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + user.PasswordHash))
+		now := BasicAuthNow()
+		basicAuthCache.Lock()
+		expiry, ok := basicAuthCache.verified[key]
+		basicAuthCache.Unlock()
+		if ok && now.Before(expiry) {
+			return user.Subject, nil
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+			return "", ErrInvalidBasicAuth
+		}
+		basicAuthCache.Lock()
+		for k, exp := range basicAuthCache.verified {
+			if !now.Before(exp) {
+				delete(basicAuthCache.verified, k)
+			}
+		}
+		basicAuthCache.verified[key] = now.Add(basicAuthCacheTTL)
+		basicAuthCache.Unlock()
+		return user.Subject, nil
+	}
+	return "", ErrInvalidBasicAuth
+}
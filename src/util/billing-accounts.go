@@ -0,0 +1,98 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Billing accounts map the tenants to the customers and the subscription items of a billing system
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BillingMetrics are the usage metrics reported to the subscription items, in whole units
+var BillingMetrics = []string{"bytes_in_gb", "bytes_out_gb", "transfer_gb", "storage_gb_hours", "peak_topics"}
+
+// BillingAccount is the customer of a tenant and the subscription item of each billing metric
+type BillingAccount struct {
+	Tenant    string            `json:"tenant"`
+	Customer  string            `json:"customer"`
+	Items     map[string]string `json:"items"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Deleted   bool              `json:"deleted,omitempty"`
+}
+
+var billingAccounts = struct {
+	sync.RWMutex
+	tenants map[string]BillingAccount
+}{tenants: map[string]BillingAccount{}}
+
+// Validate checks the customer and the metrics of the subscription items
+func (a BillingAccount) Validate() error {
+	if a.Customer == "" {
+		return fmt.Errorf("customer is required")
+	}
+	if len(a.Items) == 0 {
+		return fmt.Errorf("at least one subscription item is required")
+	}
+	for metric, item := range a.Items {
+		if !StrContains(BillingMetrics, metric) {
+			return fmt.Errorf("unsupported billing metric %s, the metrics are %v", metric, BillingMetrics)
+		}
+		if item == "" {
+			return fmt.Errorf("subscription item of metric %s is required", metric)
+		}
+	}
+	return nil
+}
+
+// ApplyBillingAccount applies an account read from the policy backend, a deleted account is removed
+func ApplyBillingAccount(a BillingAccount) {
+	billingAccounts.Lock()
+	defer billingAccounts.Unlock()
+	if a.Deleted {
+		delete(billingAccounts.tenants, a.Tenant)
+	} else {
+		billingAccounts.tenants[a.Tenant] = a
+	}
+}
+
+// GetBillingAccount returns the billing account of a tenant
+func GetBillingAccount(tenant string) (BillingAccount, bool) {
+	billingAccounts.RLock()
+	defer billingAccounts.RUnlock()
+	a, ok := billingAccounts.tenants[tenant]
+	return a, ok
+}
+
+// ListBillingAccounts returns the billing accounts sorted by the tenant
+func ListBillingAccounts() []BillingAccount {
+	billingAccounts.RLock()
+	list := make([]BillingAccount, 0, len(billingAccounts.tenants))
+	for _, a := range billingAccounts.tenants {
+		list = append(list, a)
+	}
+	billingAccounts.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list
+}
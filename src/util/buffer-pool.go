@@ -0,0 +1,71 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Pooled copy buffers of the proxied responses
+
+import (
+	"io"
+	"sync"
+)
+
+const proxyBufferSize = 32 * 1024
+
+var proxyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, proxyBufferSize)
+		return &b
+	},
+}
+
+// proxyBufferPool is the httputil.BufferPool of the reverse proxies backed by the pooled copy buffers
+type proxyBufferPool struct{}
+
+// ProxyBufferPool shares the copy buffers between the reverse proxies and CopyBuffered
+var ProxyBufferPool = proxyBufferPool{}
+
+// Get returns a copy buffer from the pool
+func (proxyBufferPool) Get() []byte {
+	return *proxyBuffers.Get().(*[]byte)
+}
+
+// Put returns a copy buffer to the pool
+func (proxyBufferPool) Put(b []byte) {
+	if cap(b) != proxyBufferSize {
+		return
+	}
+	b = b[:proxyBufferSize]
+	proxyBuffers.Put(&b)
+}
+
+// CopyBuffered streams the reader to the writer with a pooled buffer instead of reading the whole body in memory
+func CopyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := ProxyBufferPool.Get()
+	defer ProxyBufferPool.Put(buf)
+	// a writer implementing io.ReaderFrom, such as a response writer, would bypass the pooled buffer
+	return io.CopyBuffer(writerOnly{dst}, src, buf)
+}
+
+// writerOnly hides the io.ReaderFrom of a writer
+type writerOnly struct {
+	io.Writer
+}
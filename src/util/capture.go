@@ -0,0 +1,218 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Sampled request and response capture for debugging
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCaptureEntries   = 100
+	defaultCaptureBodyBytes = 64 * 1024
+	redacted                = "[REDACTED]"
+)
+
+// sensitiveHeaders are always redacted in the captures
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// sensitiveQueryParams are redacted in the logged and captured request URIs, a browser passes the websocket token
+// as a query parameter
+var sensitiveQueryParams = []string{"token"}
+
+// captureExcludedPrefixes are the routes never captured since their bodies carry tokens or secrets,
+// such as the webhook signing secrets and the connector configs
+var captureExcludedPrefixes = []string{"/subject", "/delegate", "/secrets", "/apikeys", "/session", "/webhooks",
+	"/admin/webhooks", "/admin/v3/sinks", "/admin/v3/sources", "/admin/captures"}
+
+// captureExcludedPaths are the routes with a path parameter before the part that carries the tokens
+var captureExcludedPaths = []*regexp.Regexp{regexp.MustCompile(`^/provisioning/v1/tenants/[^/]+/tokens(/|$)`)}
+
+// CapturedExchange is a captured request and its response
+type CapturedExchange struct {
+	Time            time.Time   `json:"time"`
+	RequestID       string      `json:"requestId"`
+	Subject         string      `json:"subject,omitempty"`
+	Method          string      `json:"method"`
+	URI             string      `json:"uri"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	RequestBody     string      `json:"requestBody,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	ResponseBody    string      `json:"responseBody,omitempty"`
+	// Truncated is true if a body is over the maximum captured size
+	Truncated  bool  `json:"truncated,omitempty"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// CaptureSettings is the runtime capture mode
+type CaptureSettings struct {
+	// SampleRate is the ratio of the requests captured
+	SampleRate float64 `json:"sampleRate"`
+	// Subjects are always captured
+	Subjects []string `json:"subjects"`
+}
+
+var capture = struct {
+	sync.RWMutex
+	settings CaptureSettings
+	entries  []CapturedExchange
+	next     int
+	full     bool
+}{}
+
+// SetCaptureSettings changes the capture mode, a zero value disables the capture
+func SetCaptureSettings(s CaptureSettings) {
+	capture.Lock()
+	capture.settings = s
+	capture.Unlock()
+}
+
+// GetCaptureSettings returns the capture mode
+func GetCaptureSettings() CaptureSettings {
+	capture.RLock()
+	defer capture.RUnlock()
+	return capture.settings
+}
+
+// CaptureBodyLimit is the maximum captured size of a body
+func CaptureBodyLimit() int {
+	if GetConfig().RequestCapture.MaxBodyBytes > 0 {
+		return GetConfig().RequestCapture.MaxBodyBytes
+	}
+	return defaultCaptureBodyBytes
+}
+
+// CaptureCandidate returns whether a request to the path may be captured; sampled is true if it is sampled
+// regardless of the subject, otherwise it is captured only if the subject, known after the authentication, matches.
+func CaptureCandidate(path string) (candidate, sampled bool) {
+	for _, prefix := range captureExcludedPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false, false
+		}
+	}
+	for _, excluded := range captureExcludedPaths {
+		if excluded.MatchString(path) {
+			return false, false
+		}
+	}
+	capture.RLock()
+	defer capture.RUnlock()
+	if capture.settings.SampleRate > 0 && rand.Float64() < capture.settings.SampleRate {
+		return true, true
+	}
+	return len(capture.settings.Subjects) > 0, false
+}
+
+// IsCapturedSubject returns whether the subject is always captured
+func IsCapturedSubject(subject string) bool {
+	capture.RLock()
+	defer capture.RUnlock()
+	return subject != "" && StrContains(capture.settings.Subjects, subject)
+}
+
+// StoreCapture adds an exchange to the ring buffer, the oldest one is evicted once full
+func StoreCapture(e CapturedExchange) {
+	size := GetConfig().RequestCapture.MaxEntries
+	if size <= 0 {
+		size = defaultCaptureEntries
+	}
+	e.RequestHeaders = RedactHeaders(e.RequestHeaders)
+	e.ResponseHeaders = RedactHeaders(e.ResponseHeaders)
+
+	capture.Lock()
+	defer capture.Unlock()
+	if len(capture.entries) != size {
+		// the buffer is reset when resized
+		capture.entries, capture.next, capture.full = make([]CapturedExchange, size), 0, false
+	}
+	capture.entries[capture.next] = e
+	capture.next = (capture.next + 1) % size
+	capture.full = capture.full || capture.next == 0
+}
+
+// GetCaptures returns the captured exchanges from the newest, optionally of a subject only
+func GetCaptures(subject string) []CapturedExchange {
+	capture.RLock()
+	defer capture.RUnlock()
+	n := capture.next
+	if capture.full {
+		n = len(capture.entries)
+	}
+	captures := []CapturedExchange{}
+	for i := 1; i <= n; i++ {
+		e := capture.entries[(capture.next-i+len(capture.entries))%len(capture.entries)]
+		if subject == "" || e.Subject == subject {
+			captures = append(captures, e)
+		}
+	}
+	return captures
+}
+
+// ClearCaptures empties the ring buffer
+func ClearCaptures() {
+	capture.Lock()
+	capture.entries, capture.next, capture.full = nil, 0, false
+	capture.Unlock()
+}
+
+// RedactHeaders returns a copy of the headers with the sensitive and the configured headers redacted
+func RedactHeaders(h http.Header) http.Header {
+	redactedHeaders := append(append([]string{}, sensitiveHeaders...), GetConfig().RequestCapture.RedactHeaders...)
+	copied := make(http.Header, len(h))
+	for k, v := range h {
+		copied[k] = append([]string{}, v...)
+	}
+	for _, name := range redactedHeaders {
+		key := http.CanonicalHeaderKey(name)
+		if _, ok := copied[key]; ok {
+			copied[key] = []string{redacted}
+		}
+	}
+	return copied
+}
+
+// RedactURI returns the request URI with the sensitive query parameters redacted
+func RedactURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		name := param
+		if k := strings.IndexByte(param, '='); k >= 0 {
+			name = param[:k]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil && StrContains(sensitiveQueryParams, unescaped) {
+			params[j] = name + "=" + redacted
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
@@ -0,0 +1,113 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Multi-cluster routing of tenants to Pulsar cluster endpoints
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ClusterEndpoints are the upstream endpoints of a Pulsar cluster, an empty endpoint falls back to the default
+// BrokerProxyURL, FunctionProxyURL, or PulsarURL
+type ClusterEndpoints struct {
+	// AdminURL is the broker admin REST API URL
+	AdminURL string `json:"adminURL"`
+	// BrokerURL is the pulsar:// or pulsar+ssl:// service URL
+	BrokerURL string `json:"brokerURL"`
+	// FunctionURL is the function worker REST API URL
+	FunctionURL string `json:"functionURL"`
+	// Standby are the endpoints served when the primary is unhealthy,
+	// an empty standby endpoint keeps the primary one
+	Standby *ClusterEndpoints `json:"standby,omitempty"`
+}
+
+// ValidateClusters verifies the tenant cluster mapping refers to the defined clusters with valid URLs
+func ValidateClusters(clusters map[string]ClusterEndpoints, tenantClusters map[string]string) error {
+	for name, cluster := range clusters {
+		urls := []string{cluster.AdminURL, cluster.FunctionURL}
+		if cluster.Standby != nil {
+			urls = append(urls, cluster.Standby.AdminURL, cluster.Standby.FunctionURL)
+		}
+		for _, u := range urls {
+			if u == "" {
+				continue
+			}
+			if _, err := url.ParseRequestURI(u); err != nil {
+				return fmt.Errorf("cluster %s has an invalid url %s: %v", name, u, err)
+			}
+		}
+	}
+	for tenant, name := range tenantClusters {
+		if _, ok := clusters[name]; !ok {
+			return fmt.Errorf("tenant %s is mapped to an undefined cluster %s", tenant, name)
+		}
+	}
+	return nil
+}
+
+// TenantCluster returns the cluster name of a tenant, or an empty string for the default cluster
+func TenantCluster(tenant string) string {
+	return GetConfig().TenantClusters[tenant]
+}
+
+// clusterEndpoints returns the active endpoints of a cluster, the empty name is the default cluster
+func clusterEndpoints(cluster string) ClusterEndpoints {
+	primary := ClusterEndpoints{
+		AdminURL:    GetConfig().BrokerProxyURL,
+		BrokerURL:   GetConfig().PulsarURL,
+		FunctionURL: GetConfig().FunctionProxyURL,
+		Standby:     GetConfig().Standby,
+	}
+	if cluster != "" {
+		primary = GetConfig().Clusters[cluster]
+	}
+	if primary.Standby == nil || !IsStandbyActive(cluster) {
+		return primary
+	}
+	return ClusterEndpoints{
+		AdminURL:    AssignString(primary.Standby.AdminURL, primary.AdminURL),
+		BrokerURL:   AssignString(primary.Standby.BrokerURL, primary.BrokerURL),
+		FunctionURL: AssignString(primary.Standby.FunctionURL, primary.FunctionURL),
+	}
+}
+
+// AdminURL returns the broker admin REST API URL of the cluster serving the tenant
+func AdminURL(tenant string) string {
+	return AssignString(clusterEndpoints(TenantCluster(tenant)).AdminURL, clusterEndpoints("").AdminURL)
+}
+
+// FunctionURL returns the function worker REST API URL of the cluster serving the tenant
+func FunctionURL(tenant string) string {
+	return AssignString(clusterEndpoints(TenantCluster(tenant)).FunctionURL, clusterEndpoints("").FunctionURL)
+}
+
+// BrokerServiceURL returns the pulsar service URL of the cluster serving the tenant
+func BrokerServiceURL(tenant string) string {
+	return AssignString(clusterEndpoints(TenantCluster(tenant)).BrokerURL, clusterEndpoints("").BrokerURL)
+}
+
+// DefaultAdminURL returns the broker admin REST API URL of the default cluster
+func DefaultAdminURL() string {
+	return clusterEndpoints("").AdminURL
+}
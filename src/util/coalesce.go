@@ -0,0 +1,148 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Request coalescing of the identical upstream GETs. The concurrent GETs of the same URL with the same
+// upstream credentials share a single upstream call and its response.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// maxCoalescedBodyBytes is the largest response shared by the coalesced requests
+const maxCoalescedBodyBytes = 1 << 20
+
+// CoalescedResponse is the upstream response shared by the coalesced requests, the body must not be modified
+type CoalescedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// errNotShared is the result of a coalesced call whose response is streamed to the request starting it
+var errNotShared = errors.New("upstream response is too large to share")
+
+var (
+	upstreamGets      singleflight.Group
+	coalescedRequests int64
+)
+
+// CoalescedRequests returns the number of upstream GETs served by the response of another identical GET
+func CoalescedRequests() int64 {
+	return atomic.LoadInt64(&coalescedRequests)
+}
+
+// CoalesceGet sends a GET request with the client unless an identical GET is in flight, in which case
+// the response of the in-flight GET is shared. The requests are identical if they have the same URL,
+// Authorization, and Accept headers. The upstream call outlives the cancellation of the request starting it
+// since the other requests wait for it.
+//
+// With a stream function, a response over 1MB is not shared but handed to the stream function of the request
+// starting the call, and the other requests send their own GET. CoalesceGet returns a nil response once
+// the response is streamed. Without a stream function, the whole response is shared.
+func CoalesceGet(client *http.Client, req *http.Request, stream func(*http.Response)) (*CoalescedResponse, error) {
+	if req.Method != http.MethodGet || GetConfig().DisableRequestCoalescing {
+		return fetchUpstream(client, req, stream)
+	}
+
+	key := req.URL.String() + "\n" + req.Header.Get("Authorization") + "\n" + req.Header.Get("Accept")
+	leader, streamed := false, false
+	v, err, shared := upstreamGets.Do(key, func() (interface{}, error) {
+		leader = true
+		var leaderStream func(*http.Response)
+		if stream != nil {
+			leaderStream = func(r *http.Response) {
+				streamed = true
+				stream(r)
+			}
+		}
+		resp, err := fetchUpstream(client, req.WithContext(detachedContext{req.Context()}), leaderStream)
+		if streamed {
+			return nil, errNotShared
+		}
+		return resp, err
+	})
+	if streamed {
+		return nil, nil
+	}
+	if err == errNotShared {
+		return fetchUpstream(client, req, stream)
+	}
+	if shared && !leader {
+		atomic.AddInt64(&coalescedRequests, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*CoalescedResponse), nil
+}
+
+// fetchUpstream reads the response of a request, a response over the shared size is streamed if there is a stream function
+func fetchUpstream(client *http.Client, req *http.Request, stream func(*http.Response)) (*CoalescedResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if stream == nil {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &CoalescedResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+	}
+	if resp.ContentLength > maxCoalescedBodyBytes {
+		stream(resp)
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCoalescedBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxCoalescedBodyBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		stream(resp)
+		return nil, nil
+	}
+	return &CoalescedResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+}
+
+// detachedContext keeps the values of a context without its cancellation and deadline
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
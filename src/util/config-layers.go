@@ -0,0 +1,255 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Layered configuration, command line flags over environment variables over the configuration file
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/ghodss/yaml"
+)
+
+// the sources of a configuration value in the order of precedence
+const (
+	ConfigSourceFlag    = "flag"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFile    = "file"
+	ConfigSourceDefault = "default"
+)
+
+// configOverrides is the repeatable -set Field=value command line flag
+type configOverrides map[string]string
+
+func (c configOverrides) String() string {
+	return fmt.Sprintf("%v", map[string]string(c))
+}
+
+func (c configOverrides) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%s is not in the Field=value format", s)
+	}
+	c[parts[0]] = parts[1]
+	return nil
+}
+
+var (
+	configFileFlag string
+	configFlags    = configOverrides{}
+
+	configLayers = struct {
+		sync.RWMutex
+		file    string
+		sources map[string]string
+	}{}
+)
+
+// RegisterConfigFlags adds the -config file and the repeatable -set Field=value flags.
+// A flag takes precedence over the environment variable of the same field name, which takes precedence over the file.
+func RegisterConfigFlags(fs *flag.FlagSet) {
+	configFileFlag, configFlags = "", configOverrides{}
+	fs.StringVar(&configFileFlag, "config", "", "configuration file, overrides the BURNELL_CONFIG environment variable")
+	fs.Var(configFlags, "set", "configuration override as Field=value, can be repeated")
+	fs.Func("feature-gates", "comma separated Gate=true|false pairs, the same as -set FeatureGates=...", func(s string) error {
+		configFlags["FeatureGates"] = s
+		return nil
+	})
+}
+
+// ConfigFile returns the configuration file path, the -config flag takes precedence over BURNELL_CONFIG
+func ConfigFile() string {
+	return AssignString(configFileFlag, os.Getenv("BURNELL_CONFIG"), DefaultConfigFile)
+}
+
+// fileConfigKeys returns the top level keys set in the configuration file
+func fileConfigKeys(fileBytes []byte) map[string]bool {
+	keys := map[string]bool{}
+	doc := map[string]interface{}{}
+	var err error
+	if hasJSONPrefix(fileBytes) {
+		err = json.Unmarshal(fileBytes, &doc)
+	} else {
+		err = yaml.Unmarshal(fileBytes, &doc)
+	}
+	if err != nil {
+		return keys
+	}
+	for k := range doc {
+		keys[k] = true
+	}
+	return keys
+}
+
+// setScalarField sets a string, bool, integer, or float field from its string representation
+func setScalarField(f reflect.Value, value string) (bool, error) {
+	value = strings.TrimSuffix(value, "\n") // ensure no \n at the end of line that was introduced by loading k8s secrete file
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, err
+		}
+		f.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false, err
+		}
+		f.SetFloat(v)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyConfigLayers overrides the file values of the scalar fields with the environment variables and then the flags,
+// and records the source of every field
+func applyConfigLayers(configFile string, fileKeys map[string]bool) {
+	sources := map[string]string{}
+	fields := reflect.TypeOf(Config)
+	st := reflect.ValueOf(&Config).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		name := jsonFieldName(field)
+		f := st.Field(i)
+		sources[name] = ConfigSourceDefault
+		if fileKeys[name] {
+			sources[name] = ConfigSourceFile
+		}
+		if !f.CanSet() {
+			continue
+		}
+		if envV := os.Getenv(field.Name); len(envV) > 0 {
+			if ok, err := setScalarField(f, envV); err != nil {
+				log.Warnf("ignore invalid environment variable %s %v", field.Name, err)
+			} else if ok {
+				sources[name] = ConfigSourceEnv
+			}
+		}
+		if v, ok := configFlags[field.Name]; ok {
+			if ok, err := setScalarField(f, v); err != nil {
+				log.Warnf("ignore invalid flag -set %s %v", field.Name, err)
+			} else if ok {
+				sources[name] = ConfigSourceFlag
+			}
+		}
+		if f.Kind() == reflect.String {
+			os.Setenv(field.Name, f.String())
+		}
+	}
+	for name := range configFlags {
+		if _, ok := fields.FieldByName(name); !ok {
+			log.Warnf("ignore unknown configuration flag -set %s", name)
+		}
+	}
+
+	configLayers.Lock()
+	configLayers.file = configFile
+	configLayers.sources = sources
+	configLayers.Unlock()
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+		return tag
+	}
+	return field.Name
+}
+
+// sensitiveConfigKey matches the configuration keys whose values are redacted
+var sensitiveConfigKey = regexp.MustCompile(`(?i)(secret|password|token|privatekey|encryptionkey|credential|apikey|dsn|authorization)`)
+
+// redactConfig redacts the sensitive scalar values in place, the header maps are redacted entirely
+func redactConfig(v interface{}, sensitive bool) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			childSensitive := sensitive || strings.EqualFold(k, "headers") ||
+				(sensitiveConfigKey.MatchString(k) && !strings.HasSuffix(k, "Topic"))
+			value[k] = redactConfig(child, childSensitive)
+		}
+		return value
+	case []interface{}:
+		for i, child := range value {
+			value[i] = redactConfig(child, sensitive)
+		}
+		return value
+	case string:
+		if sensitive && value != "" {
+			return redacted
+		}
+	}
+	return v
+}
+
+// EffectiveConfig is the running configuration with the secrets redacted or shown as their file and env references,
+// and the source of each top level key
+type EffectiveConfig struct {
+	File    string                 `json:"file"`
+	Config  map[string]interface{} `json:"config"`
+	Sources map[string]string      `json:"sources"`
+}
+
+// GetEffectiveConfig returns the redacted running configuration
+func GetEffectiveConfig() (EffectiveConfig, error) {
+	secretLock.RLock()
+	data, err := json.Marshal(Config)
+	secretLock.RUnlock()
+	if err != nil {
+		return EffectiveConfig{}, err
+	}
+	doc := map[string]interface{}{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return EffectiveConfig{}, err
+	}
+	redactConfig(doc, false)
+	showSecretRefs(doc)
+	configLayers.RLock()
+	defer configLayers.RUnlock()
+	sources := make(map[string]string, len(configLayers.sources))
+	for k, v := range configLayers.sources {
+		sources[k] = v
+	}
+	return EffectiveConfig{
+		File:    configLayers.file,
+		Config:  doc,
+		Sources: sources,
+	}, nil
+}
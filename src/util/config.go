@@ -27,8 +27,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
-	"os"
-	"reflect"
 	"strings"
 
 	"unicode"
@@ -48,6 +46,7 @@ const DummySuperRole = "DummySuperRole"
 // Configuration - this server's configuration
 type Configuration struct {
 	LogLevel             string `json:"logLevel"`
+	LogFormat            string `json:"logFormat"`
 	PORT                 string `json:"PORT"`
 	WebsocketURL         string `json:"WebsocketURL"`
 	BrokerProxyURL       string `json:"BrokerProxyURL"`
@@ -70,11 +69,812 @@ type Configuration struct {
 
 	FederatedPromURL      string `json:"FederatedPromURL"`
 	FederatedPromInterval string `json:"FederatedPromInterval"`
+	MaxSeriesPerMetric    string `json:"MaxSeriesPerMetric"`
+	MaxSeriesPerTenant    string `json:"MaxSeriesPerTenant"`
+
+	// FederatedPromSelector is the label selector to discover the federated Prometheus service in k8s
+	FederatedPromSelector  string `json:"FederatedPromSelector"`
+	FederatedPromNamespace string `json:"FederatedPromNamespace"`
+	FederatedPromPort      string `json:"FederatedPromPort"`
+	FederatedPromPath      string `json:"FederatedPromPath"`
 
 	TenantManagmentTopic string `json:"TenantManagmentTopic"`
 	PulsarBeamTopic      string `json:"PulsarBeamTopic"`
 
+	// ReplicaShardTopic enables the tenant shards across replicas with the membership topic
+	ReplicaShardTopic string `json:"ReplicaShardTopic"`
+	// ReplicaAddress is the URL other replicas forward the requests of the tenants owned by this replica
+	ReplicaAddress string `json:"ReplicaAddress"`
+
 	LogServerPort string `json:"LogServerPort"`
+
+	// TenantSecretTopic stores the tenant secrets referenced by the connector configs
+	TenantSecretTopic string `json:"TenantSecretTopic"`
+	// AuditTopic enables publishing the audit events to the topic
+	AuditTopic string `json:"AuditTopic"`
+	// AuditBufferSize is the number of audit events buffered while the broker is unavailable, default to 10000
+	AuditBufferSize int `json:"AuditBufferSize"`
+	// SecretEncryptionKey is the 16, 24, or 32 bytes AES key to encrypt the tenant secrets
+	SecretEncryptionKey string `json:"SecretEncryptionKey"`
+
+	// SchemaValidation pre-checks schema uploads, either syntax or compatibility, it is disabled by default
+	SchemaValidation string `json:"SchemaValidation"`
+
+	// BinaryProxyPort enables the Pulsar binary protocol proxy with token inspection
+	BinaryProxyPort string `json:"BinaryProxyPort"`
+	// BinaryProxyUpstream is the pulsar:// or pulsar+ssl:// URL of the Pulsar proxy, default to PulsarURL
+	BinaryProxyUpstream string `json:"BinaryProxyUpstream"`
+
+	// TokenClaims is the claims template applied to every minted token
+	TokenClaims icrypto.ClaimsTemplate `json:"TokenClaims"`
+
+	// AlertRules are threshold rules evaluated against the federated metrics cache
+	AlertRules []AlertRule `json:"AlertRules"`
+	// TenantAlertReceivers are the notification receivers of each tenant
+	TenantAlertReceivers map[string][]AlertReceiver `json:"TenantAlertReceivers"`
+
+	// NamespaceRewrites are applied to the namespace label of the federated metrics before caching
+	NamespaceRewrites []NamespaceRewrite `json:"NamespaceRewrites"`
+
+	// RequestLimits are the HTTP server timeouts and the request body size limits
+	RequestLimits RequestLimits `json:"RequestLimits"`
+
+	// UpstreamPool tunes the connection pool to the brokers and function workers
+	UpstreamPool UpstreamPool `json:"UpstreamPool"`
+
+	// Clusters are the named Pulsar clusters other than the default one
+	Clusters map[string]ClusterEndpoints `json:"Clusters"`
+	// TenantClusters maps tenants to the named clusters, the other tenants are served by the default cluster
+	TenantClusters map[string]string `json:"TenantClusters"`
+
+	// Standby are the standby endpoints of the default cluster
+	Standby *ClusterEndpoints `json:"Standby"`
+	// Failover is the health probe and hysteresis of the active/standby failover
+	Failover Failover `json:"Failover"`
+
+	// TopicOperations are the guardrails of the tenant triggered compaction and offload
+	TopicOperations TopicOperations `json:"TopicOperations"`
+
+	// LogFields are static fields added to every log entry, such as the cluster and the environment
+	LogFields map[string]string `json:"LogFields"`
+	// LogLevelRevertMinutes is the default duration of a runtime log level change, default to 30 minutes
+	LogLevelRevertMinutes int `json:"LogLevelRevertMinutes"`
+	// SlowRequestThresholdMs is the latency over which a request is logged as slow, default to 2000
+	SlowRequestThresholdMs int `json:"SlowRequestThresholdMs"`
+	// SLOs are the availability and latency objectives per route class
+	SLOs []SLO `json:"SLOs"`
+
+	// RequestCapture captures sampled requests and responses for debugging
+	RequestCapture RequestCapture `json:"RequestCapture"`
+
+	// Tracing is the OpenTelemetry trace exporter
+	Tracing Tracing `json:"Tracing"`
+
+	// AccessLog is the HTTP access log file separate from the application log
+	AccessLog AccessLog `json:"AccessLog"`
+
+	// ErrorReporting ships the panics and the 5xx errors to a Sentry compatible DSN
+	ErrorReporting ErrorReporting `json:"ErrorReporting"`
+
+	// LeaderElection elects one replica to run the singleton background loops
+	LeaderElection LeaderElection `json:"LeaderElection"`
+
+	// TenantDefaults are the global defaults of the settings overridden per tenant
+	TenantDefaults TenantSettings `json:"TenantDefaults"`
+	// TenantOverridesTopic stores the per tenant overrides, default to persistent://public/default/tenant-overrides
+	TenantOverridesTopic string `json:"TenantOverridesTopic"`
+
+	// DiagnosticsAddress is the separate listener of the pprof and expvar endpoints, such as 127.0.0.1:6060
+	DiagnosticsAddress string `json:"DiagnosticsAddress"`
+
+	// SharedCache is the Redis cache shared by the replicas
+	SharedCache SharedCache `json:"SharedCache"`
+
+	// StartupProbes waits for the dependencies to be reachable before the replica is ready
+	StartupProbes StartupProbes `json:"StartupProbes"`
+
+	// FeatureGates enables or disables the gated subsystems as comma separated Gate=true|false pairs
+	FeatureGates string `json:"FeatureGates"`
+
+	// LogRotatedSuffixes are the suffixes of the rotated function log files readable by the log server,
+	// from the latest rotation, default to .1
+	LogRotatedSuffixes []string `json:"LogRotatedSuffixes"`
+
+	// AuthLockout bans the source IPs and the subjects with repeated token validation failures
+	AuthLockout AuthLockout `json:"AuthLockout"`
+
+	// APIUsage aggregates the requests per subject and route class into daily summaries
+	APIUsage APIUsage `json:"APIUsage"`
+
+	// APIKeyTopic stores the API keys, default to persistent://public/default/burnell-api-keys
+	APIKeyTopic string `json:"APIKeyTopic"`
+
+	// RBAC is the role based authorization of the routes
+	RBAC RBAC `json:"RBAC"`
+
+	// BasicAuth maps the username and password pairs to the subjects for the clients without bearer tokens
+	BasicAuth BasicAuth `json:"BasicAuth"`
+
+	// TokenBinding is how the client certificates of the tokens bound to a certificate are obtained
+	TokenBinding TokenBinding `json:"TokenBinding"`
+
+	// Sessions are the cookie sessions of the browser UI opened with a token
+	Sessions Sessions `json:"Sessions"`
+
+	// UsageStatements are the monthly usage statements of the tenants rolled up by the leader
+	UsageStatements UsageStatements `json:"UsageStatements"`
+
+	// WebhookTopic stores the notification webhooks, default to persistent://public/default/burnell-webhooks
+	WebhookTopic string `json:"WebhookTopic"`
+
+	// Notifications are the webhook notifications of the quota breaches, expiring tokens, and alert thresholds
+	Notifications Notifications `json:"Notifications"`
+
+	// CostLabelTopic stores the cost allocation labels of the namespaces, default to persistent://public/default/burnell-cost-labels
+	CostLabelTopic string `json:"CostLabelTopic"`
+
+	// BillingAccountTopic stores the billing accounts of the tenants, default to persistent://public/default/burnell-billing-accounts
+	BillingAccountTopic string `json:"BillingAccountTopic"`
+
+	// Stripe reports the usage statements to the Stripe metered billing
+	Stripe Stripe `json:"Stripe"`
+
+	// BacklogCleanup are the guardrails of the tenant skip, expiry, and clear of the subscription backlogs
+	BacklogCleanup BacklogCleanup `json:"BacklogCleanup"`
+
+	// OwnershipCacheSeconds is the TTL of the cached topic lookups and namespace bundles, default to 60 seconds
+	OwnershipCacheSeconds int `json:"OwnershipCacheSeconds"`
+
+	// TokenVerification bounds the concurrent token signature verifications
+	TokenVerification TokenVerification `json:"TokenVerification"`
+
+	// CacheMemoryBudgetMB caps the memory of the metrics and token caches, the least recently used entries
+	// are evicted beyond it. 0 is unlimited.
+	CacheMemoryBudgetMB int `json:"CacheMemoryBudgetMB"`
+
+	// HTTP2 toggles HTTP/2 on the listener and to the brokers and function workers
+	HTTP2 HTTP2 `json:"HTTP2"`
+
+	// DisableRequestCoalescing sends every upstream GET separately instead of sharing the response of
+	// the concurrent identical GETs
+	DisableRequestCoalescing bool `json:"DisableRequestCoalescing"`
+
+	// PrometheusSD is the target of the tenants listed by the Prometheus HTTP service discovery
+	PrometheusSD PrometheusSD `json:"PrometheusSD"`
+
+	// Datadog pushes the tenant metrics to the Datadog accounts of the tenants
+	Datadog Datadog `json:"Datadog"`
+
+	// CloudWatchEMF exports the metrics selected in the tenant settings as CloudWatch embedded metric format records
+	CloudWatchEMF CloudWatchEMF `json:"CloudWatchEMF"`
+
+	// Loki pushes the audit events and the access log to Grafana Loki
+	Loki Loki `json:"Loki"`
+
+	// FluentForward forwards the function logs to Fluentd or Fluent Bit with the Forward protocol
+	FluentForward FluentForward `json:"FluentForward"`
+
+	// S3Export writes the usage rollups, audit archives, and metric snapshots to an S3 compatible bucket
+	S3Export S3Export `json:"S3Export"`
+
+	// AuditElasticsearch bulk indexes the audit events into Elasticsearch or OpenSearch
+	AuditElasticsearch AuditElasticsearch `json:"AuditElasticsearch"`
+
+	// OTLPMetrics pushes the burnell self metrics to an OpenTelemetry collector
+	OTLPMetrics OTLPMetrics `json:"OTLPMetrics"`
+
+	// BootstrapManifest is the yaml manifest of the tenants, namespaces, policies, and tokens created if missing
+	// by the bootstrap mode and at the proxy startup
+	BootstrapManifest string `json:"BootstrapManifest"`
+
+	// Reconciliation periodically fixes or reports the drifts from the bootstrap manifest
+	Reconciliation Reconciliation `json:"Reconciliation"`
+
+	// GitOps pulls the manifest from a Git repository instead of the BootstrapManifest file
+	GitOps GitOps `json:"GitOps"`
+
+	// Operator reconciles the custom resources of tenants, namespace policies, and tokens
+	Operator Operator `json:"Operator"`
+
+	// Scheduler runs the recurring maintenance jobs
+	Scheduler Scheduler `json:"Scheduler"`
+
+	// SchemaVersionTopic stores the applied schema versions of the stores, default to persistent://public/default/burnell-schema-versions
+	SchemaVersionTopic string `json:"SchemaVersionTopic"`
+
+	// IntegrityKey is the HMAC key to sign the sessions, verified tokens, and API key records shared by the replicas
+	// through the shared cache and the topics, they are not trusted from a shared store without the key
+	IntegrityKey string `json:"IntegrityKey"`
+
+	// WebsocketAllowedOrigins are the browser origins, such as https://console.example.com, allowed to open the
+	// function log tail and the topic reader websockets in addition to the origin of the burnell host
+	WebsocketAllowedOrigins []string `json:"WebsocketAllowedOrigins"`
+
+	// TrustedProxies are the IPs or CIDRs of the load balancers in front of burnell, only their
+	// X-Forwarded-For and client certificate headers are trusted
+	TrustedProxies []string `json:"TrustedProxies"`
+}
+
+// StartupProbes probes the dependencies with an exponential backoff at startup. The replica is not ready
+// until every dependency is reachable or the wait is over. The wait is disabled without the maximum wait.
+type StartupProbes struct {
+	MaxWaitSeconds int `json:"maxWaitSeconds"`
+	// InitialBackoffMs default to 500, it doubles after every round up to MaxBackoffSeconds
+	InitialBackoffMs int `json:"initialBackoffMs"`
+	// MaxBackoffSeconds default to 15
+	MaxBackoffSeconds int `json:"maxBackoffSeconds"`
+	// Dependencies among pulsar-admin, prometheus, and policy-store, default to all
+	Dependencies []string `json:"dependencies"`
+	// ExitOnTimeout exits the process if a dependency is unreachable by the end of the wait,
+	// otherwise the replica starts regardless
+	ExitOnTimeout bool `json:"exitOnTimeout"`
+}
+
+// AuthLockout temporarily bans a source IP or a subject after failed token validations within a window
+type AuthLockout struct {
+	// FailuresPerIP default to 20, a negative value disables the IP bans
+	FailuresPerIP int `json:"failuresPerIP"`
+	// FailuresPerSubject is disabled by default, since anyone can forge a token of a subject to ban it
+	FailuresPerSubject int `json:"failuresPerSubject"`
+	// WindowSeconds default to 300
+	WindowSeconds int `json:"windowSeconds"`
+	// BanSeconds default to 900
+	BanSeconds int `json:"banSeconds"`
+	// TrustForwardedFor takes the source IP from the X-Forwarded-For header set by one of the TrustedProxies
+	TrustForwardedFor bool `json:"trustForwardedFor"`
+}
+
+// BasicAuth is the HTTP basic-auth compatibility for the legacy monitoring tools that cannot attach a bearer token
+type BasicAuth struct {
+	// Users are the accepted username and password pairs, basic-auth is disabled without users
+	Users []BasicAuthUser `json:"users"`
+	// Resources are the RBAC resources of the read routes accepting basic-auth, default to metrics
+	Resources []string `json:"resources"`
+}
+
+// BasicAuthUser maps a username to the subject, the password is stored as a bcrypt hash
+type BasicAuthUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"`
+	Subject      string `json:"subject"`
+}
+
+// TokenBinding obtains the client certificate of a request to verify the tokens bound to a certificate
+type TokenBinding struct {
+	// ClientCAFile enables mTLS on the HTTPS and Pulsar protocol listeners, a client certificate is
+	// verified against the CAs if the client presents one
+	ClientCAFile string `json:"clientCaFile"`
+	// ClientCertHeader is the header of the URL escaped PEM client certificate forwarded by a TLS terminating
+	// load balancer, such as X-SSL-Client-Cert. It is only trusted from the TrustedProxies.
+	ClientCertHeader string `json:"clientCertHeader"`
+}
+
+// Sessions are the server side sessions of the browser UI, the browser only holds an HttpOnly session cookie
+type Sessions struct {
+	Enabled bool `json:"enabled"`
+	// TTLMinutes default to 480, a session never outlives its token
+	TTLMinutes int `json:"ttlMinutes"`
+	// CookieName default to burnell_session
+	CookieName string `json:"cookieName"`
+	// CookieDomain default to the host of the request
+	CookieDomain string `json:"cookieDomain"`
+	// SameSite is strict or lax, default to strict
+	SameSite string `json:"sameSite"`
+	// InsecureCookie drops the Secure attribute of the cookie, only for a plain HTTP development setup
+	InsecureCookie bool `json:"insecureCookie"`
+	// CSRFExemptPaths are the path prefixes of the pure API clients, their state changing requests refuse
+	// the session cookie rather than check the CSRF token
+	CSRFExemptPaths []string `json:"csrfExemptPaths"`
+}
+
+// UsageStatements closes the statements of a billing cycle, a calendar month in UTC, and pushes them to the destination
+// if it is configured
+type UsageStatements struct {
+	// Destination is the URL the closed statements are posted to
+	Destination string `json:"destination"`
+	// Format is json or csv, default to json
+	Format string `json:"format"`
+	// Headers are sent with the statements, such as the Authorization header of the billing system
+	Headers map[string]string `json:"headers"`
+	// RetentionMonths default to 13
+	RetentionMonths int `json:"retentionMonths"`
+	// SplitByLabels pushes a CSV row per cost allocation instead of per tenant
+	SplitByLabels bool `json:"splitByLabels"`
+	// HistoryDays is the retention of the daily usage history of the trends and forecasts, default to 90
+	HistoryDays int `json:"historyDays"`
+}
+
+// Notifications tunes the webhook deliveries and the events
+type Notifications struct {
+	// MaxAttempts of a delivery default to 5, the retries back off exponentially
+	MaxAttempts int `json:"maxAttempts"`
+	// CooldownMinutes suppresses the repeated events of the same kind and resource, default to 60
+	CooldownMinutes int `json:"cooldownMinutes"`
+	// TokenExpiryWarningHours is how long before the expiry a used token is notified, default to 72
+	TokenExpiryWarningHours int `json:"tokenExpiryWarningHours"`
+	// AllowPrivateNetworks lets the webhooks reach the private, loopback, and link-local addresses
+	AllowPrivateNetworks bool `json:"allowPrivateNetworks"`
+}
+
+// Stripe reports the usage of the tenants with a billing account to the subscription items on a schedule
+type Stripe struct {
+	Enabled bool `json:"enabled"`
+	// APIKey is the secret key, such as a file or env reference
+	APIKey string `json:"apiKey"`
+	// APIURL default to https://api.stripe.com
+	APIURL string `json:"apiUrl"`
+	// IntervalMinutes default to 60
+	IntervalMinutes int `json:"intervalMinutes"`
+	// DryRun logs the usage records without sending them
+	DryRun bool `json:"dryRun"`
+}
+
+// BacklogCleanup guardrails, a zero value takes the default
+type BacklogCleanup struct {
+	// MaxMessagesPerCall is the maximum number of messages a call can skip, expire, or clear, default to 100000
+	MaxMessagesPerCall int64 `json:"maxMessagesPerCall"`
+	// ConfirmationTTLSeconds is how long the confirmation token of a dry run is valid, default to 300
+	ConfirmationTTLSeconds int `json:"confirmationTtlSeconds"`
+}
+
+// TokenVerification is the worker pool of the token signature verifications, a zero value takes the default
+type TokenVerification struct {
+	// Workers is the number of concurrent verifications, default to the number of CPUs
+	Workers int `json:"workers"`
+	// MaxQueue is the number of verifications waiting for a worker before the requests are shed with 503, default to 256
+	MaxQueue int `json:"maxQueue"`
+	// QueueTimeoutMs is the longest wait for a worker before the request is shed, default to 1000
+	QueueTimeoutMs int `json:"queueTimeoutMs"`
+}
+
+// RBAC maps the subjects to roles and the roles to permissions, or delegates the decisions to OPA
+type RBAC struct {
+	// Engine is builtin or opa, default to builtin
+	Engine string `json:"engine"`
+	// OPAURL is the data API of the OPA decision, such as http://localhost:8181/v1/data/burnell/allow
+	OPAURL string `json:"opaURL"`
+	// OPATimeoutMs default to 500, a decision is denied on a timeout
+	OPATimeoutMs int `json:"opaTimeoutMs"`
+	// Roles are added to the built-in superuser and tenant-owner roles, a role of the same name replaces the built-in one
+	Roles []RBACRole `json:"roles"`
+	// Bindings are added to the default bindings of the built-in roles
+	Bindings []RBACBinding `json:"bindings"`
+	// ReplaceDefaultBindings drops the default bindings of the super roles and the tenant owners
+	ReplaceDefaultBindings bool `json:"replaceDefaultBindings"`
+}
+
+// RBACRole is a named set of permissions in the format of resource:action, either can be *
+type RBACRole struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// RBACBinding grants a role to the subjects on the tenants
+type RBACBinding struct {
+	Role string `json:"role"`
+	// Subjects are glob patterns, $superroles matches the SuperRoles
+	Subjects []string `json:"subjects"`
+	// Tenants are the tenant names, * for all the tenants and the cluster resources,
+	// or $self for the tenants of the subject, default to $self
+	Tenants []string `json:"tenants"`
+	// Namespaces are glob patterns of the namespace names in the tenants, empty binds all the namespaces.
+	// A binding with namespaces never grants a request without a namespace.
+	Namespaces []string `json:"namespaces"`
+}
+
+// APIUsage is the retention and the bounds of the per subject API usage analytics
+type APIUsage struct {
+	// RetentionDays of the daily summaries including today, default to 7
+	RetentionDays int `json:"retentionDays"`
+	// MaxSubjectsPerDay default to 10000, the requests of the subjects over the limit are counted as _other
+	MaxSubjectsPerDay int `json:"maxSubjectsPerDay"`
+	// TopTalkers is the number of subjects with the highest request rate exported as metrics, default to 10
+	TopTalkers int `json:"topTalkers"`
+	// RouteClasses maps a class to its route prefixes, the longest matching prefix wins.
+	// A route without a matching prefix is classified by the first segment of its path template.
+	RouteClasses map[string][]string `json:"routeClasses"`
+}
+
+// SharedCache keeps the federated metric cache and the verified tokens consistent across the replicas,
+// and warms a restarted replica. It is disabled without the address.
+type SharedCache struct {
+	// Address is the host:port of the Redis server
+	Address string `json:"address"`
+	// Password accepts the file: and env: references
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// KeyPrefix default to burnell:
+	KeyPrefix string `json:"keyPrefix"`
+	// PoolSize is the maximum connections, default to 10 per CPU
+	PoolSize     int `json:"poolSize"`
+	MinIdleConns int `json:"minIdleConns"`
+	// TimeoutMs bounds the dial, read, and write of a cache call, default to 200
+	TimeoutMs int `json:"timeoutMs"`
+	// RetryAfterSeconds is how long the replica uses its local caches only after an error, default to 30
+	RetryAfterSeconds int  `json:"retryAfterSeconds"`
+	TLS               bool `json:"tls"`
+	// TLSCAFile default to the TrustStore
+	TLSCAFile             string `json:"tlsCaFile"`
+	TLSInsecureSkipVerify bool   `json:"tlsInsecureSkipVerify"`
+	// VerifiedTokenSeconds caches the verified tokens up to their expiry, default to 60, a negative value disables it
+	VerifiedTokenSeconds int `json:"verifiedTokenSeconds"`
+}
+
+// LeaderElection is a Kubernetes lease, the replica holding the lease runs the federation scrape, the usage rollups,
+// and the alert evaluation. Without the election every replica runs them.
+type LeaderElection struct {
+	Enabled bool `json:"enabled"`
+	// LeaseName default to burnell-leader
+	LeaseName string `json:"leaseName"`
+	// LeaseNamespace default to the POD_NAMESPACE environment variable or PulsarNamespace
+	LeaseNamespace string `json:"leaseNamespace"`
+	// LeaseDurationSeconds is how long a lease is valid without renewal, default to 15
+	LeaseDurationSeconds int `json:"leaseDurationSeconds"`
+}
+
+// ErrorReporting is disabled without the DSN
+type ErrorReporting struct {
+	DSN         string `json:"dsn"`
+	Environment string `json:"environment"`
+	// MaxEventsPerMinute is the maximum reported events per minute, default to 30
+	MaxEventsPerMinute int `json:"maxEventsPerMinute"`
+}
+
+// AccessLog writes the access log in the Apache combined format plus the subject and the tenant.
+// It is disabled without the file.
+type AccessLog struct {
+	File string `json:"file"`
+	// MaxSizeMB rotates the file over the size, default to 100
+	MaxSizeMB int `json:"maxSizeMB"`
+	// RotateHours rotates the file at the interval, 0 disables the time based rotation
+	RotateHours int `json:"rotateHours"`
+	// MaxBackups is the number of rotated files to keep, default to 7
+	MaxBackups int `json:"maxBackups"`
+}
+
+// Tracing exports the OpenTelemetry spans over OTLP/HTTP, tracing is disabled without the endpoint.
+// The standard OTEL_EXPORTER_OTLP_* environment variables are honored as well.
+type Tracing struct {
+	// OTLPEndpoint is the host:port of the collector, such as otel-collector:4318
+	OTLPEndpoint string `json:"otlpEndpoint"`
+	// URLPath default to /v1/traces
+	URLPath  string `json:"urlPath"`
+	Insecure bool   `json:"insecure"`
+	// Headers are sent with every export request, such as the authorization of a hosted collector
+	Headers map[string]string `json:"headers"`
+	// SampleRatio is the ratio of the root spans sampled, default to 1
+	SampleRatio float64 `json:"sampleRatio"`
+	ServiceName string  `json:"serviceName"`
+}
+
+// OTLPMetrics pushes the burnell self metrics, the same as the /metrics endpoint, over OTLP/HTTP on the interval,
+// disabled without the endpoint. A zero value takes the default.
+type OTLPMetrics struct {
+	// Endpoint is the host:port of the collector, such as otel-collector:4318
+	Endpoint string `json:"endpoint"`
+	// URLPath default to /v1/metrics
+	URLPath  string `json:"urlPath"`
+	Insecure bool   `json:"insecure"`
+	// Headers are sent with every export request, such as the authorization of a hosted collector
+	Headers map[string]string `json:"headers"`
+	// TLSCAFile default to the TrustStore, TLSCertFile and TLSKeyFile are the client certificate of mTLS
+	TLSCAFile             string `json:"tlsCaFile"`
+	TLSCertFile           string `json:"tlsCertFile"`
+	TLSKeyFile            string `json:"tlsKeyFile"`
+	TLSInsecureSkipVerify bool   `json:"tlsInsecureSkipVerify"`
+	// IntervalSeconds default to 60
+	IntervalSeconds int `json:"intervalSeconds"`
+	// ServiceName default to the tracing service name, or burnell
+	ServiceName string `json:"serviceName"`
+}
+
+// RequestCapture is the initial capture mode and the capture buffer. A zero value takes the default,
+// and the capture is disabled unless the sample rate or the subjects are set, at startup or at runtime.
+type RequestCapture struct {
+	SampleRate float64  `json:"sampleRate"`
+	Subjects   []string `json:"subjects"`
+	// MaxEntries is the size of the ring buffer, default to 100
+	MaxEntries int `json:"maxEntries"`
+	// MaxBodyBytes is the maximum captured size of a request or response body, default to 65536
+	MaxBodyBytes int `json:"maxBodyBytes"`
+	// RedactHeaders are redacted in addition to Authorization, Proxy-Authorization, Cookie, Set-Cookie, and X-Api-Key
+	RedactHeaders []string `json:"redactHeaders"`
+}
+
+// SLO is the availability and latency objectives of a route class
+type SLO struct {
+	// Class is the route class, the built-in classes metrics, admin, and token have default route prefixes
+	Class string `json:"class"`
+	// RoutePrefixes of the class, the longest matching prefix among all classes wins
+	RoutePrefixes []string `json:"routePrefixes"`
+	// Availability is the target ratio of the requests without a 5xx status, such as 0.999
+	Availability float64 `json:"availability"`
+	// LatencyMs and LatencyTarget are the target ratio of the requests completed within the latency, such as 0.99 within 1000ms
+	LatencyMs     int     `json:"latencyMs"`
+	LatencyTarget float64 `json:"latencyTarget"`
+}
+
+// TopicOperations guardrails, a zero value takes the default
+type TopicOperations struct {
+	// CooldownSeconds is the minimum interval between two operations of the same kind on a topic
+	CooldownSeconds int `json:"cooldownSeconds"`
+	// MaxPerTenantPerHour is the maximum number of operations of the same kind per tenant per hour
+	MaxPerTenantPerHour int `json:"maxPerTenantPerHour"`
+	// MinCompactionBacklogBytes is the minimum topic backlog size to trigger compaction
+	MinCompactionBacklogBytes int64 `json:"minCompactionBacklogBytes"`
+	// MinOffloadStorageBytes is the minimum topic storage size to trigger offload
+	MinOffloadStorageBytes int64 `json:"minOffloadStorageBytes"`
+}
+
+// Failover settings of the clusters with standby endpoints. A zero value takes the default.
+type Failover struct {
+	// ProbePath is probed on the primary admin URL, default to /status.html
+	ProbePath            string `json:"probePath"`
+	ProbeIntervalSeconds int    `json:"probeIntervalSeconds"`
+	ProbeTimeoutSeconds  int    `json:"probeTimeoutSeconds"`
+	// FailureThreshold is the number of consecutive failed probes to fail over to the standby
+	FailureThreshold int `json:"failureThreshold"`
+	// RecoveryThreshold is the number of consecutive successful probes to fail back to the primary
+	RecoveryThreshold int `json:"recoveryThreshold"`
+}
+
+// UpstreamPool is the connection pool settings of the shared upstream http client.
+// A zero value takes the default.
+type UpstreamPool struct {
+	MaxIdleConns        int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	// MaxConnsPerHost limits the total connections per host, 0 is unlimited
+	MaxConnsPerHost        int `json:"maxConnsPerHost"`
+	IdleConnTimeoutSeconds int `json:"idleConnTimeoutSeconds"`
+	TLSSessionCacheSize    int `json:"tlsSessionCacheSize"`
+}
+
+// HTTP2 toggles of the listener and the upstream connections. h2 is negotiated on the TLS listener by default,
+// the other modes are opt-in since the brokers and function workers do not always support them.
+type HTTP2 struct {
+	// DisableListener turns off h2 on the TLS listener
+	DisableListener bool `json:"disableListener"`
+	// ListenerH2C serves HTTP/2 with prior knowledge on a plaintext listener
+	ListenerH2C bool `json:"listenerH2C"`
+	// Upstream negotiates h2 with the TLS brokers and function workers
+	Upstream bool `json:"upstream"`
+	// UpstreamH2C sends HTTP/2 with prior knowledge to the plaintext brokers and function workers
+	UpstreamH2C bool `json:"upstreamH2C"`
+}
+
+// PrometheusSD is the scrape target of the tenant metrics in the Prometheus HTTP service discovery.
+// The target defaults to the host and the scheme of the discovery request.
+type PrometheusSD struct {
+	// Target is the host:port Prometheus scrapes burnell at
+	Target string `json:"target"`
+	// Scheme is http or https
+	Scheme string `json:"scheme"`
+	// Labels are added to every target group
+	Labels map[string]string `json:"labels"`
+}
+
+// Datadog pushes the metrics of the tenants on the interval, a tenant is pushed either to the series API of its
+// account or to a DogStatsD agent. Only the leader pushes when the leader election is enabled.
+type Datadog struct {
+	// IntervalSeconds default to 60
+	IntervalSeconds int             `json:"intervalSeconds"`
+	Tenants         []DatadogTenant `json:"tenants"`
+}
+
+// DatadogTenant is the Datadog destination of a tenant's metrics
+type DatadogTenant struct {
+	Tenant string `json:"tenant"`
+	// APIKey of the tenant's account, such as a file or env reference
+	APIKey string `json:"apiKey"`
+	// Site default to datadoghq.com
+	Site string `json:"site"`
+	// StatsdAddress is a DogStatsD agent, such as 127.0.0.1:8125, it is used instead of the API
+	StatsdAddress string `json:"statsdAddress"`
+	// Tags are added to every metric, such as env:prod
+	Tags []string `json:"tags"`
+}
+
+// CloudWatchEMF is the destination of the CloudWatch embedded metric format records. The records are written
+// to stdout, collected by the container log driver, or sent to the CloudWatch agent.
+type CloudWatchEMF struct {
+	// Endpoint is stdout, or a tcp:// or udp:// address of the CloudWatch agent such as tcp://127.0.0.1:25888,
+	// default to stdout
+	Endpoint string `json:"endpoint"`
+	// IntervalSeconds default to 60
+	IntervalSeconds int `json:"intervalSeconds"`
+}
+
+// Loki is the Grafana Loki push API of the audit events and the access log, disabled without the URL.
+// A zero value takes the default.
+type Loki struct {
+	// URL is the push API, such as http://loki:3100/loki/api/v1/push
+	URL string `json:"url"`
+	// OrgID is the X-Scope-OrgID of a multi-tenant Loki
+	OrgID string `json:"orgID"`
+	// Username and Password of the basic auth, the password can be a file or env reference
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Labels are added to every stream, such as cluster
+	Labels map[string]string `json:"labels"`
+	// Audit pushes the audit events, and AccessLog pushes the access log lines
+	Audit     bool `json:"audit"`
+	AccessLog bool `json:"accessLog"`
+	// BatchSize is the number of lines per push, default to 500
+	BatchSize int `json:"batchSize"`
+	// BatchWaitMs is the longest wait of a line before a push, default to 1000
+	BatchWaitMs int `json:"batchWaitMs"`
+	// BufferSize is the number of lines buffered while Loki is unavailable, the oldest lines are dropped beyond it,
+	// default to 10000
+	BufferSize int `json:"bufferSize"`
+}
+
+// FluentForward follows the logs of the function instances and forwards the new records to a Fluentd or
+// Fluent Bit forward input, disabled without the address. A zero value takes the default.
+type FluentForward struct {
+	// Address is the host:port of the forward input, such as fluent-bit.logging:24224
+	Address string `json:"address"`
+	// TagPrefix is the tag prefix of the records, the tag is <prefix>.<tenant>.<namespace>.<function>,
+	// default to pulsar.functions
+	TagPrefix string `json:"tagPrefix"`
+	// Tenants are the tenants whose function logs are forwarded, empty forwards all tenants
+	Tenants []string `json:"tenants"`
+	// IntervalMs is the interval of the reads of the logs, default to 1000
+	IntervalMs int `json:"intervalMs"`
+	// CursorFile keeps the offsets of the forwarded lines so a restart resumes after them,
+	// default to burnell-fluent-cursors.json under the temporary directory
+	CursorFile string `json:"cursorFile"`
+}
+
+// S3Export writes the usage rollups, the audit archives, and the tenant metric snapshots to an S3 compatible
+// bucket on the interval, disabled without the bucket. A zero value takes the default.
+type S3Export struct {
+	// Endpoint is the S3 compatible API, such as http://minio.storage:9000, default to https://s3.<region>.amazonaws.com
+	Endpoint string `json:"endpoint"`
+	// Region of the signature, default to us-east-1
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	// AccessKeyID and SecretAccessKey of the signature, the secret can be a file or env reference
+	AccessKeyID     string `json:"accessKeyID"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	// PathStyle addresses the bucket in the path instead of the host name, required by most self-hosted stores
+	PathStyle bool `json:"pathStyle"`
+	// PathTemplate is the object key with the placeholders {kind}, {tenant}, {date}, {year}, {month}, {day},
+	// {time}, {replica}, and {ext}, default to burnell/{kind}/{tenant}/{date}/{time}-{replica}.{ext}.
+	// The replica keeps apart the audit archives exported by every replica.
+	PathTemplate string `json:"pathTemplate"`
+	// ServerSideEncryption is AES256 or aws:kms, and KMSKeyID is the key of aws:kms, empty uses the bucket default
+	ServerSideEncryption string `json:"serverSideEncryption"`
+	KMSKeyID             string `json:"kmsKeyID"`
+	// RetentionDays deletes the exported objects older than the days, 0 keeps them
+	RetentionDays int `json:"retentionDays"`
+	// IntervalMinutes is the interval of the exports, default to 60
+	IntervalMinutes int `json:"intervalMinutes"`
+	// Kinds among usage, audit, and metrics, default to all
+	Kinds []string `json:"kinds"`
+}
+
+// AuditElasticsearch bulk indexes the audit events into the daily indices of Elasticsearch or OpenSearch,
+// disabled without the URLs. A zero value takes the default.
+type AuditElasticsearch struct {
+	// URLs of the cluster nodes, such as https://es-0.logging:9200
+	URLs []string `json:"urls"`
+	// Username and Password of the basic auth, or APIKey as the base64 encoded id:key, the secrets can be
+	// file or env references
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"apiKey"`
+	// IndexPrefix of the daily indices <prefix>-yyyy.mm.dd and the index template, default to burnell-audit
+	IndexPrefix string `json:"indexPrefix"`
+	// Shards and Replicas of the index template, 0 leaves them to the cluster default
+	Shards   int `json:"shards"`
+	Replicas int `json:"replicas"`
+	// BulkSize is the number of events per bulk request, default to 500
+	BulkSize int `json:"bulkSize"`
+	// BufferSize is the number of events buffered while the cluster is unavailable, default to 10000
+	BufferSize int `json:"bufferSize"`
+}
+
+// Reconciliation diffs the tenants and namespaces of the bootstrap manifest against the brokers and the policy
+// store on the interval, disabled without the interval.
+type Reconciliation struct {
+	IntervalSeconds int `json:"intervalSeconds"`
+	// DryRun reports the drifts in the audit log and the report without fixing them
+	DryRun bool `json:"dryRun"`
+}
+
+// GitOps pulls the manifest of the tenants and policies from a branch of a Git repository and applies every new
+// commit, disabled without the repository. A zero value takes the default.
+type GitOps struct {
+	// Repository is the clone URL, an ssh URL takes the key of the GIT_SSH_COMMAND environment variable
+	Repository string `json:"repository"`
+	// Branch default to main
+	Branch string `json:"branch"`
+	// Path of the manifest in the repository, default to manifest.yaml
+	Path string `json:"path"`
+	// Username and Token of the https basic auth, the token can be a file or env reference
+	Username string `json:"username"`
+	Token    string `json:"token"`
+	// PollSeconds is the interval of the fetches, default to 60
+	PollSeconds int `json:"pollSeconds"`
+	// WebhookSecret verifies the push webhooks of GitHub or GitLab, the webhook is disabled without it
+	WebhookSecret string `json:"webhookSecret"`
+	// Dir is the local checkout, default to burnell-gitops under the temporary directory
+	Dir string `json:"dir"`
+}
+
+// Operator watches the PulsarTenant, PulsarNamespacePolicy, and PulsarToken custom resources in the proxy mode,
+// provisions them, and reports their Ready condition in the status. Only the leader reconciles.
+type Operator struct {
+	Enabled bool `json:"enabled"`
+	// Namespace is the watched Kubernetes namespace, required
+	Namespace string `json:"namespace"`
+	// Tenant is the only Pulsar tenant the custom resources of the namespace can manage, required
+	Tenant string `json:"tenant"`
+	// ResyncSeconds is the interval of the full resync, default to 300
+	ResyncSeconds int `json:"resyncSeconds"`
+}
+
+// Scheduler runs the maintenance jobs on their cron schedules. A job of a leader task runs on the leader only,
+// a job of a local task, such as the cache compaction, runs on every replica.
+type Scheduler struct {
+	Jobs []ScheduledJob `json:"jobs"`
+	// HistorySize is the number of the runs kept in the history, default to 100
+	HistorySize int `json:"historySize"`
+}
+
+// ScheduledJob is a recurring run of a registered task
+type ScheduledJob struct {
+	Name string `json:"name"`
+	// Task is one of key-rotation-reminder, usage-rollup, cache-compaction, stale-token-cleanup, and report-export
+	Task string `json:"task"`
+	// Schedule is a five field cron expression in UTC, or a descriptor such as @daily or @every 15m
+	Schedule string `json:"schedule"`
+	// Params are the task parameters
+	Params   map[string]string `json:"params"`
+	Disabled bool              `json:"disabled"`
+}
+
+// RequestLimits protects the HTTP server from oversized requests and slow clients.
+// A zero value takes the default.
+type RequestLimits struct {
+	ReadHeaderTimeoutSeconds int `json:"readHeaderTimeoutSeconds"`
+	ReadTimeoutSeconds       int `json:"readTimeoutSeconds"`
+	WriteTimeoutSeconds      int `json:"writeTimeoutSeconds"`
+	IdleTimeoutSeconds       int `json:"idleTimeoutSeconds"`
+	MaxHeaderBytes           int `json:"maxHeaderBytes"`
+
+	// MaxBodyBytes is the default maximum request body size
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// RouteMaxBodyBytes is the maximum request body size per route path prefix, the longest prefix wins
+	RouteMaxBodyBytes map[string]int64 `json:"routeMaxBodyBytes"`
+	// TierMaxBodyBytes caps the maximum request body size of the tenants per plan type
+	TierMaxBodyBytes map[string]int64 `json:"tierMaxBodyBytes"`
+}
+
+// NamespaceRewrite rewrites a namespace label value matching the regular expression,
+// the replacement can refer to the capture groups as $1, $2, and etc.
+type NamespaceRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// AlertRule is a threshold expression over the cached series, such as `pulsar_msg_backlog > 1000`
+type AlertRule struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+	// By is the aggregation level of the series, either tenant, namespace, or topic (default)
+	By string `json:"by"`
+	// For is the number of consecutive evaluations the expression must hold true before the alert fires
+	For       int             `json:"for"`
+	Tenants   []string        `json:"tenants"`
+	Receivers []AlertReceiver `json:"receivers"`
+}
+
+// AlertReceiver is a notification destination, the type is webhook, slack, or pagerduty
+type AlertReceiver struct {
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	RoutingKey string `json:"routingKey"`
 }
 
 // Config - this server's configuration instance
@@ -97,11 +897,13 @@ var SuperRoles []string
 
 // Init initializes configuration
 func Init(mode *string) {
-	configFile := AssignString(os.Getenv("BURNELL_CONFIG"), DefaultConfigFile)
+	configFile := ConfigFile()
 	ReadConfigFile(configFile)
 
-	log.SetLevel(logLevel(Config.LogLevel))
+	ResetLogLevel()
+	InitLogging()
 	log.Warnf("Configuration built from file - %s", configFile)
+	WatchSecretRefs()
 	if IsInitializer(mode) || IsHealer(mode) {
 		return
 	}
@@ -111,6 +913,12 @@ func Init(mode *string) {
 		if err != nil {
 			panic(err)
 		}
+		if err = Config.TokenClaims.Validate(); err != nil {
+			panic(err)
+		}
+		if !Config.TokenClaims.IsEmpty() {
+			JWTAuth.ClaimsTemplate = &Config.TokenClaims
+		}
 	}
 	BrokerProxyURL, err = url.ParseRequestURI(Config.BrokerProxyURL)
 	if err != nil {
@@ -121,6 +929,23 @@ func Init(mode *string) {
 		panic(err)
 	}
 	AdminRestPrefix = Config.AdminRestPrefix
+
+	if err = ValidateClusters(Config.Clusters, Config.TenantClusters); err != nil {
+		panic(err)
+	}
+	if err = ValidateSLOs(Config.SLOs); err != nil {
+		panic(err)
+	}
+	InitSLOs(Config.SLOs)
+	if err = SetFeatureGates(Config.FeatureGates); err != nil {
+		panic(err)
+	}
+	SetCaptureSettings(CaptureSettings{SampleRate: Config.RequestCapture.SampleRate, Subjects: Config.RequestCapture.Subjects})
+	if FeatureEnabled(FeatureSharedCache) {
+		if err = InitSharedCache(Config.SharedCache); err != nil {
+			log.Errorf("shared cache is disabled because of error %v", err)
+		}
+	}
 }
 
 // ReadConfigFile reads configuration file.
@@ -143,23 +968,10 @@ func ReadConfigFile(configFile string) {
 		}
 	}
 
-	// Next section allows env variable overwrites config file value
-	fields := reflect.TypeOf(Config)
-	// pointer to struct
-	values := reflect.ValueOf(&Config)
-	// struct
-	st := values.Elem()
-	for i := 0; i < fields.NumField(); i++ {
-		field := fields.Field(i).Name
-		f := st.FieldByName(field)
-
-		if f.Kind() == reflect.String {
-			envV := os.Getenv(field)
-			if len(envV) > 0 && f.IsValid() && f.CanSet() {
-				f.SetString(strings.TrimSuffix(envV, "\n")) // ensure no \n at the end of line that was introduced by loading k8s secrete file
-			}
-			os.Setenv(field, f.String())
-		}
+	// flags take precedence over env variables that overwrite the config file values
+	applyConfigLayers(configFile, fileConfigKeys(fileBytes))
+	if err := resolveSecretRefs(); err != nil {
+		panic(err)
 	}
 
 	if IsPulsarJWTEnabled() {
@@ -171,11 +983,14 @@ func ReadConfigFile(configFile string) {
 		SuperRoles = []string{DummySuperRole}
 	}
 
-	log.Infof("configuration loaded is %v", Config)
+	log.Infof("configuration loaded from %s", configFile)
 }
 
-//GetConfig returns a reference to the Configuration
+// GetConfig returns a reference to the current Configuration, it is replaced as a whole once a secret is refreshed
 func GetConfig() *Configuration {
+	if c, ok := configSnapshot.Load().(*Configuration); ok {
+		return c
+	}
 	return &Config
 }
 
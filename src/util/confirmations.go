@@ -0,0 +1,102 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Confirmation tokens of the guarded destructive operations. A dry run issues a random token bound to the
+// subject, the operation, and its parameters, and the operation is only carried out with the token. A token is
+// used once, and it is shared across the replicas by the shared cache if it is enabled.
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const maxConfirmations = 100000
+
+// ErrInvalidConfirmation is the error of an unknown, expired, used, or mismatched confirmation token
+var ErrInvalidConfirmation = errors.New("invalid confirmation token")
+
+type confirmation struct {
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Used is the tombstone of a consumed token in the shared cache
+	Used bool `json:"used,omitempty"`
+}
+
+var confirmations = struct {
+	sync.Mutex
+	byDigest map[string]confirmation
+}{byDigest: map[string]confirmation{}}
+
+// NewConfirmation issues a confirmation token of an operation identified by the key, valid for the ttl
+func NewConfirmation(key string, ttl time.Duration) (string, time.Time, error) {
+	token, err := sessionRandom()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	c := confirmation{Key: key, ExpiresAt: now.Add(ttl)}
+	digest := sessionDigest(token)
+	confirmations.Lock()
+	if len(confirmations.byDigest) >= maxConfirmations {
+		for k, v := range confirmations.byDigest {
+			if !now.Before(v.ExpiresAt) {
+				delete(confirmations.byDigest, k)
+			}
+		}
+	}
+	confirmations.byDigest[digest] = c
+	confirmations.Unlock()
+	if data, err := json.Marshal(c); err == nil {
+		SharedCacheSetSigned("confirmation:"+digest, data, ttl)
+	}
+	return token, c.ExpiresAt, nil
+}
+
+// ConsumeConfirmation verifies that the token is issued for the key and is not expired or used, and uses it
+func ConsumeConfirmation(token, key string) error {
+	if token == "" {
+		return ErrInvalidConfirmation
+	}
+	digest := sessionDigest(token)
+	c, ok := confirmation{}, false
+	if data, found := SharedCacheGetSigned("confirmation:" + digest); found {
+		ok = json.Unmarshal(data, &c) == nil
+	}
+	confirmations.Lock()
+	if !ok {
+		c, ok = confirmations.byDigest[digest]
+	}
+	delete(confirmations.byDigest, digest)
+	confirmations.Unlock()
+	now := time.Now()
+	if !ok || c.Used || c.Key != key || !now.Before(c.ExpiresAt) {
+		return ErrInvalidConfirmation
+	}
+	c.Used = true
+	if data, err := json.Marshal(c); err == nil {
+		SharedCacheSetSigned("confirmation:"+digest, data, c.ExpiresAt.Sub(now))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Cost allocation labels of the namespaces, such as the cost center or the team, that split a tenant's usage
+// in the chargeback reports
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxCostLabels        = 10
+	maxCostLabelValueLen = 128
+)
+
+// CostLabelPattern restricts the label names
+var CostLabelPattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]{0,62}$`)
+
+// NamespaceCostLabels are the cost allocation labels of a namespace
+type NamespaceCostLabels struct {
+	Tenant    string            `json:"tenant"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Deleted   bool              `json:"deleted,omitempty"`
+}
+
+var costLabels = struct {
+	sync.RWMutex
+	namespaces map[string]NamespaceCostLabels
+}{namespaces: map[string]NamespaceCostLabels{}}
+
+// ValidateCostLabels checks the label names and values
+func ValidateCostLabels(labels map[string]string) error {
+	if len(labels) == 0 {
+		return fmt.Errorf("at least one label is required")
+	}
+	if len(labels) > maxCostLabels {
+		return fmt.Errorf("a namespace has at most %d cost labels", maxCostLabels)
+	}
+	for k, v := range labels {
+		if !CostLabelPattern.MatchString(k) {
+			return fmt.Errorf("label name %s is invalid, allowed characters are lower case letters, digits, '.', '_', and '-'", k)
+		}
+		if v == "" || len(v) > maxCostLabelValueLen || strings.ContainsAny(v, ",=\n") {
+			return fmt.Errorf("label %s value must be 1 to %d characters without ',', '=', or new lines", k, maxCostLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// CostLabelKey is the canonical form of a label set, such as team=payments,cost-center=cc-42 sorted by the names.
+// The key of no labels is empty.
+func CostLabelKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ApplyCostLabels applies the labels read from the policy backend, deleted labels are removed
+func ApplyCostLabels(l NamespaceCostLabels) {
+	costLabels.Lock()
+	defer costLabels.Unlock()
+	if l.Deleted {
+		delete(costLabels.namespaces, l.Tenant+"/"+l.Namespace)
+	} else {
+		costLabels.namespaces[l.Tenant+"/"+l.Namespace] = l
+	}
+}
+
+// GetCostLabels returns the labels of a namespace, nil if it has no labels
+func GetCostLabels(tenant, namespace string) map[string]string {
+	costLabels.RLock()
+	defer costLabels.RUnlock()
+	return costLabels.namespaces[tenant+"/"+namespace].Labels
+}
+
+// ListAllCostLabels returns the labeled namespaces of all tenants
+func ListAllCostLabels() []NamespaceCostLabels {
+	costLabels.RLock()
+	defer costLabels.RUnlock()
+	list := make([]NamespaceCostLabels, 0, len(costLabels.namespaces))
+	for _, l := range costLabels.namespaces {
+		list = append(list, l)
+	}
+	return list
+}
+
+// ListCostLabels returns the labeled namespaces of a tenant sorted by the namespace
+func ListCostLabels(tenant string) []NamespaceCostLabels {
+	costLabels.RLock()
+	list := []NamespaceCostLabels{}
+	for _, l := range costLabels.namespaces {
+		if l.Tenant == tenant {
+			list = append(list, l)
+		}
+	}
+	costLabels.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Namespace < list[j].Namespace })
+	return list
+}
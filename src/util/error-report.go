@@ -0,0 +1,112 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Panic and 5xx error reporting to a Sentry compatible endpoint
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/getsentry/sentry-go"
+	"golang.org/x/time/rate"
+)
+
+const defaultErrorEventsPerMinute = 30
+
+var (
+	errorReporting bool
+	errorLimiter   *rate.Limiter
+)
+
+// InitErrorReporting sets up the reporting to the configured DSN, it is disabled without the DSN
+func InitErrorReporting(release string) error {
+	errorReportingRelease = release
+	cfg := GetConfig().ErrorReporting
+	if cfg.DSN == "" {
+		errorReporting = false
+		return nil
+	}
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.DSN,
+		Environment: cfg.Environment,
+		Release:     release,
+		ServerName:  GetConfig().ClusterName,
+	}); err != nil {
+		return err
+	}
+	perMinute := cfg.MaxEventsPerMinute
+	if perMinute <= 0 {
+		perMinute = defaultErrorEventsPerMinute
+	}
+	errorLimiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+	errorReporting = true
+	log.Infof("error reporting is enabled with at most %d events per minute", perMinute)
+	return nil
+}
+
+// FlushErrorReports waits for the pending reports to be sent
+func FlushErrorReports(timeout time.Duration) bool {
+	if !errorReporting {
+		return true
+	}
+	return sentry.Flush(timeout)
+}
+
+// errorHub returns a hub scoped with the context tags, or nil if the report is disabled or rate limited
+func errorHub(tags map[string]string) *sentry.Hub {
+	if !errorReporting {
+		return nil
+	}
+	if !errorLimiter.Allow() {
+		log.Debugf("error report is rate limited %v", tags)
+		return nil
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		for k, v := range tags {
+			if v != "" {
+				scope.SetTag(k, v)
+			}
+		}
+	})
+	return hub
+}
+
+// ReportPanic reports a recovered panic with the stack trace, it must be called in the deferred recover function
+func ReportPanic(ctx context.Context, recovered interface{}, tags map[string]string) {
+	if hub := errorHub(tags); hub != nil {
+		hub.RecoverWithContext(ctx, recovered)
+	}
+}
+
+// ReportServerError reports an unexpected error such as a 5xx response
+func ReportServerError(err error, tags map[string]string) {
+	if err == nil {
+		err = errors.New("unknown error")
+	}
+	if hub := errorHub(tags); hub != nil {
+		hub.CaptureException(err)
+	}
+}
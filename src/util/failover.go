@@ -0,0 +1,171 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Active/standby failover of the cluster upstream endpoints
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	defaultProbePath         = "/status.html"
+	defaultProbeInterval     = 10 * time.Second
+	defaultProbeTimeout      = 5 * time.Second
+	defaultFailureThreshold  = 3
+	defaultRecoveryThreshold = 5
+)
+
+// failoverState is the health of a cluster's primary endpoints
+type failoverState struct {
+	// standby is 1 when the standby endpoints are active
+	standby int32
+	// consecutive probe results, only accessed by the probe of the cluster
+	failures  int
+	successes int
+}
+
+var (
+	failoverLock     sync.RWMutex
+	failoverStates   = make(map[string]*failoverState)
+	failoverListener func(cluster string, standby bool)
+)
+
+// SetFailoverListener registers a callback invoked on every failover and failback
+func SetFailoverListener(fn func(cluster string, standby bool)) {
+	failoverLock.Lock()
+	failoverListener = fn
+	failoverLock.Unlock()
+}
+
+// IsStandbyActive returns whether a cluster is failed over to its standby, the empty name is the default cluster
+func IsStandbyActive(cluster string) bool {
+	failoverLock.RLock()
+	state, ok := failoverStates[cluster]
+	failoverLock.RUnlock()
+	return ok && atomic.LoadInt32(&state.standby) == 1
+}
+
+// StartFailoverProbes starts the health probes of the primary endpoints of every cluster with a standby
+func StartFailoverProbes() {
+	interval := secondsOrDefault(GetConfig().Failover.ProbeIntervalSeconds, defaultProbeInterval)
+	clusters := []string{}
+	if GetConfig().Standby != nil {
+		clusters = append(clusters, "")
+	}
+	for name, cluster := range GetConfig().Clusters {
+		if cluster.Standby != nil {
+			clusters = append(clusters, name)
+		}
+	}
+	for _, cluster := range clusters {
+		log.Infof("start failover probes of cluster %s every %v", ClusterLabel(cluster), interval)
+		go func(cluster string) {
+			ticker := time.NewTicker(interval)
+			for {
+				ProbeCluster(cluster)
+				<-ticker.C
+			}
+		}(cluster)
+	}
+}
+
+// ProbeCluster probes the primary admin endpoint of a cluster once and fails over or back
+// once the consecutive results reach the threshold. It returns whether the standby is active.
+func ProbeCluster(cluster string) bool {
+	failoverLock.Lock()
+	state, ok := failoverStates[cluster]
+	if !ok {
+		state = &failoverState{}
+		failoverStates[cluster] = state
+	}
+	listener := failoverListener
+	failoverLock.Unlock()
+
+	primary := GetConfig().BrokerProxyURL
+	if cluster != "" {
+		primary = GetConfig().Clusters[cluster].AdminURL
+	}
+	err := ProbeURL(SingleJoinSlash(primary, AssignString(GetConfig().Failover.ProbePath, defaultProbePath)))
+
+	standby := atomic.LoadInt32(&state.standby) == 1
+	if err != nil {
+		state.failures++
+		state.successes = 0
+		log.Warnf("cluster %s primary %s probe failed %d times, error %v", ClusterLabel(cluster), primary, state.failures, err)
+	} else {
+		state.successes++
+		state.failures = 0
+	}
+
+	switch {
+	case !standby && state.failures >= intOrDefault(GetConfig().Failover.FailureThreshold, defaultFailureThreshold):
+		standby = true
+		log.Errorf("cluster %s fails over to the standby after %d failed probes of the primary %s", ClusterLabel(cluster), state.failures, primary)
+	case standby && state.successes >= intOrDefault(GetConfig().Failover.RecoveryThreshold, defaultRecoveryThreshold):
+		standby = false
+		log.Warnf("cluster %s fails back to the primary %s after %d successful probes", ClusterLabel(cluster), primary, state.successes)
+	default:
+		return standby
+	}
+	if standby {
+		atomic.StoreInt32(&state.standby, 1)
+	} else {
+		atomic.StoreInt32(&state.standby, 0)
+	}
+	if listener != nil {
+		listener(ClusterLabel(cluster), standby)
+	}
+	return standby
+}
+
+// ProbeURL checks if an endpoint is reachable, a status code under 500 is reachable
+func ProbeURL(probeURL string) error {
+	timeout := secondsOrDefault(GetConfig().Failover.ProbeTimeoutSeconds, defaultProbeTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := UpstreamClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("probe returns status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ClusterLabel returns the cluster name used in logs and metrics, the empty name is the default cluster
+func ClusterLabel(cluster string) string {
+	return AssignString(cluster, "default")
+}
@@ -0,0 +1,158 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Feature gates of the subsystems shipped disabled until they mature, similar to the Kubernetes feature gates
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FeatureStage is the maturity of a gated subsystem
+type FeatureStage string
+
+// the stages of a gated subsystem
+const (
+	// FeatureAlpha is disabled by default
+	FeatureAlpha FeatureStage = "alpha"
+	// FeatureBeta is enabled by default
+	FeatureBeta FeatureStage = "beta"
+	// FeatureGA is always enabled, the gate is kept for the compatibility of the existing settings
+	FeatureGA FeatureStage = "ga"
+)
+
+// the feature gates
+const (
+	// FeatureBinaryProxy is the Pulsar binary protocol proxy
+	FeatureBinaryProxy = "BinaryProxy"
+	// FeatureAlerting is the alert rule evaluation against the federated metrics
+	FeatureAlerting = "Alerting"
+	// FeatureSharedCache is the Redis cache shared by the replicas
+	FeatureSharedCache = "SharedCache"
+	// FeatureRemoteWrite is the push of the metrics to the remote backends, Datadog, StatsD, and OTLP
+	FeatureRemoteWrite = "RemoteWrite"
+	// FeatureImpersonation lets the authorized subjects view the routes as another subject
+	FeatureImpersonation = "Impersonation"
+)
+
+// FeatureSpec is the definition of a gate
+type FeatureSpec struct {
+	Stage       FeatureStage
+	Description string
+}
+
+// FeatureGate is the status of a gate
+type FeatureGate struct {
+	Name        string       `json:"name"`
+	Stage       FeatureStage `json:"stage"`
+	Default     bool         `json:"default"`
+	Enabled     bool         `json:"enabled"`
+	Description string       `json:"description"`
+}
+
+var (
+	featureGatesLock = sync.RWMutex{}
+	featureSpecs     = map[string]FeatureSpec{
+		FeatureBinaryProxy:   {Stage: FeatureAlpha, Description: "Pulsar binary protocol proxy with token inspection, requires BinaryProxyPort"},
+		FeatureAlerting:      {Stage: FeatureAlpha, Description: "alert rule evaluation against the federated metrics, requires AlertRules"},
+		FeatureRemoteWrite:   {Stage: FeatureAlpha, Description: "push of the metrics to Datadog, StatsD, and OTLP, requires their configuration"},
+		FeatureSharedCache:   {Stage: FeatureBeta, Description: "Redis cache shared by the replicas, requires SharedCache.address"},
+		FeatureImpersonation: {Stage: FeatureAlpha, Description: "read only impersonation of a subject with the X-Impersonate-Subject header, audited"},
+	}
+	featureOverrides = map[string]bool{}
+)
+
+// RegisterFeatureGate adds a gate, it must be called before the configuration is loaded
+func RegisterFeatureGate(name string, spec FeatureSpec) {
+	featureGatesLock.Lock()
+	featureSpecs[name] = spec
+	featureGatesLock.Unlock()
+}
+
+// SetFeatureGates parses and applies the comma separated Gate=true|false pairs, the gates not listed take the default.
+// An unknown gate or disabling a GA gate is an error.
+func SetFeatureGates(gates string) error {
+	overrides := map[string]bool{}
+	featureGatesLock.Lock()
+	defer featureGatesLock.Unlock()
+	for _, pair := range strings.Split(gates, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("feature gate %s is not in the Gate=true|false format", pair)
+		}
+		name := strings.TrimSpace(parts[0])
+		spec, ok := featureSpecs[name]
+		if !ok {
+			return fmt.Errorf("unknown feature gate %s", name)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid value of feature gate %s %v", name, err)
+		}
+		if spec.Stage == FeatureGA && !enabled {
+			return fmt.Errorf("feature gate %s is GA and cannot be disabled", name)
+		}
+		overrides[name] = enabled
+	}
+	featureOverrides = overrides
+	return nil
+}
+
+// FeatureEnabled returns whether a gate is enabled, an unknown gate is disabled
+func FeatureEnabled(name string) bool {
+	featureGatesLock.RLock()
+	defer featureGatesLock.RUnlock()
+	spec, ok := featureSpecs[name]
+	return ok && featureEnabled(name, spec)
+}
+
+func featureEnabled(name string, spec FeatureSpec) bool {
+	if enabled, ok := featureOverrides[name]; ok {
+		return enabled
+	}
+	return spec.Stage != FeatureAlpha
+}
+
+// GetFeatureGates returns the status of every gate sorted by name
+func GetFeatureGates() []FeatureGate {
+	featureGatesLock.RLock()
+	defer featureGatesLock.RUnlock()
+	gates := []FeatureGate{}
+	for name, spec := range featureSpecs {
+		gates = append(gates, FeatureGate{
+			Name:        name,
+			Stage:       spec.Stage,
+			Default:     spec.Stage != FeatureAlpha,
+			Enabled:     featureEnabled(name, spec),
+			Description: spec.Description,
+		})
+	}
+	sort.Slice(gates, func(i, j int) bool { return gates[i].Name < gates[j].Name })
+	return gates
+}
@@ -0,0 +1,107 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Guardrail of the tenant triggered operations
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the resources past their cooldown are pruned once the guard tracks this many resources
+const maxGuardResources = 10000
+
+// OperationGuard throttles an operation with a cooldown per resource and an hourly quota per tenant
+type OperationGuard struct {
+	cooldown time.Duration
+	hourly   int
+	last     map[string]time.Time
+	recent   map[string][]time.Time
+	lock     sync.Mutex
+	// Now is the clock, it can be replaced in tests
+	Now func() time.Time
+}
+
+// NewOperationGuard creates a guard, a zero cooldown or hourly quota is unlimited
+func NewOperationGuard(cooldown time.Duration, hourly int) *OperationGuard {
+	return &OperationGuard{
+		cooldown: cooldown,
+		hourly:   hourly,
+		last:     make(map[string]time.Time),
+		recent:   make(map[string][]time.Time),
+		Now:      time.Now,
+	}
+}
+
+// Allow records the operation on the resource of a tenant, or returns an error if the guard rejects it
+func (g *OperationGuard) Allow(tenant, resource string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.Now()
+
+	if last, ok := g.last[resource]; ok && g.cooldown > 0 && now.Sub(last) < g.cooldown {
+		return fmt.Errorf("the operation was triggered %v ago, retry after %v",
+			now.Sub(last).Truncate(time.Second), (g.cooldown - now.Sub(last)).Truncate(time.Second))
+	}
+
+	recent := g.recent[tenant][:0]
+	for _, t := range g.recent[tenant] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if g.hourly > 0 && len(recent) >= g.hourly {
+		g.recent[tenant] = recent
+		return fmt.Errorf("tenant %s has reached the limit of %d operations per hour", tenant, g.hourly)
+	}
+
+	if len(g.last) >= maxGuardResources {
+		for r, t := range g.last {
+			if now.Sub(t) >= g.cooldown {
+				delete(g.last, r)
+			}
+		}
+	}
+	g.recent[tenant] = append(recent, now)
+	g.last[resource] = now
+	return nil
+}
+
+// Release refunds the last allowed operation on the resource of a tenant, such as an operation failed upstream
+func (g *OperationGuard) Release(tenant, resource string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	last, ok := g.last[resource]
+	if !ok {
+		return
+	}
+	delete(g.last, resource)
+	recent := g.recent[tenant]
+	for i := len(recent) - 1; i >= 0; i-- {
+		if recent[i].Equal(last) {
+			g.recent[tenant] = append(recent[:i], recent[i+1:]...)
+			return
+		}
+	}
+}
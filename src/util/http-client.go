@@ -0,0 +1,210 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Shared HTTP client and connection pool to the brokers and function workers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultMaxIdleConns          = 256
+	defaultMaxIdleConnsPerHost   = 64
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultTLSSessionCacheSize   = 256
+	defaultUpstreamDialTimeout   = 10 * time.Second
+	defaultUpstreamDialKeepAlive = 30 * time.Second
+)
+
+// UpstreamPoolStats is a snapshot of the upstream connection pool counters
+type UpstreamPoolStats struct {
+	// Dials is the number of TCP connections established
+	Dials int64 `json:"dials"`
+	// OpenConns is the number of connections currently open, either idle or in use
+	OpenConns int64 `json:"openConns"`
+	// ReusedConns and NewConns are the number of requests served by a pooled or a new connection
+	ReusedConns int64 `json:"reusedConns"`
+	NewConns    int64 `json:"newConns"`
+	// TLSHandshakes and TLSResumed are the number of TLS handshakes and the ones resuming a session
+	TLSHandshakes int64 `json:"tlsHandshakes"`
+	TLSResumed    int64 `json:"tlsResumed"`
+}
+
+var (
+	upstreamStats      UpstreamPoolStats
+	upstreamClient     *http.Client
+	upstreamClientOnce sync.Once
+)
+
+// GetUpstreamPoolStats returns the upstream connection pool counters
+func GetUpstreamPoolStats() UpstreamPoolStats {
+	return UpstreamPoolStats{
+		Dials:         atomic.LoadInt64(&upstreamStats.Dials),
+		OpenConns:     atomic.LoadInt64(&upstreamStats.OpenConns),
+		ReusedConns:   atomic.LoadInt64(&upstreamStats.ReusedConns),
+		NewConns:      atomic.LoadInt64(&upstreamStats.NewConns),
+		TLSHandshakes: atomic.LoadInt64(&upstreamStats.TLSHandshakes),
+		TLSResumed:    atomic.LoadInt64(&upstreamStats.TLSResumed),
+	}
+}
+
+// UpstreamClient returns the http client shared by all calls to the brokers and function workers.
+// It keeps the authorization header for the redirects.
+func UpstreamClient() *http.Client {
+	upstreamClientOnce.Do(func() {
+		upstreamClient = &http.Client{
+			Transport:     NewTracingTransport(&poolTransport{transport: NewUpstreamRoundTripper(GetConfig().UpstreamPool, GetConfig().HTTP2)}),
+			CheckRedirect: PreserveHeaderForRedirect,
+		}
+	})
+	return upstreamClient
+}
+
+// NewUpstreamTransport creates a http transport tuned with the pool settings, a zero value takes the default
+func NewUpstreamTransport(pool UpstreamPool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   defaultUpstreamDialTimeout,
+		KeepAlive: defaultUpstreamDialKeepAlive,
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&upstreamStats.Dials, 1)
+			atomic.AddInt64(&upstreamStats.OpenConns, 1)
+			return &countedConn{Conn: conn}, nil
+		},
+		MaxIdleConns:          intOrDefault(pool.MaxIdleConns, defaultMaxIdleConns),
+		MaxIdleConnsPerHost:   intOrDefault(pool.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:       pool.MaxConnsPerHost,
+		IdleConnTimeout:       secondsOrDefault(pool.IdleConnTimeoutSeconds, defaultIdleConnTimeout),
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(intOrDefault(pool.TLSSessionCacheSize, defaultTLSSessionCacheSize)),
+		},
+	}
+}
+
+// NewUpstreamRoundTripper creates the upstream transport with the HTTP/2 toggles. The plaintext requests are sent
+// with HTTP/2 prior knowledge if h2c is enabled, and h2 is negotiated over TLS if the upstream HTTP/2 is enabled.
+func NewUpstreamRoundTripper(pool UpstreamPool, h2 HTTP2) http.RoundTripper {
+	transport := NewUpstreamTransport(pool)
+	transport.ForceAttemptHTTP2 = h2.Upstream
+	if !h2.UpstreamH2C {
+		return transport
+	}
+	return &h2cTransport{
+		transport: transport,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			// a plaintext dial in place of the TLS dial
+			DialTLS: func(network, address string, _ *tls.Config) (net.Conn, error) {
+				return transport.DialContext(context.Background(), network, address)
+			},
+		},
+	}
+}
+
+// h2cTransport sends the http requests with HTTP/2 prior knowledge and the https requests with the transport
+type h2cTransport struct {
+	transport *http.Transport
+	h2c       *http2.Transport
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of both transports
+func (t *h2cTransport) CloseIdleConnections() {
+	t.transport.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+// poolTransport counts the connection reuse and TLS resumption of every request
+type poolTransport struct {
+	transport http.RoundTripper
+}
+
+func (p *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&upstreamStats.ReusedConns, 1)
+			} else {
+				atomic.AddInt64(&upstreamStats.NewConns, 1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&upstreamStats.TLSHandshakes, 1)
+			if state.DidResume {
+				atomic.AddInt64(&upstreamStats.TLSResumed, 1)
+			}
+		},
+	}
+	if t, ok := req.Context().Value(timingsKey{}).(*RequestTimings); ok {
+		t.SetUpstream(req.URL.Host)
+	}
+	defer StartPhase(req.Context(), PhaseUpstream)()
+	return p.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the underlying transport
+func (p *poolTransport) CloseIdleConnections() {
+	if t, ok := p.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// countedConn decrements the open connection count once closed
+type countedConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&upstreamStats.OpenConns, -1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,274 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// HTTP server with timeouts, header limits, and TLS certificate reload
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 120 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultWriteTimeout      = 300 * time.Second
+	defaultMaxHeaderBytes    = 1 << 20
+	// DefaultMaxBodyBytes is the default maximum request body size
+	DefaultMaxBodyBytes = 10 << 20
+)
+
+// DefaultRouteMaxBodyBytes allows function, source, and sink package uploads if no route limit is configured
+var DefaultRouteMaxBodyBytes = map[string]int64{
+	"/admin/v3/functions": 256 << 20,
+	"/admin/v2/functions": 256 << 20,
+	"/admin/v3/sources":   256 << 20,
+	"/admin/v3/sinks":     256 << 20,
+}
+
+// NewHTTPServer creates a http server with the configured request limits.
+// A negative write timeout disables it, the streaming responses are not bound by it in either case.
+func NewHTTPServer(address string, handler http.Handler) *http.Server {
+	limits := GetConfig().RequestLimits
+	writeTimeout := secondsOrDefault(limits.WriteTimeoutSeconds, defaultWriteTimeout)
+	if limits.WriteTimeoutSeconds < 0 {
+		writeTimeout = 0
+	}
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: secondsOrDefault(limits.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeout),
+		ReadTimeout:       secondsOrDefault(limits.ReadTimeoutSeconds, defaultReadTimeout),
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       secondsOrDefault(limits.IdleTimeoutSeconds, defaultIdleTimeout),
+		MaxHeaderBytes:    intOrDefault(limits.MaxHeaderBytes, defaultMaxHeaderBytes),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, serverConnKey{}, conn)
+		},
+	}
+}
+
+// serverConnKey is the context key of the connection of a request
+type serverConnKey struct{}
+
+// StreamWriter is the response writer of a streaming response such as server sent events or a websocket.
+// It lifts the server write timeout off the connection and bounds every write with the timeout of the stream instead,
+// so a stream stays open as long as the client keeps reading. An HTTP/2 stream shares its connection with other
+// streams, so it is still ended by the server write timeout, and an event stream client reconnects.
+type StreamWriter struct {
+	http.ResponseWriter
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// NewStreamWriter wraps the response writer of a streaming request with the write timeout of the stream
+func NewStreamWriter(w http.ResponseWriter, r *http.Request, timeout time.Duration) *StreamWriter {
+	stream := &StreamWriter{ResponseWriter: w, timeout: timeout}
+	if conn, ok := r.Context().Value(serverConnKey{}).(net.Conn); ok && r.ProtoMajor == 1 {
+		stream.conn = conn
+	}
+	stream.extendDeadline()
+	return stream
+}
+
+func (s *StreamWriter) extendDeadline() {
+	if s.conn != nil {
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+}
+
+// Write writes the response body within the write timeout of the stream
+func (s *StreamWriter) Write(data []byte) (int, error) {
+	s.extendDeadline()
+	return s.ResponseWriter.Write(data)
+}
+
+// Flush sends the buffered data to the client within the write timeout of the stream
+func (s *StreamWriter) Flush() {
+	s.extendDeadline()
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection of a websocket upgrade, the writes without a deadline of their own
+// are bounded by the write timeout of the stream
+func (s *StreamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack is not supported")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &streamConn{Conn: conn, timeout: s.timeout}, rw, nil
+}
+
+// streamConn is a hijacked connection, a websocket sets the deadline before every write
+// and a write without a deadline is bounded by the timeout of the stream
+type streamConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *streamConn) Write(data []byte) (int, error) {
+	if c.deadline.IsZero() {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(data)
+}
+
+// ListenAndServeTLS listens HTTP, or HTTPS if both the cert and key files are specified.
+// The cert and key files are reloaded when both are updated.
+func ListenAndServeTLS(address, certFile, keyFile string, handler http.Handler) error {
+	server := NewHTTPServer(address, handler)
+	if len(certFile) <= 1 || len(keyFile) <= 1 {
+		if GetConfig().HTTP2.ListenerH2C {
+			server.Handler = NewH2CHandler(handler, server)
+		}
+		return server.ListenAndServe()
+	}
+
+	tlsConfig, err := NewReloadableTLSConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	if GetConfig().HTTP2.DisableListener {
+		// a non-nil empty map keeps the server from enabling h2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return server.ServeTLS(l, "", "")
+}
+
+// NewH2CHandler serves HTTP/2 with prior knowledge on a plaintext listener besides HTTP/1.1,
+// the HTTP/2 connections are closed after the idle timeout of the server
+func NewH2CHandler(handler http.Handler, server *http.Server) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{IdleTimeout: server.IdleTimeout})
+}
+
+// NewReloadableTLSConfig creates a server TLS config whose certificate is reloaded when both the cert and key files are updated
+func NewReloadableTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	var cert atomic.Value
+	load := func() error {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Errorf("failed to load x509 key pair %v", err)
+			return err
+		}
+		cert.Store(c)
+		log.Infof("loaded cert %s and key %s", certFile, keyFile)
+		return nil
+	}
+	if err := load(); err != nil {
+		return nil, err
+	}
+	go watchCertFiles(certFile, keyFile, load)
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, ok := cert.Load().(tls.Certificate)
+			if !ok {
+				return nil, fmt.Errorf("unable to load cert")
+			}
+			return &c, nil
+		},
+	}
+	// the client certificates of the tokens bound to a certificate
+	if caFile := GetConfig().TokenBinding.ClientCAFile; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no client CA certificate is found in %s", caFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// watchCertFiles reloads the cert and key once both files are modified
+func watchCertFiles(certFile, keyFile string, load func() error) {
+	modTime := func(file string) time.Time {
+		if stat, err := os.Stat(file); err == nil {
+			return stat.ModTime()
+		}
+		return time.Time{}
+	}
+	certTime, keyTime := modTime(certFile), modTime(keyFile)
+	ticker := time.NewTicker(1 * time.Second)
+	for range ticker.C {
+		newCertTime, newKeyTime := modTime(certFile), modTime(keyFile)
+		if newCertTime != certTime && newKeyTime != keyTime {
+			certTime, keyTime = newCertTime, newKeyTime
+			load()
+		}
+	}
+}
+
+func secondsOrDefault(seconds int, defaultValue time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultValue
+}
+
+func intOrDefault(v, defaultValue int) int {
+	if v > 0 {
+		return v
+	}
+	return defaultValue
+}
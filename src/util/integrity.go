@@ -0,0 +1,84 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Integrity of the records shared by the replicas through the shared cache and the topics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// macSize is the length of a hex encoded HMAC-SHA256
+const macSize = sha256.Size * 2
+
+// IntegrityKeyConfigured returns whether the IntegrityKey is configured
+func IntegrityKeyConfigured() bool {
+	secretLock.RLock()
+	defer secretLock.RUnlock()
+	return GetConfig().IntegrityKey != ""
+}
+
+// RecordMAC returns the hex encoded HMAC of a record bound to its name, or an empty string if the IntegrityKey
+// is not configured
+func RecordMAC(name string, data []byte) string {
+	secretLock.RLock()
+	key := GetConfig().IntegrityKey
+	secretLock.RUnlock()
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRecordMAC checks the HMAC of a record, it always fails if the IntegrityKey is not configured
+func VerifyRecordMAC(name string, data []byte, mac string) bool {
+	expected := RecordMAC(name, data)
+	return expected != "" && hmac.Equal([]byte(expected), []byte(mac))
+}
+
+// SharedCacheSetSigned sets a value that is only trusted with a valid HMAC, nothing is shared without the IntegrityKey
+func SharedCacheSetSigned(key string, value []byte, ttl time.Duration) {
+	mac := RecordMAC(key, value)
+	if mac == "" {
+		return
+	}
+	SharedCacheSet(key, append([]byte(mac), value...), ttl)
+}
+
+// SharedCacheGetSigned gets a value set by SharedCacheSetSigned, a value with an invalid HMAC is a miss
+func SharedCacheGetSigned(key string) ([]byte, bool) {
+	if !IntegrityKeyConfigured() {
+		return nil, false
+	}
+	data, ok := SharedCacheGet(key)
+	if !ok || len(data) < macSize || !VerifyRecordMAC(key, data[macSize:], string(data[:macSize])) {
+		return nil, false
+	}
+	return data[macSize:], true
+}
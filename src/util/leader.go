@@ -0,0 +1,97 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Leader state of the singleton background loops across replicas
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// LeaderState is the leader election state of this replica
+type LeaderState struct {
+	Enabled  bool   `json:"enabled"`
+	Identity string `json:"identity"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"isLeader"`
+}
+
+var leader = struct {
+	sync.RWMutex
+	state LeaderState
+}{}
+
+// LeaderIdentity is the identity of this replica in the election, the replica address lets the followers
+// forward the requests served from the leader state
+func LeaderIdentity() string {
+	if GetConfig().ReplicaAddress != "" {
+		return GetConfig().ReplicaAddress
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	id, _ := NewUUID()
+	return id
+}
+
+// EnableLeaderElection makes this replica a follower until it is elected, otherwise every replica is a leader
+func EnableLeaderElection(identity string) {
+	leader.Lock()
+	leader.state = LeaderState{Enabled: true, Identity: identity}
+	leader.Unlock()
+}
+
+// SetLeader records the current leader reported by the election
+func SetLeader(current string) {
+	leader.Lock()
+	defer leader.Unlock()
+	leader.state.Leader = current
+	leader.state.IsLeader = current != "" && current == leader.state.Identity
+}
+
+// IsLeader returns whether this replica runs the singleton loops, it is always true without the election
+func IsLeader() bool {
+	leader.RLock()
+	defer leader.RUnlock()
+	return !leader.state.Enabled || leader.state.IsLeader
+}
+
+// GetLeaderState returns the leader election state
+func GetLeaderState() LeaderState {
+	leader.RLock()
+	defer leader.RUnlock()
+	return leader.state
+}
+
+// LeaderAddress returns the address of the leader if this replica is a follower and the leader identity is an address
+func LeaderAddress() string {
+	state := GetLeaderState()
+	if !state.Enabled || state.IsLeader {
+		return ""
+	}
+	if strings.HasPrefix(state.Leader, "http://") || strings.HasPrefix(state.Leader, "https://") {
+		return state.Leader
+	}
+	return ""
+}
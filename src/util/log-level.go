@@ -0,0 +1,196 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Runtime log level of the process and the modules
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// ModuleField is the log field that names the module of an entry
+const ModuleField = "module"
+
+// DefaultLogLevelRevert is the duration of a runtime log level change
+const DefaultLogLevelRevert = 30 * time.Minute
+
+// LogLevelState is the current log level of the process and the modules
+type LogLevelState struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+	// RevertAt is the time the configured log level is restored, zero if not scheduled
+	RevertAt time.Time `json:"revertAt,omitempty"`
+}
+
+var levels = struct {
+	sync.RWMutex
+	base     log.Level
+	modules  map[string]log.Level
+	revert   *time.Timer
+	revertAt time.Time
+	// generation invalidates a revert timer superseded by a later change
+	generation int
+}{base: log.InfoLevel, modules: map[string]log.Level{}}
+
+// ModuleLogger returns a log entry of a module, whose level can be changed at runtime independently
+func ModuleLogger(module string) *log.Entry {
+	return log.WithField(ModuleField, module)
+}
+
+// SetLogLevel sets the log level of the modules, or the process if no module is specified.
+// The configured log level is restored after revertAfter, which never reverts if zero.
+func SetLogLevel(level log.Level, modules []string, revertAfter time.Duration) {
+	levels.Lock()
+	if len(modules) == 0 {
+		levels.base = level
+	}
+	for _, m := range modules {
+		levels.modules[strings.TrimSpace(m)] = level
+	}
+	applyLogLevel()
+
+	stopRevert()
+	if revertAfter > 0 {
+		generation := levels.generation
+		levels.revertAt = time.Now().Add(revertAfter)
+		levels.revert = time.AfterFunc(revertAfter, func() {
+			levels.Lock()
+			reverted := generation == levels.generation
+			if reverted {
+				resetLogLevel()
+			}
+			levels.Unlock()
+			if reverted {
+				log.Warnf("reverted to the configured log level %s", logLevel(GetConfig().LogLevel))
+			}
+		})
+	}
+	levels.Unlock()
+	// the level handler acquires the lock
+	log.Warnf("log level set to %s for %s, revert after %v", level, moduleNames(modules), revertAfter)
+}
+
+// ResetLogLevel restores the configured log level and clears the module levels
+func ResetLogLevel() {
+	levels.Lock()
+	defer levels.Unlock()
+	resetLogLevel()
+}
+
+func resetLogLevel() {
+	stopRevert()
+	levels.base, levels.modules = logLevel(GetConfig().LogLevel), map[string]log.Level{}
+	applyLogLevel()
+}
+
+func stopRevert() {
+	if levels.revert != nil {
+		levels.revert.Stop()
+	}
+	levels.revert, levels.revertAt = nil, time.Time{}
+	levels.generation++
+}
+
+// GetLogLevel returns the current log level state
+func GetLogLevel() LogLevelState {
+	levels.RLock()
+	defer levels.RUnlock()
+	state := LogLevelState{Level: levels.base.String(), Modules: map[string]string{}, RevertAt: levels.revertAt}
+	for m, l := range levels.modules {
+		state.Modules[m] = l.String()
+	}
+	return state
+}
+
+// applyLogLevel lets apex emit the entries of the lowest level, the level handler filters the rest
+func applyLogLevel() {
+	lowest := levels.base
+	for _, l := range levels.modules {
+		if l < lowest {
+			lowest = l
+		}
+	}
+	log.SetLevel(lowest)
+}
+
+// levelHandler drops the entries below the level of their module, or the process level without a module
+type levelHandler struct {
+	next log.Handler
+}
+
+func (h *levelHandler) HandleLog(e *log.Entry) error {
+	levels.RLock()
+	level := levels.base
+	if module, ok := e.Fields[ModuleField].(string); ok {
+		if l, ok := levels.modules[module]; ok {
+			level = l
+		}
+	}
+	levels.RUnlock()
+	if e.Level < level {
+		return nil
+	}
+	return h.next.HandleLog(e)
+}
+
+func moduleNames(modules []string) string {
+	if len(modules) == 0 {
+		return "all modules"
+	}
+	sorted := append([]string{}, modules...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("modules %s", strings.Join(sorted, ","))
+}
+
+// HandleLogLevelSignals switches to the debug level on SIGUSR1 until the revert duration,
+// and restores the configured log level on SIGUSR2
+func HandleLogLevelSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGUSR1 {
+				SetLogLevel(log.DebugLevel, nil, LogLevelRevert())
+			} else {
+				ResetLogLevel()
+				log.Warnf("restored the configured log level on %v", s)
+			}
+		}
+	}()
+}
+
+// LogLevelRevert is the configured duration of a runtime log level change
+func LogLevelRevert() time.Duration {
+	if GetConfig().LogLevelRevertMinutes > 0 {
+		return time.Duration(GetConfig().LogLevelRevertMinutes) * time.Minute
+	}
+	return DefaultLogLevelRevert
+}
@@ -0,0 +1,117 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Structured logging setup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	stdlog "log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/json"
+)
+
+// LogFormatJSON emits every log entry as one json object per line
+const LogFormatJSON = "json"
+
+// defaultLogHandler is the apex handler of the text format
+var defaultLogHandler log.Handler
+
+func init() {
+	if logger, ok := log.Log.(*log.Logger); ok {
+		defaultLogHandler = logger.Handler
+	}
+}
+
+// InitLogging sets up the log handler according to the LogFormat and LogFields configuration.
+func InitLogging() {
+	SetLogOutput(os.Stderr)
+}
+
+// SetLogOutput sets up the log handler. The json format writes to w; the text format keeps the default apex handler.
+// The entries are filtered by the runtime log level of their modules.
+func SetLogOutput(w io.Writer) {
+	handler := defaultLogHandler
+	jsonFormat := strings.EqualFold(strings.TrimSpace(GetConfig().LogFormat), LogFormatJSON)
+	if jsonFormat {
+		handler = json.New(w)
+	}
+	if len(GetConfig().LogFields) > 0 {
+		handler = &fieldsHandler{fields: GetConfig().LogFields, next: handler}
+	}
+	if handler != nil {
+		log.SetHandler(&levelHandler{next: handler})
+	}
+
+	if jsonFormat {
+		// the standard library logger is redirected so that every line is a json object
+		stdlog.SetFlags(0)
+		stdlog.SetOutput(stdLogWriter{})
+	} else {
+		stdlog.SetFlags(stdlog.LstdFlags)
+		stdlog.SetOutput(os.Stderr)
+	}
+}
+
+// fieldsHandler adds the static fields to every log entry
+type fieldsHandler struct {
+	fields map[string]string
+	next   log.Handler
+}
+
+func (h *fieldsHandler) HandleLog(e *log.Entry) error {
+	fields := make(log.Fields, len(e.Fields)+len(h.fields))
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	entry := *e
+	entry.Fields = fields
+	return h.next.HandleLog(&entry)
+}
+
+// stdLogWriter writes the standard library log lines as info level entries
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	log.Info(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+// NewRequestID returns a random 16 byte hex request id
+func NewRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
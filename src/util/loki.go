@@ -0,0 +1,264 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Grafana Loki push client, the lines are batched per stream and retried with backoff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	defaultLokiBatchSize  = 500
+	defaultLokiBatchWait  = time.Second
+	defaultLokiBufferSize = 10000
+	lokiMinBackoff        = time.Second
+	lokiMaxBackoff        = 30 * time.Second
+	lokiMaxRetries        = 5
+)
+
+// LokiStats are the counters of the Loki push clients
+type LokiStats struct {
+	Pushed  uint64 `json:"pushed"`
+	Dropped uint64 `json:"dropped"`
+	Retries uint64 `json:"retries"`
+}
+
+var lokiPushed, lokiDropped, lokiRetries uint64
+
+// GetLokiStats returns the counters of all the Loki push clients
+func GetLokiStats() LokiStats {
+	return LokiStats{
+		Pushed:  atomic.LoadUint64(&lokiPushed),
+		Dropped: atomic.LoadUint64(&lokiDropped),
+		Retries: atomic.LoadUint64(&lokiRetries),
+	}
+}
+
+type lokiEntry struct {
+	labels map[string]string
+	time   time.Time
+	line   string
+}
+
+// LokiClient pushes the lines in the background. A push is sent once a batch is full or the oldest line waited
+// for the batch wait. A failed push is retried with backoff, a push rejected with a client error is dropped.
+type LokiClient struct {
+	cfg       Loki
+	batchSize int
+	batchWait time.Duration
+	size      int
+	client    *http.Client
+
+	lock    sync.Mutex
+	entries []lokiEntry
+	signal  chan struct{}
+}
+
+// NewLokiClient creates a client pushing to the configured URL with the job label
+func NewLokiClient(cfg Loki, job string) *LokiClient {
+	c := &LokiClient{
+		cfg:       cfg,
+		batchSize: cfg.BatchSize,
+		batchWait: time.Duration(cfg.BatchWaitMs) * time.Millisecond,
+		size:      cfg.BufferSize,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		signal:    make(chan struct{}, 1),
+	}
+	if c.batchSize <= 0 {
+		c.batchSize = defaultLokiBatchSize
+	}
+	if c.batchWait <= 0 {
+		c.batchWait = defaultLokiBatchWait
+	}
+	if c.size <= 0 {
+		c.size = defaultLokiBufferSize
+	}
+	c.cfg.Labels = map[string]string{"job": job}
+	for k, v := range cfg.Labels {
+		c.cfg.Labels[k] = v
+	}
+	go c.run()
+	return c
+}
+
+// Push buffers a line of the stream with the labels, it never blocks on Loki. The empty labels are left out.
+func (c *LokiClient) Push(labels map[string]string, t time.Time, line string) {
+	c.lock.Lock()
+	c.entries = append(c.entries, lokiEntry{labels: labels, time: t, line: line})
+	if over := len(c.entries) - c.size; over > 0 {
+		c.entries = c.entries[over:]
+		atomic.AddUint64(&lokiDropped, uint64(over))
+	}
+	full := len(c.entries) >= c.batchSize
+	c.lock.Unlock()
+	if full {
+		select {
+		case c.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *LokiClient) run() {
+	ticker := time.NewTicker(c.batchWait)
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.signal:
+		}
+		for {
+			c.lock.Lock()
+			n := len(c.entries)
+			if n > c.batchSize {
+				n = c.batchSize
+			}
+			batch := append([]lokiEntry{}, c.entries[:n]...)
+			c.entries = c.entries[n:]
+			c.lock.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+			c.send(batch)
+			if len(batch) < c.batchSize {
+				break
+			}
+		}
+	}
+}
+
+// send pushes a batch with retries, the batch is dropped after the last retry
+func (c *LokiClient) send(batch []lokiEntry) {
+	body, err := c.payload(batch)
+	if err != nil {
+		log.Errorf("failed to marshal loki push %v", err)
+		atomic.AddUint64(&lokiDropped, uint64(len(batch)))
+		return
+	}
+	backoff := lokiMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := c.post(body)
+		if err == nil {
+			atomic.AddUint64(&lokiPushed, uint64(len(batch)))
+			return
+		}
+		if !retry || attempt >= lokiMaxRetries {
+			log.Errorf("dropped %d lines of loki job %s error %v", len(batch), c.cfg.Labels["job"], err)
+			atomic.AddUint64(&lokiDropped, uint64(len(batch)))
+			return
+		}
+		atomic.AddUint64(&lokiRetries, 1)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > lokiMaxBackoff {
+			backoff = lokiMaxBackoff
+		}
+	}
+}
+
+// payload groups the lines by stream into the json body of the push API
+func (c *LokiClient) payload(batch []lokiEntry) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*stream{}
+	keys := []string{}
+	for _, e := range batch {
+		labels := make(map[string]string, len(c.cfg.Labels)+len(e.labels))
+		for k, v := range c.cfg.Labels {
+			labels[k] = v
+		}
+		for k, v := range e.labels {
+			if v != "" {
+				labels[k] = v
+			}
+		}
+		key := lokiStreamKey(labels)
+		s, ok := streams[key]
+		if !ok {
+			s = &stream{Stream: labels}
+			streams[key] = s
+			keys = append(keys, key)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+	}
+	push := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		push.Streams = append(push.Streams, streams[key])
+	}
+	return json.Marshal(push)
+}
+
+// post sends a push, it returns whether a failed push can be retried
+func (c *LokiClient) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.cfg.OrgID != "" {
+		req.Header.Set("X-Scope-OrgID", c.cfg.OrgID)
+	}
+	if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < http.StatusMultipleChoices {
+		return false, nil
+	}
+	err = fmt.Errorf("loki responded %d", resp.StatusCode)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError, err
+}
+
+// lokiStreamKey is the label set in the sorted order of the names
+func lokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "=" + strconv.Quote(labels[name]) + ",")
+	}
+	return b.String()
+}
@@ -0,0 +1,179 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Global memory budget of the in-memory caches. Every cache tracks the size of its entries in a single LRU,
+// the least recently used entries across the caches are evicted once the tracked size exceeds the budget.
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// MemoryBudgetStats is a snapshot of the cache memory budget
+type MemoryBudgetStats struct {
+	// BudgetBytes is the configured budget, 0 is unlimited
+	BudgetBytes int64 `json:"budgetBytes"`
+	// Bytes and Entries are the tracked size and number of entries per cache
+	Bytes   map[string]int64 `json:"bytes"`
+	Entries map[string]int64 `json:"entries"`
+	// Evictions is the number of entries evicted per cache
+	Evictions map[string]int64 `json:"evictions"`
+}
+
+type budgetEntry struct {
+	cache string
+	key   string
+	size  int64
+}
+
+var (
+	budgetLock     = sync.Mutex{}
+	budgetLRU      = list.New()
+	budgetItems    = make(map[budgetKey]*list.Element)
+	budgetBytes    int64
+	budgetEvictors = make(map[string]func(key string))
+	budgetCaches   = make(map[string]*cacheBudgetStats)
+)
+
+type budgetKey struct {
+	cache, key string
+}
+
+type cacheBudgetStats struct {
+	bytes, entries, evictions int64
+}
+
+func cacheMemoryBudget() int64 {
+	return int64(GetConfig().CacheMemoryBudgetMB) * 1024 * 1024
+}
+
+// RegisterBudgetedCache registers the eviction function of a cache, the function must remove the entry
+// of the key from the cache without calling back into the budget
+func RegisterBudgetedCache(cache string, evict func(key string)) {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	budgetEvictors[cache] = evict
+	if _, ok := budgetCaches[cache]; !ok {
+		budgetCaches[cache] = &cacheBudgetStats{}
+	}
+}
+
+// TrackCacheEntry records the size of a new or updated cache entry as the most recently used one,
+// then it evicts the least recently used entries over the budget. It must not be called with a cache lock held.
+func TrackCacheEntry(cache, key string, size int64) {
+	budgetLock.Lock()
+	k := budgetKey{cache, key}
+	stats := budgetCaches[cache]
+	if stats == nil {
+		stats = &cacheBudgetStats{}
+		budgetCaches[cache] = stats
+	}
+	if e, ok := budgetItems[k]; ok {
+		entry := e.Value.(*budgetEntry)
+		budgetBytes += size - entry.size
+		stats.bytes += size - entry.size
+		entry.size = size
+		budgetLRU.MoveToFront(e)
+	} else {
+		budgetItems[k] = budgetLRU.PushFront(&budgetEntry{cache: cache, key: key, size: size})
+		budgetBytes += size
+		stats.bytes += size
+		stats.entries++
+	}
+
+	var evicted []budgetEntry
+	if budget := cacheMemoryBudget(); budget > 0 {
+		// the entry just tracked is kept even if it exceeds the budget alone
+		for budgetBytes > budget && budgetLRU.Len() > 1 {
+			entry := removeBudgetEntry(budgetLRU.Back())
+			budgetCaches[entry.cache].evictions++
+			evicted = append(evicted, *entry)
+		}
+	}
+	evictors := make([]func(string), len(evicted))
+	for i, entry := range evicted {
+		evictors[i] = budgetEvictors[entry.cache]
+	}
+	budgetLock.Unlock()
+
+	for i, entry := range evicted {
+		if evictors[i] != nil {
+			evictors[i](entry.key)
+		}
+	}
+	if len(evicted) > 0 {
+		log.Infof("evicted %d cache entries over the cache memory budget of %d MB", len(evicted), GetConfig().CacheMemoryBudgetMB)
+	}
+}
+
+// TouchCacheEntry marks a cache entry as the most recently used one. The order only matters to the evictions,
+// so the hot read paths skip the lock without a budget.
+func TouchCacheEntry(cache, key string) {
+	if cacheMemoryBudget() <= 0 {
+		return
+	}
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	if e, ok := budgetItems[budgetKey{cache, key}]; ok {
+		budgetLRU.MoveToFront(e)
+	}
+}
+
+// ForgetCacheEntry stops tracking an entry removed from its cache
+func ForgetCacheEntry(cache, key string) {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	if e, ok := budgetItems[budgetKey{cache, key}]; ok {
+		removeBudgetEntry(e)
+	}
+}
+
+func removeBudgetEntry(e *list.Element) *budgetEntry {
+	entry := budgetLRU.Remove(e).(*budgetEntry)
+	delete(budgetItems, budgetKey{entry.cache, entry.key})
+	budgetBytes -= entry.size
+	stats := budgetCaches[entry.cache]
+	stats.bytes -= entry.size
+	stats.entries--
+	return entry
+}
+
+// GetMemoryBudgetStats returns the tracked size, entries, and evictions per cache
+func GetMemoryBudgetStats() MemoryBudgetStats {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	stats := MemoryBudgetStats{
+		BudgetBytes: cacheMemoryBudget(),
+		Bytes:       make(map[string]int64, len(budgetCaches)),
+		Entries:     make(map[string]int64, len(budgetCaches)),
+		Evictions:   make(map[string]int64, len(budgetCaches)),
+	}
+	for cache, s := range budgetCaches {
+		stats.Bytes[cache] = s.bytes
+		stats.Entries[cache] = s.entries
+		stats.Evictions[cache] = s.evictions
+	}
+	return stats
+}
@@ -0,0 +1,142 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Pulsar message ids in the text and the websocket forms
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MessageID is the position of a message in a topic. Partition and BatchIndex are -1 if not applicable.
+type MessageID struct {
+	LedgerID   int64 `json:"ledgerId"`
+	EntryID    int64 `json:"entryId"`
+	Partition  int32 `json:"partitionIndex"`
+	BatchIndex int32 `json:"batchIndex"`
+}
+
+// ParseMessageID parses a message id in the `ledgerId:entryId[:partition[:batchIndex]]` form of the Pulsar admin
+// API and CLI, or the base64 encoded MessageIdData of the Pulsar websocket API
+func ParseMessageID(s string) (MessageID, error) {
+	id := MessageID{Partition: -1, BatchIndex: -1}
+	if parts := strings.Split(s, ":"); len(parts) >= 2 && len(parts) <= 4 {
+		values := []int64{0, 0, -1, -1}
+		for i, part := range parts {
+			v, err := strconv.ParseInt(part, 10, 64)
+			if err != nil || v < -1 || (i < 2 && v < 0) || (i >= 2 && v > int64(^uint32(0)>>1)) {
+				return id, fmt.Errorf("invalid message id %s", s)
+			}
+			values[i] = v
+		}
+		id.LedgerID, id.EntryID, id.Partition, id.BatchIndex = values[0], values[1], int32(values[2]), int32(values[3])
+		return id, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		if data, err = base64.URLEncoding.DecodeString(s); err != nil {
+			return id, fmt.Errorf("invalid message id %s", s)
+		}
+	}
+	var fields int
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 || typ != protowire.VarintType {
+			return id, fmt.Errorf("invalid message id %s", s)
+		}
+		data = data[n:]
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return id, fmt.Errorf("invalid message id %s", s)
+		}
+		data = data[n:]
+		switch num {
+		case 1:
+			id.LedgerID = int64(v)
+			fields |= 1
+		case 2:
+			id.EntryID = int64(v)
+			fields |= 2
+		case 3:
+			id.Partition = int32(v)
+		case 4:
+			id.BatchIndex = int32(v)
+		}
+	}
+	if fields != 3 || id.LedgerID < 0 || id.EntryID < 0 {
+		return id, fmt.Errorf("invalid message id %s", s)
+	}
+	return id, nil
+}
+
+// String returns the message id in the form of the Pulsar admin API
+func (id MessageID) String() string {
+	s := fmt.Sprintf("%d:%d", id.LedgerID, id.EntryID)
+	if id.Partition >= 0 || id.BatchIndex >= 0 {
+		s += fmt.Sprintf(":%d", id.Partition)
+	}
+	if id.BatchIndex >= 0 {
+		s += fmt.Sprintf(":%d", id.BatchIndex)
+	}
+	return s
+}
+
+// Base64 returns the base64 encoded MessageIdData accepted by the messageId parameter of the Pulsar websocket API
+func (id MessageID) Base64() string {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(id.LedgerID))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(id.EntryID))
+	// the optional fields default to -1 and are omitted
+	if id.Partition >= 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(id.Partition))
+	}
+	if id.BatchIndex >= 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(id.BatchIndex))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+var partitionIndex = regexp.MustCompile(`-partition-(\d+)$`)
+
+// TopicPartitionIndex returns the partition index of a partition topic name, or -1 if the name is not a partition
+func TopicPartitionIndex(topic string) int32 {
+	m := partitionIndex.FindStringSubmatch(topic)
+	if m == nil {
+		return -1
+	}
+	index, err := strconv.ParseInt(m[1], 10, 32)
+	if err != nil {
+		return -1
+	}
+	return int32(index)
+}
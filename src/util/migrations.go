@@ -0,0 +1,124 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Versioned schema migrations of the persistent stores. A numbered migration upgrades the JSON document of a store
+// from the previous version and downgrades it back, so a release upgrade or rollback needs no manual edits of the
+// store topics or the shared cache. Version 1 is the baseline of the records written before the migrations.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// PolicySchema is the schema of the policy stores, a document is a policy store snapshot
+	PolicySchema = "policy"
+	// UsageSchema is the schema of the usage rollups in the shared cache, a document is the rollup of a tenant
+	UsageSchema = "usage"
+
+	// BaselineSchemaVersion is the version of the stores without an applied migration
+	BaselineSchemaVersion = 1
+)
+
+// Migration changes the document of a store between the previous version and its version.
+// Down is nil if the migration cannot be reverted.
+type Migration struct {
+	Version     int                                    `json:"version"`
+	Description string                                 `json:"description"`
+	Up          func(doc map[string]interface{}) error `json:"-"`
+	Down        func(doc map[string]interface{}) error `json:"-"`
+}
+
+var migrations = struct {
+	sync.RWMutex
+	stores map[string][]Migration
+}{stores: map[string][]Migration{PolicySchema: nil, UsageSchema: nil}}
+
+// RegisterMigration adds the next migration of a store, the versions of a store are numbered from 2 without gaps.
+// It must be called before the stores are loaded.
+func RegisterMigration(store string, m Migration) {
+	migrations.Lock()
+	defer migrations.Unlock()
+	next := BaselineSchemaVersion + len(migrations.stores[store]) + 1
+	if m.Version != next {
+		panic(fmt.Sprintf("migration %d of the %s schema is out of order, the next version is %d", m.Version, store, next))
+	}
+	if m.Up == nil {
+		panic(fmt.Sprintf("migration %d of the %s schema has no upgrade", m.Version, store))
+	}
+	migrations.stores[store] = append(migrations.stores[store], m)
+}
+
+// LatestSchemaVersion is the version of a store written by this release
+func LatestSchemaVersion(store string) int {
+	migrations.RLock()
+	defer migrations.RUnlock()
+	return BaselineSchemaVersion + len(migrations.stores[store])
+}
+
+// SchemaStores returns the stores with a schema in the name order
+func SchemaStores() []string {
+	migrations.RLock()
+	defer migrations.RUnlock()
+	stores := make([]string, 0, len(migrations.stores))
+	for store := range migrations.stores {
+		stores = append(stores, store)
+	}
+	sort.Strings(stores)
+	return stores
+}
+
+// ListMigrations returns the migrations of a store in the version order
+func ListMigrations(store string) []Migration {
+	migrations.RLock()
+	defer migrations.RUnlock()
+	return append([]Migration{}, migrations.stores[store]...)
+}
+
+// MigrateDocument upgrades or downgrades the document of a store from a version to another in place
+func MigrateDocument(store string, doc map[string]interface{}, from, to int) error {
+	list := ListMigrations(store)
+	latest := BaselineSchemaVersion + len(list)
+	if from < BaselineSchemaVersion || from > latest {
+		return fmt.Errorf("%s schema version %d is not between %d and %d", store, from, BaselineSchemaVersion, latest)
+	}
+	if to < BaselineSchemaVersion || to > latest {
+		return fmt.Errorf("%s schema version %d is not between %d and %d", store, to, BaselineSchemaVersion, latest)
+	}
+	for v := from + 1; v <= to; v++ {
+		if err := list[v-BaselineSchemaVersion-1].Up(doc); err != nil {
+			return fmt.Errorf("migration %d of the %s schema failed %v", v, store, err)
+		}
+	}
+	for v := from; v > to; v-- {
+		m := list[v-BaselineSchemaVersion-1]
+		if m.Down == nil {
+			return fmt.Errorf("migration %d of the %s schema cannot be reverted", v, store)
+		}
+		if err := m.Down(doc); err != nil {
+			return fmt.Errorf("revert of migration %d of the %s schema failed %v", v, store, err)
+		}
+	}
+	return nil
+}
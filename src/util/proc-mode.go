@@ -32,6 +32,18 @@ const Initializer = "init"
 // Healer repairs any misconfiguration in an already deployed cluster
 const Healer = "healer"
 
+// Bootstrap creates the resources of the bootstrap manifest that are missing and exits
+const Bootstrap = "bootstrap"
+
+// Backup writes a snapshot of the policy stores to a file and exits
+const Backup = "backup"
+
+// Restore restores the policy stores from a snapshot file and exits
+const Restore = "restore"
+
+// Migrate migrates the policy stores to a schema version and exits
+const Migrate = "migrate"
+
 // IsInitializer check if the broker is required
 func IsInitializer(mode *string) bool {
 	return *mode == Initializer
@@ -41,3 +53,23 @@ func IsInitializer(mode *string) bool {
 func IsHealer(mode *string) bool {
 	return *mode == Healer
 }
+
+// IsBootstrap is the process mode bootstrap
+func IsBootstrap(mode *string) bool {
+	return *mode == Bootstrap
+}
+
+// IsBackup is the process mode backup
+func IsBackup(mode *string) bool {
+	return *mode == Backup
+}
+
+// IsRestore is the process mode restore
+func IsRestore(mode *string) bool {
+	return *mode == Restore
+}
+
+// IsMigrate is the process mode migrate
+func IsMigrate(mode *string) bool {
+	return *mode == Migrate
+}
@@ -0,0 +1,158 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Request latency breakdown and slow request detection
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// phases of a request
+const (
+	PhaseAuth          = "auth"
+	PhasePolicy        = "policy"
+	PhaseUpstream      = "upstream"
+	PhaseSerialization = "serialization"
+)
+
+// DefaultSlowRequestThreshold is the latency over which a request is slow
+const DefaultSlowRequestThreshold = 2 * time.Second
+
+type timingsKey struct{}
+
+// RequestTimings accumulates the time spent in each phase of a request
+type RequestTimings struct {
+	lock     sync.Mutex
+	phases   map[string]time.Duration
+	upstream string
+}
+
+// RequestObservation is the latency of a completed request
+type RequestObservation struct {
+	// Route is the path template of the matched route, or the request path if Matched is false
+	Route    string
+	Matched  bool
+	Subject  string
+	Method   string
+	Status   int
+	Duration time.Duration
+	Phases   map[string]time.Duration
+	Slow     bool
+}
+
+var (
+	requestObserver     func(RequestObservation)
+	requestObserverLock sync.RWMutex
+)
+
+// WithRequestTimings returns a context that collects the phase timings of a request,
+// the timings already in the context are reused.
+func WithRequestTimings(ctx context.Context) (context.Context, *RequestTimings) {
+	if t, ok := ctx.Value(timingsKey{}).(*RequestTimings); ok {
+		return ctx, t
+	}
+	t := &RequestTimings{phases: make(map[string]time.Duration)}
+	return context.WithValue(ctx, timingsKey{}, t), t
+}
+
+// StartPhase starts timing a phase of the request, the returned function ends it.
+// It is a no-op if the context does not collect timings.
+func StartPhase(ctx context.Context, phase string) func() {
+	t, ok := ctx.Value(timingsKey{}).(*RequestTimings)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.Add(phase, time.Since(start))
+	}
+}
+
+// Add adds the duration to a phase, a phase can be entered many times such as multiple upstream calls
+func (t *RequestTimings) Add(phase string, d time.Duration) {
+	t.lock.Lock()
+	t.phases[phase] += d
+	t.lock.Unlock()
+}
+
+// SetUpstream records the upstream host last called by the request
+func (t *RequestTimings) SetUpstream(host string) {
+	t.lock.Lock()
+	t.upstream = host
+	t.lock.Unlock()
+}
+
+// Upstream returns the upstream host last called by the request
+func (t *RequestTimings) Upstream() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.upstream
+}
+
+// RequestUpstream returns the upstream host last called by the request of the context
+func RequestUpstream(ctx context.Context) string {
+	if t, ok := ctx.Value(timingsKey{}).(*RequestTimings); ok {
+		return t.Upstream()
+	}
+	return ""
+}
+
+// Phases returns a copy of the phase timings
+func (t *RequestTimings) Phases() map[string]time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	phases := make(map[string]time.Duration, len(t.phases))
+	for k, v := range t.phases {
+		phases[k] = v
+	}
+	return phases
+}
+
+// SlowRequestThreshold returns the configured latency threshold of a slow request
+func SlowRequestThreshold() time.Duration {
+	if GetConfig().SlowRequestThresholdMs > 0 {
+		return time.Duration(GetConfig().SlowRequestThresholdMs) * time.Millisecond
+	}
+	return DefaultSlowRequestThreshold
+}
+
+// SetRequestObserver registers a callback invoked on every completed request
+func SetRequestObserver(fn func(RequestObservation)) {
+	requestObserverLock.Lock()
+	requestObserver = fn
+	requestObserverLock.Unlock()
+}
+
+// ObserveRequest counts a completed request against the SLOs and the API usage, and reports it to the observer
+func ObserveRequest(o RequestObservation) {
+	recordSLO(o)
+	recordAPIUsage(o)
+	requestObserverLock.RLock()
+	fn := requestObserver
+	requestObserverLock.RUnlock()
+	if fn != nil {
+		fn(o)
+	}
+}
@@ -0,0 +1,183 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Size and time based rotation of a log file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	rotateTimeFormat = "20060102-150405"
+	// rotateRetryInterval delays the next rotation after a failed one
+	rotateRetryInterval = 10 * time.Second
+)
+
+// RotatingFile is a log file rotated once over the maximum size or at the rotation interval.
+// A rotated file is renamed with the rotation timestamp suffix, such as access.log.20210601-100000.
+type RotatingFile struct {
+	Path string
+	// MaxSize in bytes, 0 disables the size based rotation
+	MaxSize int64
+	// Interval, 0 disables the time based rotation
+	Interval time.Duration
+	// MaxBackups is the number of rotated files to keep, 0 keeps all
+	MaxBackups int
+	// Now is overridable for testing
+	Now func() time.Time
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time
+}
+
+// NewRotatingFile opens or creates the file for appending
+func NewRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, Interval: interval, MaxBackups: maxBackups, Now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, size, err := openAppend(r.Path)
+	if err != nil {
+		return err
+	}
+	r.file, r.size, r.openedAt = f, size, r.Now()
+	return nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// Write appends p to the file, the file is rotated before the write if due. A failed rotation does not lose
+// the write, it goes on to the current file and the rotation is retried later.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			r.retryAt = r.Now().Add(rotateRetryInterval)
+			log.Errorf("failed to rotate %s error %v, retry in %v", r.Path, err, rotateRetryInterval)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) due(n int64) bool {
+	if r.size == 0 || r.Now().Before(r.retryAt) {
+		return false
+	}
+	if r.MaxSize > 0 && r.size+n > r.MaxSize {
+		return true
+	}
+	return r.Interval > 0 && r.Now().Sub(r.openedAt) >= r.Interval
+}
+
+// rotate renames the file and opens a new one at the path, the old handle is only closed once the new file is open
+func (r *RotatingFile) rotate() error {
+	backup := fmt.Sprintf("%s.%s", r.Path, r.Now().Format(rotateTimeFormat))
+	if _, err := os.Stat(backup); err == nil {
+		// more than one rotation within a second
+		backup = fmt.Sprintf("%s.%d", backup, r.Now().UnixNano())
+	}
+	if err := os.Rename(r.Path, backup); err != nil {
+		return err
+	}
+	f, size, err := openAppend(r.Path)
+	if err != nil {
+		// the old handle is kept, so the file is moved back to the path
+		os.Rename(backup, r.Path)
+		return err
+	}
+	r.file.Close()
+	r.file, r.size, r.openedAt, r.retryAt = f, size, r.Now(), time.Time{}
+	r.removeBackups()
+	return nil
+}
+
+// removeBackups removes the oldest rotated files over MaxBackups
+func (r *RotatingFile) removeBackups() {
+	if r.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.Path + ".*")
+	if err != nil {
+		return
+	}
+	prefix := r.Path + "."
+	sorted := backups[:0]
+	for _, b := range backups {
+		if _, err := time.Parse(rotateTimeFormat, strings.SplitN(strings.TrimPrefix(b, prefix), ".", 2)[0]); err == nil {
+			sorted = append(sorted, b)
+		}
+	}
+	// the timestamp suffix sorts in time order
+	sort.Strings(sorted)
+	for i := 0; i < len(sorted)-r.MaxBackups; i++ {
+		os.Remove(sorted[i])
+	}
+}
+
+// Close closes the file
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
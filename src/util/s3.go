@@ -0,0 +1,254 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// S3 compatible object store client, the requests are signed with the AWS signature version 4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsV4Algorithm   = "AWS4-HMAC-SHA256"
+	awsV4TimeFormat  = "20060102T150405Z"
+	awsV4DateFormat  = "20060102"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	defaultS3Region  = "us-east-1"
+	s3ListMaxKeys    = "1000"
+	s3RequestTimeout = 60 * time.Second
+)
+
+// S3Object is an object of a list
+type S3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+type s3ListResult struct {
+	Contents              []S3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// S3Client puts, lists, and deletes the objects of a bucket
+type S3Client struct {
+	cfg    S3Export
+	client *http.Client
+}
+
+// NewS3Client creates a client of the bucket
+func NewS3Client(cfg S3Export) *S3Client {
+	cfg.Region = AssignString(cfg.Region, defaultS3Region)
+	cfg.Endpoint = strings.TrimSuffix(AssignString(cfg.Endpoint, "https://s3."+cfg.Region+".amazonaws.com"), "/")
+	return &S3Client{
+		cfg:    cfg,
+		client: &http.Client{Timeout: s3RequestTimeout},
+	}
+}
+
+// objectURL addresses the bucket in the path or as a sub domain of the endpoint
+func (c *S3Client) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(c.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.PathStyle {
+		u.Path = u.Path + "/" + c.cfg.Bucket + "/" + key
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+		u.Path = u.Path + "/" + key
+	}
+	return u, nil
+}
+
+func (c *S3Client) do(method, key string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	u, err := c.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	SignAWSV4(req, hex.EncodeToString(sum[:]), c.cfg.AccessKeyID, c.cfg.SecretAccessKey, c.cfg.Region, "s3", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("s3 %s %s failed with status %d %s", method, key, resp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+// PutObject writes an object with the configured server side encryption
+func (c *S3Client) PutObject(key, contentType string, body []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	if c.cfg.ServerSideEncryption != "" {
+		header.Set("X-Amz-Server-Side-Encryption", c.cfg.ServerSideEncryption)
+		if c.cfg.KMSKeyID != "" {
+			header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.cfg.KMSKeyID)
+		}
+	}
+	_, err := c.do(http.MethodPut, key, nil, body, header)
+	return err
+}
+
+// DeleteObject deletes an object
+func (c *S3Client) DeleteObject(key string) error {
+	_, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+// ListObjects lists the objects under the prefix, the pages are followed until the end
+func (c *S3Client) ListObjects(prefix string) ([]S3Object, error) {
+	objects := []S3Object{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {s3ListMaxKeys}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignAWSV4 signs the request with the AWS signature version 4 in the Authorization header. The host, the
+// Content-Type, the Range, and the x-amz-* headers are signed. An empty payload hash sends an unsigned payload.
+func SignAWSV4(req *http.Request, payloadHash, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	now = now.UTC()
+	payloadHash = AssignString(payloadHash, unsignedPayload)
+	req.Header.Set("X-Amz-Date", now.Format(awsV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(AssignString(req.URL.Path, "/"), false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format(awsV4DateFormat)
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{awsV4Algorithm, now.Format(awsV4TimeFormat), scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsV4Algorithm, accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCanonicalQuery sorts the parameters by the encoded names and values
+func awsCanonicalQuery(query url.Values) string {
+	params := []string{}
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsURIEncode percent encodes every byte except the unreserved characters, and the slash unless encodeSlash
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
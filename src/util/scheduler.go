@@ -0,0 +1,308 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Scheduled jobs run the registered maintenance tasks on their cron schedules and keep the history of the runs.
+// A job runs once at a time, a job of a leader task is skipped on the followers.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	// JobTriggerSchedule is the trigger of a run on the schedule
+	JobTriggerSchedule = "schedule"
+	// JobTriggerManual is the trigger of a run requested on the admin endpoint
+	JobTriggerManual = "manual"
+
+	defaultJobHistorySize = 100
+	maxSchedulerWait      = time.Minute
+)
+
+// ErrJobNotFound is the error of a job not in the configuration
+var ErrJobNotFound = errors.New("scheduled job is not found")
+
+// ErrJobRunning is the error of a manual run of a job being run
+var ErrJobRunning = errors.New("scheduled job is already running")
+
+// JobTask runs a task with the job parameters at the time now, and returns the summary of the run
+type JobTask func(now time.Time, params map[string]string) (string, error)
+
+type jobTask struct {
+	run   JobTask
+	local bool
+}
+
+// JobRun is a run of a scheduled job
+type JobRun struct {
+	Job        string    `json:"job"`
+	Task       string    `json:"task"`
+	Trigger    string    `json:"trigger"`
+	Replica    string    `json:"replica"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Summary    string    `json:"summary,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// JobStatus is a configured job with its next and last runs
+type JobStatus struct {
+	ScheduledJob
+	LeaderOnly bool       `json:"leaderOnly"`
+	Running    bool       `json:"running"`
+	NextRun    *time.Time `json:"nextRun,omitempty"`
+	LastRun    *JobRun    `json:"lastRun,omitempty"`
+}
+
+type scheduledJob struct {
+	ScheduledJob
+	schedule CronSchedule
+	task     jobTask
+	next     time.Time
+	running  bool
+	last     *JobRun
+}
+
+var scheduler = struct {
+	sync.Mutex
+	tasks   map[string]jobTask
+	jobs    []*scheduledJob
+	history []JobRun
+}{tasks: map[string]jobTask{}}
+
+// JobParamInt returns a non-negative integer parameter of a job, or the default if it is not set
+func JobParamInt(params map[string]string, name string, def int) (int, error) {
+	v, ok := params[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("parameter %s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// RegisterJobTask registers a task of the scheduled jobs. A local task runs on every replica,
+// otherwise it runs on the leader only.
+func RegisterJobTask(name string, local bool, run JobTask) {
+	scheduler.Lock()
+	scheduler.tasks[name] = jobTask{run: run, local: local}
+	scheduler.Unlock()
+}
+
+// LoadScheduledJobs validates and replaces the scheduled jobs, their first runs are scheduled after the time now
+func LoadScheduledJobs(jobs []ScheduledJob, now time.Time) error {
+	loaded := make([]*scheduledJob, 0, len(jobs))
+	names := map[string]bool{}
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	for _, job := range jobs {
+		if job.Name == "" {
+			return errors.New("scheduled job requires a name")
+		}
+		if names[job.Name] {
+			return fmt.Errorf("scheduled job %s is duplicated", job.Name)
+		}
+		names[job.Name] = true
+		task, ok := scheduler.tasks[job.Task]
+		if !ok {
+			return fmt.Errorf("scheduled job %s has an unknown task %q", job.Name, job.Task)
+		}
+		schedule, err := ParseCronSchedule(job.Schedule)
+		if err != nil {
+			return fmt.Errorf("scheduled job %s %v", job.Name, err)
+		}
+		j := &scheduledJob{ScheduledJob: job, schedule: schedule, task: task}
+		if !job.Disabled {
+			j.next = schedule.Next(now)
+		}
+		loaded = append(loaded, j)
+	}
+	scheduler.jobs = loaded
+	scheduler.history = nil
+	return nil
+}
+
+// StartScheduler loads the configured jobs and runs them on their schedules
+func StartScheduler() error {
+	cfg := GetConfig().Scheduler
+	if len(cfg.Jobs) == 0 {
+		return nil
+	}
+	if err := LoadScheduledJobs(cfg.Jobs, time.Now()); err != nil {
+		return err
+	}
+	log.Infof("scheduler runs %d jobs", len(cfg.Jobs))
+	go func() {
+		for {
+			wait := maxSchedulerWait
+			if next := nextScheduledRun(); !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			time.Sleep(wait)
+			go RunDueJobs(time.Now())
+		}
+	}()
+	return nil
+}
+
+func nextScheduledRun() time.Time {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	var next time.Time
+	for _, job := range scheduler.jobs {
+		if !job.next.IsZero() && (next.IsZero() || job.next.Before(next)) {
+			next = job.next
+		}
+	}
+	return next
+}
+
+// RunDueJobs runs the jobs scheduled at or before the time now concurrently and waits for them.
+// A due job that is still running or is of a leader task on a follower is skipped until its next run.
+func RunDueJobs(now time.Time) {
+	var wg sync.WaitGroup
+	leader := IsLeader()
+	scheduler.Lock()
+	for _, job := range scheduler.jobs {
+		if job.next.IsZero() || now.Before(job.next) {
+			continue
+		}
+		job.next = job.schedule.Next(now)
+		if job.running || !(job.task.local || leader) {
+			continue
+		}
+		job.running = true
+		wg.Add(1)
+		go func(job *scheduledJob) {
+			defer wg.Done()
+			runJob(job, JobTriggerSchedule, now)
+		}(job)
+	}
+	scheduler.Unlock()
+	wg.Wait()
+}
+
+// RunScheduledJob runs a job now regardless of its schedule, a disabled job can be run
+func RunScheduledJob(name string) (JobRun, error) {
+	scheduler.Lock()
+	var job *scheduledJob
+	for _, j := range scheduler.jobs {
+		if j.Name == name {
+			job = j
+		}
+	}
+	if job == nil {
+		scheduler.Unlock()
+		return JobRun{}, ErrJobNotFound
+	}
+	if job.running {
+		scheduler.Unlock()
+		return JobRun{}, ErrJobRunning
+	}
+	job.running = true
+	scheduler.Unlock()
+	return runJob(job, JobTriggerManual, time.Now()), nil
+}
+
+// runJob runs a job marked as running and records the run in the history
+func runJob(job *scheduledJob, trigger string, now time.Time) JobRun {
+	params := make(map[string]string, len(job.Params))
+	for k, v := range job.Params {
+		params[k] = v
+	}
+	run := JobRun{Job: job.Name, Task: job.Task, Trigger: trigger, Replica: LeaderIdentity(), StartedAt: now}
+	started := time.Now()
+	summary, err := runJobTask(job.task.run, now, params)
+	run.DurationMs = time.Since(started).Milliseconds()
+	run.Summary = summary
+	if err != nil {
+		run.Error = err.Error()
+		log.Errorf("scheduled job %s failed %v", job.Name, err)
+	} else {
+		log.Infof("scheduled job %s completed %s", job.Name, summary)
+	}
+
+	size := GetConfig().Scheduler.HistorySize
+	if size <= 0 {
+		size = defaultJobHistorySize
+	}
+	scheduler.Lock()
+	job.running = false
+	job.last = &run
+	scheduler.history = append(scheduler.history, run)
+	if over := len(scheduler.history) - size; over > 0 {
+		scheduler.history = scheduler.history[over:]
+	}
+	scheduler.Unlock()
+	return run
+}
+
+// runJobTask runs a task, a panic of the task fails the run
+func runJobTask(task JobTask, now time.Time, params map[string]string) (summary string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked %v", r)
+		}
+	}()
+	return task(now, params)
+}
+
+// GetScheduledJobs returns the configured jobs in the configuration order
+func GetScheduledJobs() []JobStatus {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	jobs := make([]JobStatus, 0, len(scheduler.jobs))
+	for _, job := range scheduler.jobs {
+		status := JobStatus{ScheduledJob: job.ScheduledJob, LeaderOnly: !job.task.local, Running: job.running}
+		if !job.next.IsZero() {
+			next := job.next
+			status.NextRun = &next
+		}
+		if job.last != nil {
+			last := *job.last
+			status.LastRun = &last
+		}
+		jobs = append(jobs, status)
+	}
+	return jobs
+}
+
+// GetJobHistory returns the runs of a job, or of all jobs if the name is empty, the latest first
+func GetJobHistory(name string) []JobRun {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	runs := []JobRun{}
+	for i := len(scheduler.history) - 1; i >= 0; i-- {
+		if name == "" || scheduler.history[i].Job == name {
+			runs = append(runs, scheduler.history[i])
+		}
+	}
+	return runs
+}
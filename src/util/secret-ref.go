@@ -0,0 +1,376 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Secret file and environment variable references in the configuration, the files are re-read once changed
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// the prefixes of a secret reference, such as file:/var/run/secrets/burnell/token or env:PULSAR_TOKEN
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+)
+
+const secretRefreshInterval = 10 * time.Second
+
+// restartRequiredSecrets are not swapped at runtime, such as the key that encrypts the stored tenant secrets
+var restartRequiredSecrets = []string{"SecretEncryptionKey", "IntegrityKey"}
+
+// secretRef is a configuration value resolved from a file or an environment variable
+type secretRef struct {
+	ref string
+	// path is the json keys to the value in the configuration
+	path  []string
+	value string
+	set   func(string)
+}
+
+var (
+	secretLock sync.RWMutex
+	secretRefs = map[string]*secretRef{}
+
+	// configSnapshot is the configuration returned by GetConfig. A refresh swaps in a copy with the new secrets,
+	// so a reader never sees a value being written.
+	configSnapshot atomic.Value
+
+	// errorReportingRelease is the release of the error reporting re-initialized with a new DSN
+	errorReportingRelease string
+)
+
+// IsSecretRef returns whether a configuration value is a file or env reference
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretFilePrefix) || strings.HasPrefix(value, secretEnvPrefix)
+}
+
+// ResolveSecretRef returns the content of the referenced file or environment variable, or the value itself
+func ResolveSecretRef(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return strings.TrimSpace(v), nil
+	}
+	return value, nil
+}
+
+// resolveSecretRefs replaces the file and env references of all string values in the configuration
+func resolveSecretRefs() error {
+	refs := map[string]*secretRef{}
+	if err := collectSecretRefs(reflect.ValueOf(&Config).Elem(), nil, refs); err != nil {
+		return err
+	}
+	secretLock.Lock()
+	defer secretLock.Unlock()
+	for _, r := range refs {
+		r.set(r.value)
+	}
+	secretRefs = refs
+	configSnapshot.Store(&Config)
+	return nil
+}
+
+// cloneConfigValue deep copies the exported fields, the slices, the maps, and the pointers of a configuration value
+func cloneConfigValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(cloneConfigValue(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				c.Field(i).Set(cloneConfigValue(v.Field(i)))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(cloneConfigValue(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			c.SetMapIndex(key, cloneConfigValue(v.MapIndex(key)))
+		}
+		return c
+	}
+	return v
+}
+
+// setConfigPath sets the string at the json keys path of a configuration value, the path of a secret reference
+func setConfigPath(v reflect.Value, path []string, value string) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		return !v.IsNil() && setConfigPath(v.Elem(), path, value)
+	case reflect.String:
+		if len(path) > 0 || !v.CanSet() {
+			return false
+		}
+		v.SetString(value)
+		return true
+	}
+	if len(path) == 0 {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.PkgPath == "" && jsonFieldName(field) == path[0] {
+				return setConfigPath(v.Field(i), path[1:], value)
+			}
+		}
+	case reflect.Slice:
+		i, err := strconv.Atoi(path[0])
+		return err == nil && i >= 0 && i < v.Len() && setConfigPath(v.Index(i), path[1:], value)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return false
+		}
+		key := reflect.ValueOf(path[0]).Convert(v.Type().Key())
+		if !v.MapIndex(key).IsValid() {
+			return false
+		}
+		// a map value is not addressable, it is set on a copy and stored back
+		elem := reflect.New(v.Type().Elem()).Elem()
+		elem.Set(v.MapIndex(key))
+		if !setConfigPath(elem, path[1:], value) {
+			return false
+		}
+		v.SetMapIndex(key, elem)
+		return true
+	}
+	return false
+}
+
+func collectSecretRefs(v reflect.Value, path []string, refs map[string]*secretRef) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return collectSecretRefs(v.Elem(), path, refs)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.PkgPath == "" {
+				if err := collectSecretRefs(v.Field(i), appendConfigPath(path, jsonFieldName(field)), refs); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := collectSecretRefs(v.Index(i), appendConfigPath(path, fmt.Sprint(i)), refs); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			m, k := v, key
+			if v.Type().Elem().Kind() == reflect.String {
+				if err := addSecretRef(v.MapIndex(key).String(), appendConfigPath(path, key.String()), func(s string) {
+					m.SetMapIndex(k, reflect.ValueOf(s).Convert(m.Type().Elem()))
+				}, refs); err != nil {
+					return err
+				}
+				continue
+			}
+			// a map value is not addressable, it is resolved on a copy and stored back
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			elemRefs := map[string]*secretRef{}
+			if err := collectSecretRefs(elem, appendConfigPath(path, fmt.Sprint(key)), elemRefs); err != nil {
+				return err
+			}
+			for p, r := range elemRefs {
+				set := r.set
+				r.set = func(s string) {
+					set(s)
+					m.SetMapIndex(k, elem)
+				}
+				refs[p] = r
+			}
+		}
+	case reflect.String:
+		if v.CanSet() {
+			f := v
+			return addSecretRef(v.String(), path, func(s string) { f.SetString(s) }, refs)
+		}
+	}
+	return nil
+}
+
+func addSecretRef(ref string, path []string, set func(string), refs map[string]*secretRef) error {
+	if !IsSecretRef(ref) {
+		return nil
+	}
+	name := strings.Join(path, ".")
+	value, err := ResolveSecretRef(ref)
+	if err != nil {
+		return fmt.Errorf("config %s reference %s %v", name, ref, err)
+	}
+	refs[name] = &secretRef{ref: ref, path: path, value: value, set: set}
+	return nil
+}
+
+func appendConfigPath(path []string, name string) []string {
+	return append(append([]string{}, path...), name)
+}
+
+// PulsarToken returns the current Pulsar token, which is refreshed once the referenced secret file changes
+func PulsarToken() string {
+	return GetConfig().PulsarToken
+}
+
+// SecretRefs returns the references of the resolved secrets by the dot separated configuration path
+func SecretRefs() map[string]string {
+	secretLock.RLock()
+	defer secretLock.RUnlock()
+	refs := make(map[string]string, len(secretRefs))
+	for path, r := range secretRefs {
+		refs[path] = r.ref
+	}
+	return refs
+}
+
+// showSecretRefs replaces the resolved secrets with their references in the configuration document
+func showSecretRefs(doc map[string]interface{}) {
+	secretLock.RLock()
+	defer secretLock.RUnlock()
+	for _, r := range secretRefs {
+		node := doc
+		for i, key := range r.path {
+			if i == len(r.path)-1 {
+				if _, ok := node[key]; ok {
+					node[key] = r.ref
+				}
+				break
+			}
+			next, ok := node[key].(map[string]interface{})
+			if !ok {
+				break
+			}
+			node = next
+		}
+	}
+}
+
+// RefreshSecretRefs re-reads the referenced files, and applies the changed values to a copy of the configuration
+// that replaces the current one, then to the running subsystems
+func RefreshSecretRefs() []string {
+	secretLock.Lock()
+	var changed []string
+	next := cloneConfigValue(reflect.ValueOf(GetConfig()))
+	for path, r := range secretRefs {
+		if !strings.HasPrefix(r.ref, secretFilePrefix) {
+			continue
+		}
+		value, err := ResolveSecretRef(r.ref)
+		if err != nil {
+			log.Errorf("failed to refresh config %s from %s %v", path, r.ref, err)
+			continue
+		}
+		if value == r.value || value == "" {
+			continue
+		}
+		if StrContains(restartRequiredSecrets, path) {
+			log.Warnf("config %s changed in %s, it takes effect after a restart", path, r.ref)
+			r.value = value
+			continue
+		}
+		if !setConfigPath(next, r.path, value) {
+			log.Errorf("failed to refresh config %s, the path is not found", path)
+			continue
+		}
+		r.value = value
+		changed = append(changed, path)
+		log.Warnf("config %s is refreshed from %s", path, r.ref)
+	}
+	if len(changed) > 0 {
+		configSnapshot.Store(next.Interface().(*Configuration))
+	}
+	secretLock.Unlock()
+
+	for _, path := range changed {
+		switch {
+		case strings.HasPrefix(path, "ErrorReporting."):
+			if err := InitErrorReporting(errorReportingRelease); err != nil {
+				log.Errorf("failed to re-initialize error reporting %v", err)
+			}
+		case strings.HasPrefix(path, "Tracing."):
+			old := tracerProvider
+			if err := InitTracing(); err != nil {
+				log.Errorf("failed to re-initialize tracing %v", err)
+			} else if old != nil && old != tracerProvider {
+				old.Shutdown(context.Background())
+			}
+		}
+	}
+	return changed
+}
+
+// WatchSecretRefs polls the referenced secret files, such as the Kubernetes secret volumes that are updated in place
+func WatchSecretRefs() {
+	if len(SecretRefs()) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(secretRefreshInterval)
+		for range ticker.C {
+			RefreshSecretRefs()
+		}
+	}()
+}
@@ -0,0 +1,165 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Resolution of ${secret:name} references in connector configs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// secretRefPattern matches a ${secret:name} reference
+var secretRefPattern = regexp.MustCompile(`\$\{secret:([A-Za-z0-9._-]+)\}`)
+
+// SecretLookup returns the value of a named secret
+type SecretLookup func(name string) (string, bool)
+
+// ResolveSecretRefs replaces the ${secret:name} references in the string values of a json config.
+// A config without any reference is returned as is.
+func ResolveSecretRefs(config []byte, lookup SecretLookup) ([]byte, error) {
+	if !secretRefPattern.Match(config) {
+		return config, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(config, &v); err != nil {
+		return nil, fmt.Errorf("config with secret references must be json: %v", err)
+	}
+	resolved, err := resolveValue(v, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+func resolveValue(v interface{}, lookup SecretLookup) (interface{}, error) {
+	var err error
+	switch t := v.(type) {
+	case string:
+		return resolveString(t, lookup)
+	case map[string]interface{}:
+		for k, e := range t {
+			if t[k], err = resolveValue(e, lookup); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			if t[i], err = resolveValue(e, lookup); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func resolveString(s string, lookup SecretLookup) (string, error) {
+	var missing string
+	resolved := secretRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := secretRefPattern.FindStringSubmatch(ref)[1]
+		value, ok := lookup(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("secret %s is not defined", missing)
+	}
+	return resolved, nil
+}
+
+// ResolveMultipartSecretRefs replaces the secret references in the named json parts of a multipart/form-data body.
+// It returns the body and the content type, which are unchanged if no part has a reference.
+func ResolveMultipartSecretRefs(body []byte, contentType string, partNames []string, lookup SecretLookup) ([]byte, string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || !secretRefPattern.Match(body) {
+		return body, contentType, nil
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.SetBoundary(params["boundary"]); err != nil {
+		return nil, "", err
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		w, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return nil, "", err
+		}
+		if !StrContains(partNames, part.FormName()) {
+			if _, err := io.Copy(w, part); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, "", err
+		}
+		if data, err = ResolveSecretRefs(data, lookup); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", part.FormName(), err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+// RedactSecretValues replaces the plain and the json escaped secret values in a response body with their
+// ${secret:name} references, the longest value first
+func RedactSecretValues(body []byte, secrets map[string]string) []byte {
+	names := make([]string, 0, len(secrets))
+	for name, value := range secrets {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return len(secrets[names[i]]) > len(secrets[names[j]]) })
+	for _, name := range names {
+		ref := []byte("${secret:" + name + "}")
+		body = bytes.ReplaceAll(body, []byte(secrets[name]), ref)
+		if escaped, err := json.Marshal(secrets[name]); err == nil {
+			body = bytes.ReplaceAll(body, escaped[1:len(escaped)-1], ref)
+		}
+	}
+	return body
+}
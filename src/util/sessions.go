@@ -0,0 +1,193 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Server side sessions of the browser UI. A session is opened with a verified token and identified by
+// a random id in an HttpOnly cookie. Sessions are keyed by the digest of the id, and shared across
+// the replicas by the shared cache if it is enabled, signed with the IntegrityKey.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/icrypto"
+)
+
+const (
+	// DefaultSessionCookie is the default name of the session cookie
+	DefaultSessionCookie = "burnell_session"
+	defaultSessionTTL    = 480 * time.Minute
+	maxSessions          = 100000
+)
+
+// ErrInvalidSession is the error of an unknown, expired, or closed session
+var ErrInvalidSession = errors.New("invalid session")
+
+// Session is a browser session of the subject of a verified token
+type Session struct {
+	Token     icrypto.VerifiedToken `json:"token"`
+	CreatedAt time.Time             `json:"createdAt"`
+	ExpiresAt time.Time             `json:"expiresAt"`
+	CSRFToken string                `json:"csrfToken"`
+	// Closed is the tombstone of a logged out session in the shared cache
+	Closed bool `json:"closed,omitempty"`
+}
+
+var sessions = struct {
+	sync.RWMutex
+	byDigest map[string]Session
+}{byDigest: map[string]Session{}}
+
+// SessionNow is the clock of the sessions
+var SessionNow = time.Now
+
+// SessionsEnabled checks if the cookie sessions are enabled
+func SessionsEnabled() bool {
+	return GetConfig().Sessions.Enabled
+}
+
+// SessionCookieName is the configured name of the session cookie
+func SessionCookieName() string {
+	return AssignString(GetConfig().Sessions.CookieName, DefaultSessionCookie)
+}
+
+func sessionTTL() time.Duration {
+	if minutes := GetConfig().Sessions.TTLMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultSessionTTL
+}
+
+func sessionRandom() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func sessionDigest(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession opens a session of a verified token, it returns the session id for the cookie.
+// The session carries a CSRF token that the browser UI must send on the state changing requests.
+func NewSession(verified icrypto.VerifiedToken) (string, Session, error) {
+	id, err := sessionRandom()
+	if err != nil {
+		return "", Session{}, err
+	}
+	csrfToken, err := sessionRandom()
+	if err != nil {
+		return "", Session{}, err
+	}
+	now := SessionNow()
+	session := Session{Token: verified, CreatedAt: now, ExpiresAt: now.Add(sessionTTL()), CSRFToken: csrfToken}
+	if !verified.ExpiresAt.IsZero() && verified.ExpiresAt.Before(session.ExpiresAt) {
+		session.ExpiresAt = verified.ExpiresAt
+	}
+	if !now.Before(session.ExpiresAt) {
+		return "", Session{}, errors.New("token is expired")
+	}
+
+	digest := sessionDigest(id)
+	sessions.Lock()
+	if len(sessions.byDigest) >= maxSessions {
+		for k, s := range sessions.byDigest {
+			if !now.Before(s.ExpiresAt) {
+				delete(sessions.byDigest, k)
+			}
+		}
+	}
+	sessions.byDigest[digest] = session
+	sessions.Unlock()
+	if data, err := json.Marshal(session); err == nil {
+		SharedCacheSetSigned("session:"+digest, data, session.ExpiresAt.Sub(now))
+	}
+	return id, session, nil
+}
+
+// GetSession returns the open session of an id. The shared cache is consulted first, so that a session
+// closed on another replica is closed here too.
+func GetSession(id string) (Session, error) {
+	if id == "" {
+		return Session{}, ErrInvalidSession
+	}
+	digest := sessionDigest(id)
+	now := SessionNow()
+	session, ok := Session{}, false
+	if data, found := SharedCacheGetSigned("session:" + digest); found {
+		ok = json.Unmarshal(data, &session) == nil
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if ok {
+		sessions.byDigest[digest] = session
+	} else {
+		session, ok = sessions.byDigest[digest]
+	}
+	if !ok || session.Closed || !now.Before(session.ExpiresAt) {
+		delete(sessions.byDigest, digest)
+		return Session{}, ErrInvalidSession
+	}
+	return session, nil
+}
+
+// CloseSession logs out a session, a tombstone in the shared cache closes it on the other replicas
+func CloseSession(id string) {
+	if id == "" {
+		return
+	}
+	digest := sessionDigest(id)
+	sessions.Lock()
+	session, ok := sessions.byDigest[digest]
+	delete(sessions.byDigest, digest)
+	sessions.Unlock()
+	ttl := sessionTTL()
+	if ok {
+		ttl = session.ExpiresAt.Sub(SessionNow())
+	}
+	if data, err := json.Marshal(Session{Closed: true}); err == nil {
+		SharedCacheSetSigned("session:"+digest, data, ttl)
+	}
+}
+
+// CompactSessions removes the expired and the closed sessions from the local registry, and returns the number removed
+func CompactSessions(now time.Time) int {
+	sessions.Lock()
+	defer sessions.Unlock()
+	removed := 0
+	for k, s := range sessions.byDigest {
+		if s.Closed || !now.Before(s.ExpiresAt) {
+			delete(sessions.byDigest, k)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,279 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// The shared cache is an optional Redis backend behind the local caches of a replica.
+// Every call is bounded by a short timeout, and an error falls the replica back to its local caches
+// for a retry period, so an unavailable Redis never fails a request.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultSharedCachePrefix  = "burnell:"
+	defaultSharedCacheTimeout = 200 * time.Millisecond
+	defaultSharedCacheRetry   = 30 * time.Second
+	defaultVerifiedTokenTTL   = 60 * time.Second
+)
+
+// SharedCacheBackend is the storage of the shared cache
+type SharedCacheBackend interface {
+	// Get returns ErrSharedCacheMiss for a missing key
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Close() error
+}
+
+// ErrSharedCacheMiss is returned by a backend for a missing key
+var ErrSharedCacheMiss = errors.New("shared cache miss")
+
+// SharedCacheStats is the shared cache status and counters
+type SharedCacheStats struct {
+	Enabled bool   `json:"enabled"`
+	Address string `json:"address,omitempty"`
+	// Available is false while the replica falls back to its local caches after an error
+	Available bool   `json:"available"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Errors    uint64 `json:"errors"`
+}
+
+var (
+	sharedCacheLock     = sync.RWMutex{}
+	sharedCacheBackend  SharedCacheBackend
+	sharedCacheSettings SharedCache
+
+	// unix nano time until which the shared cache is skipped after an error
+	sharedCacheDownUntil int64
+
+	sharedCacheHits   uint64
+	sharedCacheMisses uint64
+	sharedCacheErrors uint64
+)
+
+// redisCache is the Redis backend with a connection pool
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrSharedCacheMiss
+	}
+	return data, err
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *redisCache) Close() error {
+	return c.client.Close()
+}
+
+// InitSharedCache connects the Redis shared cache, a replica uses its local caches only without the address.
+// A previously connected backend is closed.
+func InitSharedCache(settings SharedCache) error {
+	var backend SharedCacheBackend
+	if settings.Address != "" {
+		timeout := sharedCacheTimeout(settings)
+		options := &redis.Options{
+			Addr:         settings.Address,
+			Password:     settings.Password,
+			DB:           settings.DB,
+			PoolSize:     settings.PoolSize,
+			MinIdleConns: settings.MinIdleConns,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			MaxRetries:   -1,
+		}
+		if settings.TLS {
+			tlsConfig, err := sharedCacheTLSConfig(settings)
+			if err != nil {
+				return err
+			}
+			options.TLSConfig = tlsConfig
+		}
+		backend = &redisCache{client: redis.NewClient(options)}
+	}
+	SetSharedCacheBackend(backend, settings)
+	return nil
+}
+
+// SetSharedCacheBackend replaces the shared cache backend, a nil backend disables the shared cache
+func SetSharedCacheBackend(backend SharedCacheBackend, settings SharedCache) {
+	sharedCacheLock.Lock()
+	previous := sharedCacheBackend
+	sharedCacheBackend = backend
+	sharedCacheSettings = settings
+	sharedCacheLock.Unlock()
+	atomic.StoreInt64(&sharedCacheDownUntil, 0)
+	if previous != nil {
+		previous.Close()
+	}
+	if backend != nil {
+		log.Infof("shared cache is enabled at %s", settings.Address)
+	}
+}
+
+func sharedCacheTLSConfig(settings SharedCache) (*tls.Config, error) {
+	host := settings.Address
+	if h, _, err := net.SplitHostPort(settings.Address); err == nil {
+		host = h
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: settings.TLSInsecureSkipVerify,
+	}
+	caFile := settings.TLSCAFile
+	if caFile == "" {
+		caFile = GetConfig().TrustStore
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the shared cache CA file %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the shared cache CA file %s", caFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// activeSharedCache returns the backend unless it is disabled or in the fallback period after an error
+func activeSharedCache() (SharedCacheBackend, SharedCache) {
+	sharedCacheLock.RLock()
+	defer sharedCacheLock.RUnlock()
+	if sharedCacheBackend == nil || time.Now().UnixNano() < atomic.LoadInt64(&sharedCacheDownUntil) {
+		return nil, sharedCacheSettings
+	}
+	return sharedCacheBackend, sharedCacheSettings
+}
+
+func sharedCacheTimeout(settings SharedCache) time.Duration {
+	if settings.TimeoutMs > 0 {
+		return time.Duration(settings.TimeoutMs) * time.Millisecond
+	}
+	return defaultSharedCacheTimeout
+}
+
+func sharedCacheContext(settings SharedCache) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), sharedCacheTimeout(settings))
+}
+
+func sharedCacheKey(settings SharedCache, key string) string {
+	if settings.KeyPrefix == "" {
+		return defaultSharedCachePrefix + key
+	}
+	return settings.KeyPrefix + key
+}
+
+// sharedCacheFailed starts the fallback period, only the first error of a period is logged
+func sharedCacheFailed(settings SharedCache, err error) {
+	atomic.AddUint64(&sharedCacheErrors, 1)
+	retry := secondsOrDefault(settings.RetryAfterSeconds, defaultSharedCacheRetry)
+	now := time.Now().UnixNano()
+	previous := atomic.LoadInt64(&sharedCacheDownUntil)
+	if previous < now && atomic.CompareAndSwapInt64(&sharedCacheDownUntil, previous, now+int64(retry)) {
+		log.Warnf("shared cache error %v, fall back to the local cache for %v", err, retry)
+	}
+}
+
+// SharedCacheGet gets the value of a key, it returns false if the shared cache is disabled, unavailable,
+// or missing the key
+func SharedCacheGet(key string) ([]byte, bool) {
+	backend, settings := activeSharedCache()
+	if backend == nil {
+		return nil, false
+	}
+	ctx, cancel := sharedCacheContext(settings)
+	defer cancel()
+	data, err := backend.Get(ctx, sharedCacheKey(settings, key))
+	if err == ErrSharedCacheMiss {
+		atomic.AddUint64(&sharedCacheMisses, 1)
+		return nil, false
+	} else if err != nil {
+		sharedCacheFailed(settings, err)
+		return nil, false
+	}
+	atomic.AddUint64(&sharedCacheHits, 1)
+	return data, true
+}
+
+// SharedCacheSet sets the value of a key with the TTL, an error is only counted since the local cache still holds the value
+func SharedCacheSet(key string, value []byte, ttl time.Duration) {
+	backend, settings := activeSharedCache()
+	if backend == nil || ttl <= 0 {
+		return
+	}
+	ctx, cancel := sharedCacheContext(settings)
+	defer cancel()
+	if err := backend.Set(ctx, sharedCacheKey(settings, key), value, ttl); err != nil {
+		sharedCacheFailed(settings, err)
+	}
+}
+
+// VerifiedTokenTTL is the maximum time a verified token is cached, 0 if the verified token cache is disabled
+func VerifiedTokenTTL() time.Duration {
+	sharedCacheLock.RLock()
+	seconds := sharedCacheSettings.VerifiedTokenSeconds
+	enabled := sharedCacheBackend != nil
+	sharedCacheLock.RUnlock()
+	if !enabled || seconds < 0 {
+		return 0
+	}
+	return secondsOrDefault(seconds, defaultVerifiedTokenTTL)
+}
+
+// GetSharedCacheStats returns the shared cache status and counters
+func GetSharedCacheStats() SharedCacheStats {
+	sharedCacheLock.RLock()
+	enabled := sharedCacheBackend != nil
+	address := sharedCacheSettings.Address
+	sharedCacheLock.RUnlock()
+	return SharedCacheStats{
+		Enabled:   enabled,
+		Address:   address,
+		Available: enabled && time.Now().UnixNano() >= atomic.LoadInt64(&sharedCacheDownUntil),
+		Hits:      atomic.LoadUint64(&sharedCacheHits),
+		Misses:    atomic.LoadUint64(&sharedCacheMisses),
+		Errors:    atomic.LoadUint64(&sharedCacheErrors),
+	}
+}
@@ -0,0 +1,192 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Availability and latency SLO burn rates per route class
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sloBuckets is the number of one minute buckets, the longest burn rate window
+const sloBuckets = 360
+
+// SLOWindows are the burn rate windows for the multiwindow alerts
+var SLOWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+// defaultSLORoutePrefixes are the route prefixes of the built-in route classes
+var defaultSLORoutePrefixes = map[string][]string{
+	"metrics": {"/metrics", "/pulsarmetrics", "/tenantsusage", "/namespacesusage", "/stats", "/alerts"},
+	"admin":   {"/admin", "/k/tenant"},
+	"token":   {"/subject", "/delegate"},
+}
+
+// SLOStatus is the counters and the burn rates of a route class
+type SLOStatus struct {
+	Class    string
+	Requests int64
+	Errors   int64
+	Slow     int64
+	// AvailabilityBurnRate and LatencyBurnRate are keyed by the window
+	AvailabilityBurnRate map[time.Duration]float64
+	LatencyBurnRate      map[time.Duration]float64
+}
+
+type sloBucket struct {
+	minute   int64
+	requests int64
+	errors   int64
+	slow     int64
+}
+
+type sloTracker struct {
+	slo      SLO
+	prefixes []string
+	buckets  [sloBuckets]sloBucket
+	// cumulative counters
+	requests, errors, slow int64
+}
+
+var slos = struct {
+	sync.Mutex
+	trackers []*sloTracker
+	now      func() time.Time
+}{now: time.Now}
+
+// ValidateSLOs validates the route classes and the targets
+func ValidateSLOs(objectives []SLO) error {
+	classes := make(map[string]bool)
+	for _, slo := range objectives {
+		if slo.Class == "" || classes[slo.Class] {
+			return fmt.Errorf("SLO class %q is empty or duplicated", slo.Class)
+		}
+		classes[slo.Class] = true
+		if _, ok := defaultSLORoutePrefixes[slo.Class]; !ok && len(slo.RoutePrefixes) == 0 {
+			return fmt.Errorf("SLO class %s requires routePrefixes", slo.Class)
+		}
+		if slo.Availability < 0 || slo.Availability >= 1 || slo.LatencyTarget < 0 || slo.LatencyTarget >= 1 {
+			return fmt.Errorf("SLO class %s targets must be ratios between 0 and 1", slo.Class)
+		}
+		if slo.LatencyTarget > 0 && slo.LatencyMs <= 0 {
+			return fmt.Errorf("SLO class %s latencyTarget requires latencyMs", slo.Class)
+		}
+	}
+	return nil
+}
+
+// InitSLOs sets up the SLO trackers of the configured route classes
+func InitSLOs(objectives []SLO) {
+	slos.Lock()
+	defer slos.Unlock()
+	slos.trackers = nil
+	for _, slo := range objectives {
+		prefixes := slo.RoutePrefixes
+		if len(prefixes) == 0 {
+			prefixes = defaultSLORoutePrefixes[slo.Class]
+		}
+		slos.trackers = append(slos.trackers, &sloTracker{slo: slo, prefixes: prefixes})
+	}
+}
+
+// SetSLOClock overrides the clock of the SLO trackers for testing
+func SetSLOClock(now func() time.Time) {
+	slos.Lock()
+	slos.now = now
+	slos.Unlock()
+}
+
+// recordSLO counts a request against the SLO of its route class, the longest matching route prefix wins
+func recordSLO(o RequestObservation) {
+	slos.Lock()
+	defer slos.Unlock()
+	var tracker *sloTracker
+	matched := ""
+	for _, t := range slos.trackers {
+		for _, prefix := range t.prefixes {
+			if strings.HasPrefix(o.Route, prefix) && len(prefix) > len(matched) {
+				tracker, matched = t, prefix
+			}
+		}
+	}
+	if tracker == nil {
+		return
+	}
+	minute := slos.now().Unix() / 60
+	b := &tracker.buckets[minute%sloBuckets]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.requests++
+	tracker.requests++
+	if o.Status >= 500 {
+		b.errors++
+		tracker.errors++
+	}
+	if tracker.slo.LatencyMs > 0 && o.Duration > time.Duration(tracker.slo.LatencyMs)*time.Millisecond {
+		b.slow++
+		tracker.slow++
+	}
+}
+
+// GetSLOStatus returns the counters and the burn rates of all the route classes
+func GetSLOStatus() []SLOStatus {
+	slos.Lock()
+	defer slos.Unlock()
+	now := slos.now().Unix() / 60
+	status := make([]SLOStatus, 0, len(slos.trackers))
+	for _, t := range slos.trackers {
+		s := SLOStatus{
+			Class:                t.slo.Class,
+			Requests:             t.requests,
+			Errors:               t.errors,
+			Slow:                 t.slow,
+			AvailabilityBurnRate: make(map[time.Duration]float64),
+			LatencyBurnRate:      make(map[time.Duration]float64),
+		}
+		for _, window := range SLOWindows {
+			var requests, errors, slow int64
+			from := now - int64(window/time.Minute) + 1
+			for _, b := range t.buckets {
+				if b.minute >= from && b.minute <= now {
+					requests, errors, slow = requests+b.requests, errors+b.errors, slow+b.slow
+				}
+			}
+			s.AvailabilityBurnRate[window] = burnRate(errors, requests, t.slo.Availability)
+			s.LatencyBurnRate[window] = burnRate(slow, requests, t.slo.LatencyTarget)
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Class < status[j].Class })
+	return status
+}
+
+// burnRate is the ratio of the bad events over the error budget, 1 consumes the budget exactly over the SLO period
+func burnRate(bad, total int64, target float64) float64 {
+	if total == 0 || target <= 0 || target >= 1 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - target)
+}
@@ -0,0 +1,185 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Startup probes wait for the dependencies before the replica is marked ready
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	// ProbePulsarAdmin is the Pulsar admin REST endpoint
+	ProbePulsarAdmin = "pulsar-admin"
+	// ProbePrometheus is the federated Prometheus endpoint
+	ProbePrometheus = "prometheus"
+	// ProbePolicyStore is the Pulsar cluster backing the policy store
+	ProbePolicyStore = "policy-store"
+
+	defaultProbeInitialBackoff = 500 * time.Millisecond
+	defaultProbeMaxBackoff     = 15 * time.Second
+)
+
+// DependencyStatus is the last probe result of a dependency
+type DependencyStatus struct {
+	Reachable bool      `json:"reachable"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Readiness is the readiness of the replica and its dependencies
+type Readiness struct {
+	Ready        bool                        `json:"ready"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+var (
+	startupProbesLock = sync.RWMutex{}
+	startupProbes     = make(map[string]func() error)
+	dependencyStatus  = make(map[string]DependencyStatus)
+
+	ready int32
+)
+
+func init() {
+	RegisterStartupProbe(ProbePulsarAdmin, func() error {
+		return ProbeURL(SingleJoinSlash(GetConfig().BrokerProxyURL, AssignString(GetConfig().Failover.ProbePath, defaultProbePath)))
+	})
+	RegisterStartupProbe(ProbePolicyStore, probePolicyStore)
+}
+
+// RegisterStartupProbe registers the reachability check of a dependency. A check returns nil
+// if the dependency is not configured.
+func RegisterStartupProbe(name string, check func() error) {
+	startupProbesLock.Lock()
+	startupProbes[name] = check
+	startupProbesLock.Unlock()
+}
+
+// probePolicyStore dials the Pulsar broker service, the policy store is only used in the full proxy mode
+func probePolicyStore() error {
+	if IsStatsMode() || GetConfig().PulsarURL == "" {
+		return nil
+	}
+	u, err := url.Parse(GetConfig().PulsarURL)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, secondsOrDefault(GetConfig().Failover.ProbeTimeoutSeconds, defaultProbeTimeout))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// WaitForDependencies probes the dependencies with an exponential backoff until all of them are reachable.
+// It returns an error listing the unreachable dependencies at the end of the maximum wait.
+func WaitForDependencies() error {
+	settings := GetConfig().StartupProbes
+	deadline := time.Now().Add(time.Duration(settings.MaxWaitSeconds) * time.Second)
+	backoff := defaultProbeInitialBackoff
+	if settings.InitialBackoffMs > 0 {
+		backoff = time.Duration(settings.InitialBackoffMs) * time.Millisecond
+	}
+	maxBackoff := secondsOrDefault(settings.MaxBackoffSeconds, defaultProbeMaxBackoff)
+
+	pending := map[string]func() error{}
+	startupProbesLock.RLock()
+	for name, check := range startupProbes {
+		if len(settings.Dependencies) == 0 || StrContains(settings.Dependencies, name) {
+			pending[name] = check
+		}
+	}
+	startupProbesLock.RUnlock()
+
+	for {
+		for name, check := range pending {
+			err := check()
+			startupProbesLock.Lock()
+			status := dependencyStatus[name]
+			status.Attempts++
+			status.Reachable = err == nil
+			status.CheckedAt = time.Now()
+			status.Error = ""
+			if err != nil {
+				status.Error = err.Error()
+			}
+			dependencyStatus[name] = status
+			startupProbesLock.Unlock()
+			if err == nil {
+				log.Infof("startup dependency %s is reachable", name)
+				delete(pending, name)
+			} else {
+				log.Warnf("startup dependency %s is unreachable, attempt %d error %v", name, status.Attempts, err)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			names := []string{}
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unreachable startup dependencies %v after %ds", names, settings.MaxWaitSeconds)
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// MarkReady marks the replica ready to serve
+func MarkReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+// IsReady checks the replica is marked ready
+func IsReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// GetReadiness returns the readiness of the replica and the last probe results of the dependencies
+func GetReadiness() Readiness {
+	readiness := Readiness{Ready: IsReady(), Dependencies: map[string]DependencyStatus{}}
+	startupProbesLock.RLock()
+	for name, status := range dependencyStatus {
+		readiness.Dependencies[name] = status
+	}
+	startupProbesLock.RUnlock()
+	return readiness
+}
@@ -0,0 +1,172 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Per tenant settings merged over the global defaults at request time
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantSettings are the settings a tenant override can change, a zero value keeps the global default
+type TenantSettings struct {
+	// ScrapeCacheTTLSeconds is how long the tenant metrics cache is served before a re-scrape, default to 60
+	ScrapeCacheTTLSeconds int `json:"scrapeCacheTTLSeconds,omitempty"`
+	// RequestsPerSecond limits the requests to the routes of the tenant, 0 is unlimited
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	// RequestBurst is the burst of the tenant rate limit, default to the requests per second
+	RequestBurst int `json:"requestBurst,omitempty"`
+	// MetricAllowlist are the metric name prefixes served to the tenant, empty serves all metrics
+	MetricAllowlist []string `json:"metricAllowlist,omitempty"`
+	// Features are the feature codes allowed to the tenant, they replace the feature codes of the tenant plan
+	Features []string `json:"features,omitempty"`
+	// StatsdHost and StatsdPort are the StatsD daemon the usage summary of the tenant is pushed to
+	StatsdHost string `json:"statsdHost,omitempty"`
+	StatsdPort int    `json:"statsdPort,omitempty"`
+	// StatsdPrefix is the prefix of the StatsD metric names, default to burnell.<tenant>
+	StatsdPrefix string `json:"statsdPrefix,omitempty"`
+	// CloudWatchMetrics are the metric names exported as CloudWatch embedded metric format records, empty exports none
+	CloudWatchMetrics []string `json:"cloudWatchMetrics,omitempty"`
+	// CloudWatchNamespace is the CloudWatch namespace of the exported metrics, default to Pulsar/<tenant>
+	CloudWatchNamespace string `json:"cloudWatchNamespace,omitempty"`
+}
+
+// TenantOverrides is the override layer of a tenant
+type TenantOverrides struct {
+	Tenant    string         `json:"tenant"`
+	Settings  TenantSettings `json:"settings"`
+	Deleted   bool           `json:"deleted,omitempty"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+var tenantOverrides = struct {
+	sync.RWMutex
+	tenants map[string]TenantOverrides
+}{tenants: map[string]TenantOverrides{}}
+
+// Validate verifies the settings
+func (s TenantSettings) Validate() error {
+	if s.ScrapeCacheTTLSeconds < 0 || s.RequestsPerSecond < 0 || s.RequestBurst < 0 {
+		return fmt.Errorf("tenant settings must not be negative")
+	}
+	if s.StatsdPort < 0 || s.StatsdPort > 65535 {
+		return fmt.Errorf("invalid statsd port %d", s.StatsdPort)
+	}
+	for _, prefix := range s.MetricAllowlist {
+		if strings.TrimSpace(prefix) == "" {
+			return fmt.Errorf("metric allowlist must not have an empty prefix")
+		}
+	}
+	for _, name := range s.CloudWatchMetrics {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("cloudwatch metrics must not have an empty name")
+		}
+	}
+	return nil
+}
+
+// merge takes the non-zero settings of the override over s
+func (s TenantSettings) merge(o TenantSettings) TenantSettings {
+	if o.ScrapeCacheTTLSeconds > 0 {
+		s.ScrapeCacheTTLSeconds = o.ScrapeCacheTTLSeconds
+	}
+	if o.RequestsPerSecond > 0 {
+		s.RequestsPerSecond = o.RequestsPerSecond
+	}
+	if o.RequestBurst > 0 {
+		s.RequestBurst = o.RequestBurst
+	}
+	if len(o.MetricAllowlist) > 0 {
+		s.MetricAllowlist = o.MetricAllowlist
+	}
+	if len(o.Features) > 0 {
+		s.Features = o.Features
+	}
+	if o.StatsdHost != "" {
+		s.StatsdHost = o.StatsdHost
+	}
+	if o.StatsdPort > 0 {
+		s.StatsdPort = o.StatsdPort
+	}
+	if o.StatsdPrefix != "" {
+		s.StatsdPrefix = o.StatsdPrefix
+	}
+	if len(o.CloudWatchMetrics) > 0 {
+		s.CloudWatchMetrics = o.CloudWatchMetrics
+	}
+	if o.CloudWatchNamespace != "" {
+		s.CloudWatchNamespace = o.CloudWatchNamespace
+	}
+	return s
+}
+
+// ScrapeCacheTTL returns the metrics cache TTL or the default
+func (s TenantSettings) ScrapeCacheTTL(defaultTTL time.Duration) time.Duration {
+	if s.ScrapeCacheTTLSeconds > 0 {
+		return time.Duration(s.ScrapeCacheTTLSeconds) * time.Second
+	}
+	return defaultTTL
+}
+
+// ApplyTenantOverrides applies an override read from the policy backend, a deleted override is removed
+func ApplyTenantOverrides(o TenantOverrides) {
+	tenantOverrides.Lock()
+	defer tenantOverrides.Unlock()
+	if o.Deleted {
+		delete(tenantOverrides.tenants, o.Tenant)
+	} else {
+		tenantOverrides.tenants[o.Tenant] = o
+	}
+}
+
+// GetTenantOverrides returns the override layer of a tenant
+func GetTenantOverrides(tenant string) (TenantOverrides, bool) {
+	tenantOverrides.RLock()
+	defer tenantOverrides.RUnlock()
+	o, ok := tenantOverrides.tenants[tenant]
+	return o, ok
+}
+
+// ListTenantOverrides returns the override layers of all tenants sorted by the tenant
+func ListTenantOverrides() []TenantOverrides {
+	tenantOverrides.RLock()
+	defer tenantOverrides.RUnlock()
+	list := make([]TenantOverrides, 0, len(tenantOverrides.tenants))
+	for _, o := range tenantOverrides.tenants {
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list
+}
+
+// TenantSettingsOf returns the tenant override merged over the global TenantDefaults
+func TenantSettingsOf(tenant string) TenantSettings {
+	settings := GetConfig().TenantDefaults
+	if o, ok := GetTenantOverrides(tenant); ok {
+		settings = settings.merge(o.Settings)
+	}
+	return settings
+}
@@ -29,6 +29,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -234,3 +235,50 @@ func StringToNewFile(filePath, text string) error {
 
 	return nil
 }
+
+// CompareVersions compares two dotted semantic versions such as 2.8.0 or 2.10.1-SNAPSHOT
+// returns -1, 0, or 1 if a is lower, equal, or higher than b. Pre-release suffixes are ignored.
+func CompareVersions(a, b string) int {
+	as, bs := versionParts(a), versionParts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	parts := []int{}
+	for _, p := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// partitionSuffix matches the partition suffix of a topic name
+var partitionSuffix = regexp.MustCompile(`-partition-\d+$`)
+
+// DeadLetterTopicNames returns the default dead letter and retry topic names of a subscription,
+// which are `<topic>-<subscription>-DLQ` and `<topic>-<subscription>-RETRY` of the non-partitioned topic name
+func DeadLetterTopicNames(topic, subscription string) (string, string) {
+	base := partitionSuffix.ReplaceAllString(topic, "") + "-" + subscription
+	return base + "-DLQ", base + "-RETRY"
+}
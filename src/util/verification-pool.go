@@ -0,0 +1,129 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Bounded worker pool of the token signature verifications, a burst of RSA verifications
+// waits for a worker up to a queue limit and is shed beyond it instead of starving other work.
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultVerificationQueue   = 256
+	defaultVerificationTimeout = 1000 * time.Millisecond
+)
+
+// ErrVerificationOverloaded is returned when a token verification is shed by the worker pool
+var ErrVerificationOverloaded = errors.New("token verification is overloaded")
+
+// VerificationPoolStats is a snapshot of the token verification pool
+type VerificationPoolStats struct {
+	Workers int64 `json:"workers"`
+	// Active is the number of verifications running and Queued the number waiting for a worker
+	Active int64 `json:"active"`
+	Queued int64 `json:"queued"`
+	// Verified is the number of verifications run and Shed the number rejected by the pool
+	Verified int64 `json:"verified"`
+	Shed     int64 `json:"shed"`
+}
+
+type verificationPool struct {
+	workers chan struct{}
+	size    int
+}
+
+var (
+	verificationStats    VerificationPoolStats
+	verificationPoolLock = sync.Mutex{}
+	verificationWorkers  *verificationPool
+)
+
+// GetVerificationPoolStats returns the token verification pool counters
+func GetVerificationPoolStats() VerificationPoolStats {
+	return VerificationPoolStats{
+		Workers:  atomic.LoadInt64(&verificationStats.Workers),
+		Active:   atomic.LoadInt64(&verificationStats.Active),
+		Queued:   atomic.LoadInt64(&verificationStats.Queued),
+		Verified: atomic.LoadInt64(&verificationStats.Verified),
+		Shed:     atomic.LoadInt64(&verificationStats.Shed),
+	}
+}
+
+// currentVerificationPool returns the pool of the configured size, it is rebuilt when the size changes
+func currentVerificationPool() (*verificationPool, TokenVerification) {
+	settings := GetConfig().TokenVerification
+	if settings.Workers <= 0 {
+		settings.Workers = runtime.NumCPU()
+	}
+	if settings.MaxQueue <= 0 {
+		settings.MaxQueue = defaultVerificationQueue
+	}
+	verificationPoolLock.Lock()
+	defer verificationPoolLock.Unlock()
+	if verificationWorkers == nil || verificationWorkers.size != settings.Workers {
+		verificationWorkers = &verificationPool{workers: make(chan struct{}, settings.Workers), size: settings.Workers}
+		atomic.StoreInt64(&verificationStats.Workers, int64(settings.Workers))
+	}
+	return verificationWorkers, settings
+}
+
+// RunTokenVerification runs the verification on a worker of the pool. It returns ErrVerificationOverloaded
+// without running it if the queue is full or no worker is free within the queue timeout.
+func RunTokenVerification(verify func()) error {
+	pool, settings := currentVerificationPool()
+	select {
+	case pool.workers <- struct{}{}:
+	default:
+		if atomic.AddInt64(&verificationStats.Queued, 1) > int64(settings.MaxQueue) {
+			atomic.AddInt64(&verificationStats.Queued, -1)
+			atomic.AddInt64(&verificationStats.Shed, 1)
+			return ErrVerificationOverloaded
+		}
+		timeout := defaultVerificationTimeout
+		if settings.QueueTimeoutMs > 0 {
+			timeout = time.Duration(settings.QueueTimeoutMs) * time.Millisecond
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case pool.workers <- struct{}{}:
+			timer.Stop()
+			atomic.AddInt64(&verificationStats.Queued, -1)
+		case <-timer.C:
+			atomic.AddInt64(&verificationStats.Queued, -1)
+			atomic.AddInt64(&verificationStats.Shed, 1)
+			return ErrVerificationOverloaded
+		}
+	}
+	atomic.AddInt64(&verificationStats.Active, 1)
+	defer func() {
+		atomic.AddInt64(&verificationStats.Active, -1)
+		<-pool.workers
+	}()
+	verify()
+	atomic.AddInt64(&verificationStats.Verified, 1)
+	return nil
+}
@@ -0,0 +1,384 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package util
+
+// Webhook notifications. Tenants and operators register webhooks, and the events are posted as signed JSON
+// with retries. An operator webhook has no tenant and receives the events of all tenants.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	// EventQuotaBreached is the event of a request rejected over the tenant plan limit
+	EventQuotaBreached = "quota.breached"
+	// EventTokenExpiring is the event of a token used close to its expiry
+	EventTokenExpiring = "token.expiring"
+	// EventThresholdCrossed is the event of an alert rule fired or resolved, such as a backlog threshold
+	EventThresholdCrossed = "threshold.crossed"
+	// EventKeyRotationDue is the event of an API key or a signing key older than the rotation age
+	EventKeyRotationDue = "key.rotation-due"
+
+	// WebhookSignatureHeader carries the timestamp and the HMAC-SHA256 signature of a delivery
+	WebhookSignatureHeader = "X-Burnell-Signature"
+	// WebhookEventHeader is the event type of a delivery
+	WebhookEventHeader = "X-Burnell-Event"
+
+	// DeliveryPending is the status of a delivery being attempted
+	DeliveryPending = "pending"
+	// DeliverySucceeded is the status of a delivery accepted by the webhook
+	DeliverySucceeded = "delivered"
+	// DeliveryFailed is the status of a delivery that exhausted the attempts
+	DeliveryFailed = "failed"
+
+	defaultWebhookAttempts = 5
+	maxWebhookDeliveries   = 1000
+	maxNotifyCooldowns     = 10000
+)
+
+// WebhookEvents are the supported event types
+var WebhookEvents = []string{EventQuotaBreached, EventTokenExpiring, EventThresholdCrossed, EventKeyRotationDue}
+
+// Webhook is a registered notification destination. The events are all event types if it is empty.
+type Webhook struct {
+	ID     string   `json:"id"`
+	Tenant string   `json:"tenant,omitempty"`
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	// Secret signs the deliveries, it is only returned when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+// NotificationEvent is the JSON body of a delivery
+type NotificationEvent struct {
+	ID     string      `json:"id"`
+	Type   string      `json:"type"`
+	Tenant string      `json:"tenant"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+// WebhookDelivery is the delivery status of an event to a webhook
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	WebhookID  string    `json:"webhookId"`
+	Tenant     string    `json:"tenant"`
+	EventID    string    `json:"eventId"`
+	EventType  string    `json:"eventType"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	LastError  string    `json:"lastError,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+var webhooks = struct {
+	sync.RWMutex
+	hooks      map[string]Webhook
+	deliveries []*WebhookDelivery
+	cooldowns  map[string]time.Time
+}{hooks: map[string]Webhook{}, cooldowns: map[string]time.Time{}}
+
+// webhookClient connects to the public addresses only and does not follow the redirects,
+// so a webhook cannot reach the internal services or the cloud metadata endpoint
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errors.New("webhook redirects are not followed")
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookDialControl checks the resolved address of every connection of a delivery, the private, loopback,
+// link-local, and metadata addresses are denied unless the private networks are allowed
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	if GetConfig().Notifications.AllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// WebhookRetryDelay is the base delay of the exponential backoff between the delivery attempts
+var WebhookRetryDelay = 2 * time.Second
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewWebhook validates and creates a webhook of a tenant, or an operator webhook if the tenant is empty
+func NewWebhook(tenant, rawURL string, events []string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("webhook url %s must be an absolute http or https url", rawURL)
+	}
+	for _, e := range events {
+		if !StrContains(WebhookEvents, e) {
+			return Webhook{}, fmt.Errorf("unsupported event %s, the events are %v", e, WebhookEvents)
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+	return Webhook{
+		ID:        randomHex(8),
+		Tenant:    tenant,
+		URL:       rawURL,
+		Events:    events,
+		Secret:    base64.RawURLEncoding.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// ApplyWebhook adds, replaces, or removes a deleted webhook in the local registry
+func ApplyWebhook(hook Webhook) {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	if hook.Deleted {
+		delete(webhooks.hooks, hook.ID)
+	} else {
+		webhooks.hooks[hook.ID] = hook
+	}
+}
+
+// GetWebhook returns a webhook without the secret
+func GetWebhook(id string) (Webhook, bool) {
+	webhooks.RLock()
+	hook, ok := webhooks.hooks[id]
+	webhooks.RUnlock()
+	hook.Secret = ""
+	return hook, ok
+}
+
+// SnapshotWebhooks returns the webhooks of all tenants with the secrets, for the policy store snapshot
+func SnapshotWebhooks() []Webhook {
+	webhooks.RLock()
+	defer webhooks.RUnlock()
+	list := make([]Webhook, 0, len(webhooks.hooks))
+	for _, hook := range webhooks.hooks {
+		list = append(list, hook)
+	}
+	return list
+}
+
+// ListWebhooks returns the webhooks of a tenant, or the operator webhooks if the tenant is empty, without the secrets
+func ListWebhooks(tenant string) []Webhook {
+	webhooks.RLock()
+	list := []Webhook{}
+	for _, hook := range webhooks.hooks {
+		if hook.Tenant == tenant {
+			hook.Secret = ""
+			list = append(list, hook)
+		}
+	}
+	webhooks.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// SignWebhook is the hex HMAC-SHA256 of the timestamp and the body joined by a dot.
+// The signature header is in the format of t=timestamp,v1=signature.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NotificationCooldown is the configured cooldown of the repeated events, default to 60 minutes
+func NotificationCooldown() time.Duration {
+	if minutes := GetConfig().Notifications.CooldownMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 60 * time.Minute
+}
+
+// Notify posts an event to the webhooks of the tenant and the operator webhooks. The repeated events of the same
+// type and key are suppressed within the cooldown, a zero cooldown notifies every event.
+func Notify(eventType, tenant, key string, cooldown time.Duration, data interface{}) {
+	now := time.Now()
+	webhooks.Lock()
+	targets := []Webhook{}
+	for _, hook := range webhooks.hooks {
+		if (hook.Tenant == "" || hook.Tenant == tenant) && (len(hook.Events) == 0 || StrContains(hook.Events, eventType)) {
+			targets = append(targets, hook)
+		}
+	}
+	cooldownKey := eventType + "|" + tenant + "|" + key
+	if len(targets) == 0 || now.Before(webhooks.cooldowns[cooldownKey]) {
+		webhooks.Unlock()
+		return
+	}
+	if cooldown > 0 {
+		if len(webhooks.cooldowns) >= maxNotifyCooldowns {
+			for k, until := range webhooks.cooldowns {
+				if !now.Before(until) {
+					delete(webhooks.cooldowns, k)
+				}
+			}
+		}
+		webhooks.cooldowns[cooldownKey] = now.Add(cooldown)
+	}
+	event := NotificationEvent{ID: randomHex(8), Type: eventType, Tenant: tenant, Time: now, Data: data}
+	deliveries := make([]*WebhookDelivery, 0, len(targets))
+	for _, hook := range targets {
+		d := &WebhookDelivery{
+			ID:        randomHex(8),
+			WebhookID: hook.ID,
+			Tenant:    hook.Tenant,
+			EventID:   event.ID,
+			EventType: eventType,
+			Status:    DeliveryPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		deliveries = append(deliveries, d)
+		webhooks.deliveries = append(webhooks.deliveries, d)
+	}
+	if over := len(webhooks.deliveries) - maxWebhookDeliveries; over > 0 {
+		webhooks.deliveries = webhooks.deliveries[over:]
+	}
+	webhooks.Unlock()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("failed to marshal %s event error %v", eventType, err)
+		return
+	}
+	for i, hook := range targets {
+		go deliverWebhook(hook, deliveries[i], eventType, body)
+	}
+}
+
+func deliverWebhook(hook Webhook, d *WebhookDelivery, eventType string, body []byte) {
+	attempts := GetConfig().Notifications.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	for attempt := 1; attempt <= attempts; attempt++ {
+		code, err := postWebhook(hook, eventType, body)
+		webhooks.Lock()
+		d.Attempts, d.StatusCode, d.UpdatedAt = attempt, code, time.Now()
+		if err == nil {
+			d.Status, d.LastError = DeliverySucceeded, ""
+			webhooks.Unlock()
+			return
+		}
+		d.LastError = err.Error()
+		if attempt == attempts {
+			d.Status = DeliveryFailed
+		}
+		webhooks.Unlock()
+		if attempt < attempts {
+			time.Sleep(WebhookRetryDelay * time.Duration(1<<uint(attempt-1)))
+		}
+	}
+	log.Warnf("failed to deliver %s event to webhook %s after %d attempts", eventType, hook.ID, attempts)
+}
+
+func postWebhook(hook Webhook, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, eventType)
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, SignWebhook(hook.Secret, timestamp, body)))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("failure status code %v", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// GetWebhookDeliveries returns the recent deliveries of a tenant, or all tenants if the tenant is empty,
+// filtered by the status if it is not empty, the latest first
+func GetWebhookDeliveries(tenant, status string) []WebhookDelivery {
+	webhooks.RLock()
+	list := []WebhookDelivery{}
+	for i := len(webhooks.deliveries) - 1; i >= 0; i-- {
+		d := webhooks.deliveries[i]
+		if (tenant == "" || d.Tenant == tenant) && (status == "" || d.Status == status) {
+			list = append(list, *d)
+		}
+	}
+	webhooks.RUnlock()
+	return list
+}
+
+// ResetWebhooks removes the webhooks, the deliveries, and the cooldowns from the local registry
+func ResetWebhooks() {
+	webhooks.Lock()
+	webhooks.hooks = map[string]Webhook{}
+	webhooks.deliveries = nil
+	webhooks.cooldowns = map[string]time.Time{}
+	webhooks.Unlock()
+}
@@ -0,0 +1,396 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package workflow
+
+// Bootstrap of the tenants, namespaces, policies, and tokens declared in a manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/k8s"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/ghodss/yaml"
+	"github.com/golang-jwt/jwt"
+)
+
+// bootstrapSubject is the audit subject of the changes made by the bootstrap
+const bootstrapSubject = "burnell-bootstrap"
+
+// pulsarName is a valid Pulsar tenant or namespace name
+var pulsarName = regexp.MustCompile(`^[-=:.\w]+$`)
+
+// Manifest declares the tenants, namespaces, policies, and tokens of a cluster
+type Manifest struct {
+	Tenants []TenantSpec `json:"tenants"`
+	Tokens  []TokenSpec  `json:"tokens"`
+	// Revision is the commit SHA of a manifest pulled by GitOps
+	Revision string `json:"-"`
+}
+
+// TenantSpec is a declared tenant
+type TenantSpec struct {
+	Name       string   `json:"name"`
+	AdminRoles []string `json:"adminRoles"`
+	// AllowedClusters default to the ClusterName
+	AllowedClusters []string `json:"allowedClusters"`
+	// Plan is the plan type of the tenant policy, such as free, starter, production, dedicated, or private
+	Plan string `json:"plan"`
+	Org  string `json:"org"`
+	// Settings are the tenant overrides
+	Settings   *util.TenantSettings `json:"settings"`
+	Namespaces []NamespaceSpec      `json:"namespaces"`
+}
+
+// NamespaceSpec is a declared namespace, a zero value leaves the broker default
+type NamespaceSpec struct {
+	Name string `json:"name"`
+	// RetentionMinutes and RetentionSizeMB are the retention policy, -1 is infinite
+	RetentionMinutes  int `json:"retentionMinutes"`
+	RetentionSizeMB   int `json:"retentionSizeMB"`
+	MessageTTLSeconds int `json:"messageTTLSeconds"`
+	// Permissions grant the actions, such as produce, consume, and functions, to the roles
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// TokenSpec is a declared token of a subject, stored in a Kubernetes secret or a file
+type TokenSpec struct {
+	Subject string `json:"subject"`
+	// Secret is the Kubernetes secret under PulsarNamespace, default to token-<subject> without the file
+	Secret string `json:"secret"`
+	// File is the path of the token file instead of a secret
+	File string `json:"file"`
+	// Expiry is the duration of the token such as 8760h, empty never expires
+	Expiry string `json:"expiry"`
+	// namespace of the secret, default to PulsarNamespace
+	namespace string
+}
+
+// LoadManifest reads and validates a yaml or json manifest
+func LoadManifest(path string) (Manifest, error) {
+	var m Manifest
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid manifest %s %v", path, err)
+	}
+	return m, m.Validate()
+}
+
+// Validate checks the names and the settings
+func (m Manifest) Validate() error {
+	tenants := map[string]bool{}
+	for _, t := range m.Tenants {
+		if !pulsarName.MatchString(t.Name) || tenants[t.Name] {
+			return fmt.Errorf("invalid or duplicate tenant name %q", t.Name)
+		}
+		tenants[t.Name] = true
+		if t.Settings != nil {
+			if err := t.Settings.Validate(); err != nil {
+				return fmt.Errorf("tenant %s settings %v", t.Name, err)
+			}
+		}
+		namespaces := map[string]bool{}
+		for _, ns := range t.Namespaces {
+			if !pulsarName.MatchString(ns.Name) || namespaces[ns.Name] {
+				return fmt.Errorf("invalid or duplicate namespace name %q of tenant %s", ns.Name, t.Name)
+			}
+			namespaces[ns.Name] = true
+		}
+	}
+	for _, token := range m.Tokens {
+		if token.Subject == "" {
+			return errors.New("token subject is missing")
+		}
+		if token.Expiry != "" {
+			if _, err := time.ParseDuration(token.Expiry); err != nil {
+				return fmt.Errorf("token %s expiry %v", token.Subject, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RunBootstrap applies the configured manifest, it is a no-op without the manifest
+func RunBootstrap() error {
+	path := util.GetConfig().BootstrapManifest
+	if path == "" {
+		return nil
+	}
+	m, err := LoadManifest(path)
+	if err != nil {
+		return err
+	}
+	created, err := Bootstrap(m)
+	log.Infof("bootstrap manifest %s created %d resources %v", path, len(created), created)
+	return err
+}
+
+// Bootstrap creates the declared resources that are missing, the existing resources are never changed.
+// It returns the created resources, such as tenant/acme and namespace/acme/orders. An error does not stop the
+// other resources and the last error is returned.
+func Bootstrap(m Manifest) ([]string, error) {
+	created := []string{}
+	var lastErr error
+	record := func(resource string, err error) {
+		e := audit.Event{Subject: bootstrapSubject, Action: "bootstrap.create", Resource: resource, Outcome: audit.Succeeded}
+		e.Tenant = tenantOfResource(resource)
+		if err != nil {
+			e.Outcome, e.Reason = audit.Failed, err.Error()
+			lastErr = err
+			log.Errorf("bootstrap failed to create %s %v", resource, err)
+		} else {
+			created = append(created, resource)
+		}
+		audit.Record(e)
+	}
+
+	tenants, err := policy.AdminAPIGETRespStringArray("tenants")
+	if err != nil {
+		return created, err
+	}
+	for _, t := range m.Tenants {
+		if !util.StrContains(tenants, t.Name) {
+			record("tenant/"+t.Name, createTenant(t))
+		}
+		if err := bootstrapNamespaces(t, record); err != nil {
+			lastErr = err
+		}
+		bootstrapTenantPolicy(t, record)
+	}
+	for _, token := range m.Tokens {
+		exists, err := tokenExists(token)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !exists {
+			record("token/"+token.Subject, createToken(token))
+		}
+	}
+	return created, lastErr
+}
+
+// tenantOfResource returns the tenant of a tenant, namespace, plan, or settings resource
+func tenantOfResource(resource string) string {
+	parts := strings.Split(resource, "/")
+	if len(parts) > 1 && parts[0] != "token" {
+		return parts[1]
+	}
+	return ""
+}
+
+func createTenant(t TenantSpec) error {
+	clusters := t.AllowedClusters
+	if len(clusters) == 0 {
+		clusters = []string{util.GetConfig().ClusterName}
+	}
+	return adminRequest(http.MethodPut, "tenants/"+t.Name, map[string][]string{
+		"adminRoles":      t.AdminRoles,
+		"allowedClusters": clusters,
+	})
+}
+
+func bootstrapNamespaces(t TenantSpec, record func(string, error)) error {
+	if len(t.Namespaces) == 0 {
+		return nil
+	}
+	namespaces, err := policy.AdminAPIGETRespStringArray("namespaces/" + t.Name)
+	if err != nil {
+		return err
+	}
+	for _, ns := range t.Namespaces {
+		name := t.Name + "/" + ns.Name
+		if !util.StrContains(namespaces, name) {
+			record("namespace/"+name, createNamespace(name, ns))
+		}
+	}
+	return nil
+}
+
+// createNamespace creates the namespace and sets its declared policies
+func createNamespace(name string, ns NamespaceSpec) error {
+	if err := adminRequest(http.MethodPut, "namespaces/"+name, nil); err != nil {
+		return err
+	}
+	if ns.RetentionMinutes != 0 || ns.RetentionSizeMB != 0 {
+		if err := adminRequest(http.MethodPost, "namespaces/"+name+"/retention", map[string]int{
+			"retentionTimeInMinutes": ns.RetentionMinutes,
+			"retentionSizeInMB":      ns.RetentionSizeMB,
+		}); err != nil {
+			return err
+		}
+	}
+	if ns.MessageTTLSeconds != 0 {
+		if err := adminRequest(http.MethodPost, "namespaces/"+name+"/messageTTL", ns.MessageTTLSeconds); err != nil {
+			return err
+		}
+	}
+	for role, actions := range ns.Permissions {
+		if err := adminRequest(http.MethodPost, "namespaces/"+name+"/permissions/"+role, actions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bootstrapTenantPolicy creates the plan and the settings in the policy store if the tenant has none,
+// they are skipped when the policy store is not initialized such as in the stats mode
+func bootstrapTenantPolicy(t TenantSpec, record func(string, error)) {
+	if t.Plan == "" && t.Settings == nil {
+		return
+	}
+	if policy.OverridesStore == nil {
+		log.Warnf("bootstrap skips the plan and settings of tenant %s without the policy store", t.Name)
+		return
+	}
+	if t.Plan != "" {
+		if _, err := policy.TenantManager.GetTenant(t.Name); err != nil {
+			_, _, err := policy.TenantManager.UpdateTenant(t.Name, policy.TenantPlan{PlanType: t.Plan, Org: t.Org, Audit: "bootstrap manifest"})
+			record("plan/"+t.Name, err)
+		}
+	}
+	if t.Settings != nil {
+		if _, ok := util.GetTenantOverrides(t.Name); !ok {
+			_, err := policy.OverridesStore.PutOverrides(t.Name, *t.Settings)
+			record("settings/"+t.Name, err)
+		}
+	}
+}
+
+func tokenSecretName(token TokenSpec) string {
+	return util.AssignString(token.Secret, "token-"+token.Subject)
+}
+
+func tokenNamespace(token TokenSpec) string {
+	return util.AssignString(token.namespace, util.GetConfig().PulsarNamespace)
+}
+
+func bootstrapK8sClient() (*k8s.Client, error) {
+	if k8s.LocalClient != nil {
+		return k8s.LocalClient, nil
+	}
+	client, err := k8s.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	k8s.LocalClient = client
+	return client, nil
+}
+
+func tokenExists(token TokenSpec) (bool, error) {
+	if token.File != "" {
+		_, err := os.Stat(token.File)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	client, err := bootstrapK8sClient()
+	if err != nil {
+		return false, err
+	}
+	_, err = client.GetSecret(tokenNamespace(token), tokenSecretName(token))
+	return err == nil, nil
+}
+
+// createToken signs the token with the configured private key and stores it
+func createToken(token TokenSpec) error {
+	if util.JWTAuth == nil {
+		return errors.New("no private key to sign the token")
+	}
+	var expiry time.Duration
+	if token.Expiry != "" {
+		expiry, _ = time.ParseDuration(token.Expiry)
+	}
+	tokenString, err := util.JWTAuth.GenerateToken(token.Subject, expiry, jwt.SigningMethodRS256)
+	if err != nil {
+		return err
+	}
+	if token.File != "" {
+		if err := os.MkdirAll(filepath.Dir(token.File), 0700); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(token.File, []byte(tokenString), 0600)
+	}
+	client, err := bootstrapK8sClient()
+	if err != nil {
+		return err
+	}
+	return client.CreateSecret(tokenNamespace(token), tokenSecretName(token), map[string][]byte{
+		token.Subject + JWTFileExtension: []byte(tokenString),
+	})
+}
+
+// adminRequest sends a request to the admin REST API of the default cluster with the super role token.
+// A conflict is not an error since another replica may have created the resource.
+func adminRequest(method, subroute string, body interface{}) error {
+	status, err := adminDo(method, subroute, body)
+	if status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// adminDo sends a request to the admin REST API of the default cluster with the super role token, and returns
+// the status code. A status code other than 2xx is an error.
+func adminDo(method, subroute string, body interface{}) (int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	requestURL := util.SingleJoinSlash(util.SingleJoinSlash(util.DefaultAdminURL(), "/admin/v2"), subroute)
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("X-Proxy", "burnell")
+	req.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	resp, err := util.UpstreamClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp.StatusCode, nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, fmt.Errorf("%s %s returns status code %d %s", method, subroute, resp.StatusCode, string(msg))
+}
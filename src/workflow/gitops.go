@@ -0,0 +1,218 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package workflow
+
+// GitOps source of the manifest of the tenants and policies
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+var (
+	gitopsLock      sync.Mutex
+	appliedRevision string
+	gitopsTrigger   = make(chan struct{}, 1)
+)
+
+func gitopsConfig() util.GitOps {
+	cfg := util.GetConfig().GitOps
+	if cfg.Branch == "" {
+		cfg.Branch = "main"
+	}
+	if cfg.Path == "" {
+		cfg.Path = "manifest.yaml"
+	}
+	if cfg.PollSeconds <= 0 {
+		cfg.PollSeconds = 60
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(os.TempDir(), "burnell-gitops")
+	}
+	return cfg
+}
+
+// StartGitOps applies the manifest of every new commit of the branch, on the poll interval or when a webhook
+// triggers a sync. Only the leader applies when the leader election is enabled.
+func StartGitOps() {
+	cfg := gitopsConfig()
+	if cfg.Repository == "" {
+		return
+	}
+	interval := time.Duration(cfg.PollSeconds) * time.Second
+	log.Infof("gitops repository %s branch %s path %s poll interval %v", cfg.Repository, cfg.Branch, cfg.Path, interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			if util.IsLeader() {
+				SyncGitOps()
+			}
+			select {
+			case <-ticker.C:
+			case <-gitopsTrigger:
+			}
+		}
+	}()
+}
+
+// TriggerGitOpsSync requests a sync without waiting for the poll interval
+func TriggerGitOpsSync() {
+	select {
+	case gitopsTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// SyncGitOps pulls the branch and reconciles the manifest when the commit has not been applied yet. It returns
+// the report and whether the commit was applied. A failed reconciliation is retried at the next sync.
+func SyncGitOps() (ReconcileReport, bool) {
+	cfg := gitopsConfig()
+	dryRun := util.GetConfig().Reconciliation.DryRun
+	m, err := PullManifest()
+	if err != nil {
+		report := ReconcileReport{Time: time.Now(), DryRun: dryRun, Revision: m.Revision, Drifts: []Drift{}, Error: err.Error()}
+		keepReconcileReport(cfg.Repository, report)
+		return report, false
+	}
+	gitopsLock.Lock()
+	applied := appliedRevision
+	gitopsLock.Unlock()
+	if m.Revision == applied {
+		return LastReconcileReport(), false
+	}
+	log.Infof("gitops apply revision %s of %s dry run %v", m.Revision, cfg.Repository, dryRun)
+	report := Reconcile(m, dryRun)
+	keepReconcileReport(cfg.Repository, report)
+	if report.Error == "" {
+		gitopsLock.Lock()
+		appliedRevision = m.Revision
+		gitopsLock.Unlock()
+	}
+	return report, true
+}
+
+// PullManifest clones or fetches the branch and loads the manifest of its head commit
+func PullManifest() (Manifest, error) {
+	cfg := gitopsConfig()
+	gitopsLock.Lock()
+	defer gitopsLock.Unlock()
+	if _, err := os.Stat(filepath.Join(cfg.Dir, ".git")); err != nil {
+		if err := os.RemoveAll(cfg.Dir); err != nil {
+			return Manifest{}, err
+		}
+		if _, err := runGit(cfg, "", "clone", "--depth", "1", "--branch", cfg.Branch, cfg.Repository, cfg.Dir); err != nil {
+			return Manifest{}, err
+		}
+	} else {
+		// fetch from the configured URL rather than origin in case the repository has been reconfigured
+		if _, err := runGit(cfg, cfg.Dir, "fetch", "--depth", "1", cfg.Repository, cfg.Branch); err != nil {
+			return Manifest{}, err
+		}
+		if _, err := runGit(cfg, cfg.Dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return Manifest{}, err
+		}
+	}
+	return loadCheckout(cfg)
+}
+
+// checkedOutManifest loads the manifest of the current checkout, or pulls when nothing is checked out yet
+func checkedOutManifest() (Manifest, error) {
+	cfg := gitopsConfig()
+	gitopsLock.Lock()
+	if _, err := os.Stat(filepath.Join(cfg.Dir, ".git")); err == nil {
+		defer gitopsLock.Unlock()
+		return loadCheckout(cfg)
+	}
+	gitopsLock.Unlock()
+	return PullManifest()
+}
+
+func loadCheckout(cfg util.GitOps) (Manifest, error) {
+	revision, err := runGit(cfg, cfg.Dir, "rev-parse", "HEAD")
+	if err != nil {
+		return Manifest{}, err
+	}
+	m, err := LoadManifest(filepath.Join(cfg.Dir, filepath.FromSlash(cfg.Path)))
+	m.Revision = revision
+	if err != nil {
+		return m, fmt.Errorf("revision %s %v", revision, err)
+	}
+	return m, nil
+}
+
+// runGit runs a git command without prompts. The basic auth header is passed in the environment to keep
+// the token out of the process arguments.
+func runGit(cfg util.GitOps, dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if cfg.Token != "" {
+		username := cfg.Username
+		if username == "" {
+			username = "git"
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + cfg.Token))
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed %v %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// VerifyGitWebhook checks the HMAC SHA256 signature of a GitHub webhook, or the token of a GitLab webhook
+func VerifyGitWebhook(secret string, header http.Header, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+// GitOpsBranchRef is the ref of the configured branch in the push webhooks
+func GitOpsBranchRef() string {
+	return "refs/heads/" + gitopsConfig().Branch
+}
@@ -145,6 +145,9 @@ func (m *Cluster) Create() error {
 	if err != nil {
 		return err
 	}
+	if !util.GetConfig().TokenClaims.IsEmpty() {
+		rsaKey.ClaimsTemplate = &util.GetConfig().TokenClaims
+	}
 	keysAndJWTs := KeysJWTs{
 		KeyManager: rsaKey,
 		PulsarJWTs: make(map[string]string),
@@ -188,6 +191,9 @@ func (m *Cluster) Healer() error {
 	if err != nil {
 		return err
 	}
+	if !util.GetConfig().TokenClaims.IsEmpty() {
+		rsaKey.ClaimsTemplate = &util.GetConfig().TokenClaims
+	}
 	keysAndJWTs := KeysJWTs{
 		KeyManager: rsaKey,
 		PulsarJWTs: make(map[string]string),
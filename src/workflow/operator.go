@@ -0,0 +1,324 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package workflow
+
+// Kubernetes operator of the tenant, namespace policy, and token custom resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/k8s"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	operatorGroup         = "burnell.datastax.com"
+	operatorVersion       = "v1alpha1"
+	defaultOperatorResync = 300 * time.Second
+)
+
+var (
+	// TenantResource is the PulsarTenant custom resource
+	TenantResource = schema.GroupVersionResource{Group: operatorGroup, Version: operatorVersion, Resource: "pulsartenants"}
+	// NamespacePolicyResource is the PulsarNamespacePolicy custom resource
+	NamespacePolicyResource = schema.GroupVersionResource{Group: operatorGroup, Version: operatorVersion, Resource: "pulsarnamespacepolicies"}
+	// TokenResource is the PulsarToken custom resource
+	TokenResource = schema.GroupVersionResource{Group: operatorGroup, Version: operatorVersion, Resource: "pulsartokens"}
+
+	operatorTrigger = make(chan struct{}, 1)
+)
+
+// namespacePolicySpec is the spec of a PulsarNamespacePolicy, the namespace name defaults to the resource name
+type namespacePolicySpec struct {
+	Tenant string `json:"tenant"`
+	NamespaceSpec
+}
+
+// readyCondition is the Ready condition in the status of a custom resource
+type readyCondition struct {
+	status  bool
+	reason  string
+	message string
+}
+
+// StartOperator watches the custom resources and reconciles them on a change or the resync interval.
+// Only the leader reconciles when the leader election is enabled.
+func StartOperator() error {
+	cfg := util.GetConfig().Operator
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Namespace == "" || cfg.Tenant == "" {
+		return errors.New("the operator requires the watched namespace and its tenant")
+	}
+	client, err := k8s.GetK8sClient()
+	if err != nil {
+		return err
+	}
+	resync := defaultOperatorResync
+	if cfg.ResyncSeconds > 0 {
+		resync = time.Duration(cfg.ResyncSeconds) * time.Second
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client.Dynamic, 0, cfg.Namespace, nil)
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { triggerOperator() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// the status updates do not change the generation of the spec
+			o, ok1 := oldObj.(*unstructured.Unstructured)
+			n, ok2 := newObj.(*unstructured.Unstructured)
+			if ok1 && ok2 && o.GetGeneration() == n.GetGeneration() {
+				return
+			}
+			triggerOperator()
+		},
+	}
+	for _, gvr := range []schema.GroupVersionResource{TenantResource, NamespacePolicyResource, TokenResource} {
+		factory.ForResource(gvr).Informer().AddEventHandler(handler)
+	}
+	factory.Start(wait.NeverStop)
+	log.Infof("operator watches namespace %q of tenant %s resync interval %v", cfg.Namespace, cfg.Tenant, resync)
+
+	go func() {
+		ticker := time.NewTicker(resync)
+		for {
+			select {
+			case <-ticker.C:
+			case <-operatorTrigger:
+			}
+			if util.IsLeader() {
+				if err := SyncOperator(client.Dynamic, cfg.Namespace, cfg.Tenant); err != nil {
+					log.Errorf("operator sync error %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func triggerOperator() {
+	select {
+	case operatorTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// SyncOperator reconciles the tenants, then the namespace policies, and then the tokens of the namespace, and
+// updates the Ready condition of every resource. The resources can only manage the tenant mapped to the namespace.
+// Deleting a resource leaves the provisioned tenant, namespace, or token as it is.
+func SyncOperator(client dynamic.Interface, namespace, tenant string) error {
+	if namespace == "" || tenant == "" {
+		return errors.New("the operator requires the watched namespace and its tenant")
+	}
+	var lastErr error
+	for _, r := range []struct {
+		gvr       schema.GroupVersionResource
+		reconcile func(*unstructured.Unstructured, string) readyCondition
+	}{
+		{TenantResource, reconcileTenantResource},
+		{NamespacePolicyResource, reconcileNamespacePolicyResource},
+		{TokenResource, reconcileTokenResource},
+	} {
+		list, err := client.Resource(r.gvr).Namespace(namespace).List(context.TODO(), meta_v1.ListOptions{})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			if err := updateReadyCondition(client, r.gvr, obj, r.reconcile(obj, tenant)); err != nil {
+				log.Errorf("failed to update the status of %s %s/%s %v", r.gvr.Resource, obj.GetNamespace(), obj.GetName(), err)
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+func reconcileTenantResource(obj *unstructured.Unstructured, tenant string) readyCondition {
+	var t TenantSpec
+	if err := decodeSpec(obj, &t); err != nil {
+		return readyCondition{reason: "InvalidSpec", message: err.Error()}
+	}
+	t.Name, t.Namespaces = util.AssignString(t.Name, obj.GetName()), nil
+	if t.Name != tenant {
+		return forbiddenCondition(obj, "tenant "+t.Name)
+	}
+	m := Manifest{Tenants: []TenantSpec{t}}
+	if err := m.Validate(); err != nil {
+		return readyCondition{reason: "InvalidSpec", message: err.Error()}
+	}
+	return reportCondition(Reconcile(m, false))
+}
+
+func reconcileNamespacePolicyResource(obj *unstructured.Unstructured, tenant string) readyCondition {
+	var spec namespacePolicySpec
+	if err := decodeSpec(obj, &spec); err != nil {
+		return readyCondition{reason: "InvalidSpec", message: err.Error()}
+	}
+	spec.Name, spec.Tenant = util.AssignString(spec.Name, obj.GetName()), util.AssignString(spec.Tenant, tenant)
+	if spec.Tenant != tenant {
+		return forbiddenCondition(obj, "tenant "+spec.Tenant)
+	}
+	t := TenantSpec{Name: spec.Tenant, Namespaces: []NamespaceSpec{spec.NamespaceSpec}}
+	if err := (Manifest{Tenants: []TenantSpec{t}}).Validate(); err != nil {
+		return readyCondition{reason: "InvalidSpec", message: err.Error()}
+	}
+	tenants, err := policy.AdminAPIGETRespStringArray("tenants")
+	if err != nil {
+		return readyCondition{reason: "ReconcileFailed", message: err.Error()}
+	}
+	if !util.StrContains(tenants, t.Name) {
+		return readyCondition{reason: "TenantNotFound", message: fmt.Sprintf("tenant %s does not exist", t.Name)}
+	}
+	report, drift := newReconciler("", false)
+	if err := reconcileNamespaces(t, drift); err != nil {
+		report.Error = err.Error()
+	}
+	return reportCondition(*report)
+}
+
+// reconcileTokenResource issues the token of a subject of the tenant into a secret in the namespace of the resource,
+// an existing secret is never changed
+func reconcileTokenResource(obj *unstructured.Unstructured, tenant string) readyCondition {
+	var token TokenSpec
+	if err := decodeSpec(obj, &token); err != nil {
+		return readyCondition{reason: "InvalidSpec", message: err.Error()}
+	}
+	if util.StrContains(util.SuperRoles, token.Subject) || !isTenantSubject(token.Subject, tenant) {
+		return forbiddenCondition(obj, "subject "+token.Subject)
+	}
+	token.Secret, token.File, token.namespace = util.AssignString(token.Secret, obj.GetName()), "", obj.GetNamespace()
+	if err := (Manifest{Tokens: []TokenSpec{token}}).Validate(); err != nil {
+		return readyCondition{reason: "InvalidSpec", message: err.Error()}
+	}
+	exists, err := tokenExists(token)
+	if err != nil {
+		return readyCondition{reason: "ReconcileFailed", message: err.Error()}
+	}
+	if !exists {
+		e := audit.Event{Subject: bootstrapSubject, Action: "reconcile.fix", Resource: "token/" + token.Subject, Outcome: audit.Succeeded}
+		err = createToken(token)
+		if err != nil {
+			e.Outcome, e.Reason = audit.Failed, err.Error()
+		}
+		audit.Record(e)
+		if err != nil {
+			return readyCondition{reason: "ReconcileFailed", message: err.Error()}
+		}
+	}
+	return readyCondition{status: true, reason: "Issued", message: "secret " + token.Secret}
+}
+
+// isTenantSubject returns true if the subject is the tenant, <tenant>-<id>, <tenant>-client-<id>, or
+// <tenant>-admin-<id>, the same way as the route package extracts the tenant of a subject
+func isTenantSubject(subject, tenant string) bool {
+	if subject == tenant {
+		return true
+	}
+	id := strings.TrimPrefix(subject, tenant+"-")
+	if id == subject {
+		return false
+	}
+	if parts := strings.SplitN(id, "-", 2); len(parts) == 2 && (parts[0] == "client" || parts[0] == "admin") {
+		id = parts[1]
+	}
+	return id != "" && !strings.Contains(id, "-")
+}
+
+func forbiddenCondition(obj *unstructured.Unstructured, target string) readyCondition {
+	return readyCondition{reason: "Forbidden", message: fmt.Sprintf("%s is not allowed in namespace %s", target, obj.GetNamespace())}
+}
+
+func decodeSpec(obj *unstructured.Unstructured, v interface{}) error {
+	data, err := json.Marshal(obj.Object["spec"])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func reportCondition(report ReconcileReport) readyCondition {
+	if report.Error != "" {
+		return readyCondition{reason: "ReconcileFailed", message: report.Error}
+	}
+	for _, d := range report.Drifts {
+		if d.Error != "" {
+			return readyCondition{reason: "ReconcileFailed", message: d.Resource + " " + d.Error}
+		}
+	}
+	if len(report.Drifts) == 0 {
+		return readyCondition{status: true, reason: "Reconciled", message: "in sync"}
+	}
+	return readyCondition{status: true, reason: "Reconciled", message: fmt.Sprintf("fixed %d drifts", len(report.Drifts))}
+}
+
+// updateReadyCondition updates the status when the condition or the observed generation changes, the transition
+// time is kept while the status stays the same
+func updateReadyCondition(client dynamic.Interface, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, c readyCondition) error {
+	status := "False"
+	if c.status {
+		status = "True"
+	}
+	transition := time.Now().UTC().Format(time.RFC3339)
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	for _, item := range conditions {
+		current, ok := item.(map[string]interface{})
+		if !ok || current["type"] != "Ready" || current["status"] != status {
+			continue
+		}
+		if current["reason"] == c.reason && current["message"] == c.message && observed == obj.GetGeneration() {
+			return nil
+		}
+		if t, ok := current["lastTransitionTime"].(string); ok {
+			transition = t
+		}
+	}
+	updated := obj.DeepCopy()
+	updated.Object["status"] = map[string]interface{}{
+		"observedGeneration": obj.GetGeneration(),
+		"conditions": []interface{}{map[string]interface{}{
+			"type":               "Ready",
+			"status":             status,
+			"reason":             c.reason,
+			"message":            c.message,
+			"lastTransitionTime": transition,
+		}},
+	}
+	_, err := client.Resource(gvr).Namespace(obj.GetNamespace()).UpdateStatus(context.TODO(), updated, meta_v1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,353 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package workflow
+
+// Provisioning of tenants, namespaces, and tokens with a full replacement semantics for the provisioning API
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+// ProvisionError is a provisioning failure with the status code of the provisioning API
+type ProvisionError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *ProvisionError) Error() string {
+	return e.Err.Error()
+}
+
+func provisionError(statusCode int, format string, a ...interface{}) error {
+	return &ProvisionError{StatusCode: statusCode, Err: fmt.Errorf(format, a...)}
+}
+
+// upstreamError keeps a conflict of the admin REST API, other failures are a bad gateway
+func upstreamError(status int, err error) error {
+	if status == http.StatusConflict || status == http.StatusPreconditionFailed {
+		return &ProvisionError{StatusCode: http.StatusConflict, Err: err}
+	}
+	return &ProvisionError{StatusCode: http.StatusBadGateway, Err: err}
+}
+
+// ProvisionedTenant is a tenant of the provisioning API, the ID is the tenant name
+type ProvisionedTenant struct {
+	ID              string   `json:"id"`
+	AdminRoles      []string `json:"adminRoles"`
+	AllowedClusters []string `json:"allowedClusters"`
+	// Plan and Org are the tenant plan, an empty plan leaves the plan as it is
+	Plan string `json:"plan,omitempty"`
+	Org  string `json:"org,omitempty"`
+	// Settings are the tenant overrides, nil removes the overrides
+	Settings *util.TenantSettings `json:"settings,omitempty"`
+}
+
+// ProvisionedNamespace is a namespace of the provisioning API, the ID is tenant/namespace
+type ProvisionedNamespace struct {
+	ID string `json:"id"`
+	// RetentionMinutes and RetentionSizeMB are the retention policy, -1 is infinite
+	RetentionMinutes  int `json:"retentionMinutes"`
+	RetentionSizeMB   int `json:"retentionSizeMB"`
+	MessageTTLSeconds int `json:"messageTTLSeconds"`
+	// Permissions are all the granted actions by the role, the undeclared roles are revoked
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// ProvisionedToken is a named API key of a tenant, the ID is the API key ID. A token is immutable.
+type ProvisionedToken struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Subject     string    `json:"subject"`
+	Namespaces  []string  `json:"namespaces"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	// Exp is the duration of a new token such as 30d, empty does not expire
+	Exp string `json:"exp,omitempty"`
+	// Key is only returned when the token is created
+	Key string `json:"key,omitempty"`
+}
+
+func recordProvision(subject, tenant, action, resource string, err error) {
+	e := audit.Event{Subject: subject, Tenant: tenant, Action: action, Resource: resource, Outcome: audit.Succeeded}
+	if err != nil {
+		e.Outcome, e.Reason = audit.Failed, err.Error()
+	}
+	audit.Record(e)
+}
+
+// GetProvisionedTenant returns the tenant, or nil if it does not exist
+func GetProvisionedTenant(name string) (*ProvisionedTenant, error) {
+	var info tenantInfo
+	status, err := adminGetJSON("tenants/"+name, &info)
+	if status == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, upstreamError(status, err)
+	}
+	t := ProvisionedTenant{ID: name, AdminRoles: sortedCopy(info.AdminRoles), AllowedClusters: sortedCopy(info.AllowedClusters)}
+	if policy.OverridesStore != nil {
+		if plan, err := policy.TenantManager.GetTenant(name); err == nil {
+			t.Plan, t.Org = plan.PlanType, plan.Org
+		}
+	}
+	if o, ok := util.GetTenantOverrides(name); ok {
+		settings := o.Settings
+		t.Settings = &settings
+	}
+	return &t, nil
+}
+
+// PutProvisionedTenant creates the tenant, or updates the current tenant to the desired one
+func PutProvisionedTenant(name string, desired ProvisionedTenant, current *ProvisionedTenant, subject string) (*ProvisionedTenant, error) {
+	if err := (Manifest{Tenants: []TenantSpec{{Name: name, Settings: desired.Settings}}}).Validate(); err != nil {
+		return nil, &ProvisionError{StatusCode: http.StatusUnprocessableEntity, Err: err}
+	}
+	if (desired.Plan != "" || desired.Settings != nil || (current != nil && current.Settings != nil)) && policy.OverridesStore == nil {
+		return nil, provisionError(http.StatusServiceUnavailable, "policy store is not initialized")
+	}
+	info := tenantInfo{AdminRoles: sortedCopy(desired.AdminRoles), AllowedClusters: sortedCopy(desired.AllowedClusters)}
+	if len(info.AllowedClusters) == 0 {
+		info.AllowedClusters = []string{util.GetConfig().ClusterName}
+	}
+	action, resource, changed := "provision.update", "tenant/"+name, true
+	if current == nil {
+		action = "provision.create"
+		if status, err := adminDo(http.MethodPut, "tenants/"+name, info); err != nil {
+			recordProvision(subject, name, action, resource, err)
+			return nil, upstreamError(status, err)
+		}
+	} else if !reflect.DeepEqual(info.AdminRoles, current.AdminRoles) || !reflect.DeepEqual(info.AllowedClusters, current.AllowedClusters) {
+		if status, err := adminDo(http.MethodPost, "tenants/"+name, info); err != nil {
+			recordProvision(subject, name, action, resource, err)
+			return nil, upstreamError(status, err)
+		}
+	} else {
+		changed = false
+	}
+	if desired.Plan != "" && (current == nil || current.Plan != desired.Plan || current.Org != desired.Org) {
+		changed = true
+		plan := policy.TenantPlan{PlanType: desired.Plan, Org: desired.Org, Audit: "provisioned by " + subject}
+		if _, status, err := policy.TenantManager.UpdateTenant(name, plan); err != nil {
+			recordProvision(subject, name, action, resource, err)
+			return nil, &ProvisionError{StatusCode: status, Err: err}
+		}
+	}
+	if desired.Settings != nil && (current == nil || current.Settings == nil || !reflect.DeepEqual(*desired.Settings, *current.Settings)) {
+		changed = true
+		if _, err := policy.OverridesStore.PutOverrides(name, *desired.Settings); err != nil {
+			recordProvision(subject, name, action, resource, err)
+			return nil, &ProvisionError{StatusCode: http.StatusUnprocessableEntity, Err: err}
+		}
+	} else if desired.Settings == nil && current != nil && current.Settings != nil {
+		changed = true
+		if err := policy.OverridesStore.DeleteOverrides(name); err != nil {
+			recordProvision(subject, name, action, resource, err)
+			return nil, &ProvisionError{StatusCode: http.StatusInternalServerError, Err: err}
+		}
+	}
+	if changed {
+		recordProvision(subject, name, action, resource, nil)
+	}
+	return GetProvisionedTenant(name)
+}
+
+// DeleteProvisionedTenant deletes the tenant, its plan, and its overrides. A tenant with namespaces is a conflict.
+func DeleteProvisionedTenant(name, subject string) error {
+	resource := "tenant/" + name
+	if status, err := adminDo(http.MethodDelete, "tenants/"+name, nil); err != nil && status != http.StatusNotFound {
+		recordProvision(subject, name, "provision.delete", resource, err)
+		return upstreamError(status, err)
+	}
+	if policy.OverridesStore != nil {
+		policy.TenantManager.DeleteTenant(name)
+		if _, ok := util.GetTenantOverrides(name); ok {
+			if err := policy.OverridesStore.DeleteOverrides(name); err != nil {
+				recordProvision(subject, name, "provision.delete", resource, err)
+				return &ProvisionError{StatusCode: http.StatusInternalServerError, Err: err}
+			}
+		}
+	}
+	recordProvision(subject, name, "provision.delete", resource, nil)
+	return nil
+}
+
+// GetProvisionedNamespace returns the namespace, or nil if it or its tenant does not exist
+func GetProvisionedNamespace(tenant, namespace string) (*ProvisionedNamespace, error) {
+	name := tenant + "/" + namespace
+	var names []string
+	status, err := adminGetJSON("namespaces/"+tenant, &names)
+	if status == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, upstreamError(status, err)
+	}
+	if !util.StrContains(names, name) {
+		return nil, nil
+	}
+	ns := ProvisionedNamespace{ID: name, Permissions: map[string][]string{}}
+	var retention retentionPolicy
+	if status, err := adminGetJSON("namespaces/"+name+"/retention", &retention); err != nil {
+		return nil, upstreamError(status, err)
+	}
+	ns.RetentionMinutes, ns.RetentionSizeMB = retention.RetentionTimeInMinutes, retention.RetentionSizeInMB
+	if status, err := adminGetJSON("namespaces/"+name+"/messageTTL", &ns.MessageTTLSeconds); err != nil {
+		return nil, upstreamError(status, err)
+	}
+	permissions := map[string][]string{}
+	if status, err := adminGetJSON("namespaces/"+name+"/permissions", &permissions); err != nil {
+		return nil, upstreamError(status, err)
+	}
+	for role, actions := range permissions {
+		ns.Permissions[role] = sortedCopy(actions)
+	}
+	return &ns, nil
+}
+
+// PutProvisionedNamespace creates the namespace, or updates the current namespace to the desired one.
+// A missing tenant is a conflict.
+func PutProvisionedNamespace(tenant, namespace string, desired ProvisionedNamespace, current *ProvisionedNamespace, subject string) (*ProvisionedNamespace, error) {
+	name := tenant + "/" + namespace
+	spec := NamespaceSpec{Name: namespace, RetentionMinutes: desired.RetentionMinutes, RetentionSizeMB: desired.RetentionSizeMB,
+		MessageTTLSeconds: desired.MessageTTLSeconds, Permissions: desired.Permissions}
+	if err := (Manifest{Tenants: []TenantSpec{{Name: tenant, Namespaces: []NamespaceSpec{spec}}}}).Validate(); err != nil {
+		return nil, &ProvisionError{StatusCode: http.StatusUnprocessableEntity, Err: err}
+	}
+	action, resource, changed := "provision.update", "namespace/"+name, false
+	set := func(method, subroute string, body interface{}) error {
+		changed = true
+		status, err := adminDo(method, "namespaces/"+name+subroute, body)
+		if err != nil {
+			recordProvision(subject, tenant, action, resource, err)
+			return upstreamError(status, err)
+		}
+		return nil
+	}
+	if current == nil {
+		action, changed = "provision.create", true
+		if status, err := adminDo(http.MethodPut, "namespaces/"+name, nil); err != nil {
+			recordProvision(subject, tenant, action, resource, err)
+			if status == http.StatusNotFound {
+				return nil, provisionError(http.StatusConflict, "tenant %s does not exist", tenant)
+			}
+			return nil, upstreamError(status, err)
+		}
+		current = &ProvisionedNamespace{ID: name, Permissions: map[string][]string{}}
+	}
+	if desired.RetentionMinutes != current.RetentionMinutes || desired.RetentionSizeMB != current.RetentionSizeMB {
+		if err := set(http.MethodPost, "/retention", retentionPolicy{RetentionTimeInMinutes: desired.RetentionMinutes,
+			RetentionSizeInMB: desired.RetentionSizeMB}); err != nil {
+			return nil, err
+		}
+	}
+	if desired.MessageTTLSeconds != current.MessageTTLSeconds {
+		if err := set(http.MethodPost, "/messageTTL", desired.MessageTTLSeconds); err != nil {
+			return nil, err
+		}
+	}
+	for role, actions := range desired.Permissions {
+		if declared := sortedCopy(actions); !reflect.DeepEqual(declared, current.Permissions[role]) {
+			if err := set(http.MethodPost, "/permissions/"+role, declared); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for role := range current.Permissions {
+		if _, ok := desired.Permissions[role]; !ok {
+			if err := set(http.MethodDelete, "/permissions/"+role, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if changed {
+		recordProvision(subject, tenant, action, resource, nil)
+	}
+	return GetProvisionedNamespace(tenant, namespace)
+}
+
+// DeleteProvisionedNamespace deletes the namespace, a namespace with topics is a conflict
+func DeleteProvisionedNamespace(tenant, namespace, subject string) error {
+	resource := "namespace/" + tenant + "/" + namespace
+	if status, err := adminDo(http.MethodDelete, "namespaces/"+tenant+"/"+namespace, nil); err != nil && status != http.StatusNotFound {
+		recordProvision(subject, tenant, "provision.delete", resource, err)
+		return upstreamError(status, err)
+	}
+	recordProvision(subject, tenant, "provision.delete", resource, nil)
+	return nil
+}
+
+// GetProvisionedToken returns the token of the name, or nil if it does not exist
+func GetProvisionedToken(tenant, name string) *ProvisionedToken {
+	for _, key := range util.ListAPIKeys(tenant) {
+		if key.Name == name {
+			return &ProvisionedToken{ID: key.ID, Name: key.Name, Subject: key.Subject, Namespaces: sortedCopy(key.Namespaces),
+				Permissions: sortedCopy(key.Permissions), CreatedAt: key.CreatedAt, ExpiresAt: key.ExpiresAt}
+		}
+	}
+	return nil
+}
+
+// PutProvisionedToken creates the token, or returns the current token if it has the desired subject, namespaces,
+// and permissions. A token of another spec is a conflict since a token cannot be changed.
+func PutProvisionedToken(tenant, name string, desired ProvisionedToken, current *ProvisionedToken, subject string) (*ProvisionedToken, bool, error) {
+	if current != nil {
+		if current.Subject != desired.Subject || !reflect.DeepEqual(current.Namespaces, sortedCopy(desired.Namespaces)) ||
+			!reflect.DeepEqual(current.Permissions, sortedCopy(desired.Permissions)) {
+			return nil, false, provisionError(http.StatusConflict, "token %s exists with another spec, delete it to replace", name)
+		}
+		return current, false, nil
+	}
+	if desired.Subject == "" {
+		return nil, false, provisionError(http.StatusUnprocessableEntity, "token subject is missing")
+	}
+	if policy.APIKeyStore == nil {
+		return nil, false, provisionError(http.StatusServiceUnavailable, "API key store is not initialized")
+	}
+	resource := "token/" + tenant + "/" + name
+	keyStr, key, err := policy.APIKeyStore.CreateAPIKey(tenant, desired.Subject, policy.APIKeyRequest{Name: name,
+		Subject: desired.Subject, Namespaces: desired.Namespaces, Permissions: desired.Permissions, Exp: desired.Exp})
+	recordProvision(subject, tenant, "provision.create", resource, err)
+	if err != nil {
+		return nil, false, &ProvisionError{StatusCode: http.StatusUnprocessableEntity, Err: err}
+	}
+	token := GetProvisionedToken(tenant, name)
+	if token == nil {
+		return nil, false, errors.New("the created token " + key.ID + " is not found")
+	}
+	token.Key = keyStr
+	return token, true, nil
+}
+
+// DeleteProvisionedToken revokes the token
+func DeleteProvisionedToken(tenant string, token ProvisionedToken, subject string) error {
+	err := policy.APIKeyStore.RevokeAPIKey(tenant, token.ID)
+	recordProvision(subject, tenant, "provision.delete", "token/"+tenant+"/"+token.Name, err)
+	return err
+}
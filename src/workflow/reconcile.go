@@ -0,0 +1,349 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package workflow
+
+// Continuous reconciliation of the declared tenants and namespaces against the brokers and the policy store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/audit"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+)
+
+// Drift is a difference between the manifest and the cluster
+type Drift struct {
+	// Resource is such as tenant/acme, namespace/acme/orders/retention, or plan/acme
+	Resource string      `json:"resource"`
+	Declared interface{} `json:"declared"`
+	Actual   interface{} `json:"actual"`
+	Fixed    bool        `json:"fixed"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// ReconcileReport is the result of a reconciliation
+type ReconcileReport struct {
+	Time     time.Time `json:"time"`
+	DryRun   bool      `json:"dryRun"`
+	Revision string    `json:"revision,omitempty"`
+	Drifts   []Drift   `json:"drifts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	lastReconcile     ReconcileReport
+	lastReconcileLock sync.RWMutex
+)
+
+type tenantInfo struct {
+	AdminRoles      []string `json:"adminRoles"`
+	AllowedClusters []string `json:"allowedClusters"`
+}
+
+type retentionPolicy struct {
+	RetentionTimeInMinutes int `json:"retentionTimeInMinutes"`
+	RetentionSizeInMB      int `json:"retentionSizeInMB"`
+}
+
+// StartReconciliation reconciles the bootstrap manifest on the interval, only the leader reconciles when the
+// leader election is enabled
+func StartReconciliation() {
+	cfg := util.GetConfig().Reconciliation
+	path := util.GetConfig().BootstrapManifest
+	if util.GetConfig().GitOps.Repository != "" {
+		path = util.GetConfig().GitOps.Repository
+	}
+	if path == "" || cfg.IntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	log.Infof("reconcile manifest %s at interval %v dry run %v", path, interval, cfg.DryRun)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if util.IsLeader() {
+				RunReconciliation(util.GetConfig().Reconciliation.DryRun)
+			}
+		}
+	}()
+}
+
+// RunReconciliation reconciles the configured manifest and keeps the report. The manifest comes from the last
+// GitOps checkout when GitOps is configured.
+func RunReconciliation(dryRun bool) ReconcileReport {
+	path := util.GetConfig().BootstrapManifest
+	var m Manifest
+	var err error
+	if repository := util.GetConfig().GitOps.Repository; repository != "" {
+		path = repository
+		m, err = checkedOutManifest()
+	} else {
+		m, err = LoadManifest(path)
+	}
+	var report ReconcileReport
+	if err != nil {
+		report = ReconcileReport{Time: time.Now(), DryRun: dryRun, Drifts: []Drift{}, Error: err.Error()}
+	} else {
+		report = Reconcile(m, dryRun)
+	}
+	keepReconcileReport(path, report)
+	return report
+}
+
+func keepReconcileReport(path string, report ReconcileReport) {
+	dryRun := report.DryRun
+	if report.Error != "" {
+		log.Errorf("reconcile manifest %s error %s", path, report.Error)
+	} else if len(report.Drifts) > 0 {
+		log.Warnf("reconcile manifest %s found %d drifts dry run %v", path, len(report.Drifts), dryRun)
+	}
+	lastReconcileLock.Lock()
+	lastReconcile = report
+	lastReconcileLock.Unlock()
+}
+
+// LastReconcileReport returns the report of the last reconciliation
+func LastReconcileReport() ReconcileReport {
+	lastReconcileLock.RLock()
+	defer lastReconcileLock.RUnlock()
+	return lastReconcile
+}
+
+// Reconcile diffs the declared tenants and namespaces against the brokers and the policy store, and fixes the
+// drifts unless dry run. Every drift is audited with the revision of the manifest. The undeclared resources and
+// settings are left as they are.
+func Reconcile(m Manifest, dryRun bool) ReconcileReport {
+	report, drift := newReconciler(m.Revision, dryRun)
+	reconcileTenants(m, report, drift)
+	return *report
+}
+
+// newReconciler returns an empty report and the drift func that fixes and audits a drift into the report
+func newReconciler(revision string, dryRun bool) (*ReconcileReport, driftFunc) {
+	report := &ReconcileReport{Time: time.Now(), DryRun: dryRun, Revision: revision, Drifts: []Drift{}}
+	if revision != "" {
+		revision = "revision " + revision
+	}
+	drift := func(resource string, declared, actual interface{}, fix func() error) {
+		d := Drift{Resource: resource, Declared: declared, Actual: actual}
+		e := audit.Event{Subject: bootstrapSubject, Tenant: tenantOfResource(resource), Action: "reconcile.drift",
+			Resource: resource, Outcome: audit.Succeeded, Reason: strings.TrimSpace("dry run " + revision)}
+		if !dryRun {
+			e.Action, e.Reason = "reconcile.fix", revision
+			if err := fix(); err != nil {
+				d.Error = err.Error()
+				e.Outcome, e.Reason = audit.Failed, strings.TrimSpace(err.Error()+" "+revision)
+			} else {
+				d.Fixed = true
+			}
+		}
+		audit.Record(e)
+		report.Drifts = append(report.Drifts, d)
+	}
+	return report, drift
+}
+
+func reconcileTenants(m Manifest, report *ReconcileReport, drift driftFunc) {
+	dryRun := report.DryRun
+	tenants, err := policy.AdminAPIGETRespStringArray("tenants")
+	if err != nil {
+		report.Error = err.Error()
+		return
+	}
+	for _, t := range m.Tenants {
+		t := t
+		if !util.StrContains(tenants, t.Name) {
+			drift("tenant/"+t.Name, "present", "missing", func() error { return createTenant(t) })
+			if dryRun {
+				// the namespaces of a missing tenant are missing too
+				for _, ns := range t.Namespaces {
+					drift("namespace/"+t.Name+"/"+ns.Name, "present", "missing", nil)
+				}
+			} else if err := reconcileNamespaces(t, drift); err != nil {
+				report.Error = err.Error()
+			}
+			reconcileTenantPolicy(t, drift)
+			continue
+		}
+		if err := reconcileTenantInfo(t, drift); err != nil {
+			report.Error = err.Error()
+		}
+		if err := reconcileNamespaces(t, drift); err != nil {
+			report.Error = err.Error()
+		}
+		reconcileTenantPolicy(t, drift)
+	}
+}
+
+type driftFunc func(resource string, declared, actual interface{}, fix func() error)
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
+
+func reconcileTenantInfo(t TenantSpec, drift driftFunc) error {
+	var actual tenantInfo
+	if _, err := adminGetJSON("tenants/"+t.Name, &actual); err != nil {
+		return err
+	}
+	declared := tenantInfo{AdminRoles: sortedCopy(t.AdminRoles), AllowedClusters: sortedCopy(t.AllowedClusters)}
+	if len(declared.AllowedClusters) == 0 {
+		declared.AllowedClusters = []string{util.GetConfig().ClusterName}
+	}
+	actual.AdminRoles, actual.AllowedClusters = sortedCopy(actual.AdminRoles), sortedCopy(actual.AllowedClusters)
+	if !reflect.DeepEqual(declared, actual) {
+		drift("tenant/"+t.Name, declared, actual, func() error {
+			return adminRequest(http.MethodPost, "tenants/"+t.Name, declared)
+		})
+	}
+	return nil
+}
+
+func reconcileNamespaces(t TenantSpec, drift driftFunc) error {
+	if len(t.Namespaces) == 0 {
+		return nil
+	}
+	namespaces, err := policy.AdminAPIGETRespStringArray("namespaces/" + t.Name)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, ns := range t.Namespaces {
+		ns, name := ns, t.Name+"/"+ns.Name
+		if !util.StrContains(namespaces, name) {
+			drift("namespace/"+name, "present", "missing", func() error { return createNamespace(name, ns) })
+			continue
+		}
+		if err := reconcileNamespacePolicies(name, ns, drift); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// reconcileNamespacePolicies compares the declared policies, and the permissions of the declared roles
+func reconcileNamespacePolicies(name string, ns NamespaceSpec, drift driftFunc) error {
+	resource := "namespace/" + name
+	if ns.RetentionMinutes != 0 || ns.RetentionSizeMB != 0 {
+		var actual retentionPolicy
+		if _, err := adminGetJSON("namespaces/"+name+"/retention", &actual); err != nil {
+			return err
+		}
+		declared := retentionPolicy{RetentionTimeInMinutes: ns.RetentionMinutes, RetentionSizeInMB: ns.RetentionSizeMB}
+		if declared != actual {
+			drift(resource+"/retention", declared, actual, func() error {
+				return adminRequest(http.MethodPost, "namespaces/"+name+"/retention", declared)
+			})
+		}
+	}
+	if ns.MessageTTLSeconds != 0 {
+		var actual int
+		if _, err := adminGetJSON("namespaces/"+name+"/messageTTL", &actual); err != nil {
+			return err
+		}
+		if actual != ns.MessageTTLSeconds {
+			drift(resource+"/messageTTL", ns.MessageTTLSeconds, actual, func() error {
+				return adminRequest(http.MethodPost, "namespaces/"+name+"/messageTTL", ns.MessageTTLSeconds)
+			})
+		}
+	}
+	if len(ns.Permissions) > 0 {
+		actual := map[string][]string{}
+		if _, err := adminGetJSON("namespaces/"+name+"/permissions", &actual); err != nil {
+			return err
+		}
+		for role, actions := range ns.Permissions {
+			role, declared := role, sortedCopy(actions)
+			if current := sortedCopy(actual[role]); !reflect.DeepEqual(declared, current) {
+				drift(resource+"/permissions/"+role, declared, current, func() error {
+					return adminRequest(http.MethodPost, "namespaces/"+name+"/permissions/"+role, declared)
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileTenantPolicy compares the plan type and the settings overrides in the policy store
+func reconcileTenantPolicy(t TenantSpec, drift driftFunc) {
+	if (t.Plan == "" && t.Settings == nil) || policy.OverridesStore == nil {
+		return
+	}
+	if t.Plan != "" {
+		plan, err := policy.TenantManager.GetTenant(t.Name)
+		if actual := plan.PlanType; err != nil || actual != t.Plan {
+			drift("plan/"+t.Name, t.Plan, actual, func() error {
+				_, _, err := policy.TenantManager.UpdateTenant(t.Name, policy.TenantPlan{PlanType: t.Plan, Org: t.Org, Audit: "reconciled"})
+				return err
+			})
+		}
+	}
+	if t.Settings != nil {
+		overrides, _ := util.GetTenantOverrides(t.Name)
+		if !reflect.DeepEqual(*t.Settings, overrides.Settings) {
+			drift("settings/"+t.Name, *t.Settings, overrides.Settings, func() error {
+				_, err := policy.OverridesStore.PutOverrides(t.Name, *t.Settings)
+				return err
+			})
+		}
+	}
+}
+
+// adminGetJSON gets a json object from the admin REST API of the default cluster with the super role token,
+// an empty body leaves the object as it is
+func adminGetJSON(subroute string, v interface{}) (int, error) {
+	requestURL := util.SingleJoinSlash(util.SingleJoinSlash(util.DefaultAdminURL(), "/admin/v2"), subroute)
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("X-Proxy", "burnell")
+	req.Header.Add("Authorization", "Bearer "+util.PulsarToken())
+	resp, err := util.UpstreamClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return resp.StatusCode, fmt.Errorf("GET %s returns status code %d", subroute, resp.StatusCode)
+	}
+	if len(body) == 0 || string(body) == "null" {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(body, v)
+}